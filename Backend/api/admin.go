@@ -0,0 +1,94 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/models"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+type userTypeRequest struct {
+	Type string `json:"type"`
+}
+
+type auditResponse struct {
+	Entries  []models.AuditEntry `json:"entries"`
+	Bookmark string              `json:"bookmark,omitempty"`
+}
+
+// @info GET /api/v1/roles. Lets the frontend know what each user type may do.
+func (s *Server) hdnl_roles(ectx echo.Context) error {
+	return ectx.JSON(http.StatusOK, auth.RolePermissions())
+}
+
+// @info PUT /api/v1/admin/users/:id/type. The new role applies from the next request, see requireAuth, and the user's
+// sessions are revoked so the user logs in again with it.
+func (s *Server) hdnl_set_user_type(ectx echo.Context) error {
+	req := userTypeRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	actor := CurrentUser(ectx)
+	if id == actor.UserID() {
+		return echo.NewHTTPError(http.StatusForbidden, "You can't change your own type")
+	}
+	if !models.IsUserType(req.Type) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown user type")
+	}
+	previous, err := models.SetUserType(s.Client, id, req.Type)
+	if err != nil {
+		return err
+	}
+	// @info Audited with the type replaced by this very write, once it is done, so it records what happened
+	if previous != req.Type {
+		if err := s.audit(ectx, models.AuditUserTypeChanged, id, previous, req.Type); err != nil {
+			return err
+		}
+		if err := s.Tokens.RevokeUserSessions(id); err != nil {
+			return err
+		}
+	}
+	usr, err := models.GetUser(s.Client, id)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, usr.Profile())
+}
+
+// @info GET /api/v1/admin/audit?target_id=&action=&limit=&bookmark=
+func (s *Server) hdnl_list_audit(ectx echo.Context) error {
+	limit := parseLimit(ectx.QueryParam("limit"))
+	entries, bookmark, err := models.ListAudit(s.Client, ectx.QueryParam("target_id"), ectx.QueryParam("action"), limit, ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, auditResponse{Entries: entries, Bookmark: bookmark})
+}
+
+// @info Records an audit entry of a change made by the authenticated user
+func (s *Server) audit(ectx echo.Context, action string, targetID string, before interface{}, after interface{}) error {
+	entry := &models.AuditEntry{
+		Action:    action,
+		ActorID:   CurrentUser(ectx).UserID(),
+		TargetID:  targetID,
+		Before:    before,
+		After:     after,
+		RequestID: ectx.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	return models.RecordAudit(s.Client, entry)
+}
+
+// @info Page size from the query string, 25 by default and never more than 200
+func parseLimit(raw string) uint64 {
+	limit, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || limit == 0 {
+		return 25
+	}
+	if limit > 200 {
+		return 200
+	}
+	return limit
+}
@@ -0,0 +1,49 @@
+package api_test
+
+import (
+	"3DQuest/models"
+	"net/http"
+	"testing"
+)
+
+func TestSetUserTypeAudit(t *testing.T) {
+	s, client := newServer(t)
+	admin, adminToken := newSession(t, s, "admin")
+	customer, _ := newSession(t, s, "user")
+
+	cases := []struct {
+		name   string
+		id     string
+		body   string
+		status int
+		audits int // Entries of the target after the call
+	}{
+		{"missing user", "nobody", `{"type":"operator"}`, http.StatusNotFound, 0},
+		{"unknown type", customer.ID, `{"type":"wizard"}`, http.StatusBadRequest, 0},
+		{"own type", admin.ID, `{"type":"user"}`, http.StatusForbidden, 0},
+		{"promotion", customer.ID, `{"type":"operator"}`, http.StatusOK, 1},
+		{"same type again", customer.ID, `{"type":"operator"}`, http.StatusOK, 1},
+		{"demotion", customer.ID, `{"type":"academic"}`, http.StatusOK, 2},
+	}
+	for _, c := range cases {
+		if rec := call(s, http.MethodPut, "/admin/users/"+c.id+"/type", adminToken, c.body); rec.Code != c.status {
+			t.Errorf("%s: %d, want %d: %s", c.name, rec.Code, c.status, rec.Body)
+		}
+		entries, _, err := models.ListAudit(client, c.id, models.AuditUserTypeChanged, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != c.audits {
+			t.Errorf("%s: %d audit entries, want %d", c.name, len(entries), c.audits)
+		}
+	}
+	entries, _, _ := models.ListAudit(client, customer.ID, models.AuditUserTypeChanged, 0, "")
+	for _, entry := range entries {
+		if entry.ActorID != admin.ID {
+			t.Errorf("entry by %s, want %s", entry.ActorID, admin.ID)
+		}
+	}
+	if last := entries[0]; last.Before != "operator" || last.After != "academic" {
+		t.Errorf("last entry from %v to %v, want operator to academic", last.Before, last.After)
+	}
+}
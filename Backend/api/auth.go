@@ -0,0 +1,158 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/models"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type registerRequest struct {
+	Name     string `json:"name"`
+	EMAIL    string `json:"email"`
+	Password string `json:"password"`
+	NIF      string `json:"nif"`
+}
+
+type loginRequest struct {
+	EMAIL    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type sessionResponse struct {
+	User models.UserProfile `json:"user"`
+	*auth.Session
+}
+
+// @info POST /api/v1/auth/register. New accounts are always basic users, only admins can change the type.
+// A Cart-Token header moves the cart of the visitor into the new account.
+func (s *Server) hdnl_register(ectx echo.Context) error {
+	req := registerRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	if err := auth.CheckPasswordStrength(req.Password); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	usr := &models.User{Type: "user", Name: req.Name, NIF: req.NIF, EMAIL: req.EMAIL, PSWD_HASH: hash}
+	if err := models.CreateUser(s.Client, usr); err != nil {
+		return err
+	}
+	session, err := s.Tokens.NewSession(usr)
+	if err != nil {
+		return err
+	}
+	s.mergeCart(ectx, usr.ID)
+	return ectx.JSON(http.StatusCreated, sessionResponse{User: usr.Profile(), Session: session})
+}
+
+// @info POST /api/v1/auth/login. A Cart-Token header moves the cart of the visitor into the account.
+func (s *Server) hdnl_login(ectx echo.Context) error {
+	req := loginRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	session, usr, err := s.Tokens.Login(req.EMAIL, req.Password)
+	if errors.Is(err, auth.ErrInvalidCredentials) {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	s.mergeCart(ectx, usr.ID)
+	return ectx.JSON(http.StatusOK, sessionResponse{User: usr.Profile(), Session: session})
+}
+
+// @info POST /api/v1/auth/refresh. The refresh token sent is consumed, the response holds its replacement.
+func (s *Server) hdnl_refresh(ectx echo.Context) error {
+	req := refreshRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	session, usr, err := s.Tokens.Refresh(req.RefreshToken)
+	if errors.Is(err, auth.ErrInvalidToken) {
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, sessionResponse{User: usr.Profile(), Session: session})
+}
+
+// @info POST /api/v1/auth/logout. Access tokens already issued stay valid until they expire.
+func (s *Server) hdnl_logout(ectx echo.Context) error {
+	req := refreshRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	if err := s.Tokens.Logout(req.RefreshToken); err != nil {
+		return err
+	}
+	return ectx.NoContent(http.StatusNoContent)
+}
+
+// @info GET /api/v1/auth/me
+func (s *Server) hdnl_me(ectx echo.Context) error {
+	usr, err := models.GetCachedUser(s.Client, CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	if usr.IsDeleted() {
+		return echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	return ectx.JSON(http.StatusOK, usr.Profile())
+}
+
+// @info PATCH /api/v1/auth/me. Only the fields sent are changed.
+func (s *Server) hdnl_update_me(ectx echo.Context) error {
+	update := models.ProfileUpdate{}
+	if err := ectx.Bind(&update); err != nil {
+		return err
+	}
+	usr, err := models.UpdateUserProfile(s.Client, CurrentUser(ectx).UserID(), &update)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, usr.Profile())
+}
+
+// @info DELETE /api/v1/auth/me. Deletes the account of the authenticated user and closes all its sessions.
+func (s *Server) hdnl_delete_me(ectx echo.Context) error {
+	id := CurrentUser(ectx).UserID()
+	if err := s.deleteUser(ectx, id); err != nil {
+		return err
+	}
+	return ectx.NoContent(http.StatusNoContent)
+}
+
+// @info PUT /api/v1/auth/me/billing
+func (s *Server) hdnl_set_my_billing(ectx echo.Context) error {
+	billing := &models.BillingProfile{}
+	if err := ectx.Bind(billing); err != nil {
+		return err
+	}
+	usr, err := models.SetBillingProfile(s.Client, CurrentUser(ectx).UserID(), billing)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, usr.Profile())
+}
+
+// @info DELETE /api/v1/auth/me/billing. Invoices go back to using the name and NIF of the user.
+func (s *Server) hdnl_delete_my_billing(ectx echo.Context) error {
+	usr, err := models.SetBillingProfile(s.Client, CurrentUser(ectx).UserID(), nil)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, usr.Profile())
+}
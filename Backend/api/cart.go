@@ -0,0 +1,321 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/models"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// @info Header identifying the cart of a visitor who has not logged in. Told by the API when the visitor first adds an
+// item, and sent again on login or registration to move the cart into the account.
+const headerCartToken = "Cart-Token"
+
+type cartItemRequest struct {
+	Kind      models.CartItemKind `json:"kind"`
+	ProductID string              `json:"product_id"`
+	SKU       string              `json:"sku"`
+	OrderID   string              `json:"order_id"`
+	Quantity  int                 `json:"quantity"`
+}
+
+type quantityRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+type couponRequest struct {
+	Code string `json:"code"`
+}
+
+type confirmCheckoutRequest struct {
+	Reference string `json:"reference"`
+}
+
+type cancelCheckoutRequest struct {
+	Note string `json:"note"`
+}
+
+// @info A priced cart, with the token of the cart for visitors who just got one
+type cartResponse struct {
+	*models.PricedCart
+	CartToken string `json:"cart_token,omitempty"`
+}
+
+type checkoutsResponse struct {
+	Checkouts []models.Checkout `json:"checkouts"`
+	Bookmark  string            `json:"bookmark,omitempty"`
+}
+
+// @info Like requireAuth, but lets requests without an Authorization header through as visitors. A header with an
+// invalid token is still rejected, so expired sessions are not silently treated as visitors.
+func (s *Server) optionalAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ectx echo.Context) error {
+		if ectx.Request().Header.Get(echo.HeaderAuthorization) == "" {
+			return next(ectx)
+		}
+		return s.requireAuth(next)(ectx)
+	}
+}
+
+// @info The cart of the request: the customer's one, or the visitor's one from the Cart-Token header. Visitors without
+// a token get a new one when create is true, empty IDs otherwise.
+func (s *Server) currentCart(ectx echo.Context, create bool) (cartID string, userID string, token string, err error) {
+	if claims := CurrentUser(ectx); claims != nil {
+		return models.UserCartID(claims.UserID()), claims.UserID(), "", nil
+	}
+	if token = ectx.Request().Header.Get(headerCartToken); token != "" {
+		return models.AnonymousCartID(token), "", "", nil
+	}
+	if !create {
+		return "", "", "", nil
+	}
+	if token, err = models.NewCartToken(); err != nil {
+		return "", "", "", err
+	}
+	ectx.Response().Header().Set(headerCartToken, token)
+	return models.AnonymousCartID(token), "", token, nil
+}
+
+func (s *Server) cartJSON(ectx echo.Context, cart *models.Cart, token string) error {
+	priced, err := models.PriceCart(s.Client, cart)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, cartResponse{PricedCart: priced, CartToken: token})
+}
+
+// @info Moves the cart of the visitor, if the request has one, into the account they just logged in to. A cart that
+// can't be moved is only logged, it must not stop the login.
+func (s *Server) mergeCart(ectx echo.Context, userID string) {
+	token := ectx.Request().Header.Get(headerCartToken)
+	if token == "" {
+		return
+	}
+	if _, err := models.MergeCarts(s.Client, &s.Config.Store, token, userID); err != nil {
+		ectx.Logger().Warn("couldn't merge the cart of the visitor: ", err)
+	}
+}
+
+// @info Maps the errors of a checkout to their status codes
+func checkoutError(err error) error {
+	switch {
+	case errors.Is(err, models.ErrEmptyCart):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case errors.Is(err, models.ErrOutOfStock), errors.Is(err, models.ErrPriceChanged), errors.Is(err, models.ErrCheckoutClosed):
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	return creditsError(err)
+}
+
+// @info GET /api/v1/cart. The cart priced as it would be paid now. Visitors without a Cart-Token get an empty cart.
+func (s *Server) hdnl_get_cart(ectx echo.Context) error {
+	cartID, userID, _, err := s.currentCart(ectx, false)
+	if err != nil {
+		return err
+	}
+	if cartID == "" {
+		return s.cartJSON(ectx, &models.Cart{Type: models.CartDocType, Items: []models.CartItem{}}, "")
+	}
+	cart, err := models.GetCart(s.Client, cartID, userID)
+	if err != nil {
+		return err
+	}
+	return s.cartJSON(ectx, cart, "")
+}
+
+// @info POST /api/v1/cart/items {"kind": "product", "product_id", "sku", "quantity"} or {"kind": "print", "order_id"}.
+// Visitors without a Cart-Token get one in the response, in the header of the same name and in "cart_token".
+func (s *Server) hdnl_add_cart_item(ectx echo.Context) error {
+	req := cartItemRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	cartID, userID, token, err := s.currentCart(ectx, true)
+	if err != nil {
+		return err
+	}
+	item := models.CartItem{Kind: req.Kind, ProductID: req.ProductID, SKU: req.SKU, OrderID: req.OrderID, Quantity: req.Quantity}
+	if item.Kind == "" {
+		item.Kind = models.CartProduct
+	}
+	cart, err := models.AddCartItem(s.Client, &s.Config.Store, cartID, userID, item)
+	if err != nil {
+		return checkoutError(err)
+	}
+	return s.cartJSON(ectx, cart, token)
+}
+
+// @info PUT /api/v1/cart/items/:index {"quantity": 2}. The index counts from 0, zero units remove the line.
+func (s *Server) hdnl_set_cart_item(ectx echo.Context) error {
+	req := quantityRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	return s.setCartItem(ectx, req.Quantity)
+}
+
+// @info DELETE /api/v1/cart/items/:index
+func (s *Server) hdnl_remove_cart_item(ectx echo.Context) error {
+	return s.setCartItem(ectx, 0)
+}
+
+func (s *Server) setCartItem(ectx echo.Context, quantity int) error {
+	index, err := strconv.Atoi(ectx.Param("index"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "The item index must be a number")
+	}
+	cartID, userID, _, err := s.currentCart(ectx, false)
+	if err != nil {
+		return err
+	}
+	if cartID == "" {
+		return echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	cart, err := models.SetCartItemQuantity(s.Client, &s.Config.Store, cartID, userID, index, quantity)
+	if err != nil {
+		return checkoutError(err)
+	}
+	return s.cartJSON(ectx, cart, "")
+}
+
+// @info PUT /api/v1/cart/coupon {"code": "SUMMER10"}
+func (s *Server) hdnl_set_cart_coupon(ectx echo.Context) error {
+	req := couponRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	if req.Code == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "A coupon code is required")
+	}
+	return s.setCartCoupon(ectx, req.Code)
+}
+
+// @info DELETE /api/v1/cart/coupon
+func (s *Server) hdnl_remove_cart_coupon(ectx echo.Context) error {
+	return s.setCartCoupon(ectx, "")
+}
+
+func (s *Server) setCartCoupon(ectx echo.Context, code string) error {
+	cartID, userID, token, err := s.currentCart(ectx, code != "")
+	if err != nil {
+		return err
+	}
+	if cartID == "" {
+		return echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	cart, err := models.SetCartCoupon(s.Client, &s.Config.Store, cartID, userID, code)
+	if err != nil {
+		return err
+	}
+	return s.cartJSON(ectx, cart, token)
+}
+
+// @info POST /api/v1/cart/checkout {"payment_method": "credits", "expected_total_cents": 2500}. Pays for the cart of
+// the authenticated customer. Retries with the same Idempotency-Key header answer the checkout already made.
+func (s *Server) hdnl_checkout(ectx echo.Context) error {
+	req := &models.CheckoutRequest{}
+	if err := ectx.Bind(req); err != nil {
+		return err
+	}
+	req.IdempotencyKey = ectx.Request().Header.Get(headerIdempotencyKey)
+	checkout, err := models.PayCart(s.Client, &s.Config.Store, CurrentUser(ectx).UserID(), req)
+	if err != nil {
+		return checkoutError(err)
+	}
+	if checkout.Status == models.CheckoutPaid && len(checkout.OrderIDs) > 0 {
+		s.replan(ectx) // @info Its print orders were accepted
+	}
+	return ectx.JSON(http.StatusCreated, checkout)
+}
+
+// @info Loads the checkout if the authenticated user may see it. Other customers' checkouts are reported as not found.
+func (s *Server) loadCheckout(ectx echo.Context) (*models.Checkout, error) {
+	checkout, err := models.GetCheckout(s.Client, ectx.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	claims := CurrentUser(ectx)
+	if !claims.Can(auth.PermManageOrders) && checkout.CustomerID != claims.UserID() {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	return checkout, nil
+}
+
+// @info GET /api/v1/checkouts?status=&customer_id=&limit=&bookmark=. Customers only get their own checkouts.
+func (s *Server) hdnl_list_checkouts(ectx echo.Context) error {
+	filter := &models.CheckoutFilter{CustomerID: ectx.QueryParam("customer_id"), Status: models.CheckoutStatus(ectx.QueryParam("status"))}
+	if filter.Status != "" && !models.IsCheckoutStatus(filter.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown checkout status")
+	}
+	claims := CurrentUser(ectx)
+	if !claims.Can(auth.PermManageOrders) {
+		filter.CustomerID = claims.UserID()
+	}
+	checkouts, bookmark, err := models.ListCheckouts(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, checkoutsResponse{Checkouts: checkouts, Bookmark: bookmark})
+}
+
+// @info GET /api/v1/checkouts/:id
+func (s *Server) hdnl_get_checkout(ectx echo.Context) error {
+	checkout, err := s.loadCheckout(ectx)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, checkout)
+}
+
+// @info POST /api/v1/checkouts/:id/cancel {"note": "..."}. Only checkouts awaiting payment, their stock, coupon and
+// print orders are given back.
+func (s *Server) hdnl_cancel_checkout(ectx echo.Context) error {
+	req := cancelCheckoutRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	before, err := s.loadCheckout(ectx)
+	if err != nil {
+		return err
+	}
+	checkout, err := models.CancelCheckout(s.Client, before.ID, req.Note)
+	if err != nil {
+		return checkoutError(err)
+	}
+	if err := s.audit(ectx, models.AuditCheckoutCancelled, checkout.ID, before, checkout); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, checkout)
+}
+
+// @info POST /api/v1/checkouts/:id/confirm {"reference": "..."}. Records that a checkout was paid outside the backend
+// and accepts its print orders.
+func (s *Server) hdnl_confirm_checkout(ectx echo.Context) error {
+	req := confirmCheckoutRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	if req.Reference == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "The reference of the payment is required")
+	}
+	before, err := models.GetCheckout(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	checkout, err := models.ConfirmCheckout(s.Client, before.ID, req.Reference)
+	if err != nil {
+		return checkoutError(err)
+	}
+	if before.Status != checkout.Status {
+		if err := s.audit(ectx, models.AuditCheckoutConfirmed, checkout.ID, before, checkout); err != nil {
+			return err
+		}
+		if len(checkout.OrderIDs) > 0 {
+			s.replan(ectx)
+		}
+	}
+	return ectx.JSON(http.StatusOK, checkout)
+}
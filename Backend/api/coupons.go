@@ -0,0 +1,65 @@
+package api
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type couponsResponse struct {
+	Coupons []models.Coupon `json:"coupons"`
+}
+
+// @info GET /api/v1/admin/coupons
+func (s *Server) hdnl_list_coupons(ectx echo.Context) error {
+	coupons, err := models.ListCoupons(s.Client)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, couponsResponse{Coupons: coupons})
+}
+
+// @info GET /api/v1/admin/coupons/:code
+func (s *Server) hdnl_get_coupon(ectx echo.Context) error {
+	coupon, err := models.GetCoupon(s.Client, ectx.Param("code"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, coupon)
+}
+
+// @info PUT /api/v1/admin/coupons/:code. Creates or replaces the coupon or promotion, its uses are kept.
+func (s *Server) hdnl_set_coupon(ectx echo.Context) error {
+	coupon := &models.Coupon{}
+	if err := ectx.Bind(coupon); err != nil {
+		return err
+	}
+	coupon.Code, coupon.Rev, coupon.UpdatedBy = ectx.Param("code"), "", CurrentUser(ectx).UserID()
+	var before *models.Coupon
+	if current, err := models.GetCoupon(s.Client, coupon.Code); err == nil {
+		before = current
+	} else if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	if err := models.SetCoupon(s.Client, coupon); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditCouponSet, coupon.ID, before, coupon); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, coupon)
+}
+
+// @info DELETE /api/v1/admin/coupons/:code. Only coupons never used, the rest can be deactivated.
+func (s *Server) hdnl_delete_coupon(ectx echo.Context) error {
+	coupon, err := models.DeleteCoupon(s.Client, ectx.Param("code"))
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditCouponDeleted, coupon.ID, coupon, nil); err != nil {
+		return err
+	}
+	return ectx.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"3DQuest/models"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// @info Header clients set to make a POST safe to retry, see models.CreditRequest
+const headerIdempotencyKey = "Idempotency-Key"
+
+type balanceResponse struct {
+	UserID       string `json:"user_id"`
+	BalanceCents int64  `json:"balance_cents"`
+}
+
+type statementResponse struct {
+	Transactions []models.CreditTransaction `json:"transactions"`
+	Bookmark     string                     `json:"bookmark,omitempty"`
+}
+
+// @info GET /api/v1/auth/me/credits
+func (s *Server) hdnl_my_credits(ectx echo.Context) error {
+	return s.creditBalance(ectx, CurrentUser(ectx).UserID())
+}
+
+// @info GET /api/v1/auth/me/credits/transactions?limit=&bookmark=
+func (s *Server) hdnl_my_statement(ectx echo.Context) error {
+	return s.creditStatement(ectx, CurrentUser(ectx).UserID())
+}
+
+// @info GET /api/v1/admin/users/:id/credits
+func (s *Server) hdnl_user_credits(ectx echo.Context) error {
+	if _, err := models.GetUser(s.Client, ectx.Param("id")); err != nil {
+		return err
+	}
+	return s.creditBalance(ectx, ectx.Param("id"))
+}
+
+// @info GET /api/v1/admin/users/:id/credits/transactions?limit=&bookmark=
+func (s *Server) hdnl_user_statement(ectx echo.Context) error {
+	return s.creditStatement(ectx, ectx.Param("id"))
+}
+
+// @info POST /api/v1/admin/users/:id/credits/transactions. Order charges can't be posted by hand, they come from orders.
+func (s *Server) hdnl_post_credits(ectx echo.Context) error {
+	req := &models.CreditRequest{}
+	if err := ectx.Bind(req); err != nil {
+		return err
+	}
+	if req.Kind == models.CreditOrderCharge {
+		return echo.NewHTTPError(http.StatusBadRequest, "Order charges are posted by the orders themselves")
+	}
+	req.UserID = ectx.Param("id")
+	req.ActorID = CurrentUser(ectx).UserID()
+	req.IdempotencyKey = ectx.Request().Header.Get(headerIdempotencyKey)
+	txn, err := models.PostCreditTransaction(s.Client, req)
+	if err != nil {
+		return creditsError(err)
+	}
+	if err := s.audit(ectx, "credits."+string(txn.Kind), req.UserID, nil, txn.ID); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, txn)
+}
+
+// @info GET /api/v1/admin/credits/accounts. Balance of every account of the ledger, users and system accounts.
+func (s *Server) hdnl_credit_accounts(ectx echo.Context) error {
+	balances, err := models.ListAccountBalances(s.Client)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, balances)
+}
+
+func (s *Server) creditBalance(ectx echo.Context, userID string) error {
+	balance, err := models.GetCreditBalance(s.Client, userID)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, balanceResponse{UserID: userID, BalanceCents: balance})
+}
+
+func (s *Server) creditStatement(ectx echo.Context, userID string) error {
+	txns, bookmark, err := models.ListCreditTransactions(s.Client, userID, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, statementResponse{Transactions: txns, Bookmark: bookmark})
+}
+
+// @info Maps the errors of models.PostCreditTransaction that are the client's fault
+func creditsError(err error) error {
+	switch {
+	case errors.Is(err, models.ErrInsufficientCredits):
+		return echo.NewHTTPError(http.StatusPaymentRequired, err.Error())
+	case errors.Is(err, models.ErrIdempotencyMismatch):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, models.ErrInvalidCredits):
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return err
+}
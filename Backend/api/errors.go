@@ -0,0 +1,105 @@
+package api
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"3DQuest/payment"
+	"3DQuest/quote"
+	"3DQuest/shipping"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// @info Body of every error answered by the API
+type errorResponse struct {
+	Message   string                `json:"message"`
+	Fields    []dbdriver.FieldError `json:"fields,omitempty"` // Only for validation errors
+	RequestID string                `json:"request_id,omitempty"`
+}
+
+// @info Turns errors returned by handlers into JSON responses. Driver errors keep their meaning (404, 409, 422) and
+// anything unexpected becomes a 500 without leaking its details.
+func handleError(err error, ectx echo.Context) {
+	if ectx.Response().Committed {
+		return
+	}
+	status := http.StatusInternalServerError
+	resp := errorResponse{Message: http.StatusText(status), RequestID: ectx.Response().Header().Get(echo.HeaderXRequestID)}
+
+	var httpErr *echo.HTTPError
+	var validationErr *dbdriver.ValidationError
+	var transitionErr *models.TransitionError
+	var providerErr *payment.ProviderError
+	switch {
+	case errors.As(err, &httpErr):
+		status = httpErr.Code
+		if message, ok := httpErr.Message.(string); ok {
+			resp.Message = message
+		} else {
+			resp.Message = http.StatusText(status)
+		}
+	case errors.As(err, &validationErr):
+		status = http.StatusUnprocessableEntity
+		resp.Message = "Invalid " + validationErr.DocType
+		resp.Fields = validationErr.Fields
+	case errors.As(err, &transitionErr):
+		status = http.StatusConflict
+		resp.Message = transitionErr.Error()
+	case errors.Is(err, quote.ErrUnknownMaterial), errors.Is(err, quote.ErrUnknownExtra), errors.Is(err, quote.ErrInvalidSettings):
+		status = http.StatusUnprocessableEntity
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrEmailTaken):
+		status = http.StatusConflict
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrCategoryInUse), errors.Is(err, models.ErrProductNotDraft), errors.Is(err, models.ErrCouponUsed):
+		status = http.StatusConflict
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrNotInvoiceable):
+		status = http.StatusConflict
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrNotShippable), errors.Is(err, models.ErrShipmentClosed), errors.Is(err, models.ErrLabelExists),
+		errors.Is(err, models.ErrNoLabel), errors.Is(err, models.ErrDeliveryClosed):
+		status = http.StatusConflict
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrWrongPickupCode), errors.Is(err, shipping.ErrTooHeavy), errors.Is(err, shipping.ErrTooLarge):
+		status = http.StatusUnprocessableEntity
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrCarrier):
+		status = http.StatusBadGateway
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrInvoicingDisabled), errors.Is(err, models.ErrNoCarrier):
+		status = http.StatusServiceUnavailable
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrImageTooLarge):
+		status = http.StatusRequestEntityTooLarge
+		resp.Message = err.Error()
+	case errors.Is(err, models.ErrImageType):
+		status = http.StatusUnsupportedMediaType
+		resp.Message = err.Error()
+	case errors.As(err, &providerErr):
+		status = http.StatusBadGateway
+		resp.Message = providerErr.Error()
+	case errors.Is(err, models.ErrPrinterHost):
+		status = http.StatusBadGateway
+		resp.Message = err.Error()
+	case dbdriver.IsNotFound(err):
+		status = http.StatusNotFound
+		resp.Message = "Not found"
+	case dbdriver.IsConflict(err):
+		status = http.StatusConflict
+		resp.Message = "The resource was modified by someone else, reload it and try again"
+	default:
+		ectx.Logger().Error(err)
+	}
+
+	if ectx.Request().Method == http.MethodHead {
+		err = ectx.NoContent(status)
+	} else {
+		err = ectx.JSON(status, resp)
+	}
+	if err != nil {
+		ectx.Logger().Error(err)
+	}
+}
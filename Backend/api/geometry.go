@@ -0,0 +1,88 @@
+package api
+
+import (
+	"3DQuest/gcode"
+	"3DQuest/geometry"
+	"3DQuest/models"
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	str "strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// @info POST /api/v1/models/analyze, multipart with the model or G-code in the "file" field, and optionally the
+// "unit" of models that do not declare it (mm by default). Nothing is stored.
+func (s *Server) hdnl_analyze_model(ectx echo.Context) error {
+	upload, err := readModel(ectx)
+	if err != nil {
+		return err
+	}
+	if upload.GCode != nil {
+		return ectx.JSON(http.StatusOK, upload.GCode)
+	}
+	return ectx.JSON(http.StatusOK, upload.Model)
+}
+
+// @info File extensions of G-code, everything else is parsed as a model
+var gcodeExtensions = map[string]bool{".gcode": true, ".gco": true, ".g": true, ".gc": true}
+
+// @info Reads and analyses the model or G-code uploaded in the "file" field of a multipart request. The "unit" field
+// applies to STL and OBJ files, which do not declare theirs; 3MF files keep the one they declare.
+func readModel(ectx echo.Context) (*models.ModelUpload, error) {
+	header, err := ectx.FormFile("file")
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Missing the model file")
+	}
+	unit, err := geometry.ParseUnit(ectx.FormValue("unit"))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+	data, err := readUpload(header)
+	if err != nil {
+		return nil, err
+	}
+	upload := &models.ModelUpload{Filename: header.Filename, Data: data}
+	if gcodeExtensions[str.ToLower(filepath.Ext(header.Filename))] {
+		upload.GCode, err = gcode.Analyze(bytes.NewReader(data), nil)
+		if err != nil {
+			return nil, geometryError(err)
+		}
+		return upload, nil
+	}
+	mesh, err := geometry.Parse(data, header.Filename)
+	if err != nil {
+		return nil, geometryError(err)
+	}
+	if mesh.Unit == geometry.UnitUnknown {
+		mesh.Unit = unit
+	}
+	upload.Model = geometry.Analyze(mesh)
+	return upload, nil
+}
+
+func readUpload(header *multipart.FileHeader) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// @info Every parsing error is the fault of the uploaded file
+func geometryError(err error) error {
+	var parseErr *geometry.ParseError
+	switch {
+	case errors.As(err, &parseErr), errors.Is(err, geometry.ErrUnknownFormat), errors.Is(err, geometry.ErrNoTriangles),
+		errors.Is(err, gcode.ErrNotGCode), errors.Is(err, gcode.ErrBinary):
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, geometry.ErrTooLarge):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	}
+	return err
+}
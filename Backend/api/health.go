@@ -0,0 +1,25 @@
+package api
+
+import (
+	"3DQuest/dbdriver"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type healthResponse struct {
+	Status   string `json:"status"`
+	Database string `json:"database"`
+	CouchDB  string `json:"couchdb_version"`
+}
+
+// @info GET /api/v1/health. Answers 503 when CouchDB can't be reached so load balancers stop sending traffic.
+func (s *Server) hdnl_health(ectx echo.Context) error {
+	resp := healthResponse{Status: "ok", Database: s.Config.CouchDB.Database, CouchDB: s.Client.Version}
+	info, err := dbdriver.GetDBInfo(s.Client)
+	if err != nil || info.Name == "" {
+		resp.Status = "unavailable"
+		return ectx.JSON(http.StatusServiceUnavailable, resp)
+	}
+	return ectx.JSON(http.StatusOK, resp)
+}
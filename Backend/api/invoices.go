@@ -0,0 +1,146 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/models"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type invoiceRequest struct {
+	OrderID    string `json:"order_id"`    // An order shipped or collected
+	CheckoutID string `json:"checkout_id"` // Or the store items of a paid checkout
+}
+
+type invoicesResponse struct {
+	Invoices []models.Invoice `json:"invoices"`
+	Bookmark string           `json:"bookmark,omitempty"`
+}
+
+// @info Loads the invoice if the authenticated user may see it. Other customers' invoices are reported as not found.
+func (s *Server) loadInvoice(ectx echo.Context) (*models.Invoice, error) {
+	invoice, err := models.GetInvoice(s.Client, ectx.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	claims := CurrentUser(ectx)
+	if !claims.Can(auth.PermManageOrders) && invoice.CustomerID != claims.UserID() {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	return invoice, nil
+}
+
+// @info Issues the invoice of an order that was just completed, reporting whether it was. Orders are completed anyway
+// if it fails, the invoice can be asked for again.
+func (s *Server) invoiceCompletedOrder(ectx echo.Context, order *models.Order) bool {
+	if !s.Config.Invoice.Enabled() || (order.Status != models.OrderShipped && order.Status != models.OrderCollected) {
+		return false
+	}
+	if _, err := models.IssueInvoice(s.Client, &s.Config.Invoice, &models.InvoiceRequest{OrderID: order.ID}); err != nil {
+		ectx.Logger().Warn("couldn't invoice order ", order.ID, ": ", err)
+		return false
+	}
+	return true
+}
+
+// @info POST /api/v1/invoices {"order_id": "..."} or {"checkout_id": "..."}. Issues the invoice of an order shipped or
+// collected, or of the store items of a paid checkout, or answers it if it was already issued. Customers can only ask
+// for their own.
+func (s *Server) hdnl_issue_invoice(ectx echo.Context) error {
+	req := invoiceRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	claims := CurrentUser(ectx)
+	customerID := ""
+	switch {
+	case req.OrderID != "" && req.CheckoutID == "":
+		order, err := models.GetOrder(s.Client, req.OrderID)
+		if err != nil {
+			return err
+		}
+		customerID = order.CustomerID
+	case req.CheckoutID != "" && req.OrderID == "":
+		checkout, err := models.GetCheckout(s.Client, req.CheckoutID)
+		if err != nil {
+			return err
+		}
+		customerID = checkout.CustomerID
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Send either an order_id or a checkout_id")
+	}
+	if !claims.Can(auth.PermManageOrders) && customerID != claims.UserID() {
+		return echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	invoice, err := models.IssueInvoice(s.Client, &s.Config.Invoice, &models.InvoiceRequest{OrderID: req.OrderID, CheckoutID: req.CheckoutID})
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, invoice)
+}
+
+// @info GET /api/v1/invoices?customer_id=&kind=&limit=&bookmark=. Customers only get their own invoices.
+func (s *Server) hdnl_list_invoices(ectx echo.Context) error {
+	filter := &models.InvoiceFilter{
+		CustomerID: ectx.QueryParam("customer_id"),
+		Kind:       models.InvoiceKind(ectx.QueryParam("kind")),
+	}
+	if filter.Kind != "" && filter.Kind != models.InvoiceOrdinary && filter.Kind != models.InvoiceRectifying {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown kind of invoice")
+	}
+	claims := CurrentUser(ectx)
+	if !claims.Can(auth.PermManageOrders) {
+		filter.CustomerID = claims.UserID()
+	}
+	invoices, bookmark, err := models.ListInvoices(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, invoicesResponse{Invoices: invoices, Bookmark: bookmark})
+}
+
+// @info GET /api/v1/invoices/:id
+func (s *Server) hdnl_get_invoice(ectx echo.Context) error {
+	invoice, err := s.loadInvoice(ectx)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, invoice)
+}
+
+// @info GET /api/v1/invoices/:id/pdf
+func (s *Server) hdnl_invoice_pdf(ectx echo.Context) error {
+	invoice, err := s.loadInvoice(ectx)
+	if err != nil {
+		return err
+	}
+	data, name, err := models.InvoicePDF(s.Client, invoice.ID)
+	if err != nil {
+		return err
+	}
+	ectx.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=%q", name))
+	return ectx.Blob(http.StatusOK, "application/pdf", data)
+}
+
+// @info POST /api/v1/admin/invoices/:id/rectify {"amount_cents": 500, "reason": "..."}. Issues a rectifying invoice
+// for a refund, of all that is left if amount_cents is not given. Honours Idempotency-Key.
+func (s *Server) hdnl_rectify_invoice(ectx echo.Context) error {
+	req := amountRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	before, err := models.GetInvoice(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	rectifying, err := models.RectifyInvoice(s.Client, &s.Config.Invoice, before.ID, req.AmountCents, req.Reason, ectx.Request().Header.Get(headerIdempotencyKey))
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditInvoiceRectified, before.ID, before, rectifying); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, rectifying)
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"3DQuest/models"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type spoolsResponse struct {
+	Spools   []models.Spool `json:"spools"`
+	Bookmark string         `json:"bookmark,omitempty"`
+}
+
+type spoolPrinterRequest struct {
+	PrinterID string `json:"printer_id"` // Empty to unload it
+}
+
+type stockResponse struct {
+	Stock []models.MaterialStock `json:"stock"`
+}
+
+type thresholdsResponse struct {
+	Thresholds []models.MaterialThreshold `json:"thresholds"`
+}
+
+type purchaseResponse struct {
+	Suggestions []models.PurchaseSuggestion `json:"suggestions"`
+}
+
+// @info GET /api/v1/materials/spools?material=&colour=&status=&printer_id=&limit=&bookmark=
+func (s *Server) hdnl_list_spools(ectx echo.Context) error {
+	filter := &models.SpoolFilter{
+		Material:  ectx.QueryParam("material"),
+		Colour:    ectx.QueryParam("colour"),
+		Status:    models.SpoolStatus(ectx.QueryParam("status")),
+		PrinterID: ectx.QueryParam("printer_id"),
+	}
+	if filter.Status != "" && !models.IsSpoolStatus(filter.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown spool status")
+	}
+	spools, bookmark, err := models.ListSpools(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, spoolsResponse{Spools: spools, Bookmark: bookmark})
+}
+
+// @info POST /api/v1/materials/spools. New spools are active and full unless remaining_grams says otherwise.
+func (s *Server) hdnl_create_spool(ectx echo.Context) error {
+	spool := &models.Spool{}
+	if err := ectx.Bind(spool); err != nil {
+		return err
+	}
+	spool.ID, spool.Rev = "", ""
+	if err := models.CreateSpool(s.Client, spool); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditSpoolCreated, spool.ID, nil, spool); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, spool)
+}
+
+// @info GET /api/v1/materials/spools/:id
+func (s *Server) hdnl_get_spool(ectx echo.Context) error {
+	spool, err := models.GetSpool(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, spool)
+}
+
+// @info PATCH /api/v1/materials/spools/:id. Only the fields sent are changed, e.g. remaining_grams after weighing it.
+func (s *Server) hdnl_update_spool(ectx echo.Context) error {
+	update := &models.SpoolUpdate{}
+	if err := ectx.Bind(update); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetSpool(s.Client, id)
+	if err != nil {
+		return err
+	}
+	spool, err := models.UpdateSpool(s.Client, id, update)
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditSpoolUpdated, id, before, spool); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, spool)
+}
+
+// @info PUT /api/v1/materials/spools/:id/printer {"printer_id": "..."}. The printer gets the material and colour of
+// the spool, and the queue is planned again.
+func (s *Server) hdnl_load_spool(ectx echo.Context) error {
+	req := spoolPrinterRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetSpool(s.Client, id)
+	if err != nil {
+		return err
+	}
+	spool, err := models.LoadSpool(s.Client, id, req.PrinterID)
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditSpoolLoaded, id, before, spool); err != nil {
+		return err
+	}
+	if req.PrinterID != "" {
+		s.replan(ectx)
+	}
+	return ectx.JSON(http.StatusOK, spool)
+}
+
+// @info GET /api/v1/materials/stock. Filament of each material and colour against the print queue and thresholds.
+func (s *Server) hdnl_material_stock(ectx echo.Context) error {
+	stock, err := models.ListMaterialStock(s.Client, &s.Config.Materials)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, stockResponse{Stock: stock})
+}
+
+// @info GET /api/v1/materials/thresholds
+func (s *Server) hdnl_list_thresholds(ectx echo.Context) error {
+	thresholds, err := models.ListMaterialThresholds(s.Client)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, thresholdsResponse{Thresholds: thresholds})
+}
+
+// @info PUT /api/v1/materials/thresholds {"material": "PLA", "colour": "Black", "min_grams": 2000, "target_grams": 5000}
+func (s *Server) hdnl_set_threshold(ectx echo.Context) error {
+	threshold := &models.MaterialThreshold{}
+	if err := ectx.Bind(threshold); err != nil {
+		return err
+	}
+	threshold.Rev = ""
+	threshold.UpdatedBy = CurrentUser(ectx).UserID()
+	if err := models.SetMaterialThreshold(s.Client, threshold); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditThresholdSet, threshold.ID, nil, threshold); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, threshold)
+}
+
+// @info DELETE /api/v1/materials/thresholds?material=&colour=. MATERIALS_LOW_STOCK_GRAMS applies again.
+func (s *Server) hdnl_delete_threshold(ectx echo.Context) error {
+	threshold, err := models.DeleteMaterialThreshold(s.Client, ectx.QueryParam("material"), ectx.QueryParam("colour"))
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditThresholdDeleted, threshold.ID, threshold, nil); err != nil {
+		return err
+	}
+	return ectx.NoContent(http.StatusNoContent)
+}
+
+// @info GET /api/v1/materials/purchase-suggestions. Spools to buy for the materials running low.
+func (s *Server) hdnl_purchase_suggestions(ectx echo.Context) error {
+	suggestions, err := models.SuggestPurchases(s.Client, &s.Config.Materials)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, purchaseResponse{Suggestions: suggestions})
+}
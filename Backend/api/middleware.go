@@ -0,0 +1,74 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"net/http"
+	str "strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// @info Key under which the *auth.Claims of the authenticated user are stored in the echo.Context
+const userContextKey = "user"
+
+// @info Rejects requests without a valid "Authorization: Bearer <access token>" header, or whose user was deleted
+// since the token was issued. The claims of the user, with the type the user has now, are stored both in the echo.Context (see CurrentUser) and in the request's context.Context (see auth.ClaimsFromContext).
+func (s *Server) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ectx echo.Context) error {
+		claims, err := s.authenticate(ectx)
+		if err != nil {
+			ectx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="3DQuest"`)
+			return err
+		}
+		ectx.Set(userContextKey, claims)
+		ectx.SetRequest(ectx.Request().WithContext(auth.WithClaims(ectx.Request().Context(), claims)))
+		return next(ectx)
+	}
+}
+
+func (s *Server) authenticate(ectx echo.Context) (*auth.Claims, error) {
+	header := ectx.Request().Header.Get(echo.HeaderAuthorization)
+	scheme, token, found := str.Cut(header, " ")
+	if !found || !str.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Missing bearer token")
+	}
+	claims, err := s.Tokens.ParseAccessToken(token)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	}
+	// @info The type in the token is the one it had when issued, permissions follow the one stored. Read through the
+	// cache, which every write to the user evicts, so a demotion applies to the next request.
+	usr, err := models.GetCachedUser(s.Client, claims.UserID())
+	if dbdriver.IsNotFound(err) || (err == nil && usr.IsDeleted()) {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "The account no longer exists")
+	}
+	if err != nil {
+		return nil, err
+	}
+	claims.Type = usr.Type
+	return claims, nil
+}
+
+// @info Claims of the authenticated user. Only valid in handlers behind requireAuth, returns nil otherwise.
+func CurrentUser(ectx echo.Context) *auth.Claims {
+	claims, _ := ectx.Get(userContextKey).(*auth.Claims)
+	return claims
+}
+
+// @info Requires an authenticated user whose type grants every given permission (see auth.HasPermission).
+// It includes requireAuth, so routes only need this one.
+func (s *Server) requirePermission(perms ...auth.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return s.requireAuth(func(ectx echo.Context) error {
+			claims := CurrentUser(ectx)
+			for _, perm := range perms {
+				if !claims.Can(perm) {
+					return echo.NewHTTPError(http.StatusForbidden, "You are not allowed to do this")
+				}
+			}
+			return next(ectx)
+		})
+	}
+}
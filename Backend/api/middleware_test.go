@@ -0,0 +1,127 @@
+package api_test
+
+import (
+	"3DQuest/api"
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/dbdriver/fake"
+	"3DQuest/models"
+	"net/http"
+	"net/http/httptest"
+	str "strings"
+	"testing"
+	"time"
+)
+
+// @info A server without printers, payments or carrier, on its own fake CouchDB. configure changes the test defaults.
+func newServer(t *testing.T, configure ...func(*config.Config)) (*api.Server, *dbdriver.CouchDBClient) {
+	t.Helper()
+	couch := httptest.NewServer(fake.NewCouch())
+	t.Cleanup(couch.Close)
+	client, err := fake.Client(couch.URL, couch.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// @info Documents are validated as in main
+	client.Schemas = dbdriver.NewSchemaRegistry()
+	if err := models.RegisterSchemas(client.Schemas); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Server: config.ServerConfig{BodyLimit: "1M"},
+		Auth:   config.AuthConfig{JWTSecret: str.Repeat("test-secret-", 4), Issuer: "3DQuest", AccessTokenTTL: time.Minute, RefreshTokenTTL: time.Hour},
+	}
+	for _, change := range configure {
+		change(cfg)
+	}
+	return api.NewServer(cfg, client, nil, nil, nil), client
+}
+
+// @info A user of the type and the access token of a session of it
+func newSession(t *testing.T, s *api.Server, userType string) (*models.User, string) {
+	t.Helper()
+	usr := &models.User{Type: userType, Name: userType, EMAIL: userType + "@example.com", PSWD_HASH: "$argon2id$test"}
+	if err := models.CreateUser(s.Client, usr); err != nil {
+		t.Fatal(err)
+	}
+	session, err := s.Tokens.NewSession(usr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usr, session.AccessToken
+}
+
+func call(s *api.Server, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, api.V1Prefix+path, str.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.Echo.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequirePermission(t *testing.T) {
+	s, _ := newServer(t)
+	tokens := map[string]string{}
+	for _, userType := range []string{"user", "academic", "operator", "admin"} {
+		_, tokens[userType] = newSession(t, s, userType)
+	}
+	cases := []struct {
+		path string
+		want map[string]int // By user type
+	}{
+		{"/roles", map[string]int{"user": 200, "academic": 200, "operator": 200, "admin": 200}},
+		{"/orders", map[string]int{"user": 200, "academic": 200, "operator": 200, "admin": 200}},
+		{"/printers", map[string]int{"user": 403, "academic": 403, "operator": 200, "admin": 200}},
+		{"/materials/spools", map[string]int{"user": 403, "academic": 403, "operator": 200, "admin": 200}},
+		{"/admin/users", map[string]int{"user": 403, "academic": 403, "operator": 403, "admin": 200}},
+		{"/admin/coupons", map[string]int{"user": 403, "academic": 403, "operator": 403, "admin": 200}},
+		{"/admin/audit", map[string]int{"user": 403, "academic": 403, "operator": 200, "admin": 200}},
+		{"/catalog/products", map[string]int{"user": 403, "academic": 403, "operator": 403, "admin": 200}},
+		{"/alerts", map[string]int{"user": 403, "academic": 403, "operator": 200, "admin": 200}},
+		{"/checkouts", map[string]int{"user": 200, "academic": 200, "operator": 200, "admin": 200}},
+	}
+	for _, c := range cases {
+		if rec := call(s, http.MethodGet, c.path, "", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a token: %d", c.path, rec.Code)
+		}
+		if rec := call(s, http.MethodGet, c.path, "not-a-token", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s with a bad token: %d", c.path, rec.Code)
+		}
+		for userType, want := range c.want {
+			if rec := call(s, http.MethodGet, c.path, tokens[userType], ""); rec.Code != want {
+				t.Errorf("GET %s as %s: %d, want %d: %s", c.path, userType, rec.Code, want, rec.Body)
+			}
+		}
+	}
+}
+
+func TestPermissionsFollowTheStoredType(t *testing.T) {
+	s, _ := newServer(t)
+	_, admin := newSession(t, s, "admin")
+	operator, operatorToken := newSession(t, s, "operator")
+	customer, customerToken := newSession(t, s, "user")
+
+	if rec := call(s, http.MethodGet, "/printers", operatorToken, ""); rec.Code != http.StatusOK {
+		t.Fatalf("operator before the demotion: %d", rec.Code)
+	}
+	if rec := call(s, http.MethodPut, "/admin/users/"+operator.ID+"/type", admin, `{"type":"user"}`); rec.Code != http.StatusOK {
+		t.Fatalf("demotion: %d %s", rec.Code, rec.Body)
+	}
+	// @info Same access token, still valid for some minutes
+	if rec := call(s, http.MethodGet, "/printers", operatorToken, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("demoted operator: %d, want 403", rec.Code)
+	}
+	if rec := call(s, http.MethodGet, "/orders", operatorToken, ""); rec.Code != http.StatusOK {
+		t.Errorf("demoted operator placing orders: %d", rec.Code)
+	}
+
+	if rec := call(s, http.MethodDelete, "/admin/users/"+customer.ID, admin, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deletion: %d %s", rec.Code, rec.Body)
+	}
+	if rec := call(s, http.MethodGet, "/orders", customerToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("deleted user: %d, want 401", rec.Code)
+	}
+}
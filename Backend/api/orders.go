@@ -0,0 +1,175 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type orderRequest struct {
+	Items []models.OrderItem `json:"items"`
+	Notes string             `json:"notes"`
+	DueAt *time.Time         `json:"due_at"`
+}
+
+// @info An order together with the statuses the authenticated user may move it to
+type orderResponse struct {
+	*models.Order
+	Next []models.OrderStatus `json:"next"`
+}
+
+type ordersResponse struct {
+	Orders   []models.Order `json:"orders"`
+	Bookmark string         `json:"bookmark,omitempty"`
+}
+
+// @info Staff act on any order, customers only on their own
+func orderActor(claims *auth.Claims) models.OrderActor {
+	if claims.Can(auth.PermManageOrders) {
+		return models.ActorStaff
+	}
+	return models.ActorCustomer
+}
+
+// @info Loads the order if the authenticated user may see it. Other customers' orders are reported as not found.
+func (s *Server) loadOrder(ectx echo.Context) (*models.Order, error) {
+	order, err := models.GetOrder(s.Client, ectx.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	claims := CurrentUser(ectx)
+	if orderActor(claims) == models.ActorCustomer && order.CustomerID != claims.UserID() {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	return order, nil
+}
+
+func (s *Server) orderJSON(ectx echo.Context, status int, order *models.Order) error {
+	return ectx.JSON(status, orderResponse{Order: order, Next: order.NextStatuses(orderActor(CurrentUser(ectx)))})
+}
+
+// @info POST /api/v1/orders. Creates a draft order of the authenticated user.
+func (s *Server) hdnl_create_order(ectx echo.Context) error {
+	req := orderRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	order := &models.Order{CustomerID: CurrentUser(ectx).UserID(), Items: req.Items, Notes: req.Notes, DueAt: req.DueAt}
+	if err := models.CreateOrder(s.Client, order); err != nil {
+		return err
+	}
+	return s.orderJSON(ectx, http.StatusCreated, order)
+}
+
+// @info GET /api/v1/orders?status=&customer_id=&limit=&bookmark=. Customers only get their own orders.
+func (s *Server) hdnl_list_orders(ectx echo.Context) error {
+	filter := &models.OrderFilter{CustomerID: ectx.QueryParam("customer_id"), Status: models.OrderStatus(ectx.QueryParam("status"))}
+	if filter.Status != "" && !models.IsOrderStatus(filter.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown order status")
+	}
+	claims := CurrentUser(ectx)
+	if orderActor(claims) == models.ActorCustomer {
+		filter.CustomerID = claims.UserID()
+	}
+	orders, bookmark, err := models.ListOrders(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, ordersResponse{Orders: orders, Bookmark: bookmark})
+}
+
+// @info GET /api/v1/orders/:id
+func (s *Server) hdnl_get_order(ectx echo.Context) error {
+	order, err := s.loadOrder(ectx)
+	if err != nil {
+		return err
+	}
+	return s.orderJSON(ectx, http.StatusOK, order)
+}
+
+// @info PUT /api/v1/orders/:id/items. Only while the order is a draft.
+func (s *Server) hdnl_update_order_items(ectx echo.Context) error {
+	req := orderRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	if _, err := s.loadOrder(ectx); err != nil {
+		return err
+	}
+	order, err := models.UpdateOrderItems(s.Client, ectx.Param("id"), req.Items, req.Notes, req.DueAt)
+	if err != nil {
+		return err
+	}
+	return s.orderJSON(ectx, http.StatusOK, order)
+}
+
+// @info POST /api/v1/orders/:id/transitions {"to": "cancelled", "note": "..."}
+func (s *Server) hdnl_transition_order(ectx echo.Context) error {
+	transition := &models.OrderTransition{}
+	if err := ectx.Bind(transition); err != nil {
+		return err
+	}
+	if !models.IsOrderStatus(transition.To) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown order status")
+	}
+	if _, err := s.loadOrder(ectx); err != nil {
+		return err
+	}
+	claims := CurrentUser(ectx)
+	transition.Actor = orderActor(claims)
+	transition.ActorID = claims.UserID()
+	order, err := models.TransitionOrder(s.Client, ectx.Param("id"), transition)
+	if err != nil {
+		return err
+	}
+	if s.replanAfter(ectx, transition.To) {
+		// @info Accepted orders are queued straight away if a printer can take them
+		if order, err = models.GetOrder(s.Client, order.ID); err != nil {
+			return err
+		}
+	}
+	if s.invoiceCompletedOrder(ectx, order) {
+		if order, err = models.GetOrder(s.Client, order.ID); err != nil {
+			return err
+		}
+	}
+	return s.orderJSON(ectx, http.StatusOK, order)
+}
+
+// @info PUT /api/v1/orders/:id/items/:index/model, multipart with the model or G-code in the "file" field. Stores the model of
+// the item (counting from 0) and its analysis. Only while the order is a draft.
+func (s *Server) hdnl_upload_order_model(ectx echo.Context) error {
+	index, err := strconv.Atoi(ectx.Param("index"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "The item index must be a number")
+	}
+	if _, err := s.loadOrder(ectx); err != nil {
+		return err
+	}
+	upload, err := readModel(ectx)
+	if err != nil {
+		return err
+	}
+	order, err := models.AttachOrderModel(s.Client, ectx.Param("id"), index, upload)
+	if err != nil {
+		return err
+	}
+	return s.orderJSON(ectx, http.StatusOK, order)
+}
+
+// @info POST /api/v1/orders/:id/quote. Prices a draft order with the tariffs in force and moves it to quoted.
+// Every item needs a model, see hdnl_upload_order_model.
+func (s *Server) hdnl_quote_order(ectx echo.Context) error {
+	if _, err := s.loadOrder(ectx); err != nil {
+		return err
+	}
+	order, err := models.QuoteOrder(s.Client, ectx.Param("id"), CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	return s.orderJSON(ectx, http.StatusOK, order)
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/models"
+	"3DQuest/payment"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type paymentRequest struct {
+	CheckoutID string `json:"checkout_id"`  // Pays a checkout awaiting payment
+	TopUpCents int64  `json:"top_up_cents"` // Or buys credits
+}
+
+// @info A payment with the secret the frontend needs to complete it with the provider
+type startedPaymentResponse struct {
+	Payment      *models.Payment `json:"payment"`
+	ClientSecret string          `json:"client_secret"`
+}
+
+type paymentsResponse struct {
+	Payments []models.Payment `json:"payments"`
+	Bookmark string           `json:"bookmark,omitempty"`
+}
+
+type amountRequest struct {
+	AmountCents int64  `json:"amount_cents"` // All that is left if 0
+	Reason      string `json:"reason"`
+}
+
+type reconciliationResponse struct {
+	Reconciled int              `json:"reconciled"`
+	Problems   []models.Payment `json:"problems"`
+}
+
+// @info The payment provider, or a 503 if PAYMENT_PROVIDER is not set
+func (s *Server) paymentProvider() (payment.Provider, error) {
+	if s.Payments == nil {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, "Card payments are not available")
+	}
+	return s.Payments, nil
+}
+
+// @info Context of a call to the provider, bounded by PAYMENT_TIMEOUT
+func (s *Server) paymentContext(ectx echo.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ectx.Request().Context(), s.Config.Payment.Timeout)
+}
+
+// @info POST /api/v1/payments {"checkout_id": "..."} or {"top_up_cents": 2000}. Starts a card payment of the
+// authenticated user. Top-ups honour Idempotency-Key.
+func (s *Server) hdnl_start_payment(ectx echo.Context) error {
+	provider, err := s.paymentProvider()
+	if err != nil {
+		return err
+	}
+	req := paymentRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	if (req.CheckoutID == "") == (req.TopUpCents == 0) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Send either a checkout_id or top_up_cents")
+	}
+	ctx, cancel := s.paymentContext(ectx)
+	defer cancel()
+	userID := CurrentUser(ectx).UserID()
+	var p *models.Payment
+	var secret string
+	if req.CheckoutID != "" {
+		p, secret, err = models.StartCheckoutPayment(ctx, s.Client, provider, &s.Config.Payment, req.CheckoutID, userID)
+	} else {
+		p, secret, err = models.StartTopUpPayment(ctx, s.Client, provider, &s.Config.Payment, userID, req.TopUpCents, ectx.Request().Header.Get(headerIdempotencyKey))
+	}
+	if err != nil {
+		return checkoutError(err)
+	}
+	return ectx.JSON(http.StatusCreated, startedPaymentResponse{Payment: p, ClientSecret: secret})
+}
+
+// @info POST /api/v1/payments/webhook. Events of the provider, authenticated by their signature. Answers an error
+// when an event could not be applied, so the provider sends it again.
+func (s *Server) hdnl_payment_webhook(ectx echo.Context) error {
+	provider, err := s.paymentProvider()
+	if err != nil {
+		return err
+	}
+	payload, err := io.ReadAll(ectx.Request().Body)
+	if err != nil {
+		return err
+	}
+	event, err := provider.ParseWebhook(payload, ectx.Request().Header)
+	if err != nil { // @info A bad signature or a payload that is not an event
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	record, err := models.HandlePaymentEvent(s.Client, provider.Kind(), event)
+	if err != nil {
+		return err
+	}
+	if event.Type == payment.EventSucceeded && record.Status == models.PaymentEventProcessed {
+		s.replan(ectx) // @info It may have paid for print orders
+	}
+	return ectx.JSON(http.StatusOK, map[string]string{"status": string(record.Status)})
+}
+
+// @info GET /api/v1/payments?status=&user_id=&checkout_id=&limit=&bookmark=. Customers only get their own payments.
+func (s *Server) hdnl_list_payments(ectx echo.Context) error {
+	filter := &models.PaymentFilter{
+		UserID:     ectx.QueryParam("user_id"),
+		CheckoutID: ectx.QueryParam("checkout_id"),
+		Status:     models.PaymentStatus(ectx.QueryParam("status")),
+	}
+	if filter.Status != "" && !models.IsPaymentStatus(filter.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown payment status")
+	}
+	claims := CurrentUser(ectx)
+	if !claims.Can(auth.PermManageOrders) {
+		filter.UserID = claims.UserID()
+	}
+	payments, bookmark, err := models.ListPayments(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, paymentsResponse{Payments: payments, Bookmark: bookmark})
+}
+
+// @info GET /api/v1/payments/:id. Other customers' payments are reported as not found.
+func (s *Server) hdnl_get_payment(ectx echo.Context) error {
+	p, err := models.GetPayment(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	claims := CurrentUser(ectx)
+	if !claims.Can(auth.PermManageOrders) && p.UserID != claims.UserID() {
+		return echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	return ectx.JSON(http.StatusOK, p)
+}
+
+// @info POST /api/v1/admin/payments/:id/capture {"amount_cents": 0}. Takes a payment that was only authorized.
+func (s *Server) hdnl_capture_payment(ectx echo.Context) error {
+	provider, err := s.paymentProvider()
+	if err != nil {
+		return err
+	}
+	req := amountRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	before, err := models.GetPayment(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.paymentContext(ectx)
+	defer cancel()
+	p, err := models.CapturePayment(ctx, s.Client, provider, before.ID, req.AmountCents)
+	if err != nil {
+		return checkoutError(err)
+	}
+	if err := s.audit(ectx, models.AuditPaymentCaptured, p.ID, before, p); err != nil {
+		return err
+	}
+	s.replan(ectx)
+	return ectx.JSON(http.StatusOK, p)
+}
+
+// @info POST /api/v1/admin/payments/:id/refund {"amount_cents": 500, "reason": "..."}. Credits bought with the payment
+// are taken back.
+func (s *Server) hdnl_refund_payment(ectx echo.Context) error {
+	provider, err := s.paymentProvider()
+	if err != nil {
+		return err
+	}
+	req := amountRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	before, err := models.GetPayment(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.paymentContext(ectx)
+	defer cancel()
+	p, err := models.RefundPayment(ctx, s.Client, provider, before.ID, req.AmountCents, req.Reason, CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditPaymentRefunded, p.ID, before, p); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, p)
+}
+
+// @info POST /api/v1/admin/payments/reconcile. Gives what every captured payment paid for, in case an event was lost,
+// and answers the payments that need the staff.
+func (s *Server) hdnl_reconcile_payments(ectx echo.Context) error {
+	reconciled, problems, err := models.ReconcilePayments(s.Client)
+	if err != nil {
+		return err
+	}
+	resp := reconciliationResponse{Reconciled: reconciled, Problems: problems}
+	if reconciled > 0 || len(problems) > 0 {
+		if err := s.audit(ectx, models.AuditPaymentsReconciled, "", nil, resp); err != nil {
+			return err
+		}
+	}
+	if reconciled > 0 {
+		s.replan(ectx)
+	}
+	return ectx.JSON(http.StatusOK, resp)
+}
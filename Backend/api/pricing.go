@@ -0,0 +1,142 @@
+package api
+
+import (
+	"3DQuest/models"
+	"3DQuest/quote"
+	"net/http"
+	"strconv"
+	str "strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type publishPricingRequest struct {
+	Rules quote.Rules `json:"rules"`
+	Notes string      `json:"notes"`
+}
+
+type pricingVersionsResponse struct {
+	Versions []models.PricingRules `json:"versions"`
+	Bookmark string                `json:"bookmark,omitempty"`
+}
+
+// @info GET /api/v1/pricing. Tariffs in force, so the frontend can list materials and extras.
+func (s *Server) hdnl_current_pricing(ectx echo.Context) error {
+	current, err := models.GetCurrentPricingRules(s.Client)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, current)
+}
+
+// @info POST /api/v1/quotes, multipart with the model or G-code in the "file" field and the print settings in the fields
+// material, infill_percent, layer_height_mm, quantity, post_processing (repeated or comma separated) and the unit of
+// the model (mm by default, see readModel).
+// Prices a single model for the authenticated user without storing anything, with the promotions they would get at
+// checkout and the coupon in coupon_code if given.
+func (s *Server) hdnl_instant_quote(ectx echo.Context) error {
+	upload, err := readModel(ectx)
+	if err != nil {
+		return err
+	}
+	item := quote.Item{Name: upload.Filename, Model: upload.Model, GCode: upload.GCode, Material: ectx.FormValue("material"), Quantity: 1}
+	if item.InfillPercent, err = formFloat(ectx, "infill_percent"); err != nil {
+		return err
+	}
+	if item.LayerHeightMM, err = formFloat(ectx, "layer_height_mm"); err != nil {
+		return err
+	}
+	if raw := ectx.FormValue("quantity"); raw != "" {
+		if item.Quantity, err = strconv.Atoi(raw); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "quantity must be a number")
+		}
+	}
+	if form, err := ectx.MultipartForm(); err == nil {
+		for _, value := range form.Value["post_processing"] {
+			for _, extra := range str.Split(value, ",") {
+				if extra = str.TrimSpace(extra); extra != "" {
+					item.PostProcessing = append(item.PostProcessing, extra)
+				}
+			}
+		}
+	}
+	// @info The customer, whose type gives the discount and the promotions
+	customer, err := models.GetUser(s.Client, CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	q, err := models.QuoteItems(s.Client, []quote.Item{item}, customer.Type)
+	if err != nil {
+		return err
+	}
+	typeDiscounted := int64(0)
+	if q.DiscountCents > 0 {
+		typeDiscounted = q.TotalCents
+	}
+	promotions, err := models.EvaluatePromotions(s.Client, customer, ectx.FormValue("coupon_code"), q.TotalCents, typeDiscounted, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	// @info Whether the shop has the filament for it right now, the order can still be placed otherwise
+	inStock, err := models.MaterialInStock(s.Client, q.Lines[0].Material, q.FilamentGrams)
+	if err != nil {
+		return err
+	}
+	if upload.GCode != nil {
+		return ectx.JSON(http.StatusOK, echo.Map{"gcode": upload.GCode, "quote": q, "promotions": promotions, "in_stock": inStock})
+	}
+	return ectx.JSON(http.StatusOK, echo.Map{"model": upload.Model, "quote": q, "promotions": promotions, "in_stock": inStock})
+}
+
+// @info Optional number of a form, zero when missing
+func formFloat(ectx echo.Context, field string) (float64, error) {
+	raw := ectx.FormValue(field)
+	if raw == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, field+" must be a number")
+	}
+	return value, nil
+}
+
+// @info GET /api/v1/admin/pricing?limit=&bookmark=. Every version of the tariffs, newest first.
+func (s *Server) hdnl_list_pricing(ectx echo.Context) error {
+	versions, bookmark, err := models.ListPricingRules(s.Client, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, pricingVersionsResponse{Versions: versions, Bookmark: bookmark})
+}
+
+// @info GET /api/v1/admin/pricing/:version
+func (s *Server) hdnl_get_pricing(ectx echo.Context) error {
+	version, err := strconv.Atoi(ectx.Param("version"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "The version must be a number")
+	}
+	published, err := models.GetPricingRules(s.Client, version)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, published)
+}
+
+// @info POST /api/v1/admin/pricing {"rules": {...}, "notes": "..."}. Publishes the tariffs as a new version, in force
+// for every quote made from now on. Quotes already made keep their price.
+func (s *Server) hdnl_publish_pricing(ectx echo.Context) error {
+	req := publishPricingRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	published, err := models.PublishPricingRules(s.Client, &req.Rules, req.Notes, CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditPricingPublished, published.ID, nil, published.Version); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, published)
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"3DQuest/models"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type printerStatusRequest struct {
+	Status models.PrinterStatus `json:"status"`
+	Note   string               `json:"note"` // Why it stopped, copied to the job it fails
+}
+
+type jobFailureRequest struct {
+	Note string `json:"note"`
+}
+
+type printerCommandRequest struct {
+	Note string `json:"note"` // Why it was cancelled, copied to the job it fails
+}
+
+type printersResponse struct {
+	Printers []models.Printer `json:"printers"`
+	Bookmark string           `json:"bookmark,omitempty"`
+}
+
+// @info GET /api/v1/printers?status=&location=&limit=&bookmark=
+func (s *Server) hdnl_list_printers(ectx echo.Context) error {
+	filter := &models.PrinterFilter{Status: models.PrinterStatus(ectx.QueryParam("status")), Location: ectx.QueryParam("location")}
+	if filter.Status != "" && !models.IsPrinterStatus(filter.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown printer status")
+	}
+	printers, bookmark, err := models.ListPrinters(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	for i := range printers {
+		printers[i].HideAPIKey()
+	}
+	return ectx.JSON(http.StatusOK, printersResponse{Printers: printers, Bookmark: bookmark})
+}
+
+// @info POST /api/v1/printers. New printers are idle and join the plan straight away.
+func (s *Server) hdnl_create_printer(ectx echo.Context) error {
+	printer := &models.Printer{}
+	if err := ectx.Bind(printer); err != nil {
+		return err
+	}
+	printer.ID, printer.Rev = "", ""
+	if err := models.CreatePrinter(s.Client, printer); err != nil {
+		return err
+	}
+	printer.HideAPIKey()
+	if err := s.audit(ectx, models.AuditPrinterCreated, printer.ID, nil, printer); err != nil {
+		return err
+	}
+	s.replan(ectx)
+	return ectx.JSON(http.StatusCreated, printer)
+}
+
+// @info GET /api/v1/printers/:id
+func (s *Server) hdnl_get_printer(ectx echo.Context) error {
+	printer, err := models.GetPrinter(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	printer.HideAPIKey()
+	return ectx.JSON(http.StatusOK, printer)
+}
+
+// @info PATCH /api/v1/printers/:id. Only the fields sent are changed, the status has its own endpoint.
+func (s *Server) hdnl_update_printer(ectx echo.Context) error {
+	update := &models.PrinterUpdate{}
+	if err := ectx.Bind(update); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetPrinter(s.Client, id)
+	if err != nil {
+		return err
+	}
+	printer, err := models.UpdatePrinter(s.Client, id, update)
+	if err != nil {
+		return err
+	}
+	before.HideAPIKey()
+	printer.HideAPIKey()
+	if err := s.audit(ectx, models.AuditPrinterUpdated, id, before, printer); err != nil {
+		return err
+	}
+	s.replan(ectx)
+	return ectx.JSON(http.StatusOK, printer)
+}
+
+// @info PUT /api/v1/printers/:id/status {"status": "error", "note": "Clogged nozzle"}. A printer that stops being
+// available fails the job it was printing, and the queue is planned again without it.
+func (s *Server) hdnl_set_printer_status(ectx echo.Context) error {
+	req := printerStatusRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	if !models.IsPrinterStatus(req.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown printer status")
+	}
+	if req.Status == models.PrinterPrinting {
+		return echo.NewHTTPError(http.StatusBadRequest, "Printers start printing when a job is started")
+	}
+	id := ectx.Param("id")
+	printer, previous, err := s.Scheduler.SetPrinterStatus(id, req.Status, req.Note)
+	if err != nil {
+		return err
+	}
+	printer.HideAPIKey()
+	if previous != req.Status {
+		if err := s.audit(ectx, models.AuditPrinterStatus, id, previous, req.Status); err != nil {
+			return err
+		}
+	}
+	return ectx.JSON(http.StatusOK, printer)
+}
+
+// @info GET /api/v1/printers/:id/telemetry. Last reading of a printer with a connection: state, progress and
+// temperatures.
+func (s *Server) hdnl_printer_telemetry(ectx echo.Context) error {
+	status, err := s.Scheduler.Telemetry(ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, status)
+}
+
+// @info POST /api/v1/printers/:id/pause
+func (s *Server) hdnl_pause_printer(ectx echo.Context) error {
+	return s.commandPrinter(ectx, models.PrinterPause)
+}
+
+// @info POST /api/v1/printers/:id/resume
+func (s *Server) hdnl_resume_printer(ectx echo.Context) error {
+	return s.commandPrinter(ectx, models.PrinterResume)
+}
+
+// @info POST /api/v1/printers/:id/cancel {"note": "Spaghetti"}. The job it was printing fails.
+func (s *Server) hdnl_cancel_printer(ectx echo.Context) error {
+	return s.commandPrinter(ectx, models.PrinterCancel)
+}
+
+// @info Sends the command through the connection of the printer. The printer answering with an error is a 502.
+func (s *Server) commandPrinter(ectx echo.Context, command models.PrinterCommand) error {
+	req := printerCommandRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetPrinter(s.Client, id)
+	if err != nil {
+		return err
+	}
+	printer, err := s.Scheduler.CommandPrinter(id, command, req.Note)
+	if err != nil {
+		return err
+	}
+	if before.Status != printer.Status {
+		if err := s.audit(ectx, models.AuditPrinterStatus, id, before.Status, printer.Status); err != nil {
+			return err
+		}
+	}
+	printer.HideAPIKey()
+	return ectx.JSON(http.StatusOK, printer)
+}
+
+// @info GET /api/v1/queue?printer_id=. Jobs printing and planned, in the order they start, and the parts that
+// could not be planned with the reason.
+func (s *Server) hdnl_print_queue(ectx echo.Context) error {
+	queue, err := s.Scheduler.Queue(ectx.QueryParam("printer_id"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, queue)
+}
+
+// @info POST /api/v1/queue/replan
+func (s *Server) hdnl_replan(ectx echo.Context) error {
+	queue, err := s.Scheduler.Replan()
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, queue)
+}
+
+// @info POST /api/v1/queue/jobs/:id/start. The printer and the orders of the job move to printing.
+func (s *Server) hdnl_start_job(ectx echo.Context) error {
+	job, err := s.Scheduler.StartJob(ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, job)
+}
+
+// @info POST /api/v1/queue/jobs/:id/complete {"filament_grams": 41.5}. Orders with every part printed move on, and
+// the filament is taken from the spools.
+func (s *Server) hdnl_complete_job(ectx echo.Context) error {
+	report := &models.FilamentReport{}
+	if err := ectx.Bind(report); err != nil {
+		return err
+	}
+	job, err := s.Scheduler.CompleteJob(ectx.Param("id"), report)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, job)
+}
+
+// @info POST /api/v1/queue/jobs/:id/fail {"note": "Warped"}. The orders of the job fail, to be reprinted or cancelled.
+func (s *Server) hdnl_fail_job(ectx echo.Context) error {
+	req := jobFailureRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	job, err := s.Scheduler.FailJob(ectx.Param("id"), req.Note)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, job)
+}
+
+// @info Plans the queue again after a change that affects it. The change itself already succeeded, so a failure is
+// only logged: the next replan picks it up.
+func (s *Server) replan(ectx echo.Context) {
+	if _, err := s.Scheduler.Replan(); err != nil {
+		ectx.Logger().Error(err)
+	}
+}
+
+// @info Replans when an order enters or leaves the queue. Returns whether it did.
+func (s *Server) replanAfter(ectx echo.Context, status models.OrderStatus) bool {
+	switch status {
+	case models.OrderAccepted, models.OrderReprint, models.OrderCancelled, models.OrderFailed:
+		s.replan(ectx)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"3DQuest/payment"
+	"3DQuest/shipping"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// @info Version prefix of every REST endpoint. Breaking changes go to a new group (/api/v2) next to this one.
+const V1Prefix = "/api/v1"
+
+// @info Holds the dependencies shared by every handler. Handlers are methods of Server so they can reach them.
+type Server struct {
+	Echo      *echo.Echo
+	Config    *config.Config
+	Client    *dbdriver.CouchDBClient
+	Tokens    *auth.TokenManager
+	Scheduler *models.PrintScheduler
+	Payments  payment.Provider        // nil when card payments are not configured
+	Carrier   shipping.Carrier        // nil when tracking numbers are entered by hand
+	Tracker   *models.ShipmentTracker // Follows the parcels of Carrier, nil without one
+	V1        *echo.Group
+}
+
+func NewServer(cfg *config.Config, client *dbdriver.CouchDBClient, printScheduler *models.PrintScheduler, payments payment.Provider, carrier shipping.Carrier) *Server {
+	e := echo.New()
+	e.HideBanner = true
+	e.HTTPErrorHandler = handleError
+
+	// @info Order matters: the request ID must exist before anything logs, and Recover must wrap everything below it
+	e.Use(middleware.RequestID())
+	e.Use(middleware.Logger())
+	e.Use(middleware.Recover())
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     cfg.Server.AllowedOrigins,
+		AllowMethods:     []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, echo.HeaderXRequestID, headerIdempotencyKey, headerCartToken},
+		ExposeHeaders:    []string{echo.HeaderXRequestID, headerCartToken},
+		AllowCredentials: true,
+	}))
+	e.Use(middleware.BodyLimit(cfg.Server.BodyLimit))
+	e.Use(middleware.Gzip())
+
+	s := &Server{Echo: e, Config: cfg, Client: client, Tokens: auth.NewTokenManager(client, &cfg.Auth), Scheduler: printScheduler, Payments: payments, Carrier: carrier}
+	if carrier != nil {
+		s.Tracker = models.NewShipmentTracker(client, carrier, &cfg.Invoice)
+	}
+	e.GET("/", hdnl_hello_world)
+	s.V1 = e.Group(V1Prefix)
+	s.registerRoutes()
+	return s
+}
+
+// @info Every /api/v1 route is registered here so the whole API can be read in one place
+func (s *Server) registerRoutes() {
+	s.V1.GET("/health", s.hdnl_health)
+
+	authGroup := s.V1.Group("/auth")
+	authGroup.POST("/register", s.hdnl_register)
+	authGroup.POST("/login", s.hdnl_login)
+	authGroup.POST("/refresh", s.hdnl_refresh)
+	authGroup.POST("/logout", s.hdnl_logout)
+	authGroup.GET("/me", s.hdnl_me, s.requireAuth)
+	authGroup.PATCH("/me", s.hdnl_update_me, s.requireAuth)
+	authGroup.DELETE("/me", s.hdnl_delete_me, s.requireAuth)
+	authGroup.PUT("/me/billing", s.hdnl_set_my_billing, s.requireAuth)
+	authGroup.DELETE("/me/billing", s.hdnl_delete_my_billing, s.requireAuth)
+	authGroup.GET("/me/credits", s.hdnl_my_credits, s.requireAuth)
+	authGroup.GET("/me/credits/transactions", s.hdnl_my_statement, s.requireAuth)
+
+	s.V1.GET("/roles", s.hdnl_roles, s.requireAuth)
+
+	orders := s.V1.Group("/orders", s.requirePermission(auth.PermPlaceOrders))
+	orders.POST("", s.hdnl_create_order)
+	orders.GET("", s.hdnl_list_orders)
+	orders.GET("/:id", s.hdnl_get_order)
+	orders.PUT("/:id/items", s.hdnl_update_order_items)
+	orders.POST("/:id/transitions", s.hdnl_transition_order)
+	orders.PUT("/:id/items/:index/model", s.hdnl_upload_order_model)
+	orders.POST("/:id/quote", s.hdnl_quote_order)
+	orders.GET("/:id/delivery-options", s.hdnl_delivery_options)
+	orders.PUT("/:id/delivery", s.hdnl_set_delivery)
+	orders.DELETE("/:id/delivery", s.hdnl_remove_delivery)
+
+	s.V1.GET("/pricing", s.hdnl_current_pricing, s.requireAuth)
+	s.V1.POST("/quotes", s.hdnl_instant_quote, s.requirePermission(auth.PermPlaceOrders))
+
+	s.V1.POST("/models/analyze", s.hdnl_analyze_model, s.requirePermission(auth.PermPlaceOrders))
+
+	printers := s.V1.Group("/printers", s.requirePermission(auth.PermManagePrinters))
+	printers.GET("", s.hdnl_list_printers)
+	printers.POST("", s.hdnl_create_printer)
+	printers.GET("/:id", s.hdnl_get_printer)
+	printers.PATCH("/:id", s.hdnl_update_printer)
+	printers.PUT("/:id/status", s.hdnl_set_printer_status)
+	printers.GET("/:id/telemetry", s.hdnl_printer_telemetry)
+	printers.POST("/:id/pause", s.hdnl_pause_printer)
+	printers.POST("/:id/resume", s.hdnl_resume_printer)
+	printers.POST("/:id/cancel", s.hdnl_cancel_printer)
+	printers.GET("/:id/state", s.hdnl_printer_state)
+	printers.GET("/:id/series", s.hdnl_printer_series)
+
+	alerts := s.V1.Group("/alerts", s.requirePermission(auth.PermManagePrinters))
+	alerts.GET("", s.hdnl_list_alerts)
+	alerts.GET("/:id", s.hdnl_get_alert)
+	alerts.POST("/:id/acknowledge", s.hdnl_acknowledge_alert)
+
+	materials := s.V1.Group("/materials", s.requirePermission(auth.PermManageStock))
+	materials.GET("/spools", s.hdnl_list_spools)
+	materials.POST("/spools", s.hdnl_create_spool)
+	materials.GET("/spools/:id", s.hdnl_get_spool)
+	materials.PATCH("/spools/:id", s.hdnl_update_spool)
+	materials.PUT("/spools/:id/printer", s.hdnl_load_spool)
+	materials.GET("/stock", s.hdnl_material_stock)
+	materials.GET("/thresholds", s.hdnl_list_thresholds)
+	materials.PUT("/thresholds", s.hdnl_set_threshold)
+	materials.DELETE("/thresholds", s.hdnl_delete_threshold)
+	materials.GET("/purchase-suggestions", s.hdnl_purchase_suggestions)
+
+	store := s.V1.Group("/store")
+	store.GET("/products", s.hdnl_store_products)
+	store.GET("/products/:id", s.hdnl_store_product)
+	store.GET("/products/:id/images/:name", s.hdnl_store_product_image)
+	store.GET("/categories", s.hdnl_store_categories)
+
+	cart := s.V1.Group("/cart", s.optionalAuth)
+	cart.GET("", s.hdnl_get_cart)
+	cart.POST("/items", s.hdnl_add_cart_item)
+	cart.PUT("/items/:index", s.hdnl_set_cart_item)
+	cart.DELETE("/items/:index", s.hdnl_remove_cart_item)
+	cart.PUT("/coupon", s.hdnl_set_cart_coupon)
+	cart.DELETE("/coupon", s.hdnl_remove_cart_coupon)
+	cart.POST("/checkout", s.hdnl_checkout, s.requirePermission(auth.PermPlaceOrders))
+
+	checkouts := s.V1.Group("/checkouts", s.requirePermission(auth.PermPlaceOrders))
+	checkouts.GET("", s.hdnl_list_checkouts)
+	checkouts.GET("/:id", s.hdnl_get_checkout)
+	checkouts.POST("/:id/cancel", s.hdnl_cancel_checkout)
+	checkouts.POST("/:id/confirm", s.hdnl_confirm_checkout, s.requirePermission(auth.PermManageOrders))
+
+	// @info The provider authenticates by signing the payload, not with a token
+	s.V1.POST("/payments/webhook", s.hdnl_payment_webhook)
+	payments := s.V1.Group("/payments", s.requirePermission(auth.PermPlaceOrders))
+	payments.POST("", s.hdnl_start_payment)
+	payments.GET("", s.hdnl_list_payments)
+	payments.GET("/:id", s.hdnl_get_payment)
+
+	invoices := s.V1.Group("/invoices", s.requirePermission(auth.PermPlaceOrders))
+	invoices.POST("", s.hdnl_issue_invoice)
+	invoices.GET("", s.hdnl_list_invoices)
+	invoices.GET("/:id", s.hdnl_get_invoice)
+	invoices.GET("/:id/pdf", s.hdnl_invoice_pdf)
+
+	s.V1.GET("/shipping/pickup-points", s.hdnl_pickup_points)
+	shipments := s.V1.Group("/shipments", s.requirePermission(auth.PermPlaceOrders))
+	shipments.GET("", s.hdnl_list_shipments)
+	shipments.GET("/:id", s.hdnl_get_shipment)
+
+	catalog := s.V1.Group("/catalog", s.requirePermission(auth.PermEditCatalog))
+	catalog.GET("/products", s.hdnl_list_products)
+	catalog.POST("/products", s.hdnl_create_product)
+	catalog.GET("/products/:id", s.hdnl_get_product)
+	catalog.PATCH("/products/:id", s.hdnl_update_product)
+	catalog.DELETE("/products/:id", s.hdnl_delete_product)
+	catalog.POST("/products/:id/publish", s.hdnl_publish_product)
+	catalog.POST("/products/:id/unpublish", s.hdnl_unpublish_product)
+	catalog.POST("/products/:id/stock", s.hdnl_adjust_stock)
+	catalog.POST("/products/:id/images", s.hdnl_add_product_image)
+	catalog.DELETE("/products/:id/images/:name", s.hdnl_remove_product_image)
+	catalog.PUT("/categories/:slug", s.hdnl_set_category)
+	catalog.DELETE("/categories/:slug", s.hdnl_delete_category)
+
+	queue := s.V1.Group("/queue", s.requirePermission(auth.PermManagePrinters))
+	queue.GET("", s.hdnl_print_queue)
+	queue.POST("/replan", s.hdnl_replan)
+	queue.POST("/jobs/:id/start", s.hdnl_start_job)
+	queue.POST("/jobs/:id/complete", s.hdnl_complete_job)
+	queue.POST("/jobs/:id/fail", s.hdnl_fail_job)
+
+	admin := s.V1.Group("/admin")
+	admin.GET("/users", s.hdnl_list_users, s.requirePermission(auth.PermManageUsers))
+	admin.POST("/users", s.hdnl_create_user, s.requirePermission(auth.PermManageUsers))
+	admin.GET("/users/:id", s.hdnl_get_user, s.requirePermission(auth.PermManageUsers))
+	admin.PATCH("/users/:id", s.hdnl_update_user, s.requirePermission(auth.PermManageUsers))
+	admin.DELETE("/users/:id", s.hdnl_delete_user, s.requirePermission(auth.PermManageUsers))
+	admin.PUT("/users/:id/type", s.hdnl_set_user_type, s.requirePermission(auth.PermManageUsers))
+	admin.PUT("/users/:id/billing", s.hdnl_set_user_billing, s.requirePermission(auth.PermManageUsers))
+	admin.GET("/users/:id/credits", s.hdnl_user_credits, s.requirePermission(auth.PermManageUsers))
+	admin.GET("/users/:id/credits/transactions", s.hdnl_user_statement, s.requirePermission(auth.PermManageUsers))
+	admin.POST("/users/:id/credits/transactions", s.hdnl_post_credits, s.requirePermission(auth.PermAdjustCredits))
+	admin.GET("/credits/accounts", s.hdnl_credit_accounts, s.requirePermission(auth.PermViewReports))
+	admin.GET("/audit", s.hdnl_list_audit, s.requirePermission(auth.PermViewReports))
+	admin.GET("/pricing", s.hdnl_list_pricing, s.requirePermission(auth.PermManagePricing))
+	admin.POST("/pricing", s.hdnl_publish_pricing, s.requirePermission(auth.PermManagePricing))
+	admin.GET("/pricing/:version", s.hdnl_get_pricing, s.requirePermission(auth.PermManagePricing))
+	admin.GET("/coupons", s.hdnl_list_coupons, s.requirePermission(auth.PermManagePricing))
+	admin.GET("/coupons/:code", s.hdnl_get_coupon, s.requirePermission(auth.PermManagePricing))
+	admin.PUT("/coupons/:code", s.hdnl_set_coupon, s.requirePermission(auth.PermManagePricing))
+	admin.DELETE("/coupons/:code", s.hdnl_delete_coupon, s.requirePermission(auth.PermManagePricing))
+	admin.POST("/payments/reconcile", s.hdnl_reconcile_payments, s.requirePermission(auth.PermAdjustCredits))
+	admin.POST("/payments/:id/capture", s.hdnl_capture_payment, s.requirePermission(auth.PermManageOrders))
+	admin.POST("/payments/:id/refund", s.hdnl_refund_payment, s.requirePermission(auth.PermAdjustCredits))
+	admin.POST("/invoices/:id/rectify", s.hdnl_rectify_invoice, s.requirePermission(auth.PermAdjustCredits))
+	admin.POST("/shipments", s.hdnl_create_shipment, s.requirePermission(auth.PermManageOrders))
+	admin.POST("/shipments/track", s.hdnl_track_shipments, s.requirePermission(auth.PermManageOrders))
+	admin.POST("/shipments/:id/label", s.hdnl_create_label, s.requirePermission(auth.PermManageOrders))
+	admin.GET("/shipments/:id/label", s.hdnl_shipment_label, s.requirePermission(auth.PermManageOrders))
+	admin.DELETE("/shipments/:id/label", s.hdnl_cancel_label, s.requirePermission(auth.PermManageOrders))
+	admin.POST("/shipments/:id/events", s.hdnl_record_shipment_event, s.requirePermission(auth.PermManageOrders))
+	admin.POST("/shipments/:id/collect", s.hdnl_collect_shipment, s.requirePermission(auth.PermManageOrders))
+	admin.GET("/shipping/pickup-points", s.hdnl_list_pickup_points, s.requirePermission(auth.PermManagePricing))
+	admin.PUT("/shipping/pickup-points/:slug", s.hdnl_set_pickup_point, s.requirePermission(auth.PermManagePricing))
+	admin.GET("/shipping/services", s.hdnl_list_shipping_services, s.requirePermission(auth.PermManagePricing))
+	admin.PUT("/shipping/services/:code", s.hdnl_set_shipping_service, s.requirePermission(auth.PermManagePricing))
+}
+
+// @info Serves until ctx is cancelled (SIGTERM/SIGINT in main), then stops accepting connections and waits up to
+// ShutdownTimeout for in-flight requests to finish.
+func (s *Server) Run(ctx context.Context) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Echo.Start(fmt.Sprintf(":%s", s.Config.Server.Port))
+	}()
+	select {
+	case err := <-errs:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+	s.Echo.Logger.Info("Shutting down the server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Config.Server.ShutdownTimeout)
+	defer cancel()
+	return s.Echo.Shutdown(shutdownCtx)
+}
+
+func hdnl_hello_world(ectx echo.Context) error {
+	return ectx.String(http.StatusOK, "hello world!")
+}
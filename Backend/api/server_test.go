@@ -0,0 +1,187 @@
+package api_test
+
+import (
+	"3DQuest/api"
+	"3DQuest/config"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	str "strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const frontend = "https://shop.example.com"
+
+func TestMiddlewareChain(t *testing.T) {
+	s, _ := newServer(t, func(cfg *config.Config) {
+		cfg.Server.AllowedOrigins = []string{frontend}
+		cfg.Server.BodyLimit = "1K"
+	})
+	s.V1.GET("/panic", func(echo.Context) error { panic("broken handler") })
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		body    string
+		status  int
+		check   func(rec *httptest.ResponseRecorder) string // Describes what is wrong, if anything
+	}{
+		{"request ID generated", http.MethodGet, "/health", nil, "", http.StatusOK, func(rec *httptest.ResponseRecorder) string {
+			if rec.Header().Get(echo.HeaderXRequestID) == "" {
+				return "no request ID"
+			}
+			return ""
+		}},
+		{"request ID kept", http.MethodGet, "/health", map[string]string{echo.HeaderXRequestID: "req-42"}, "", http.StatusOK, func(rec *httptest.ResponseRecorder) string {
+			if id := rec.Header().Get(echo.HeaderXRequestID); id != "req-42" {
+				return "request ID " + id
+			}
+			return ""
+		}},
+		{"CORS preflight", http.MethodOptions, "/orders", map[string]string{echo.HeaderOrigin: frontend, echo.HeaderAccessControlRequestMethod: http.MethodPost,
+			echo.HeaderAccessControlRequestHeaders: "authorization,content-type"}, "", http.StatusNoContent, func(rec *httptest.ResponseRecorder) string {
+			h := rec.Header()
+			if h.Get(echo.HeaderAccessControlAllowOrigin) != frontend || h.Get(echo.HeaderAccessControlAllowCredentials) != "true" ||
+				!str.Contains(h.Get(echo.HeaderAccessControlAllowMethods), http.MethodPost) || !str.Contains(str.ToLower(h.Get(echo.HeaderAccessControlAllowHeaders)), "authorization") {
+				return fmt.Sprintf("headers %v", h)
+			}
+			return ""
+		}},
+		{"CORS on a response", http.MethodGet, "/health", map[string]string{echo.HeaderOrigin: frontend}, "", http.StatusOK, func(rec *httptest.ResponseRecorder) string {
+			if rec.Header().Get(echo.HeaderAccessControlAllowOrigin) != frontend || !str.Contains(rec.Header().Get(echo.HeaderAccessControlExposeHeaders), echo.HeaderXRequestID) {
+				return fmt.Sprintf("headers %v", rec.Header())
+			}
+			return ""
+		}},
+		{"CORS from another origin", http.MethodGet, "/health", map[string]string{echo.HeaderOrigin: "https://evil.example.com"}, "", http.StatusOK, func(rec *httptest.ResponseRecorder) string {
+			if origin := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); origin != "" {
+				return "allowed origin " + origin
+			}
+			return ""
+		}},
+		{"gzip", http.MethodGet, "/health", map[string]string{echo.HeaderAcceptEncoding: "gzip"}, "", http.StatusOK, func(rec *httptest.ResponseRecorder) string {
+			if rec.Header().Get(echo.HeaderContentEncoding) != "gzip" {
+				return "not compressed"
+			}
+			reader, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				return err.Error()
+			}
+			health := map[string]string{}
+			if err := json.NewDecoder(reader).Decode(&health); err != nil || health["status"] != "ok" {
+				return fmt.Sprintf("body %v: %v", health, err)
+			}
+			return ""
+		}},
+		{"body over the limit", http.MethodPost, "/auth/register", nil, `{"name":"` + str.Repeat("a", 2048) + `"}`, http.StatusRequestEntityTooLarge, nil},
+		{"body within the limit", http.MethodPost, "/auth/register", nil, `{"name":"a"}`, http.StatusBadRequest, nil},
+		{"panic recovered", http.MethodGet, "/panic", map[string]string{echo.HeaderXRequestID: "req-43"}, "", http.StatusInternalServerError, func(rec *httptest.ResponseRecorder) string {
+			resp := map[string]string{}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if resp["message"] != http.StatusText(http.StatusInternalServerError) || resp["request_id"] != "req-43" {
+				return fmt.Sprintf("body %s", rec.Body)
+			}
+			return ""
+		}},
+		{"unknown route", http.MethodGet, "/nothing-here", nil, "", http.StatusNotFound, func(rec *httptest.ResponseRecorder) string {
+			if !str.HasPrefix(rec.Header().Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+				return fmt.Sprintf("body %s", rec.Body)
+			}
+			return ""
+		}},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, api.V1Prefix+c.path, str.NewReader(c.body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		for name, value := range c.headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s: %d, want %d: %s", c.name, rec.Code, c.status, rec.Body)
+			continue
+		}
+		if c.check != nil {
+			if problem := c.check(rec); problem != "" {
+				t.Errorf("%s: %s", c.name, problem)
+			}
+		}
+	}
+}
+
+func TestHealthWithoutCouchDB(t *testing.T) {
+	s, client := newServer(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	client.DatabaseURL, _ = url.Parse(down.URL + "/db")
+	if rec := call(s, http.MethodGet, "/health", "", ""); rec.Code != http.StatusServiceUnavailable || !str.Contains(rec.Body.String(), `"unavailable"`) {
+		t.Errorf("health with CouchDB down: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRunShutsDownGracefully(t *testing.T) {
+	s, _ := newServer(t, func(cfg *config.Config) {
+		cfg.Server.Port = "0"
+		cfg.Server.ShutdownTimeout = 5 * time.Second
+	})
+	entered, release := make(chan struct{}), make(chan struct{})
+	s.V1.GET("/slow", func(ectx echo.Context) error {
+		close(entered)
+		<-release
+		return ectx.String(http.StatusOK, "done")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Run(ctx) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Echo.ListenerAddr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	answered := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + s.Echo.ListenerAddr().String() + api.V1Prefix + "/slow")
+		if err != nil {
+			answered <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		answered <- string(body)
+	}()
+	<-entered
+	cancel()
+	select {
+	case err := <-stopped:
+		t.Fatalf("stopped with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if body := <-answered; body != "done" {
+		t.Errorf("in-flight request answered %q", body)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the server kept running after the shutdown")
+	}
+}
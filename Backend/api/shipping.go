@@ -0,0 +1,350 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"3DQuest/shipping"
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type pickupPointsResponse struct {
+	PickupPoints []models.PickupPoint `json:"pickup_points"`
+}
+
+type shippingServicesResponse struct {
+	Services []models.ShippingService `json:"services"`
+}
+
+type deliveryOptionsResponse struct {
+	Options []models.DeliveryOption `json:"options"`
+	Parcel  shipping.Parcel         `json:"parcel"` // Estimated, what parcel services are priced for
+}
+
+type shipmentsResponse struct {
+	Shipments []models.Shipment `json:"shipments"`
+	Bookmark  string            `json:"bookmark,omitempty"`
+}
+
+type shipmentRequest struct {
+	OrderID string `json:"order_id"`
+}
+
+type labelRequest struct {
+	Parcel *shipping.Parcel `json:"parcel"` // As packed, the estimate of the order if not given
+}
+
+type collectRequest struct {
+	PickupCode string `json:"pickup_code"`
+}
+
+type trackResponse struct {
+	Updated int `json:"updated"`
+}
+
+// @info Loads the shipment if the authenticated user may see it. Other customers' shipments are reported as not found,
+// and only its customer sees the pickup code, so the prints are only handed to whoever has it.
+func (s *Server) loadShipment(ectx echo.Context) (*models.Shipment, error) {
+	shipment, err := models.GetShipment(s.Client, ectx.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	claims := CurrentUser(ectx)
+	if !claims.Can(auth.PermManageOrders) && shipment.CustomerID != claims.UserID() {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	hidePickupCode(ectx, shipment)
+	return shipment, nil
+}
+
+func hidePickupCode(ectx echo.Context, shipment *models.Shipment) {
+	if shipment.CustomerID != CurrentUser(ectx).UserID() {
+		shipment.PickupCode = ""
+	}
+}
+
+// @info Context of a call to the carrier, bounded by models.CarrierTimeout
+func carrierContext(ectx echo.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ectx.Request().Context(), models.CarrierTimeout)
+}
+
+// @info GET /api/v1/shipping/pickup-points. The pickup points in use, for everyone.
+func (s *Server) hdnl_pickup_points(ectx echo.Context) error {
+	points, err := models.ListPickupPoints(s.Client, true)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, pickupPointsResponse{PickupPoints: points})
+}
+
+// @info GET /api/v1/orders/:id/delivery-options. The pickup points and parcel services, priced for the order.
+func (s *Server) hdnl_delivery_options(ectx echo.Context) error {
+	order, err := s.loadOrder(ectx)
+	if err != nil {
+		return err
+	}
+	options, err := models.DeliveryOptions(s.Client, &s.Config.Shipping, order)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, deliveryOptionsResponse{Options: options, Parcel: models.EstimateParcel(&s.Config.Shipping, order)})
+}
+
+// @info PUT /api/v1/orders/:id/delivery {"method": "pickup", "pickup_point": "..."} or {"method": "parcel", "service":
+// "...", "address": {...}}. Only while the order is quoted and not being paid, its price is added to the cart.
+func (s *Server) hdnl_set_delivery(ectx echo.Context) error {
+	delivery := &models.OrderDelivery{}
+	if err := ectx.Bind(delivery); err != nil {
+		return err
+	}
+	if _, err := s.loadOrder(ectx); err != nil {
+		return err
+	}
+	order, err := models.SetOrderDelivery(s.Client, &s.Config.Shipping, ectx.Param("id"), delivery)
+	if err != nil {
+		return err
+	}
+	return s.orderJSON(ectx, http.StatusOK, order)
+}
+
+// @info DELETE /api/v1/orders/:id/delivery
+func (s *Server) hdnl_remove_delivery(ectx echo.Context) error {
+	if _, err := s.loadOrder(ectx); err != nil {
+		return err
+	}
+	order, err := models.SetOrderDelivery(s.Client, &s.Config.Shipping, ectx.Param("id"), nil)
+	if err != nil {
+		return err
+	}
+	return s.orderJSON(ectx, http.StatusOK, order)
+}
+
+// @info GET /api/v1/shipments?status=. Customers only see their own, staff may filter by customer_id.
+func (s *Server) hdnl_list_shipments(ectx echo.Context) error {
+	filter := &models.ShipmentFilter{CustomerID: ectx.QueryParam("customer_id"), Status: models.ShipmentStatus(ectx.QueryParam("status"))}
+	claims := CurrentUser(ectx)
+	if !claims.Can(auth.PermManageOrders) {
+		filter.CustomerID = claims.UserID()
+	}
+	shipments, bookmark, err := models.ListShipments(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	for i := range shipments {
+		hidePickupCode(ectx, &shipments[i])
+	}
+	return ectx.JSON(http.StatusOK, shipmentsResponse{Shipments: shipments, Bookmark: bookmark})
+}
+
+// @info GET /api/v1/shipments/:id
+func (s *Server) hdnl_get_shipment(ectx echo.Context) error {
+	shipment, err := s.loadShipment(ectx)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, shipment)
+}
+
+// @info POST /api/v1/admin/shipments {"order_id": "..."}. Makes the shipment of a ready order, for orders that got
+// their delivery after being ready. Asking again answers the one made.
+func (s *Server) hdnl_create_shipment(ectx echo.Context) error {
+	req := shipmentRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	order, err := models.GetOrder(s.Client, req.OrderID)
+	if err != nil {
+		return err
+	}
+	existed := order.ShipmentID != ""
+	shipment, err := models.CreateShipment(s.Client, order.ID)
+	if err != nil {
+		return err
+	}
+	hidePickupCode(ectx, shipment)
+	if existed {
+		return ectx.JSON(http.StatusOK, shipment)
+	}
+	if err := s.audit(ectx, models.AuditShipmentCreated, shipment.ID, nil, shipment); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, shipment)
+}
+
+// @info POST /api/v1/admin/shipments/:id/label {"parcel": {...}}. Buys the label of the parcel from the carrier.
+func (s *Server) hdnl_create_label(ectx echo.Context) error {
+	req := labelRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	ctx, cancel := carrierContext(ectx)
+	defer cancel()
+	shipment, err := models.CreateShipmentLabel(ctx, s.Client, s.Carrier, &s.Config.Shipping, ectx.Param("id"), req.Parcel)
+	if err != nil {
+		return err
+	}
+	hidePickupCode(ectx, shipment)
+	if err := s.audit(ectx, models.AuditLabelCreated, shipment.ID, nil, shipment); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, shipment)
+}
+
+// @info GET /api/v1/admin/shipments/:id/label. The label to print and stick on the parcel.
+func (s *Server) hdnl_shipment_label(ectx echo.Context) error {
+	shipment, err := s.loadShipment(ectx)
+	if err != nil {
+		return err
+	}
+	data, contentType, err := models.ShipmentLabel(s.Client, shipment)
+	if err != nil {
+		return err
+	}
+	ectx.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("inline; filename=%q", shipment.TrackingNumber+".pdf"))
+	return ectx.Blob(http.StatusOK, contentType, data)
+}
+
+// @info DELETE /api/v1/admin/shipments/:id/label. Voids the label while the carrier has not picked up the parcel.
+func (s *Server) hdnl_cancel_label(ectx echo.Context) error {
+	before, err := s.loadShipment(ectx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := carrierContext(ectx)
+	defer cancel()
+	shipment, err := models.CancelShipmentLabel(ctx, s.Client, s.Carrier, before.ID, CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	hidePickupCode(ectx, shipment)
+	if err := s.audit(ectx, models.AuditLabelCancelled, shipment.ID, before, shipment); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, shipment)
+}
+
+// @info POST /api/v1/admin/shipments/:id/events {"status": "in_transit", "tracking_number": "...", ...}. Records what
+// the staff know of the shipment, e.g. a parcel sent with a label bought elsewhere, or the prints arriving at the
+// pickup point. Parcels handed to the carrier ship their order.
+func (s *Server) hdnl_record_shipment_event(ectx echo.Context) error {
+	update := &models.ShipmentUpdate{}
+	if err := ectx.Bind(update); err != nil {
+		return err
+	}
+	before, err := s.loadShipment(ectx)
+	if err != nil {
+		return err
+	}
+	shipment, err := models.RecordShipmentEvent(s.Client, &s.Config.Invoice, before.ID, update, CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	hidePickupCode(ectx, shipment)
+	if err := s.audit(ectx, models.AuditShipmentEvent, shipment.ID, before, shipment); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, shipment)
+}
+
+// @info POST /api/v1/admin/shipments/:id/collect {"pickup_code": "123456"}. Hands the prints to the customer who
+// shows the code, the order is collected.
+func (s *Server) hdnl_collect_shipment(ectx echo.Context) error {
+	req := collectRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	before, err := s.loadShipment(ectx)
+	if err != nil {
+		return err
+	}
+	shipment, err := models.CollectShipment(s.Client, &s.Config.Invoice, before.ID, req.PickupCode, CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	hidePickupCode(ectx, shipment)
+	if err := s.audit(ectx, models.AuditShipmentCollected, shipment.ID, before, shipment); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, shipment)
+}
+
+// @info POST /api/v1/admin/shipments/track. Asks the carrier about its parcels now instead of waiting for
+// SHIPPING_TRACK_INTERVAL.
+func (s *Server) hdnl_track_shipments(ectx echo.Context) error {
+	if s.Tracker == nil {
+		return models.ErrNoCarrier
+	}
+	updated, err := s.Tracker.Track(ectx.Request().Context())
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, trackResponse{Updated: updated})
+}
+
+// @info GET /api/v1/admin/shipping/pickup-points. Every pickup point, the inactive ones too.
+func (s *Server) hdnl_list_pickup_points(ectx echo.Context) error {
+	points, err := models.ListPickupPoints(s.Client, false)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, pickupPointsResponse{PickupPoints: points})
+}
+
+// @info PUT /api/v1/admin/shipping/pickup-points/:slug. Creates or replaces the pickup point. They are deactivated
+// rather than deleted, shipments refer to them.
+func (s *Server) hdnl_set_pickup_point(ectx echo.Context) error {
+	point := &models.PickupPoint{}
+	if err := ectx.Bind(point); err != nil {
+		return err
+	}
+	point.Slug, point.Rev, point.UpdatedBy = ectx.Param("slug"), "", CurrentUser(ectx).UserID()
+	var before *models.PickupPoint
+	if current, err := models.GetPickupPoint(s.Client, point.Slug); err == nil {
+		before = current
+	} else if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	if err := models.SetPickupPoint(s.Client, point); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditPickupPointSet, point.ID, before, point); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, point)
+}
+
+// @info GET /api/v1/admin/shipping/services. Every parcel service, the inactive ones too.
+func (s *Server) hdnl_list_shipping_services(ectx echo.Context) error {
+	services, err := models.ListShippingServices(s.Client, false)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, shippingServicesResponse{Services: services})
+}
+
+// @info PUT /api/v1/admin/shipping/services/:code. Creates or replaces the parcel service and its rate table. Orders
+// keep the price they were given.
+func (s *Server) hdnl_set_shipping_service(ectx echo.Context) error {
+	service := &models.ShippingService{}
+	if err := ectx.Bind(service); err != nil {
+		return err
+	}
+	service.Code, service.Rev, service.UpdatedBy = ectx.Param("code"), "", CurrentUser(ectx).UserID()
+	var before *models.ShippingService
+	if current, err := models.GetShippingService(s.Client, service.Code); err == nil {
+		before = current
+	} else if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	if err := models.SetShippingService(s.Client, service); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditShippingServiceSet, service.ID, before, service); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, service)
+}
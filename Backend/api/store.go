@@ -0,0 +1,338 @@
+package api
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type productsResponse struct {
+	Products []models.Product `json:"products"`
+	Bookmark string           `json:"bookmark,omitempty"`
+}
+
+type categoriesResponse struct {
+	Categories []models.Category `json:"categories"`
+}
+
+type stockRequest struct {
+	SKU   string `json:"sku"`
+	Delta int    `json:"delta"` // Units received, or taken if negative
+}
+
+// @info Reads the filters of the product listings. Published is left to the caller.
+func productFilter(ectx echo.Context) (*models.ProductFilter, error) {
+	filter := &models.ProductFilter{
+		Query:    ectx.QueryParam("q"),
+		Category: ectx.QueryParam("category"),
+		Kind:     models.ProductKind(ectx.QueryParam("kind")),
+		Colour:   ectx.QueryParam("colour"),
+		Size:     ectx.QueryParam("size"),
+		Material: ectx.QueryParam("material"),
+		InStock:  ectx.QueryParam("in_stock") == "true",
+	}
+	if filter.Kind != "" && !models.IsProductKind(filter.Kind) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Unknown product kind")
+	}
+	var err error
+	if raw := ectx.QueryParam("min_price"); raw != "" {
+		if filter.MinPriceCents, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "min_price must be a number of cents")
+		}
+	}
+	if raw := ectx.QueryParam("max_price"); raw != "" {
+		if filter.MaxPriceCents, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "max_price must be a number of cents")
+		}
+	}
+	return filter, nil
+}
+
+// @info Drops what only the backend and the staff need from a product shown in the store. The stock shown is what is
+// not kept in carts.
+func publicProduct(product *models.Product) *models.Product {
+	now := time.Now().UTC()
+	for i := range product.Variants {
+		product.Variants[i].Stock = product.Available(product.Variants[i].SKU, "", now)
+	}
+	product.Search = ""
+	product.Reservations = nil
+	product.Attachments = nil
+	return product
+}
+
+// @info Loads a product shown in the store. Unpublished products are reported as not found.
+func (s *Server) loadPublishedProduct(ectx echo.Context) (*models.Product, error) {
+	product, err := models.GetCachedProduct(s.Client, ectx.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	if !product.Published {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Not found")
+	}
+	return product, nil
+}
+
+// @info GET /api/v1/store/products?q=&category=&kind=&colour=&size=&material=&min_price=&max_price=&in_stock=&limit=&bookmark=
+// Published products by name. Public.
+func (s *Server) hdnl_store_products(ectx echo.Context) error {
+	filter, err := productFilter(ectx)
+	if err != nil {
+		return err
+	}
+	published := true
+	filter.Published = &published
+	products, bookmark, err := models.ListProducts(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		publicProduct(&products[i])
+	}
+	return ectx.JSON(http.StatusOK, productsResponse{Products: products, Bookmark: bookmark})
+}
+
+// @info GET /api/v1/store/products/:id. Public.
+func (s *Server) hdnl_store_product(ectx echo.Context) error {
+	product, err := s.loadPublishedProduct(ectx)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, publicProduct(product))
+}
+
+// @info GET /api/v1/store/products/:id/images/:name. Public. Images are named after their content, so they can be
+// cached for good.
+func (s *Server) hdnl_store_product_image(ectx echo.Context) error {
+	product, err := s.loadPublishedProduct(ectx)
+	if err != nil {
+		return err
+	}
+	data, contentType, err := models.GetProductImage(s.Client, product, ectx.Param("name"))
+	if err != nil {
+		return err
+	}
+	ectx.Response().Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	return ectx.Blob(http.StatusOK, contentType, data)
+}
+
+// @info GET /api/v1/store/categories. Public.
+func (s *Server) hdnl_store_categories(ectx echo.Context) error {
+	categories, err := models.ListCategories(s.Client)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, categoriesResponse{Categories: categories})
+}
+
+// @info GET /api/v1/catalog/products?published=&...&limit=&bookmark=. Every product, with the filters of the store.
+func (s *Server) hdnl_list_products(ectx echo.Context) error {
+	filter, err := productFilter(ectx)
+	if err != nil {
+		return err
+	}
+	switch ectx.QueryParam("published") {
+	case "":
+	case "true", "false":
+		published := ectx.QueryParam("published") == "true"
+		filter.Published = &published
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "published must be true or false")
+	}
+	products, bookmark, err := models.ListProducts(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, productsResponse{Products: products, Bookmark: bookmark})
+}
+
+// @info POST /api/v1/catalog/products. New products are unpublished and have no images.
+func (s *Server) hdnl_create_product(ectx echo.Context) error {
+	product := &models.Product{}
+	if err := ectx.Bind(product); err != nil {
+		return err
+	}
+	product.ID, product.Rev = "", ""
+	if err := models.CreateProduct(s.Client, product); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditProductCreated, product.ID, nil, product); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, product)
+}
+
+// @info GET /api/v1/catalog/products/:id
+func (s *Server) hdnl_get_product(ectx echo.Context) error {
+	product, err := models.GetProduct(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, product)
+}
+
+// @info PATCH /api/v1/catalog/products/:id. Only the fields sent are changed. Variants keep their stock, see
+// hdnl_adjust_stock.
+func (s *Server) hdnl_update_product(ectx echo.Context) error {
+	update := &models.ProductUpdate{}
+	if err := ectx.Bind(update); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetProduct(s.Client, id)
+	if err != nil {
+		return err
+	}
+	product, err := models.UpdateProduct(s.Client, id, update)
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditProductUpdated, id, before, product); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, product)
+}
+
+// @info DELETE /api/v1/catalog/products/:id. Only unpublished products.
+func (s *Server) hdnl_delete_product(ectx echo.Context) error {
+	product, err := models.DeleteProduct(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditProductDeleted, product.ID, product, nil); err != nil {
+		return err
+	}
+	return ectx.NoContent(http.StatusNoContent)
+}
+
+// @info POST /api/v1/catalog/products/:id/publish
+func (s *Server) hdnl_publish_product(ectx echo.Context) error {
+	return s.setPublished(ectx, true, models.AuditProductPublished)
+}
+
+// @info POST /api/v1/catalog/products/:id/unpublish
+func (s *Server) hdnl_unpublish_product(ectx echo.Context) error {
+	return s.setPublished(ectx, false, models.AuditProductHidden)
+}
+
+func (s *Server) setPublished(ectx echo.Context, published bool, action string) error {
+	before, err := models.GetProduct(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	product, err := models.PublishProduct(s.Client, before.ID, published)
+	if err != nil {
+		return err
+	}
+	if before.Published != product.Published {
+		if err := s.audit(ectx, action, product.ID, before, product); err != nil {
+			return err
+		}
+	}
+	return ectx.JSON(http.StatusOK, product)
+}
+
+// @info POST /api/v1/catalog/products/:id/stock {"sku": "...", "delta": 10}. Relative, so it can't undo a sale made
+// in between.
+func (s *Server) hdnl_adjust_stock(ectx echo.Context) error {
+	req := stockRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetProduct(s.Client, id)
+	if err != nil {
+		return err
+	}
+	product, err := models.AdjustProductStock(s.Client, id, req.SKU, req.Delta)
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditStockAdjusted, id, before.Variant(req.SKU), product.Variant(req.SKU)); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, product)
+}
+
+// @info POST /api/v1/catalog/products/:id/images, multipart with the image in the "file" field and its "alt" text
+func (s *Server) hdnl_add_product_image(ectx echo.Context) error {
+	header, err := ectx.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing the image file")
+	}
+	if header.Size > models.MaxProductImageBytes {
+		return models.ErrImageTooLarge
+	}
+	data, err := readUpload(header)
+	if err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetProduct(s.Client, id)
+	if err != nil {
+		return err
+	}
+	product, err := models.AddProductImage(s.Client, id, data, ectx.FormValue("alt"))
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditProductUpdated, id, before.Images, product.Images); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, product)
+}
+
+// @info DELETE /api/v1/catalog/products/:id/images/:name
+func (s *Server) hdnl_remove_product_image(ectx echo.Context) error {
+	id := ectx.Param("id")
+	before, err := models.GetProduct(s.Client, id)
+	if err != nil {
+		return err
+	}
+	product, err := models.RemoveProductImage(s.Client, id, ectx.Param("name"))
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditProductUpdated, id, before.Images, product.Images); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, product)
+}
+
+// @info PUT /api/v1/catalog/categories/:slug {"name": "Figures", "description": "...", "position": 1}
+func (s *Server) hdnl_set_category(ectx echo.Context) error {
+	category := &models.Category{}
+	if err := ectx.Bind(category); err != nil {
+		return err
+	}
+	category.Slug, category.Rev = ectx.Param("slug"), ""
+	var before *models.Category
+	if current, err := models.GetCategory(s.Client, category.Slug); err == nil {
+		before = current
+	} else if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	if err := models.SetCategory(s.Client, category); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditCategorySet, category.ID, before, category); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, category)
+}
+
+// @info DELETE /api/v1/catalog/categories/:slug. Only categories without products.
+func (s *Server) hdnl_delete_category(ectx echo.Context) error {
+	category, err := models.DeleteCategory(s.Client, ectx.Param("slug"))
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditCategoryDeleted, category.ID, category, nil); err != nil {
+		return err
+	}
+	return ectx.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"3DQuest/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultSeriesLimit = 1440 // A day of samples at the default MQTT_SAMPLE_INTERVAL of a minute
+	maxSeriesLimit     = 10000
+)
+
+type seriesResponse struct {
+	PrinterID string                   `json:"printer_id"`
+	From      time.Time                `json:"from"`
+	To        time.Time                `json:"to"`
+	Samples   []models.TelemetrySample `json:"samples"`
+}
+
+type alertsResponse struct {
+	Alerts   []models.PrinterAlert `json:"alerts"`
+	Bookmark string                `json:"bookmark,omitempty"`
+}
+
+// @info GET /api/v1/printers/:id/state. What the printer last published over MQTT.
+func (s *Server) hdnl_printer_state(ectx echo.Context) error {
+	printer, err := models.GetPrinter(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	state, err := models.GetPrinterState(s.Client, printer.ID)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, state)
+}
+
+// @info GET /api/v1/printers/:id/series?from=&to=&limit=. Samples of the printer between two RFC 3339 times, oldest
+// first. Defaults to the last 24 hours.
+func (s *Server) hdnl_printer_series(ectx echo.Context) error {
+	printer, err := models.GetPrinter(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	to, err := parseTime(ectx.QueryParam("to"), time.Now())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "to must be an RFC 3339 time")
+	}
+	from, err := parseTime(ectx.QueryParam("from"), to.Add(-24*time.Hour))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be an RFC 3339 time")
+	}
+	if !from.Before(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+	limit, err := strconv.ParseUint(ectx.QueryParam("limit"), 10, 64)
+	if err != nil || limit == 0 {
+		limit = defaultSeriesLimit
+	}
+	if limit > maxSeriesLimit {
+		limit = maxSeriesLimit
+	}
+	samples, err := models.ListTelemetrySamples(s.Client, printer.ID, from, to, limit)
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, seriesResponse{PrinterID: printer.ID, From: from, To: to, Samples: samples})
+}
+
+// @info GET /api/v1/alerts?printer_id=&status=&limit=&bookmark=. status=active lists those not resolved yet.
+func (s *Server) hdnl_list_alerts(ectx echo.Context) error {
+	filter := &models.AlertFilter{PrinterID: ectx.QueryParam("printer_id")}
+	switch status := models.AlertStatus(ectx.QueryParam("status")); status {
+	case "":
+	case "active":
+		filter.Active = true
+	case models.AlertOpen, models.AlertAcknowledged, models.AlertResolved:
+		filter.Status = status
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown alert status")
+	}
+	alerts, bookmark, err := models.ListPrinterAlerts(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, alertsResponse{Alerts: alerts, Bookmark: bookmark})
+}
+
+// @info GET /api/v1/alerts/:id
+func (s *Server) hdnl_get_alert(ectx echo.Context) error {
+	alert, err := models.GetPrinterAlert(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, alert)
+}
+
+// @info POST /api/v1/alerts/:id/acknowledge. The alert stays until its condition clears, nobody else needs to look.
+func (s *Server) hdnl_acknowledge_alert(ectx echo.Context) error {
+	before, err := models.GetPrinterAlert(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	alert, err := models.AcknowledgePrinterAlert(s.Client, before.ID, CurrentUser(ectx).UserID())
+	if err != nil {
+		return err
+	}
+	if before.Status != alert.Status {
+		if err := s.audit(ectx, models.AuditAlertAcknowledged, alert.ID, before, alert); err != nil {
+			return err
+		}
+	}
+	return ectx.JSON(http.StatusOK, alert)
+}
+
+// @info Parses an RFC 3339 time to the second, or returns fallback if raw is empty
+func parseTime(raw string, fallback time.Time) (time.Time, error) {
+	if raw == "" {
+		return fallback.UTC().Truncate(time.Second), nil
+	}
+	parsed, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return parsed, err
+	}
+	return parsed.UTC().Truncate(time.Second), nil
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"3DQuest/auth"
+	"3DQuest/models"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+type createUserRequest struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	EMAIL    string `json:"email"`
+	Password string `json:"password"`
+	NIF      string `json:"nif"`
+}
+
+type usersResponse struct {
+	Users    []models.UserProfile `json:"users"`
+	Bookmark string               `json:"bookmark,omitempty"`
+}
+
+// @info GET /api/v1/admin/users?type=&email=&include_deleted=&limit=&bookmark=
+func (s *Server) hdnl_list_users(ectx echo.Context) error {
+	filter := &models.UserFilter{Type: ectx.QueryParam("type"), EMAIL: ectx.QueryParam("email")}
+	if filter.Type != "" && !models.IsUserType(filter.Type) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown user type")
+	}
+	filter.IncludeDeleted, _ = strconv.ParseBool(ectx.QueryParam("include_deleted"))
+	users, bookmark, err := models.ListUsers(s.Client, filter, parseLimit(ectx.QueryParam("limit")), ectx.QueryParam("bookmark"))
+	if err != nil {
+		return err
+	}
+	resp := usersResponse{Users: []models.UserProfile{}, Bookmark: bookmark}
+	for _, usr := range users {
+		resp.Users = append(resp.Users, usr.Profile())
+	}
+	return ectx.JSON(http.StatusOK, resp)
+}
+
+// @info GET /api/v1/admin/users/:id
+func (s *Server) hdnl_get_user(ectx echo.Context) error {
+	usr, err := models.GetUser(s.Client, ectx.Param("id"))
+	if err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, usr.Profile())
+}
+
+// @info POST /api/v1/admin/users. Unlike register, admins may create users of any type.
+func (s *Server) hdnl_create_user(ectx echo.Context) error {
+	req := createUserRequest{}
+	if err := ectx.Bind(&req); err != nil {
+		return err
+	}
+	if !models.IsUserType(req.Type) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown user type")
+	}
+	if err := auth.CheckPasswordStrength(req.Password); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	usr := &models.User{Type: req.Type, Name: req.Name, NIF: req.NIF, EMAIL: req.EMAIL, PSWD_HASH: hash}
+	if err := models.CreateUser(s.Client, usr); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditUserCreated, usr.ID, nil, usr.Profile()); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusCreated, usr.Profile())
+}
+
+// @info PATCH /api/v1/admin/users/:id. Only the fields sent are changed, the type has its own endpoint.
+func (s *Server) hdnl_update_user(ectx echo.Context) error {
+	update := models.ProfileUpdate{}
+	if err := ectx.Bind(&update); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetUser(s.Client, id)
+	if err != nil {
+		return err
+	}
+	usr, err := models.UpdateUserProfile(s.Client, id, &update)
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditUserUpdated, id, before.Profile(), usr.Profile()); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, usr.Profile())
+}
+
+// @info PUT /api/v1/admin/users/:id/billing
+func (s *Server) hdnl_set_user_billing(ectx echo.Context) error {
+	billing := &models.BillingProfile{}
+	if err := ectx.Bind(billing); err != nil {
+		return err
+	}
+	id := ectx.Param("id")
+	before, err := models.GetUser(s.Client, id)
+	if err != nil {
+		return err
+	}
+	usr, err := models.SetBillingProfile(s.Client, id, billing)
+	if err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditUserUpdated, id, before.Billing, usr.Billing); err != nil {
+		return err
+	}
+	return ectx.JSON(http.StatusOK, usr.Profile())
+}
+
+// @info DELETE /api/v1/admin/users/:id. Admins delete their own account through DELETE /api/v1/auth/me.
+func (s *Server) hdnl_delete_user(ectx echo.Context) error {
+	id := ectx.Param("id")
+	if id == CurrentUser(ectx).UserID() {
+		return echo.NewHTTPError(http.StatusForbidden, "Use /auth/me to delete your own account")
+	}
+	if err := s.deleteUser(ectx, id); err != nil {
+		return err
+	}
+	return ectx.NoContent(http.StatusNoContent)
+}
+
+// @info Soft-deletes the user, audits it and revokes its sessions
+func (s *Server) deleteUser(ectx echo.Context, id string) error {
+	if err := models.DeleteUser(s.Client, id); err != nil {
+		return err
+	}
+	if err := s.audit(ectx, models.AuditUserDeleted, id, nil, nil); err != nil {
+		return err
+	}
+	return s.Tokens.RevokeUserSessions(id)
+}
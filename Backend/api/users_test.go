@@ -0,0 +1,94 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	str "strings"
+	"testing"
+)
+
+func TestUserEndpoints(t *testing.T) {
+	s, _ := newServer(t)
+	admin, adminToken := newSession(t, s, "admin")
+	customer, customerToken := newSession(t, s, "user")
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"create", http.MethodPost, "/admin/users", adminToken, `{"type":"operator","name":"Olga","email":"Olga@Example.com","password":"correct horse"}`, http.StatusCreated},
+		{"create with a taken email", http.MethodPost, "/admin/users", adminToken, `{"type":"user","name":"Other","email":"olga@example.com","password":"correct horse"}`, http.StatusConflict},
+		{"create of an unknown type", http.MethodPost, "/admin/users", adminToken, `{"type":"wizard","name":"Merlin","email":"merlin@example.com","password":"correct horse"}`, http.StatusBadRequest},
+		{"create with a weak password", http.MethodPost, "/admin/users", adminToken, `{"type":"user","name":"Weak","email":"weak@example.com","password":"1234"}`, http.StatusBadRequest},
+		{"create without a name", http.MethodPost, "/admin/users", adminToken, `{"type":"user","name":"","email":"noname@example.com","password":"correct horse"}`, http.StatusUnprocessableEntity},
+		{"list of an unknown type", http.MethodGet, "/admin/users?type=wizard", adminToken, "", http.StatusBadRequest},
+		{"get", http.MethodGet, "/admin/users/" + customer.ID, adminToken, "", http.StatusOK},
+		{"get someone missing", http.MethodGet, "/admin/users/nobody", adminToken, "", http.StatusNotFound},
+		{"update", http.MethodPatch, "/admin/users/" + customer.ID, adminToken, `{"name":"Renamed"}`, http.StatusOK},
+		{"update to a taken email", http.MethodPatch, "/admin/users/" + customer.ID, adminToken, `{"email":"admin@example.com"}`, http.StatusConflict},
+		{"update of the own profile", http.MethodPatch, "/auth/me", customerToken, `{"name":"Customer","email":"customer@example.org"}`, http.StatusOK},
+		{"own email taken", http.MethodPatch, "/auth/me", customerToken, `{"email":"olga@example.com"}`, http.StatusConflict},
+		{"others may not be updated", http.MethodPatch, "/admin/users/" + admin.ID, customerToken, `{"name":"Hacked"}`, http.StatusForbidden},
+		{"deleting oneself as an admin", http.MethodDelete, "/admin/users/" + admin.ID, adminToken, "", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if rec := call(s, c.method, c.path, c.token, c.body); rec.Code != c.status {
+			t.Errorf("%s: %d, want %d: %s", c.name, rec.Code, c.status, rec.Body)
+		}
+	}
+
+	rec := call(s, http.MethodGet, "/auth/me", customerToken, "")
+	me := map[string]interface{}{}
+	json.Unmarshal(rec.Body.Bytes(), &me)
+	if me["name"] != "Customer" || me["email"] != "customer@example.org" || me["password_hash"] != nil {
+		t.Errorf("own profile %s", rec.Body)
+	}
+
+	// @info Paged through, two users at a time
+	seen := map[string]bool{}
+	bookmark := ""
+	for page := 0; page < 5; page++ {
+		rec := call(s, http.MethodGet, "/admin/users?limit=2&bookmark="+url.QueryEscape(bookmark), adminToken, "")
+		resp := struct {
+			Users []struct {
+				ID string `json:"id"`
+			} `json:"users"`
+			Bookmark string `json:"bookmark"`
+		}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("page %d: %d %s", page, rec.Code, rec.Body)
+		}
+		for _, usr := range resp.Users {
+			seen[usr.ID] = true
+		}
+		if len(resp.Users) < 2 {
+			break
+		}
+		bookmark = resp.Bookmark
+	}
+	if len(seen) != 3 {
+		t.Errorf("%d users listed, want admin, customer and the one created", len(seen))
+	}
+	if rec := call(s, http.MethodGet, "/admin/users?email=Olga@example.com", adminToken, ""); rec.Code != http.StatusOK || str.Count(rec.Body.String(), `"id"`) != 1 {
+		t.Errorf("by email: %d %s", rec.Code, rec.Body)
+	}
+
+	// @info Deleting the own account closes every session
+	if rec := call(s, http.MethodDelete, "/auth/me", customerToken, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleting the own account: %d %s", rec.Code, rec.Body)
+	}
+	if rec := call(s, http.MethodGet, "/auth/me", customerToken, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("deleted account: %d, want 401", rec.Code)
+	}
+	if rec := call(s, http.MethodGet, "/admin/users/"+customer.ID, adminToken, ""); rec.Code != http.StatusOK {
+		t.Errorf("deleted user, as seen by admins: %d", rec.Code)
+	}
+	if rec := call(s, http.MethodGet, "/admin/users", adminToken, ""); rec.Code != http.StatusOK || str.Contains(rec.Body.String(), customer.ID) {
+		t.Errorf("deleted user listed: %s", rec.Body)
+	}
+}
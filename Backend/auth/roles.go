@@ -0,0 +1,67 @@
+package auth
+
+import "sort"
+
+// @info Every action guarded by the API. A user may do something if the permission is granted to its type.
+type Permission string
+
+const (
+	PermPlaceOrders    Permission = "orders:place"     // Upload models, request quotes and buy in the store
+	PermManageOrders   Permission = "orders:manage"    // Move any order through its lifecycle
+	PermManagePrinters Permission = "printers:manage"  // Register printers and run the print queue
+	PermApproveQuotes  Permission = "quotes:approve"   // Review and override automatic quotes
+	PermEditCatalog    Permission = "catalog:edit"     // Products, prices and stock of the store
+	PermViewReports    Permission = "reports:view"     // Sales, usage and audit reports
+	PermAdjustCredits  Permission = "credits:adjust"   // Manual credit adjustments and refunds
+	PermManageUsers    Permission = "users:manage"     // List users and change their type
+	PermManagePricing  Permission = "pricing:manage"   // Tariffs, promotions, coupons and delivery rates
+	PermManageStock    Permission = "materials:manage" // Filament spools and inventory
+)
+
+// @info Permissions of customers. Every customer type (ASCFI, CREA...) gets the same ones, they only differ on discounts
+var customerPermissions = []Permission{PermPlaceOrders}
+
+// @info Permissions of the print shop staff
+var operatorPermissions = []Permission{
+	PermPlaceOrders, PermManageOrders, PermManagePrinters, PermApproveQuotes, PermViewReports, PermManageStock,
+}
+
+var allPermissions = []Permission{
+	PermPlaceOrders, PermManageOrders, PermManagePrinters, PermApproveQuotes, PermEditCatalog,
+	PermViewReports, PermAdjustCredits, PermManageUsers, PermManagePricing, PermManageStock,
+}
+
+// @info User type (the "type" field of the user document) => permissions. Types not listed here have none.
+var rolePermissions = map[string][]Permission{
+	"admin":    allPermissions,
+	"operator": operatorPermissions,
+	"user":     customerPermissions,
+	"ascfi":    customerPermissions,
+	"crea":     customerPermissions,
+	"asoc":     customerPermissions,
+	"academic": customerPermissions,
+}
+
+func HasPermission(userType string, perm Permission) bool {
+	for _, granted := range rolePermissions[userType] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Claims) Can(perm Permission) bool {
+	return c != nil && HasPermission(c.Type, perm)
+}
+
+// @info Permissions granted to every user type, sorted by type
+func RolePermissions() map[string][]Permission {
+	roles := make(map[string][]Permission, len(rolePermissions))
+	for userType, perms := range rolePermissions {
+		sorted := append([]Permission{}, perms...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		roles[userType] = sorted
+	}
+	return roles
+}
@@ -0,0 +1,68 @@
+package auth_test
+
+import (
+	"3DQuest/auth"
+	"3DQuest/models"
+	"sort"
+	"testing"
+)
+
+func TestHasPermission(t *testing.T) {
+	customers := []string{"user", "ascfi", "crea", "asoc", "academic"}
+	cases := []struct {
+		perm    auth.Permission
+		granted []string // User types, the rest are refused
+	}{
+		{auth.PermPlaceOrders, append([]string{"operator", "admin"}, customers...)},
+		{auth.PermManageOrders, []string{"operator", "admin"}},
+		{auth.PermManagePrinters, []string{"operator", "admin"}},
+		{auth.PermApproveQuotes, []string{"operator", "admin"}},
+		{auth.PermViewReports, []string{"operator", "admin"}},
+		{auth.PermManageStock, []string{"operator", "admin"}},
+		{auth.PermEditCatalog, []string{"admin"}},
+		{auth.PermAdjustCredits, []string{"admin"}},
+		{auth.PermManageUsers, []string{"admin"}},
+		{auth.PermManagePricing, []string{"admin"}},
+	}
+	// @info Unknown and legacy capitalised types get nothing, see models.NormalizeUserTypes
+	userTypes := append([]string{"Admin", "ADMIN", "", "wizard"}, models.UserTypes...)
+	for _, c := range cases {
+		for _, userType := range userTypes {
+			want := false
+			for _, granted := range c.granted {
+				want = want || granted == userType
+			}
+			if got := auth.HasPermission(userType, c.perm); got != want {
+				t.Errorf("%s of %q: %v, want %v", c.perm, userType, got, want)
+			}
+			if got := (&auth.Claims{Type: userType}).Can(c.perm); got != want {
+				t.Errorf("claims of %q can %s: %v, want %v", userType, c.perm, got, want)
+			}
+		}
+		var nobody *auth.Claims
+		if nobody.Can(c.perm) {
+			t.Errorf("no claims can %s", c.perm)
+		}
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	roles := auth.RolePermissions()
+	for _, userType := range models.UserTypes {
+		perms, ok := roles[userType]
+		if !ok || len(perms) == 0 {
+			t.Errorf("user type %s has no role", userType)
+		}
+		if !sort.SliceIsSorted(perms, func(i, j int) bool { return perms[i] < perms[j] }) {
+			t.Errorf("permissions of %s not sorted: %v", userType, perms)
+		}
+	}
+	if len(roles) != len(models.UserTypes) {
+		t.Errorf("%d roles for %d user types", len(roles), len(models.UserTypes))
+	}
+	// @info Callers get copies
+	roles["user"][0] = auth.PermManageUsers
+	if auth.HasPermission("user", auth.PermManageUsers) || auth.RolePermissions()["user"][0] == auth.PermManageUsers {
+		t.Error("changing the returned roles changed the permissions")
+	}
+}
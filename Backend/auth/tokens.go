@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("Invalid email or password")
+	ErrInvalidToken       = errors.New("Invalid or expired token")
+)
+
+// @info Claims of the access tokens. The subject is the user ID.
+type Claims struct {
+	Email string `json:"email"`
+	Type  string `json:"type"` // User type at the time the token was issued
+	jwt.RegisteredClaims
+}
+
+func (c *Claims) UserID() string {
+	return c.Subject
+}
+
+// @info Refresh tokens are opaque random strings. Only their SHA-256 is stored, as the ID of a refresh_token document,
+// so a leaked database does not leak usable tokens. Every refresh rotates the token: the old one is marked as replaced
+// and a new one is issued in the same family. Presenting an already replaced token means it was stolen (or replayed),
+// so the whole family is revoked and the user has to log in again.
+type RefreshToken struct {
+	ID         string     `json:"_id"`
+	Rev        string     `json:"_rev,omitempty"`
+	Type       string     `json:"type"`
+	UserID     string     `json:"user_id"`
+	Family     string     `json:"family"` // Shared by every token rotated from the same login
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	ReplacedBy string     `json:"replaced_by,omitempty"`
+}
+
+const refreshTokenDocType = "refresh_token"
+
+// @info Everything a client needs after logging in or refreshing
+type Session struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+}
+
+type TokenManager struct {
+	client *dbdriver.CouchDBClient
+	cfg    *config.AuthConfig
+}
+
+func NewTokenManager(client *dbdriver.CouchDBClient, cfg *config.AuthConfig) *TokenManager {
+	return &TokenManager{client: client, cfg: cfg}
+}
+
+// @info Checks the credentials and opens a new session (a new refresh token family)
+func (m *TokenManager) Login(email string, password string) (*Session, *models.User, error) {
+	usr, err := models.GetUserByEmail(m.client, email)
+	if err != nil {
+		return nil, nil, err
+	}
+	if usr == nil || usr.IsDeleted() {
+		VerifyPassword(password, dummyHash)
+		return nil, nil, ErrInvalidCredentials
+	}
+	ok, err := VerifyPassword(password, usr.PSWD_HASH)
+	if err != nil || !ok {
+		return nil, nil, ErrInvalidCredentials
+	}
+	session, err := m.NewSession(usr)
+	return session, usr, err
+}
+
+func (m *TokenManager) NewSession(usr *models.User) (*Session, error) {
+	family, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	return m.issue(usr, family)
+}
+
+// @info Exchanges a refresh token for a new session, rotating the refresh token
+func (m *TokenManager) Refresh(refreshToken string) (*Session, *models.User, error) {
+	token, err := m.getRefreshToken(refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if token.RevokedAt != nil {
+		if token.ReplacedBy != "" {
+			m.revokeFamily(token.Family) // @info Reuse of a rotated token, see RefreshToken
+		}
+		return nil, nil, ErrInvalidToken
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, nil, ErrInvalidToken
+	}
+	usr, err := models.GetCachedUser(m.client, token.UserID)
+	if err != nil {
+		if dbdriver.IsNotFound(err) {
+			return nil, nil, ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+	if usr.IsDeleted() {
+		return nil, nil, ErrInvalidToken
+	}
+
+	session, err := m.issue(usr, token.Family)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = dbdriver.UpdateDocument(m.client, token.ID, func(doc dbdriver.GenericDocument) error {
+		if _, revoked := doc["revoked_at"]; revoked {
+			return ErrInvalidToken // Someone else rotated it at the same time
+		}
+		doc["revoked_at"] = time.Now().UTC()
+		doc["replaced_by"] = hashToken(session.RefreshToken)
+		return nil
+	})
+	if err != nil {
+		m.revokeToken(hashToken(session.RefreshToken))
+		return nil, nil, err
+	}
+	return session, usr, nil
+}
+
+// @info Revokes the session the refresh token belongs to (its whole family). Unknown tokens are ignored.
+func (m *TokenManager) Logout(refreshToken string) error {
+	token, err := m.getRefreshToken(refreshToken)
+	if errors.Is(err, ErrInvalidToken) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return m.revokeFamily(token.Family)
+}
+
+// @info Revokes every session of the user, e.g. after a password change or when the account is deleted
+func (m *TokenManager) RevokeUserSessions(userID string) error {
+	return m.revokeWhere(map[string]interface{}{"type": refreshTokenDocType, "user_id": userID})
+}
+
+func (m *TokenManager) ParseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+		}
+		return []byte(m.cfg.JWTSecret), nil
+	})
+	if err != nil || !token.Valid || !claims.VerifyIssuer(m.cfg.Issuer, true) || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func (m *TokenManager) issue(usr *models.User, family string) (*Session, error) {
+	now := time.Now()
+	expiresAt := now.Add(m.cfg.AccessTokenTTL)
+	claims := &Claims{
+		Email: usr.EMAIL,
+		Type:  usr.Type,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.cfg.Issuer,
+			Subject:   usr.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(m.cfg.JWTSecret))
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	doc := dbdriver.GenericDocument{
+		"type":       refreshTokenDocType,
+		"user_id":    usr.ID,
+		"family":     family,
+		"created_at": now.UTC(),
+		"expires_at": now.Add(m.cfg.RefreshTokenTTL).UTC(),
+	}
+	if _, err := dbdriver.CreateOrModifyDocument(m.client, &doc, hashToken(refreshToken)); err != nil {
+		return nil, err
+	}
+	return &Session{AccessToken: accessToken, TokenType: "Bearer", ExpiresAt: expiresAt, RefreshToken: refreshToken}, nil
+}
+
+func (m *TokenManager) getRefreshToken(refreshToken string) (*RefreshToken, error) {
+	token := &RefreshToken{}
+	if refreshToken == "" {
+		return token, ErrInvalidToken
+	}
+	doc, err := dbdriver.GetDocument(m.client, hashToken(refreshToken))
+	if dbdriver.IsNotFound(err) {
+		return token, ErrInvalidToken
+	}
+	if err != nil {
+		return token, err
+	}
+	if err := dbdriver.DecodeDocument(doc, token); err != nil || token.Type != refreshTokenDocType {
+		return token, ErrInvalidToken
+	}
+	return token, nil
+}
+
+func (m *TokenManager) revokeFamily(family string) error {
+	return m.revokeWhere(map[string]interface{}{"type": refreshTokenDocType, "family": family})
+}
+
+func (m *TokenManager) revokeWhere(selector map[string]interface{}) error {
+	selector["revoked_at"] = map[string]interface{}{"$exists": false}
+	for {
+		found, err := dbdriver.FindInDatabase(m.client, &dbdriver.FindOptions{Selector: selector, Limit: 100, Fields: []string{"_id"}})
+		if err != nil {
+			return err
+		}
+		if len(found.Docs) == 0 {
+			return nil
+		}
+		for _, doc := range found.Docs {
+			id, _ := doc["_id"].(string)
+			if err := m.revokeToken(id); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *TokenManager) revokeToken(id string) error {
+	_, err := dbdriver.UpdateDocument(m.client, id, func(doc dbdriver.GenericDocument) error {
+		if _, revoked := doc["revoked_at"]; !revoked {
+			doc["revoked_at"] = time.Now().UTC()
+		}
+		return nil
+	})
+	if dbdriver.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return refreshTokenDocType + ":" + hex.EncodeToString(sum[:])
+}
+
+func randomToken(size int) (string, error) {
+	buff := make([]byte, size)
+	if _, err := rand.Read(buff); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buff), nil
+}
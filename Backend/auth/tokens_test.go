@@ -0,0 +1,210 @@
+package auth_test
+
+import (
+	"3DQuest/auth"
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/dbdriver/fake"
+	"3DQuest/models"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const secret = "a-secret-long-enough-to-sign-tokens"
+
+var authConfig = &config.AuthConfig{JWTSecret: secret, Issuer: "3DQuest", AccessTokenTTL: time.Minute, RefreshTokenTTL: time.Hour}
+
+func newCouch(t *testing.T) *dbdriver.CouchDBClient {
+	t.Helper()
+	server := httptest.NewServer(fake.NewCouch())
+	t.Cleanup(server.Close)
+	client, err := fake.Client(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func newUser(t *testing.T, client *dbdriver.CouchDBClient, email string, password string) *models.User {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr := &models.User{Type: "user", Name: email, EMAIL: email, PSWD_HASH: hash}
+	if err := models.CreateUser(client, usr); err != nil {
+		t.Fatal(err)
+	}
+	return usr
+}
+
+func TestLogin(t *testing.T) {
+	client := newCouch(t)
+	tokens := auth.NewTokenManager(client, authConfig)
+	alice := newUser(t, client, "alice@example.com", "correct horse")
+	deleted := newUser(t, client, "bob@example.com", "correct horse")
+	if err := models.DeleteUser(client, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		email    string
+		password string
+		fails    bool
+	}{
+		{"right password", "alice@example.com", "correct horse", false},
+		{"email as typed", " Alice@Example.com ", "correct horse", false},
+		{"wrong password", "alice@example.com", "battery staple", true},
+		{"unknown email", "carol@example.com", "correct horse", true},
+		{"deleted user", "bob@example.com", "correct horse", true},
+	}
+	for _, c := range cases {
+		session, usr, err := tokens.Login(c.email, c.password)
+		if c.fails {
+			if !errors.Is(err, auth.ErrInvalidCredentials) {
+				t.Errorf("%s: error %v, want invalid credentials", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		claims, err := tokens.ParseAccessToken(session.AccessToken)
+		if err != nil || usr.ID != alice.ID || claims.UserID() != alice.ID || claims.Type != "user" || session.RefreshToken == "" {
+			t.Errorf("%s: session %+v of %s, claims %+v: %v", c.name, session, usr.ID, claims, err)
+		}
+	}
+}
+
+func TestParseAccessToken(t *testing.T) {
+	client := newCouch(t)
+	alice := newUser(t, client, "alice@example.com", "correct horse")
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.RegisteredClaims) string {
+		token, err := jwt.NewWithClaims(method, &auth.Claims{Type: "admin", RegisteredClaims: claims}).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	now := time.Now()
+	valid := jwt.RegisteredClaims{Issuer: "3DQuest", Subject: alice.ID, ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute))}
+	expired, otherIssuer, noSubject := valid, valid, valid
+	expired.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute))
+	otherIssuer.Issuer = "someone-else"
+	noSubject.Subject = ""
+	cases := []struct {
+		name  string
+		token string
+		fails bool
+	}{
+		{"valid", sign(jwt.SigningMethodHS256, []byte(secret), valid), false},
+		{"other secret", sign(jwt.SigningMethodHS256, []byte("another-secret-long-enough-to-sign"), valid), true},
+		{"unsigned", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid), true},
+		{"expired", sign(jwt.SigningMethodHS256, []byte(secret), expired), true},
+		{"other issuer", sign(jwt.SigningMethodHS256, []byte(secret), otherIssuer), true},
+		{"no subject", sign(jwt.SigningMethodHS256, []byte(secret), noSubject), true},
+		{"not a token", "not-a-token", true},
+	}
+	tokens := auth.NewTokenManager(client, authConfig)
+	for _, c := range cases {
+		claims, err := tokens.ParseAccessToken(c.token)
+		if c.fails {
+			if !errors.Is(err, auth.ErrInvalidToken) {
+				t.Errorf("%s: error %v, claims %+v", c.name, err, claims)
+			}
+		} else if err != nil || claims.UserID() != alice.ID {
+			t.Errorf("%s: claims %+v: %v", c.name, claims, err)
+		}
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	client := newCouch(t)
+	tokens := auth.NewTokenManager(client, authConfig)
+	alice := newUser(t, client, "alice@example.com", "correct horse")
+	first, err := tokens.NewSession(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := tokens.NewSession(alice) // @info Another device, another family
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, usr, err := tokens.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.ID != alice.ID || second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+		t.Fatalf("refreshed into %+v of %s", second, usr.ID)
+	}
+	third, _, err := tokens.Refresh(second.RefreshToken)
+	if err != nil {
+		t.Fatalf("refreshing the rotated token: %v", err)
+	}
+
+	// @info The first token was already used: whoever has it stole it, and the whole family goes
+	if _, _, err := tokens.Refresh(first.RefreshToken); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Fatalf("reuse of a rotated token: %v", err)
+	}
+	if _, _, err := tokens.Refresh(third.RefreshToken); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Errorf("latest token of the family after a reuse: %v", err)
+	}
+	if _, _, err := tokens.Refresh(other.RefreshToken); err != nil {
+		t.Errorf("session of another family after a reuse: %v", err)
+	}
+}
+
+func TestRefreshRefused(t *testing.T) {
+	client := newCouch(t)
+	tokens := auth.NewTokenManager(client, authConfig)
+	alice := newUser(t, client, "alice@example.com", "correct horse")
+	bob := newUser(t, client, "bob@example.com", "correct horse")
+	session := func(manager *auth.TokenManager, usr *models.User) string {
+		s, err := manager.NewSession(usr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.RefreshToken
+	}
+
+	expired := session(auth.NewTokenManager(client, &config.AuthConfig{JWTSecret: secret, Issuer: "3DQuest", AccessTokenTTL: time.Minute, RefreshTokenTTL: -time.Minute}), alice)
+	loggedOut := session(tokens, alice)
+	if err := tokens.Logout(loggedOut); err != nil {
+		t.Fatal(err)
+	}
+	revoked := session(tokens, alice)
+	stillBob := session(tokens, bob)
+	if err := tokens.RevokeUserSessions(alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	ofDeleted := session(tokens, bob)
+	if err := models.DeleteUser(client, bob.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"unknown", "not-a-refresh-token"},
+		{"expired", expired},
+		{"logged out", loggedOut},
+		{"every session revoked", revoked},
+		{"deleted user", ofDeleted},
+		{"deleted user, older session", stillBob},
+	}
+	for _, c := range cases {
+		if _, _, err := tokens.Refresh(c.token); !errors.Is(err, auth.ErrInvalidToken) {
+			t.Errorf("%s: error %v, want an invalid token", c.name, err)
+		}
+	}
+	if err := tokens.Logout("not-a-refresh-token"); err != nil {
+		t.Errorf("logout with an unknown token: %v", err)
+	}
+}
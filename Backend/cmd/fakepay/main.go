@@ -0,0 +1,58 @@
+package main
+
+import (
+	"3DQuest/payment/fake"
+	"flag"
+	"log"
+	"net/http"
+	str "strings"
+)
+
+// @info Runs a fake Stripe to try payments without an account:
+//
+//	go run ./cmd/fakepay -addr :12111 -webhook-url http://localhost:8082/api/v1/payments/webhook
+//
+// POST /fake/pay/{intent} pays an intent as the customer would, POST /fake/decline/{intent}?message= declines the card
+// and POST /fake/redeliver/{event} sends an event again.
+func main() {
+	addr := flag.String("addr", ":12111", "Address to listen on")
+	secretKey := flag.String("secret-key", "sk_test_fake", "Secret key the requests must carry")
+	webhookSecret := flag.String("webhook-secret", "whsec_fake", "Secret the webhooks are signed with")
+	webhookURL := flag.String("webhook-url", "", "Where to send the events, nowhere if empty")
+	flag.Parse()
+
+	stripe := fake.NewStripe(*secretKey, *webhookSecret, *webhookURL)
+	mux := http.NewServeMux()
+	mux.Handle("/", stripe)
+	mux.HandleFunc("/fake/pay/", func(w http.ResponseWriter, r *http.Request) {
+		id := str.TrimPrefix(r.URL.Path, "/fake/pay/")
+		if err := stripe.Pay(id); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Paid %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/fake/decline/", func(w http.ResponseWriter, r *http.Request) {
+		id, message := str.TrimPrefix(r.URL.Path, "/fake/decline/"), r.URL.Query().Get("message")
+		if message == "" {
+			message = "Your card was declined."
+		}
+		if err := stripe.Decline(id, message); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Declined %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/fake/redeliver/", func(w http.ResponseWriter, r *http.Request) {
+		if err := stripe.Redeliver(str.TrimPrefix(r.URL.Path, "/fake/redeliver/")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("Fake Stripe listening on %s, secret key %s, webhooks to '%s'", *addr, *secretKey, *webhookURL)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"3DQuest/connector/fake"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+)
+
+// @info Runs a fake OctoPrint or Moonraker host to try printer connections without hardware:
+//
+//	go run ./cmd/fakeprinter -kind moonraker -addr :7125 -duration 2m
+//
+// POST /fake/fail?message= halts the printer as a firmware error would, POST /fake/reset clears the error.
+func main() {
+	kind := flag.String("kind", "octoprint", "octoprint or moonraker")
+	addr := flag.String("addr", ":5000", "Address to listen on")
+	apiKey := flag.String("api-key", "", "API key the requests must carry, none if empty")
+	duration := flag.Duration("duration", time.Minute, "How long every print takes")
+	flag.Parse()
+
+	var host interface {
+		http.Handler
+		Fail(message string)
+		Reset()
+	}
+	switch *kind {
+	case "octoprint":
+		host = fake.NewOctoPrint(*apiKey, *duration)
+	case "moonraker":
+		host = fake.NewMoonraker(*apiKey, *duration)
+	default:
+		log.Fatalf("Unknown kind '%s'", *kind)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", host)
+	mux.HandleFunc("/fake/fail", func(w http.ResponseWriter, r *http.Request) {
+		message := r.URL.Query().Get("message")
+		if message == "" {
+			message = "Heater extruder not heating at expected rate"
+		}
+		log.Printf("Printer halted: %s", message)
+		host.Fail(message)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/fake/reset", func(w http.ResponseWriter, r *http.Request) {
+		log.Println("Printer restarted")
+		host.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("Fake %s listening on %s, prints take %s", *kind, *addr, *duration)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
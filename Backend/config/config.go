@@ -0,0 +1,452 @@
+package config
+
+import (
+	"3DQuest/scheduler"
+	"3DQuest/shipping"
+	"3DQuest/taxid"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	str "strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/creasty/defaults"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// @info Typed configuration of the whole backend. Values are loaded with the following precedence (last wins):
+//  1. The `default` struct tags
+//  2. The .env file, with the names of the `env` struct tags. Optional
+//  3. The config file (CONFIG_FILE, config.yaml by default), YAML or TOML by its extension. Optional unless
+//     CONFIG_FILE is set explicitly
+//  4. Environment variables, named by the `env` struct tags
+//
+// The .env file holds the defaults of a development machine, so a config file of the deployment overrides it, and
+// the environment overrides both. The config file uses the names of the `yaml` struct tags in either format.
+//
+// Every environment variable can also be given as {NAME}_FILE pointing to a file holding the value, which is how
+// secrets are usually mounted (Docker/Kubernetes secrets). {NAME} itself wins if both are set.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	CouchDB   CouchDBConfig   `yaml:"couchdb"`
+	Design    DesignConfig    `yaml:"design"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Shop      ShopConfig      `yaml:"shop"`
+	MQTT      MQTTConfig      `yaml:"mqtt"`
+	Materials MaterialsConfig `yaml:"materials"`
+	Store     StoreConfig     `yaml:"store"`
+	Payment   PaymentConfig   `yaml:"payment"`
+	Invoice   InvoiceConfig   `yaml:"invoice"`
+	Shipping  ShippingConfig  `yaml:"shipping"`
+}
+
+type ServerConfig struct {
+	Port            string        `yaml:"port" env:"PORT" default:"8082" required:"true"`
+	AllowedOrigins  []string      `yaml:"allowed_origins" env:"CORS_ORIGINS" default:"[\"http://localhost:5173\"]"` // Origins of the Svelte frontend, comma separated in the environment
+	BodyLimit       string        `yaml:"body_limit" env:"BODY_LIMIT" default:"10M" required:"true"`                // Maximum request body size, e.g. 512K, 10M, 1G
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" default:"15s"`                    // Time given to in-flight requests on SIGTERM
+}
+
+type CouchDBConfig struct {
+	Scheme     string `yaml:"scheme" env:"COUCHDB_SCH" default:"http" required:"true"`
+	User       string `yaml:"user" env:"COUCHDB_USR" required:"true"`
+	Password   string `yaml:"password" env:"COUCHDB_PWD" required:"true"`
+	URL        string `yaml:"url" env:"COUCHDB_URL" default:"localhost:5984" required:"true"` // Host and port, without scheme
+	Database   string `yaml:"database" env:"COUCHDB_DB" default:"questdb" required:"true"`
+	AllDBsPath string `yaml:"all_dbs_path" env:"ALL_DBS_URL" default:"_all_dbs"`
+
+	Cache        bool          `yaml:"cache" env:"COUCHDB_CACHE" default:"false"`                // Caches the user and store product lookups, evicted by the changes feed
+	CacheTTL     time.Duration `yaml:"cache_ttl" env:"COUCHDB_CACHE_TTL" default:"5m"`           // Age after which a cached document is revalidated with CouchDB
+	CacheEntries int           `yaml:"cache_entries" env:"COUCHDB_CACHE_ENTRIES" default:"1024"` // Most documents kept in the cache
+}
+
+type DesignConfig struct {
+	UserDesignDoc           string `yaml:"user_design_doc" env:"USER_DESIGN_DOC" default:"_design/test"`
+	AllUsersView            string `yaml:"all_users_view" env:"ALL_USERS_VIEW" default:"_view/all_user_view"`
+	BasicUsersView          string `yaml:"basic_users_view" env:"BASIC_USERS_VIEW" default:"_view/user_view"`
+	AdminUsersView          string `yaml:"admin_users_view" env:"ADMIN_USERS_VIEW" default:"_view/admin_user_view"`
+	InstallSchemaValidation bool   `yaml:"install_schema_validation" env:"INSTALL_SCHEMA_VALIDATION" default:"false"`
+}
+
+type AuthConfig struct {
+	JWTSecret       string        `yaml:"jwt_secret" env:"JWT_SECRET" required:"true"` // HMAC key signing the access tokens, at least 32 characters
+	Issuer          string        `yaml:"issuer" env:"JWT_ISSUER" default:"3DQuest"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl" env:"ACCESS_TOKEN_TTL" default:"15m"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl" env:"REFRESH_TOKEN_TTL" default:"720h"`
+}
+
+// @info Workshop settings used by the print scheduler
+type ShopConfig struct {
+	Timezone       string        `yaml:"timezone" env:"SHOP_TIMEZONE" default:"Europe/Madrid" required:"true"`
+	OpeningHours   []string      `yaml:"opening_hours" env:"SHOP_OPENING_HOURS" default:"[\"mon-fri 09:00-20:00\"]"` // e.g. "mon-fri 09:00-14:00 16:00-20:00", comma separated in the environment. Empty is always open
+	Overnight      bool          `yaml:"overnight" env:"SHOP_OVERNIGHT" default:"true"`                              // Whether plates may keep printing after closing time. They always start while open
+	MaxPlate       time.Duration `yaml:"max_plate" env:"SHOP_MAX_PLATE" default:"24h"`                               // Longest plate built by batching parts
+	MaterialChange time.Duration `yaml:"material_change" env:"SHOP_MATERIAL_CHANGE" default:"10m"`                   // Time to swap the filament of a printer
+	PollInterval   time.Duration `yaml:"poll_interval" env:"PRINTER_POLL_INTERVAL" default:"10s"`                    // How often connected printers are asked for their status, 0 to never ask
+}
+
+// @info Telemetry published by printers over MQTT
+type MQTTConfig struct {
+	Broker         string        `yaml:"broker" env:"MQTT_BROKER"`                         // e.g. tcp://localhost:1883. Empty disables the ingestion
+	ClientID       string        `yaml:"client_id" env:"MQTT_CLIENT_ID" default:"3dquest"` // Must be unique on the broker
+	Username       string        `yaml:"username" env:"MQTT_USERNAME"`                     // Also required by the embedded broker if set
+	Password       string        `yaml:"password" env:"MQTT_PASSWORD"`
+	Listen         string        `yaml:"listen" env:"MQTT_LISTEN"`                                // Address of the embedded broker, e.g. :1883. Empty to not run it
+	SampleInterval time.Duration `yaml:"sample_interval" env:"MQTT_SAMPLE_INTERVAL" default:"1m"` // Length of each point of the stored series
+	Silence        time.Duration `yaml:"silence" env:"MQTT_SILENCE" default:"5m"`                 // A printer printing and silent for longer raises an alert, 0 to never
+	OverheatMargin float64       `yaml:"overheat_margin" env:"MQTT_OVERHEAT_MARGIN" default:"15"` // °C over its target a heater may reach before raising an alert, 0 to never
+}
+
+// @info Filament inventory
+type MaterialsConfig struct {
+	LowStockGrams float64 `yaml:"low_stock_grams" env:"MATERIALS_LOW_STOCK_GRAMS" default:"1000"` // Stock of a material and colour below which it is low, unless it has a threshold of its own
+	SpoolGrams    float64 `yaml:"spool_grams" env:"MATERIALS_SPOOL_GRAMS" default:"1000"`         // Filament of the spools suggested for purchase, when none of that material was bought before
+}
+
+// @info Carts and checkout of the store
+type StoreConfig struct {
+	ReservationTTL   time.Duration `yaml:"reservation_ttl" env:"STORE_RESERVATION_TTL" default:"30m"`        // How long units put in a cart are kept from other customers
+	AnonymousCartTTL time.Duration `yaml:"anonymous_cart_ttl" env:"STORE_ANONYMOUS_CART_TTL" default:"720h"` // Carts of visitors who never log in are forgotten after this long untouched
+	CheckoutTTL      time.Duration `yaml:"checkout_ttl" env:"STORE_CHECKOUT_TTL" default:"72h"`              // Checkouts not paid this long after they were made are cancelled, giving their stock back
+}
+
+// @info Card payments through an external provider
+type PaymentConfig struct {
+	Provider      string        `yaml:"provider" env:"PAYMENT_PROVIDER"`                                // stripe, or empty to only take credits and payments confirmed by the staff
+	APIURL        string        `yaml:"api_url" env:"PAYMENT_API_URL" default:"https://api.stripe.com"` // Point it to cmd/fakepay to try payments locally
+	SecretKey     string        `yaml:"secret_key" env:"PAYMENT_SECRET_KEY"`
+	WebhookSecret string        `yaml:"webhook_secret" env:"PAYMENT_WEBHOOK_SECRET"`                   // Signs the events the provider sends to /api/v1/payments/webhook
+	Currency      string        `yaml:"currency" env:"PAYMENT_CURRENCY" default:"eur"`                 // ISO 4217, lowercase
+	ManualCapture bool          `yaml:"manual_capture" env:"PAYMENT_MANUAL_CAPTURE" default:"false"`   // Only authorize checkouts, the staff capture them later
+	MinTopUpCents int64         `yaml:"min_top_up_cents" env:"PAYMENT_MIN_TOP_UP_CENTS" default:"500"` // Smallest amount of credits that can be bought
+	Timeout       time.Duration `yaml:"timeout" env:"PAYMENT_TIMEOUT" default:"15s"`                   // Of every call to the provider
+}
+
+// @info Who issues the invoices and how they are numbered. Invoices are not issued until the issuer is set.
+type InvoiceConfig struct {
+	Series           string `yaml:"series" env:"INVOICE_SERIES" default:"F"`                       // Prefix of the invoice numbers, e.g. F-2024-000001
+	RectifyingSeries string `yaml:"rectifying_series" env:"INVOICE_RECTIFYING_SERIES" default:"R"` // Series of the rectifying invoices, it must be a different one
+	IssuerName       string `yaml:"issuer_name" env:"INVOICE_ISSUER_NAME"`                         // Legal name of the shop
+	IssuerTaxID      string `yaml:"issuer_tax_id" env:"INVOICE_ISSUER_TAX_ID"`                     // NIF or CIF of the shop
+	IssuerAddress    string `yaml:"issuer_address" env:"INVOICE_ISSUER_ADDRESS"`                   // As printed on the invoices, lines separated by commas
+}
+
+// @info Whether invoices can be issued
+func (c *InvoiceConfig) Enabled() bool {
+	return c.IssuerName != "" && c.IssuerTaxID != ""
+}
+
+// @info Parcels sent to customers. Without a carrier the staff enter the tracking numbers of the labels they buy.
+type ShippingConfig struct {
+	Carrier          string        `yaml:"carrier" env:"SHIPPING_CARRIER"`                               // fake, or empty to enter tracking numbers by hand
+	TrackInterval    time.Duration `yaml:"track_interval" env:"SHIPPING_TRACK_INTERVAL" default:"30m"`   // How often the carrier is asked where parcels are, 0 to never ask
+	PackagingGrams   int           `yaml:"packaging_grams" env:"SHIPPING_PACKAGING_GRAMS" default:"150"` // Weight of the box and filling added to the prints
+	PaddingMM        int           `yaml:"padding_mm" env:"SHIPPING_PADDING_MM" default:"20"`            // Added to every side of the prints to size the box
+	SenderName       string        `yaml:"sender_name" env:"SHIPPING_SENDER_NAME"`                       // The rest of the sender address is required with a carrier
+	SenderLine1      string        `yaml:"sender_line1" env:"SHIPPING_SENDER_LINE1"`
+	SenderCity       string        `yaml:"sender_city" env:"SHIPPING_SENDER_CITY"`
+	SenderPostalCode string        `yaml:"sender_postal_code" env:"SHIPPING_SENDER_POSTAL_CODE"`
+	SenderCountry    string        `yaml:"sender_country" env:"SHIPPING_SENDER_COUNTRY" default:"ES"`
+	SenderPhone      string        `yaml:"sender_phone" env:"SHIPPING_SENDER_PHONE"`
+}
+
+// @info Address parcels are sent from
+func (c *ShippingConfig) Sender() shipping.Address {
+	return shipping.Address{Name: c.SenderName, Line1: c.SenderLine1, City: c.SenderCity, PostalCode: c.SenderPostalCode, Country: c.SenderCountry, Phone: c.SenderPhone}
+}
+
+var seriesPattern = regexp.MustCompile(`^[A-Z0-9]{1,10}$`)
+
+// @info JWT secrets published with the project at some point, which anyone can sign tokens with
+var publishedJWTSecrets = []string{"development-only-secret-change-me-in-production"}
+
+const (
+	DefaultEnvFile    = ".env"
+	DefaultConfigFile = "config.yaml"
+)
+
+// @info Returned by Load when values are missing or malformed. Lists every problem at once.
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "Invalid configuration:\n  - " + str.Join(e.Problems, "\n  - ")
+}
+
+// @info Loads the configuration from the default sources: .env, CONFIG_FILE (or config.yaml) and the environment
+func Load() (*Config, error) {
+	configFile, explicit := os.LookupEnv("CONFIG_FILE")
+	if !explicit {
+		configFile = DefaultConfigFile
+	}
+	return LoadFrom(DefaultEnvFile, configFile, explicit)
+}
+
+// @info Loads the configuration from the given files. Missing files are skipped unless required is true, in which case
+// a missing configFile is an error. Either path may be empty to skip it.
+func LoadFrom(envFile string, configFile string, required bool) (*Config, error) {
+	cfg := &Config{}
+	if err := defaults.Set(cfg); err != nil {
+		return cfg, err
+	}
+
+	problems := []string{}
+	if envFile != "" {
+		dotenv, err := godotenv.Read(envFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return cfg, fmt.Errorf("Couldn't load the %s file: %w", envFile, err)
+		}
+		applyEnv(reflect.ValueOf(cfg).Elem(), "", func(name string) (string, bool) {
+			value, ok := dotenv[name]
+			return value, ok
+		}, &problems)
+	}
+
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		switch {
+		case err == nil:
+			if err := decodeConfigFile(configFile, data, cfg); err != nil {
+				return cfg, fmt.Errorf("Couldn't parse the config file %s: %w", configFile, err)
+			}
+		case errors.Is(err, fs.ErrNotExist) && !required:
+		default:
+			return cfg, fmt.Errorf("Couldn't read the config file %s: %w", configFile, err)
+		}
+	}
+
+	applyEnv(reflect.ValueOf(cfg).Elem(), "", os.LookupEnv, &problems)
+	validate(reflect.ValueOf(cfg).Elem(), "", &problems)
+	if port, err := strconv.Atoi(cfg.Server.Port); err != nil || port <= 0 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("server.port (PORT) must be a port number, got '%s'", cfg.Server.Port))
+	}
+	if cfg.Auth.JWTSecret != "" && len(cfg.Auth.JWTSecret) < 32 {
+		problems = append(problems, "auth.jwt_secret (JWT_SECRET) must be at least 32 characters long")
+	}
+	for _, published := range publishedJWTSecrets {
+		if cfg.Auth.JWTSecret == published {
+			problems = append(problems, "auth.jwt_secret (JWT_SECRET) is the example secret published with the project, generate a new one")
+		}
+	}
+	if _, err := scheduler.ParseHours(cfg.Shop.OpeningHours, cfg.Shop.Timezone); err != nil && cfg.Shop.Timezone != "" {
+		problems = append(problems, fmt.Sprintf("shop (SHOP_TIMEZONE, SHOP_OPENING_HOURS): %s", err.Error()))
+	}
+	if cfg.MQTT.Broker != "" && cfg.MQTT.SampleInterval < time.Second {
+		problems = append(problems, "mqtt.sample_interval (MQTT_SAMPLE_INTERVAL) must be at least 1s")
+	}
+	if cfg.Materials.LowStockGrams < 0 {
+		problems = append(problems, "materials.low_stock_grams (MATERIALS_LOW_STOCK_GRAMS) must not be negative")
+	}
+	if cfg.Materials.SpoolGrams <= 0 {
+		problems = append(problems, "materials.spool_grams (MATERIALS_SPOOL_GRAMS) must be positive")
+	}
+	if cfg.Store.ReservationTTL < time.Minute {
+		problems = append(problems, "store.reservation_ttl (STORE_RESERVATION_TTL) must be at least 1m")
+	}
+	if cfg.Store.AnonymousCartTTL < cfg.Store.ReservationTTL {
+		problems = append(problems, "store.anonymous_cart_ttl (STORE_ANONYMOUS_CART_TTL) must not be shorter than the reservations")
+	}
+	if cfg.Store.CheckoutTTL < cfg.Store.ReservationTTL {
+		problems = append(problems, "store.checkout_ttl (STORE_CHECKOUT_TTL) must not be shorter than the reservations")
+	}
+	switch cfg.Payment.Provider {
+	case "":
+	case "stripe":
+		if cfg.Payment.SecretKey == "" || cfg.Payment.WebhookSecret == "" {
+			problems = append(problems, "payment.secret_key (PAYMENT_SECRET_KEY) and payment.webhook_secret (PAYMENT_WEBHOOK_SECRET) are required by the payment provider")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("payment.provider (PAYMENT_PROVIDER) must be stripe or empty, got '%s'", cfg.Payment.Provider))
+	}
+	if cfg.Payment.MinTopUpCents < 1 {
+		problems = append(problems, "payment.min_top_up_cents (PAYMENT_MIN_TOP_UP_CENTS) must be positive")
+	}
+	for _, series := range []struct{ field, value string }{
+		{"invoice.series (INVOICE_SERIES)", cfg.Invoice.Series},
+		{"invoice.rectifying_series (INVOICE_RECTIFYING_SERIES)", cfg.Invoice.RectifyingSeries},
+	} {
+		if !seriesPattern.MatchString(series.value) {
+			problems = append(problems, series.field+" must be 1 to 10 capital letters or digits")
+		}
+	}
+	if cfg.Invoice.Series == cfg.Invoice.RectifyingSeries {
+		problems = append(problems, "invoice.rectifying_series (INVOICE_RECTIFYING_SERIES) must differ from the series of the invoices")
+	}
+	if (cfg.Invoice.IssuerName == "") != (cfg.Invoice.IssuerTaxID == "") {
+		problems = append(problems, "invoice.issuer_name (INVOICE_ISSUER_NAME) and invoice.issuer_tax_id (INVOICE_ISSUER_TAX_ID) go together")
+	} else if cfg.Invoice.IssuerTaxID != "" {
+		if taxID, err := taxid.Parse(cfg.Invoice.IssuerTaxID); err != nil {
+			problems = append(problems, "invoice.issuer_tax_id (INVOICE_ISSUER_TAX_ID): "+err.Error())
+		} else {
+			cfg.Invoice.IssuerTaxID = taxID.Value
+		}
+	}
+	switch cfg.Shipping.Carrier {
+	case "":
+	case "fake":
+		if cfg.Shipping.SenderName == "" || cfg.Shipping.SenderLine1 == "" || cfg.Shipping.SenderCity == "" || cfg.Shipping.SenderPostalCode == "" || cfg.Shipping.SenderCountry == "" {
+			problems = append(problems, "shipping.sender_name, sender_line1, sender_city, sender_postal_code and sender_country (SHIPPING_SENDER_*) are required by the carrier")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("shipping.carrier (SHIPPING_CARRIER) must be fake or empty, got '%s'", cfg.Shipping.Carrier))
+	}
+	if cfg.Shipping.PackagingGrams < 0 || cfg.Shipping.PaddingMM < 0 {
+		problems = append(problems, "shipping.packaging_grams (SHIPPING_PACKAGING_GRAMS) and shipping.padding_mm (SHIPPING_PADDING_MM) must not be negative")
+	}
+	if len(problems) > 0 {
+		return cfg, &Error{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// @info Decodes a YAML or TOML file over cfg. TOML is read into a map and decoded as YAML, so both use the `yaml`
+// struct tags.
+func decodeConfigFile(name string, data []byte, cfg *Config) error {
+	if str.ToLower(filepath.Ext(name)) == ".toml" {
+		values := map[string]interface{}{}
+		if _, err := toml.Decode(string(data), &values); err != nil {
+			return err
+		}
+		var err error
+		if data, err = yaml.Marshal(values); err != nil {
+			return err
+		}
+	}
+	return yaml.Unmarshal(data, cfg)
+}
+
+// @info Overrides every field tagged with `env` with the variable (or the file it points to) if lookup finds it
+func applyEnv(value reflect.Value, path string, lookup func(name string) (string, bool), problems *[]string) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		fieldType := value.Type().Field(i)
+		fieldPath := joinPath(path, fieldType)
+		if field.Kind() == reflect.Struct {
+			applyEnv(field, fieldPath, lookup, problems)
+			continue
+		}
+		name := fieldType.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		raw, ok, err := lookupEnv(name, lookup)
+		if err != nil {
+			*problems = append(*problems, err.Error())
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(field, raw); err != nil {
+			*problems = append(*problems, fmt.Sprintf("%s (%s): %s", fieldPath, name, err.Error()))
+		}
+	}
+}
+
+func lookupEnv(name string, lookup func(name string) (string, bool)) (string, bool, error) {
+	if value, ok := lookup(name); ok {
+		return value, true, nil
+	}
+	path, ok := lookup(name + "_FILE")
+	if !ok || path == "" {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("Couldn't read the secret file given in %s_FILE: %s", name, err.Error())
+	}
+	return str.TrimRight(string(data), "\r\n"), true, nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got '%s'", raw)
+		}
+		field.SetBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected an integer, got '%s'", raw)
+		}
+		field.SetInt(value)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a positive integer, got '%s'", raw)
+		}
+		field.SetUint(value)
+	case reflect.Float32, reflect.Float64:
+		value, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("expected a number, got '%s'", raw)
+		}
+		field.SetFloat(value)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.New("unsupported list type")
+		}
+		values := []string{}
+		for _, elem := range str.Split(raw, ",") {
+			if elem = str.TrimSpace(elem); elem != "" {
+				values = append(values, elem)
+			}
+		}
+		field.Set(reflect.ValueOf(values))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// @info Reports every field tagged `required:"true"` that was left empty
+func validate(value reflect.Value, path string, problems *[]string) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		fieldType := value.Type().Field(i)
+		fieldPath := joinPath(path, fieldType)
+		if field.Kind() == reflect.Struct {
+			validate(field, fieldPath, problems)
+			continue
+		}
+		if fieldType.Tag.Get("required") != "true" || !field.IsZero() {
+			continue
+		}
+		if name := fieldType.Tag.Get("env"); name != "" {
+			*problems = append(*problems, fmt.Sprintf("%s is required, set it in the config file or with %s (or %s_FILE)", fieldPath, name, name))
+		} else {
+			*problems = append(*problems, fmt.Sprintf("%s is required", fieldPath))
+		}
+	}
+}
+
+func joinPath(path string, field reflect.StructField) string {
+	name := str.Split(field.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		name = str.ToLower(field.Name)
+	}
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
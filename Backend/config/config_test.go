@@ -0,0 +1,145 @@
+package config_test
+
+import (
+	"3DQuest/config"
+	"errors"
+	"os"
+	"path/filepath"
+	str "strings"
+	"testing"
+	"time"
+)
+
+const secret = "a-secret-long-enough-to-sign-tokens"
+
+func write(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	envFile := write(t, ".env", "COUCHDB_USR=dotenv\nCOUCHDB_PWD=dotenv\nJWT_SECRET="+secret+"\nPORT=8001\nCOUCHDB_DB=dotenv\nBODY_LIMIT=1M\n")
+	yamlFile := write(t, "config.yaml", "server:\n  port: \"8002\"\n  body_limit: 2M\ncouchdb:\n  database: file\n")
+	tomlFile := write(t, "config.toml", "[server]\nport = \"8002\"\nbody_limit = \"2M\"\n\n[couchdb]\ndatabase = \"file\"\n")
+	for _, configFile := range []string{yamlFile, tomlFile} {
+		t.Setenv("PORT", "8003")
+		cfg, err := config.LoadFrom(envFile, configFile, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases := []struct {
+			name string
+			got  string
+			want string
+		}{
+			{"default", cfg.CouchDB.Scheme, "http"},
+			{".env over the default", cfg.CouchDB.User, "dotenv"},
+			{"file over .env", cfg.CouchDB.Database, "file"},
+			{"file over .env and the default", cfg.Server.BodyLimit, "2M"},
+			{"environment over all", cfg.Server.Port, "8003"},
+		}
+		for _, c := range cases {
+			if c.got != c.want {
+				t.Errorf("%s, %s: %q, want %q", filepath.Base(configFile), c.name, c.got, c.want)
+			}
+		}
+	}
+	if _, ok := os.LookupEnv("COUCHDB_USR"); ok {
+		t.Error("the .env file was loaded into the environment")
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	t.Setenv("COUCHDB_USR", "admin")
+	t.Setenv("COUCHDB_PWD_FILE", write(t, "couchdb_pwd", "from-file\n"))
+	t.Setenv("JWT_SECRET_FILE", write(t, "jwt_secret", "ignored-because-the-variable-is-set"))
+	t.Setenv("JWT_SECRET", secret)
+	cfg, err := config.LoadFrom("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CouchDB.Password != "from-file" {
+		t.Errorf("password %q, want the file without its newline", cfg.CouchDB.Password)
+	}
+	if cfg.Auth.JWTSecret != secret {
+		t.Errorf("JWT secret %q, want the variable over its file", cfg.Auth.JWTSecret)
+	}
+
+	t.Setenv("COUCHDB_PWD_FILE", filepath.Join(t.TempDir(), "missing"))
+	var cfgErr *config.Error
+	if _, err := config.LoadFrom("", "", false); !errors.As(err, &cfgErr) || !str.Contains(cfgErr.Error(), "COUCHDB_PWD_FILE") {
+		t.Errorf("missing secret file: %v", err)
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	cases := []struct {
+		name     string
+		env      map[string]string
+		problems []string // Parts of the problems expected, in any order
+	}{
+		{"valid", map[string]string{}, nil},
+		{"missing values", map[string]string{"COUCHDB_USR": "", "COUCHDB_PWD": ""}, []string{"couchdb.user is required", "couchdb.password is required"}},
+		{"short secret", map[string]string{"JWT_SECRET": "short"}, []string{"at least 32 characters"}},
+		{"published secret", map[string]string{"JWT_SECRET": "development-only-secret-change-me-in-production"}, []string{"example secret"}},
+		{"bad port", map[string]string{"PORT": "http"}, []string{"server.port (PORT) must be a port number"}},
+		{"bad duration", map[string]string{"ACCESS_TOKEN_TTL": "soon"}, []string{"auth.access_token_ttl (ACCESS_TOKEN_TTL)"}},
+		{"bad boolean", map[string]string{"COUCHDB_CACHE": "maybe"}, []string{"expected true or false"}},
+		{"short checkouts", map[string]string{"STORE_CHECKOUT_TTL": "1m"}, []string{"store.checkout_ttl"}},
+		{"same series", map[string]string{"INVOICE_SERIES": "F", "INVOICE_RECTIFYING_SERIES": "F"}, []string{"must differ"}},
+		{"every problem at once", map[string]string{"PORT": "0", "JWT_SECRET": "short", "PAYMENT_PROVIDER": "paypal"}, []string{"server.port", "jwt_secret", "payment.provider"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("COUCHDB_USR", "admin")
+			t.Setenv("COUCHDB_PWD", "admin")
+			t.Setenv("JWT_SECRET", secret)
+			for name, value := range c.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := config.LoadFrom("", "", false)
+			if c.problems == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cfg.Auth.AccessTokenTTL != 15*time.Minute {
+					t.Errorf("access tokens last %v, want the default", cfg.Auth.AccessTokenTTL)
+				}
+				return
+			}
+			var cfgErr *config.Error
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("error %v, want a *config.Error", err)
+			}
+			if len(cfgErr.Problems) != len(c.problems) {
+				t.Errorf("problems %q, want %d", cfgErr.Problems, len(c.problems))
+			}
+			for _, want := range c.problems {
+				if !str.Contains(err.Error(), want) {
+					t.Errorf("%q is not among the problems %q", want, cfgErr.Problems)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	t.Setenv("COUCHDB_USR", "admin")
+	t.Setenv("COUCHDB_PWD", "admin")
+	t.Setenv("JWT_SECRET", secret)
+	if _, err := config.LoadFrom("", filepath.Join(t.TempDir(), "config.yaml"), false); err != nil {
+		t.Errorf("optional config file missing: %v", err)
+	}
+	if _, err := config.LoadFrom("", filepath.Join(t.TempDir(), "config.yaml"), true); err == nil {
+		t.Error("required config file missing, and no error")
+	}
+	for name, content := range map[string]string{"config.yaml": "server: [", "config.toml": "[server\nport = 1"} {
+		if _, err := config.LoadFrom("", write(t, name, content), true); err == nil || !str.Contains(err.Error(), "Couldn't parse") {
+			t.Errorf("malformed %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	str "strings"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindOctoPrint Kind = "octoprint"
+	KindMoonraker Kind = "moonraker" // Klipper
+)
+
+// @info What the printer is doing, the same for every kind of printer
+type State string
+
+const (
+	StateIdle      State = "idle"
+	StatePrinting  State = "printing"
+	StatePaused    State = "paused"
+	StateComplete  State = "complete"  // The last print finished
+	StateCancelled State = "cancelled" // The last print was cancelled
+	StateError     State = "error"     // The firmware stopped, e.g. thermal runaway
+	StateOffline   State = "offline"   // The host is up but the printer is not connected to it, or the host is unreachable
+)
+
+type Temperature struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+}
+
+// @info A reading of the printer
+type Status struct {
+	State            State                  `json:"state"`
+	Filename         string                 `json:"filename,omitempty"` // File being printed, or last printed
+	Progress         float64                `json:"progress"`           // 0 to 1
+	ElapsedSeconds   float64                `json:"elapsed_seconds"`
+	RemainingSeconds float64                `json:"remaining_seconds"`     // Estimated, zero if unknown
+	Temperatures     map[string]Temperature `json:"temperatures"`          // "nozzle", "bed" and "nozzle1"... for other tools
+	Message          string                 `json:"message,omitempty"`     // Error or status message of the firmware
+	FilamentMM       float64                `json:"filament_mm,omitempty"` // Extruded by the current or last print, zero if the host does not say
+	At               time.Time              `json:"at"`                    // When it was read
+}
+
+// @info Drives a printer through its host software. Every call honours the context's deadline.
+type Connector interface {
+	Kind() Kind
+	// @info Stores the G-code on the printer host under filename, replacing any file with that name
+	Upload(ctx context.Context, filename string, data []byte) error
+	// @info Prints a file previously uploaded
+	Start(ctx context.Context, filename string) error
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+	Cancel(ctx context.Context) error
+	Status(ctx context.Context) (*Status, error)
+}
+
+var ErrUnknownKind = errors.New("Unknown printer connection kind")
+
+// @info Returned when the printer host answers with an error
+type HostError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("The printer host answered %d: %s", e.StatusCode, e.Message)
+}
+
+// @info Connector for a printer host at baseURL (e.g. http://octopi.local), authenticated with apiKey if not empty
+func New(kind Kind, baseURL string, apiKey string) (Connector, error) {
+	baseURL = str.TrimRight(baseURL, "/")
+	if !str.HasPrefix(baseURL, "http://") && !str.HasPrefix(baseURL, "https://") {
+		return nil, fmt.Errorf("The printer URL must start with http:// or https://, got '%s'", baseURL)
+	}
+	switch kind {
+	case KindOctoPrint:
+		return NewOctoPrint(baseURL, apiKey), nil
+	case KindMoonraker:
+		return NewMoonraker(baseURL, apiKey), nil
+	}
+	return nil, fmt.Errorf("%w: '%s'", ErrUnknownKind, kind)
+}
+
+// @info Client of the REST calls, the context sets the deadlines
+var httpClient = &http.Client{}
+
+// @info Sends the request and fails with a *HostError on any status above 299
+func do(req *http.Request, apiKey string) ([]byte, error) {
+	if apiKey != "" {
+		req.Header.Set("X-Api-Key", apiKey)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode > 299 {
+		return body, &HostError{StatusCode: resp.StatusCode, Message: str.TrimSpace(string(body))}
+	}
+	return body, nil
+}
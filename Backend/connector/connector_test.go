@@ -0,0 +1,180 @@
+package connector_test
+
+import (
+	"3DQuest/connector"
+	"3DQuest/connector/fake"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeHost interface {
+	http.Handler
+	Fail(message string)
+	File(name string) ([]byte, bool)
+}
+
+const apiKey = "secret"
+
+func hosts(duration time.Duration) map[connector.Kind]fakeHost {
+	return map[connector.Kind]fakeHost{
+		connector.KindOctoPrint: fake.NewOctoPrint(apiKey, duration),
+		connector.KindMoonraker: fake.NewMoonraker(apiKey, duration),
+	}
+}
+
+func connect(t *testing.T, kind connector.Kind, host fakeHost, key string) connector.Connector {
+	t.Helper()
+	server := httptest.NewServer(host)
+	t.Cleanup(server.Close)
+	conn, err := connector.New(kind, server.URL+"/", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func status(t *testing.T, conn connector.Connector) *connector.Status {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := conn.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestPrintToCompletion(t *testing.T) {
+	for kind, host := range hosts(300 * time.Millisecond) {
+		t.Run(string(kind), func(t *testing.T) {
+			conn := connect(t, kind, host, apiKey)
+			ctx := context.Background()
+			if st := status(t, conn); st.State != connector.StateIdle {
+				t.Fatalf("state before printing = %s, want idle", st.State)
+			}
+			gcode := []byte("G28\nG1 X10 Y10\nG1 X20 E5\n")
+			if err := conn.Upload(ctx, "cube.gcode", gcode); err != nil {
+				t.Fatal(err)
+			}
+			if data, ok := host.File("cube.gcode"); !ok || string(data) != string(gcode) {
+				t.Fatalf("uploaded file = %q, %v", data, ok)
+			}
+			if err := conn.Start(ctx, "cube.gcode"); err != nil {
+				t.Fatal(err)
+			}
+			st := status(t, conn)
+			if st.State != connector.StatePrinting || st.Filename != "cube.gcode" {
+				t.Fatalf("status after start = %s %q, want printing cube.gcode", st.State, st.Filename)
+			}
+			if st.Temperatures["nozzle"].Target == 0 || st.Temperatures["bed"].Target == 0 {
+				t.Fatalf("heaters off while printing: %+v", st.Temperatures)
+			}
+			if err := conn.Start(ctx, "cube.gcode"); err == nil {
+				t.Fatal("starting a second print succeeded")
+			}
+
+			time.Sleep(400 * time.Millisecond)
+			st = status(t, conn)
+			if st.State != connector.StateComplete || st.Progress < 1 {
+				t.Fatalf("status after the print = %s %.2f, want complete 1", st.State, st.Progress)
+			}
+			// @info Only Klipper reports the filament it used
+			if kind == connector.KindMoonraker && st.FilamentMM != 5 {
+				t.Fatalf("filament used = %.2f mm, want 5", st.FilamentMM)
+			}
+		})
+	}
+}
+
+func TestPauseResumeCancel(t *testing.T) {
+	for kind, host := range hosts(time.Minute) {
+		t.Run(string(kind), func(t *testing.T) {
+			conn := connect(t, kind, host, apiKey)
+			ctx := context.Background()
+			if err := conn.Pause(ctx); err == nil {
+				t.Fatal("pausing an idle printer succeeded")
+			}
+			if err := conn.Upload(ctx, "part.gcode", []byte("G28\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Start(ctx, "part.gcode"); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Pause(ctx); err != nil {
+				t.Fatal(err)
+			}
+			paused := status(t, conn)
+			if paused.State != connector.StatePaused {
+				t.Fatalf("state after pause = %s", paused.State)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if st := status(t, conn); st.Progress != paused.Progress {
+				t.Fatalf("progress moved while paused: %f -> %f", paused.Progress, st.Progress)
+			}
+			if err := conn.Resume(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if st := status(t, conn); st.State != connector.StatePrinting {
+				t.Fatalf("state after resume = %s", st.State)
+			}
+			if err := conn.Cancel(ctx); err != nil {
+				t.Fatal(err)
+			}
+			// @info OctoPrint goes back to operational, Moonraker remembers the print was cancelled
+			if st := status(t, conn); st.State != connector.StateIdle && st.State != connector.StateCancelled {
+				t.Fatalf("state after cancel = %s", st.State)
+			}
+		})
+	}
+}
+
+func TestFirmwareError(t *testing.T) {
+	for kind, host := range hosts(time.Minute) {
+		t.Run(string(kind), func(t *testing.T) {
+			conn := connect(t, kind, host, apiKey)
+			ctx := context.Background()
+			if err := conn.Upload(ctx, "part.gcode", []byte("G28\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Start(ctx, "part.gcode"); err != nil {
+				t.Fatal(err)
+			}
+			host.Fail("Heater extruder not heating at expected rate")
+			st := status(t, conn)
+			if st.State != connector.StateError || st.Message == "" {
+				t.Fatalf("status after failure = %s %q, want error with a message", st.State, st.Message)
+			}
+		})
+	}
+}
+
+func TestWrongAPIKey(t *testing.T) {
+	for kind, host := range hosts(time.Minute) {
+		t.Run(string(kind), func(t *testing.T) {
+			conn := connect(t, kind, host, "wrong")
+			err := conn.Upload(context.Background(), "part.gcode", []byte("G28\n"))
+			var hostErr *connector.HostError
+			if !errors.As(err, &hostErr) || hostErr.StatusCode < 400 {
+				t.Fatalf("upload with a wrong key = %v, want a host error", err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := conn.Status(ctx); err == nil {
+				t.Fatal("status with a wrong key succeeded")
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := connector.New("prusalink", "http://printer.local", ""); !errors.Is(err, connector.ErrUnknownKind) {
+		t.Fatalf("unknown kind = %v, want ErrUnknownKind", err)
+	}
+	if _, err := connector.New(connector.KindOctoPrint, "printer.local", ""); err == nil {
+		t.Fatal("URL without a scheme accepted")
+	}
+}
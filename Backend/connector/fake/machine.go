@@ -0,0 +1,193 @@
+package fake
+
+import (
+	"3DQuest/gcode"
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+type machineState string
+
+const (
+	machineIdle      machineState = "idle"
+	machinePrinting  machineState = "printing"
+	machinePaused    machineState = "paused"
+	machineComplete  machineState = "complete"
+	machineCancelled machineState = "cancelled"
+	machineError     machineState = "error"
+)
+
+const (
+	ambient      = 22.0
+	nozzleTarget = 215.0
+	bedTarget    = 60.0
+	heatUp       = 5 * time.Second // From ambient to target
+)
+
+var (
+	errBusy        = errors.New("Printer is busy")
+	errNotPrinting = errors.New("Printer is not printing")
+	errNoFile      = errors.New("File not found")
+	errHalted      = errors.New("Printer is halted")
+)
+
+// @info The simulated printer behind both fake hosts: every print takes duration, progress grows linearly and the
+// heaters ramp up while printing
+type machine struct {
+	mu       sync.Mutex
+	duration time.Duration
+	files    map[string][]byte
+	state    machineState
+	filename string
+	filament float64       // mm the file extrudes, zero if it is not G-code
+	started  time.Time     // Of the current run since the last resume
+	elapsed  time.Duration // Printed before the last pause
+	heated   time.Time     // When the heaters were switched on, zero if off
+	message  string
+}
+
+func newMachine(duration time.Duration) *machine {
+	if duration <= 0 {
+		duration = time.Minute
+	}
+	return &machine{duration: duration, files: map[string][]byte{}, state: machineIdle}
+}
+
+type snapshot struct {
+	State      machineState
+	Filename   string
+	Progress   float64
+	Elapsed    time.Duration
+	Left       time.Duration
+	FilamentMM float64    // Extruded so far
+	Nozzle     [2]float64 // Actual, target
+	Bed        [2]float64
+	Message    string
+}
+
+func (m *machine) upload(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = append([]byte(nil), data...)
+}
+
+func (m *machine) file(name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	return data, ok
+}
+
+func (m *machine) start(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tick()
+	switch m.state {
+	case machinePrinting, machinePaused:
+		return errBusy
+	case machineError:
+		return errHalted
+	}
+	data, ok := m.files[name]
+	if !ok {
+		return errNoFile
+	}
+	m.filament = 0
+	if analysis, err := gcode.Analyze(bytes.NewReader(data), nil); err == nil {
+		m.filament = analysis.FilamentMM
+	}
+	now := time.Now()
+	m.state, m.filename, m.started, m.elapsed, m.heated, m.message = machinePrinting, name, now, 0, now, ""
+	return nil
+}
+
+func (m *machine) pause() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tick()
+	if m.state != machinePrinting {
+		return errNotPrinting
+	}
+	m.elapsed += time.Since(m.started)
+	m.state = machinePaused
+	return nil
+}
+
+func (m *machine) resume() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state != machinePaused {
+		return errNotPrinting
+	}
+	m.state, m.started = machinePrinting, time.Now()
+	return nil
+}
+
+func (m *machine) cancel() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tick()
+	if m.state != machinePrinting && m.state != machinePaused {
+		return errNotPrinting
+	}
+	if m.state == machinePrinting {
+		m.elapsed += time.Since(m.started)
+	}
+	m.state, m.heated = machineCancelled, time.Time{}
+	return nil
+}
+
+// @info Halts the printer as the firmware would, e.g. on a thermal runaway
+func (m *machine) fail(message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tick()
+	if m.state == machinePrinting {
+		m.elapsed += time.Since(m.started)
+	}
+	m.state, m.heated, m.message = machineError, time.Time{}, message
+}
+
+// @info Clears an error, as a firmware restart would
+func (m *machine) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == machineError {
+		m.state, m.message = machineIdle, ""
+	}
+}
+
+// @info Completes the print once its time is up. Called with the lock held.
+func (m *machine) tick() {
+	if m.state == machinePrinting && m.elapsed+time.Since(m.started) >= m.duration {
+		m.state, m.elapsed, m.heated = machineComplete, m.duration, time.Time{}
+	}
+}
+
+func (m *machine) read() snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tick()
+	elapsed := m.elapsed
+	if m.state == machinePrinting {
+		elapsed += time.Since(m.started)
+	}
+	snap := snapshot{State: m.state, Filename: m.filename, Elapsed: elapsed, Message: m.message}
+	if m.filename != "" {
+		snap.Progress = float64(elapsed) / float64(m.duration)
+		snap.Left = m.duration - elapsed
+		snap.FilamentMM = m.filament * snap.Progress
+	}
+	snap.Nozzle, snap.Bed = [2]float64{ambient, 0}, [2]float64{ambient, 0}
+	if !m.heated.IsZero() {
+		ramp := float64(time.Since(m.heated)) / float64(heatUp)
+		if ramp > 1 {
+			ramp = 1
+		}
+		snap.Nozzle = [2]float64{ambient + (nozzleTarget-ambient)*ramp, nozzleTarget}
+		snap.Bed = [2]float64{ambient + (bedTarget-ambient)*ramp, bedTarget}
+	}
+	return snap
+}
@@ -0,0 +1,175 @@
+package fake
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// @info A stand-in for Moonraker with the file upload and the JSON-RPC methods the connector uses
+type Moonraker struct {
+	*machine
+	apiKey string
+}
+
+// @info Every print takes duration. Requests must carry apiKey in X-Api-Key unless it is empty.
+func NewMoonraker(apiKey string, duration time.Duration) *Moonraker {
+	return &Moonraker{machine: newMachine(duration), apiKey: apiKey}
+}
+
+// @info Shuts Klipper down with message, as a firmware error would
+func (m *Moonraker) Fail(message string) {
+	m.fail(message)
+}
+
+// @info Clears a failure, as a FIRMWARE_RESTART would
+func (m *Moonraker) Reset() {
+	m.reset()
+}
+
+// @info Contents of an uploaded file
+func (m *Moonraker) File(name string) ([]byte, bool) {
+	return m.file(name)
+}
+
+func (m *Moonraker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.apiKey != "" && r.Header.Get("X-Api-Key") != m.apiKey {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/server/files/upload":
+		m.upload(w, r)
+	case "/websocket":
+		websocket.Server{Handler: m.serve}.ServeHTTP(w, r) // @info No origin check, as Moonraker with trusted clients
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *Moonraker) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if root := r.FormValue("root"); root != "" && root != "gcodes" {
+		http.Error(w, "Unsupported root", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "No file included", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.machine.upload(header.Filename, data)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"item": map[string]string{"path": header.Filename, "root": "gcodes"}, "action": "create_file"})
+}
+
+type rpcCall struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     *int64          `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// @info Answers calls until the client goes away. Each answer follows a status notification, as Moonraker pushes
+// them between answers too.
+func (m *Moonraker) serve(conn *websocket.Conn) {
+	defer conn.Close()
+	for {
+		message := []byte{}
+		if err := websocket.Message.Receive(conn, &message); err != nil {
+			return
+		}
+		call := rpcCall{}
+		if err := json.Unmarshal(message, &call); err != nil || call.ID == nil {
+			continue
+		}
+		result, callErr := m.dispatch(call)
+		notification, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": "notify_status_update", "params": []interface{}{m.objects(), float64(time.Now().UnixNano()) / 1e9}})
+		if err := websocket.Message.Send(conn, string(notification)); err != nil {
+			return
+		}
+		answer := map[string]interface{}{"jsonrpc": "2.0", "id": *call.ID}
+		if callErr != nil {
+			answer["error"] = callErr
+		} else {
+			answer["result"] = result
+		}
+		payload, _ := json.Marshal(answer)
+		if err := websocket.Message.Send(conn, string(payload)); err != nil {
+			return
+		}
+	}
+}
+
+func (m *Moonraker) dispatch(call rpcCall) (interface{}, *rpcError) {
+	var err error
+	switch call.Method {
+	case "printer.objects.query":
+		return map[string]interface{}{"eventtime": float64(time.Now().UnixNano()) / 1e9, "status": m.objects()}, nil
+	case "printer.print.start":
+		params := struct {
+			Filename string `json:"filename"`
+		}{}
+		if len(call.Params) > 0 {
+			json.Unmarshal(call.Params, &params)
+		}
+		err = m.start(params.Filename)
+		if err == errNoFile {
+			return nil, &rpcError{Code: 404, Message: err.Error()}
+		}
+	case "printer.print.pause":
+		err = m.pause()
+	case "printer.print.resume":
+		err = m.resume()
+	case "printer.print.cancel":
+		err = m.cancel()
+	default:
+		return nil, &rpcError{Code: -32601, Message: "Method not found"}
+	}
+	if err != nil {
+		return nil, &rpcError{Code: 400, Message: err.Error()}
+	}
+	return "ok", nil
+}
+
+// @info The objects Klipper reports, with every field the connector queries
+func (m *Moonraker) objects() map[string]interface{} {
+	snap := m.read()
+	webhooks := map[string]string{"state": "ready", "state_message": "Printer is ready"}
+	state := string(snap.State)
+	switch snap.State {
+	case machineIdle:
+		state = "standby"
+	case machineError:
+		webhooks = map[string]string{"state": "shutdown", "state_message": snap.Message}
+	}
+	return map[string]interface{}{
+		"print_stats": map[string]interface{}{
+			"state":          state,
+			"filename":       snap.Filename,
+			"print_duration": snap.Elapsed.Seconds(),
+			"total_duration": snap.Elapsed.Seconds(),
+			"filament_used":  snap.FilamentMM,
+			"message":        snap.Message,
+		},
+		"virtual_sdcard": map[string]interface{}{"progress": snap.Progress, "is_active": snap.State == machinePrinting},
+		"webhooks":       webhooks,
+		"extruder":       map[string]float64{"temperature": snap.Nozzle[0], "target": snap.Nozzle[1]},
+		"heater_bed":     map[string]float64{"temperature": snap.Bed[0], "target": snap.Bed[1]},
+	}
+}
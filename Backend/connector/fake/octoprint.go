@@ -0,0 +1,172 @@
+package fake
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	str "strings"
+	"time"
+)
+
+// @info A stand-in for OctoPrint with the part of its REST API the connector uses
+type OctoPrint struct {
+	*machine
+	apiKey string
+	mux    *http.ServeMux
+}
+
+// @info Every print takes duration. Requests must carry apiKey in X-Api-Key unless it is empty.
+func NewOctoPrint(apiKey string, duration time.Duration) *OctoPrint {
+	o := &OctoPrint{machine: newMachine(duration), apiKey: apiKey, mux: http.NewServeMux()}
+	o.mux.HandleFunc("/api/files/local", o.upload)
+	o.mux.HandleFunc("/api/files/local/", o.selectFile)
+	o.mux.HandleFunc("/api/job", o.job)
+	o.mux.HandleFunc("/api/printer", o.printer)
+	return o
+}
+
+// @info Halts the printer with message, as a firmware error would
+func (o *OctoPrint) Fail(message string) {
+	o.fail(message)
+}
+
+// @info Clears a failure
+func (o *OctoPrint) Reset() {
+	o.reset()
+}
+
+// @info Contents of an uploaded file
+func (o *OctoPrint) File(name string) ([]byte, bool) {
+	return o.file(name)
+}
+
+func (o *OctoPrint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if o.apiKey != "" && r.Header.Get("X-Api-Key") != o.apiKey {
+		http.Error(w, "Invalid API key", http.StatusForbidden)
+		return
+	}
+	o.mux.ServeHTTP(w, r)
+}
+
+func (o *OctoPrint) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "No file included", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	o.machine.upload(header.Filename, data)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"done": true, "files": map[string]interface{}{"local": map[string]string{"name": header.Filename, "origin": "local"}}})
+}
+
+func (o *OctoPrint) selectFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	command := octoPrintCommand{}
+	if err := json.NewDecoder(r.Body).Decode(&command); err != nil || command.Command != "select" {
+		http.Error(w, "Expected a select command", http.StatusBadRequest)
+		return
+	}
+	name := str.TrimPrefix(r.URL.Path, "/api/files/local/")
+	if _, ok := o.file(name); !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if command.Print {
+		if err := o.start(name); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type octoPrintCommand struct {
+	Command string `json:"command"`
+	Action  string `json:"action"`
+	Print   bool   `json:"print"`
+}
+
+func (o *OctoPrint) job(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		snap := o.read()
+		job := map[string]interface{}{"file": map[string]interface{}{"name": nil}}
+		progress := map[string]interface{}{"completion": nil, "printTime": nil, "printTimeLeft": nil}
+		if snap.Filename != "" {
+			job["file"] = map[string]interface{}{"name": snap.Filename, "origin": "local"}
+			progress["completion"] = snap.Progress * 100
+			progress["printTime"] = int(snap.Elapsed.Seconds())
+			progress["printTimeLeft"] = int(snap.Left.Seconds())
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"job": job, "progress": progress, "state": octoPrintStateText(snap.State), "error": snap.Message})
+	case http.MethodPost:
+		command := octoPrintCommand{}
+		if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+			http.Error(w, "Invalid command", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch {
+		case command.Command == "cancel":
+			err = o.cancel()
+		case command.Command == "pause" && command.Action == "pause":
+			err = o.pause()
+		case command.Command == "pause" && command.Action == "resume":
+			err = o.resume()
+		default:
+			http.Error(w, "Unknown command", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (o *OctoPrint) printer(w http.ResponseWriter, r *http.Request) {
+	snap := o.read()
+	if snap.State == machineError {
+		http.Error(w, "Printer is not operational", http.StatusConflict)
+		return
+	}
+	temperature := map[string]interface{}{
+		"tool0": map[string]float64{"actual": snap.Nozzle[0], "target": snap.Nozzle[1], "offset": 0},
+		"bed":   map[string]float64{"actual": snap.Bed[0], "target": snap.Bed[1], "offset": 0},
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"temperature": temperature})
+}
+
+// @info OctoPrint keeps "Operational" after a print ends, the progress tells how
+func octoPrintStateText(state machineState) string {
+	switch state {
+	case machinePrinting:
+		return "Printing"
+	case machinePaused:
+		return "Paused"
+	case machineError:
+		return "Error"
+	}
+	return "Operational"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,299 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/http"
+	str "strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// @info Largest message accepted from Moonraker. Status answers are a few kilobytes, file listings may be larger.
+const maxMessageBytes = 16 << 20
+
+// @info Moonraker, the API of Klipper, https://moonraker.readthedocs.io/en/latest/web_api/. Files are uploaded over
+// HTTP, everything else is JSON-RPC over a WebSocket kept open between calls.
+type Moonraker struct {
+	baseURL string
+	apiKey  string
+
+	mu     sync.Mutex // One call at a time on the WebSocket
+	conn   *websocket.Conn
+	nextID int64
+}
+
+func NewMoonraker(baseURL string, apiKey string) *Moonraker {
+	return &Moonraker{baseURL: baseURL, apiKey: apiKey}
+}
+
+func (m *Moonraker) Kind() Kind {
+	return KindMoonraker
+}
+
+// @info POST /server/files/upload, multipart, into the gcodes root
+func (m *Moonraker) Upload(ctx context.Context, filename string, data []byte) error {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	if err := form.WriteField("root", "gcodes"); err != nil {
+		return err
+	}
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.baseURL+"/server/files/upload", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	_, err = do(req, m.apiKey)
+	return err
+}
+
+func (m *Moonraker) Start(ctx context.Context, filename string) error {
+	return m.call(ctx, "printer.print.start", map[string]interface{}{"filename": filename}, nil)
+}
+
+func (m *Moonraker) Pause(ctx context.Context) error {
+	return m.call(ctx, "printer.print.pause", nil, nil)
+}
+
+func (m *Moonraker) Resume(ctx context.Context) error {
+	return m.call(ctx, "printer.print.resume", nil, nil)
+}
+
+func (m *Moonraker) Cancel(ctx context.Context) error {
+	return m.call(ctx, "printer.print.cancel", nil, nil)
+}
+
+type moonrakerHeater struct {
+	Temperature float64 `json:"temperature"`
+	Target      float64 `json:"target"`
+}
+
+type moonrakerObjects struct {
+	Status struct {
+		PrintStats struct {
+			State         string  `json:"state"` // standby, printing, paused, complete, cancelled, error
+			Filename      string  `json:"filename"`
+			PrintDuration float64 `json:"print_duration"`
+			FilamentUsed  float64 `json:"filament_used"` // mm
+			Message       string  `json:"message"`
+		} `json:"print_stats"`
+		VirtualSDCard struct {
+			Progress float64 `json:"progress"`
+		} `json:"virtual_sdcard"`
+		Webhooks struct {
+			State        string `json:"state"` // ready, startup, shutdown, error
+			StateMessage string `json:"state_message"`
+		} `json:"webhooks"`
+		Extruder  *moonrakerHeater `json:"extruder"`
+		Extruder1 *moonrakerHeater `json:"extruder1"`
+		HeaterBed *moonrakerHeater `json:"heater_bed"`
+	} `json:"status"`
+}
+
+// @info printer.objects.query of print_stats, virtual_sdcard, webhooks and the heaters
+func (m *Moonraker) Status(ctx context.Context) (*Status, error) {
+	params := map[string]interface{}{"objects": map[string]interface{}{
+		"print_stats":    nil,
+		"virtual_sdcard": []string{"progress"},
+		"webhooks":       nil,
+		"extruder":       []string{"temperature", "target"},
+		"extruder1":      []string{"temperature", "target"},
+		"heater_bed":     []string{"temperature", "target"},
+	}}
+	objects := moonrakerObjects{}
+	if err := m.call(ctx, "printer.objects.query", params, &objects); err != nil {
+		return nil, err
+	}
+	stats := objects.Status.PrintStats
+	status := &Status{
+		Filename:       stats.Filename,
+		Progress:       objects.Status.VirtualSDCard.Progress,
+		ElapsedSeconds: stats.PrintDuration,
+		FilamentMM:     stats.FilamentUsed,
+		Message:        stats.Message,
+		Temperatures:   map[string]Temperature{},
+	}
+	// @info Klipper does not estimate the time left, the elapsed time is scaled by the file progress instead
+	if status.Progress > 0 && status.Progress < 1 {
+		status.RemainingSeconds = stats.PrintDuration * (1 - status.Progress) / status.Progress
+	}
+	switch objects.Status.Webhooks.State {
+	case "shutdown", "error":
+		status.State = StateError
+		status.Message = objects.Status.Webhooks.StateMessage
+	case "startup":
+		status.State = StateOffline
+	default:
+		status.State = moonrakerState(stats.State)
+	}
+	heaters := map[string]*moonrakerHeater{"nozzle": objects.Status.Extruder, "nozzle1": objects.Status.Extruder1, "bed": objects.Status.HeaterBed}
+	for key, heater := range heaters {
+		if heater != nil {
+			status.Temperatures[key] = Temperature{Actual: heater.Temperature, Target: heater.Target}
+		}
+	}
+	return status, nil
+}
+
+func moonrakerState(state string) State {
+	switch state {
+	case "printing":
+		return StatePrinting
+	case "paused":
+		return StatePaused
+	case "complete":
+		return StateComplete
+	case "cancelled":
+		return StateCancelled
+	case "error":
+		return StateError
+	}
+	return StateIdle // @info standby
+}
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	ID      int64       `json:"id"`
+}
+
+type rpcResponse struct {
+	ID     *int64          `json:"id"` // Notifications have none
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// @info Calls method and decodes its result into result, unless nil. A broken connection is dropped so that the next
+// call dials again.
+func (m *Moonraker) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		conn, err := m.dial(ctx)
+		if err != nil {
+			return err
+		}
+		m.conn = conn
+	}
+	raw, err := m.roundTrip(ctx, method, params)
+	if err != nil {
+		m.conn.Close()
+		m.conn = nil
+		return err
+	}
+	if raw.Error != nil {
+		return &HostError{StatusCode: raw.Error.Code, Message: raw.Error.Message}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(raw.Result, result)
+}
+
+func (m *Moonraker) roundTrip(ctx context.Context, method string, params interface{}) (*rpcResponse, error) {
+	m.nextID++
+	id := m.nextID
+	payload, err := json.Marshal(rpcRequest{JSONRPC: "2.0", Method: method, Params: params, ID: id})
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(30 * time.Second)
+	}
+	m.conn.SetDeadline(deadline)
+	defer m.conn.SetDeadline(time.Time{})
+	if err := websocket.Message.Send(m.conn, string(payload)); err != nil {
+		return nil, err
+	}
+	for {
+		message := []byte{}
+		if err := websocket.Message.Receive(m.conn, &message); err != nil {
+			return nil, err
+		}
+		resp := &rpcResponse{}
+		if err := json.Unmarshal(message, resp); err != nil {
+			return nil, err
+		}
+		if resp.ID != nil && *resp.ID == id {
+			return resp, nil
+		}
+		// @info Status notifications and answers to calls that timed out are skipped
+	}
+}
+
+// @info Opens the WebSocket. The connection and the handshake must both finish before the deadline of ctx, or
+// within 10 seconds.
+func (m *Moonraker) dial(ctx context.Context) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig("ws"+str.TrimPrefix(m.baseURL, "http")+"/websocket", m.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if m.apiKey != "" {
+		config.Header.Set("X-Api-Key", m.apiKey)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(10 * time.Second)
+	}
+	host := config.Location.Host
+	if config.Location.Port() == "" {
+		port := "80"
+		if config.Location.Scheme == "wss" {
+			port = "443"
+		}
+		host = net.JoinHostPort(config.Location.Hostname(), port)
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	var raw net.Conn
+	if config.Location.Scheme == "wss" {
+		raw, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: config.Location.Hostname()})
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to Moonraker: %w", err)
+	}
+	raw.SetDeadline(deadline)
+	conn, err := websocket.NewClient(config, raw)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("Could not connect to Moonraker: %w", err)
+	}
+	raw.SetDeadline(time.Time{})
+	conn.MaxPayloadBytes = maxMessageBytes
+	return conn, nil
+}
+
+// @info Closes the WebSocket, the next call opens another
+func (m *Moonraker) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return nil
+	}
+	err := m.conn.Close()
+	m.conn = nil
+	return err
+}
@@ -0,0 +1,186 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	str "strings"
+)
+
+// @info OctoPrint's REST API, https://docs.octoprint.org/en/master/api/
+type OctoPrint struct {
+	baseURL string
+	apiKey  string
+}
+
+func NewOctoPrint(baseURL string, apiKey string) *OctoPrint {
+	return &OctoPrint{baseURL: baseURL, apiKey: apiKey}
+}
+
+func (o *OctoPrint) Kind() Kind {
+	return KindOctoPrint
+}
+
+// @info POST /api/files/local, multipart
+func (o *OctoPrint) Upload(ctx context.Context, filename string, data []byte) error {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/api/files/local", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	_, err = do(req, o.apiKey)
+	return err
+}
+
+// @info POST /api/files/local/{filename} {"command": "select", "print": true}
+func (o *OctoPrint) Start(ctx context.Context, filename string) error {
+	return o.command(ctx, "/api/files/local/"+url.PathEscape(filename), map[string]interface{}{"command": "select", "print": true})
+}
+
+// @info POST /api/job {"command": "pause", "action": "pause"}
+func (o *OctoPrint) Pause(ctx context.Context) error {
+	return o.command(ctx, "/api/job", map[string]interface{}{"command": "pause", "action": "pause"})
+}
+
+func (o *OctoPrint) Resume(ctx context.Context) error {
+	return o.command(ctx, "/api/job", map[string]interface{}{"command": "pause", "action": "resume"})
+}
+
+func (o *OctoPrint) Cancel(ctx context.Context) error {
+	return o.command(ctx, "/api/job", map[string]interface{}{"command": "cancel"})
+}
+
+// @info OctoPrint answers 409 when the command does not fit the state of the printer
+func (o *OctoPrint) command(ctx context.Context, path string, command map[string]interface{}) error {
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = do(req, o.apiKey)
+	return err
+}
+
+type octoPrintJob struct {
+	State string `json:"state"` // Operational, Printing, Pausing, Paused, Cancelling, Error, Offline...
+	Error string `json:"error"`
+	Job   struct {
+		File struct {
+			Name string `json:"name"`
+		} `json:"file"`
+	} `json:"job"`
+	Progress struct {
+		Completion    *float64 `json:"completion"` // Percent
+		PrintTime     *float64 `json:"printTime"`
+		PrintTimeLeft *float64 `json:"printTimeLeft"`
+	} `json:"progress"`
+}
+
+type octoPrintPrinter struct {
+	Temperature map[string]struct {
+		Actual *float64 `json:"actual"`
+		Target *float64 `json:"target"`
+	} `json:"temperature"`
+}
+
+// @info GET /api/job for the job and GET /api/printer for the temperatures. The latter answers 409 while the printer
+// is not connected to OctoPrint, which is not an error here.
+func (o *OctoPrint) Status(ctx context.Context) (*Status, error) {
+	job := octoPrintJob{}
+	if err := o.get(ctx, "/api/job", &job); err != nil {
+		return nil, err
+	}
+	status := &Status{Filename: job.Job.File.Name, Message: job.Error, Temperatures: map[string]Temperature{}}
+	if job.Progress.Completion != nil {
+		status.Progress = *job.Progress.Completion / 100
+	}
+	if job.Progress.PrintTime != nil {
+		status.ElapsedSeconds = *job.Progress.PrintTime
+	}
+	if job.Progress.PrintTimeLeft != nil {
+		status.RemainingSeconds = *job.Progress.PrintTimeLeft
+	}
+	status.State = octoPrintState(job.State, status.Progress)
+
+	printer := octoPrintPrinter{}
+	err := o.get(ctx, "/api/printer?exclude=sd,state", &printer)
+	var hostErr *HostError
+	if err != nil && !(errors.As(err, &hostErr) && hostErr.StatusCode == http.StatusConflict) {
+		return nil, err
+	}
+	for name, reading := range printer.Temperature {
+		key := name
+		switch {
+		case name == "bed":
+		case name == "tool0":
+			key = "nozzle"
+		case str.HasPrefix(name, "tool"):
+			key = "nozzle" + str.TrimPrefix(name, "tool")
+		default:
+			continue // @info chamber, history...
+		}
+		temperature := Temperature{}
+		if reading.Actual != nil {
+			temperature.Actual = *reading.Actual
+		}
+		if reading.Target != nil {
+			temperature.Target = *reading.Target
+		}
+		status.Temperatures[key] = temperature
+	}
+	return status, nil
+}
+
+func (o *OctoPrint) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	body, err := do(req, o.apiKey)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// @info OctoPrint does not say how the last print ended: a file at 100% was completed, anything else was cancelled
+// or never started
+func octoPrintState(state string, progress float64) State {
+	lower := str.ToLower(state)
+	switch {
+	case str.HasPrefix(lower, "printing"), str.HasPrefix(lower, "starting"), str.HasPrefix(lower, "finishing"), str.HasPrefix(lower, "resuming"):
+		return StatePrinting
+	case str.HasPrefix(lower, "paus"):
+		return StatePaused
+	case str.HasPrefix(lower, "cancelling"):
+		return StateCancelled
+	case str.HasPrefix(lower, "error"):
+		return StateError
+	case str.HasPrefix(lower, "operational"), str.HasPrefix(lower, "ready"):
+		if progress >= 1 {
+			return StateComplete
+		}
+		return StateIdle
+	}
+	return StateOffline // @info Offline, Closed, Opening serial connection, Connecting...
+}
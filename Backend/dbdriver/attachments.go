@@ -0,0 +1,87 @@
+package dbdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// @info https://docs.couchdb.org/en/3.2.2/api/document/common.html#attachments
+// Documents list their attachments as stubs under _attachments. A document written back without its stubs loses the
+// attachments, so models keeping files must carry this map around (see Order.Attachments). An attachment written with
+// its Data is stored in the same revision as the rest of the document.
+type Attachment struct {
+	ContentType string `json:"content_type"`
+	Length      int64  `json:"length,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	Stub        bool   `json:"stub,omitempty"`
+	RevPos      int    `json:"revpos,omitempty"`
+	Data        []byte `json:"data,omitempty"` // Content to write inline with the document, CouchDB keeps a stub in its place
+}
+
+// @info Largest attachment GetAttachment reads into memory
+const MaxAttachmentBytes = 256 << 20
+
+// url := "http://localhost:5984/{DB_NAME}/{DOC_NAME}/{ATTACHMENT_NAME}?rev={REV}"
+// @info Adds or replaces an attachment of the given revision of a document. With an empty rev a new document holding
+// only the attachment is created.
+func PutAttachment(client *CouchDBClient, id string, rev string, name string, contentType string, data []byte) (*PutResponseData, error) {
+	resp_data := &PutResponseData{}
+	if client.DatabaseURL == nil {
+		return resp_data, errors.New("Attempted to put an attachment in an unspecified database (client is not connected)")
+	}
+	params := url.Values{}
+	if rev != "" {
+		params.Set("rev", rev)
+	}
+	url := client.DatabaseURL.JoinPath(id, name)
+	url.RawQuery = params.Encode()
+	req, err := http.NewRequest(http.MethodPut, url.String(), bytes.NewReader(data))
+	if err != nil {
+		return resp_data, err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return resp_data, err
+	}
+	if resp.StatusCode != 201 && resp.StatusCode != 202 {
+		return resp_data, newCouchDBError(resp) // @info 409 if rev is not the current revision
+	}
+	defer resp.Body.Close()
+	client.evict(id)
+	err = json.NewDecoder(resp.Body).Decode(&resp_data)
+	return resp_data, err
+}
+
+// url := "http://localhost:5984/{DB_NAME}/{DOC_NAME}/{ATTACHMENT_NAME}"
+// @info Reads an attachment, returning its content and content type
+func GetAttachment(client *CouchDBClient, id string, name string) ([]byte, string, error) {
+	if client.DatabaseURL == nil {
+		return nil, "", errors.New("Attempted to get an attachment from an unspecified database (client is not connected)")
+	}
+	url := client.DatabaseURL.JoinPath(id, name)
+	resp, err := client.Client.Get(url.String())
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != 200 {
+		return nil, "", newCouchDBError(resp) // @info See IsNotFound
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxAttachmentBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > MaxAttachmentBytes {
+		return nil, "", errors.New("The attachment is larger than MaxAttachmentBytes")
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
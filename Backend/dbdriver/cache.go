@@ -0,0 +1,299 @@
+package dbdriver
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	str "strings"
+	"sync"
+	"time"
+
+	"github.com/creasty/defaults"
+)
+
+// @info Read-through cache in front of GetDocument and GetDesignView.
+// Entries are kept for at most TTL, after which they are revalidated against CouchDB with If-None-Match (a 304 keeps
+// the cached body). Documents are keyed by ID and remember their revision, views by design doc, view name and query string.
+// When Watch is running, the database changes feed evicts documents whose revision changed and marks every view as
+// stale, so the next read revalidates it.
+// Cached bodies are stored as raw JSON and decoded on every read, so callers are free to modify what they get.
+type DocumentCache struct {
+	client  *CouchDBClient
+	opts    CacheOptions
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Front is the most recently used entry
+	bytes   int64
+	// @info Fetches in flight by key, and how many times their key was evicted meanwhile. A fetch whose key was evicted
+	// may have read the body from before the change, so it is not stored. Keys are dropped once nothing fetches them.
+	fetching    map[string]int
+	generations map[string]uint64
+}
+
+type CacheOptions struct {
+	MaxEntries int           `default:"1024"`     // Maximum number of cached documents and views
+	MaxBytes   int64         `default:"33554432"` // Maximum size of all cached bodies, 32MiB by default
+	TTL        time.Duration `default:"5m"`       // Time after which an entry must be revalidated with CouchDB
+}
+
+type cacheEntry struct {
+	key     string
+	rev     string // Only set for documents
+	etag    string
+	body    []byte
+	expires time.Time
+}
+
+type CacheStats struct {
+	Entries int
+	Bytes   int64
+}
+
+const (
+	docCachePrefix  = "doc:"
+	viewCachePrefix = "view:"
+)
+
+// @info A nil opts, or any zero value in it, uses the defaults of CacheOptions.
+func NewDocumentCache(client *CouchDBClient, opts *CacheOptions) *DocumentCache {
+	cache := &DocumentCache{
+		client:      client,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		fetching:    map[string]int{},
+		generations: map[string]uint64{},
+	}
+	if opts != nil {
+		cache.opts = *opts
+	}
+	defaults.Set(&cache.opts) // @info Only zero values are replaced
+	return cache
+}
+
+// url := "http://localhost:5984/{DB_NAME}/{DOC_NAME}"
+func (c *DocumentCache) GetDocument(id string) (GenericDocument, error) {
+	var doc = GenericDocument{}
+	if c.client.DatabaseURL == nil {
+		return doc, errors.New("Attempted to get a document from an unspecified database (client is not connected)")
+	}
+	body, err := c.get(docCachePrefix+id, id, c.client.DatabaseURL.JoinPath(id).String())
+	if err != nil {
+		return doc, err
+	}
+	err = json.Unmarshal(body, &doc)
+	return doc, err
+}
+
+// url := "http://localhost:5984/{DB_NAME}/_design/{DESIGN_DOC_NAME}/_view/{VIEW_NAME}"
+func (c *DocumentCache) GetDesignView(designDoc string, viewName string, opts *designViewOptions) (*DesignView, error) {
+	designView := &DesignView{}
+	if c.client.DatabaseURL == nil {
+		return designView, errors.New("Attempted to get a design view from an unspecified database (client is not connected)")
+	}
+	if !str.HasPrefix(designDoc, "_design/") {
+		designDoc = "_design/" + designDoc
+	}
+	if !str.HasPrefix(viewName, "_view/") {
+		viewName = "_view/" + viewName
+	}
+	url := c.client.DatabaseURL.JoinPath(designDoc).JoinPath(viewName)
+	if opts != nil {
+		queryString, err := designViewOptionsToQueryString(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: An error ocurred converting DesignViewOptions to a Query String.")
+		}
+		url.RawQuery = queryString
+	}
+	key := viewCachePrefix + designDoc + "/" + viewName + "?" + url.RawQuery
+	body, err := c.get(key, "", url.String())
+	if err != nil {
+		return designView, err
+	}
+	err = json.Unmarshal(body, designView)
+	return designView, err
+}
+
+// @info Evicts a document from the cache. Views are marked as stale since they may contain it.
+func (c *DocumentCache) Invalidate(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[docCachePrefix+id]; ok {
+		c.remove(elem)
+	}
+	c.evicted(docCachePrefix + id)
+	c.staleViews()
+}
+
+func (c *DocumentCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.bytes = 0
+	for key := range c.fetching {
+		c.evicted(key)
+	}
+}
+
+func (c *DocumentCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return CacheStats{Entries: c.lru.Len(), Bytes: c.bytes}
+}
+
+// @info Follows the database changes feed until ctx is cancelled, invalidating entries as documents change.
+// It is meant to be run on its own goroutine: go cache.Watch(ctx)
+func (c *DocumentCache) Watch(ctx context.Context) error {
+	return FollowChanges(ctx, c.client, &ChangesOptions{Since: "now"}, func(change Change) error {
+		c.applyChange(change)
+		return nil
+	})
+}
+
+func (c *DocumentCache) applyChange(change Change) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[docCachePrefix+change.ID]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if change.Deleted || entry.rev != change.REV() {
+			c.remove(elem)
+		}
+	}
+	c.evicted(docCachePrefix + change.ID)
+	c.staleViews()
+}
+
+// @info Returns the cached body for key, fetching or revalidating it from url when needed.
+func (c *DocumentCache) get(key string, id string, url string) ([]byte, error) {
+	etag := ""
+	c.mutex.Lock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			c.mutex.Unlock()
+			return entry.body, nil
+		}
+		etag = entry.etag
+	}
+	c.fetching[key]++
+	generation := c.generations[key]
+	c.mutex.Unlock()
+	defer c.fetched(key)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := c.client.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		resp.Body.Close()
+		c.mutex.Lock()
+		elem, ok := c.entries[key]
+		if ok && c.generations[key] == generation {
+			entry := elem.Value.(*cacheEntry)
+			entry.expires = time.Now().Add(c.opts.TTL)
+			c.lru.MoveToFront(elem)
+		}
+		c.mutex.Unlock()
+		if !ok {
+			return c.get(key, id, url) // @info Evicted while being revalidated, fetch it again without the ETag
+		}
+		return elem.Value.(*cacheEntry).body, nil
+	case http.StatusOK:
+	default:
+		c.mutex.Lock()
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+		}
+		c.mutex.Unlock()
+		return nil, newCouchDBError(resp)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &cacheEntry{
+		key:     key,
+		etag:    resp.Header.Get("ETag"),
+		body:    body,
+		expires: time.Now().Add(c.opts.TTL),
+	}
+	if id != "" {
+		entry.rev = str.Trim(entry.etag, `"`) // @info The ETag of a document is its quoted revision
+	}
+	c.store(entry, generation)
+	return body, nil
+}
+
+// @info Stores the entry unless its key was evicted since generation was read, see DocumentCache.generations
+func (c *DocumentCache) store(entry *cacheEntry, generation uint64) {
+	size := int64(len(entry.body))
+	if size > c.opts.MaxBytes {
+		return // Never cache something that would evict everything else
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.generations[entry.key] != generation {
+		return
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.bytes += size
+	for c.lru.Len() > c.opts.MaxEntries || c.bytes > c.opts.MaxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// @info Must be called with the mutex held
+func (c *DocumentCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.body))
+}
+
+// @info Forces every cached view to be revalidated on its next read. Must be called with the mutex held
+func (c *DocumentCache) staleViews() {
+	for key, elem := range c.entries {
+		if str.HasPrefix(key, viewCachePrefix) {
+			elem.Value.(*cacheEntry).expires = time.Time{}
+		}
+	}
+	for key := range c.fetching {
+		if str.HasPrefix(key, viewCachePrefix) {
+			c.evicted(key)
+		}
+	}
+}
+
+// @info Makes the fetches of key in flight drop what they read. Must be called with the mutex held
+func (c *DocumentCache) evicted(key string) {
+	if c.fetching[key] > 0 {
+		c.generations[key]++
+	}
+}
+
+func (c *DocumentCache) fetched(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.fetching[key]--; c.fetching[key] <= 0 {
+		delete(c.fetching, key)
+		delete(c.generations, key)
+	}
+}
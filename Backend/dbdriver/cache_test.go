@@ -0,0 +1,232 @@
+package dbdriver_test
+
+import (
+	"3DQuest/dbdriver"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	str "strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// @info Just enough of CouchDB for the cache: documents with ETags, writes and a continuous changes feed
+type fakeCouch struct {
+	mutex   sync.Mutex
+	revs    map[string]int
+	gets    map[string]int // Full reads of each document, revalidations answered with 304 are not counted
+	changes chan string
+	pause   func() // Called once, by the next full read after taking its revision and before answering
+}
+
+func newFakeCouch() *fakeCouch {
+	return &fakeCouch{revs: map[string]int{}, gets: map[string]int{}, changes: make(chan string, 16)}
+}
+
+func (f *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := str.TrimPrefix(r.URL.Path, "/db/")
+	if id == "_changes" {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case line := <-f.changes:
+				fmt.Fprintln(w, line)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.revs[id]++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"ok":true,"id":%q,"rev":"%d-x"}`, id, f.revs[id])
+	case http.MethodGet:
+		rev, ok := f.revs[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":"not_found","reason":"missing"}`)
+			return
+		}
+		etag := fmt.Sprintf(`"%d-x"`, rev)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		f.gets[id]++
+		if pause := f.pause; pause != nil {
+			f.pause = nil
+			f.mutex.Unlock()
+			pause()
+			f.mutex.Lock()
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"_id": id, "_rev": fmt.Sprintf("%d-x", rev)})
+	}
+}
+
+// @info Changes the document behind the back of the cache, as another backend would
+func (f *fakeCouch) bump(id string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.revs[id]++
+	return fmt.Sprintf("%d-x", f.revs[id])
+}
+
+func (f *fakeCouch) reads(id string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.gets[id]
+}
+
+func cached(t *testing.T, opts *dbdriver.CacheOptions) (*dbdriver.CouchDBClient, *fakeCouch) {
+	t.Helper()
+	couch := newFakeCouch()
+	server := httptest.NewServer(couch)
+	t.Cleanup(server.Close)
+	dbURL, err := url.Parse(server.URL + "/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &dbdriver.CouchDBClient{DatabaseURL: dbURL, Client: server.Client()}
+	client.Cache = dbdriver.NewDocumentCache(client, opts)
+	return client, couch
+}
+
+func revOf(t *testing.T, client *dbdriver.CouchDBClient, id string) string {
+	t.Helper()
+	doc, err := dbdriver.GetCachedDocument(client, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc["_rev"].(string)
+}
+
+func TestCacheRevalidatesAfterTTL(t *testing.T) {
+	client, couch := cached(t, &dbdriver.CacheOptions{TTL: 50 * time.Millisecond})
+	couch.bump("user:1")
+	revOf(t, client, "user:1")
+	revOf(t, client, "user:1")
+	if reads := couch.reads("user:1"); reads != 1 {
+		t.Fatalf("reads within the TTL = %d, want 1", reads)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if rev := revOf(t, client, "user:1"); rev != "1-x" {
+		t.Fatalf("rev = %s, want 1-x", rev)
+	}
+	if reads := couch.reads("user:1"); reads != 1 {
+		t.Fatalf("reads after revalidating an unchanged document = %d, want 1", reads)
+	}
+
+	couch.bump("user:1")
+	time.Sleep(60 * time.Millisecond)
+	if rev := revOf(t, client, "user:1"); rev != "2-x" {
+		t.Fatalf("rev after the TTL = %s, want 2-x", rev)
+	}
+}
+
+func TestCacheEvictsOnChanges(t *testing.T) {
+	client, couch := cached(t, &dbdriver.CacheOptions{TTL: time.Hour})
+	couch.bump("product:1")
+	couch.bump("product:2")
+	revOf(t, client, "product:1")
+	revOf(t, client, "product:2")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watching := make(chan error, 1)
+	go func() { watching <- client.Cache.Watch(ctx) }()
+	// @info A change to the revision already cached keeps it, the next one evicts it
+	couch.changes <- `{"seq":"1","id":"product:2","changes":[{"rev":"1-x"}]}`
+	couch.changes <- fmt.Sprintf(`{"seq":"2","id":"product:1","changes":[{"rev":%q}]}`, couch.bump("product:1"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for client.Cache.Stats().Entries != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("entries = %d, want 1", client.Cache.Stats().Entries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rev := revOf(t, client, "product:1"); rev != "2-x" {
+		t.Fatalf("rev after the change = %s, want 2-x", rev)
+	}
+	if reads := couch.reads("product:2"); reads != 1 {
+		t.Fatalf("reads of the unchanged document = %d, want 1", reads)
+	}
+	cancel()
+	if err := <-watching; err != context.Canceled {
+		t.Fatalf("Watch = %v, want context.Canceled", err)
+	}
+}
+
+func TestCacheEvictsOwnWrites(t *testing.T) {
+	client, couch := cached(t, &dbdriver.CacheOptions{TTL: time.Hour})
+	couch.bump("user:1")
+	revOf(t, client, "user:1")
+	doc := dbdriver.GenericDocument{"_rev": "1-x"}
+	if _, err := dbdriver.CreateOrModifyDocument(client, &doc, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if rev := revOf(t, client, "user:1"); rev != "2-x" {
+		t.Fatalf("rev after writing = %s, want 2-x", rev)
+	}
+}
+
+func TestCacheDropsReadsOlderThanAnEviction(t *testing.T) {
+	client, couch := cached(t, &dbdriver.CacheOptions{TTL: time.Hour})
+	couch.bump("user:1")
+	reading, written := make(chan struct{}), make(chan struct{})
+	couch.mutex.Lock()
+	couch.pause = func() {
+		close(reading)
+		<-written
+	}
+	couch.mutex.Unlock()
+
+	done := make(chan string)
+	go func() {
+		doc, err := dbdriver.GetCachedDocument(client, "user:1")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- fmt.Sprint(doc["_rev"])
+	}()
+	// @info Written while the read above is on its way, with the revision from before
+	<-reading
+	couch.bump("user:1")
+	client.Cache.Invalidate("user:1")
+	close(written)
+	if rev := <-done; rev != "1-x" {
+		t.Fatalf("rev of the read in flight = %s, want 1-x", rev)
+	}
+	if rev := revOf(t, client, "user:1"); rev != "2-x" {
+		t.Fatalf("rev after the write = %s, want 2-x", rev)
+	}
+}
+
+func TestCacheBounds(t *testing.T) {
+	client, couch := cached(t, &dbdriver.CacheOptions{MaxEntries: 2, TTL: time.Hour})
+	for _, id := range []string{"a", "b", "c"} {
+		couch.bump(id)
+		revOf(t, client, id)
+	}
+	if entries := client.Cache.Stats().Entries; entries != 2 {
+		t.Fatalf("entries = %d, want 2", entries)
+	}
+	revOf(t, client, "a") // @info The least recently used was evicted
+	if reads := couch.reads("a"); reads != 2 {
+		t.Fatalf("reads of the evicted document = %d, want 2", reads)
+	}
+
+	if _, err := dbdriver.GetCachedDocument(client, "missing"); !dbdriver.IsNotFound(err) {
+		t.Fatalf("GetCachedDocument of a missing document = %v, want not found", err)
+	}
+}
@@ -0,0 +1,137 @@
+package dbdriver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/go-querystring/query"
+)
+
+// @info https://docs.couchdb.org/en/3.2.2/api/database/changes.html
+type Change struct {
+	Seq     string          `json:"seq"` // Opaque update sequence, pass it as Since to resume the feed
+	ID      string          `json:"id"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Doc     GenericDocument `json:"doc,omitempty"`
+	Changes []struct {
+		REV string `json:"rev"`
+	} `json:"changes"`
+}
+
+// @info Revision of the leaf that triggered the change. Empty if CouchDB did not report one.
+func (c *Change) REV() string {
+	if len(c.Changes) == 0 {
+		return ""
+	}
+	return c.Changes[0].REV
+}
+
+type ChangesOptions struct {
+	Since       string `url:"since,omitempty"`        // "now" skips the history, "0" or empty replays every change
+	IncludeDocs bool   `url:"include_docs,omitempty"` // Send the full document with every change
+	Filter      string `url:"filter,omitempty"`       // {DESIGN_DOC}/{FILTER}, or a builtin filter such as _design
+	Heartbeat   uint32 `url:"heartbeat,omitempty"`    // Milliseconds between newlines sent to keep the connection alive
+	Style       string `url:"style,omitempty"`        // "main_only" (default) or "all_docs"
+	Conflicts   bool   `url:"conflicts,omitempty"`
+	Descending  bool   `url:"descending,omitempty"`
+}
+
+// @info Minimum and maximum wait between reconnections of FollowChanges
+const (
+	changesMinBackoff = 500 * time.Millisecond
+	changesMaxBackoff = 30 * time.Second
+)
+
+// url := "http://localhost:5984/{DB_NAME}/_changes?feed=continuous"
+// @info Follows the continuous changes feed calling handler for every change, in order. The feed is resumed from the
+// last seen sequence when the connection drops. It only returns when ctx is cancelled (returning ctx.Err()) or when
+// handler returns an error (which is returned as-is).
+func FollowChanges(ctx context.Context, client *CouchDBClient, opts *ChangesOptions, handler func(Change) error) error {
+	if client.DatabaseURL == nil {
+		return errors.New("Attempted to follow the changes feed of an unspecified database (client is not connected)")
+	}
+	current := ChangesOptions{}
+	if opts != nil {
+		current = *opts
+	}
+	if current.Heartbeat == 0 {
+		current.Heartbeat = 10000
+	}
+	backoff := changesMinBackoff
+	for {
+		var handlerErr error
+		connected, err := followChangesOnce(ctx, client, &current, func(change Change) error {
+			handlerErr = handler(change)
+			if handlerErr == nil {
+				current.Since = change.Seq
+			}
+			return handlerErr
+		})
+		if handlerErr != nil {
+			return handlerErr
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected && err == nil {
+			backoff = changesMinBackoff // Clean disconnection (e.g. server restart), reconnect right away
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > changesMaxBackoff {
+			backoff = changesMaxBackoff
+		}
+	}
+}
+
+// @info Opens a single continuous feed connection and reads it until it is closed. Returns whether the connection succeeded.
+func followChangesOnce(ctx context.Context, client *CouchDBClient, opts *ChangesOptions, handler func(Change) error) (bool, error) {
+	url := client.DatabaseURL.JoinPath("_changes")
+	vals, err := query.Values(opts)
+	if err != nil {
+		return false, err
+	}
+	vals.Set("feed", "continuous")
+	url.RawQuery = vals.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, newCouchDBError(resp)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // @info Lines hold whole documents when IncludeDocs is set
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue // Heartbeat
+		}
+		change := Change{}
+		if err := json.Unmarshal(line, &change); err != nil {
+			return true, err
+		}
+		if change.ID == "" {
+			continue // Last line of the feed ({"last_seq": ...}) when the server closes it
+		}
+		if err := handler(change); err != nil {
+			return true, err
+		}
+	}
+	return true, scanner.Err()
+}
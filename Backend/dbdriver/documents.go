@@ -0,0 +1,23 @@
+package dbdriver
+
+import "encoding/json"
+
+// @info Converts a GenericDocument returned by the driver into a model struct (or anything JSON can decode into)
+func DecodeDocument(doc GenericDocument, v interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// @info Converts a model struct into a GenericDocument that can be written with CreateOrModifyDocument
+func EncodeDocument(v interface{}) (GenericDocument, error) {
+	doc := GenericDocument{}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return doc, err
+	}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
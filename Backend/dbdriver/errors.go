@@ -0,0 +1,50 @@
+package dbdriver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// @info https://docs.couchdb.org/en/3.2.2/api/basics.html#http-status-codes
+// CouchDB answers every failed request with a JSON object holding an error name and a reason.
+type CouchDBError struct {
+	StatusCode int    `json:"-"`
+	ErrorName  string `json:"error"`  // Short error name, e.g. "conflict", "not_found"
+	Reason     string `json:"reason"` // Human readable explanation given by CouchDB
+}
+
+func (e *CouchDBError) Error() string {
+	if e.ErrorName == "" {
+		return fmt.Sprintf("CouchDB responded with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("CouchDB responded with status %d (%s): %s", e.StatusCode, e.ErrorName, e.Reason)
+}
+
+// @info Reads and closes the body of a failed response, turning it into a *CouchDBError
+func newCouchDBError(resp *http.Response) error {
+	defer resp.Body.Close()
+	couchErr := &CouchDBError{StatusCode: resp.StatusCode}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err == nil && len(body) > 0 {
+		json.Unmarshal(body, couchErr) // @info A non JSON body still yields a usable error with the status code
+	}
+	return couchErr
+}
+
+func hasStatus(err error, status int) bool {
+	var couchErr *CouchDBError
+	return errors.As(err, &couchErr) && couchErr.StatusCode == status
+}
+
+// @info 404 Not Found. The database or document does not exist (or was deleted)
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// @info 409 Conflict. The document was modified since its _rev was read
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
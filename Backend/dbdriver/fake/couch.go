@@ -0,0 +1,401 @@
+package fake
+
+import (
+	"3DQuest/dbdriver"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	str "strings"
+	"sync"
+)
+
+// @info Just enough of CouchDB for the models: one database with revisions and conflicts, _find with the selectors
+// and sorts the models use, _bulk_docs, _uuids and attachment uploads, standalone or inline. Indexes are accepted and
+// ignored.
+type Couch struct {
+	mutex sync.Mutex
+	docs  map[string]map[string]interface{}
+	revs  map[string]int
+}
+
+func NewCouch() *Couch {
+	return &Couch{docs: map[string]map[string]interface{}{}, revs: map[string]int{}}
+}
+
+// @info A client of the database of the fake served at serverURL, e.g. by httptest.NewServer
+func Client(serverURL string, httpClient *http.Client) (*dbdriver.CouchDBClient, error) {
+	parsed, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	return &dbdriver.CouchDBClient{ServerURL: parsed, DatabaseURL: parsed.JoinPath("db"), Client: httpClient}, nil
+}
+
+// @info The documents whose type is docType, as stored
+func (f *Couch) OfType(docType string) []map[string]interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	found := []map[string]interface{}{}
+	for _, doc := range f.docs {
+		if doc["type"] == docType {
+			found = append(found, doc)
+		}
+	}
+	return found
+}
+
+func (f *Couch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	path := str.TrimPrefix(r.URL.Path, "/")
+	if path == "_uuids" {
+		reply(w, http.StatusOK, map[string]interface{}{"uuids": []string{newID()}})
+		return
+	}
+	path = str.TrimPrefix(str.TrimPrefix(path, "db"), "/")
+	if id, name, ok := str.Cut(path, "/"); ok && r.Method == http.MethodPut && !str.HasPrefix(id, "_") {
+		f.attach(w, id, name, r)
+		return
+	}
+	var body map[string]interface{}
+	if r.Method == http.MethodPut || r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			reply(w, http.StatusBadRequest, map[string]string{"error": "bad_request", "reason": err.Error()})
+			return
+		}
+	}
+	switch {
+	case path == "" && r.Method == http.MethodPost:
+		f.write(w, newID(), body)
+	case path == "":
+		reply(w, http.StatusOK, map[string]interface{}{"db_name": "db", "doc_count": len(f.docs)})
+	case path == "_find":
+		f.find(w, body)
+	case path == "_index":
+		reply(w, http.StatusOK, map[string]string{"result": "created"})
+	case path == "_bulk_docs":
+		results := []map[string]interface{}{}
+		docs, _ := body["docs"].([]interface{})
+		for _, doc := range docs {
+			doc := doc.(map[string]interface{})
+			id, _ := doc["_id"].(string)
+			if id == "" {
+				id = newID()
+			}
+			status, result := f.put(id, doc)
+			if status != http.StatusCreated {
+				result["id"] = id
+			}
+			results = append(results, result)
+		}
+		reply(w, http.StatusCreated, results)
+	case r.Method == http.MethodGet:
+		doc, ok := f.docs[path]
+		if !ok {
+			reply(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "missing"})
+			return
+		}
+		w.Header().Set("ETag", strconv.Quote(doc["_rev"].(string)))
+		reply(w, http.StatusOK, doc)
+	case r.Method == http.MethodPut:
+		f.write(w, path, body)
+	case r.Method == http.MethodDelete:
+		// @info CouchDB answers deletions with 200 rather than 201
+		status, result := f.put(path, map[string]interface{}{"_rev": r.URL.Query().Get("rev"), "_deleted": true})
+		if status == http.StatusCreated {
+			status = http.StatusOK
+		}
+		reply(w, status, result)
+	default:
+		reply(w, http.StatusMethodNotAllowed, map[string]string{"error": "method_not_allowed", "reason": r.Method})
+	}
+}
+
+func (f *Couch) write(w http.ResponseWriter, id string, doc map[string]interface{}) {
+	status, result := f.put(id, doc)
+	reply(w, status, result)
+}
+
+// @info Only its stub is kept, attachments are not read back
+func (f *Couch) attach(w http.ResponseWriter, id string, name string, r *http.Request) {
+	doc, ok := f.docs[id]
+	if !ok {
+		reply(w, http.StatusNotFound, map[string]string{"error": "not_found", "reason": "missing"})
+		return
+	}
+	data, _ := io.ReadAll(r.Body)
+	updated := map[string]interface{}{}
+	for key, value := range doc {
+		updated[key] = value
+	}
+	attachments := map[string]interface{}{}
+	if stored, ok := doc["_attachments"].(map[string]interface{}); ok {
+		for key, value := range stored {
+			attachments[key] = value
+		}
+	}
+	attachments[name] = map[string]interface{}{"content_type": r.Header.Get("Content-Type"), "length": float64(len(data)), "stub": true}
+	updated["_attachments"], updated["_rev"] = attachments, r.URL.Query().Get("rev")
+	f.write(w, id, updated)
+}
+
+// @info Called with the lock held
+func (f *Couch) put(id string, doc map[string]interface{}) (int, map[string]interface{}) {
+	rev, _ := doc["_rev"].(string)
+	if current, exists := f.docs[id]; (exists && current["_rev"] != rev) || (!exists && rev != "") {
+		return http.StatusConflict, map[string]interface{}{"error": "conflict", "reason": "Document update conflict."}
+	}
+	f.revs[id]++
+	rev = fmt.Sprintf("%d-%s", f.revs[id], newID())
+	if deleted, _ := doc["_deleted"].(bool); deleted {
+		delete(f.docs, id)
+	} else {
+		stored := map[string]interface{}{}
+		for key, value := range doc {
+			stored[key] = value
+		}
+		stored["_id"], stored["_rev"] = id, rev
+		if attachments, ok := doc["_attachments"].(map[string]interface{}); ok {
+			stored["_attachments"] = stubs(attachments)
+		}
+		f.docs[id] = stored
+	}
+	return http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": rev}
+}
+
+// @info Attachments written inline with their data are kept as stubs, as CouchDB does
+func stubs(attachments map[string]interface{}) map[string]interface{} {
+	kept := map[string]interface{}{}
+	for name, value := range attachments {
+		attachment, _ := value.(map[string]interface{})
+		if encoded, ok := attachment["data"].(string); ok {
+			data, _ := base64.StdEncoding.DecodeString(encoded)
+			value = map[string]interface{}{"content_type": attachment["content_type"], "length": float64(len(data)), "stub": true}
+		}
+		kept[name] = value
+	}
+	return kept
+}
+
+func (f *Couch) find(w http.ResponseWriter, body map[string]interface{}) {
+	selector, _ := body["selector"].(map[string]interface{})
+	found := []map[string]interface{}{}
+	for _, doc := range f.docs {
+		if matches(doc, selector) {
+			found = append(found, doc)
+		}
+	}
+	sorts, _ := body["sort"].([]interface{})
+	sort.SliceStable(found, func(i, j int) bool {
+		for _, s := range sorts {
+			field, descending := "", false
+			switch s := s.(type) {
+			case string:
+				field = s
+			case map[string]interface{}:
+				for key, direction := range s {
+					field, descending = key, direction == "desc"
+				}
+			}
+			if c := collate(lookup(found[i], field), lookup(found[j], field)); c != 0 {
+				return (c < 0) != descending
+			}
+		}
+		return collate(found[i]["_id"], found[j]["_id"]) < 0
+	})
+	skip := 0
+	if bookmark, _ := body["bookmark"].(string); bookmark != "" {
+		decoded, _ := base64.StdEncoding.DecodeString(bookmark)
+		skip, _ = strconv.Atoi(string(decoded))
+	}
+	limit := 25
+	if value, ok := body["limit"].(float64); ok && value > 0 {
+		limit = int(value)
+	}
+	if skip > len(found) {
+		skip = len(found)
+	}
+	end := skip + limit
+	if end > len(found) {
+		end = len(found)
+	}
+	reply(w, http.StatusOK, map[string]interface{}{"docs": found[skip:end], "bookmark": base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(end)))})
+}
+
+func matches(doc interface{}, selector map[string]interface{}) bool {
+	for key, condition := range selector {
+		switch key {
+		case "$and", "$or":
+			clauses, _ := condition.([]interface{})
+			any := false
+			for _, clause := range clauses {
+				ok := matches(doc, clause.(map[string]interface{}))
+				if key == "$and" && !ok {
+					return false
+				}
+				any = any || ok
+			}
+			if key == "$or" && !any {
+				return false
+			}
+		default:
+			object, _ := doc.(map[string]interface{})
+			if !satisfies(lookup(object, key), condition) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// @info A missing value is told apart from null by missing
+type missingValue struct{}
+
+var missing = missingValue{}
+
+func satisfies(value interface{}, condition interface{}) bool {
+	operators, ok := condition.(map[string]interface{})
+	if !ok {
+		return value != missing && collate(value, condition) == 0
+	}
+	for operator, argument := range operators {
+		ok := true
+		switch operator {
+		case "$eq":
+			ok = value != missing && collate(value, argument) == 0
+		case "$ne":
+			ok = value == missing || collate(value, argument) != 0
+		case "$lt":
+			ok = value != missing && collate(value, argument) < 0
+		case "$lte":
+			ok = value != missing && collate(value, argument) <= 0
+		case "$gt":
+			ok = value != missing && collate(value, argument) > 0
+		case "$gte":
+			ok = value != missing && collate(value, argument) >= 0
+		case "$exists":
+			ok = (value != missing) == argument.(bool)
+		case "$in", "$nin":
+			in := false
+			for _, candidate := range argument.([]interface{}) {
+				in = in || (value != missing && collate(value, candidate) == 0)
+			}
+			ok = in == (operator == "$in")
+		case "$elemMatch":
+			ok = false
+			elements, _ := value.([]interface{})
+			for _, element := range elements {
+				if sub, isSelector := argument.(map[string]interface{}); isSelector && elementMatches(element, sub) {
+					ok = true
+				}
+			}
+		case "$regex":
+			text, isString := value.(string)
+			ok = isString && regexp.MustCompile(argument.(string)).MatchString(text)
+		default:
+			if str.HasPrefix(operator, "$") {
+				panic("fake CouchDB: unsupported operator " + operator)
+			}
+			ok = matches(value, map[string]interface{}{operator: argument})
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// @info The elements of $elemMatch are either objects matched by field or values matched by operators, e.g.
+// {"$eq": "tools"}
+func elementMatches(element interface{}, selector map[string]interface{}) bool {
+	for key := range selector {
+		if str.HasPrefix(key, "$") && key != "$and" && key != "$or" {
+			return satisfies(element, selector)
+		}
+	}
+	return matches(element, selector)
+}
+
+func lookup(doc map[string]interface{}, field string) interface{} {
+	var value interface{} = doc
+	for _, part := range str.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return missing
+		}
+		if value, ok = object[part]; !ok {
+			return missing
+		}
+	}
+	return value
+}
+
+// @info CouchDB's collation, simplified: null, booleans, numbers, strings, arrays, objects
+func collate(a interface{}, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case missingValue, nil:
+			return 0
+		case bool:
+			return 1
+		case float64:
+			return 2
+		case string:
+			return 3
+		case []interface{}:
+			return 4
+		}
+		return 5
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case float64:
+		switch b := b.(float64); {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case string:
+		return str.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := collate(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	}
+	return 0
+}
+
+func reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,64 @@
+package dbdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// @info https://docs.couchdb.org/en/3.2.2/api/database/find.html#db-index
+type IndexDefinition struct {
+	Index struct {
+		Fields          []interface{}          `json:"fields"` // Field names or {"field": "asc|desc"} objects
+		PartialSelector map[string]interface{} `json:"partial_filter_selector,omitempty"`
+	} `json:"index"`
+	DesignDoc string `json:"ddoc,omitempty"` // Design document holding the index, shared by every index with the same ddoc
+	Name      string `json:"name,omitempty"`
+	Type      string `json:"type,omitempty"` // "json" (default) or "text"
+}
+
+type IndexResponseData struct {
+	Result string `json:"result"` // "created" or "exists"
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+}
+
+// url := "http://localhost:5984/{DB_NAME}/_index"
+// @info Creates a Mango index. Creating an index that already exists is a no-op, so it is safe to call on every startup.
+func CreateIndex(client *CouchDBClient, index *IndexDefinition) (*IndexResponseData, error) {
+	resp_data := &IndexResponseData{}
+	if client.DatabaseURL == nil {
+		return resp_data, errors.New("Attempted to create an index in an unspecified database (client is not connected)")
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return resp_data, err
+	}
+	url := client.DatabaseURL.JoinPath("_index")
+	req, err := http.NewRequest(http.MethodPost, url.String(), bytes.NewReader(data))
+	if err != nil {
+		return resp_data, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return resp_data, err
+	}
+	if resp.StatusCode != 200 {
+		return resp_data, newCouchDBError(resp)
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(resp_data)
+	return resp_data, err
+}
+
+// @info Shorthand for a json index over the given fields, all sorted in the same direction
+func NewIndex(name string, fields ...string) *IndexDefinition {
+	index := &IndexDefinition{Name: name, DesignDoc: name, Type: "json"}
+	for _, field := range fields {
+		index.Index.Fields = append(index.Index.Fields, field)
+	}
+	return index
+}
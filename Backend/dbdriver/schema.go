@@ -0,0 +1,426 @@
+package dbdriver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	str "strings"
+	"sync"
+	"time"
+)
+
+// @info Documents are told apart by their "type" field. A SchemaRegistry holds the expected shape of every type and is
+// checked by CreateOrModifyDocument (and so UpdateDocument) before anything is written when set on CouchDBClient.Schemas.
+// The same rules can be installed as a validate_doc_update function so CouchDB rejects bad writes from any other client.
+// Schemas are usually derived from model structs with SchemaFromStruct, using the `json` name of every field and an
+// optional `validate` tag:
+//
+//	Email   string  `json:"email" validate:"required,format=email"`
+//	Credits float32 `json:"credits" validate:"min=0"`
+//	Type    string  `json:"type" validate:"required,enum=user|admin"`
+//
+// Supported rules: required, min, max (numbers), minlen, maxlen (strings and arrays), enum (| separated), pattern (a
+// regular expression understood by both Go and JavaScript, it can't contain commas) and format (email, date-time).
+type SchemaRegistry struct {
+	mutex   sync.RWMutex
+	schemas map[string]*Schema
+}
+
+type Schema struct {
+	Fields map[string]*FieldRule `json:"fields"`
+	Strict bool                  `json:"strict,omitempty"` // Reject fields that are not declared (except the ones starting with '_')
+}
+
+type FieldRule struct {
+	Kind      string   `json:"kind,omitempty"` // string, number, integer, boolean, array or object. Empty accepts anything
+	Required  bool     `json:"required,omitempty"`
+	Nullable  bool     `json:"nullable,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	MinLength *int     `json:"minlen,omitempty"`
+	MaxLength *int     `json:"maxlen,omitempty"`
+	Enum      []string `json:"enum,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp // Pattern compiled by Register
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// @info Returned when a document does not match the schema of its type
+type ValidationError struct {
+	DocType string       `json:"type"`
+	Fields  []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		problems[i] = field.Field + " " + field.Message
+	}
+	return fmt.Sprintf("Invalid %s document: %s", e.DocType, str.Join(problems, "; "))
+}
+
+func IsValidationError(err error) bool {
+	var validationErr *ValidationError
+	return errors.As(err, &validationErr)
+}
+
+var schemaFormats = map[string]string{
+	"email":     `^[^@\s]+@[^@\s]+\.[^@\s]+$`,
+	"date-time": `^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$`,
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{schemas: map[string]*Schema{}}
+}
+
+// @info Registers schema for every given document type, replacing any previous one
+func (r *SchemaRegistry) Register(schema *Schema, docTypes ...string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name, field := range schema.Fields {
+		if field.Pattern == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(field.Pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid pattern for field %s: %w", name, err)
+		}
+		field.pattern = pattern
+	}
+	for _, docType := range docTypes {
+		r.schemas[docType] = schema
+	}
+	return nil
+}
+
+func (r *SchemaRegistry) Schema(docType string) (*Schema, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	schema, ok := r.schemas[docType]
+	return schema, ok
+}
+
+// @info Validates any JSON-marshallable document (GenericDocument or model struct). Documents without a registered type,
+// and deleted documents, are always valid.
+func (r *SchemaRegistry) Validate(doc interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return r.validateJSON(data)
+}
+
+func (r *SchemaRegistry) validateJSON(data []byte) error {
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	if deleted, _ := values["_deleted"].(bool); deleted {
+		return nil
+	}
+	docType, _ := values["type"].(string)
+	schema, ok := r.Schema(docType)
+	if !ok {
+		return nil
+	}
+	validationErr := &ValidationError{DocType: docType}
+	for _, name := range schema.fieldNames() {
+		value, present := values[name]
+		if problem := schema.Fields[name].check(value, present); problem != "" {
+			validationErr.Fields = append(validationErr.Fields, FieldError{Field: name, Message: problem})
+		}
+	}
+	if schema.Strict {
+		for name := range values {
+			if _, declared := schema.Fields[name]; !declared && !str.HasPrefix(name, "_") {
+				validationErr.Fields = append(validationErr.Fields, FieldError{Field: name, Message: "is not allowed"})
+			}
+		}
+	}
+	if len(validationErr.Fields) > 0 {
+		sort.Slice(validationErr.Fields, func(i, j int) bool { return validationErr.Fields[i].Field < validationErr.Fields[j].Field })
+		return validationErr
+	}
+	return nil
+}
+
+func (s *Schema) fieldNames() []string {
+	names := make([]string, 0, len(s.Fields))
+	for name := range s.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// @info Returns a description of the problem, or an empty string if the value is fine
+func (f *FieldRule) check(value interface{}, present bool) string {
+	if !present {
+		if f.Required {
+			return "is required"
+		}
+		return ""
+	}
+	if value == nil {
+		if f.Nullable || !f.Required {
+			return ""
+		}
+		return "can't be null"
+	}
+	switch f.Kind {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return "must be a string"
+		}
+	case "number", "integer":
+		number, ok := value.(float64)
+		if !ok {
+			return "must be a number"
+		}
+		if f.Kind == "integer" && number != math.Trunc(number) {
+			return "must be an integer"
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return "must be a boolean"
+		}
+	case "array":
+		if _, ok := value.([]interface{}); !ok {
+			return "must be an array"
+		}
+	case "object":
+		if _, ok := value.(map[string]interface{}); !ok {
+			return "must be an object"
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if f.Min != nil && v < *f.Min {
+			return fmt.Sprintf("must be at least %v", *f.Min)
+		}
+		if f.Max != nil && v > *f.Max {
+			return fmt.Sprintf("must be at most %v", *f.Max)
+		}
+	case string:
+		length := len([]rune(v))
+		if f.MinLength != nil && length < *f.MinLength {
+			return fmt.Sprintf("must be at least %d characters long", *f.MinLength)
+		}
+		if f.MaxLength != nil && length > *f.MaxLength {
+			return fmt.Sprintf("must be at most %d characters long", *f.MaxLength)
+		}
+		if len(f.Enum) > 0 && !containsString(f.Enum, v) {
+			return "must be one of " + str.Join(f.Enum, ", ")
+		}
+		if f.pattern != nil && !f.pattern.MatchString(v) {
+			return "has an invalid format"
+		}
+	case []interface{}:
+		if f.MinLength != nil && len(v) < *f.MinLength {
+			return fmt.Sprintf("must have at least %d elements", *f.MinLength)
+		}
+		if f.MaxLength != nil && len(v) > *f.MaxLength {
+			return fmt.Sprintf("must have at most %d elements", *f.MaxLength)
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, value string) bool {
+	for _, elem := range list {
+		if elem == value {
+			return true
+		}
+	}
+	return false
+}
+
+// @info Builds a Schema from the `json` and `validate` tags of a struct (or pointer to struct). Fields without a json
+// name, ignored with "-" or starting with '_' (_id, _rev...) are skipped.
+func SchemaFromStruct(model interface{}) (*Schema, error) {
+	modelType := reflect.TypeOf(model)
+	for modelType != nil && modelType.Kind() == reflect.Pointer {
+		modelType = modelType.Elem()
+	}
+	if modelType == nil || modelType.Kind() != reflect.Struct {
+		return nil, errors.New("SchemaFromStruct expects a struct")
+	}
+	schema := &Schema{Fields: map[string]*FieldRule{}}
+	for i := 0; i < modelType.NumField(); i++ {
+		field := modelType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := str.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || str.HasPrefix(name, "_") {
+			continue
+		}
+		rule, err := parseValidateTag(field.Tag.Get("validate"))
+		if err != nil {
+			return nil, fmt.Errorf("Field %s: %w", field.Name, err)
+		}
+		rule.Kind = kindOf(field.Type)
+		if field.Type.Kind() == reflect.Pointer {
+			rule.Nullable = true
+		}
+		schema.Fields[name] = rule
+	}
+	return schema, nil
+}
+
+func kindOf(fieldType reflect.Type) string {
+	for fieldType.Kind() == reflect.Pointer {
+		fieldType = fieldType.Elem()
+	}
+	if fieldType == reflect.TypeOf(time.Time{}) {
+		return "string"
+	}
+	switch fieldType.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return ""
+}
+
+func parseValidateTag(tag string) (*FieldRule, error) {
+	rule := &FieldRule{}
+	if tag == "" {
+		return rule, nil
+	}
+	for _, option := range str.Split(tag, ",") {
+		key, value, _ := str.Cut(option, "=")
+		var err error
+		switch key {
+		case "required":
+			rule.Required = true
+		case "min", "max":
+			var number float64
+			number, err = strconv.ParseFloat(value, 64)
+			if key == "min" {
+				rule.Min = &number
+			} else {
+				rule.Max = &number
+			}
+		case "minlen", "maxlen":
+			var length int
+			length, err = strconv.Atoi(value)
+			if key == "minlen" {
+				rule.MinLength = &length
+			} else {
+				rule.MaxLength = &length
+			}
+		case "enum":
+			rule.Enum = str.Split(value, "|")
+		case "pattern":
+			rule.Pattern = value
+		case "format":
+			pattern, ok := schemaFormats[value]
+			if !ok {
+				return nil, fmt.Errorf("Unknown format '%s'", value)
+			}
+			rule.Pattern = pattern
+		default:
+			return nil, fmt.Errorf("Unknown validation rule '%s'", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for validation rule '%s': %w", key, err)
+		}
+	}
+	return rule, nil
+}
+
+// @info https://docs.couchdb.org/en/3.2.2/ddocs/ddocs.html#validate-document-update-functions
+// The registered schemas are embedded as JSON and checked with the same rules used in Go.
+const validateDocUpdateTemplate = `function (newDoc, oldDoc, userCtx, secObj) {
+	if (newDoc._deleted) { return; }
+	var schemas = %s;
+	var schema = schemas[newDoc.type];
+	if (!schema) { return; }
+	function fail(field, message) { throw({forbidden: "Invalid " + newDoc.type + " document: " + field + " " + message}); }
+	function kindOf(value) {
+		if (Array.isArray(value)) { return "array"; }
+		return typeof value;
+	}
+	for (var name in schema.fields) {
+		var rule = schema.fields[name];
+		var present = newDoc.hasOwnProperty(name);
+		var value = newDoc[name];
+		if (!present) { if (rule.required) { fail(name, "is required"); } continue; }
+		if (value === null) { if (rule.required && !rule.nullable) { fail(name, "can't be null"); } continue; }
+		var kind = kindOf(value);
+		if (rule.kind === "integer") {
+			if (kind !== "number") { fail(name, "must be a number"); }
+			if (Math.floor(value) !== value) { fail(name, "must be an integer"); }
+		} else if (rule.kind && kind !== rule.kind) {
+			fail(name, "must be a " + rule.kind);
+		}
+		if (kind === "number") {
+			if (rule.hasOwnProperty("min") && value < rule.min) { fail(name, "must be at least " + rule.min); }
+			if (rule.hasOwnProperty("max") && value > rule.max) { fail(name, "must be at most " + rule.max); }
+		}
+		if (kind === "string" || kind === "array") {
+			if (rule.hasOwnProperty("minlen") && value.length < rule.minlen) { fail(name, "is too short"); }
+			if (rule.hasOwnProperty("maxlen") && value.length > rule.maxlen) { fail(name, "is too long"); }
+		}
+		if (kind === "string") {
+			if (rule.enum && rule.enum.indexOf(value) < 0) { fail(name, "must be one of " + rule.enum.join(", ")); }
+			if (rule.pattern && !(new RegExp(rule.pattern)).test(value)) { fail(name, "has an invalid format"); }
+		}
+	}
+	if (schema.strict) {
+		for (var key in newDoc) {
+			if (key.charAt(0) !== "_" && !schema.fields.hasOwnProperty(key)) { fail(key, "is not allowed"); }
+		}
+	}
+}`
+
+// @info JavaScript source of a validate_doc_update function enforcing every registered schema
+func (r *SchemaRegistry) ValidateDocUpdateFunction() (string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	schemas, err := json.Marshal(r.schemas)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(validateDocUpdateTemplate, schemas), nil
+}
+
+// @info Writes the validate_doc_update function into the given design document, creating it if needed and keeping its
+// views and update handlers.
+func InstallSchemaValidation(client *CouchDBClient, registry *SchemaRegistry, designDoc string) (*PutResponseData, error) {
+	function, err := registry.ValidateDocUpdateFunction()
+	if err != nil {
+		return &PutResponseData{}, err
+	}
+	doc, err := GetDesignDocument(client, designDoc)
+	if err != nil {
+		return &PutResponseData{}, err
+	}
+	if doc.ID == "" { // @info The design document does not exist yet
+		doc = &DesignDocument{ID: designDoc}
+	}
+	doc.ValidateDocUpdate = function
+	return PutDesignDocument(client, doc)
+}
@@ -0,0 +1,290 @@
+package dbdriver_test
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/dbdriver/fake"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	str "strings"
+	"testing"
+	"time"
+)
+
+type part struct {
+	ID       string    `json:"_id,omitempty"`
+	Type     string    `json:"type" validate:"required"`
+	Name     string    `json:"name" validate:"required,minlen=2,maxlen=10"`
+	Quantity int       `json:"quantity,omitempty" validate:"min=1,max=100"`
+	Weight   float64   `json:"weight,omitempty" validate:"min=0"`
+	Status   string    `json:"status,omitempty" validate:"enum=draft|ready"`
+	SKU      string    `json:"sku,omitempty" validate:"pattern=^[A-Z]{2}-[0-9]{2}$"`
+	Email    string    `json:"email,omitempty" validate:"format=email"`
+	Tags     []string  `json:"tags,omitempty" validate:"maxlen=2"`
+	Notes    *string   `json:"notes" validate:"required"`
+	Printed  bool      `json:"printed,omitempty"`
+	Updated  time.Time `json:"updated,omitempty"`
+	Options  struct{}  `json:"options,omitempty"`
+	Internal string    `json:"-"`
+	hidden   string
+}
+
+// @info Parts are registered as "part", and again as "sealed" with a strict schema
+func registry(t *testing.T) *dbdriver.SchemaRegistry {
+	t.Helper()
+	registry := dbdriver.NewSchemaRegistry()
+	for _, docType := range []string{"part", "sealed"} {
+		schema, err := dbdriver.SchemaFromStruct(&part{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema.Strict = docType == "sealed"
+		if err := registry.Register(schema, docType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return registry
+}
+
+var schemaCases = []struct {
+	name     string
+	doc      string
+	problems []string // Field and message of every problem, in order
+}{
+	{"valid", `{"type":"part","name":"bracket","quantity":2,"weight":1.5,"tags":["a"],"notes":null,"printed":true,"updated":"2024-03-01T10:00:00Z","options":{}}`, nil},
+	{"only the required fields", `{"type":"part","name":"lid","notes":"fragile"}`, nil},
+	{"missing fields", `{"type":"part"}`, []string{"name is required", "notes is required"}},
+	{"required null", `{"type":"part","name":null,"notes":null}`, []string{"name can't be null"}},
+	{"optional null", `{"type":"part","name":"lid","notes":null,"quantity":null,"tags":null}`, nil},
+	{"not a string", `{"type":"part","name":5,"notes":null}`, []string{"name must be a string"}},
+	{"not a number", `{"type":"part","name":"lid","notes":null,"quantity":"2"}`, []string{"quantity must be a number"}},
+	{"not an integer", `{"type":"part","name":"lid","notes":null,"quantity":1.5}`, []string{"quantity must be an integer"}},
+	{"not a boolean", `{"type":"part","name":"lid","notes":null,"printed":"yes"}`, []string{"printed must be a boolean"}},
+	{"not an array", `{"type":"part","name":"lid","notes":null,"tags":"a"}`, []string{"tags must be an array"}},
+	{"not an object", `{"type":"part","name":"lid","notes":null,"options":[]}`, []string{"options must be an object"}},
+	{"below the minimum", `{"type":"part","name":"lid","notes":null,"quantity":0,"weight":-1}`, []string{"quantity must be at least 1", "weight must be at least 0"}},
+	{"above the maximum", `{"type":"part","name":"lid","notes":null,"quantity":101}`, []string{"quantity must be at most 100"}},
+	{"too short", `{"type":"part","name":"a","notes":null}`, []string{"name must be at least 2 characters long"}},
+	{"too long", `{"type":"part","name":"a bracket for the nozzle","notes":null}`, []string{"name must be at most 10 characters long"}},
+	{"length in characters", `{"type":"part","name":"ñandúñandú","notes":null}`, nil},
+	{"too many elements", `{"type":"part","name":"lid","notes":null,"tags":["a","b","c"]}`, []string{"tags must have at most 2 elements"}},
+	{"not in the enum", `{"type":"part","name":"lid","notes":null,"status":"done"}`, []string{"status must be one of draft, ready"}},
+	{"in the enum", `{"type":"part","name":"lid","notes":null,"status":"ready"}`, nil},
+	{"pattern", `{"type":"part","name":"lid","notes":null,"sku":"nz-04"}`, []string{"sku has an invalid format"}},
+	{"format", `{"type":"part","name":"lid","notes":null,"email":"alice","updated":"yesterday"}`, []string{"email has an invalid format"}},
+	{"undeclared field", `{"type":"part","name":"lid","notes":null,"colour":"red"}`, nil},
+	{"undeclared field, strict", `{"type":"sealed","name":"lid","notes":null,"colour":"red","_attachments":{}}`, []string{"colour is not allowed"}},
+	{"every problem, sorted", `{"type":"sealed","name":"a","weight":-1,"colour":"red"}`, []string{"colour is not allowed", "name must be at least 2 characters long", "notes is required", "weight must be at least 0"}},
+	{"deleted", `{"type":"part","_deleted":true}`, nil},
+	{"unregistered type", `{"type":"printer","name":5}`, nil},
+	{"no type", `{"name":5}`, nil},
+}
+
+func TestSchemaValidate(t *testing.T) {
+	registry := registry(t)
+	for _, c := range schemaCases {
+		doc := dbdriver.GenericDocument{}
+		if err := json.Unmarshal([]byte(c.doc), &doc); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		err := registry.Validate(doc)
+		if c.problems == nil {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			}
+			continue
+		}
+		var validationErr *dbdriver.ValidationError
+		if !errors.As(err, &validationErr) || !dbdriver.IsValidationError(err) {
+			t.Errorf("%s: error %v, want a *ValidationError", c.name, err)
+			continue
+		}
+		problems := []string{}
+		for _, field := range validationErr.Fields {
+			problems = append(problems, field.Field+" "+field.Message)
+		}
+		if !reflect.DeepEqual(problems, c.problems) {
+			t.Errorf("%s: problems %q, want %q", c.name, problems, c.problems)
+		}
+		if validationErr.DocType != doc["type"] {
+			t.Errorf("%s: type %q", c.name, validationErr.DocType)
+		}
+	}
+
+	// @info Model structs are validated as they are written
+	if err := registry.Validate(&part{Type: "part", Name: "lid", Quantity: 3}); err != nil {
+		t.Errorf("struct: %v", err)
+	}
+	if err := registry.Validate(&part{Type: "part", Name: "lid", Status: "done"}); !dbdriver.IsValidationError(err) {
+		t.Errorf("invalid struct: %v", err)
+	}
+}
+
+func TestSchemaFromStruct(t *testing.T) {
+	schema, err := dbdriver.SchemaFromStruct(part{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]string{}
+	for name, rule := range schema.Fields {
+		kinds[name] = rule.Kind
+	}
+	want := map[string]string{"type": "string", "name": "string", "quantity": "integer", "weight": "number", "status": "string", "sku": "string",
+		"email": "string", "tags": "array", "notes": "string", "printed": "boolean", "updated": "string", "options": "object"}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("fields %v, want %v", kinds, want)
+	}
+	notes, name := schema.Fields["notes"], schema.Fields["name"]
+	if !notes.Required || !notes.Nullable || name.Nullable {
+		t.Errorf("notes %+v, name %+v: pointers are nullable, and only them", notes, name)
+	}
+	if *name.MinLength != 2 || *name.MaxLength != 10 || *schema.Fields["quantity"].Min != 1 || *schema.Fields["quantity"].Max != 100 {
+		t.Errorf("bounds of name %+v and quantity %+v", name, schema.Fields["quantity"])
+	}
+	if email := schema.Fields["email"]; email.Pattern == "" {
+		t.Error("format=email set no pattern")
+	}
+
+	cases := []struct {
+		name  string
+		model interface{}
+		fails string
+	}{
+		{"not a struct", 5, "expects a struct"},
+		{"nil", nil, "expects a struct"},
+		{"unknown rule", &struct {
+			Name string `json:"name" validate:"required,colour=red"`
+		}{}, "Unknown validation rule 'colour'"},
+		{"unknown format", &struct {
+			ID string `json:"id" validate:"format=uuid"`
+		}{}, "Unknown format 'uuid'"},
+		{"bad number", &struct {
+			Size int `json:"size" validate:"min=small"`
+		}{}, "Invalid value for validation rule 'min'"},
+		{"bad length", &struct {
+			Name string `json:"name" validate:"maxlen=1.5"`
+		}{}, "Invalid value for validation rule 'maxlen'"},
+	}
+	for _, c := range cases {
+		if _, err := dbdriver.SchemaFromStruct(c.model); err == nil || !str.Contains(err.Error(), c.fails) {
+			t.Errorf("%s: error %v, want %q", c.name, err, c.fails)
+		}
+	}
+
+	badPattern := &dbdriver.Schema{Fields: map[string]*dbdriver.FieldRule{"sku": {Kind: "string", Pattern: "(NZ"}}}
+	if err := dbdriver.NewSchemaRegistry().Register(badPattern, "product"); err == nil {
+		t.Error("a schema with an invalid pattern was registered")
+	}
+}
+
+func TestValidateDocUpdateFunction(t *testing.T) {
+	registry := registry(t)
+	function, err := registry.ValidateDocUpdateFunction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// @info The schemas are embedded as they are registered
+	start, end := str.Index(function, "var schemas = "), str.Index(function, ";\n\tvar schema =")
+	if !str.HasPrefix(function, "function (newDoc, oldDoc, userCtx, secObj) {") || start < 0 || end < start {
+		t.Fatalf("not a validate_doc_update function:\n%s", function)
+	}
+	embedded := map[string]*dbdriver.Schema{}
+	if err := json.Unmarshal([]byte(function[start+len("var schemas = "):end]), &embedded); err != nil {
+		t.Fatalf("embedded schemas: %v", err)
+	}
+	for _, docType := range []string{"part", "sealed"} {
+		schema, _ := registry.Schema(docType)
+		if embedded[docType] == nil || !reflect.DeepEqual(embedded[docType].Fields["name"], schema.Fields["name"]) || embedded[docType].Strict != schema.Strict {
+			t.Errorf("schema of %s embedded as %+v", docType, embedded[docType])
+		}
+	}
+
+	// @info CouchDB runs it, and it should refuse the same documents as Validate
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed, the function is not run")
+	}
+	docs := []string{}
+	for _, c := range schemaCases {
+		docs = append(docs, c.doc)
+	}
+	script := "var validate = " + function + ";\nvar docs = [" + str.Join(docs, ",") + "];\n" +
+		`console.log(JSON.stringify(docs.map(function (doc) {
+	try { validate(doc, null, {}, {}); return ""; } catch (e) { return e.forbidden || String(e); }
+})));`
+	path := filepath.Join(t.TempDir(), "validate.js")
+	if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(node, path).Output()
+	if err != nil {
+		t.Fatalf("running the function: %v", err)
+	}
+	refusals := []string{}
+	if err := json.Unmarshal(out, &refusals); err != nil || len(refusals) != len(schemaCases) {
+		t.Fatalf("output %s: %v", out, err)
+	}
+	for i, c := range schemaCases {
+		if (refusals[i] != "") != (c.problems != nil) {
+			t.Errorf("%s: refused with %q, want problems %q", c.name, refusals[i], c.problems)
+		}
+		doc := dbdriver.GenericDocument{}
+		json.Unmarshal([]byte(c.doc), &doc)
+		if refusals[i] != "" && !str.HasPrefix(refusals[i], fmt.Sprintf("Invalid %s document: ", doc["type"])) {
+			t.Errorf("%s: refused with %q", c.name, refusals[i])
+		}
+	}
+}
+
+func TestInstallSchemaValidation(t *testing.T) {
+	server := httptest.NewServer(fake.NewCouch())
+	t.Cleanup(server.Close)
+	client, err := fake.Client(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := registry(t)
+	function, _ := registry.ValidateDocUpdateFunction()
+
+	// @info Created when missing, then written again keeping the views
+	if _, err := dbdriver.InstallSchemaValidation(client, registry, "schemas"); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := dbdriver.GetDesignDocument(client, "schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.ID != "_design/schemas" || doc.ValidateDocUpdate != function {
+		t.Fatalf("design document %s with validate_doc_update %q", doc.ID, doc.ValidateDocUpdate)
+	}
+	doc.Views = map[string]dbdriver.View{"by-name": {MapFunction: "function (doc) { emit(doc.name); }"}}
+	doc.ValidateDocUpdate = ""
+	if _, err := dbdriver.PutDesignDocument(client, doc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbdriver.InstallSchemaValidation(client, registry, "_design/schemas"); err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ = dbdriver.GetDesignDocument(client, "schemas"); doc.ValidateDocUpdate != function || doc.Views["by-name"].MapFunction == "" {
+		t.Errorf("design document %+v", doc)
+	}
+
+	// @info With the registry on the client, invalid documents are refused before being sent
+	client.Schemas = registry
+	invalid := dbdriver.GenericDocument{"type": "part", "name": 5}
+	if _, err := dbdriver.CreateOrModifyDocument(client, &invalid, "part:1"); !dbdriver.IsValidationError(err) {
+		t.Errorf("invalid document written: %v", err)
+	}
+	if _, err := dbdriver.GetDocument(client, "part:1"); !dbdriver.IsNotFound(err) {
+		t.Errorf("the invalid document was stored: %v", err)
+	}
+	valid := dbdriver.GenericDocument{"type": "part", "name": "lid", "notes": nil}
+	if _, err := dbdriver.CreateOrModifyDocument(client, &valid, "part:1"); err != nil {
+		t.Error(err)
+	}
+}
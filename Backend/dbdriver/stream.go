@@ -0,0 +1,312 @@
+package dbdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	str "strings"
+)
+
+// @info Streaming counterpart of GetDesignView and FindInDatabase. Instead of decoding the whole response into memory,
+// a RowReader walks the response body and decodes the elements of "rows" (views, _all_docs) or "docs" (_find) one at a time.
+// Usage:
+//
+//	reader, err := dbdriver.StreamDesignView(client, "test", "all_user_view", opts)
+//	if err != nil { ... }
+//	defer reader.Close()
+//	for reader.Next() {
+//		row := dbdriver.Row{}
+//		if err := reader.Scan(&row); err != nil { ... }
+//	}
+//	if err := reader.Err(); err != nil { ... }
+//
+// Calling Close before the end of the results terminates the stream early and closes the underlying connection.
+type RowReader struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+	field   string          // Name of the array holding the results, "rows" or "docs"
+	current json.RawMessage // Last element read by Next
+	err     error
+	inArray bool
+	done    bool
+	closed  bool
+
+	totalRows    uint64
+	offset       uint32
+	bookmark     string
+	warning      string
+	seenTotal    bool
+	seenOffset   bool
+	seenBookmark bool
+}
+
+// @info Single row of _all_docs. Key is always the document ID and Value holds its current revision.
+type AllDocsRow struct {
+	ID    string `json:"id"`
+	Key   string `json:"key"`
+	Value struct {
+		REV     string `json:"rev"`
+		Deleted bool   `json:"deleted,omitempty"`
+	} `json:"value"`
+	Doc   GenericDocument `json:"doc,omitempty"`
+	Error string          `json:"error,omitempty"` // Only present when querying by keys that do not exist
+}
+
+func newRowReader(body io.ReadCloser, field string) (*RowReader, error) {
+	reader := &RowReader{body: body, decoder: json.NewDecoder(body), field: field}
+	tok, err := reader.decoder.Token()
+	if err != nil {
+		body.Close()
+		return reader, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		body.Close()
+		return reader, errors.New("Expected a JSON object at the start of the response")
+	}
+	return reader, nil
+}
+
+// @info Advances to the next element of the result array. Returns false once all elements have been read, the reader
+// has been closed or an error occurred (check Err).
+func (r *RowReader) Next() bool {
+	if r.done || r.closed || r.err != nil {
+		return false
+	}
+	if !r.inArray {
+		if !r.seekArray() {
+			return false
+		}
+	}
+	if !r.decoder.More() {
+		r.inArray = false
+		if _, err := r.decoder.Token(); err != nil { // Consume the closing ']'
+			r.fail(err)
+			return false
+		}
+		r.readTrailer()
+		return false
+	}
+	r.current = r.current[:0]
+	if err := r.decoder.Decode(&r.current); err != nil {
+		r.fail(err)
+		return false
+	}
+	return true
+}
+
+// @info Decodes the current element into v, which is usually a *Row, *AllDocsRow, *GenericDocument or a model struct.
+func (r *RowReader) Scan(v interface{}) error {
+	if len(r.current) == 0 {
+		return errors.New("Scan called without a current row (call Next first)")
+	}
+	return json.Unmarshal(r.current, v)
+}
+
+// @info Raw JSON of the current element. The slice is reused on the next call to Next.
+func (r *RowReader) Raw() json.RawMessage {
+	return r.current
+}
+
+func (r *RowReader) Err() error {
+	return r.err
+}
+
+// @info Closes the response body. If the results were not fully read the connection is dropped instead of being reused.
+func (r *RowReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.body.Close()
+}
+
+// @info total_rows is sent before the rows by CouchDB, so it is available after the first call to Next.
+func (r *RowReader) TotalRows() (uint64, bool) {
+	return r.totalRows, r.seenTotal
+}
+
+func (r *RowReader) Offset() (uint32, bool) {
+	return r.offset, r.seenOffset
+}
+
+// @info The _find bookmark is sent after the docs, so it is only available once Next has returned false.
+func (r *RowReader) Bookmark() (string, bool) {
+	return r.bookmark, r.seenBookmark
+}
+
+func (r *RowReader) Warning() string {
+	return r.warning
+}
+
+func (r *RowReader) fail(err error) {
+	r.err = err
+	r.Close()
+}
+
+// @info Reads top-level keys until the result array is reached, storing any metadata found on the way.
+func (r *RowReader) seekArray() bool {
+	for r.decoder.More() {
+		key, ok := r.readKey()
+		if !ok {
+			return false
+		}
+		if key == r.field {
+			tok, err := r.decoder.Token()
+			if err != nil {
+				r.fail(err)
+				return false
+			}
+			if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+				r.fail(fmt.Errorf("Expected \"%s\" to be a JSON array", r.field))
+				return false
+			}
+			r.inArray = true
+			return true
+		}
+		if !r.readMetadata(key) {
+			return false
+		}
+	}
+	r.finish()
+	return false
+}
+
+// @info Reads whatever follows the result array (bookmark, warning, execution_stats...)
+func (r *RowReader) readTrailer() {
+	for r.decoder.More() {
+		key, ok := r.readKey()
+		if !ok || !r.readMetadata(key) {
+			return
+		}
+	}
+	r.finish()
+}
+
+func (r *RowReader) finish() {
+	if _, err := r.decoder.Token(); err != nil { // Consume the closing '}'
+		r.fail(err)
+		return
+	}
+	r.done = true
+	r.Close()
+}
+
+func (r *RowReader) readKey() (string, bool) {
+	tok, err := r.decoder.Token()
+	if err != nil {
+		r.fail(err)
+		return "", false
+	}
+	key, ok := tok.(string)
+	if !ok {
+		r.fail(errors.New("Expected an object key in the response"))
+		return "", false
+	}
+	return key, true
+}
+
+func (r *RowReader) readMetadata(key string) bool {
+	var err error
+	switch key {
+	case "total_rows":
+		err = r.decoder.Decode(&r.totalRows)
+		r.seenTotal = err == nil
+	case "offset":
+		err = r.decoder.Decode(&r.offset)
+		r.seenOffset = err == nil
+	case "bookmark":
+		err = r.decoder.Decode(&r.bookmark)
+		r.seenBookmark = err == nil
+	case "warning":
+		err = r.decoder.Decode(&r.warning)
+	default:
+		var skip json.RawMessage
+		err = r.decoder.Decode(&skip)
+	}
+	if err != nil {
+		r.fail(err)
+		return false
+	}
+	return true
+}
+
+func streamRequest(client *CouchDBClient, req *http.Request, field string) (*RowReader, error) {
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newCouchDBError(resp)
+	}
+	return newRowReader(resp.Body, field)
+}
+
+// url := "http://localhost:5984/{DB_NAME}/_design/{DESIGN_DOC_NAME}/_view/{VIEW_NAME}"
+func StreamDesignView(client *CouchDBClient, designDoc string, viewName string, opts *designViewOptions) (*RowReader, error) {
+	if client.DatabaseURL == nil {
+		return nil, errors.New("Attempted to stream a design view from an unspecified database (client is not connected)")
+	}
+	if !str.HasPrefix(designDoc, "_design/") {
+		designDoc = "_design/" + designDoc
+	}
+	if !str.HasPrefix(viewName, "_view/") {
+		viewName = "_view/" + viewName
+	}
+	url := client.DatabaseURL.JoinPath(designDoc).JoinPath(viewName)
+	if opts != nil {
+		queryString, err := designViewOptionsToQueryString(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: An error ocurred converting DesignViewOptions to a Query String.")
+		}
+		url.RawQuery = queryString
+	}
+	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return streamRequest(client, req, "rows")
+}
+
+// url := "http://localhost:5984/{DB_NAME}/_all_docs"
+// @info _all_docs accepts the same query parameters as a view. Rows should be scanned into an AllDocsRow.
+func StreamAllDocs(client *CouchDBClient, opts *designViewOptions) (*RowReader, error) {
+	if client.DatabaseURL == nil {
+		return nil, errors.New("Attempted to stream all documents from an unspecified database (client is not connected)")
+	}
+	url := client.DatabaseURL.JoinPath("_all_docs")
+	if opts != nil {
+		queryString, err := designViewOptionsToQueryString(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: An error ocurred converting DesignViewOptions to a Query String.")
+		}
+		url.RawQuery = queryString
+	}
+	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return streamRequest(client, req, "rows")
+}
+
+// url := "http://localhost:5984/{DB_NAME}/_find"
+// @info Documents are scanned directly (no row wrapper). The bookmark for the next page is read after the last doc.
+func StreamFind(client *CouchDBClient, opts *FindOptions) (*RowReader, error) {
+	if client.DatabaseURL == nil {
+		return nil, errors.New("Attempted to stream a find in a database but no database was specified (client is not connected)")
+	}
+	url := client.DatabaseURL.JoinPath("_find")
+	jsonBytes, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url.String(), bytes.NewReader(jsonBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return streamRequest(client, req, "docs")
+}
@@ -0,0 +1,164 @@
+package dbdriver_test
+
+import (
+	"3DQuest/dbdriver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// @info A client of a server answering every request with status and body
+func answering(t *testing.T, status int, body string) *dbdriver.CouchDBClient {
+	t.Helper()
+	return serving(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func serving(t *testing.T, handler http.Handler) *dbdriver.CouchDBClient {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	dbURL, err := url.Parse(server.URL + "/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dbdriver.CouchDBClient{DatabaseURL: dbURL, Client: server.Client()}
+}
+
+func TestRowReader(t *testing.T) {
+	cases := []struct {
+		name     string
+		find     bool
+		body     string
+		ids      []string
+		total    interface{} // uint64, or nil if not sent
+		offset   interface{} // uint32, or nil if not sent
+		bookmark interface{} // string, or nil if not sent
+		warning  string
+		fails    bool
+	}{
+		{"view", false, `{"total_rows":3,"offset":1,"rows":[{"id":"b","key":"b","value":{"rev":"1-x"}},{"id":"c","key":"c","value":{"rev":"2-x"}}]}`, []string{"b", "c"}, uint64(3), uint32(1), nil, "", false},
+		{"find", true, `{"docs":[{"_id":"a"},{"_id":"b"}],"bookmark":"g1AAAA","warning":"No matching index found"}`, []string{"a", "b"}, nil, nil, "g1AAAA", "No matching index found", false},
+		{"metadata among other keys", false, `{"update_seq":"7-x","total_rows":0,"rows":[],"execution_stats":{"docs":0}}`, []string{}, uint64(0), nil, nil, "", false},
+		{"no results array", true, `{"bookmark":"nil"}`, []string{}, nil, nil, "nil", "", false},
+		{"truncated", false, `{"total_rows":2,"rows":[{"id":"a"},{"id":`, []string{"a"}, uint64(2), nil, nil, "", true},
+		{"results not an array", true, `{"docs":{"_id":"a"}}`, []string{}, nil, nil, nil, "", true},
+	}
+	for _, c := range cases {
+		client := answering(t, http.StatusOK, c.body)
+		var reader *dbdriver.RowReader
+		var err error
+		if c.find {
+			reader, err = dbdriver.StreamFind(client, &dbdriver.FindOptions{Selector: map[string]interface{}{"type": "user"}})
+		} else {
+			reader, err = dbdriver.StreamAllDocs(client, nil)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		ids := []string{}
+		for reader.Next() {
+			row := struct {
+				ID    string `json:"id"`
+				DocID string `json:"_id"`
+			}{}
+			if err := reader.Scan(&row); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			ids = append(ids, row.ID+row.DocID)
+		}
+		if (reader.Err() != nil) != c.fails {
+			t.Errorf("%s: error %v", c.name, reader.Err())
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(c.ids) {
+			t.Errorf("%s: rows %v, want %v", c.name, ids, c.ids)
+		}
+		total, seenTotal := reader.TotalRows()
+		offset, seenOffset := reader.Offset()
+		bookmark, seenBookmark := reader.Bookmark()
+		for _, meta := range []struct {
+			what  string
+			value interface{}
+			seen  bool
+			want  interface{}
+		}{
+			{"total_rows", total, seenTotal, c.total},
+			{"offset", offset, seenOffset, c.offset},
+			{"bookmark", bookmark, seenBookmark, c.bookmark},
+		} {
+			if meta.seen != (meta.want != nil) || (meta.seen && meta.value != meta.want) {
+				t.Errorf("%s: %s %v (seen %v), want %v", c.name, meta.what, meta.value, meta.seen, meta.want)
+			}
+		}
+		if reader.Warning() != c.warning {
+			t.Errorf("%s: warning %q, want %q", c.name, reader.Warning(), c.warning)
+		}
+		reader.Close()
+	}
+}
+
+func TestRowReaderErrors(t *testing.T) {
+	if _, err := dbdriver.StreamAllDocs(answering(t, http.StatusNotFound, `{"error":"not_found","reason":"Database does not exist."}`), nil); !dbdriver.IsNotFound(err) {
+		t.Errorf("missing database: %v", err)
+	}
+	if _, err := dbdriver.StreamAllDocs(answering(t, http.StatusOK, `[]`), nil); err == nil {
+		t.Error("a response that is not an object was accepted")
+	}
+	reader, err := dbdriver.StreamAllDocs(answering(t, http.StatusOK, `{"rows":[]}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Scan(&struct{}{}); err == nil {
+		t.Error("Scan before Next succeeded")
+	}
+}
+
+func TestRowReaderStreams(t *testing.T) {
+	more, gone := make(chan struct{}), make(chan struct{})
+	client := serving(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(gone)
+		fmt.Fprint(w, `{"total_rows":1000000,"offset":0,"rows":[{"id":"row-0"}`)
+		w.(http.Flusher).Flush()
+		// @info The rest is only sent when asked, and never if the client goes away first
+		for i := 1; ; i++ {
+			select {
+			case <-more:
+				fmt.Fprintf(w, `,{"id":"row-%d"}`, i)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	reader, err := dbdriver.StreamDesignView(client, "users", "all", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if !reader.Next() {
+			t.Fatalf("row %d not read: %v", i, reader.Err())
+		}
+		row := struct{ ID string }{}
+		if err := reader.Scan(&row); err != nil || row.ID != fmt.Sprintf("row-%d", i) {
+			t.Fatalf("row %d is %q: %v", i, row.ID, err)
+		}
+		if total, seen := reader.TotalRows(); !seen || total != 1000000 {
+			t.Fatalf("total_rows %d (seen %v) while reading", total, seen)
+		}
+		more <- struct{}{}
+	}
+	reader.Close()
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection was kept open after closing the reader")
+	}
+	if reader.Next() {
+		t.Error("Next after Close returned a row")
+	}
+}
@@ -0,0 +1,165 @@
+package dbdriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	str "strings"
+	"time"
+)
+
+// @info Number of times UpdateDocument re-reads and retries a document after a 409 Conflict
+const DefaultUpdateAttempts = 5
+
+// @info Optimistic-concurrency read-modify-write of a single document.
+// The document is read, handed to mutate and written back with the _rev it was read with. If someone else wrote it in
+// between, CouchDB answers 409 and the whole cycle is repeated on a fresh copy, so mutate may run several times and
+// must only depend on the document it receives. Returning an error from mutate aborts the update with that error.
+// Usage:
+//
+//	_, err := dbdriver.UpdateDocument(client, userID, func(doc dbdriver.GenericDocument) error {
+//		doc["credits"] = doc["credits"].(float64) + 10
+//		return nil
+//	})
+func UpdateDocument(client *CouchDBClient, id string, mutate func(doc GenericDocument) error) (*PutResponseData, error) {
+	return UpdateDocumentWithAttempts(client, id, DefaultUpdateAttempts, mutate)
+}
+
+func UpdateDocumentWithAttempts(client *CouchDBClient, id string, attempts int, mutate func(doc GenericDocument) error) (*PutResponseData, error) {
+	if id == "" {
+		return &PutResponseData{}, errors.New("Attempted to update a document without specifying its ID")
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			// @info Random jitter so concurrent writers do not collide again on the next round
+			time.Sleep(time.Duration(attempt*10+rand.Intn(25)) * time.Millisecond)
+		}
+		var doc GenericDocument
+		doc, err = GetDocument(client, id)
+		if err != nil {
+			return &PutResponseData{}, err
+		}
+		if err = mutate(doc); err != nil {
+			return &PutResponseData{}, err
+		}
+		var resp_data *PutResponseData
+		resp_data, err = CreateOrModifyDocument(client, &doc, id)
+		if err == nil || !IsConflict(err) {
+			return resp_data, err
+		}
+	}
+	return &PutResponseData{}, fmt.Errorf("Gave up updating document %s after %d attempts: %w", id, attempts, err)
+}
+
+// @info https://docs.couchdb.org/en/3.2.2/api/ddoc/render.html#db-design-design-doc-update-update-name
+type UpdateHandlerResponse struct {
+	StatusCode int
+	ID         string // X-Couch-Id, the document the handler worked on
+	REV        string // X-Couch-Update-NewRev, empty if the handler did not save anything
+	Body       []byte // Whatever the handler returned as the second element of its result
+}
+
+// url := "http://localhost:5984/{DB_NAME}/_design/{DESIGN_DOC_NAME}/_update/{UPDATE_NAME}/{DOC_ID}"
+// @info Invokes an update handler, which mutates the document atomically on the server. With an empty docID the
+// handler receives a null document (POST), which is how handlers create new documents.
+// body is sent as JSON unless it is already a []byte or a string, in which case it is sent untouched.
+// Handler errors (e.g. a thrown {forbidden: ...}) are returned as a *CouchDBError.
+func CallUpdateHandler(client *CouchDBClient, designDoc string, handler string, docID string, body interface{}) (*UpdateHandlerResponse, error) {
+	resp_data := &UpdateHandlerResponse{}
+	if client.DatabaseURL == nil {
+		return resp_data, errors.New("Attempted to call an update handler from an unspecified database (client is not connected)")
+	}
+	if !str.HasPrefix(designDoc, "_design/") {
+		designDoc = "_design/" + designDoc
+	}
+	url := client.DatabaseURL.JoinPath(designDoc, "_update", handler)
+	method := http.MethodPost
+	if docID != "" {
+		url = url.JoinPath(docID)
+		method = http.MethodPut
+	}
+
+	var data []byte
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		data = b
+	case string:
+		data = []byte(b)
+		contentType = "text/plain"
+	default:
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return resp_data, err
+		}
+	}
+
+	req, err := http.NewRequest(method, url.String(), bytes.NewReader(data))
+	if err != nil {
+		return resp_data, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return resp_data, err
+	}
+	if resp.StatusCode >= 400 {
+		return resp_data, newCouchDBError(resp)
+	}
+	defer resp.Body.Close()
+	resp_data.StatusCode = resp.StatusCode
+	resp_data.ID = resp.Header.Get("X-Couch-Id")
+	resp_data.REV = resp.Header.Get("X-Couch-Update-NewRev")
+	if resp_data.REV != "" {
+		client.evict(resp_data.ID)
+	}
+	resp_data.Body, err = io.ReadAll(resp.Body)
+	return resp_data, err
+}
+
+// url := "http://localhost:5984/{DB_NAME}/_design/{DESIGN_DOC_NAME}"
+// @info Creates the design document, or replaces it when doc.REV holds its current revision.
+func PutDesignDocument(client *CouchDBClient, doc *DesignDocument) (*PutResponseData, error) {
+	resp_data := &PutResponseData{}
+	if client.DatabaseURL == nil {
+		return resp_data, errors.New("Attempted to put a design document in an unspecified database (client is not connected)")
+	}
+	if !str.HasPrefix(doc.ID, "_design/") {
+		doc.ID = "_design/" + doc.ID
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return resp_data, err
+	}
+	url := client.DatabaseURL.JoinPath(doc.ID)
+	req, err := http.NewRequest(http.MethodPut, url.String(), bytes.NewReader(data))
+	if err != nil {
+		return resp_data, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Client.Do(req)
+	if err != nil {
+		return resp_data, err
+	}
+	if resp.StatusCode != 201 && resp.StatusCode != 202 && resp.StatusCode != 200 {
+		return resp_data, newCouchDBError(resp)
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&resp_data)
+	if err == nil {
+		doc.REV = resp_data.REV
+	}
+	return resp_data, err
+}
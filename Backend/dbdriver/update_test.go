@@ -0,0 +1,198 @@
+package dbdriver_test
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/dbdriver/fake"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	str "strings"
+	"sync"
+	"testing"
+)
+
+// @info In front of a fake CouchDB: the next writes of a document are preceded by one of someone else, which adds 100
+// to its counter, so they conflict
+type competing struct {
+	couch     *fake.Couch
+	mutex     sync.Mutex
+	conflicts int
+}
+
+func (c *competing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mutex.Lock()
+	compete := r.Method == http.MethodPut && c.conflicts > 0
+	if compete {
+		c.conflicts--
+	}
+	c.mutex.Unlock()
+	if compete {
+		read := httptest.NewRecorder()
+		c.couch.ServeHTTP(read, httptest.NewRequest(http.MethodGet, r.URL.Path, nil))
+		doc := map[string]interface{}{}
+		json.Unmarshal(read.Body.Bytes(), &doc)
+		doc["n"] = doc["n"].(float64) + 100
+		body, _ := json.Marshal(doc)
+		c.couch.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, r.URL.Path, str.NewReader(string(body))))
+	}
+	c.couch.ServeHTTP(w, r)
+}
+
+func counter(t *testing.T, conflicts int) (*dbdriver.CouchDBClient, *competing) {
+	t.Helper()
+	front := &competing{couch: fake.NewCouch()}
+	server := httptest.NewServer(front)
+	t.Cleanup(server.Close)
+	client, err := fake.Client(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := dbdriver.GenericDocument{"type": "counter", "n": float64(0)}
+	if _, err := dbdriver.CreateOrModifyDocument(client, &doc, "counter:1"); err != nil {
+		t.Fatal(err)
+	}
+	front.conflicts = conflicts
+	return client, front
+}
+
+func countOf(t *testing.T, client *dbdriver.CouchDBClient) float64 {
+	t.Helper()
+	doc, err := dbdriver.GetDocument(client, "counter:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc["n"].(float64)
+}
+
+func TestUpdateDocumentRetries(t *testing.T) {
+	failure := errors.New("refused")
+	cases := []struct {
+		name      string
+		conflicts int
+		attempts  int
+		mutateErr error
+		calls     int     // Of mutate
+		n         float64 // Counter once done
+		conflict  bool    // Whether it gives up with the conflict
+	}{
+		{"no conflict", 0, 5, nil, 1, 1, false},
+		{"retried after conflicts", 2, 5, nil, 3, 201, false},
+		{"last attempt", 4, 5, nil, 5, 401, false},
+		{"gives up", 5, 5, nil, 5, 500, true},
+		{"at least one attempt", 0, 0, nil, 1, 1, false},
+		{"mutate refuses", 1, 5, failure, 1, 0, false},
+	}
+	for _, c := range cases {
+		client, _ := counter(t, c.conflicts)
+		calls := 0
+		_, err := dbdriver.UpdateDocumentWithAttempts(client, "counter:1", c.attempts, func(doc dbdriver.GenericDocument) error {
+			calls++
+			doc["n"] = doc["n"].(float64) + 1
+			return c.mutateErr
+		})
+		switch {
+		case c.mutateErr != nil:
+			if !errors.Is(err, c.mutateErr) {
+				t.Errorf("%s: error %v, want the one of mutate", c.name, err)
+			}
+		case dbdriver.IsConflict(err) != c.conflict || (err != nil && !c.conflict):
+			t.Errorf("%s: error %v", c.name, err)
+		}
+		if calls != c.calls {
+			t.Errorf("%s: mutate called %d times, want %d", c.name, calls, c.calls)
+		}
+		if n := countOf(t, client); n != c.n {
+			t.Errorf("%s: counter %v, want %v", c.name, n, c.n)
+		}
+	}
+
+	client, _ := counter(t, 0)
+	if _, err := dbdriver.UpdateDocument(client, "missing", func(dbdriver.GenericDocument) error { return nil }); !dbdriver.IsNotFound(err) {
+		t.Errorf("missing document: %v", err)
+	}
+	if _, err := dbdriver.UpdateDocument(client, "", func(dbdriver.GenericDocument) error { return nil }); err == nil {
+		t.Error("a document without ID was updated")
+	}
+}
+
+func TestUpdateDocumentConcurrently(t *testing.T) {
+	client, _ := counter(t, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dbdriver.UpdateDocumentWithAttempts(client, "counter:1", 50, func(doc dbdriver.GenericDocument) error {
+				doc["n"] = doc["n"].(float64) + 1
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := countOf(t, client); n != 10 {
+		t.Errorf("counter %v after 10 increments, writes were lost", n)
+	}
+}
+
+func TestCallUpdateHandler(t *testing.T) {
+	cases := []struct {
+		name        string
+		docID       string
+		body        interface{}
+		status      int
+		method      string
+		path        string
+		contentType string
+		sent        string
+	}{
+		{"on a document", "user:1", map[string]int{"amount": 5}, http.StatusCreated, http.MethodPut, "/db/_design/credits/_update/add/user:1", "application/json", `{"amount":5}`},
+		{"creating a document", "", nil, http.StatusCreated, http.MethodPost, "/db/_design/credits/_update/add", "application/json", ""},
+		{"plain text", "user:1", "5", http.StatusOK, http.MethodPut, "/db/_design/credits/_update/add/user:1", "text/plain", "5"},
+		{"raw bytes", "user:1", []byte(`{"amount":5}`), http.StatusCreated, http.MethodPut, "/db/_design/credits/_update/add/user:1", "application/json", `{"amount":5}`},
+		{"refused by the handler", "user:1", nil, http.StatusForbidden, http.MethodPut, "/db/_design/credits/_update/add/user:1", "application/json", ""},
+	}
+	for _, c := range cases {
+		c := c
+		client := serving(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sent, _ := io.ReadAll(r.Body)
+			if r.Method != c.method || r.URL.Path != c.path || r.Header.Get("Content-Type") != c.contentType || string(sent) != c.sent {
+				t.Errorf("%s: %s %s (%s) %q", c.name, r.Method, r.URL.Path, r.Header.Get("Content-Type"), sent)
+			}
+			if c.status == http.StatusForbidden {
+				w.WriteHeader(c.status)
+				fmt.Fprint(w, `{"error":"forbidden","reason":"not enough credits"}`)
+				return
+			}
+			w.Header().Set("X-Couch-Id", "user:1")
+			if c.status == http.StatusCreated {
+				w.Header().Set("X-Couch-Update-NewRev", "2-x")
+			}
+			w.WriteHeader(c.status)
+			fmt.Fprint(w, "done")
+		}))
+		resp, err := dbdriver.CallUpdateHandler(client, "credits", "add", c.docID, c.body)
+		if c.status == http.StatusForbidden {
+			var couchErr *dbdriver.CouchDBError
+			if !errors.As(err, &couchErr) || couchErr.ErrorName != "forbidden" {
+				t.Errorf("%s: error %v, want the one of the handler", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		wantRev := ""
+		if c.status == http.StatusCreated {
+			wantRev = "2-x"
+		}
+		if resp.StatusCode != c.status || resp.ID != "user:1" || resp.REV != wantRev || string(resp.Body) != "done" {
+			t.Errorf("%s: response %+v", c.name, resp)
+		}
+	}
+}
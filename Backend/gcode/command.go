@@ -0,0 +1,212 @@
+package gcode
+
+import (
+	"strconv"
+	str "strings"
+)
+
+// @info One line of G-code. Classic commands (G1 X10 E0.5, M104 S215, T0) have a Letter and Number and single letter
+// parameters. Extended commands (Klipper's SET_VELOCITY_LIMIT ACCEL=3000, macros such as PRINT_START BED=60) have a
+// Name and KEY=VALUE arguments instead.
+type Command struct {
+	Letter  byte   // G, M or T. Zero for extended commands and lines without a command
+	Number  int    // 1 for G1
+	Sub     int    // 3 for M862.3, -1 if there is none
+	Name    string // Upper case name of an extended command
+	Args    map[string]string
+	Text    string // Raw argument of commands taking a string, e.g. the message of M117
+	Comment string // Text after the ';', trimmed
+	params  [26]float64
+	has     uint32
+}
+
+// @info Commands whose argument is free text that must not be read as parameters
+var textCommands = map[int]bool{16: true, 23: true, 28: true, 30: true, 32: true, 33: true, 117: true, 118: true, 862: true, 928: true}
+
+func (c *Command) Is(letter byte, number int) bool {
+	return c.Letter == letter && c.Number == number
+}
+
+// @info Whether the parameter was given, even without a value (G28 X)
+func (c *Command) Has(letter byte) bool {
+	return letter >= 'A' && letter <= 'Z' && c.has&(1<<(letter-'A')) != 0
+}
+
+// @info Value of a parameter, or def if it was not given
+func (c *Command) Get(letter byte, def float64) float64 {
+	if !c.Has(letter) {
+		return def
+	}
+	return c.params[letter-'A']
+}
+
+// @info Value of an argument of an extended command (case insensitive key)
+func (c *Command) Arg(key string) (string, bool) {
+	value, ok := c.Args[str.ToUpper(key)]
+	return value, ok
+}
+
+func (c *Command) set(letter byte, value float64) {
+	c.params[letter-'A'] = value
+	c.has |= 1 << (letter - 'A')
+}
+
+// @info Parses a line of G-code. Line numbers (N123) and checksums (*71) are dropped, as are comments in parentheses.
+// Unparseable values are ignored rather than failing, the way firmwares do.
+func ParseLine(line string) Command {
+	cmd := Command{Sub: -1}
+	if i := commentStart(line); i >= 0 {
+		cmd.Comment = str.TrimSpace(line[i+1:])
+		line = line[:i]
+	}
+	if i := str.IndexByte(line, '*'); i >= 0 && !str.ContainsRune(line[:i], '"') {
+		line = line[:i]
+	}
+	line = stripParentheses(str.TrimSpace(line))
+	if len(line) >= 2 && (line[0] == 'N' || line[0] == 'n') && isDigit(line[1]) {
+		end := 1
+		for end < len(line) && isDigit(line[end]) {
+			end++
+		}
+		line = str.TrimSpace(line[end:])
+	}
+	if line == "" {
+		return cmd
+	}
+
+	letter := upper(line[0])
+	if (letter == 'G' || letter == 'M' || letter == 'T') && len(line) > 1 && isDigit(line[1]) {
+		parseClassic(&cmd, letter, line)
+		return cmd
+	}
+	parseExtended(&cmd, line)
+	return cmd
+}
+
+func parseClassic(cmd *Command, letter byte, line string) {
+	cmd.Letter = letter
+	end := 1
+	for end < len(line) && isDigit(line[end]) {
+		end++
+	}
+	cmd.Number, _ = strconv.Atoi(line[1:end])
+	if end+1 < len(line) && line[end] == '.' && isDigit(line[end+1]) {
+		subEnd := end + 1
+		for subEnd < len(line) && isDigit(line[subEnd]) {
+			subEnd++
+		}
+		cmd.Sub, _ = strconv.Atoi(line[end+1 : subEnd])
+		end = subEnd
+	}
+	rest := line[end:]
+	if letter == 'M' && textCommands[cmd.Number] {
+		cmd.Text = str.TrimSpace(rest)
+		return
+	}
+	for i := 0; i < len(rest); {
+		param := upper(rest[i])
+		if param < 'A' || param > 'Z' {
+			i++
+			continue
+		}
+		start := i + 1
+		end := start
+		for end < len(rest) && isNumberByte(rest[end]) {
+			end++
+		}
+		value, err := strconv.ParseFloat(rest[start:end], 64)
+		if err != nil || !isFinite(value) {
+			value = 0
+		}
+		cmd.set(param, value)
+		i = end
+	}
+}
+
+// @info Klipper style: NAME KEY=VALUE KEY="quoted value". Names are case insensitive.
+func parseExtended(cmd *Command, line string) {
+	fields := splitArgs(line)
+	cmd.Name = str.ToUpper(fields[0])
+	cmd.Args = map[string]string{}
+	for _, field := range fields[1:] {
+		if key, value, ok := str.Cut(field, "="); ok {
+			cmd.Args[str.ToUpper(key)] = str.Trim(value, `"'`)
+		}
+	}
+}
+
+// @info Splits on spaces, keeping quoted values together
+func splitArgs(line string) []string {
+	fields := []string{}
+	current := str.Builder{}
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+			current.WriteByte(c)
+		case (c == ' ' || c == '\t') && !quoted:
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteByte(c)
+		}
+	}
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	}
+	return fields
+}
+
+// @info Index of the ';' starting the comment, ignoring the ones inside quotes. -1 if there is none.
+func commentStart(line string) int {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// @info Removes (comments) as used by RepRap and CNC dialects
+func stripParentheses(line string) string {
+	if !str.ContainsRune(line, '(') {
+		return line
+	}
+	out := str.Builder{}
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '(':
+			depth++
+		case line[i] == ')' && depth > 0:
+			depth--
+		case depth == 0:
+			out.WriteByte(line[i])
+		}
+	}
+	return str.TrimSpace(out.String())
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNumberByte(c byte) bool {
+	return isDigit(c) || c == '.' || c == '-' || c == '+'
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
@@ -0,0 +1,557 @@
+package gcode
+
+import (
+	"3DQuest/geometry"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	str "strings"
+)
+
+// @info Firmware flavours. They mostly agree, the differences handled are listed where they matter.
+type Dialect string
+
+const (
+	DialectMarlin  Dialect = "marlin"
+	DialectKlipper Dialect = "klipper"
+	DialectRepRap  Dialect = "reprap" // RepRapFirmware (Duet)
+)
+
+// @info Value of Analysis.Format, so G-code and model analyses can be told apart
+const Format = "gcode"
+
+var (
+	ErrNotGCode = errors.New("The file does not look like G-code (no moves found)")
+	ErrBinary   = errors.New("Binary G-code is not supported, export it as plain text")
+)
+
+// @info Longest line accepted. Slicers write thumbnails in lines of less than 100 characters.
+const MaxLineBytes = 1 << 20
+
+// @info What an uploaded G-code tells about the print. Times are in seconds and lengths in millimetres.
+// PrintSeconds is estimated by simulating the moves; SlicerSeconds is what the slicer wrote in the file, which is not
+// trusted for pricing because anyone can edit a comment. For the same reason the filament volume and weight use the
+// diameter and density of the Options, and the ones in the file are only shown as SlicerDiameterMM and SlicerDensity.
+type Analysis struct {
+	Format              string        `json:"format"`
+	Dialect             Dialect       `json:"dialect"`
+	Slicer              string        `json:"slicer,omitempty"` // e.g. PrusaSlicer, Cura, OrcaSlicer
+	SlicerVersion       string        `json:"slicer_version,omitempty"`
+	Printer             string        `json:"printer,omitempty"`  // Printer the file was sliced for
+	Material            string        `json:"material,omitempty"` // Filament type, e.g. PLA
+	Lines               int           `json:"lines"`
+	Moves               int           `json:"moves"`
+	Layers              int           `json:"layers"`
+	PrintSeconds        float64       `json:"print_seconds"`
+	SlicerSeconds       float64       `json:"slicer_seconds,omitempty"`
+	FilamentMM          float64       `json:"filament_mm"`
+	FilamentMM3         float64       `json:"filament_mm3"`
+	FilamentGrams       float64       `json:"filament_grams"`
+	SlicerFilamentGrams float64       `json:"slicer_filament_grams,omitempty"`
+	FilamentDiameterMM  float64       `json:"filament_diameter_mm"`
+	FilamentDensity     float64       `json:"filament_density_g_cm3"`
+	SlicerDiameterMM    float64       `json:"slicer_filament_diameter_mm,omitempty"`
+	SlicerDensity       float64       `json:"slicer_filament_density_g_cm3,omitempty"`
+	NozzleDiameterMM    float64       `json:"nozzle_diameter_mm,omitempty"`
+	LayerHeightMM       float64       `json:"layer_height_mm,omitempty"`
+	InfillPercent       float64       `json:"infill_percent,omitempty"`
+	NozzleTempC         float64       `json:"nozzle_temp_c"` // Highest target of the hotend
+	BedTempC            float64       `json:"bed_temp_c"`    // Highest target of the bed
+	BoundingBox         geometry.Box  `json:"bounding_box"`  // Of the extruding moves
+	Size                geometry.Vec3 `json:"size"`
+}
+
+// @info Defaults used when the file does not say. Zero values take the package defaults.
+type Options struct {
+	Limits *Limits // Of the printer, the file may lower them but not raise them
+
+	FilamentDiameterMM float64 // 1.75
+	FilamentDensity    float64 // g/cm³, 1.24 (PLA)
+}
+
+// @info Longest extruder move a firmware performs, Marlin's EXTRUDE_MAXLENGTH. Longer ones are skipped by the firmware
+// and are not taken as retractions.
+const maxRetractMM = 200
+
+// @info State of the machine while the file is read
+type machine struct {
+	a             *Analysis
+	limits        Limits
+	ceiling       Limits  // Of the printer, see Limits.within
+	dialect       Dialect // Declared by the slicer, empty if unknown
+	pos           [4]float64
+	feed          float64 // mm/s
+	speedFactor   float64
+	absolute      bool
+	absoluteE     bool
+	inches        bool
+	extruded      float64 // Filament pushed into the nozzle, never negative
+	retracted     float64 // Filament pulled back and not primed again yet
+	layerZ        float64
+	box           geometry.Box
+	hasBox        bool
+	plan          planner
+	sawKlipper    bool
+	sawRepRap     bool
+	slicerTemps   [2]float64 // Nozzle and bed from the slicer settings, used if no command sets them
+	slicerPrinter [3]string  // Model, M862.3 check, settings name; the first one set wins
+}
+
+// @info Reads a whole G-code file. Unknown commands are skipped, as firmwares do.
+// @error ErrNotGCode, ErrBinary, or an error reading r
+func Analyze(r io.Reader, opts *Options) (*Analysis, error) {
+	m := &machine{
+		a:           &Analysis{Format: Format},
+		limits:      DefaultLimits(),
+		speedFactor: 1,
+		absolute:    true,
+		absoluteE:   true,
+		feed:        25,
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.Limits != nil {
+		m.limits = *opts.Limits
+	}
+	m.ceiling = m.limits
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	if head, _ := reader.Peek(8); bytes.HasPrefix(head, []byte("GCDE")) {
+		return nil, ErrBinary
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), MaxLineBytes)
+	for scanner.Scan() {
+		m.a.Lines++
+		line := scanner.Text()
+		if bytes.IndexByte(scanner.Bytes(), 0) >= 0 {
+			return nil, ErrNotGCode
+		}
+		cmd := ParseLine(line)
+		if cmd.Comment != "" {
+			m.comment(cmd.Comment)
+		}
+		m.execute(&cmd)
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("%w: line %d is longer than %d bytes", ErrNotGCode, m.a.Lines+1, MaxLineBytes)
+		}
+		return nil, err
+	}
+	if m.a.Moves == 0 {
+		return nil, ErrNotGCode
+	}
+	m.finish(opts)
+	return m.a, nil
+}
+
+func (m *machine) finish(opts *Options) {
+	a := m.a
+	m.plan.wait(0)
+	a.PrintSeconds = math.Round(m.plan.seconds)
+	a.Dialect = m.currentDialect()
+
+	a.FilamentDiameterMM = firstPositive(opts.FilamentDiameterMM, 1.75)
+	a.FilamentDensity = firstPositive(opts.FilamentDensity, 1.24)
+	a.FilamentMM = round(m.extruded, 1)
+	radius := a.FilamentDiameterMM / 2
+	a.FilamentMM3 = round(a.FilamentMM*math.Pi*radius*radius, 1)
+	a.FilamentGrams = round(a.FilamentMM3/1000*a.FilamentDensity, 2)
+
+	if a.NozzleTempC == 0 {
+		a.NozzleTempC = m.slicerTemps[0]
+	}
+	if a.BedTempC == 0 {
+		a.BedTempC = m.slicerTemps[1]
+	}
+	for _, printer := range m.slicerPrinter {
+		if printer != "" {
+			a.Printer = printer
+			break
+		}
+	}
+	if m.hasBox {
+		a.BoundingBox = m.box
+		a.Size = m.box.Size()
+	}
+}
+
+// @info The dialect declared by the slicer, or guessed from the commands used
+func (m *machine) currentDialect() Dialect {
+	switch {
+	case m.dialect != "":
+		return m.dialect
+	case m.sawKlipper:
+		return DialectKlipper
+	case m.sawRepRap:
+		return DialectRepRap
+	}
+	return DialectMarlin
+}
+
+func (m *machine) execute(cmd *Command) {
+	switch cmd.Letter {
+	case 'G':
+		m.gcode(cmd)
+	case 'M':
+		m.mcode(cmd)
+	case 0:
+		if cmd.Name != "" {
+			m.extended(cmd)
+		}
+	}
+}
+
+func (m *machine) gcode(cmd *Command) {
+	switch cmd.Number {
+	case 0, 1:
+		m.linear(cmd)
+	case 2, 3:
+		m.arc(cmd, cmd.Number == 2)
+	case 4: // Dwell, P in milliseconds or S in seconds
+		m.plan.wait(cmd.Get('P', 0)/1000 + cmd.Get('S', 0))
+	case 10:
+		if cmd.Has('S') || cmd.Has('R') { // RepRapFirmware tool temperatures: G10 P0 S215 R170
+			m.sawRepRap = true
+			m.nozzle(cmd.Get('S', 0))
+		}
+	case 20:
+		m.inches = true
+	case 21:
+		m.inches = false
+	case 28:
+		m.plan.wait(0)
+		all := !cmd.Has('X') && !cmd.Has('Y') && !cmd.Has('Z')
+		for axis, letter := range []byte{'X', 'Y', 'Z'} {
+			if all || cmd.Has(letter) {
+				m.pos[axis] = 0
+			}
+		}
+	case 90:
+		m.absolute = true
+		if m.currentDialect() != DialectKlipper {
+			m.absoluteE = true // @info Marlin and RRF switch the extruder too, Klipper keeps M82/M83
+		}
+	case 91:
+		m.absolute = false
+		if m.currentDialect() != DialectKlipper {
+			m.absoluteE = false
+		}
+	case 92:
+		all := !cmd.Has('X') && !cmd.Has('Y') && !cmd.Has('Z') && !cmd.Has('E')
+		for axis, letter := range []byte{'X', 'Y', 'Z', 'E'} {
+			if all || cmd.Has(letter) {
+				m.pos[axis] = m.units(cmd.Get(letter, 0))
+			}
+		}
+	}
+}
+
+func (m *machine) mcode(cmd *Command) {
+	switch cmd.Number {
+	case 73: // Progress written by PrusaSlicer, R is the remaining time in minutes
+		if cmd.Has('R') && m.a.SlicerSeconds == 0 && m.a.Moves == 0 {
+			m.a.SlicerSeconds = cmd.Get('R', 0) * 60
+		}
+	case 82:
+		m.absoluteE = true
+	case 83:
+		m.absoluteE = false
+	case 104, 109:
+		m.nozzle(cmd.Get('S', cmd.Get('R', 0)))
+		if cmd.Number == 109 {
+			m.plan.wait(0)
+		}
+	case 140, 190:
+		m.bed(cmd.Get('S', cmd.Get('R', 0)))
+		if cmd.Number == 190 {
+			m.plan.wait(0)
+		}
+	case 201: // Maximum acceleration per axis
+		m.axisLimits(cmd, &m.limits.AxisAccel, 1)
+	case 203: // Maximum feedrate per axis, in mm/s for Marlin and mm/min for RepRapFirmware
+		scale := 1.0
+		if m.currentDialect() == DialectRepRap {
+			scale = 1.0 / 60
+		}
+		m.axisLimits(cmd, &m.limits.AxisVelocity, scale)
+	case 204:
+		if cmd.Has('S') { // Marlin (legacy) and Klipper: every move
+			m.limits.Accel = cmd.Get('S', 0)
+			m.limits.TravelAccel = m.limits.Accel
+		}
+		m.limits.Accel = cmd.Get('P', m.limits.Accel)
+		m.limits.TravelAccel = cmd.Get('T', m.limits.TravelAccel)
+		m.limits.RetractAccel = cmd.Get('R', m.limits.RetractAccel)
+	case 205:
+		if cmd.Has('J') {
+			m.limits.JunctionDeviation = cmd.Get('J', 0)
+		} else if cmd.Has('X') { // Classic jerk, roughly the speed kept through a corner
+			m.limits.SquareCornerVelocity = cmd.Get('X', 0)
+			m.limits.JunctionDeviation = 0
+		}
+	case 220: // Only slows the print down, the printer is not faster than its limits
+		if factor := cmd.Get('S', 100); factor > 0 {
+			m.speedFactor = math.Min(factor/100, 1)
+		}
+	case 400:
+		m.plan.wait(0)
+	case 566: // RepRapFirmware jerk, mm/min
+		m.sawRepRap = true
+		if cmd.Has('X') {
+			m.limits.SquareCornerVelocity = cmd.Get('X', 0) / 60
+			m.limits.JunctionDeviation = 0
+		}
+	case 568: // RepRapFirmware tool temperatures
+		m.sawRepRap = true
+		m.nozzle(cmd.Get('S', 0))
+	case 862:
+		if cmd.Sub == 3 { // Prusa printer model check: M862.3 P "MK4"
+			if _, model, ok := str.Cut(cmd.Text, `"`); ok {
+				m.slicerPrinter[1], _, _ = str.Cut(model, `"`)
+			}
+		}
+	}
+	m.limits = m.limits.within(m.ceiling)
+}
+
+func (m *machine) axisLimits(cmd *Command, limits *[4]float64, scale float64) {
+	for axis, letter := range []byte{'X', 'Y', 'Z', 'E'} {
+		if value := cmd.Get(letter, 0); value > 0 {
+			limits[axis] = value * scale
+		}
+	}
+}
+
+// @info Klipper commands and the start macros of the usual configurations
+func (m *machine) extended(cmd *Command) {
+	switch cmd.Name {
+	case "SET_VELOCITY_LIMIT":
+		m.sawKlipper = true
+		if v := argFloat(cmd, "VELOCITY"); v > 0 {
+			m.limits.MaxVelocity = v
+		}
+		if v := argFloat(cmd, "ACCEL"); v > 0 {
+			m.limits.Accel, m.limits.TravelAccel, m.limits.RetractAccel = v, v, v
+		}
+		if v := argFloat(cmd, "SQUARE_CORNER_VELOCITY"); v > 0 {
+			m.limits.SquareCornerVelocity = v
+			m.limits.JunctionDeviation = 0
+		}
+		m.limits = m.limits.within(m.ceiling)
+	case "SET_HEATER_TEMPERATURE":
+		m.sawKlipper = true
+		heater, _ := cmd.Arg("HEATER")
+		if str.Contains(str.ToLower(heater), "bed") {
+			m.bed(argFloat(cmd, "TARGET"))
+		} else {
+			m.nozzle(argFloat(cmd, "TARGET"))
+		}
+	case "PRINT_START", "START_PRINT", "PRINT_START_MACRO":
+		m.sawKlipper = true
+		for _, key := range []string{"EXTRUDER", "EXTRUDER_TEMP", "HOTEND", "HOTEND_TEMP", "NOZZLE", "NOZZLE_TEMP", "TOOL_TEMP"} {
+			m.nozzle(argFloat(cmd, key))
+		}
+		for _, key := range []string{"BED", "BED_TEMP"} {
+			m.bed(argFloat(cmd, key))
+		}
+	case "EXCLUDE_OBJECT_DEFINE", "EXCLUDE_OBJECT_START", "EXCLUDE_OBJECT_END", "BED_MESH_CALIBRATE", "SAVE_GCODE_STATE", "RESTORE_GCODE_STATE":
+		m.sawKlipper = true
+	}
+}
+
+func argFloat(cmd *Command, key string) float64 {
+	raw, _ := cmd.Arg(key)
+	return number(raw)
+}
+
+func (m *machine) nozzle(celsius float64) {
+	m.a.NozzleTempC = math.Max(m.a.NozzleTempC, celsius)
+}
+
+func (m *machine) bed(celsius float64) {
+	m.a.BedTempC = math.Max(m.a.BedTempC, celsius)
+}
+
+func (m *machine) units(value float64) float64 {
+	if m.inches {
+		return value * 25.4
+	}
+	return value
+}
+
+// @info Target of a move along every axis, following the absolute/relative modes
+func (m *machine) target(cmd *Command) [4]float64 {
+	target := m.pos
+	for axis, letter := range []byte{'X', 'Y', 'Z', 'E'} {
+		if !cmd.Has(letter) {
+			continue
+		}
+		value := m.units(cmd.Get(letter, 0))
+		absolute := m.absolute
+		if axis == 3 {
+			absolute = m.absoluteE && (m.absolute || m.currentDialect() != DialectKlipper)
+		}
+		if absolute {
+			target[axis] = value
+		} else {
+			target[axis] += value
+		}
+	}
+	return target
+}
+
+func (m *machine) linear(cmd *Command) {
+	if cmd.Has('F') {
+		if feed := m.units(cmd.Get('F', 0)) / 60; feed > 0 {
+			m.feed = feed
+		}
+	}
+	m.moveTo(m.target(cmd))
+}
+
+// @info G2 (clockwise) and G3 arcs on the XY plane, with the centre given as I J offsets or as a radius R. They are
+// split in segments of about a millimetre, like firmwares do.
+func (m *machine) arc(cmd *Command, clockwise bool) {
+	if cmd.Has('F') {
+		if feed := m.units(cmd.Get('F', 0)) / 60; feed > 0 {
+			m.feed = feed
+		}
+	}
+	start := m.pos
+	end := m.target(cmd)
+	var cx, cy float64
+	if cmd.Has('R') {
+		radius := m.units(cmd.Get('R', 0))
+		dx, dy := end[0]-start[0], end[1]-start[1]
+		chord := math.Hypot(dx, dy)
+		if chord == 0 || math.Abs(radius) < chord/2 {
+			m.moveTo(end)
+			return
+		}
+		h := math.Sqrt(radius*radius - chord*chord/4)
+		if clockwise == (radius > 0) {
+			h = -h // @info A negative radius asks for the long way round
+		}
+		cx, cy = start[0]+dx/2-h*dy/chord, start[1]+dy/2+h*dx/chord
+	} else {
+		cx, cy = start[0]+m.units(cmd.Get('I', 0)), start[1]+m.units(cmd.Get('J', 0))
+	}
+	radius := math.Hypot(start[0]-cx, start[1]-cy)
+	a0 := math.Atan2(start[1]-cy, start[0]-cx)
+	a1 := math.Atan2(end[1]-cy, end[0]-cx)
+	sweep := a1 - a0
+	if clockwise {
+		if sweep >= 0 {
+			sweep -= 2 * math.Pi
+		}
+	} else if sweep <= 0 {
+		sweep += 2 * math.Pi
+	}
+	segments := int(math.Min(math.Ceil(math.Abs(sweep)*radius), 10000))
+	if !isFinite(radius) || segments < 1 {
+		m.moveTo(end)
+		return
+	}
+	for i := 1; i < segments; i++ {
+		t := float64(i) / float64(segments)
+		angle := a0 + sweep*t
+		m.moveTo([4]float64{
+			cx + radius*math.Cos(angle),
+			cy + radius*math.Sin(angle),
+			start[2] + (end[2]-start[2])*t,
+			start[3] + (end[3]-start[3])*t,
+		})
+	}
+	m.moveTo(end)
+}
+
+// @info Plans a straight move from the current position, counting extrusion, layers and the printed volume
+func (m *machine) moveTo(target [4]float64) {
+	var delta [4]float64
+	for axis := range delta {
+		delta[axis] = target[axis] - m.pos[axis]
+		if !isFinite(delta[axis]) {
+			return
+		}
+	}
+	m.pos = target
+	xyz := math.Sqrt(delta[0]*delta[0] + delta[1]*delta[1] + delta[2]*delta[2])
+	if xyz == 0 && delta[3] == 0 {
+		return
+	}
+	m.a.Moves++
+	m.extrude(delta[3])
+
+	v := math.Min(m.feed*m.speedFactor, m.limits.MaxVelocity)
+	accel := m.limits.TravelAccel
+	dist := xyz
+	if xyz == 0 {
+		dist = math.Abs(delta[3])
+		accel = m.limits.RetractAccel
+	} else if delta[3] > 0 {
+		accel = m.limits.Accel
+		m.extrudeAt(target)
+	}
+	// @info Each axis may be slower than the toolhead, see M201 and M203
+	for axis := range delta {
+		share := math.Abs(delta[axis]) / dist
+		if share == 0 {
+			continue
+		}
+		if limit := m.limits.AxisVelocity[axis]; limit > 0 {
+			v = math.Min(v, limit/share)
+		}
+		if limit := m.limits.AxisAccel[axis]; limit > 0 {
+			accel = math.Min(accel, limit/share)
+		}
+	}
+	jd := math.Min(m.limits.junctionDeviation(accel), m.ceiling.junctionDeviation(accel))
+	m.plan.add([3]float64{delta[0], delta[1], delta[2]}, dist, v, accel, jd)
+}
+
+// @info Counts the filament of an extruder move. What a retraction pulls back is owed and the prime that follows only
+// puts it back, so neither is counted; G92 only renames the position and changes nothing.
+func (m *machine) extrude(e float64) {
+	switch {
+	case e < 0 && -e <= maxRetractMM:
+		m.retracted -= e
+	case e > 0:
+		primed := math.Min(e, m.retracted)
+		m.retracted -= primed
+		m.extruded += e - primed
+	}
+}
+
+func (m *machine) extrudeAt(target [4]float64) {
+	point := geometry.Vec3{X: target[0], Y: target[1], Z: target[2]}
+	if !m.hasBox {
+		m.box = geometry.Box{Min: point, Max: point}
+		m.hasBox = true
+	}
+	m.box.Min = geometry.Vec3{X: math.Min(m.box.Min.X, point.X), Y: math.Min(m.box.Min.Y, point.Y), Z: math.Min(m.box.Min.Z, point.Z)}
+	m.box.Max = geometry.Vec3{X: math.Max(m.box.Max.X, point.X), Y: math.Max(m.box.Max.Y, point.Y), Z: math.Max(m.box.Max.Z, point.Z)}
+	if m.a.Layers == 0 || target[2] > m.layerZ+0.01 {
+		m.a.Layers++
+		m.layerZ = target[2]
+	}
+}
+
+func firstPositive(values ...float64) float64 {
+	for _, value := range values {
+		if value > 0 {
+			return value
+		}
+	}
+	return 0
+}
+
+func round(value float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(value*scale) / scale
+}
@@ -0,0 +1,174 @@
+package gcode_test
+
+import (
+	"3DQuest/gcode"
+	"errors"
+	"math"
+	str "strings"
+	"testing"
+)
+
+func analyze(t *testing.T, text string, opts *gcode.Options) *gcode.Analysis {
+	t.Helper()
+	a, err := gcode.Analyze(str.NewReader(text), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestExtrusion(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		mm   float64
+	}{
+		{"absolute", "G1 X10 E5\nG1 X20 E10", 10},
+		{"relative", "M83\nG1 X10 E5\nG1 X20 E5", 10},
+		{"relative with G91", "G91\nG1 X10 E5\nG1 X10 E5", 10},
+		{"absolute again", "M83\nG1 X10 E5\nM82\nG1 X20 E10", 10},
+		{"inches", "G20\nG1 X1 E0.5", 12.7},
+		{"retraction and prime", "G1 X10 E5\nG1 E4\nG1 E5\nG1 X20 E10", 10},
+		{"relative retraction and prime", "M83\nG1 X10 E5\nG1 E-1\nG1 E1\nG1 X20 E5", 10},
+		{"prime longer than the retraction", "M83\nG1 X10 E5\nG1 E-1\nG1 E1.5\nG1 X20 E5", 10.5},
+		{"retracting while travelling", "M83\nG1 X10 E5\nG1 X0 E-2\nG1 E2\nG1 X20 E5", 10},
+		{"G92 reset", "G1 X10 E5\nG92 E0\nG1 X20 E5", 10},
+		{"G92 to a huge value", "G1 X10 E5\nG92 E99999\nG1 E0\nG1 X20 E5", 10},
+		{"final retraction", "G1 X10 E10\nG1 E-150", 10},
+		{"several retractions", "M83\nG1 X10 E5\nG1 E-150\nG1 E-150\nG1 E300\nG1 X20 E5", 10},
+		{"travel only", "G1 X10\nG1 Y10", 0},
+	}
+	for _, c := range cases {
+		a := analyze(t, c.text, nil)
+		if a.FilamentMM != c.mm {
+			t.Errorf("%s: filament = %v mm, want %v", c.name, a.FilamentMM, c.mm)
+		}
+	}
+}
+
+func TestFilamentVolume(t *testing.T) {
+	text := "; filament_diameter = 2.85\n; filament_density = 0.5\nG1 X10 E100"
+	a := analyze(t, text, nil)
+	// @info 100 mm of 1.75 mm filament is 240.5 mm³, 0.3 g of PLA at 1.24 g/cm³
+	if a.FilamentDiameterMM != 1.75 || a.FilamentDensity != 1.24 || a.FilamentMM3 != 240.5 || a.FilamentGrams != 0.3 {
+		t.Errorf("diameter %v, density %v, volume %v, grams %v, want the defaults", a.FilamentDiameterMM, a.FilamentDensity, a.FilamentMM3, a.FilamentGrams)
+	}
+	if a.SlicerDiameterMM != 2.85 || a.SlicerDensity != 0.5 {
+		t.Errorf("slicer diameter %v, density %v, want those of the file", a.SlicerDiameterMM, a.SlicerDensity)
+	}
+
+	a = analyze(t, text, &gcode.Options{FilamentDiameterMM: 2.85, FilamentDensity: 1.27})
+	if a.FilamentDiameterMM != 2.85 || a.FilamentMM3 != 637.9 || a.FilamentGrams != 0.81 {
+		t.Errorf("diameter %v, volume %v, grams %v, want those of the options", a.FilamentDiameterMM, a.FilamentMM3, a.FilamentGrams)
+	}
+}
+
+func TestSlicerSettings(t *testing.T) {
+	prusa := str.Join([]string{
+		"; generated by PrusaSlicer 2.6.1+win64 on 2023-10-01 at 10:00:00 UTC",
+		"M73 P0 R62",
+		"G1 X10 Y10 Z0.2 E1",
+		"; estimated printing time (normal mode) = 1h 2m 3s",
+		"; filament used [g] = 1.5, 2.5",
+		"; filament_type = PETG;PLA",
+		"; gcode_flavor = klipper",
+		"; printer_model = MK4",
+		"; printer_settings_id = Original Prusa MK4 0.4 nozzle",
+		"; nozzle_diameter = 0.4,0.6",
+		"; layer_height = 0.2",
+		"; fill_density = 15%",
+		"; first_layer_temperature = 230,240",
+		"; temperature = 225",
+		"; bed_temperature = 85",
+	}, "\n")
+	a := analyze(t, prusa, nil)
+	if a.Slicer != "PrusaSlicer" || a.SlicerVersion != "2.6.1+win64" || a.Dialect != gcode.DialectKlipper {
+		t.Errorf("slicer %s %s, dialect %s", a.Slicer, a.SlicerVersion, a.Dialect)
+	}
+	// @info The remaining time of the first M73 comes before the estimate in the settings and wins
+	if a.SlicerSeconds != 3720 || a.SlicerFilamentGrams != 4 || a.Material != "PETG" || a.Printer != "MK4" {
+		t.Errorf("slicer seconds %v, grams %v, material %s, printer %s", a.SlicerSeconds, a.SlicerFilamentGrams, a.Material, a.Printer)
+	}
+	if a.NozzleDiameterMM != 0.4 || a.LayerHeightMM != 0.2 || a.InfillPercent != 15 || a.NozzleTempC != 230 || a.BedTempC != 85 {
+		t.Errorf("nozzle %v, layer %v, infill %v, temperatures %v %v", a.NozzleDiameterMM, a.LayerHeightMM, a.InfillPercent, a.NozzleTempC, a.BedTempC)
+	}
+
+	cura := str.Join([]string{
+		";FLAVOR:RepRap (RepRap)",
+		";TIME:3600",
+		";Layer height: 0.12",
+		";Generated with Cura_SteamEngine 5.4.0",
+		"M104 S200",
+		"M140 S60",
+		"G1 X10 E1",
+	}, "\n")
+	a = analyze(t, cura, nil)
+	if a.Slicer != "Cura" || a.SlicerVersion != "5.4.0" || a.Dialect != gcode.DialectRepRap || a.SlicerSeconds != 3600 || a.LayerHeightMM != 0.12 {
+		t.Errorf("cura = %+v", a)
+	}
+	if a.NozzleTempC != 200 || a.BedTempC != 60 {
+		t.Errorf("temperatures %v %v, want those of the commands", a.NozzleTempC, a.BedTempC)
+	}
+
+	orca := "; HEADER_BLOCK_START\n; total estimated time: 2d 3h; total filament weight [g] : 12.5\n; machine_name = \"Bambu Lab X1C\"\nG1 X10 E1"
+	a = analyze(t, orca, nil)
+	if a.SlicerSeconds != 183600 || a.SlicerFilamentGrams != 12.5 || a.Printer != "Bambu Lab X1C" {
+		t.Errorf("orca seconds %v, grams %v, printer %q", a.SlicerSeconds, a.SlicerFilamentGrams, a.Printer)
+	}
+	if a.Dialect != gcode.DialectMarlin {
+		t.Errorf("dialect of a file that does not say = %s, want marlin", a.Dialect)
+	}
+}
+
+func TestPrintTime(t *testing.T) {
+	// @info At 100 mm/s and 100 mm/s² a move takes 1 s and 50 mm to reach its speed and the same to stop
+	cases := []struct {
+		name    string
+		text    string
+		seconds float64
+	}{
+		{"one move", "G1 X1000 F6000", 11},
+		{"straight moves do not slow down", "G1 X250 F6000\nG1 X500\nG1 X1000", 11},
+		{"reversal stops", "G1 X500 F6000\nG1 X0", 12},
+		{"dwell", "G1 X1000 F6000\nG4 P2000\nG4 S1", 14},
+		{"feed rate in inches", "G20\nG1 X39.37007874 F236.2204724", 11},
+		{"axis limit", "M203 X50\nG1 X1000 F6000", 20.5},
+		{"speed factor", "M220 S50\nG1 X1000 F6000", 20.5},
+		{"klipper limits", "SET_VELOCITY_LIMIT VELOCITY=50\nG1 X1000 F6000", 20.5},
+		{"slow corners", "M205 X0\nG1 X500 F6000\nG1 Y500", 12},
+	}
+	for _, c := range cases {
+		a := analyze(t, "M204 S100\n"+c.text, nil)
+		if want := math.Round(c.seconds); a.PrintSeconds != want {
+			t.Errorf("%s: %v s, want %v", c.name, a.PrintSeconds, want)
+		}
+	}
+}
+
+func TestFileCannotRaiseLimits(t *testing.T) {
+	limits := &gcode.Limits{MaxVelocity: 100, Accel: 100, TravelAccel: 100, RetractAccel: 100, SquareCornerVelocity: 5, AxisVelocity: [4]float64{40, 40, 5, 20}}
+	moves := "G1 X500 F3000\nG1 Y500\nG1 X0 Y0 E10\nG1 Z10 F600\nG1 E-2 F3000\n" + str.Repeat("G1 X20 F3000\nG1 Y20\nG1 X0\nG1 Y0\n", 10)
+	plain := analyze(t, moves, &gcode.Options{Limits: limits})
+	for name, raise := range map[string]string{
+		"accelerations":     "M201 X100000 Y100000 Z100000\nM204 S100000\nM204 P100000 T100000 R100000",
+		"feed rates":        "M203 X10000 Y10000 Z10000 E10000",
+		"klipper":           "SET_VELOCITY_LIMIT VELOCITY=10000 ACCEL=100000 SQUARE_CORNER_VELOCITY=1000",
+		"jerk":              "M205 X1000",
+		"junction":          "M205 J10",
+		"reprap jerk":       "M566 X60000",
+		"speed factor":      "M220 S1000",
+		"all of them again": "M204 S100000\nM203 X10000 Y10000\nM220 S1000\nM205 J10",
+	} {
+		if a := analyze(t, raise+"\n"+moves, &gcode.Options{Limits: limits}); a.PrintSeconds < plain.PrintSeconds {
+			t.Errorf("%s: %v s, want at least %v", name, a.PrintSeconds, plain.PrintSeconds)
+		}
+	}
+}
+
+func TestAnalyzeErrors(t *testing.T) {
+	for name, text := range map[string]string{"no moves": "; nothing\nM104 S200", "binary": "GCDE\x01\x00\x00\x00", "null bytes": "G1 X1\x00"} {
+		if _, err := gcode.Analyze(str.NewReader(text), nil); !errors.Is(err, gcode.ErrNotGCode) && !errors.Is(err, gcode.ErrBinary) {
+			t.Errorf("%s: error = %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package gcode
+
+import (
+	"regexp"
+	"strconv"
+	str "strings"
+)
+
+// @info Slicers describe the print in comments. PrusaSlicer, SuperSlicer, OrcaSlicer and Bambu Studio write
+// "; key = value" (mostly at the end of the file), Cura writes ";KEY:value" at the top and OrcaSlicer also packs several
+// "key: value" pairs in one line of its header block.
+func (m *machine) comment(comment string) {
+	lower := str.ToLower(comment)
+	switch {
+	case str.HasPrefix(lower, "generated by "):
+		m.slicer(comment[len("generated by "):])
+		return
+	case str.HasPrefix(lower, "generated with "): // Cura_SteamEngine 5.4.0
+		m.slicer(comment[len("generated with "):])
+		return
+	case str.HasPrefix(lower, "g-code generated by "): // Simplify3D(R) Version 4.1.2
+		m.slicer(str.Replace(comment[len("g-code generated by "):], "(R) Version", "", 1))
+		return
+	}
+	for _, part := range str.Split(comment, ";") {
+		key, value, ok := str.Cut(part, " = ")
+		if !ok {
+			key, value, ok = str.Cut(part, ":")
+		}
+		if ok {
+			m.setting(str.ToLower(str.TrimSpace(key)), str.TrimSpace(value))
+		}
+	}
+}
+
+// @info "PrusaSlicer 2.6.1+win64 on 2023-10-01 at 10:00:00 UTC" => PrusaSlicer, 2.6.1+win64
+func (m *machine) slicer(generator string) {
+	fields := str.Fields(generator)
+	if len(fields) == 0 || m.a.Slicer != "" {
+		return
+	}
+	m.a.Slicer = fields[0]
+	if m.a.Slicer == "Cura_SteamEngine" {
+		m.a.Slicer = "Cura"
+	}
+	if len(fields) > 1 {
+		m.a.SlicerVersion = fields[1]
+	}
+}
+
+func (m *machine) setting(key string, value string) {
+	a := m.a
+	switch key {
+	// @info Dialect
+	case "gcode_flavor", "flavor":
+		m.flavor(value)
+
+	// @info Slicer estimates
+	case "estimated printing time (normal mode)", "estimated printing time", "model printing time", "total estimated time":
+		if a.SlicerSeconds == 0 {
+			a.SlicerSeconds = parseDuration(value)
+		}
+	case "time", "print.time": // Cura, in seconds
+		if seconds := number(value); seconds > 0 && a.SlicerSeconds == 0 {
+			a.SlicerSeconds = seconds
+		}
+	case "filament used [g]", "total filament used [g]", "total filament weight [g]":
+		if grams := sumList(value); grams > 0 {
+			a.SlicerFilamentGrams = grams
+		}
+
+	// @info Material
+	case "filament_type", "filament type":
+		if a.Material == "" {
+			a.Material = str.TrimSpace(firstOfList(value))
+		}
+	case "filament_diameter", "extruder_train.0.material.diameter":
+		a.SlicerDiameterMM = number(firstOfList(value))
+	case "filament_density":
+		a.SlicerDensity = number(firstOfList(value))
+
+	// @info Printer
+	case "printer_model", "target_machine.name", "machine_name":
+		if m.slicerPrinter[0] == "" {
+			m.slicerPrinter[0] = unquote(value)
+		}
+	case "printer_settings_id", "printer_preset":
+		m.slicerPrinter[2] = unquote(value)
+	case "nozzle_diameter", "extruder_train.0.nozzle.diameter":
+		a.NozzleDiameterMM = number(firstOfList(value))
+
+	// @info Print settings
+	case "layer_height", "layer height":
+		a.LayerHeightMM = number(value)
+	case "fill_density", "sparse_infill_density", "infill_sparse_density":
+		a.InfillPercent = number(str.TrimSuffix(value, "%"))
+	case "temperature", "nozzle_temperature", "extruder_train.0.initial_temperature", "first_layer_temperature", "nozzle_temperature_initial_layer":
+		if celsius := number(firstOfList(value)); celsius > m.slicerTemps[0] {
+			m.slicerTemps[0] = celsius
+		}
+	case "bed_temperature", "hot_plate_temp", "build_plate.initial_temperature", "first_layer_bed_temperature", "hot_plate_temp_initial_layer":
+		if celsius := number(firstOfList(value)); celsius > m.slicerTemps[1] {
+			m.slicerTemps[1] = celsius
+		}
+	}
+}
+
+// @info Cura's FLAVOR (Marlin, "RepRap (RepRap)", Griffin...) and PrusaSlicer's gcode_flavor (marlin2, klipper,
+// reprapfirmware...)
+func (m *machine) flavor(value string) {
+	value = str.ToLower(value)
+	switch {
+	case str.Contains(value, "klipper"):
+		m.dialect = DialectKlipper
+	case value == "reprapfirmware" || value == "reprap (reprap)":
+		m.dialect = DialectRepRap
+	case str.Contains(value, "marlin") || value == "reprap" || value == "griffin" || value == "ultigcode":
+		m.dialect = DialectMarlin
+	}
+}
+
+var durationPart = regexp.MustCompile(`(\d+(?:\.\d+)?)\s*([dhms])`)
+
+// @info "1d 2h 3m 4s" => seconds
+func parseDuration(value string) float64 {
+	seconds := 0.0
+	units := map[string]float64{"d": 86400, "h": 3600, "m": 60, "s": 1}
+	for _, match := range durationPart.FindAllStringSubmatch(value, -1) {
+		amount, _ := strconv.ParseFloat(match[1], 64)
+		seconds += amount * units[match[2]]
+	}
+	return seconds
+}
+
+// @info Multi extruder settings are lists: "215,215" or "PLA;PETG"
+func firstOfList(value string) string {
+	if i := str.IndexAny(value, ",;"); i >= 0 {
+		return value[:i]
+	}
+	return value
+}
+
+func sumList(value string) float64 {
+	total := 0.0
+	for _, part := range str.Split(value, ",") {
+		total += number(part)
+	}
+	return total
+}
+
+func number(value string) float64 {
+	parsed, err := strconv.ParseFloat(str.TrimSpace(value), 64)
+	if err != nil || !isFinite(parsed) {
+		return 0
+	}
+	return parsed
+}
+
+func unquote(value string) string {
+	return str.TrimSpace(str.Trim(value, `"`))
+}
@@ -0,0 +1,186 @@
+package gcode
+
+import "math"
+
+// @info Motion limits of the printer. Files usually set them (M201, M203, M204, M205, SET_VELOCITY_LIMIT...), but
+// only below these: a file may slow the printer down, never make it faster than it is, or the print time would be
+// cheaper than the machine time it takes.
+type Limits struct {
+	MaxVelocity          float64    // mm/s, cap of any move
+	Accel                float64    // mm/s², printing moves
+	TravelAccel          float64    // mm/s², moves that do not extrude
+	RetractAccel         float64    // mm/s², extruder only moves
+	SquareCornerVelocity float64    // mm/s, speed kept through a 90° corner (Klipper's definition)
+	JunctionDeviation    float64    // mm, overrides SquareCornerVelocity when set (Marlin's M205 J)
+	AxisVelocity         [4]float64 // mm/s per axis X, Y, Z, E (M203). Zero is unlimited
+	AxisAccel            [4]float64 // mm/s² per axis X, Y, Z, E (M201). Zero is unlimited
+}
+
+// @info Typical limits of a desktop FDM printer
+func DefaultLimits() Limits {
+	return Limits{
+		MaxVelocity:          300,
+		Accel:                1500,
+		TravelAccel:          1500,
+		RetractAccel:         1500,
+		SquareCornerVelocity: 5,
+		AxisVelocity:         [4]float64{500, 500, 12, 120},
+		AxisAccel:            [4]float64{5000, 5000, 200, 5000},
+	}
+}
+
+// @info Each limit lowered to the one of the ceiling. The junction deviation depends on the acceleration of the move
+// and is compared there, see junctionDeviation.
+func (l Limits) within(ceiling Limits) Limits {
+	l.MaxVelocity = math.Min(l.MaxVelocity, ceiling.MaxVelocity)
+	l.Accel = math.Min(l.Accel, ceiling.Accel)
+	l.TravelAccel = math.Min(l.TravelAccel, ceiling.TravelAccel)
+	l.RetractAccel = math.Min(l.RetractAccel, ceiling.RetractAccel)
+	l.SquareCornerVelocity = math.Min(l.SquareCornerVelocity, ceiling.SquareCornerVelocity)
+	for axis := range l.AxisVelocity {
+		l.AxisVelocity[axis] = lowerLimit(l.AxisVelocity[axis], ceiling.AxisVelocity[axis])
+		l.AxisAccel[axis] = lowerLimit(l.AxisAccel[axis], ceiling.AxisAccel[axis])
+	}
+	return l
+}
+
+// @info Junction deviation of a move at accel, from the square corner velocity unless set
+func (l Limits) junctionDeviation(accel float64) float64 {
+	if l.JunctionDeviation > 0 || accel <= 0 {
+		return l.JunctionDeviation
+	}
+	return l.SquareCornerVelocity * l.SquareCornerVelocity * (math.Sqrt2 - 1) / accel
+}
+
+// @info The lower of two axis limits, where zero is unlimited
+func lowerLimit(a float64, b float64) float64 {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 {
+		return a
+	}
+	return math.Min(a, b)
+}
+
+// @info Moves kept to look ahead before the oldest ones are timed. Only the oldest half is timed on every flush, so
+// every move sees at least this many moves ahead, which is enough for it to reach its cruise speed.
+const lookahead = 1024
+
+type move struct {
+	dist       float64
+	unit       [3]float64 // Direction in XYZ, zero for extruder only moves
+	accel      float64
+	maxV2      float64 // Nominal speed, squared
+	maxStartV2 float64 // Junction limit with the previous move
+	startV2    float64
+	endV2      float64
+}
+
+// @info Trapezoidal motion planner with look-ahead, following Klipper's: moves accelerate, cruise and decelerate, and
+// the speed through each junction is limited by its angle.
+type planner struct {
+	moves   []move
+	seconds float64
+	prevEnd float64 // endV2 of the last timed move
+}
+
+// @info Queues a move of the given XYZ delta and length at speed v (mm/s) and acceleration accel (mm/s²), cornering
+// with junction deviation jd (mm). Extruder only moves give the extruder distance as dist and a zero delta.
+func (p *planner) add(delta [3]float64, dist float64, v float64, accel float64, jd float64) {
+	if dist <= 1e-9 || v <= 0 || accel <= 0 || !isFinite(dist) {
+		return
+	}
+	m := move{dist: dist, accel: accel, maxV2: v * v}
+	xyz := math.Sqrt(delta[0]*delta[0] + delta[1]*delta[1] + delta[2]*delta[2])
+	if xyz > 0 {
+		m.unit = [3]float64{delta[0] / xyz, delta[1] / xyz, delta[2] / xyz}
+	}
+	if n := len(p.moves); n > 0 && xyz > 0 {
+		prev := &p.moves[n-1]
+		if prev.unit != [3]float64{} {
+			m.maxStartV2 = junctionV2(prev, &m, jd)
+		}
+	}
+	p.moves = append(p.moves, m)
+	if len(p.moves) >= 2*lookahead {
+		p.flush(lookahead)
+	}
+}
+
+// @info Maximum speed² through the junction of prev and m, see Klipper's toolhead.py
+func junctionV2(prev *move, m *move, jd float64) float64 {
+	cosTheta := -(prev.unit[0]*m.unit[0] + prev.unit[1]*m.unit[1] + prev.unit[2]*m.unit[2])
+	if cosTheta > 0.999999 {
+		return 0 // Full reversal
+	}
+	cosTheta = math.Max(cosTheta, -0.999999)
+	sinThetaD2 := math.Sqrt(0.5 * (1 - cosTheta))
+	rJD := sinThetaD2 / (1 - sinThetaD2)
+	tanThetaD2 := sinThetaD2 / math.Sqrt(0.5*(1+cosTheta))
+	v2 := math.Min(rJD*jd*m.accel, rJD*jd*prev.accel)
+	v2 = math.Min(v2, 0.5*m.dist*tanThetaD2*m.accel)
+	v2 = math.Min(v2, 0.5*prev.dist*tanThetaD2*prev.accel)
+	v2 = math.Min(v2, math.Min(m.maxV2, prev.maxV2))
+	return v2
+}
+
+// @info Times the first count moves (every move if count is negative), assuming the machine stops after the last one
+func (p *planner) flush(count int) {
+	n := len(p.moves)
+	if n == 0 {
+		return
+	}
+	if count < 0 || count > n {
+		count = n
+	}
+	// @info Backward pass: the fastest each move may start so that it can still slow down in time
+	next := 0.0
+	for i := n - 1; i >= 0; i-- {
+		m := &p.moves[i]
+		m.endV2 = next
+		m.startV2 = math.Min(m.maxStartV2, m.endV2+2*m.accel*m.dist)
+		next = m.startV2
+	}
+	// @info Forward pass: moves start at the speed the previous one ended with
+	prev := p.prevEnd
+	for i := 0; i < count; i++ {
+		m := &p.moves[i]
+		m.startV2 = math.Min(m.startV2, prev)
+		m.endV2 = math.Min(m.endV2, m.startV2+2*m.accel*m.dist)
+		p.seconds += m.duration()
+		prev = m.endV2
+	}
+	p.prevEnd = prev
+	p.moves = append(p.moves[:0], p.moves[count:]...)
+	if len(p.moves) > 0 {
+		p.moves[0].maxStartV2 = math.Min(p.moves[0].maxStartV2, prev)
+	}
+}
+
+// @info Time to accelerate from startV2 to the cruise speed, cruise and decelerate to endV2
+func (m *move) duration() float64 {
+	cruiseV2 := math.Min(m.maxV2, (m.startV2+m.endV2)/2+m.accel*m.dist)
+	vs, ve, vc := math.Sqrt(m.startV2), math.Sqrt(m.endV2), math.Sqrt(cruiseV2)
+	accelDist := (cruiseV2 - m.startV2) / (2 * m.accel)
+	decelDist := (cruiseV2 - m.endV2) / (2 * m.accel)
+	cruiseDist := math.Max(m.dist-accelDist-decelDist, 0)
+	seconds := (vc-vs)/m.accel + (vc-ve)/m.accel
+	if vc > 0 {
+		seconds += cruiseDist / vc
+	}
+	return seconds
+}
+
+// @info Stops the machine (dwell, waiting for heaters...) and adds the time it spends stopped
+func (p *planner) wait(seconds float64) {
+	p.flush(-1)
+	p.prevEnd = 0
+	if seconds > 0 && isFinite(seconds) {
+		p.seconds += seconds
+	}
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
@@ -0,0 +1,193 @@
+package geometry
+
+import (
+	"errors"
+	"math"
+	str "strings"
+)
+
+// @info Length unit of a model
+type Unit string
+
+const (
+	UnitUnknown    Unit = ""
+	UnitMicron     Unit = "micron"
+	UnitMillimeter Unit = "mm"
+	UnitCentimeter Unit = "cm"
+	UnitMeter      Unit = "m"
+	UnitInch       Unit = "in"
+	UnitFoot       Unit = "ft"
+)
+
+// @info Millimetres in one unit
+var unitScale = map[Unit]float64{
+	UnitMicron:     0.001,
+	UnitMillimeter: 1,
+	UnitCentimeter: 10,
+	UnitMeter:      1000,
+	UnitInch:       25.4,
+	UnitFoot:       304.8,
+}
+
+var ErrUnknownUnit = errors.New("Unknown unit, it must be one of micron, mm, cm, m, in or ft")
+
+// @info Parses a unit given by the customer, by its symbol or its name. Empty is UnitUnknown.
+// @error ErrUnknownUnit
+func ParseUnit(unit string) (Unit, error) {
+	switch str.ToLower(str.TrimSpace(unit)) {
+	case "":
+		return UnitUnknown, nil
+	case "micron", "um", "µm":
+		return UnitMicron, nil
+	case "mm", "millimeter", "millimetre":
+		return UnitMillimeter, nil
+	case "cm", "centimeter", "centimetre":
+		return UnitCentimeter, nil
+	case "m", "meter", "metre":
+		return UnitMeter, nil
+	case "in", "inch":
+		return UnitInch, nil
+	case "ft", "foot":
+		return UnitFoot, nil
+	}
+	return UnitUnknown, ErrUnknownUnit
+}
+
+func unitFrom3MF(unit string) Unit {
+	switch unit {
+	case "micron":
+		return UnitMicron
+	case "", "millimeter":
+		return UnitMillimeter // @info Millimetres are the default of the 3MF spec
+	case "centimeter":
+		return UnitCentimeter
+	case "meter":
+		return UnitMeter
+	case "inch":
+		return UnitInch
+	case "foot":
+		return UnitFoot
+	}
+	return UnitUnknown
+}
+
+// @info Suspects the unit of a file that does not declare it from its largest dimension, in file units: models that
+// would be absurdly small in millimetres were maybe exported in metres (under 1 unit) or inches (under 8 units, typical
+// of CAD tools configured in imperial units). Only a hint for the customer, genuinely small parts exist too, so
+// Analyze never applies it.
+func DetectUnit(largestDimension float64) Unit {
+	switch {
+	case largestDimension <= 0:
+		return UnitMillimeter
+	case largestDimension < 1:
+		return UnitMeter
+	case largestDimension < 8:
+		return UnitInch
+	}
+	return UnitMillimeter
+}
+
+type Box struct {
+	Min Vec3 `json:"min"`
+	Max Vec3 `json:"max"`
+}
+
+func (b Box) Size() Vec3 {
+	return b.Max.Sub(b.Min)
+}
+
+// @info Everything needed to quote a model. Sizes are converted to millimetres using Unit.
+type Analysis struct {
+	Format              Format  `json:"format"`
+	Unit                Unit    `json:"unit"`                     // Unit of the file
+	UnitGuessed         bool    `json:"unit_guessed"`             // Neither the file nor the customer gave the unit, so millimetres are assumed
+	SuggestedUnit       Unit    `json:"suggested_unit,omitempty"` // With UnitGuessed, the unit the size hints at when it is not millimetres, see DetectUnit
+	Triangles           int     `json:"triangles"`
+	Vertices            int     `json:"vertices"`
+	BoundingBox         Box     `json:"bounding_box"` // mm
+	Size                Vec3    `json:"size"`         // mm
+	VolumeMM3           float64 `json:"volume_mm3"`
+	AreaMM2             float64 `json:"area_mm2"`
+	Watertight          bool    `json:"watertight"`           // Closed and manifold: every edge is shared by exactly two triangles
+	Manifold            bool    `json:"manifold"`             // No edge shared by more than two triangles and consistent winding
+	BoundaryEdges       int     `json:"boundary_edges"`       // Edges of a single triangle, i.e. holes
+	NonManifoldEdges    int     `json:"non_manifold_edges"`   // Edges of three or more triangles
+	FlippedEdges        int     `json:"flipped_edges"`        // Edges whose triangles disagree on the winding
+	DegenerateTriangles int     `json:"degenerate_triangles"` // Triangles without area
+}
+
+// @info The volume is only meaningful for watertight models, otherwise it is an approximation. Meshes without a unit
+// are taken as millimetres, set Mesh.Unit first to use the one given by the customer.
+func Analyze(mesh *Mesh) *Analysis {
+	analysis := &Analysis{Format: mesh.Format, Unit: mesh.Unit, Triangles: len(mesh.Faces), Vertices: len(mesh.Vertices)}
+
+	box := Box{Min: Vec3{math.Inf(1), math.Inf(1), math.Inf(1)}, Max: Vec3{math.Inf(-1), math.Inf(-1), math.Inf(-1)}}
+	for _, v := range mesh.Vertices {
+		box.Min = Vec3{math.Min(box.Min.X, v.X), math.Min(box.Min.Y, v.Y), math.Min(box.Min.Z, v.Z)}
+		box.Max = Vec3{math.Max(box.Max.X, v.X), math.Max(box.Max.Y, v.Y), math.Max(box.Max.Z, v.Z)}
+	}
+	if len(mesh.Vertices) == 0 {
+		box = Box{}
+	}
+	if analysis.Unit == UnitUnknown {
+		analysis.Unit = UnitMillimeter
+		analysis.UnitGuessed = true
+		size := box.Size()
+		if suggested := DetectUnit(math.Max(size.X, math.Max(size.Y, size.Z))); suggested != UnitMillimeter {
+			analysis.SuggestedUnit = suggested
+		}
+	}
+	scale := unitScale[analysis.Unit]
+	analysis.BoundingBox = Box{Min: box.Min.Scale(scale), Max: box.Max.Scale(scale)}
+	analysis.Size = analysis.BoundingBox.Size()
+
+	// @info Signed volume of the tetrahedra formed by each triangle and the origin, see
+	// http://chenlab.ece.cornell.edu/Publication/Cha/icip01_Cha.pdf
+	volume, area := 0.0, 0.0
+	for _, face := range mesh.Faces {
+		v0, v1, v2 := mesh.Vertices[face[0]], mesh.Vertices[face[1]], mesh.Vertices[face[2]]
+		volume += v0.Dot(v1.Cross(v2)) / 6
+		triangleArea := v1.Sub(v0).Cross(v2.Sub(v0)).Length() / 2
+		if triangleArea == 0 || face[0] == face[1] || face[1] == face[2] || face[0] == face[2] {
+			analysis.DegenerateTriangles++
+		}
+		area += triangleArea
+	}
+	analysis.VolumeMM3 = math.Abs(volume) * scale * scale * scale
+	analysis.AreaMM2 = area * scale * scale
+
+	checkEdges(mesh, analysis)
+	return analysis
+}
+
+// @info Counts how many triangles use each edge, and in which direction
+func checkEdges(mesh *Mesh, analysis *Analysis) {
+	type edge struct{ a, b int }
+	undirected := make(map[edge]int, len(mesh.Faces)*3/2)
+	directed := make(map[edge]int, len(mesh.Faces)*3)
+	for _, face := range mesh.Faces {
+		for i := 0; i < 3; i++ {
+			a, b := face[i], face[(i+1)%3]
+			if a == b {
+				continue
+			}
+			directed[edge{a, b}]++
+			if a > b {
+				a, b = b, a
+			}
+			undirected[edge{a, b}]++
+		}
+	}
+	for e, count := range undirected {
+		switch {
+		case count == 1:
+			analysis.BoundaryEdges++
+		case count > 2:
+			analysis.NonManifoldEdges++
+		case directed[e] != 1 || directed[edge{e.b, e.a}] != 1:
+			analysis.FlippedEdges++
+		}
+	}
+	analysis.Manifold = analysis.NonManifoldEdges == 0 && analysis.FlippedEdges == 0
+	analysis.Watertight = analysis.Manifold && analysis.BoundaryEdges == 0
+}
@@ -0,0 +1,214 @@
+package geometry
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// @info Unit cube with outward facing triangles, used to build the seed corpus
+var cubeVertices = []Vec3{{0, 0, 0}, {10, 0, 0}, {10, 10, 0}, {0, 10, 0}, {0, 0, 10}, {10, 0, 10}, {10, 10, 10}, {0, 10, 10}}
+var cubeFaces = [][3]int{
+	{0, 2, 1}, {0, 3, 2}, {4, 5, 6}, {4, 6, 7}, {0, 1, 5}, {0, 5, 4},
+	{1, 2, 6}, {1, 6, 5}, {2, 3, 7}, {2, 7, 6}, {3, 0, 4}, {3, 4, 7},
+}
+
+func cubeBinarySTL() []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(make([]byte, stlHeaderSize))
+	binary.Write(buf, binary.LittleEndian, uint32(len(cubeFaces)))
+	for _, face := range cubeFaces {
+		binary.Write(buf, binary.LittleEndian, [3]float32{})
+		for _, index := range face {
+			v := cubeVertices[index]
+			binary.Write(buf, binary.LittleEndian, [3]float32{float32(v.X), float32(v.Y), float32(v.Z)})
+		}
+		binary.Write(buf, binary.LittleEndian, uint16(0))
+	}
+	return buf.Bytes()
+}
+
+func cubeASCIISTL() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("solid cube\n")
+	for _, face := range cubeFaces {
+		buf.WriteString("  facet normal 0 0 0\n    outer loop\n")
+		for _, index := range face {
+			v := cubeVertices[index]
+			fmt.Fprintf(buf, "      vertex %g %g %g\n", v.X, v.Y, v.Z)
+		}
+		buf.WriteString("    endloop\n  endfacet\n")
+	}
+	buf.WriteString("endsolid cube\n")
+	return buf.Bytes()
+}
+
+func cubeOBJ() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString("# cube\no cube\n")
+	for _, v := range cubeVertices {
+		fmt.Fprintf(buf, "v %g %g %g\n", v.X, v.Y, v.Z)
+	}
+	for _, face := range cubeFaces {
+		fmt.Fprintf(buf, "f %d/1 %d//2 %d\n", face[0]+1, face[1]+1, face[2]-len(cubeVertices))
+	}
+	return buf.Bytes()
+}
+
+func cube3MF(unit string) []byte {
+	model := &bytes.Buffer{}
+	fmt.Fprintf(model, `<?xml version="1.0" encoding="UTF-8"?><model unit="%s" xmlns="http://schemas.microsoft.com/3dmanufacturing/core/2015/02"><resources><object id="1" type="model"><mesh><vertices>`, unit)
+	for _, v := range cubeVertices {
+		fmt.Fprintf(model, `<vertex x="%g" y="%g" z="%g"/>`, v.X, v.Y, v.Z)
+	}
+	model.WriteString(`</vertices><triangles>`)
+	for _, face := range cubeFaces {
+		fmt.Fprintf(model, `<triangle v1="%d" v2="%d" v3="%d"/>`, face[0], face[1], face[2])
+	}
+	model.WriteString(`</triangles></mesh></object><object id="2"><components><component objectid="1" transform="1 0 0 0 1 0 0 0 1 5 5 5"/></components></object></resources><build><item objectid="2" transform="2 0 0 0 1 0 0 0 1 0 0 0"/></build></model>`)
+
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+	rels, _ := archive.Create("_rels/.rels")
+	fmt.Fprintf(rels, `<?xml version="1.0" encoding="UTF-8"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Target="/3D/3dmodel.model" Id="rel0" Type="%s"/></Relationships>`, threeMFModelRelType)
+	file, _ := archive.Create(threeMFDefaultModel)
+	file.Write(model.Bytes())
+	archive.Close()
+	return buf.Bytes()
+}
+
+func TestParseCube(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   []byte
+		volume float64
+		unit   Unit
+	}{
+		{"binary.stl", cubeBinarySTL(), 1000, UnitMillimeter},
+		{"ascii.stl", cubeASCIISTL(), 1000, UnitMillimeter},
+		{"cube.obj", cubeOBJ(), 1000, UnitMillimeter},
+		{"cube.3mf", cube3MF("centimeter"), 2000 * 1000, UnitCentimeter},
+	}
+	for _, c := range cases {
+		mesh, err := Parse(c.data, c.name)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		analysis := Analyze(mesh)
+		if analysis.Triangles != 12 || analysis.Vertices != 8 {
+			t.Errorf("%s: got %d triangles and %d vertices", c.name, analysis.Triangles, analysis.Vertices)
+		}
+		if math.Abs(analysis.VolumeMM3-c.volume) > 1e-6 {
+			t.Errorf("%s: volume %f, want %f", c.name, analysis.VolumeMM3, c.volume)
+		}
+		if !analysis.Watertight || !analysis.Manifold {
+			t.Errorf("%s: expected a watertight manifold, got %+v", c.name, analysis)
+		}
+		if analysis.Unit != c.unit {
+			t.Errorf("%s: unit %s, want %s", c.name, analysis.Unit, c.unit)
+		}
+	}
+}
+
+// @info Small parts are measured as they come, the unit the size suggests is only a hint
+func TestUnitNotRescaled(t *testing.T) {
+	cases := []struct {
+		obj       string
+		unit      Unit
+		volume    float64
+		suggested Unit
+	}{
+		{"v 0 0 0\nv 5 0 0\nv 0 5 0\nv 0 0 5\n", UnitUnknown, 125.0 / 6, UnitInch},
+		{"v 0 0 0\nv 0.5 0 0\nv 0 0.5 0\nv 0 0 0.5\n", UnitUnknown, 0.125 / 6, UnitMeter},
+		{"v 0 0 0\nv 50 0 0\nv 0 50 0\nv 0 0 50\n", UnitUnknown, 125000.0 / 6, UnitUnknown},
+		{"v 0 0 0\nv 5 0 0\nv 0 5 0\nv 0 0 5\n", UnitInch, 125.0 / 6 * 25.4 * 25.4 * 25.4, UnitUnknown},
+	}
+	for _, c := range cases {
+		mesh, err := ParseOBJ([]byte(c.obj + "f 1 3 2\nf 1 2 4\nf 1 4 3\nf 2 3 4\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mesh.Unit = c.unit
+		analysis := Analyze(mesh)
+		if math.Abs(analysis.VolumeMM3-c.volume) > 1e-6*c.volume {
+			t.Errorf("%s: volume %f, want %f", c.unit, analysis.VolumeMM3, c.volume)
+		}
+		if analysis.UnitGuessed != (c.unit == UnitUnknown) || analysis.SuggestedUnit != c.suggested {
+			t.Errorf("%s: unit %s guessed %v suggested %s, want suggested %s", c.unit, analysis.Unit, analysis.UnitGuessed, analysis.SuggestedUnit, c.suggested)
+		}
+	}
+}
+
+func TestParseUnit(t *testing.T) {
+	for raw, want := range map[string]Unit{"": UnitUnknown, "mm": UnitMillimeter, " Inch ": UnitInch, "CM": UnitCentimeter, "metre": UnitMeter} {
+		if unit, err := ParseUnit(raw); err != nil || unit != want {
+			t.Errorf("ParseUnit(%q) = %s, %v, want %s", raw, unit, err, want)
+		}
+	}
+	if _, err := ParseUnit("furlong"); !errors.Is(err, ErrUnknownUnit) {
+		t.Errorf("ParseUnit of an unknown unit = %v, want ErrUnknownUnit", err)
+	}
+}
+
+func TestOpenMesh(t *testing.T) {
+	mesh, err := ParseOBJ([]byte("v 0 0 0\nv 10 0 0\nv 0 10 0\nv 0 0 10\nf 1 2 3\nf 1 2 4\nf 1 3 4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	analysis := Analyze(mesh)
+	if analysis.Watertight || analysis.BoundaryEdges != 3 {
+		t.Errorf("expected 3 boundary edges, got %+v", analysis)
+	}
+}
+
+func TestCorruptFiles(t *testing.T) {
+	truncated := cubeBinarySTL()
+	truncated = append(truncated[:100], 's')
+	cases := map[string][]byte{
+		"truncated.stl": truncated,
+		"bad.stl":       []byte("solid x\nfacet normal 0 0 0\nouter loop\nvertex 1 2\nendloop\nendfacet\nendsolid\n"),
+		"bad.obj":       []byte("v 0 0 0\nf 1 2 3\n"),
+		"bad.3mf":       []byte("PK\x03\x04garbage"),
+	}
+	for name, data := range cases {
+		_, err := Parse(data, name)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%s: expected a *ParseError, got %v", name, err)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(cubeBinarySTL(), "cube.stl")
+	f.Add(cubeASCIISTL(), "cube.stl")
+	f.Add(cubeOBJ(), "cube.obj")
+	f.Add(cube3MF("millimeter"), "cube.3mf")
+	f.Add([]byte("solid\nfacet\nvertex 1 1 1\nendfacet\n"), "x.stl")
+	f.Add([]byte("v 1 2 3\nf -1 -1 -1 -1\n"), "x.obj")
+	f.Fuzz(func(t *testing.T, data []byte, name string) {
+		mesh, err := Parse(data, name)
+		if err != nil {
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) && !errors.Is(err, ErrUnknownFormat) && !errors.Is(err, ErrNoTriangles) && !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			return
+		}
+		for _, face := range mesh.Faces {
+			for _, index := range face {
+				if index < 0 || index >= len(mesh.Vertices) {
+					t.Fatalf("face references vertex %d of %d", index, len(mesh.Vertices))
+				}
+			}
+		}
+		analysis := Analyze(mesh)
+		if math.IsNaN(analysis.VolumeMM3) || math.IsNaN(analysis.AreaMM2) || analysis.VolumeMM3 < 0 {
+			t.Fatalf("invalid analysis %+v", analysis)
+		}
+	})
+}
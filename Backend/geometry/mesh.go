@@ -0,0 +1,158 @@
+package geometry
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	str "strings"
+)
+
+// @info File formats understood by Parse
+type Format string
+
+const (
+	FormatSTL Format = "stl"
+	FormatOBJ Format = "obj"
+	Format3MF Format = "3mf"
+)
+
+// @info Limits protecting the server from huge or malicious files
+const (
+	MaxTriangles    = 5_000_000
+	MaxVertices     = 3 * MaxTriangles
+	MaxArchiveBytes = 512 << 20 // Uncompressed size of the model inside a 3MF
+)
+
+var (
+	ErrUnknownFormat = errors.New("Unknown model format, expected STL, OBJ or 3MF")
+	ErrNoTriangles   = errors.New("The model has no triangles")
+	ErrTooLarge      = fmt.Errorf("The model has more than %d triangles", MaxTriangles)
+)
+
+// @info Returned when a file is corrupt. Line is set for text formats and Offset for binary ones.
+type ParseError struct {
+	Format Format
+	Line   int
+	Offset int64
+	Reason string
+	Err    error // Underlying error, e.g. from the zip or XML decoders
+}
+
+func (e *ParseError) Error() string {
+	where := ""
+	switch {
+	case e.Line > 0:
+		where = fmt.Sprintf(" at line %d", e.Line)
+	case e.Offset > 0:
+		where = fmt.Sprintf(" at byte %d", e.Offset)
+	}
+	message := fmt.Sprintf("Invalid %s file%s: %s", str.ToUpper(string(e.Format)), where, e.Reason)
+	if e.Err != nil {
+		message += ": " + e.Err.Error()
+	}
+	return message
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+type Vec3 struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+func (a Vec3) Add(b Vec3) Vec3      { return Vec3{a.X + b.X, a.Y + b.Y, a.Z + b.Z} }
+func (a Vec3) Sub(b Vec3) Vec3      { return Vec3{a.X - b.X, a.Y - b.Y, a.Z - b.Z} }
+func (a Vec3) Scale(s float64) Vec3 { return Vec3{a.X * s, a.Y * s, a.Z * s} }
+func (a Vec3) Dot(b Vec3) float64   { return a.X*b.X + a.Y*b.Y + a.Z*b.Z }
+func (a Vec3) Length() float64      { return math.Sqrt(a.Dot(a)) }
+func (a Vec3) IsFinite() bool       { return isFinite(a.X) && isFinite(a.Y) && isFinite(a.Z) }
+func (a Vec3) Cross(b Vec3) Vec3 {
+	return Vec3{a.Y*b.Z - a.Z*b.Y, a.Z*b.X - a.X*b.Z, a.X*b.Y - a.Y*b.X}
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// @info Indexed triangle mesh. Identical vertices are merged, so faces sharing an edge share its vertex indexes.
+type Mesh struct {
+	Format   Format
+	Unit     Unit // UnitUnknown unless the file declares it (only 3MF does). Set it before Analyze to use another one
+	Vertices []Vec3
+	Faces    [][3]int
+}
+
+// @info Builds a Mesh merging identical vertices
+type meshBuilder struct {
+	mesh  *Mesh
+	index map[Vec3]int
+}
+
+func newMeshBuilder(format Format) *meshBuilder {
+	return &meshBuilder{mesh: &Mesh{Format: format, Unit: UnitUnknown}, index: map[Vec3]int{}}
+}
+
+func (b *meshBuilder) vertex(v Vec3) int {
+	if i, ok := b.index[v]; ok {
+		return i
+	}
+	b.mesh.Vertices = append(b.mesh.Vertices, v)
+	b.index[v] = len(b.mesh.Vertices) - 1
+	return len(b.mesh.Vertices) - 1
+}
+
+func (b *meshBuilder) triangle(v0 Vec3, v1 Vec3, v2 Vec3) error {
+	if len(b.mesh.Faces) >= MaxTriangles {
+		return ErrTooLarge
+	}
+	b.mesh.Faces = append(b.mesh.Faces, [3]int{b.vertex(v0), b.vertex(v1), b.vertex(v2)})
+	return nil
+}
+
+func (b *meshBuilder) finish() (*Mesh, error) {
+	if len(b.mesh.Faces) == 0 {
+		return nil, ErrNoTriangles
+	}
+	return b.mesh, nil
+}
+
+// @info Parses a model, guessing its format from the contents or, failing that, from the file name
+// @error ErrUnknownFormat, ErrNoTriangles, ErrTooLarge or a *ParseError
+func Parse(data []byte, filename string) (*Mesh, error) {
+	switch DetectFormat(data, filename) {
+	case FormatSTL:
+		return ParseSTL(data)
+	case FormatOBJ:
+		return ParseOBJ(data)
+	case Format3MF:
+		return Parse3MF(data)
+	}
+	return nil, ErrUnknownFormat
+}
+
+// @info Empty if the format can't be recognised
+func DetectFormat(data []byte, filename string) Format {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return Format3MF
+	case isBinarySTL(data) || isASCIISTL(data):
+		return FormatSTL
+	}
+	switch str.ToLower(filepath.Ext(filename)) {
+	case ".stl":
+		return FormatSTL
+	case ".obj":
+		return FormatOBJ
+	case ".3mf":
+		return Format3MF
+	}
+	if looksLikeOBJ(data) {
+		return FormatOBJ
+	}
+	return ""
+}
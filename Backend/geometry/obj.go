@@ -0,0 +1,96 @@
+package geometry
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	str "strings"
+)
+
+func looksLikeOBJ(data []byte) bool {
+	for _, line := range bytes.SplitN(data[:minInt(len(data), 4096)], []byte("\n"), 64) {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("v ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// @info Parses Wavefront OBJ. Only vertices (v) and faces (f) are used; polygons are split into triangles as a fan,
+// and every object and group is merged into a single mesh.
+func ParseOBJ(data []byte) (*Mesh, error) {
+	builder := newMeshBuilder(FormatOBJ)
+	vertices := []Vec3{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	fail := func(line int, reason string) error {
+		return &ParseError{Format: FormatOBJ, Line: line, Reason: reason}
+	}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if comment := str.IndexByte(text, '#'); comment >= 0 {
+			text = text[:comment]
+		}
+		fields := str.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "v":
+			if len(fields) < 4 {
+				return nil, fail(line, "a vertex needs 3 coordinates")
+			}
+			if len(vertices) >= MaxVertices {
+				return nil, ErrTooLarge
+			}
+			v, err := parseVec3(fields[1:4])
+			if err != nil {
+				return nil, fail(line, err.Error())
+			}
+			vertices = append(vertices, v)
+		case "f":
+			if len(fields) < 4 {
+				return nil, fail(line, "a face needs at least 3 vertices")
+			}
+			corners := make([]Vec3, 0, len(fields)-1)
+			for _, field := range fields[1:] {
+				index, err := objIndex(field, len(vertices))
+				if err != nil {
+					return nil, fail(line, err.Error())
+				}
+				corners = append(corners, vertices[index])
+			}
+			for i := 1; i+1 < len(corners); i++ {
+				if err := builder.triangle(corners[0], corners[i], corners[i+1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ParseError{Format: FormatOBJ, Line: line + 1, Reason: "line too long", Err: err}
+	}
+	return builder.finish()
+}
+
+// @info Resolves the vertex of a face corner: "v", "v/vt", "v/vt/vn" or "v//vn". Indexes start at 1 and negative ones
+// count back from the last vertex read.
+func objIndex(field string, count int) (int, error) {
+	raw, _, _ := str.Cut(field, "/")
+	index, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, problem("'" + truncate(field, 32) + "' is not a valid vertex reference")
+	}
+	if index < 0 {
+		index += count
+	} else {
+		index--
+	}
+	if index < 0 || index >= count {
+		return 0, problem("vertex " + raw + " does not exist")
+	}
+	return index, nil
+}
@@ -0,0 +1,168 @@
+package geometry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	str "strings"
+)
+
+// @info Binary STL: 80 byte header, uint32 triangle count, then 50 bytes per triangle (normal, 3 vertices and a
+// 2 byte attribute), all little endian float32.
+const (
+	stlHeaderSize   = 80
+	stlTriangleSize = 50
+)
+
+func isBinarySTL(data []byte) bool {
+	if len(data) < stlHeaderSize+4 {
+		return false
+	}
+	count := binary.LittleEndian.Uint32(data[stlHeaderSize:])
+	return uint64(len(data)) == stlHeaderSize+4+uint64(count)*stlTriangleSize
+}
+
+func isASCIISTL(data []byte) bool {
+	head := bytes.TrimLeft(data[:minInt(len(data), 1024)], " \t\r\n")
+	return bytes.HasPrefix(head, []byte("solid")) && bytes.Contains(data[:minInt(len(data), 4096)], []byte("facet"))
+}
+
+// @info Parses binary or ASCII STL. Normals are ignored, they are recomputed from the vertices when needed.
+func ParseSTL(data []byte) (*Mesh, error) {
+	if isBinarySTL(data) {
+		return parseBinarySTL(data)
+	}
+	head := bytes.TrimLeft(data[:minInt(len(data), 1024)], " \t\r\n")
+	if bytes.HasPrefix(head, []byte("solid")) {
+		return parseASCIISTL(data)
+	}
+	return parseBinarySTL(data)
+}
+
+func parseBinarySTL(data []byte) (*Mesh, error) {
+	if len(data) < stlHeaderSize+4 {
+		return nil, &ParseError{Format: FormatSTL, Offset: int64(len(data)), Reason: "the file is shorter than the STL header"}
+	}
+	count := uint64(binary.LittleEndian.Uint32(data[stlHeaderSize:]))
+	if count > MaxTriangles {
+		return nil, ErrTooLarge
+	}
+	if want := stlHeaderSize + 4 + count*stlTriangleSize; uint64(len(data)) < want {
+		return nil, &ParseError{Format: FormatSTL, Offset: int64(len(data)), Reason: "the file is truncated, the header announces " + strconv.FormatUint(count, 10) + " triangles"}
+	}
+	builder := newMeshBuilder(FormatSTL)
+	for i := uint64(0); i < count; i++ {
+		offset := stlHeaderSize + 4 + i*stlTriangleSize
+		var v [3]Vec3
+		for j := range v {
+			base := offset + 12 + uint64(j)*12 // @info Skip the normal
+			v[j] = Vec3{
+				X: float64(math.Float32frombits(binary.LittleEndian.Uint32(data[base:]))),
+				Y: float64(math.Float32frombits(binary.LittleEndian.Uint32(data[base+4:]))),
+				Z: float64(math.Float32frombits(binary.LittleEndian.Uint32(data[base+8:]))),
+			}
+			if !v[j].IsFinite() {
+				return nil, &ParseError{Format: FormatSTL, Offset: int64(base), Reason: "vertex coordinates must be finite numbers"}
+			}
+		}
+		if err := builder.triangle(v[0], v[1], v[2]); err != nil {
+			return nil, err
+		}
+	}
+	return builder.finish()
+}
+
+func parseASCIISTL(data []byte) (*Mesh, error) {
+	builder := newMeshBuilder(FormatSTL)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	fail := func(line int, reason string) error {
+		return &ParseError{Format: FormatSTL, Line: line, Reason: reason}
+	}
+
+	line := 0
+	inFacet := false
+	vertices := []Vec3{}
+	for scanner.Scan() {
+		line++
+		fields := str.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch str.ToLower(fields[0]) {
+		case "solid", "endsolid", "outer", "endloop":
+		case "facet":
+			if inFacet {
+				return nil, fail(line, "facet inside another facet")
+			}
+			inFacet = true
+			vertices = vertices[:0]
+		case "vertex":
+			if !inFacet {
+				return nil, fail(line, "vertex outside a facet")
+			}
+			if len(fields) != 4 {
+				return nil, fail(line, "a vertex needs 3 coordinates")
+			}
+			v, err := parseVec3(fields[1:4])
+			if err != nil {
+				return nil, fail(line, err.Error())
+			}
+			vertices = append(vertices, v)
+		case "endfacet":
+			if !inFacet {
+				return nil, fail(line, "endfacet without facet")
+			}
+			if len(vertices) != 3 {
+				return nil, fail(line, "a facet needs exactly 3 vertices, got "+strconv.Itoa(len(vertices)))
+			}
+			if err := builder.triangle(vertices[0], vertices[1], vertices[2]); err != nil {
+				return nil, err
+			}
+			inFacet = false
+		default:
+			return nil, fail(line, "unexpected '"+truncate(fields[0], 32)+"'")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ParseError{Format: FormatSTL, Line: line + 1, Reason: "line too long", Err: err}
+	}
+	if inFacet {
+		return nil, fail(line, "the file ends inside a facet")
+	}
+	return builder.finish()
+}
+
+type problem string
+
+func (e problem) Error() string {
+	return string(e)
+}
+
+func parseVec3(fields []string) (Vec3, error) {
+	var coords [3]float64
+	for i := range coords {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil || !isFinite(value) {
+			return Vec3{}, problem("'" + truncate(fields[i], 32) + "' is not a valid coordinate")
+		}
+		coords[i] = value
+	}
+	return Vec3{coords[0], coords[1], coords[2]}, nil
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return s[:length] + "..."
+	}
+	return s
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
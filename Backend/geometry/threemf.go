@@ -0,0 +1,231 @@
+package geometry
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"path"
+	"strconv"
+	str "strings"
+)
+
+// @info https://github.com/3MFConsortium/spec_core/blob/master/3MF%20Core%20Specification.md
+const (
+	threeMFModelRelType = "http://schemas.microsoft.com/3dmanufacturing/2013/01/3dmodel"
+	threeMFDefaultModel = "3D/3dmodel.model"
+	threeMFMaxDepth     = 32    // Nesting depth of components, to stop reference cycles
+	threeMFMaxInstances = 10000 // Objects placed in total, components can reference the same object many times
+)
+
+type threeMFRelationships struct {
+	Relationships []struct {
+		Target string `xml:"Target,attr"`
+		Type   string `xml:"Type,attr"`
+	} `xml:"Relationship"`
+}
+
+type threeMFModel struct {
+	Unit    string          `xml:"unit,attr"`
+	Objects []threeMFObject `xml:"resources>object"`
+	Items   []struct {
+		ObjectID  string `xml:"objectid,attr"`
+		Transform string `xml:"transform,attr"`
+	} `xml:"build>item"`
+}
+
+type threeMFObject struct {
+	ID       string `xml:"id,attr"`
+	Type     string `xml:"type,attr"`
+	Vertices []struct {
+		X string `xml:"x,attr"`
+		Y string `xml:"y,attr"`
+		Z string `xml:"z,attr"`
+	} `xml:"mesh>vertices>vertex"`
+	Triangles []struct {
+		V1 string `xml:"v1,attr"`
+		V2 string `xml:"v2,attr"`
+		V3 string `xml:"v3,attr"`
+	} `xml:"mesh>triangles>triangle"`
+	Components []struct {
+		ObjectID  string `xml:"objectid,attr"`
+		Transform string `xml:"transform,attr"`
+	} `xml:"components>component"`
+}
+
+// @info Affine transform of 3MF, the 3x4 matrix "m00 m01 m02 m10 m11 m12 m20 m21 m22 m30 m31 m32" applied to row vectors
+type transform [12]float64
+
+var identity = transform{1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0}
+
+func (t transform) apply(v Vec3) Vec3 {
+	return Vec3{
+		X: v.X*t[0] + v.Y*t[3] + v.Z*t[6] + t[9],
+		Y: v.X*t[1] + v.Y*t[4] + v.Z*t[7] + t[10],
+		Z: v.X*t[2] + v.Y*t[5] + v.Z*t[8] + t[11],
+	}
+}
+
+// @info The transform of a component applied inside the transform of its parent
+func (t transform) then(parent transform) transform {
+	var out transform
+	for row := 0; row < 4; row++ {
+		for col := 0; col < 3; col++ {
+			value := t[row*3]*parent[col] + t[row*3+1]*parent[3+col] + t[row*3+2]*parent[6+col]
+			if row == 3 {
+				value += parent[9+col]
+			}
+			out[row*3+col] = value
+		}
+	}
+	return out
+}
+
+func parseTransform(raw string) (transform, error) {
+	if str.TrimSpace(raw) == "" {
+		return identity, nil
+	}
+	fields := str.Fields(raw)
+	if len(fields) != 12 {
+		return identity, problem("a transform needs 12 numbers")
+	}
+	var t transform
+	for i, field := range fields {
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil || !isFinite(value) {
+			return identity, problem("'" + truncate(field, 32) + "' is not a valid transform value")
+		}
+		t[i] = value
+	}
+	return t, nil
+}
+
+// @info Parses a 3MF package: every build item is added to the mesh with its transform applied. The unit declared by
+// the model is kept in Mesh.Unit.
+func Parse3MF(data []byte) (*Mesh, error) {
+	fail := func(reason string, err error) error {
+		return &ParseError{Format: Format3MF, Reason: reason, Err: err}
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fail("not a zip archive", err)
+	}
+
+	modelPath := threeMFDefaultModel
+	if rels, err := readZipFile(archive, "_rels/.rels"); err == nil {
+		parsed := threeMFRelationships{}
+		if err := xml.Unmarshal(rels, &parsed); err != nil {
+			return nil, fail("corrupt _rels/.rels", err)
+		}
+		for _, rel := range parsed.Relationships {
+			if rel.Type == threeMFModelRelType {
+				modelPath = str.TrimPrefix(path.Clean("/"+rel.Target), "/")
+				break
+			}
+		}
+	}
+	raw, err := readZipFile(archive, modelPath)
+	if err != nil {
+		return nil, fail("can't read "+modelPath, err)
+	}
+	model := threeMFModel{}
+	if err := xml.Unmarshal(raw, &model); err != nil {
+		return nil, fail("corrupt "+modelPath, err)
+	}
+
+	builder := newMeshBuilder(Format3MF)
+	builder.mesh.Unit = unitFrom3MF(model.Unit)
+	objects := map[string]*threeMFObject{}
+	for i := range model.Objects {
+		objects[model.Objects[i].ID] = &model.Objects[i]
+	}
+
+	instances := 0
+	var addObject func(id string, t transform, depth int) error
+	addObject = func(id string, t transform, depth int) error {
+		object, ok := objects[id]
+		if !ok {
+			return fail("object "+truncate(id, 32)+" does not exist", nil)
+		}
+		if depth > threeMFMaxDepth {
+			return fail("components are nested too deep", nil)
+		}
+		if instances++; instances > threeMFMaxInstances {
+			return ErrTooLarge
+		}
+		if object.Type != "" && object.Type != "model" && object.Type != "solidsupport" {
+			return nil // @info "support" and "other" objects are not printed as part of the model
+		}
+		vertices := make([]Vec3, len(object.Vertices))
+		for i, vertex := range object.Vertices {
+			v, err := parseVec3([]string{vertex.X, vertex.Y, vertex.Z})
+			if err != nil {
+				return fail("object "+truncate(id, 32), err)
+			}
+			vertices[i] = t.apply(v)
+		}
+		for _, triangle := range object.Triangles {
+			var corners [3]Vec3
+			for j, raw := range []string{triangle.V1, triangle.V2, triangle.V3} {
+				index, err := strconv.Atoi(raw)
+				if err != nil || index < 0 || index >= len(vertices) {
+					return fail("object "+truncate(id, 32)+" references vertex '"+truncate(raw, 32)+"' which does not exist", nil)
+				}
+				corners[j] = vertices[index]
+			}
+			if err := builder.triangle(corners[0], corners[1], corners[2]); err != nil {
+				return err
+			}
+		}
+		for _, component := range object.Components {
+			local, err := parseTransform(component.Transform)
+			if err != nil {
+				return fail("object "+truncate(id, 32), err)
+			}
+			if err := addObject(component.ObjectID, local.then(t), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(model.Items) == 0 {
+		return nil, fail("the build has no items", nil)
+	}
+	for _, item := range model.Items {
+		t, err := parseTransform(item.Transform)
+		if err != nil {
+			return nil, fail("build item", err)
+		}
+		if err := addObject(item.ObjectID, t, 0); err != nil {
+			return nil, err
+		}
+	}
+	return builder.finish()
+}
+
+// @info Reads a file of the archive, refusing files that would take more than MaxArchiveBytes once decompressed
+func readZipFile(archive *zip.Reader, name string) ([]byte, error) {
+	for _, file := range archive.File {
+		if !str.EqualFold(file.Name, name) {
+			continue
+		}
+		if file.UncompressedSize64 > MaxArchiveBytes {
+			return nil, ErrTooLarge
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(io.LimitReader(reader, MaxArchiveBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > MaxArchiveBytes {
+			return nil, ErrTooLarge
+		}
+		return data, nil
+	}
+	return nil, problem("missing file")
+}
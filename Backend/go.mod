@@ -1,26 +1,40 @@
-module 3DQuest
-
-go 1.19
-
-require (
-	github.com/creasty/defaults v1.6.0 // indirect
-	github.com/fatih/color v1.9.0 // indirect
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
-	github.com/githubnemo/CompileDaemon v1.4.0 // indirect
-	github.com/go-kivik/couchdb/v4 v4.0.0-20220217152009-9380cf8517a0 // indirect
-	github.com/go-kivik/kivik/v4 v4.0.0-20220330131300-9effce90869a // indirect
-	github.com/google/go-querystring v1.1.0 // indirect
-	github.com/joho/godotenv v1.4.0 // indirect
-	github.com/labstack/echo/v4 v4.8.0 // indirect
-	github.com/labstack/gommon v0.3.1 // indirect
-	github.com/mattn/go-colorable v0.1.11 // indirect
-	github.com/mattn/go-isatty v0.0.14 // indirect
-	github.com/radovskyb/watcher v1.0.7 // indirect
-	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasttemplate v1.2.1 // indirect
-	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
-	golang.org/x/net v0.0.0-20220826154423-83b083e8dc8b // indirect
-	golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10 // indirect
-	golang.org/x/text v0.3.7 // indirect
-	golang.org/x/xerrors v0.0.0-20220609144429-65e65417b02f // indirect
-)
+module 3DQuest
+
+go 1.19
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/creasty/defaults v1.6.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/golang-jwt/jwt/v4 v4.5.1
+	github.com/google/go-querystring v1.1.0
+	github.com/joho/godotenv v1.4.0
+	github.com/labstack/echo/v4 v4.8.0
+	github.com/mochi-mqtt/server/v2 v2.3.0
+	github.com/rs/zerolog v1.28.0
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/net v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/fatih/color v1.9.0 // indirect
+	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/githubnemo/CompileDaemon v1.4.0 // indirect
+	github.com/go-kivik/couchdb/v4 v4.0.0-20220217152009-9380cf8517a0 // indirect
+	github.com/go-kivik/kivik/v4 v4.0.0-20220330131300-9effce90869a // indirect
+	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/labstack/gommon v0.3.1 // indirect
+	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/mattn/go-isatty v0.0.14 // indirect
+	github.com/radovskyb/watcher v1.0.7 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasttemplate v1.2.1 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/text v0.8.0 // indirect
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324 // indirect
+	golang.org/x/xerrors v0.0.0-20220609144429-65e65417b02f // indirect
+)
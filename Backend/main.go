@@ -1,119 +1,142 @@
-package main
-
-import (
-	"3DQuest/dbdriver"
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"os"
-
-	// _ "github.com/go-kivik/couchdb/v4" // Kivik CouchDB Driver
-	"github.com/joho/godotenv"
-	"github.com/labstack/echo/v4"
-)
-
-func init() {
-	err := godotenv.Load()
-	if err != nil {
-		panic("Couldn't load the .env file")
-	}
-}
-
-func main() {
-	fmt.Printf("Hello World @ PORT = %s\n", os.Getenv("PORT"))
-	client, _ := dbdriver.CreateClient()
-	// fmt.Println(client.URL.String())
-	dbs, _ := dbdriver.GetAllDBs(client)
-	db_info, _ := dbdriver.ConnectToDB(client, dbs[2])
-	// fmt.Println(dbs)
-	// db_info, _ := dbdriver.GetDBInfo(client, dbs[2])
-	fmt.Println(db_info.Name, db_info.Sizes.External)
-	// doc, _ := dbdriver.GetDesignDocument(client, dbs[2], "test")
-	// fmt.Printf("%+v\n", doc.Views["admin_user_view"])
-	// docInfo, _ := dbdriver.GetDesignDocumentInfo(client, dbs[2], "test")
-	// fmt.Println(docInfo.ViewIndex.Sizes.File)
-
-	// newDoc, _ := dbdriver.GetDocument(client, dbs[2], "b7a10978cdb6f2c3b3fbbc91660007a2")
-	// fmt.Printf("%+v\n", newDoc["type"])
-	opts := dbdriver.CreateDesignViewOptions()
-	opts.IncludeDocs = true
-	// @TODO must test json query
-	view, _ := dbdriver.GetDesignView(client, "test", "all_user_view", opts)
-	fmt.Printf("%+v\n", view.Rows[2].Key["name"])
-	// fmt.Printf("THIS SHOULD NOT BE EMPTY %+v\n", view.Rows[1].Doc)
-	opts.Sorted = false
-	opts.IncludeDocs = false
-	view, _ = dbdriver.GetDesignView(client, "test", "all_user_view", opts)
-	// fmt.Printf("THIS SHOULD NOT EXIST %+v\n", view.TotalRows)
-	// fmt.Println(opts.EndKey, opts.StartKeyDocID, opts.Update)
-	new_id, _ := dbdriver.GetUUIDFromCouchDB(client)
-	fmt.Println(new_id)
-	// documentito := `{
-	// 	"_id": "%s",
-	// 	"type": "user",
-	// 	"name": "Sr. Patata Potato",
-	// 	"nif": "AAAAA",
-	// 	"credits": 69,
-	// 	"email": "mr.potato@patata.es",
-	// 	"password_hash": "lmaolmaolmaohasherino"
-	// }`
-	// documentito = fmt.Sprintf(documentito, new_id)
-	// fmt.Println(documentito)
-	// data, _ := dbdriver.PutDocument(client, dbs[2], new_id, documentito)
-	// fmt.Printf("%+v\n", *data)
-
-	// fmt.Println("REV ", rev)
-	// documentito := make(map[string]interface{}, 0)
-	// documentito2 := &map[string]interface{}{
-	// 	"type":          "admin",
-	// 	"name":          "COOLIO The Artist",
-	// 	"nif":           "676676676Q",
-	// 	"credits":       777,
-	// 	"email":         "gangstas@paradi.se",
-	// 	"password_hash": "Everybody's runnin', but half of them ain't lookin'",
-	// }
-	// responserino, _ := dbdriver.CreateNewDocument(client, dbs[2], documentito2)
-	// fmt.Printf("%+v\n", responserino)
-	// res := dbdriver.CreateNewDatabase(client, "lmaodb")
-	// fmt.Println(res)
-	findopts := &dbdriver.FindOptions{}
-
-	jsonStr := `{
-			"credits": {
-				"$lt": 666
-			},
-            "type": "user"
-		}`
-
-	findopts.Limit = 3
-	json.Unmarshal([]byte(jsonStr), &findopts.Selector)
-	fmt.Printf("%v\n", findopts.Selector)
-
-	jsonfile, _ := json.Marshal(&findopts)
-	fmt.Println(string(jsonfile))
-	found, _ := dbdriver.FindInDatabase(client, findopts)
-	fmt.Printf("%v\n", found.Docs)
-}
-
-func hdnl_hello_world(ectx echo.Context) error {
-	return ectx.String(http.StatusOK, "hello world!")
-}
-
-// e := echo.New()
-// 	e.GET("/", hdnl_hello_world)
-
-// db := client.DB("questdb")
-
-// usr := User{}
-// row := db.Get(context.TODO(), "b7a10978cdb6f2c3b3fbbc91660007a2")
-// ctx := context.TODO()
-// models.QueryAllUsers(db, ctx)
-// fmt.Println("All Users queried")
-
-// models.QueryBasicUsers(db, ctx)
-// fmt.Println("Admin Users queried")
-
-// models.QueryUserByEmail(db, ctx)
-// fmt.Println("Basic Users queried")
-
-// e.Start(fmt.Sprintf(":%s", os.Getenv("PORT")))
+package main
+
+import (
+	"3DQuest/api"
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"3DQuest/mqtt"
+	"3DQuest/payment"
+	"3DQuest/shipping"
+	"3DQuest/shipping/fake"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	client, err := dbdriver.CreateClient(&dbdriver.ClientOptions{
+		Scheme:     cfg.CouchDB.Scheme,
+		Host:       cfg.CouchDB.URL,
+		User:       cfg.CouchDB.User,
+		Password:   cfg.CouchDB.Password,
+		AllDBsPath: cfg.CouchDB.AllDBsPath,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't reach CouchDB:", err)
+		os.Exit(1)
+	}
+	db_info, err := dbdriver.ConnectToDB(client, cfg.CouchDB.Database)
+	if err != nil || db_info.Name == "" {
+		fmt.Fprintf(os.Stderr, "Couldn't connect to the database '%s': %v\n", cfg.CouchDB.Database, err)
+		os.Exit(1)
+	}
+	if cfg.CouchDB.Cache {
+		client.Cache = dbdriver.NewDocumentCache(client, &dbdriver.CacheOptions{MaxEntries: cfg.CouchDB.CacheEntries, TTL: cfg.CouchDB.CacheTTL})
+	}
+	client.Schemas = dbdriver.NewSchemaRegistry()
+	if err := models.RegisterSchemas(client.Schemas); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't register the document schemas:", err)
+		os.Exit(1)
+	}
+	if err := models.EnsureIndexes(client); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Couldn't create the database indexes:", err)
+	}
+	if err := models.EnsureViews(client); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Couldn't install the database views:", err)
+	}
+	normalized, err := models.NormalizeUserTypes(client)
+	if normalized > 0 {
+		fmt.Printf("Changed the type of %d users to lowercase\n", normalized)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning:", err)
+	}
+	imported, err := models.ImportLegacyCredits(client)
+	if imported > 0 {
+		fmt.Printf("Moved the credits of %d users into the ledger\n", imported)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Couldn't move the old user credits into the ledger:", err)
+	}
+	if err := models.EnsurePricingRules(client); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Couldn't install the default pricing rules:", err)
+	}
+	if completed, err := models.CompletePendingInvoices(client, &cfg.Invoice); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Couldn't write the invoices left pending:", err)
+	} else if completed > 0 {
+		fmt.Printf("Wrote %d invoices left pending\n", completed)
+	}
+	if cfg.Design.InstallSchemaValidation {
+		// @info Makes CouchDB enforce the same schemas for writes that do not go through this backend
+		if _, err := dbdriver.InstallSchemaValidation(client, client.Schemas, cfg.Design.UserDesignDoc); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: Couldn't install the validate_doc_update function:", err)
+		}
+	}
+
+	printScheduler, err := models.NewPrintScheduler(client, &cfg.Shop)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := printScheduler.Replan(); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Couldn't plan the print queue:", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go printScheduler.Watch(ctx, cfg.Shop.PollInterval)
+	go models.WatchCheckouts(ctx, client, &cfg.Store, time.Minute)
+	if client.Cache != nil {
+		go client.Cache.Watch(ctx) // @info Only returns once ctx is cancelled
+	}
+
+	if cfg.MQTT.Listen != "" {
+		// @info For printers on the local network that have nowhere else to publish
+		broker := mqtt.NewBroker()
+		broker.Username, broker.Password = cfg.MQTT.Username, cfg.MQTT.Password
+		go func() {
+			if err := broker.ListenAndServe(cfg.MQTT.Listen); err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: The MQTT broker stopped:", err)
+			}
+		}()
+		defer broker.Close()
+	}
+	if cfg.MQTT.Broker != "" {
+		go models.NewTelemetryIngester(client, &cfg.MQTT).Run(ctx)
+	}
+
+	var payments payment.Provider
+	if cfg.Payment.Provider != "" {
+		payments, err = payment.New(payment.Kind(cfg.Payment.Provider), cfg.Payment.APIURL, cfg.Payment.SecretKey, cfg.Payment.WebhookSecret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	var carrier shipping.Carrier
+	if cfg.Shipping.Carrier == "fake" {
+		// @info Parcels move on one step every time they are tracked, to try the whole way without a carrier
+		carrier = fake.New(cfg.Shipping.TrackInterval)
+	}
+
+	server := api.NewServer(cfg, client, printScheduler, payments, carrier)
+	if server.Tracker != nil {
+		go server.Tracker.Watch(ctx, cfg.Shipping.TrackInterval)
+	}
+	fmt.Printf("3DQuest @ PORT = %s, DB = %s\n", cfg.Server.Port, db_info.Name)
+	if err := server.Run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
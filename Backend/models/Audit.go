@@ -0,0 +1,109 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"time"
+)
+
+const AuditDocType = "audit"
+
+// @info Append-only record of a sensitive change, e.g. a user's type being changed. Entries are never modified.
+type AuditEntry struct {
+	ID        string      `json:"_id"`
+	Rev       string      `json:"_rev,omitempty"`
+	Type      string      `json:"type" validate:"required"`
+	Action    string      `json:"action" validate:"required"`   // e.g. user.type_changed
+	ActorID   string      `json:"actor_id" validate:"required"` // User who made the change
+	TargetID  string      `json:"target_id"`                    // Document that was changed
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	CreatedAt time.Time   `json:"created_at" validate:"required"`
+}
+
+const (
+	AuditUserTypeChanged    = "user.type_changed"
+	AuditUserCreated        = "user.created"
+	AuditUserUpdated        = "user.updated"
+	AuditUserDeleted        = "user.deleted"
+	AuditPricingPublished   = "pricing.published"
+	AuditPrinterCreated     = "printer.created"
+	AuditPrinterUpdated     = "printer.updated"
+	AuditPrinterStatus      = "printer.status_changed"
+	AuditAlertAcknowledged  = "printer_alert.acknowledged"
+	AuditSpoolCreated       = "spool.created"
+	AuditSpoolUpdated       = "spool.updated"
+	AuditSpoolLoaded        = "spool.loaded"
+	AuditThresholdSet       = "material_threshold.set"
+	AuditThresholdDeleted   = "material_threshold.deleted"
+	AuditProductCreated     = "product.created"
+	AuditProductUpdated     = "product.updated"
+	AuditProductPublished   = "product.published"
+	AuditProductHidden      = "product.unpublished"
+	AuditProductDeleted     = "product.deleted"
+	AuditStockAdjusted      = "product.stock_adjusted"
+	AuditCategorySet        = "category.set"
+	AuditCategoryDeleted    = "category.deleted"
+	AuditCouponSet          = "coupon.set"
+	AuditCouponDeleted      = "coupon.deleted"
+	AuditCheckoutConfirmed  = "checkout.confirmed"
+	AuditCheckoutCancelled  = "checkout.cancelled"
+	AuditPaymentCaptured    = "payment.captured"
+	AuditPaymentRefunded    = "payment.refunded"
+	AuditPaymentsReconciled = "payments.reconciled"
+	AuditInvoiceRectified   = "invoice.rectified"
+	AuditPickupPointSet     = "pickup_point.set"
+	AuditShippingServiceSet = "shipping_service.set"
+	AuditShipmentCreated    = "shipment.created"
+	AuditLabelCreated       = "shipment.label_created"
+	AuditLabelCancelled     = "shipment.label_cancelled"
+	AuditShipmentEvent      = "shipment.event_recorded"
+	AuditShipmentCollected  = "shipment.collected"
+)
+
+// @info Newest first. Needs the audit index, see EnsureIndexes
+var auditSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"created_at": "desc"}}
+
+func RecordAudit(client *dbdriver.CouchDBClient, entry *AuditEntry) error {
+	entry.Type = AuditDocType
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	doc, err := dbdriver.EncodeDocument(entry)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, entry.ID)
+	if err != nil {
+		return err
+	}
+	entry.ID = resp_data.ID
+	entry.Rev = resp_data.REV
+	return nil
+}
+
+// @info Newest entries first. targetID and action are optional filters. Pass the returned bookmark to get the next page.
+func ListAudit(client *dbdriver.CouchDBClient, targetID string, action string, limit uint64, bookmark string) ([]AuditEntry, string, error) {
+	selector := map[string]interface{}{"type": AuditDocType}
+	if targetID != "" {
+		selector["target_id"] = targetID
+	}
+	if action != "" {
+		selector["action"] = action
+	}
+	opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: auditSort}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	entries := []AuditEntry{}
+	if err != nil {
+		return entries, "", err
+	}
+	for _, doc := range found.Docs {
+		entry := AuditEntry{}
+		if err := dbdriver.DecodeDocument(doc, &entry); err != nil {
+			return entries, "", err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, found.Bookmark, nil
+}
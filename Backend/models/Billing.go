@@ -0,0 +1,121 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/taxid"
+	"regexp"
+	str "strings"
+)
+
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	PostalCode string `json:"postal_code"`
+	Province   string `json:"province,omitempty"`
+	Country    string `json:"country"` // ISO 3166-1 alpha-2, e.g. ES
+}
+
+// @info Who invoices are addressed to. Users without one are invoiced with their name and NIF, see BillingParty.
+type BillingProfile struct {
+	LegalName string     `json:"legal_name"`
+	TaxID     string     `json:"tax_id"`      // Normalized, see taxid.Parse
+	TaxIDType taxid.Kind `json:"tax_id_type"` // Filled in from TaxID
+	Address   Address    `json:"address"`
+}
+
+var (
+	countryPattern       = regexp.MustCompile(`^[A-Z]{2}$`)
+	spanishPostalPattern = regexp.MustCompile(`^(0[1-9]|[1-4][0-9]|5[0-2])[0-9]{3}$`)
+)
+
+// @info Normalizes the profile in place and reports every problem at once as a *dbdriver.ValidationError
+func (b *BillingProfile) Validate() error {
+	problems := []dbdriver.FieldError{}
+	fail := func(field string, message string) {
+		problems = append(problems, dbdriver.FieldError{Field: "billing." + field, Message: message})
+	}
+
+	b.LegalName = str.TrimSpace(b.LegalName)
+	if b.LegalName == "" {
+		fail("legal_name", "is required")
+	}
+	if taxID, err := taxid.Parse(b.TaxID); err != nil {
+		fail("tax_id", err.Error())
+	} else {
+		b.TaxID = taxID.Value
+		b.TaxIDType = taxID.Kind
+	}
+
+	addr := &b.Address
+	addr.Country = str.ToUpper(str.TrimSpace(addr.Country))
+	addr.PostalCode = str.ToUpper(str.TrimSpace(addr.PostalCode))
+	if str.TrimSpace(addr.Line1) == "" {
+		fail("address.line1", "is required")
+	}
+	if str.TrimSpace(addr.City) == "" {
+		fail("address.city", "is required")
+	}
+	if !countryPattern.MatchString(addr.Country) {
+		fail("address.country", "must be a two letter country code")
+	}
+	if addr.PostalCode == "" {
+		fail("address.postal_code", "is required")
+	} else if addr.Country == "ES" && !spanishPostalPattern.MatchString(addr.PostalCode) {
+		fail("address.postal_code", "is not a Spanish postal code")
+	}
+
+	if len(problems) > 0 {
+		return &dbdriver.ValidationError{DocType: "user", Fields: problems}
+	}
+	return nil
+}
+
+// @info Billing identity used on invoices: the billing profile if the user has one, or else their name and NIF
+func (u *User) BillingParty() BillingProfile {
+	if u.Billing != nil {
+		return *u.Billing
+	}
+	party := BillingProfile{LegalName: u.Name, TaxID: u.NIF}
+	if taxID, err := taxid.Parse(u.NIF); err == nil {
+		party.TaxIDType = taxID.Kind
+	}
+	return party
+}
+
+// @info Validates and stores the billing profile of a user. A nil profile removes it.
+func SetBillingProfile(client *dbdriver.CouchDBClient, id string, billing *BillingProfile) (*User, error) {
+	if billing != nil {
+		if err := billing.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		userType, _ := doc["type"].(string)
+		if _, deleted := doc["deleted_at"]; deleted || !IsUserType(userType) {
+			return errNotAUser()
+		}
+		if billing == nil {
+			delete(doc, "billing")
+		} else {
+			doc["billing"] = billing
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetUser(client, id)
+}
+
+// @info Users may leave the NIF empty, otherwise it must be a valid tax ID and it is stored normalized
+func normalizeNIF(nif string) (string, error) {
+	if str.TrimSpace(nif) == "" {
+		return "", nil
+	}
+	taxID, err := taxid.Parse(nif)
+	if err != nil {
+		return "", &dbdriver.ValidationError{DocType: "user", Fields: []dbdriver.FieldError{{Field: "nif", Message: err.Error()}}}
+	}
+	return taxID.Value, nil
+}
@@ -0,0 +1,1022 @@
+package models
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	str "strings"
+	"time"
+)
+
+const (
+	CartDocType     = "cart"
+	CheckoutDocType = "checkout"
+)
+
+type CartItemKind string
+
+const (
+	CartProduct  CartItemKind = "product"  // A variant of a product of the store
+	CartPrint    CartItemKind = "print"    // A quoted print order of the customer
+	CartShipping CartItemKind = "shipping" // Delivery of a print order, only in checkout lines, see SetOrderDelivery
+)
+
+type CheckoutStatus string
+
+const (
+	CheckoutAwaitingPayment CheckoutStatus = "awaiting_payment" // Paid outside the backend, waiting to be confirmed
+	CheckoutPaid            CheckoutStatus = "paid"
+	CheckoutCancelled       CheckoutStatus = "cancelled" // Never paid, the stock and the coupon were given back
+)
+
+type PaymentMethod string
+
+const (
+	PaymentCredits  PaymentMethod = "credits"  // Charged to the credits of the customer straight away
+	PaymentExternal PaymentMethod = "external" // Card, transfer... confirmed afterwards, see ConfirmCheckout
+)
+
+var (
+	ErrEmptyCart      = errors.New("The cart is empty")
+	ErrPriceChanged   = errors.New("The total of the cart changed, review it before paying")
+	ErrCheckoutClosed = errors.New("The checkout is no longer awaiting payment")
+)
+
+type CartItem struct {
+	Kind          CartItemKind `json:"kind"`
+	ProductID     string       `json:"product_id,omitempty"`
+	SKU           string       `json:"sku,omitempty"`
+	OrderID       string       `json:"order_id,omitempty"`
+	Quantity      int          `json:"quantity"`                 // Always 1 for print orders, the order has its own quantities
+	ReservedUntil *time.Time   `json:"reserved_until,omitempty"` // Until when the units are kept for the cart
+}
+
+// @info The cart of a customer, or of a visitor who has not logged in yet. Visitors are told a token that identifies
+// their cart, see AnonymousCartID.
+type Cart struct {
+	ID         string     `json:"_id"`
+	Rev        string     `json:"_rev,omitempty"`
+	Type       string     `json:"type" validate:"required"`
+	UserID     string     `json:"user_id,omitempty"` // Empty for visitors
+	Items      []CartItem `json:"items"`
+	CouponCode string     `json:"coupon_code,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // Only for visitors, see STORE_ANONYMOUS_CART_TTL
+	CreatedAt  time.Time  `json:"created_at" validate:"required"`
+	UpdatedAt  time.Time  `json:"updated_at" validate:"required"`
+}
+
+// @info A line of a cart or of a checkout, priced
+type CheckoutLine struct {
+	Kind           CartItemKind `json:"kind"`
+	ProductID      string       `json:"product_id,omitempty"`
+	SKU            string       `json:"sku,omitempty"`
+	OrderID        string       `json:"order_id,omitempty"`
+	Name           string       `json:"name"`
+	Quantity       int          `json:"quantity"`
+	UnitPriceCents int64        `json:"unit_price_cents"` // VAT included
+	VATPercent     float64      `json:"vat_percent"`
+	DiscountCents  int64        `json:"discount_cents"`    // Share of the promotions
+	TotalCents     int64        `json:"total_cents"`       // Quantity × UnitPriceCents - DiscountCents
+	Problem        string       `json:"problem,omitempty"` // Why it can't be bought now, only in carts
+}
+
+// @info A cart with its lines priced as they would be paid now
+type PricedCart struct {
+	*Cart
+	Lines         []CheckoutLine     `json:"lines"`
+	SubtotalCents int64              `json:"subtotal_cents"`
+	Promotions    []AppliedPromotion `json:"promotions"`
+	DiscountCents int64              `json:"discount_cents"`
+	TotalCents    int64              `json:"total_cents"`
+	CouponProblem string             `json:"coupon_problem,omitempty"`
+}
+
+// @info What a customer paid for in one go: the store items, of which it is the order, and their print orders
+type Checkout struct {
+	ID               string             `json:"_id"`
+	Rev              string             `json:"_rev,omitempty"`
+	Type             string             `json:"type" validate:"required"`
+	CustomerID       string             `json:"customer_id" validate:"required"`
+	Status           CheckoutStatus     `json:"status" validate:"required,enum=awaiting_payment|paid|cancelled"`
+	Lines            []CheckoutLine     `json:"lines" validate:"minlen=1"`
+	OrderIDs         []string           `json:"order_ids"` // The print orders among the lines
+	SubtotalCents    int64              `json:"subtotal_cents" validate:"min=0"`
+	DiscountCents    int64              `json:"discount_cents" validate:"min=0"`
+	TotalCents       int64              `json:"total_cents" validate:"min=0"` // VAT included
+	CouponCode       string             `json:"coupon_code,omitempty"`
+	Promotions       []AppliedPromotion `json:"promotions,omitempty"`
+	PaymentMethod    PaymentMethod      `json:"payment_method" validate:"required,enum=credits|external"`
+	PaymentReference string             `json:"payment_reference,omitempty"` // The credit transaction, or the reference of the external payment
+	IdempotencyKey   string             `json:"idempotency_key,omitempty"`
+	InvoiceID        string             `json:"invoice_id,omitempty"` // Of its store items, see IssueInvoice
+	Note             string             `json:"note,omitempty" validate:"maxlen=1024"`
+	CreatedAt        time.Time          `json:"created_at" validate:"required"`
+	PaidAt           *time.Time         `json:"paid_at,omitempty"`
+	CancelledAt      *time.Time         `json:"cancelled_at,omitempty"`
+	ExpiresAt        *time.Time         `json:"expires_at,omitempty"` // While awaiting payment, see ExpireCheckouts
+	UpdatedAt        time.Time          `json:"updated_at" validate:"required"`
+}
+
+// @info What PayCart needs to know. Requests of the same customer with the same IdempotencyKey are only applied once.
+type CheckoutRequest struct {
+	PaymentMethod      PaymentMethod `json:"payment_method"`
+	ExpectedTotalCents *int64        `json:"expected_total_cents"` // The total the customer saw, the checkout is refused if it changed
+	IdempotencyKey     string        `json:"-"`
+}
+
+// @info Filters of ListCheckouts. Empty fields match every checkout.
+type CheckoutFilter struct {
+	CustomerID string
+	Status     CheckoutStatus
+}
+
+var checkoutSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"created_at": "desc"}}
+var customerCheckoutSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"customer_id": "desc"}, map[string]string{"created_at": "desc"}}
+
+// @info The cart of a customer
+func UserCartID(userID string) string {
+	return CartDocType + ":user:" + userID
+}
+
+// @info The cart of a visitor, derived from the token only they hold so it can't be guessed
+func AnonymousCartID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return CartDocType + ":anon:" + hex.EncodeToString(sum[:16])
+}
+
+// @info A token for the cart of a new visitor
+func NewCartToken() (string, error) {
+	buff := make([]byte, 24)
+	if _, err := rand.Read(buff); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buff), nil
+}
+
+func IsPaymentMethod(method PaymentMethod) bool {
+	return method == PaymentCredits || method == PaymentExternal
+}
+
+func IsCheckoutStatus(status CheckoutStatus) bool {
+	return status == CheckoutAwaitingPayment || status == CheckoutPaid || status == CheckoutCancelled
+}
+
+// @info The line of a product variant, -1 if it is not in the cart
+func (c *Cart) productIndex(productID string, sku string) int {
+	for i, item := range c.Items {
+		if item.Kind == CartProduct && item.ProductID == productID && item.SKU == sku {
+			return i
+		}
+	}
+	return -1
+}
+
+// @info The cart with that ID. Carts that do not exist yet, and those of visitors that expired, are empty.
+func GetCart(client *dbdriver.CouchDBClient, id string, userID string) (*Cart, error) {
+	now := time.Now().UTC()
+	cart := &Cart{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if dbdriver.IsNotFound(err) {
+		return &Cart{ID: id, Type: CartDocType, UserID: userID, Items: []CartItem{}, CreatedAt: now, UpdatedAt: now}, nil
+	}
+	if err != nil {
+		return cart, err
+	}
+	if err = dbdriver.DecodeDocument(doc, cart); err != nil {
+		return cart, err
+	}
+	if cart.Type != CartDocType {
+		return cart, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a cart"}
+	}
+	if cart.ExpiresAt != nil && !cart.ExpiresAt.After(now) {
+		// @info Keeps the revision, so the next write replaces the old cart
+		return &Cart{ID: id, Rev: cart.Rev, Type: CartDocType, UserID: userID, Items: []CartItem{}, CreatedAt: now, UpdatedAt: now}, nil
+	}
+	if cart.Items == nil {
+		cart.Items = []CartItem{}
+	}
+	return cart, nil
+}
+
+// @info Puts units of a product variant, or a quoted print order of the customer, in the cart. The units of the cart
+// are kept from other customers for STORE_RESERVATION_TTL.
+// @error ErrOutOfStock if there are not enough units left, or a *dbdriver.ValidationError
+func AddCartItem(client *dbdriver.CouchDBClient, cfg *config.StoreConfig, cartID string, userID string, item CartItem) (*Cart, error) {
+	switch item.Kind {
+	case CartProduct:
+		if item.Quantity < 1 {
+			return nil, &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "quantity", Message: "must be at least 1"}}}
+		}
+		product, err := GetProduct(client, item.ProductID)
+		if dbdriver.IsNotFound(err) || (err == nil && !product.Published) {
+			return nil, &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "product_id", Message: "is not a product of the store"}}}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if product.Variant(item.SKU) == nil {
+			return nil, &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "sku", Message: "is not a variant of the product"}}}
+		}
+		return updateCart(client, cfg, cartID, userID, func(cart *Cart) error {
+			quantity := item.Quantity
+			index := cart.productIndex(item.ProductID, item.SKU)
+			if index >= 0 {
+				quantity += cart.Items[index].Quantity
+			}
+			until := time.Now().UTC().Add(cfg.ReservationTTL)
+			if _, err := reserveStock(client, item.ProductID, item.SKU, cart.ID, quantity, until); err != nil {
+				return err
+			}
+			if index < 0 {
+				cart.Items = append(cart.Items, CartItem{Kind: CartProduct, ProductID: item.ProductID, SKU: item.SKU})
+				index = len(cart.Items) - 1
+			}
+			cart.Items[index].Quantity = quantity
+			cart.Items[index].ReservedUntil = &until
+			return nil
+		})
+	case CartPrint:
+		if userID == "" {
+			return nil, &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "order_id", Message: "log in to pay for print orders"}}}
+		}
+		order, err := GetOrder(client, item.OrderID)
+		if dbdriver.IsNotFound(err) || (err == nil && order.CustomerID != userID) {
+			return nil, &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "order_id", Message: "is not an order of yours"}}}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if order.Status != OrderQuoted || order.CheckoutID != "" {
+			return nil, &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "order_id", Message: "only quoted orders waiting to be paid can be bought"}}}
+		}
+		return updateCart(client, cfg, cartID, userID, func(cart *Cart) error {
+			for _, current := range cart.Items {
+				if current.Kind == CartPrint && current.OrderID == order.ID {
+					return nil
+				}
+			}
+			cart.Items = append(cart.Items, CartItem{Kind: CartPrint, OrderID: order.ID, Quantity: 1})
+			return nil
+		})
+	}
+	return nil, &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "kind", Message: "must be one of product, print"}}}
+}
+
+// @info Changes the units of a line of the cart (counting from 0), keeping them for STORE_RESERVATION_TTL again. Zero
+// removes the line.
+// @error ErrOutOfStock if there are not enough units left, or a *dbdriver.ValidationError
+func SetCartItemQuantity(client *dbdriver.CouchDBClient, cfg *config.StoreConfig, cartID string, userID string, index int, quantity int) (*Cart, error) {
+	return updateCart(client, cfg, cartID, userID, func(cart *Cart) error {
+		if index < 0 || index >= len(cart.Items) {
+			return &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "items", Message: fmt.Sprintf("there is no item %d", index)}}}
+		}
+		item := &cart.Items[index]
+		if quantity <= 0 {
+			if item.Kind == CartProduct {
+				if _, err := reserveStock(client, item.ProductID, item.SKU, cart.ID, 0, time.Time{}); err != nil && !dbdriver.IsNotFound(err) {
+					return err
+				}
+			}
+			cart.Items = append(cart.Items[:index], cart.Items[index+1:]...)
+			return nil
+		}
+		if item.Kind == CartPrint {
+			if quantity != 1 {
+				return &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "quantity", Message: "print orders are bought once, their quantities are in the order"}}}
+			}
+			return nil
+		}
+		until := time.Now().UTC().Add(cfg.ReservationTTL)
+		if _, err := reserveStock(client, item.ProductID, item.SKU, cart.ID, quantity, until); err != nil {
+			return err
+		}
+		item.Quantity = quantity
+		item.ReservedUntil = &until
+		return nil
+	})
+}
+
+// @info Sets the coupon of the cart, or removes it with an empty code. Whether it applies is told when pricing the
+// cart, see PriceCart.
+// @error A *dbdriver.ValidationError if there is no coupon with that code
+func SetCartCoupon(client *dbdriver.CouchDBClient, cfg *config.StoreConfig, cartID string, userID string, code string) (*Cart, error) {
+	code = NormalizeCouponCode(code)
+	if code != "" {
+		if _, err := GetCoupon(client, code); dbdriver.IsNotFound(err) {
+			return nil, &dbdriver.ValidationError{DocType: CartDocType, Fields: []dbdriver.FieldError{{Field: "coupon_code", Message: "is not a coupon"}}}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return updateCart(client, cfg, cartID, userID, func(cart *Cart) error {
+		cart.CouponCode = code
+		return nil
+	})
+}
+
+// @info Moves the cart of a visitor into that of the customer they logged in as, and deletes it. Units already in the
+// customer's cart are added up, as far as the stock allows.
+func MergeCarts(client *dbdriver.CouchDBClient, cfg *config.StoreConfig, token string, userID string) (*Cart, error) {
+	anon, err := GetCart(client, AnonymousCartID(token), "")
+	if err != nil {
+		return nil, err
+	}
+	if len(anon.Items) == 0 && anon.CouponCode == "" {
+		return GetCart(client, UserCartID(userID), userID)
+	}
+	cart, err := updateCart(client, cfg, UserCartID(userID), userID, func(cart *Cart) error {
+		now := time.Now().UTC()
+		until := now.Add(cfg.ReservationTTL)
+		for _, item := range anon.Items {
+			if item.Kind != CartProduct {
+				continue
+			}
+			// @info The units the visitor kept are released first, so the customer's cart can take them
+			product, err := reserveStock(client, item.ProductID, item.SKU, anon.ID, 0, time.Time{})
+			if dbdriver.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			quantity, index := item.Quantity, cart.productIndex(item.ProductID, item.SKU)
+			if index >= 0 {
+				quantity += cart.Items[index].Quantity
+			}
+			if available := product.Available(item.SKU, cart.ID, now); quantity > available {
+				quantity = available
+			}
+			if quantity <= 0 || (index >= 0 && quantity <= cart.Items[index].Quantity) {
+				continue
+			}
+			if _, err := reserveStock(client, item.ProductID, item.SKU, cart.ID, quantity, until); err != nil {
+				return err
+			}
+			if index < 0 {
+				cart.Items = append(cart.Items, CartItem{Kind: CartProduct, ProductID: item.ProductID, SKU: item.SKU})
+				index = len(cart.Items) - 1
+			}
+			cart.Items[index].Quantity = quantity
+			cart.Items[index].ReservedUntil = &until
+		}
+		if cart.CouponCode == "" {
+			cart.CouponCode = anon.CouponCode
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if anon.Rev != "" {
+		if _, err := dbdriver.DeleteDocument(client, anon.ID, anon.Rev); err != nil && !dbdriver.IsNotFound(err) {
+			return cart, err
+		}
+	}
+	return cart, nil
+}
+
+// @info Prices the cart with the current prices of the store and the promotions its customer gets, see
+// EvaluatePromotions. Lines that can't be bought now say why.
+func PriceCart(client *dbdriver.CouchDBClient, cart *Cart) (*PricedCart, error) {
+	now := time.Now().UTC()
+	priced := &PricedCart{Cart: cart, Lines: []CheckoutLine{}, Promotions: []AppliedPromotion{}}
+	defaultVAT := -1.0
+	deliveries := []CheckoutLine{} // @info After the items, so lines keep the index of their item
+	var typeDiscounted int64       // @info Prints quoted with the discount of the customer's type, see EvaluatePromotions
+	for _, item := range cart.Items {
+		line := CheckoutLine{Kind: item.Kind, ProductID: item.ProductID, SKU: item.SKU, OrderID: item.OrderID, Quantity: item.Quantity}
+		discountedForType := false
+		switch item.Kind {
+		case CartProduct:
+			product, err := GetProduct(client, item.ProductID)
+			if err != nil && !dbdriver.IsNotFound(err) {
+				return nil, err
+			}
+			variant := product.Variant(item.SKU)
+			if err != nil || variant == nil || !product.Published {
+				line.Name, line.Problem = item.SKU, "The product is no longer sold"
+				break
+			}
+			line.Name = variantName(product, variant)
+			line.UnitPriceCents, line.VATPercent = variant.PriceCents, product.VATPercent
+			if available := product.Available(item.SKU, cart.ID, now); available < item.Quantity {
+				line.Problem = fmt.Sprintf("Only %d left", available)
+			}
+		case CartPrint:
+			order, err := GetOrder(client, item.OrderID)
+			if err != nil && !dbdriver.IsNotFound(err) {
+				return nil, err
+			}
+			if err != nil {
+				line.Name, line.Problem = item.OrderID, "The order no longer exists"
+				break
+			}
+			line.Name, line.UnitPriceCents = orderName(order), order.TotalCents
+			if order.Quote != nil {
+				line.VATPercent = order.Quote.VATPercent
+				discountedForType = order.Quote.DiscountCents > 0
+			} else {
+				if defaultVAT < 0 {
+					rules, err := GetCurrentPricingRules(client)
+					if err != nil && !dbdriver.IsNotFound(err) {
+						return nil, err
+					}
+					defaultVAT = 0
+					if rules != nil {
+						defaultVAT = rules.Rules.VATPercent
+					}
+				}
+				line.VATPercent = defaultVAT
+			}
+			if order.Status != OrderQuoted || order.CheckoutID != "" {
+				line.Problem = "The order is not waiting to be paid"
+			} else if order.Delivery != nil && order.Delivery.PriceCents > 0 {
+				deliveries = append(deliveries, CheckoutLine{
+					Kind:           CartShipping,
+					OrderID:        order.ID,
+					Name:           deliveryName(client, order.Delivery),
+					Quantity:       1,
+					UnitPriceCents: order.Delivery.PriceCents,
+					VATPercent:     line.VATPercent,
+					TotalCents:     order.Delivery.PriceCents,
+				})
+			}
+		}
+		line.TotalCents = line.UnitPriceCents * int64(line.Quantity)
+		if discountedForType {
+			typeDiscounted += line.TotalCents
+		}
+		priced.SubtotalCents += line.TotalCents
+		priced.Lines = append(priced.Lines, line)
+	}
+	for _, line := range deliveries {
+		priced.SubtotalCents += line.TotalCents
+		priced.Lines = append(priced.Lines, line)
+	}
+	var customer *User
+	if cart.UserID != "" {
+		user, err := GetUser(client, cart.UserID)
+		if err != nil && !dbdriver.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			customer = user
+		}
+	}
+	promotions, err := EvaluatePromotions(client, customer, cart.CouponCode, priced.SubtotalCents, typeDiscounted, now)
+	if err != nil {
+		return nil, err
+	}
+	priced.Promotions, priced.DiscountCents, priced.CouponProblem = promotions.Promotions, promotions.DiscountCents, promotions.CouponProblem
+	spreadDiscount(priced.Lines, priced.SubtotalCents, priced.DiscountCents)
+	priced.TotalCents = priced.SubtotalCents - priced.DiscountCents
+	return priced, nil
+}
+
+// @info Pays for the cart of the customer: takes the units out of the stock, counts a use of its promotions and charges
+// the credits, or waits for the payment. Everything done is undone if a step fails. The print orders of paid
+// checkouts are accepted, and the cart is emptied. A request with the IdempotencyKey of an earlier one answers the
+// checkout of that one, even while it is still being made.
+// @error A *dbdriver.ValidationError listing the lines that can't be bought, ErrEmptyCart, ErrPriceChanged,
+// ErrOutOfStock or ErrInsufficientCredits
+func PayCart(client *dbdriver.CouchDBClient, cfg *config.StoreConfig, customerID string, req *CheckoutRequest) (*Checkout, error) {
+	if !IsPaymentMethod(req.PaymentMethod) {
+		return nil, &dbdriver.ValidationError{DocType: CheckoutDocType, Fields: []dbdriver.FieldError{{Field: "payment_method", Message: "must be one of credits, external"}}}
+	}
+	checkoutID, err := newCheckoutID(customerID, req.IdempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	if req.IdempotencyKey != "" {
+		existing, err := GetCheckout(client, checkoutID)
+		if err == nil || !dbdriver.IsNotFound(err) {
+			return existing, err
+		}
+	}
+	cart, err := GetCart(client, UserCartID(customerID), customerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(cart.Items) == 0 {
+		return nil, ErrEmptyCart
+	}
+	priced, err := PriceCart(client, cart)
+	if err != nil {
+		return nil, err
+	}
+	fields := []dbdriver.FieldError{}
+	for i, line := range priced.Lines {
+		if line.Problem != "" {
+			fields = append(fields, dbdriver.FieldError{Field: fmt.Sprintf("items.%d", i), Message: line.Problem})
+		}
+	}
+	if priced.CouponProblem != "" {
+		fields = append(fields, dbdriver.FieldError{Field: "coupon_code", Message: priced.CouponProblem})
+	}
+	if len(fields) > 0 {
+		return nil, &dbdriver.ValidationError{DocType: CheckoutDocType, Fields: fields}
+	}
+	if req.ExpectedTotalCents != nil && *req.ExpectedTotalCents != priced.TotalCents {
+		return nil, ErrPriceChanged
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(cfg.CheckoutTTL)
+	checkout := &Checkout{
+		ID:             checkoutID,
+		Type:           CheckoutDocType,
+		CustomerID:     customerID,
+		Status:         CheckoutAwaitingPayment,
+		Lines:          priced.Lines,
+		OrderIDs:       []string{},
+		SubtotalCents:  priced.SubtotalCents,
+		DiscountCents:  priced.DiscountCents,
+		TotalCents:     priced.TotalCents,
+		CouponCode:     cart.CouponCode,
+		Promotions:     priced.Promotions,
+		PaymentMethod:  req.PaymentMethod,
+		IdempotencyKey: req.IdempotencyKey,
+		CreatedAt:      now,
+		ExpiresAt:      &expires,
+		UpdatedAt:      now,
+	}
+	// @info Written before anything else: a second request with the same key gets a conflict here and returns the
+	// checkout of the first one, never touching the stock or the credits
+	doc, err := dbdriver.EncodeDocument(checkout)
+	if err != nil {
+		return nil, err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, checkout.ID)
+	if dbdriver.IsConflict(err) {
+		return GetCheckout(client, checkout.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkout.Rev = resp_data.REV
+	undo := []func() error{func() error {
+		_, err := dbdriver.DeleteDocument(client, checkout.ID, checkout.Rev)
+		return err
+	}}
+	rollback := func(err error) (*Checkout, error) {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				fmt.Fprintln(os.Stderr, "Warning: couldn't undo part of the failed checkout", checkout.ID+":", undoErr)
+			}
+		}
+		return nil, err
+	}
+
+	for _, line := range priced.Lines {
+		line := line
+		switch line.Kind {
+		case CartProduct:
+			if _, err := takeStock(client, line.ProductID, line.SKU, cart.ID, line.Quantity); err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, func() error {
+				_, err := AdjustProductStock(client, line.ProductID, line.SKU, line.Quantity)
+				return err
+			})
+		case CartPrint:
+			if err := claimOrder(client, line.OrderID, checkout.ID); err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, func() error { return releaseOrder(client, line.OrderID, checkout.ID) })
+			checkout.OrderIDs = append(checkout.OrderIDs, line.OrderID)
+		}
+	}
+	if len(checkout.Promotions) > 0 {
+		customer, err := GetUser(client, customerID)
+		if err != nil {
+			return rollback(err)
+		}
+		for i := range checkout.Promotions {
+			promotion := &checkout.Promotions[i]
+			if err := redeemPromotion(client, promotion, customer, checkout.SubtotalCents); err != nil {
+				return rollback(err)
+			}
+			undo = append(undo, func() error { return releaseCoupon(client, promotion.Code, customerID) })
+		}
+	}
+	if checkout.PaymentMethod == PaymentCredits {
+		if checkout.TotalCents > 0 {
+			txn, err := PostCreditTransaction(client, &CreditRequest{
+				UserID:         customerID,
+				Kind:           CreditOrderCharge,
+				AmountCents:    -checkout.TotalCents,
+				Description:    "Store checkout",
+				Reference:      checkout.ID,
+				IdempotencyKey: checkout.ID,
+			})
+			if err != nil {
+				return rollback(err)
+			}
+			checkout.PaymentReference = txn.ID
+			undo = append(undo, func() error {
+				_, err := PostCreditTransaction(client, &CreditRequest{
+					UserID:         customerID,
+					Kind:           CreditRefund,
+					AmountCents:    checkout.TotalCents,
+					Description:    "Store checkout that could not be saved",
+					Reference:      checkout.ID,
+					IdempotencyKey: checkout.ID + ":refund",
+				})
+				return err
+			})
+		}
+		checkout.Status = CheckoutPaid
+		checkout.PaidAt = &now
+		checkout.ExpiresAt = nil
+	}
+
+	doc, err = dbdriver.EncodeDocument(checkout)
+	if err != nil {
+		return rollback(err)
+	}
+	resp_data, err = dbdriver.CreateOrModifyDocument(client, &doc, checkout.ID)
+	if err != nil {
+		return rollback(err)
+	}
+	checkout.Rev = resp_data.REV
+
+	if checkout.Status == CheckoutPaid {
+		acceptCheckoutOrders(client, checkout)
+	}
+	_, err = updateCart(client, cfg, cart.ID, customerID, func(cart *Cart) error {
+		cart.Items = []CartItem{}
+		cart.CouponCode = ""
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: couldn't empty the cart of checkout", checkout.ID+":", err)
+	}
+	return checkout, nil
+}
+
+// @info Records the payment of a checkout paid outside the backend and accepts its print orders. Confirming a paid
+// checkout again does nothing.
+// @error ErrCheckoutClosed if it was cancelled
+func ConfirmCheckout(client *dbdriver.CouchDBClient, id string, reference string) (*Checkout, error) {
+	confirmed := false
+	checkout, err := updateCheckout(client, id, func(checkout *Checkout) error {
+		confirmed = false
+		switch checkout.Status {
+		case CheckoutPaid:
+			return nil
+		case CheckoutCancelled:
+			return ErrCheckoutClosed
+		}
+		now := time.Now().UTC()
+		checkout.Status = CheckoutPaid
+		checkout.PaidAt = &now
+		checkout.ExpiresAt = nil
+		checkout.PaymentReference = reference
+		confirmed = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if confirmed {
+		acceptCheckoutOrders(client, checkout)
+	}
+	return checkout, nil
+}
+
+// @info Cancels a checkout that was never paid, giving back its stock, the uses of its promotions and its print orders
+// @error ErrCheckoutClosed if it was paid
+func CancelCheckout(client *dbdriver.CouchDBClient, id string, note string) (*Checkout, error) {
+	checkout, err := updateCheckout(client, id, func(checkout *Checkout) error {
+		if checkout.Status != CheckoutAwaitingPayment {
+			return ErrCheckoutClosed
+		}
+		now := time.Now().UTC()
+		checkout.Status = CheckoutCancelled
+		checkout.CancelledAt = &now
+		checkout.ExpiresAt = nil
+		checkout.Note = note
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// @info The status is written first, so a checkout can't give its stock back twice
+	for _, line := range checkout.Lines {
+		switch line.Kind {
+		case CartProduct:
+			_, err = AdjustProductStock(client, line.ProductID, line.SKU, line.Quantity)
+		case CartPrint:
+			err = releaseOrder(client, line.OrderID, checkout.ID)
+		}
+		if err != nil && !dbdriver.IsNotFound(err) {
+			return checkout, err
+		}
+	}
+	for _, code := range checkout.promotionCodes() {
+		if err := releaseCoupon(client, code, checkout.CustomerID); err != nil && !dbdriver.IsNotFound(err) {
+			return checkout, err
+		}
+	}
+	return checkout, nil
+}
+
+// @info Cancels the checkouts still awaiting payment after their ExpiresAt, see CancelCheckout. Those made before
+// checkouts expired expire cfg.CheckoutTTL after they were made. A checkout whose card payment is authorized is left
+// for the staff to capture it. Returns how many were cancelled.
+func ExpireCheckouts(client *dbdriver.CouchDBClient, cfg *config.StoreConfig, now time.Time) (int, error) {
+	selector := map[string]interface{}{"type": CheckoutDocType, "status": CheckoutAwaitingPayment}
+	expired := 0
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: 200, Bookmark: bookmark}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return expired, err
+		}
+		for _, doc := range found.Docs {
+			checkout := Checkout{}
+			if err := dbdriver.DecodeDocument(doc, &checkout); err != nil {
+				return expired, err
+			}
+			expires := checkout.CreatedAt.Add(cfg.CheckoutTTL)
+			if checkout.ExpiresAt != nil {
+				expires = *checkout.ExpiresAt
+			}
+			if now.Before(expires) {
+				continue
+			}
+			if authorized, err := hasAuthorizedPayment(client, checkout.ID); err != nil || authorized {
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Warning: Couldn't check the payments of checkout", checkout.ID+":", err)
+				}
+				continue
+			}
+			_, err := CancelCheckout(client, checkout.ID, "Not paid in time")
+			switch {
+			case err == nil:
+				expired++
+			case !errors.Is(err, ErrCheckoutClosed): // @info Paid or cancelled meanwhile
+				fmt.Fprintln(os.Stderr, "Warning: Couldn't cancel the expired checkout", checkout.ID+":", err)
+			}
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			return expired, nil
+		}
+		bookmark = found.Bookmark
+	}
+}
+
+// @info Calls ExpireCheckouts every interval until ctx is cancelled
+func WatchCheckouts(ctx context.Context, client *dbdriver.CouchDBClient, cfg *config.StoreConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := ExpireCheckouts(client, cfg, time.Now().UTC()); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: Couldn't cancel the expired checkouts:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func hasAuthorizedPayment(client *dbdriver.CouchDBClient, checkoutID string) (bool, error) {
+	payments, _, err := ListPayments(client, &PaymentFilter{CheckoutID: checkoutID, Status: PaymentAuthorized}, 1, "")
+	return len(payments) > 0, err
+}
+
+// @info Codes of the promotions the checkout used. Checkouts made before promotions only have their coupon.
+func (c *Checkout) promotionCodes() []string {
+	if len(c.Promotions) == 0 && c.CouponCode != "" && c.DiscountCents > 0 {
+		return []string{c.CouponCode}
+	}
+	codes := []string{}
+	for _, promotion := range c.Promotions {
+		codes = append(codes, promotion.Code)
+	}
+	return codes
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no checkout with that ID
+func GetCheckout(client *dbdriver.CouchDBClient, id string) (*Checkout, error) {
+	checkout := &Checkout{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return checkout, err
+	}
+	if err = dbdriver.DecodeDocument(doc, checkout); err != nil {
+		return checkout, err
+	}
+	if checkout.Type != CheckoutDocType {
+		return checkout, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a checkout"}
+	}
+	return checkout, nil
+}
+
+// @info Newest checkouts first. Pass the returned bookmark to get the next page.
+func ListCheckouts(client *dbdriver.CouchDBClient, filter *CheckoutFilter, limit uint64, bookmark string) ([]Checkout, string, error) {
+	selector := map[string]interface{}{"type": CheckoutDocType}
+	sort := checkoutSort
+	if filter.CustomerID != "" {
+		selector["customer_id"] = filter.CustomerID
+		sort = customerCheckoutSort
+	}
+	if filter.Status != "" {
+		selector["status"] = filter.Status
+	}
+	opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: sort}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	checkouts := []Checkout{}
+	if err != nil {
+		return checkouts, "", err
+	}
+	for _, doc := range found.Docs {
+		checkout := Checkout{}
+		if err := dbdriver.DecodeDocument(doc, &checkout); err != nil {
+			return checkouts, "", err
+		}
+		checkouts = append(checkouts, checkout)
+	}
+	return checkouts, found.Bookmark, nil
+}
+
+// @info Checkouts with an idempotency key are named after it and their customer, so CouchDB refuses a second one.
+// The others get a random ID.
+func newCheckoutID(customerID string, idempotencyKey string) (string, error) {
+	if idempotencyKey != "" {
+		sum := sha256.Sum256([]byte(customerID + "\x00" + idempotencyKey))
+		return CheckoutDocType + ":" + hex.EncodeToString(sum[:16]), nil
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return CheckoutDocType + ":" + hex.EncodeToString(id), nil
+}
+
+// @info Marks a quoted order as being paid by the checkout, so no other checkout can take it and the customer can't
+// change it in between
+func claimOrder(client *dbdriver.CouchDBClient, orderID string, checkoutID string) error {
+	_, err := updateOrder(client, orderID, func(order *Order) error {
+		if order.Status != OrderQuoted || (order.CheckoutID != "" && order.CheckoutID != checkoutID) {
+			return &TransitionError{From: order.Status, To: OrderAccepted, Reason: "the order is not waiting to be paid"}
+		}
+		order.CheckoutID = checkoutID
+		return nil
+	})
+	return err
+}
+
+func releaseOrder(client *dbdriver.CouchDBClient, orderID string, checkoutID string) error {
+	_, err := updateOrder(client, orderID, func(order *Order) error {
+		if order.CheckoutID == checkoutID && order.Status == OrderQuoted {
+			order.CheckoutID = ""
+		}
+		return nil
+	})
+	return err
+}
+
+// @info Accepts the print orders of a paid checkout, the only way they are accepted while a checkout holds them. Failures are only logged, the orders
+// are paid and the staff can accept them by hand.
+func acceptCheckoutOrders(client *dbdriver.CouchDBClient, checkout *Checkout) {
+	for _, orderID := range checkout.OrderIDs {
+		_, err := updateOrder(client, orderID, func(order *Order) error {
+			if order.Status != OrderQuoted || order.CheckoutID != checkout.ID {
+				return nil
+			}
+			return order.apply(&OrderTransition{
+				To:         OrderAccepted,
+				Note:       "Paid with checkout " + checkout.ID,
+				Actor:      ActorSystem,
+				ActorID:    checkout.CustomerID,
+				checkoutID: checkout.ID,
+			})
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: couldn't accept order", orderID, "of checkout", checkout.ID+":", err)
+		}
+	}
+}
+
+// @info Shares the discount among the lines in proportion to their totals, the last one taking what rounding leaves
+func spreadDiscount(lines []CheckoutLine, subtotalCents int64, discountCents int64) {
+	left := discountCents
+	for i := range lines {
+		share := left
+		if i < len(lines)-1 && subtotalCents > 0 {
+			share = int64(math.Round(float64(discountCents) * float64(lines[i].TotalCents) / float64(subtotalCents)))
+		}
+		if share > lines[i].TotalCents {
+			share = lines[i].TotalCents
+		}
+		lines[i].DiscountCents = share
+		lines[i].TotalCents -= share
+		left -= share
+	}
+}
+
+// @info Name of the product with what sets the variant apart, e.g. "Dragon (Red, M)"
+func variantName(product *Product, variant *ProductVariant) string {
+	options := []string{}
+	for _, option := range []string{variant.Colour, variant.Size, variant.Material} {
+		if option != "" {
+			options = append(options, option)
+		}
+	}
+	if len(options) == 0 {
+		return product.Name
+	}
+	return product.Name + " (" + str.Join(options, ", ") + ")"
+}
+
+// @info Name of a print order in a cart, after its first item
+func orderName(order *Order) string {
+	if len(order.Items) == 0 {
+		return "Print order"
+	}
+	if len(order.Items) == 1 {
+		return "Print order: " + order.Items[0].Name
+	}
+	return fmt.Sprintf("Print order: %s and %d more", order.Items[0].Name, len(order.Items)-1)
+}
+
+// @info Read-modify-write of a cart, creating it if it does not exist. The expiry of visitors' carts starts again.
+func updateCart(client *dbdriver.CouchDBClient, cfg *config.StoreConfig, id string, userID string, mutate func(cart *Cart) error) (*Cart, error) {
+	for attempt := 0; ; attempt++ {
+		cart, err := GetCart(client, id, userID)
+		if err != nil {
+			return nil, err
+		}
+		if err := mutate(cart); err != nil {
+			return nil, err
+		}
+		now := time.Now().UTC()
+		cart.UpdatedAt = now
+		cart.ExpiresAt = nil
+		if cart.UserID == "" {
+			expires := now.Add(cfg.AnonymousCartTTL)
+			cart.ExpiresAt = &expires
+		}
+		doc, err := dbdriver.EncodeDocument(cart)
+		if err != nil {
+			return nil, err
+		}
+		if cart.Rev == "" {
+			delete(doc, "_rev")
+		}
+		resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, id)
+		if err == nil {
+			cart.Rev = resp_data.REV
+			return cart, nil
+		}
+		if !dbdriver.IsConflict(err) || attempt+1 >= dbdriver.DefaultUpdateAttempts {
+			return nil, err
+		}
+	}
+}
+
+// @info Read-modify-write of a checkout with conflict retries, see dbdriver.UpdateDocument
+func updateCheckout(client *dbdriver.CouchDBClient, id string, mutate func(checkout *Checkout) error) (*Checkout, error) {
+	checkout := &Checkout{}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		checkout = &Checkout{}
+		if err := dbdriver.DecodeDocument(doc, checkout); err != nil {
+			return err
+		}
+		if checkout.Type != CheckoutDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a checkout"}
+		}
+		if err := mutate(checkout); err != nil {
+			return err
+		}
+		checkout.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(checkout)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetCheckout(client, id)
+}
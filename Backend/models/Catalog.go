@@ -0,0 +1,702 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	str "strings"
+	"time"
+)
+
+const (
+	ProductDocType  = "product"
+	CategoryDocType = "category"
+)
+
+type ProductKind string
+
+const (
+	ProductPrinted   ProductKind = "printed" // Printed by the shop, e.g. figures or spare parts
+	ProductFilament  ProductKind = "filament"
+	ProductAccessory ProductKind = "accessory" // Nozzles, build plates, tools...
+)
+
+// @info Largest product image accepted by AddProductImage
+const MaxProductImageBytes = 8 << 20
+
+// @info Image formats accepted for products, by the content type sniffed from the file => extension
+var productImageTypes = map[string]string{"image/jpeg": ".jpg", "image/png": ".png", "image/gif": ".gif", "image/webp": ".webp"}
+
+var (
+	ErrImageTooLarge   = errors.New("The image is larger than 8 MiB")
+	ErrImageType       = errors.New("The image must be a JPEG, PNG, GIF or WebP file")
+	ErrCategoryInUse   = errors.New("The category still has products")
+	ErrProductNotDraft = errors.New("Only unpublished products can be deleted")
+	ErrOutOfStock      = errors.New("Not enough units in stock")
+)
+
+// @info One way a product is sold, e.g. the red one in size M. Products without options have a single variant.
+type ProductVariant struct {
+	SKU        string `json:"sku"`
+	Colour     string `json:"colour,omitempty"`
+	Size       string `json:"size,omitempty"`
+	Material   string `json:"material,omitempty"`
+	PriceCents int64  `json:"price_cents"` // VAT included
+	Stock      int    `json:"stock"`       // Units on the shelf, see AdjustProductStock
+}
+
+// @info Units of a variant kept for a cart until ExpiresAt, see reserveStock
+type StockReservation struct {
+	CartID    string    `json:"cart_id"`
+	SKU       string    `json:"sku"`
+	Quantity  int       `json:"quantity"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ProductImage struct {
+	Name string `json:"name"` // Attachment holding it
+	Alt  string `json:"alt,omitempty"`
+}
+
+// @info Something sold in the store
+type Product struct {
+	ID           string             `json:"_id"`
+	Rev          string             `json:"_rev,omitempty"`
+	Type         string             `json:"type" validate:"required"`
+	Kind         ProductKind        `json:"kind" validate:"required,enum=printed|filament|accessory"`
+	Name         string             `json:"name" validate:"required,minlen=1,maxlen=256"`
+	Description  string             `json:"description,omitempty" validate:"maxlen=8192"`
+	Categories   []string           `json:"categories"` // Slugs, see Category
+	VATPercent   float64            `json:"vat_percent" validate:"min=0,max=100"`
+	Variants     []ProductVariant   `json:"variants" validate:"minlen=1"`
+	Images       []ProductImage     `json:"images"` // The first one is the cover
+	Published    bool               `json:"published"`
+	PublishedAt  *time.Time         `json:"published_at,omitempty"` // Last time it was published
+	Search       string             `json:"search,omitempty"`       // Lowercase text the search matches, set by the backend
+	Reservations []StockReservation `json:"reservations,omitempty"` // Units in carts, expired ones are dropped on the next write
+	CreatedAt    time.Time          `json:"created_at" validate:"required"`
+	UpdatedAt    time.Time          `json:"updated_at" validate:"required"`
+
+	Attachments map[string]dbdriver.Attachment `json:"_attachments,omitempty"` // The images, kept so updates do not drop them
+}
+
+// @info Fields of a product that can be changed with UpdateProduct. Nil fields are left untouched.
+type ProductUpdate struct {
+	Kind        *ProductKind      `json:"kind"`
+	Name        *string           `json:"name"`
+	Description *string           `json:"description"`
+	Categories  *[]string         `json:"categories"`
+	VATPercent  *float64          `json:"vat_percent"`
+	Variants    *[]ProductVariant `json:"variants"`
+}
+
+// @info Filters of ListProducts. Empty fields match every product. The variant filters must all hold for the same
+// variant.
+type ProductFilter struct {
+	Query         string // Words that must all appear in the name, description, categories or variants
+	Category      string
+	Kind          ProductKind
+	Colour        string
+	Size          string
+	Material      string
+	MinPriceCents int64
+	MaxPriceCents int64
+	InStock       bool
+	Published     *bool
+}
+
+// @info A section of the store. Products list the slugs of the categories they are in.
+type Category struct {
+	ID          string    `json:"_id"`
+	Rev         string    `json:"_rev,omitempty"`
+	Type        string    `json:"type" validate:"required"`
+	Slug        string    `json:"slug" validate:"required,minlen=1,maxlen=64,pattern=^[a-z0-9]+(-[a-z0-9]+)*$"`
+	Name        string    `json:"name" validate:"required,minlen=1,maxlen=128"`
+	Description string    `json:"description,omitempty" validate:"maxlen=2048"`
+	Position    int       `json:"position"` // Order in the menu of the store, lowest first
+	UpdatedAt   time.Time `json:"updated_at" validate:"required"`
+}
+
+var productSort = []interface{}{map[string]string{"type": "asc"}, map[string]string{"name": "asc"}}
+
+func categoryID(slug string) string {
+	return CategoryDocType + ":" + slug
+}
+
+func IsProductKind(kind ProductKind) bool {
+	return kind == ProductPrinted || kind == ProductFilament || kind == ProductAccessory
+}
+
+// @info Whether any variant can be bought
+func (p *Product) InStock() bool {
+	for _, variant := range p.Variants {
+		if variant.Stock > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// @info The variant with that SKU, nil if there is none
+func (p *Product) Variant(sku string) *ProductVariant {
+	for i := range p.Variants {
+		if p.Variants[i].SKU == sku {
+			return &p.Variants[i]
+		}
+	}
+	return nil
+}
+
+// @info Units of the variant left for the cart, those in stock minus those other carts keep
+func (p *Product) Available(sku string, cartID string, now time.Time) int {
+	variant := p.Variant(sku)
+	if variant == nil {
+		return 0
+	}
+	available := variant.Stock
+	for _, reservation := range p.Reservations {
+		if reservation.SKU == sku && reservation.CartID != cartID && reservation.ExpiresAt.After(now) {
+			available -= reservation.Quantity
+		}
+	}
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+// @info Drops the expired reservations, those of variants that no longer exist and, if cartID is given, that of the
+// cart for the variant
+func (p *Product) dropReservations(now time.Time, cartID string, sku string) {
+	reservations := []StockReservation{}
+	for _, reservation := range p.Reservations {
+		if !reservation.ExpiresAt.After(now) || p.Variant(reservation.SKU) == nil {
+			continue
+		}
+		if cartID != "" && reservation.CartID == cartID && reservation.SKU == sku {
+			continue
+		}
+		reservations = append(reservations, reservation)
+	}
+	p.Reservations = reservations
+}
+
+// @info Stores a new unpublished product. Products without a VAT rate take the one of the tariffs.
+func CreateProduct(client *dbdriver.CouchDBClient, product *Product) error {
+	now := time.Now().UTC()
+	product.Type = ProductDocType
+	product.Published = false
+	product.PublishedAt = nil
+	product.Images = []ProductImage{}
+	product.Reservations = nil
+	product.Attachments = nil
+	product.CreatedAt = now
+	product.UpdatedAt = now
+	if product.VATPercent == 0 {
+		rules, err := GetCurrentPricingRules(client)
+		if err != nil && !dbdriver.IsNotFound(err) {
+			return err
+		}
+		if rules != nil {
+			product.VATPercent = rules.Rules.VATPercent
+		}
+	}
+	if err := normalizeProduct(client, product); err != nil {
+		return err
+	}
+	doc, err := dbdriver.EncodeDocument(product)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, product.ID)
+	if err != nil {
+		return err
+	}
+	product.ID = resp_data.ID
+	product.Rev = resp_data.REV
+	return nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no product with that ID
+func GetProduct(client *dbdriver.CouchDBClient, id string) (*Product, error) {
+	doc, err := dbdriver.GetDocument(client, id)
+	return decodeProduct(doc, err)
+}
+
+// @info Like GetProduct, but read through the cache of the client, see dbdriver.GetCachedDocument. For lookups only.
+func GetCachedProduct(client *dbdriver.CouchDBClient, id string) (*Product, error) {
+	doc, err := dbdriver.GetCachedDocument(client, id)
+	return decodeProduct(doc, err)
+}
+
+func decodeProduct(doc dbdriver.GenericDocument, err error) (*Product, error) {
+	product := &Product{}
+	if err != nil {
+		return product, err
+	}
+	if err = dbdriver.DecodeDocument(doc, product); err != nil {
+		return product, err
+	}
+	if product.Type != ProductDocType {
+		return product, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a product"}
+	}
+	return product, nil
+}
+
+// @info Products by name. Pass the returned bookmark to get the next page, or a zero limit to get them all.
+func ListProducts(client *dbdriver.CouchDBClient, filter *ProductFilter, limit uint64, bookmark string) ([]Product, string, error) {
+	selector := map[string]interface{}{"type": ProductDocType}
+	if filter.Published != nil {
+		selector["published"] = *filter.Published
+	}
+	if filter.Kind != "" {
+		selector["kind"] = filter.Kind
+	}
+	if filter.Category != "" {
+		selector["categories"] = map[string]interface{}{"$elemMatch": map[string]interface{}{"$eq": filter.Category}}
+	}
+	variant := map[string]interface{}{}
+	if filter.Colour != "" {
+		variant["colour"] = filter.Colour
+	}
+	if filter.Size != "" {
+		variant["size"] = filter.Size
+	}
+	if filter.Material != "" {
+		variant["material"] = filter.Material
+	}
+	price := map[string]interface{}{}
+	if filter.MinPriceCents > 0 {
+		price["$gte"] = filter.MinPriceCents
+	}
+	if filter.MaxPriceCents > 0 {
+		price["$lte"] = filter.MaxPriceCents
+	}
+	if len(price) > 0 {
+		variant["price_cents"] = price
+	}
+	if filter.InStock {
+		variant["stock"] = map[string]interface{}{"$gt": 0}
+	}
+	if len(variant) > 0 {
+		selector["variants"] = map[string]interface{}{"$elemMatch": variant}
+	}
+	// @info Mango has no full text search: every word must be a substring of the search field
+	words := []interface{}{}
+	for _, word := range str.Fields(str.ToLower(filter.Query)) {
+		words = append(words, map[string]interface{}{"search": map[string]interface{}{"$regex": regexp.QuoteMeta(word)}})
+	}
+	if len(words) > 0 {
+		selector["$and"] = words
+	}
+	products := []Product{}
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: productSort}
+		if limit == 0 {
+			opts.Limit = 200
+		}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return products, "", err
+		}
+		for _, doc := range found.Docs {
+			product := Product{}
+			if err := dbdriver.DecodeDocument(doc, &product); err != nil {
+				return products, "", err
+			}
+			products = append(products, product)
+		}
+		if limit > 0 || len(found.Docs) < int(opts.Limit) {
+			return products, found.Bookmark, nil
+		}
+		bookmark = found.Bookmark
+	}
+}
+
+// @info Changes a product. Variants keep the stock they had, matched by SKU, so a sale can't be lost in between;
+// stock is changed with AdjustProductStock and only new variants take the stock sent.
+func UpdateProduct(client *dbdriver.CouchDBClient, id string, update *ProductUpdate) (*Product, error) {
+	return updateProduct(client, id, func(product *Product) error {
+		if update.Kind != nil {
+			product.Kind = *update.Kind
+		}
+		if update.Name != nil {
+			product.Name = *update.Name
+		}
+		if update.Description != nil {
+			product.Description = *update.Description
+		}
+		if update.Categories != nil {
+			product.Categories = *update.Categories
+		}
+		if update.VATPercent != nil {
+			product.VATPercent = *update.VATPercent
+		}
+		if update.Variants != nil {
+			variants := append([]ProductVariant{}, *update.Variants...)
+			for i := range variants {
+				if current := product.Variant(str.TrimSpace(variants[i].SKU)); current != nil {
+					variants[i].Stock = current.Stock
+				}
+			}
+			product.Variants = variants
+			product.dropReservations(time.Now().UTC(), "", "")
+		}
+		return normalizeProduct(client, product)
+	})
+}
+
+// @info Shows the product in the store, or hides it
+func PublishProduct(client *dbdriver.CouchDBClient, id string, published bool) (*Product, error) {
+	return updateProduct(client, id, func(product *Product) error {
+		if published && !product.Published {
+			now := time.Now().UTC()
+			product.PublishedAt = &now
+		}
+		product.Published = published
+		return nil
+	})
+}
+
+// @info Deletes an unpublished product together with its images
+// @error ErrProductNotDraft if it is published
+func DeleteProduct(client *dbdriver.CouchDBClient, id string) (*Product, error) {
+	product, err := GetProduct(client, id)
+	if err != nil {
+		return nil, err
+	}
+	if product.Published {
+		return nil, ErrProductNotDraft
+	}
+	_, err = dbdriver.DeleteDocument(client, product.ID, product.Rev)
+	return product, err
+}
+
+// @info Keeps quantity units of a variant for a cart until the given time, replacing what the cart kept of it. A
+// zero quantity releases them.
+// @error ErrOutOfStock if fewer units are left for the cart
+func reserveStock(client *dbdriver.CouchDBClient, id string, sku string, cartID string, quantity int, until time.Time) (*Product, error) {
+	return updateProduct(client, id, func(product *Product) error {
+		now := time.Now().UTC()
+		product.dropReservations(now, cartID, sku)
+		if quantity <= 0 {
+			return nil
+		}
+		if product.Variant(sku) == nil {
+			return &dbdriver.ValidationError{DocType: ProductDocType, Fields: []dbdriver.FieldError{{Field: "sku", Message: "is not a variant of the product"}}}
+		}
+		if available := product.Available(sku, cartID, now); available < quantity {
+			return fmt.Errorf("%w: %s has only %d left", ErrOutOfStock, sku, available)
+		}
+		product.Reservations = append(product.Reservations, StockReservation{CartID: cartID, SKU: sku, Quantity: quantity, ExpiresAt: until})
+		return nil
+	})
+}
+
+// @info Takes units of a variant sold to a cart out of the stock, together with what the cart kept of it. Units the
+// cart kept count as available even if the reservation expired, as long as no other cart took them in between.
+// @error ErrOutOfStock if fewer units are left for the cart
+func takeStock(client *dbdriver.CouchDBClient, id string, sku string, cartID string, quantity int) (*Product, error) {
+	return updateProduct(client, id, func(product *Product) error {
+		now := time.Now().UTC()
+		variant := product.Variant(sku)
+		if variant == nil {
+			return &dbdriver.ValidationError{DocType: ProductDocType, Fields: []dbdriver.FieldError{{Field: "sku", Message: "is not a variant of the product"}}}
+		}
+		if available := product.Available(sku, cartID, now); available < quantity {
+			return fmt.Errorf("%w: %s has only %d left", ErrOutOfStock, sku, available)
+		}
+		product.dropReservations(now, cartID, sku)
+		variant.Stock -= quantity
+		return nil
+	})
+}
+
+// @info Adds delta units to the stock of a variant, or takes them with a negative delta
+// @error A *dbdriver.ValidationError if the variant does not exist or has fewer units than taken
+func AdjustProductStock(client *dbdriver.CouchDBClient, id string, sku string, delta int) (*Product, error) {
+	return updateProduct(client, id, func(product *Product) error {
+		variant := product.Variant(sku)
+		if variant == nil {
+			return &dbdriver.ValidationError{DocType: ProductDocType, Fields: []dbdriver.FieldError{{Field: "sku", Message: "is not a variant of the product"}}}
+		}
+		if variant.Stock+delta < 0 {
+			return &dbdriver.ValidationError{DocType: ProductDocType, Fields: []dbdriver.FieldError{{Field: "stock", Message: fmt.Sprintf("%s has only %d left", sku, variant.Stock)}}}
+		}
+		variant.Stock += delta
+		return nil
+	})
+}
+
+// @info Stores an image of the product as an attachment, appended to its images. Identical images are stored once,
+// the attachment is named after the hash of the content.
+// @error ErrImageTooLarge or ErrImageType if the image can't be used
+func AddProductImage(client *dbdriver.CouchDBClient, id string, data []byte, alt string) (*Product, error) {
+	if len(data) > MaxProductImageBytes {
+		return nil, ErrImageTooLarge
+	}
+	contentType := http.DetectContentType(data)
+	ext, ok := productImageTypes[contentType]
+	if !ok {
+		return nil, ErrImageType
+	}
+	sum := sha256.Sum256(data)
+	name := productImagePrefix + hex.EncodeToString(sum[:8]) + ext
+	for attempt := 0; ; attempt++ {
+		product, err := GetProduct(client, id)
+		if err != nil {
+			return nil, err
+		}
+		if _, stored := product.Attachments[name]; stored {
+			break
+		}
+		_, err = dbdriver.PutAttachment(client, id, product.Rev, name, contentType, data)
+		if err == nil {
+			break
+		}
+		if !dbdriver.IsConflict(err) || attempt+1 >= dbdriver.DefaultUpdateAttempts {
+			return nil, err
+		}
+	}
+	return updateProduct(client, id, func(product *Product) error {
+		for i, image := range product.Images {
+			if image.Name == name {
+				product.Images[i].Alt = alt
+				return nil
+			}
+		}
+		product.Images = append(product.Images, ProductImage{Name: name, Alt: alt})
+		return nil
+	})
+}
+
+// @info Removes an image of the product and its attachment
+func RemoveProductImage(client *dbdriver.CouchDBClient, id string, name string) (*Product, error) {
+	return updateProduct(client, id, func(product *Product) error {
+		images := []ProductImage{}
+		for _, image := range product.Images {
+			if image.Name != name {
+				images = append(images, image)
+			}
+		}
+		if len(images) == len(product.Images) {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not an image of the product"}
+		}
+		product.Images = images
+		delete(product.Attachments, name)
+		return nil
+	})
+}
+
+// @info Reads an image of the product, returning its content and content type
+func GetProductImage(client *dbdriver.CouchDBClient, product *Product, name string) ([]byte, string, error) {
+	for _, image := range product.Images {
+		if image.Name == name {
+			return dbdriver.GetAttachment(client, product.ID, name)
+		}
+	}
+	return nil, "", &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not an image of the product"}
+}
+
+// @info Attachments holding the images of a product
+const productImagePrefix = "image-"
+
+// @info Creates a category or replaces the one with the same slug
+func SetCategory(client *dbdriver.CouchDBClient, category *Category) error {
+	category.Slug = str.ToLower(str.TrimSpace(category.Slug))
+	category.Name = str.TrimSpace(category.Name)
+	category.ID = categoryID(category.Slug)
+	category.Type = CategoryDocType
+	category.UpdatedAt = time.Now().UTC()
+	doc, err := dbdriver.EncodeDocument(category)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	current, err := dbdriver.GetDocument(client, category.ID)
+	if err == nil {
+		doc["_rev"] = current["_rev"]
+	} else if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, category.ID)
+	if err != nil {
+		return err
+	}
+	category.Rev = resp_data.REV
+	return nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no category with that slug
+func GetCategory(client *dbdriver.CouchDBClient, slug string) (*Category, error) {
+	category := &Category{}
+	doc, err := dbdriver.GetDocument(client, categoryID(slug))
+	if err != nil {
+		return category, err
+	}
+	if err = dbdriver.DecodeDocument(doc, category); err != nil {
+		return category, err
+	}
+	if category.Type != CategoryDocType {
+		return category, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a category"}
+	}
+	return category, nil
+}
+
+// @info Removes a category that no product is in
+// @error ErrCategoryInUse if a product is still in it
+func DeleteCategory(client *dbdriver.CouchDBClient, slug string) (*Category, error) {
+	category, err := GetCategory(client, slug)
+	if err != nil {
+		return nil, err
+	}
+	products, _, err := ListProducts(client, &ProductFilter{Category: category.Slug}, 1, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(products) > 0 {
+		return nil, ErrCategoryInUse
+	}
+	_, err = dbdriver.DeleteDocument(client, category.ID, category.Rev)
+	return category, err
+}
+
+// @info Every category, in the order of the menu
+func ListCategories(client *dbdriver.CouchDBClient) ([]Category, error) {
+	categories := []Category{}
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{Selector: map[string]interface{}{"type": CategoryDocType}, Limit: 200, Bookmark: bookmark}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return categories, err
+		}
+		for _, doc := range found.Docs {
+			category := Category{}
+			if err := dbdriver.DecodeDocument(doc, &category); err != nil {
+				return categories, err
+			}
+			categories = append(categories, category)
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			break
+		}
+		bookmark = found.Bookmark
+	}
+	sort.Slice(categories, func(i, j int) bool {
+		if categories[i].Position != categories[j].Position {
+			return categories[i].Position < categories[j].Position
+		}
+		return categories[i].Name < categories[j].Name
+	})
+	return categories, nil
+}
+
+// @info Read-modify-write of a product with conflict retries, see dbdriver.UpdateDocument
+func updateProduct(client *dbdriver.CouchDBClient, id string, mutate func(product *Product) error) (*Product, error) {
+	product := &Product{}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		product = &Product{}
+		if err := dbdriver.DecodeDocument(doc, product); err != nil {
+			return err
+		}
+		if product.Type != ProductDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a product"}
+		}
+		if err := mutate(product); err != nil {
+			return err
+		}
+		product.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(product)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetProduct(client, id)
+}
+
+// @info Trims the names, checks the variants and categories and fills in the search field
+func normalizeProduct(client *dbdriver.CouchDBClient, product *Product) error {
+	product.Name = str.TrimSpace(product.Name)
+	product.Description = str.TrimSpace(product.Description)
+	if product.Categories == nil {
+		product.Categories = []string{}
+	}
+	if product.Variants == nil {
+		product.Variants = []ProductVariant{}
+	}
+	if product.Images == nil {
+		product.Images = []ProductImage{}
+	}
+	fields := []dbdriver.FieldError{}
+	if !IsProductKind(product.Kind) {
+		fields = append(fields, dbdriver.FieldError{Field: "kind", Message: "must be one of printed, filament, accessory"})
+	}
+	if len(product.Variants) == 0 {
+		fields = append(fields, dbdriver.FieldError{Field: "variants", Message: "must have at least 1 elements"})
+	}
+	skus := map[string]bool{}
+	words := []string{product.Name, product.Description}
+	for i := range product.Variants {
+		variant := &product.Variants[i]
+		variant.SKU = str.TrimSpace(variant.SKU)
+		variant.Colour = str.TrimSpace(variant.Colour)
+		variant.Size = str.TrimSpace(variant.Size)
+		variant.Material = str.TrimSpace(variant.Material)
+		switch {
+		case variant.SKU == "":
+			fields = append(fields, dbdriver.FieldError{Field: fmt.Sprintf("variants.%d.sku", i), Message: "is required"})
+		case skus[variant.SKU]:
+			fields = append(fields, dbdriver.FieldError{Field: fmt.Sprintf("variants.%d.sku", i), Message: "is repeated"})
+		}
+		skus[variant.SKU] = true
+		if variant.PriceCents < 0 {
+			fields = append(fields, dbdriver.FieldError{Field: fmt.Sprintf("variants.%d.price_cents", i), Message: "must not be negative"})
+		}
+		if variant.Stock < 0 {
+			fields = append(fields, dbdriver.FieldError{Field: fmt.Sprintf("variants.%d.stock", i), Message: "must not be negative"})
+		}
+		words = append(words, variant.SKU, variant.Colour, variant.Size, variant.Material)
+	}
+	categories := []string{}
+	seen := map[string]bool{}
+	for _, slug := range product.Categories {
+		slug = str.ToLower(str.TrimSpace(slug))
+		if seen[slug] {
+			continue
+		}
+		seen[slug] = true
+		_, err := GetCategory(client, slug)
+		if dbdriver.IsNotFound(err) {
+			fields = append(fields, dbdriver.FieldError{Field: "categories", Message: fmt.Sprintf("there is no category %q", slug)})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		categories = append(categories, slug)
+		words = append(words, str.ReplaceAll(slug, "-", " ")) // @info The slug, since names can change
+	}
+	product.Categories = categories
+	if len(fields) > 0 {
+		return &dbdriver.ValidationError{DocType: ProductDocType, Fields: fields}
+	}
+	product.Search = str.ToLower(str.Join(str.Fields(str.Join(words, " ")), " "))
+	return nil
+}
@@ -0,0 +1,427 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	str "strings"
+	"time"
+)
+
+const CouponDocType = "coupon"
+
+var ErrCouponUsed = errors.New("Coupons already used can only be deactivated")
+
+type CouponKind string
+
+const (
+	CouponPercent CouponKind = "percent" // PercentOff of the total
+	CouponFixed   CouponKind = "fixed"   // AmountOffCents off the total, never more than it
+)
+
+// @info A discount code customers enter in their cart, or a promotion applied by itself to the carts it can
+type Coupon struct {
+	ID             string         `json:"_id"`
+	Rev            string         `json:"_rev,omitempty"`
+	Type           string         `json:"type" validate:"required"`
+	Code           string         `json:"code" validate:"required,minlen=3,maxlen=32,pattern=^[A-Z0-9_-]+$"` // Uppercase, entered in any case
+	Description    string         `json:"description,omitempty" validate:"maxlen=256"`                       // Shown to customers
+	Kind           CouponKind     `json:"kind" validate:"required,enum=percent|fixed"`
+	PercentOff     float64        `json:"percent_off" validate:"min=0,max=100"`
+	AmountOffCents int64          `json:"amount_off_cents" validate:"min=0"`
+	MinTotalCents  int64          `json:"min_total_cents" validate:"min=0"` // Smallest cart it applies to
+	ValidFrom      *time.Time     `json:"valid_from,omitempty"`
+	ValidUntil     *time.Time     `json:"valid_until,omitempty"`
+	Automatic      bool           `json:"automatic"`                 // Applied without entering the code
+	UserTypes      []string       `json:"user_types,omitempty"`      // Only for customers of these types, e.g. academic. Any if empty
+	FirstOrderOnly bool           `json:"first_order_only"`          // Only for customers who never placed an order
+	Stackable      bool           `json:"stackable"`                 // Adds up with other stackable ones, see EvaluatePromotions
+	MaxUses        int            `json:"max_uses" validate:"min=0"` // Checkouts it can be used in, 0 for no limit
+	MaxUsesPerUser int            `json:"max_uses_per_user" validate:"min=0"`
+	Uses           int            `json:"uses" validate:"min=0"` // Set by the backend
+	Redemptions    map[string]int `json:"redemptions,omitempty"` // Uses by customer, set by the backend
+	Active         bool           `json:"active"`
+	UpdatedBy      string         `json:"updated_by,omitempty"`
+	UpdatedAt      time.Time      `json:"updated_at" validate:"required"`
+}
+
+// @info A promotion given, and what it takes off
+type AppliedPromotion struct {
+	Code          string     `json:"code"`
+	Description   string     `json:"description,omitempty"`
+	Kind          CouponKind `json:"kind"`
+	Automatic     bool       `json:"automatic"`
+	BaseCents     int64      `json:"base_cents"` // What it was taken off, what is left after the stackable ones before it
+	DiscountCents int64      `json:"discount_cents"`
+}
+
+// @info What EvaluatePromotions decides for an amount
+type PromotionResult struct {
+	Promotions    []AppliedPromotion `json:"promotions"`
+	DiscountCents int64              `json:"discount_cents"`
+	CouponProblem string             `json:"coupon_problem,omitempty"` // Why the coupon entered does not apply
+}
+
+func couponID(code string) string {
+	return CouponDocType + ":" + NormalizeCouponCode(code)
+}
+
+func NormalizeCouponCode(code string) string {
+	return str.ToUpper(str.TrimSpace(code))
+}
+
+// @info Why the coupon can't be used by the customer (nil for visitors) on a total of the given cents, empty if it can
+func (c *Coupon) problem(customer *User, firstOrder bool, totalCents int64, now time.Time) string {
+	switch {
+	case !c.Active:
+		return "The coupon is not active"
+	case c.ValidFrom != nil && now.Before(*c.ValidFrom):
+		return "The coupon is not valid yet"
+	case c.ValidUntil != nil && !now.Before(*c.ValidUntil):
+		return "The coupon expired"
+	case c.MaxUses > 0 && c.Uses >= c.MaxUses:
+		return "The coupon was used up"
+	case customer == nil && (len(c.UserTypes) > 0 || c.FirstOrderOnly || c.MaxUsesPerUser > 0):
+		return "Log in to use the coupon"
+	case c.MaxUsesPerUser > 0 && c.Redemptions[customer.ID] >= c.MaxUsesPerUser:
+		return "You already used the coupon as many times as it allows"
+	case len(c.UserTypes) > 0 && !c.forUserType(customer.Type):
+		return "The coupon is not for your type of account"
+	case c.FirstOrderOnly && !firstOrder:
+		return "The coupon is only for a first order"
+	case totalCents < c.MinTotalCents:
+		return fmt.Sprintf("The coupon needs a total of at least %.2f", float64(c.MinTotalCents)/100)
+	}
+	return ""
+}
+
+func (c *Coupon) forUserType(userType string) bool {
+	for _, allowed := range c.UserTypes {
+		if allowed == userType {
+			return true
+		}
+	}
+	return false
+}
+
+// @info Discount of the coupon on the given cents, never more than them
+func (c *Coupon) discountOn(cents int64) int64 {
+	discount := c.AmountOffCents
+	if c.Kind == CouponPercent {
+		discount = int64(math.Round(float64(cents) * c.PercentOff / 100))
+	}
+	if discount > cents {
+		discount = cents
+	}
+	return discount
+}
+
+// @info Decides the promotions a customer (nil for visitors) gets on a total of the given cents, VAT included, with
+// the coupon they entered if any. Every automatic promotion they can use is considered together with the coupon.
+// Stackable promotions add up, percentages first, each taken off what the ones before left; one that is not stackable
+// only applies alone. The customer gets whichever gives the larger discount.
+// typeDiscountedCents is the part of the total priced with the discount of the customer's type in the tariffs
+// (quote.Rules.Discounts). Promotions limited to user types are not taken off that part, so a type is discounted once.
+func EvaluatePromotions(client *dbdriver.CouchDBClient, customer *User, couponCode string, totalCents int64, typeDiscountedCents int64, now time.Time) (*PromotionResult, error) {
+	result := &PromotionResult{Promotions: []AppliedPromotion{}}
+	candidates, err := findCoupons(client, map[string]interface{}{"type": CouponDocType, "automatic": true, "active": true})
+	if err != nil {
+		return nil, err
+	}
+	couponCode = NormalizeCouponCode(couponCode)
+	if couponCode != "" {
+		coupon, err := GetCoupon(client, couponCode)
+		switch {
+		case dbdriver.IsNotFound(err):
+			result.CouponProblem = "The coupon no longer exists"
+		case err != nil:
+			return nil, err
+		case !coupon.Automatic || !coupon.Active:
+			candidates = append(candidates, *coupon)
+		}
+	}
+
+	firstOrder, checked := false, false
+	usable := []Coupon{}
+	for _, coupon := range candidates {
+		if coupon.FirstOrderOnly && customer != nil && !checked {
+			placed, err := placedOrder(client, customer.ID)
+			if err != nil {
+				return nil, err
+			}
+			firstOrder, checked = !placed, true
+		}
+		problem := coupon.problem(customer, firstOrder, totalCents, now)
+		if problem == "" && len(coupon.UserTypes) > 0 && typeDiscountedCents >= totalCents {
+			problem = "The coupon is not for prices already discounted for your type of account"
+		}
+		if problem != "" {
+			if coupon.Code == couponCode {
+				result.CouponProblem = problem
+			}
+			continue
+		}
+		usable = append(usable, coupon)
+	}
+	result.Promotions = choosePromotions(usable, totalCents, typeDiscountedCents)
+	applied := false
+	for _, promotion := range result.Promotions {
+		result.DiscountCents += promotion.DiscountCents
+		applied = applied || promotion.Code == couponCode
+	}
+	if couponCode != "" && result.CouponProblem == "" && !applied {
+		result.CouponProblem = "The coupon can't be combined with a better promotion"
+	}
+	return result, nil
+}
+
+// @info The stackable promotions together or the best one that is not stackable, whichever takes more off
+func choosePromotions(usable []Coupon, totalCents int64, typeDiscountedCents int64) []AppliedPromotion {
+	sort.Slice(usable, func(i, j int) bool {
+		if usable[i].Kind != usable[j].Kind {
+			return usable[i].Kind == CouponPercent
+		}
+		return usable[i].Code < usable[j].Code
+	})
+	// @info What a promotion is taken off out of the cents left: those for user types leave out the share of them the
+	// tariffs already discounted for the type
+	base := func(coupon *Coupon, left int64) int64 {
+		if len(coupon.UserTypes) == 0 || typeDiscountedCents <= 0 || totalCents <= 0 {
+			return left
+		}
+		return left - int64(math.Round(float64(left)*float64(typeDiscountedCents)/float64(totalCents)))
+	}
+	stacked := []AppliedPromotion{}
+	left := totalCents
+	var best *AppliedPromotion
+	for i := range usable {
+		coupon := &usable[i]
+		if coupon.Stackable {
+			if discount := coupon.discountOn(base(coupon, left)); discount > 0 {
+				stacked = append(stacked, coupon.applied(base(coupon, left), discount))
+				left -= discount
+			}
+			continue
+		}
+		if discount := coupon.discountOn(base(coupon, totalCents)); discount > 0 && (best == nil || discount > best.DiscountCents) {
+			promotion := coupon.applied(base(coupon, totalCents), discount)
+			best = &promotion
+		}
+	}
+	if best != nil && best.DiscountCents > totalCents-left {
+		return []AppliedPromotion{*best}
+	}
+	return stacked
+}
+
+func (c *Coupon) applied(baseCents int64, discountCents int64) AppliedPromotion {
+	return AppliedPromotion{Code: c.Code, Description: c.Description, Kind: c.Kind, Automatic: c.Automatic, BaseCents: baseCents, DiscountCents: discountCents}
+}
+
+// @info Whether the customer already paid, or is paying, for an order or store items
+func placedOrder(client *dbdriver.CouchDBClient, customerID string) (bool, error) {
+	selectors := []map[string]interface{}{
+		{"type": CheckoutDocType, "customer_id": customerID, "status": map[string]interface{}{"$ne": CheckoutCancelled}},
+		{"type": OrderDocType, "customer_id": customerID, "status_times." + string(OrderAccepted): map[string]interface{}{"$exists": true}},
+	}
+	for _, selector := range selectors {
+		found, err := dbdriver.FindInDatabase(client, &dbdriver.FindOptions{Selector: selector, Limit: 1})
+		if err != nil {
+			return false, err
+		}
+		if len(found.Docs) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// @info Creates a coupon or replaces the one with the same code, keeping how many times and by whom it was used. First
+// order promotions are used once by each customer.
+func SetCoupon(client *dbdriver.CouchDBClient, coupon *Coupon) error {
+	coupon.Code = NormalizeCouponCode(coupon.Code)
+	coupon.ID = couponID(coupon.Code)
+	coupon.Type = CouponDocType
+	coupon.Description = str.TrimSpace(coupon.Description)
+	coupon.UpdatedAt = time.Now().UTC()
+	fields := []dbdriver.FieldError{}
+	if coupon.Kind == CouponPercent && !(coupon.PercentOff > 0) {
+		fields = append(fields, dbdriver.FieldError{Field: "percent_off", Message: "must be positive"})
+	}
+	if coupon.Kind == CouponFixed && coupon.AmountOffCents <= 0 {
+		fields = append(fields, dbdriver.FieldError{Field: "amount_off_cents", Message: "must be positive"})
+	}
+	if coupon.ValidFrom != nil && coupon.ValidUntil != nil && !coupon.ValidFrom.Before(*coupon.ValidUntil) {
+		fields = append(fields, dbdriver.FieldError{Field: "valid_until", Message: "must be after valid_from"})
+	}
+	for i, userType := range coupon.UserTypes {
+		coupon.UserTypes[i] = str.ToLower(str.TrimSpace(userType))
+		if !IsUserType(coupon.UserTypes[i]) {
+			fields = append(fields, dbdriver.FieldError{Field: "user_types", Message: fmt.Sprintf("'%s' is not a user type", userType)})
+		}
+	}
+	if len(fields) > 0 {
+		return &dbdriver.ValidationError{DocType: CouponDocType, Fields: fields}
+	}
+	if coupon.FirstOrderOnly && coupon.MaxUsesPerUser == 0 {
+		coupon.MaxUsesPerUser = 1
+	}
+	coupon.Uses, coupon.Redemptions = 0, nil
+	current, err := GetCoupon(client, coupon.Code)
+	if err == nil {
+		coupon.Uses, coupon.Redemptions = current.Uses, current.Redemptions
+	} else if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	doc, err := dbdriver.EncodeDocument(coupon)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	if current.Rev != "" {
+		doc["_rev"] = current.Rev // @info A checkout using the coupon in between makes this fail with a 409
+	}
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, coupon.ID)
+	if err != nil {
+		return err
+	}
+	coupon.Rev = resp_data.REV
+	return nil
+}
+
+// @info Deletes a coupon that was never used. Used ones are kept, so their limits hold if they are created again.
+// @error ErrCouponUsed
+func DeleteCoupon(client *dbdriver.CouchDBClient, code string) (*Coupon, error) {
+	coupon, err := GetCoupon(client, code)
+	if err != nil {
+		return nil, err
+	}
+	if coupon.Uses > 0 {
+		return nil, ErrCouponUsed
+	}
+	_, err = dbdriver.DeleteDocument(client, coupon.ID, coupon.Rev)
+	return coupon, err
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no coupon with that code
+func GetCoupon(client *dbdriver.CouchDBClient, code string) (*Coupon, error) {
+	coupon := &Coupon{}
+	doc, err := dbdriver.GetDocument(client, couponID(code))
+	if err != nil {
+		return coupon, err
+	}
+	if err = dbdriver.DecodeDocument(doc, coupon); err != nil {
+		return coupon, err
+	}
+	if coupon.Type != CouponDocType {
+		return coupon, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a coupon"}
+	}
+	return coupon, nil
+}
+
+// @info Every coupon, by code
+func ListCoupons(client *dbdriver.CouchDBClient) ([]Coupon, error) {
+	coupons, err := findCoupons(client, map[string]interface{}{"type": CouponDocType})
+	if err != nil {
+		return coupons, err
+	}
+	sort.Slice(coupons, func(i, j int) bool { return coupons[i].Code < coupons[j].Code })
+	return coupons, nil
+}
+
+func findCoupons(client *dbdriver.CouchDBClient, selector map[string]interface{}) ([]Coupon, error) {
+	coupons := []Coupon{}
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: 200, Bookmark: bookmark}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return coupons, err
+		}
+		for _, doc := range found.Docs {
+			coupon := Coupon{}
+			if err := dbdriver.DecodeDocument(doc, &coupon); err != nil {
+				return coupons, err
+			}
+			coupons = append(coupons, coupon)
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			break
+		}
+		bookmark = found.Bookmark
+	}
+	return coupons, nil
+}
+
+// @info Counts a use of a promotion by the customer on a total of the given cents. The use is counted on the coupon
+// document itself, so MaxUses and MaxUsesPerUser hold under concurrent checkouts. Whether it is a first order was
+// checked when the promotion was chosen.
+// @error A *dbdriver.ValidationError if the promotion no longer applies, ErrPriceChanged if its discount changed
+func redeemPromotion(client *dbdriver.CouchDBClient, promotion *AppliedPromotion, customer *User, totalCents int64) error {
+	_, err := updateCoupon(client, promotion.Code, func(coupon *Coupon) error {
+		if problem := coupon.problem(customer, true, totalCents, time.Now().UTC()); problem != "" {
+			return &dbdriver.ValidationError{DocType: CouponDocType, Fields: []dbdriver.FieldError{{Field: "coupon_code", Message: problem}}}
+		}
+		if coupon.discountOn(promotion.BaseCents) != promotion.DiscountCents {
+			return ErrPriceChanged // @info The coupon was changed in between
+		}
+		coupon.Uses++
+		if coupon.Redemptions == nil {
+			coupon.Redemptions = map[string]int{}
+		}
+		coupon.Redemptions[customer.ID]++
+		return nil
+	})
+	return err
+}
+
+// @info Gives back a use of the coupon by the customer, when the checkout it was used in did not go ahead
+func releaseCoupon(client *dbdriver.CouchDBClient, code string, customerID string) error {
+	_, err := updateCoupon(client, code, func(coupon *Coupon) error {
+		if coupon.Uses > 0 {
+			coupon.Uses--
+		}
+		if coupon.Redemptions[customerID] > 1 {
+			coupon.Redemptions[customerID]--
+		} else {
+			delete(coupon.Redemptions, customerID)
+		}
+		return nil
+	})
+	return err
+}
+
+// @info Read-modify-write of a coupon with conflict retries, see dbdriver.UpdateDocument
+func updateCoupon(client *dbdriver.CouchDBClient, code string, mutate func(coupon *Coupon) error) (*Coupon, error) {
+	coupon := &Coupon{}
+	_, err := dbdriver.UpdateDocument(client, couponID(code), func(doc dbdriver.GenericDocument) error {
+		coupon = &Coupon{}
+		if err := dbdriver.DecodeDocument(doc, coupon); err != nil {
+			return err
+		}
+		if coupon.Type != CouponDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a coupon"}
+		}
+		if err := mutate(coupon); err != nil {
+			return err
+		}
+		coupon.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(coupon)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetCoupon(client, code)
+}
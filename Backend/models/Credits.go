@@ -0,0 +1,344 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	str "strings"
+	"time"
+)
+
+const CreditTransactionDocType = "credit_transaction"
+
+type CreditKind string
+
+const (
+	CreditTopUp       CreditKind = "top_up"        // Credits bought by the user
+	CreditOrderCharge CreditKind = "order_charge"  // Credits spent on an order
+	CreditRefund      CreditKind = "refund"        // Credits given back for an order
+	CreditAdjustment  CreditKind = "adjustment"    // Manual correction made by an admin, either way
+	CreditPromotion   CreditKind = "promotion"     // Credits given away
+	CreditTopUpRefund CreditKind = "top_up_refund" // Credits taken back because the payment that bought them was refunded
+)
+
+// @info Accounts on the other side of the users' own accounts (see UserAccount). Every transaction moves credits
+// between the user's account and one of these, so the balances of all accounts always add up to zero.
+const (
+	AccountPayments    = "external:payments"
+	AccountSales       = "revenue:orders"
+	AccountAdjustments = "equity:adjustments"
+	AccountPromotions  = "expense:promotions"
+)
+
+var counterAccounts = map[CreditKind]string{
+	CreditTopUp:       AccountPayments,
+	CreditOrderCharge: AccountSales,
+	CreditRefund:      AccountSales,
+	CreditAdjustment:  AccountAdjustments,
+	CreditPromotion:   AccountPromotions,
+	CreditTopUpRefund: AccountPayments,
+}
+
+var (
+	ErrInsufficientCredits = errors.New("Not enough credits")
+	ErrIdempotencyMismatch = errors.New("The idempotency key was already used for a different transaction")
+	ErrInvalidCredits      = errors.New("Invalid credit transaction")
+)
+
+type LedgerEntry struct {
+	Account     string `json:"account"`
+	AmountCents int64  `json:"amount_cents"` // Positive credits the account, negative debits it
+}
+
+// @info Append-only record of a change of a user's credits. Transactions are never modified nor deleted, mistakes are
+// fixed with a new adjustment. 100 cents make one credit (one euro).
+// The ID is derived from the user and Sequence, so two concurrent transactions of the same user can't both be written
+// (see PostCreditTransaction), which keeps BalanceAfterCents exact and the balance from going negative.
+type CreditTransaction struct {
+	ID                string        `json:"_id"`
+	Rev               string        `json:"_rev,omitempty"`
+	Type              string        `json:"type" validate:"required"`
+	UserID            string        `json:"user_id" validate:"required"`
+	Sequence          int64         `json:"sequence" validate:"required,min=1"`
+	Kind              CreditKind    `json:"kind" validate:"required,enum=top_up|order_charge|refund|adjustment|promotion|top_up_refund"`
+	AmountCents       int64         `json:"amount_cents" validate:"required"` // Change of the user's balance
+	BalanceAfterCents int64         `json:"balance_after_cents" validate:"min=0"`
+	Entries           []LedgerEntry `json:"entries" validate:"required,minlen=2"`
+	Description       string        `json:"description,omitempty" validate:"maxlen=512"`
+	Reference         string        `json:"reference,omitempty"` // e.g. the order or payment behind it
+	IdempotencyKey    string        `json:"idempotency_key,omitempty"`
+	ActorID           string        `json:"actor_id,omitempty"` // Who made it, empty if made by the system
+	CreatedAt         time.Time     `json:"created_at" validate:"required"`
+}
+
+// @info What PostCreditTransaction needs to know. Requests with the same UserID and IdempotencyKey are only applied once.
+type CreditRequest struct {
+	UserID         string     `json:"-"`
+	Kind           CreditKind `json:"kind"`
+	AmountCents    int64      `json:"amount_cents"`
+	Description    string     `json:"description"`
+	Reference      string     `json:"reference"`
+	IdempotencyKey string     `json:"-"`
+	ActorID        string     `json:"-"`
+}
+
+type AccountBalance struct {
+	Account      string `json:"account"`
+	BalanceCents int64  `json:"balance_cents"`
+	Transactions int64  `json:"transactions"`
+}
+
+// @info The account of a user in the ledger
+func UserAccount(userID string) string {
+	return "user:" + userID
+}
+
+var creditSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"user_id": "desc"}, map[string]string{"sequence": "desc"}}
+
+func (r *CreditRequest) check() error {
+	if _, ok := counterAccounts[r.Kind]; !ok {
+		return fmt.Errorf("%w: unknown kind '%s'", ErrInvalidCredits, r.Kind)
+	}
+	switch {
+	case r.AmountCents == 0:
+		return fmt.Errorf("%w: the amount can't be zero", ErrInvalidCredits)
+	case (r.Kind == CreditOrderCharge || r.Kind == CreditTopUpRefund) && r.AmountCents > 0:
+		return fmt.Errorf("%w: a %s must be negative", ErrInvalidCredits, r.Kind)
+	case r.Kind != CreditOrderCharge && r.Kind != CreditTopUpRefund && r.Kind != CreditAdjustment && r.AmountCents < 0:
+		return fmt.Errorf("%w: a %s must be positive", ErrInvalidCredits, r.Kind)
+	}
+	return nil
+}
+
+// @info Applies a credit transaction to the user's balance and returns it. If a transaction with the same idempotency
+// key was already posted for the user it is returned instead, as long as it was for the same kind and amount.
+// @error ErrInvalidCredits, ErrInsufficientCredits if the balance would become negative, ErrIdempotencyMismatch, or a
+// *dbdriver.CouchDBError
+func PostCreditTransaction(client *dbdriver.CouchDBClient, req *CreditRequest) (*CreditTransaction, error) {
+	if err := req.check(); err != nil {
+		return nil, err
+	}
+	usr, err := GetUser(client, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if usr.IsDeleted() {
+		return nil, errNotAUser()
+	}
+
+	account := UserAccount(req.UserID)
+	for attempt := 0; attempt < dbdriver.DefaultUpdateAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt*10+rand.Intn(25)) * time.Millisecond)
+		}
+		if req.IdempotencyKey != "" {
+			existing, err := findCreditTransaction(client, req.UserID, req.IdempotencyKey)
+			if err != nil {
+				return nil, err
+			}
+			if existing != nil {
+				if existing.Kind != req.Kind || existing.AmountCents != req.AmountCents {
+					return nil, ErrIdempotencyMismatch
+				}
+				return existing, nil
+			}
+		}
+
+		balance, err := GetAccountBalance(client, account)
+		if err != nil {
+			return nil, err
+		}
+		if req.AmountCents < 0 && balance.BalanceCents+req.AmountCents < 0 {
+			return nil, ErrInsufficientCredits
+		}
+		sequence := balance.Transactions + 1
+		txn := &CreditTransaction{
+			ID:                fmt.Sprintf("%s:%s:%010d", CreditTransactionDocType, req.UserID, sequence),
+			Type:              CreditTransactionDocType,
+			UserID:            req.UserID,
+			Sequence:          sequence,
+			Kind:              req.Kind,
+			AmountCents:       req.AmountCents,
+			BalanceAfterCents: balance.BalanceCents + req.AmountCents,
+			Entries: []LedgerEntry{
+				{Account: account, AmountCents: req.AmountCents},
+				{Account: counterAccounts[req.Kind], AmountCents: -req.AmountCents},
+			},
+			Description:    req.Description,
+			Reference:      req.Reference,
+			IdempotencyKey: req.IdempotencyKey,
+			ActorID:        req.ActorID,
+			CreatedAt:      time.Now().UTC(),
+		}
+		doc, err := dbdriver.EncodeDocument(txn)
+		if err != nil {
+			return nil, err
+		}
+		delete(doc, "_rev")
+		resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, txn.ID)
+		if dbdriver.IsConflict(err) {
+			continue // @info Someone else posted a transaction of this user in between, start over
+		}
+		if err != nil {
+			return nil, err
+		}
+		txn.Rev = resp_data.REV
+		return txn, nil
+	}
+	return nil, &dbdriver.CouchDBError{StatusCode: 409, ErrorName: "conflict", Reason: "too many concurrent credit transactions"}
+}
+
+// @info Current balance of any account, from the reduce of the credits balances view
+func GetAccountBalance(client *dbdriver.CouchDBClient, account string) (*AccountBalance, error) {
+	balances, err := readBalances(client, account)
+	if err != nil || len(balances) == 0 {
+		return &AccountBalance{Account: account}, err
+	}
+	return &balances[0], nil
+}
+
+func GetCreditBalance(client *dbdriver.CouchDBClient, userID string) (int64, error) {
+	balance, err := GetAccountBalance(client, UserAccount(userID))
+	return balance.BalanceCents, err
+}
+
+// @info Balance of every account. Since every transaction is balanced, they always add up to zero.
+func ListAccountBalances(client *dbdriver.CouchDBClient) ([]AccountBalance, error) {
+	return readBalances(client, "")
+}
+
+// @info Reads the balances view grouped by account, only for the given account unless it is empty
+func readBalances(client *dbdriver.CouchDBClient, account string) ([]AccountBalance, error) {
+	balances := []AccountBalance{}
+	opts := dbdriver.CreateDesignViewOptions()
+	opts.Group = true
+	if account != "" {
+		key, err := json.Marshal(account)
+		if err != nil {
+			return balances, err
+		}
+		opts.Key = string(key)
+	}
+	reader, err := dbdriver.StreamDesignView(client, creditsDesignDoc, creditBalancesView, opts)
+	if err != nil {
+		return balances, err
+	}
+	defer reader.Close()
+	for reader.Next() {
+		row := struct {
+			Key   string `json:"key"`
+			Value struct {
+				Sum   float64 `json:"sum"`
+				Count int64   `json:"count"`
+			} `json:"value"`
+		}{}
+		if err := reader.Scan(&row); err != nil {
+			return balances, err
+		}
+		balances = append(balances, AccountBalance{Account: row.Key, BalanceCents: int64(math.Round(row.Value.Sum)), Transactions: row.Value.Count})
+	}
+	return balances, reader.Err()
+}
+
+// @info Statement of a user, newest transactions first. Pass the returned bookmark to get the next page.
+func ListCreditTransactions(client *dbdriver.CouchDBClient, userID string, limit uint64, bookmark string) ([]CreditTransaction, string, error) {
+	opts := &dbdriver.FindOptions{
+		Selector: map[string]interface{}{"type": CreditTransactionDocType, "user_id": userID},
+		Limit:    limit,
+		Bookmark: bookmark,
+		Sort:     creditSort,
+	}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	txns := []CreditTransaction{}
+	if err != nil {
+		return txns, "", err
+	}
+	for _, doc := range found.Docs {
+		txn := CreditTransaction{}
+		if err := dbdriver.DecodeDocument(doc, &txn); err != nil {
+			return txns, "", err
+		}
+		txns = append(txns, txn)
+	}
+	return txns, found.Bookmark, nil
+}
+
+func findCreditTransaction(client *dbdriver.CouchDBClient, userID string, idempotencyKey string) (*CreditTransaction, error) {
+	opts := &dbdriver.FindOptions{
+		Selector: map[string]interface{}{"type": CreditTransactionDocType, "user_id": userID, "idempotency_key": idempotencyKey},
+		Limit:    1,
+	}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	if err != nil || len(found.Docs) == 0 {
+		return nil, err
+	}
+	txn := &CreditTransaction{}
+	err = dbdriver.DecodeDocument(found.Docs[0], txn)
+	return txn, err
+}
+
+// @info Moves the balances of the old `credits` field of the users into the ledger as adjustments, and removes the
+// field. Safe to run on every startup, users are only imported once. Returns how many users were imported.
+// The field is only removed once its balance is in the ledger. Users whose balance can't be posted (deleted users, or
+// a negative balance, which the ledger never allows) keep it, and are reported in the error on every startup until
+// the staff settle them by hand. A user whose field can't be removed is reported too, without stopping the import.
+func ImportLegacyCredits(client *dbdriver.CouchDBClient) (int, error) {
+	imported := 0
+	kept := []string{}
+	problems := []string{}
+	for {
+		selector := map[string]interface{}{"type": map[string]interface{}{"$in": UserTypes}, "credits": map[string]interface{}{"$exists": true}}
+		if len(kept) > 0 {
+			selector["_id"] = map[string]interface{}{"$nin": kept}
+		}
+		found, err := dbdriver.FindInDatabase(client, &dbdriver.FindOptions{Selector: selector, Limit: 100})
+		if err != nil {
+			return imported, err
+		}
+		if len(found.Docs) == 0 {
+			break
+		}
+		for _, doc := range found.Docs {
+			id, _ := doc["_id"].(string)
+			credits, _ := doc["credits"].(float64)
+			cents := int64(math.Round(credits * 100))
+			if cents < 0 {
+				kept = append(kept, id)
+				problems = append(problems, fmt.Sprintf("%s has a negative balance of %d cents", id, cents))
+				continue
+			}
+			if cents > 0 {
+				req := &CreditRequest{
+					UserID:         id,
+					Kind:           CreditAdjustment,
+					AmountCents:    cents,
+					Description:    "Balance before the credits ledger",
+					IdempotencyKey: "legacy-credits",
+				}
+				if _, err := PostCreditTransaction(client, req); err != nil {
+					kept = append(kept, id)
+					problems = append(problems, fmt.Sprintf("%s: %v", id, err))
+					continue
+				}
+			}
+			_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+				delete(doc, "credits")
+				return nil
+			})
+			if err != nil {
+				// @info Its balance is in the ledger already, the next run finds the transaction and only removes the field
+				kept = append(kept, id)
+				problems = append(problems, fmt.Sprintf("%s: couldn't remove the old field: %v", id, err))
+				continue
+			}
+			imported++
+		}
+	}
+	if len(problems) > 0 {
+		return imported, fmt.Errorf("Kept the old credits of %d users out of the ledger: %s", len(problems), str.Join(problems, "; "))
+	}
+	return imported, nil
+}
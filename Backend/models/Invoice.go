@@ -0,0 +1,885 @@
+package models
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/quote"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	str "strings"
+	"time"
+)
+
+const (
+	InvoiceDocType       = "invoice"
+	InvoiceSeriesDocType = "invoice_series"
+)
+
+type InvoiceKind string
+
+const (
+	InvoiceOrdinary   InvoiceKind = "ordinary"
+	InvoiceRectifying InvoiceKind = "rectifying" // Corrects an invoice, e.g. after a refund, with negative amounts
+)
+
+var (
+	ErrInvoicingDisabled = errors.New("Invoices can't be issued until the issuer is configured")
+	ErrNotInvoiceable    = errors.New("Only orders shipped or collected and paid checkouts can be invoiced")
+)
+
+type InvoiceLine struct {
+	Description string  `json:"description"`
+	Quantity    int     `json:"quantity"`
+	VATPercent  float64 `json:"vat_percent"`
+	NetCents    int64   `json:"net_cents"`   // VAT excluded
+	TotalCents  int64   `json:"total_cents"` // VAT included
+}
+
+// @info Taxable base and tax of one VAT rate of an invoice
+type VATBreakdown struct {
+	VATPercent float64 `json:"vat_percent"`
+	BaseCents  int64   `json:"base_cents"`
+	VATCents   int64   `json:"vat_cents"`
+}
+
+// @info The shop, as configured when the invoice was issued
+type InvoiceIssuer struct {
+	LegalName string `json:"legal_name"`
+	TaxID     string `json:"tax_id"`
+	Address   string `json:"address"`
+}
+
+// @info A rectifying invoice of an invoice. The amount is reserved before the rectifying invoice is issued, with no
+// InvoiceID until it is.
+type InvoiceRectification struct {
+	InvoiceID      string `json:"invoice_id,omitempty"`
+	IdempotencyKey string `json:"idempotency_key"`
+	TotalCents     int64  `json:"total_cents"` // Negative
+}
+
+// @info An invoice is never changed once issued, except to list the rectifying invoices that correct it. Its ID is
+// derived from its number, so two invoices can't get the same one.
+type Invoice struct {
+	ID             string                 `json:"_id"`
+	Rev            string                 `json:"_rev,omitempty"`
+	Type           string                 `json:"type" validate:"required"`
+	Kind           InvoiceKind            `json:"kind" validate:"required,enum=ordinary|rectifying"`
+	Series         string                 `json:"series" validate:"required"`
+	Year           int                    `json:"year" validate:"min=2000"`
+	Number         int64                  `json:"number" validate:"min=1"`  // Within the series and year, without gaps
+	Code           string                 `json:"code" validate:"required"` // As printed, e.g. F-2024-000001
+	CustomerID     string                 `json:"customer_id" validate:"required"`
+	OrderID        string                 `json:"order_id,omitempty"`
+	CheckoutID     string                 `json:"checkout_id,omitempty"`
+	Issuer         InvoiceIssuer          `json:"issuer"`
+	Customer       BillingProfile         `json:"customer"` // See User.BillingParty
+	Currency       string                 `json:"currency" validate:"required"`
+	Lines          []InvoiceLine          `json:"lines" validate:"minlen=1"`
+	VAT            []VATBreakdown         `json:"vat"`
+	NetCents       int64                  `json:"net_cents"`
+	VATCents       int64                  `json:"vat_cents"`
+	TotalCents     int64                  `json:"total_cents"`
+	RectifiesID    string                 `json:"rectifies_id,omitempty"` // Invoice corrected by this one
+	RectifiesCode  string                 `json:"rectifies_code,omitempty"`
+	Reason         string                 `json:"reason,omitempty" validate:"maxlen=1024"`
+	Rectifications []InvoiceRectification `json:"rectifications,omitempty"` // Invoices correcting this one
+	IssuedAt       time.Time              `json:"issued_at" validate:"required"`
+	UpdatedAt      time.Time              `json:"updated_at" validate:"required"`
+
+	Attachments map[string]dbdriver.Attachment `json:"_attachments,omitempty"` // The PDF, see InvoicePDF
+}
+
+// @info What to invoice: a completed order, the store items of a paid checkout, or a refund of an invoice
+type InvoiceRequest struct {
+	OrderID        string `json:"order_id,omitempty"`
+	CheckoutID     string `json:"checkout_id,omitempty"`
+	RectifiesID    string `json:"rectifies_id,omitempty"`
+	AmountCents    int64  `json:"amount_cents,omitempty"` // Refunded, VAT included. All that is left if 0.
+	Reason         string `json:"reason,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"` // Rectifications with the same key are issued once
+}
+
+// @info A number given to an invoice that is not written yet
+type PendingInvoice struct {
+	Number     int64          `json:"number"`
+	Request    InvoiceRequest `json:"request"`
+	ReservedAt time.Time      `json:"reserved_at"`
+}
+
+// @info The numbers given in a series and year. A number is reserved here before its invoice is written, so a number
+// is never given twice, and reservations stay pending until their invoice is, so none is lost if writing it fails.
+type InvoiceSeries struct {
+	ID        string                    `json:"_id"`
+	Rev       string                    `json:"_rev,omitempty"`
+	Type      string                    `json:"type" validate:"required"`
+	Series    string                    `json:"series" validate:"required"`
+	Year      int                       `json:"year" validate:"min=2000"`
+	Last      int64                     `json:"last" validate:"min=0"`
+	Pending   map[string]PendingInvoice `json:"pending"` // By what they invoice, see InvoiceRequest.source
+	UpdatedAt time.Time                 `json:"updated_at" validate:"required"`
+}
+
+// @info Filters of ListInvoices. Empty fields match every invoice.
+type InvoiceFilter struct {
+	CustomerID string
+	Kind       InvoiceKind
+}
+
+var invoiceSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"issued_at": "desc"}}
+var customerInvoiceSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"customer_id": "desc"}, map[string]string{"issued_at": "desc"}}
+
+// @info Returned when the source of a reservation got an invoice in the meantime
+var errAlreadyInvoiced = errors.New("already invoiced")
+
+func invoiceCode(series string, year int, number int64) string {
+	return fmt.Sprintf("%s-%d-%06d", series, year, number)
+}
+
+func invoiceSeriesID(series string, year int) string {
+	return fmt.Sprintf("%s:%s:%d", InvoiceSeriesDocType, series, year)
+}
+
+// @info What the request invoices, which gets one invoice at most
+func (r *InvoiceRequest) source() string {
+	switch {
+	case r.RectifiesID != "":
+		return "rectification:" + r.RectifiesID + ":" + r.IdempotencyKey
+	case r.CheckoutID != "":
+		return "checkout:" + r.CheckoutID
+	}
+	return "order:" + r.OrderID
+}
+
+func (r *InvoiceRequest) series(cfg *config.InvoiceConfig) string {
+	if r.RectifiesID != "" {
+		return cfg.RectifyingSeries
+	}
+	return cfg.Series
+}
+
+// @info Issues the invoice of an order shipped or collected, or of the store items of a paid checkout. Orders and
+// checkouts get one invoice, asking again answers it.
+// @error ErrInvoicingDisabled, ErrNotInvoiceable, or a *dbdriver.ValidationError if the checkout only paid print orders
+func IssueInvoice(client *dbdriver.CouchDBClient, cfg *config.InvoiceConfig, req *InvoiceRequest) (*Invoice, error) {
+	if !cfg.Enabled() {
+		return nil, ErrInvoicingDisabled
+	}
+	if (req.OrderID == "") == (req.CheckoutID == "") || req.RectifiesID != "" {
+		return nil, &dbdriver.ValidationError{DocType: InvoiceDocType, Fields: []dbdriver.FieldError{{Field: "order_id", Message: "give either an order or a checkout"}}}
+	}
+	return issueInvoice(client, cfg, req)
+}
+
+// @info Issues a rectifying invoice giving back part of an invoice, all that is left if amountCents is 0. Requests
+// with the same idempotency key are only issued once.
+// @error ErrInvoicingDisabled, or a *dbdriver.ValidationError if the invoice is a rectifying one or there is not that
+// much left
+func RectifyInvoice(client *dbdriver.CouchDBClient, cfg *config.InvoiceConfig, id string, amountCents int64, reason string, idempotencyKey string) (*Invoice, error) {
+	if !cfg.Enabled() {
+		return nil, ErrInvoicingDisabled
+	}
+	original, err := GetInvoice(client, id)
+	if err != nil {
+		return nil, err
+	}
+	if idempotencyKey == "" {
+		idempotencyKey = strconv.Itoa(len(original.Rectifications) + 1)
+	}
+	req := &InvoiceRequest{RectifiesID: id, AmountCents: amountCents, Reason: str.TrimSpace(reason), IdempotencyKey: idempotencyKey}
+	// @info Reserved in the same write that checks what is left, so concurrent rectifications can't give back more
+	// than the invoice. A retry with the key gets the amount reserved the first time.
+	if _, err := updateInvoice(client, id, func(original *Invoice) error {
+		amount, err := rectifiableAmount(original, req)
+		if err != nil {
+			return err
+		}
+		req.AmountCents = amount
+		for _, rectification := range original.Rectifications {
+			if rectification.IdempotencyKey == req.IdempotencyKey {
+				return nil
+			}
+		}
+		original.Rectifications = append(original.Rectifications, InvoiceRectification{IdempotencyKey: req.IdempotencyKey, TotalCents: -amount})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return issueInvoice(client, cfg, req)
+}
+
+// @info Writes the invoices whose number was reserved but which were never written, e.g. because the backend stopped
+// in between. Called on startup, so their numbers do not stay as gaps.
+func CompletePendingInvoices(client *dbdriver.CouchDBClient, cfg *config.InvoiceConfig) (int, error) {
+	if !cfg.Enabled() {
+		return 0, nil
+	}
+	found, err := dbdriver.FindInDatabase(client, &dbdriver.FindOptions{
+		Selector: map[string]interface{}{"type": InvoiceSeriesDocType},
+		Limit:    1000,
+	})
+	if err != nil {
+		return 0, err
+	}
+	completed := 0
+	for _, doc := range found.Docs {
+		series := &InvoiceSeries{}
+		if err := dbdriver.DecodeDocument(doc, series); err != nil {
+			return completed, err
+		}
+		for key, pending := range series.Pending {
+			pending := pending
+			if _, err := completeInvoice(client, cfg, series, key, &pending); err != nil {
+				return completed, fmt.Errorf("invoice %s: %w", invoiceCode(series.Series, series.Year, pending.Number), err)
+			}
+			completed++
+		}
+	}
+	return completed, nil
+}
+
+func issueInvoice(client *dbdriver.CouchDBClient, cfg *config.InvoiceConfig, req *InvoiceRequest) (*Invoice, error) {
+	if invoiceID, err := invoicedBy(client, req); err != nil || invoiceID != "" {
+		if err != nil {
+			return nil, err
+		}
+		return GetInvoice(client, invoiceID)
+	}
+	// @info Checked before taking a number, so a request that can't be invoiced leaves no gap
+	if _, err := draftInvoice(client, cfg, req); err != nil {
+		releaseRectification(client, req)
+		return nil, err
+	}
+	series, pending, err := reserveInvoiceNumber(client, req.series(cfg), req)
+	if errors.Is(err, errAlreadyInvoiced) {
+		invoiceID, err := invoicedBy(client, req)
+		if err != nil {
+			return nil, err
+		}
+		return GetInvoice(client, invoiceID)
+	}
+	if err != nil {
+		releaseRectification(client, req)
+		return nil, err
+	}
+	invoice, err := completeInvoice(client, cfg, series, req.source(), pending)
+	if err == nil {
+		return invoice, nil
+	}
+	// @info Tried once more, then the number is given back if no later one was given, so it is not left as a gap
+	// until CompletePendingInvoices runs on the next start
+	if invoice, err = completeInvoice(client, cfg, series, req.source(), pending); err == nil {
+		return invoice, nil
+	}
+	voided, voidErr := voidInvoiceNumber(client, series, req.source(), pending)
+	switch {
+	case voidErr != nil:
+		fmt.Fprintf(os.Stderr, "Warning: Couldn't give back number %s: %v\n", invoiceCode(series.Series, series.Year, pending.Number), voidErr)
+	case voided:
+		releaseRectification(client, req)
+	}
+	return nil, err
+}
+
+// @info Reserves the next number of the series in the current year for the request, or answers the one it was given
+// already. Numbers reserved late last year are answered too, so they are not left as gaps.
+func reserveInvoiceNumber(client *dbdriver.CouchDBClient, seriesName string, req *InvoiceRequest) (*InvoiceSeries, *PendingInvoice, error) {
+	now := time.Now()
+	key := req.source()
+	if previous, err := getInvoiceSeries(client, invoiceSeriesID(seriesName, now.Year()-1)); err == nil {
+		if pending, ok := previous.Pending[key]; ok {
+			return previous, &pending, nil
+		}
+	} else if !dbdriver.IsNotFound(err) {
+		return nil, nil, err
+	}
+
+	id := invoiceSeriesID(seriesName, now.Year())
+	if _, err := getInvoiceSeries(client, id); dbdriver.IsNotFound(err) {
+		doc, err := dbdriver.EncodeDocument(&InvoiceSeries{ID: id, Type: InvoiceSeriesDocType, Series: seriesName, Year: now.Year(), Pending: map[string]PendingInvoice{}, UpdatedAt: now.UTC()})
+		if err != nil {
+			return nil, nil, err
+		}
+		delete(doc, "_rev")
+		if _, err := dbdriver.CreateOrModifyDocument(client, &doc, id); err != nil && !dbdriver.IsConflict(err) {
+			return nil, nil, err
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var pending PendingInvoice
+	series, err := updateInvoiceSeries(client, id, func(series *InvoiceSeries) error {
+		if existing, ok := series.Pending[key]; ok {
+			pending = existing
+			return nil
+		}
+		// @info Read after the series, which is written after the source is marked, so a source invoiced
+		// concurrently is always noticed here
+		invoiceID, err := invoicedBy(client, req)
+		if err != nil {
+			return err
+		}
+		if invoiceID != "" {
+			return errAlreadyInvoiced
+		}
+		series.Last++
+		pending = PendingInvoice{Number: series.Last, Request: *req, ReservedAt: now.UTC()}
+		series.Pending[key] = pending
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return series, &pending, nil
+}
+
+// @info Gives back a reserved number whose invoice could not be written, only while it is the last one of the series and
+// nothing was written with it. Otherwise it stays pending.
+func voidInvoiceNumber(client *dbdriver.CouchDBClient, series *InvoiceSeries, key string, pending *PendingInvoice) (bool, error) {
+	id := InvoiceDocType + ":" + invoiceCode(series.Series, series.Year, pending.Number)
+	if _, err := GetInvoice(client, id); !dbdriver.IsNotFound(err) {
+		return false, err
+	}
+	voided := false
+	_, err := updateInvoiceSeries(client, series.ID, func(series *InvoiceSeries) error {
+		voided = false
+		if existing, ok := series.Pending[key]; !ok || existing.Number != pending.Number || series.Last != pending.Number {
+			return nil
+		}
+		delete(series.Pending, key)
+		series.Last--
+		voided = true
+		return nil
+	})
+	return voided, err
+}
+
+// @info Drops the amount reserved by a rectification that got no number, so it can be given back again
+func releaseRectification(client *dbdriver.CouchDBClient, req *InvoiceRequest) {
+	if req.RectifiesID == "" {
+		return
+	}
+	if _, err := updateInvoice(client, req.RectifiesID, func(original *Invoice) error {
+		kept := original.Rectifications[:0]
+		for _, rectification := range original.Rectifications {
+			if rectification.IdempotencyKey != req.IdempotencyKey || rectification.InvoiceID != "" {
+				kept = append(kept, rectification)
+			}
+		}
+		original.Rectifications = kept
+		return nil
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Couldn't release the rectification %s of invoice %s: %v\n", req.IdempotencyKey, req.RectifiesID, err)
+	}
+}
+
+// @info Writes the invoice of a reserved number, records it on what it invoices and releases the reservation. Each step
+// can be repeated, so a reservation can be completed as many times as needed.
+func completeInvoice(client *dbdriver.CouchDBClient, cfg *config.InvoiceConfig, series *InvoiceSeries, key string, pending *PendingInvoice) (*Invoice, error) {
+	req := &pending.Request
+	code := invoiceCode(series.Series, series.Year, pending.Number)
+	id := InvoiceDocType + ":" + code
+
+	invoiceID, err := invoicedBy(client, req)
+	if err != nil {
+		return nil, err
+	}
+	if invoiceID == "" {
+		invoice, err := GetInvoice(client, id)
+		if dbdriver.IsNotFound(err) {
+			if invoice, err = draftInvoice(client, cfg, req); err != nil {
+				return nil, err
+			}
+			invoice.ID = id
+			invoice.Series, invoice.Year, invoice.Number, invoice.Code = series.Series, series.Year, pending.Number, code
+			invoice.IssuedAt = pending.ReservedAt
+			invoice.UpdatedAt = time.Now().UTC()
+			doc, err := dbdriver.EncodeDocument(invoice)
+			if err != nil {
+				return nil, err
+			}
+			delete(doc, "_rev")
+			if _, err := dbdriver.CreateOrModifyDocument(client, &doc, id); err != nil && !dbdriver.IsConflict(err) {
+				return nil, err
+			}
+			if invoice, err = GetInvoice(client, id); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		// @info A missing PDF is rendered when it is first downloaded
+		if _, _, err := InvoicePDF(client, id); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Couldn't store the PDF of invoice %s: %v\n", code, err)
+		}
+		if err := markInvoiced(client, req, invoice); err != nil {
+			return nil, err
+		}
+		invoiceID = id
+	}
+
+	if _, err := updateInvoiceSeries(client, series.ID, func(series *InvoiceSeries) error {
+		delete(series.Pending, key)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return GetInvoice(client, invoiceID)
+}
+
+// @info The invoice already issued for the request, if any
+func invoicedBy(client *dbdriver.CouchDBClient, req *InvoiceRequest) (string, error) {
+	switch {
+	case req.RectifiesID != "":
+		original, err := GetInvoice(client, req.RectifiesID)
+		if err != nil {
+			return "", err
+		}
+		for _, rectification := range original.Rectifications {
+			if rectification.IdempotencyKey == req.IdempotencyKey {
+				return rectification.InvoiceID, nil
+			}
+		}
+		return "", nil
+	case req.CheckoutID != "":
+		checkout, err := GetCheckout(client, req.CheckoutID)
+		if err != nil {
+			return "", err
+		}
+		return checkout.InvoiceID, nil
+	}
+	order, err := GetOrder(client, req.OrderID)
+	if err != nil {
+		return "", err
+	}
+	return order.InvoiceID, nil
+}
+
+func markInvoiced(client *dbdriver.CouchDBClient, req *InvoiceRequest, invoice *Invoice) error {
+	var err error
+	switch {
+	case req.RectifiesID != "":
+		_, err = updateInvoice(client, req.RectifiesID, func(original *Invoice) error {
+			for i, rectification := range original.Rectifications {
+				if rectification.IdempotencyKey == req.IdempotencyKey {
+					original.Rectifications[i].InvoiceID, original.Rectifications[i].TotalCents = invoice.ID, invoice.TotalCents
+					return nil
+				}
+			}
+			original.Rectifications = append(original.Rectifications, InvoiceRectification{InvoiceID: invoice.ID, IdempotencyKey: req.IdempotencyKey, TotalCents: invoice.TotalCents})
+			return nil
+		})
+	case req.CheckoutID != "":
+		_, err = updateCheckout(client, req.CheckoutID, func(checkout *Checkout) error {
+			checkout.InvoiceID = invoice.ID
+			return nil
+		})
+	default:
+		_, err = updateOrder(client, req.OrderID, func(order *Order) error {
+			order.InvoiceID = invoice.ID
+			return nil
+		})
+	}
+	return err
+}
+
+// @info Everything of the invoice but its number
+func draftInvoice(client *dbdriver.CouchDBClient, cfg *config.InvoiceConfig, req *InvoiceRequest) (*Invoice, error) {
+	invoice := &Invoice{
+		Type:   InvoiceDocType,
+		Kind:   InvoiceOrdinary,
+		Issuer: InvoiceIssuer{LegalName: cfg.IssuerName, TaxID: cfg.IssuerTaxID, Address: cfg.IssuerAddress},
+	}
+	var amounts []invoiceAmount
+	var err error
+	switch {
+	case req.RectifiesID != "":
+		amounts, err = draftRectification(client, invoice, req)
+	case req.CheckoutID != "":
+		amounts, err = draftCheckoutInvoice(client, invoice, req.CheckoutID)
+	default:
+		amounts, err = draftOrderInvoice(client, invoice, req.OrderID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Kind == InvoiceOrdinary {
+		customer, err := GetUser(client, invoice.CustomerID)
+		if err != nil {
+			return nil, err
+		}
+		invoice.Customer = customer.BillingParty()
+	}
+	invoice.total(amounts)
+	return invoice, nil
+}
+
+func draftOrderInvoice(client *dbdriver.CouchDBClient, invoice *Invoice, orderID string) ([]invoiceAmount, error) {
+	order, err := GetOrder(client, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != OrderShipped && order.Status != OrderCollected {
+		return nil, ErrNotInvoiceable
+	}
+	invoice.CustomerID, invoice.OrderID = order.CustomerID, order.ID
+	amounts := []invoiceAmount{}
+	vat := 0.0
+	if q := order.Quote; q != nil {
+		invoice.Currency, vat = q.Currency, q.VATPercent
+		for _, line := range q.Lines {
+			description := fmt.Sprintf("3D print: %s, %s", line.Name, line.Material)
+			if len(line.PostProcessing) > 0 {
+				description += " (" + str.Join(line.PostProcessing, ", ") + ")"
+			}
+			amounts = append(amounts, netAmount(description, line.Quantity, vat, line.SubtotalCents))
+		}
+		if q.MinimumFeeCents > 0 {
+			amounts = append(amounts, netAmount("Minimum order fee", 1, vat, q.MinimumFeeCents))
+		}
+		if q.DiscountCents > 0 {
+			amounts = append(amounts, netAmount(fmt.Sprintf("Discount %s%%", formatPercent(q.DiscountPercent)), 1, vat, -q.DiscountCents))
+		}
+	} else {
+		// @info Priced by hand, at the VAT rate in force
+		rules, err := GetCurrentPricingRules(client)
+		if err != nil && !dbdriver.IsNotFound(err) {
+			return nil, err
+		}
+		defaults := quote.DefaultRules()
+		if rules != nil {
+			defaults = rules.Rules
+		}
+		invoice.Currency, vat = defaults.Currency, defaults.VATPercent
+		names := []string{}
+		for _, item := range order.Items {
+			names = append(names, fmt.Sprintf("%d × %s", item.Quantity, item.Name))
+		}
+		amounts = append(amounts, grossAmount("3D print: "+str.Join(names, ", "), 1, vat, order.TotalCents))
+	}
+	if order.CheckoutID != "" {
+		checkout, err := GetCheckout(client, order.CheckoutID)
+		if err != nil {
+			return nil, err
+		}
+		discount := int64(0)
+		for _, line := range checkout.Lines {
+			if line.OrderID != order.ID {
+				continue
+			}
+			if line.Kind == CartShipping {
+				amounts = append(amounts, grossAmount(line.Name, 1, line.VATPercent, line.UnitPriceCents))
+			}
+			discount += line.DiscountCents
+		}
+		if discount > 0 {
+			amounts = append(amounts, grossAmount("Discount "+str.Join(checkout.promotionCodes(), ", "), 1, vat, -discount))
+		}
+	}
+	return amounts, nil
+}
+
+func draftCheckoutInvoice(client *dbdriver.CouchDBClient, invoice *Invoice, checkoutID string) ([]invoiceAmount, error) {
+	checkout, err := GetCheckout(client, checkoutID)
+	if err != nil {
+		return nil, err
+	}
+	if checkout.Status != CheckoutPaid {
+		return nil, ErrNotInvoiceable
+	}
+	invoice.CustomerID, invoice.CheckoutID = checkout.CustomerID, checkout.ID
+	invoice.Currency = quote.DefaultRules().Currency
+	if rules, err := GetCurrentPricingRules(client); err == nil {
+		invoice.Currency = rules.Rules.Currency
+	} else if !dbdriver.IsNotFound(err) {
+		return nil, err
+	}
+	amounts := []invoiceAmount{}
+	for _, line := range checkout.Lines {
+		if line.Kind != CartProduct {
+			continue // @info Print orders are invoiced on their own once completed
+		}
+		amounts = append(amounts, grossAmount(line.Name, line.Quantity, line.VATPercent, line.TotalCents))
+	}
+	if len(amounts) == 0 {
+		return nil, &dbdriver.ValidationError{DocType: InvoiceDocType, Fields: []dbdriver.FieldError{{Field: "checkout_id", Message: "only paid print orders, they are invoiced once completed"}}}
+	}
+	return amounts, nil
+}
+
+func draftRectification(client *dbdriver.CouchDBClient, invoice *Invoice, req *InvoiceRequest) ([]invoiceAmount, error) {
+	original, err := GetInvoice(client, req.RectifiesID)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := rectifiableAmount(original, req)
+	if err != nil {
+		return nil, err
+	}
+	invoice.Kind = InvoiceRectifying
+	invoice.CustomerID, invoice.OrderID, invoice.CheckoutID = original.CustomerID, original.OrderID, original.CheckoutID
+	invoice.Customer, invoice.Currency = original.Customer, original.Currency
+	invoice.RectifiesID, invoice.RectifiesCode, invoice.Reason = original.ID, original.Code, req.Reason
+
+	amounts := []invoiceAmount{}
+	if amount == original.TotalCents {
+		for _, line := range original.Lines {
+			amounts = append(amounts, invoiceAmount{line: InvoiceLine{Description: line.Description, Quantity: line.Quantity, VATPercent: line.VATPercent, NetCents: -line.NetCents, TotalCents: -line.TotalCents}, given: givenBoth})
+		}
+		return amounts, nil
+	}
+	// @info Given back from every VAT rate in proportion to what it was of the invoice
+	remaining := amount
+	for i, vat := range original.VAT {
+		share := remaining
+		if i < len(original.VAT)-1 {
+			share = int64(math.Round(float64(amount) * float64(vat.BaseCents+vat.VATCents) / float64(original.TotalCents)))
+		}
+		remaining -= share
+		if share != 0 {
+			amounts = append(amounts, grossAmount("Partial refund of invoice "+original.Code, 1, vat.VATPercent, -share))
+		}
+	}
+	return amounts, nil
+}
+
+// @info The amount the request gives back: the one reserved with its key, or else the one asked for, all that is left
+// if 0. What the other rectifications gave back or reserved is not left.
+func rectifiableAmount(original *Invoice, req *InvoiceRequest) (int64, error) {
+	if original.Kind != InvoiceOrdinary {
+		return 0, &dbdriver.ValidationError{DocType: InvoiceDocType, Fields: []dbdriver.FieldError{{Field: "rectifies_id", Message: "rectifying invoices can't be rectified, rectify the original one"}}}
+	}
+	if req.Reason == "" {
+		return 0, &dbdriver.ValidationError{DocType: InvoiceDocType, Fields: []dbdriver.FieldError{{Field: "reason", Message: "is required"}}}
+	}
+	left := original.TotalCents
+	amount := req.AmountCents
+	for _, rectification := range original.Rectifications {
+		if rectification.IdempotencyKey == req.IdempotencyKey {
+			amount = -rectification.TotalCents
+			continue
+		}
+		left += rectification.TotalCents
+	}
+	if amount == 0 {
+		amount = left
+	}
+	if amount <= 0 || amount > left {
+		return 0, &dbdriver.ValidationError{DocType: InvoiceDocType, Fields: []dbdriver.FieldError{{Field: "amount_cents", Message: fmt.Sprintf("only %d left to rectify", left)}}}
+	}
+	return amount, nil
+}
+
+// @info Which amounts of a line are known before the VAT of the invoice is worked out
+type amountGiven int
+
+const (
+	givenNet   amountGiven = iota // Priced without VAT, e.g. quotes
+	givenGross                    // Priced VAT included, e.g. the store
+	givenBoth                     // Copied from another invoice
+)
+
+type invoiceAmount struct {
+	line  InvoiceLine
+	given amountGiven
+}
+
+func netAmount(description string, quantity int, vatPercent float64, netCents int64) invoiceAmount {
+	return invoiceAmount{line: InvoiceLine{Description: description, Quantity: quantity, VATPercent: vatPercent, NetCents: netCents}, given: givenNet}
+}
+
+func grossAmount(description string, quantity int, vatPercent float64, totalCents int64) invoiceAmount {
+	return invoiceAmount{line: InvoiceLine{Description: description, Quantity: quantity, VATPercent: vatPercent, TotalCents: totalCents}, given: givenGross}
+}
+
+// @info Works out the lines and the VAT breakdown. For every rate, the VAT of the lines priced without it is taken
+// on their sum, as the quotes do, and the base of those priced with VAT is taken out of their sum, so the invoice adds
+// up to what was paid. The rounding of each rate goes to its last line.
+func (inv *Invoice) total(amounts []invoiceAmount) {
+	rates := []float64{}
+	byRate := map[float64][]int{}
+	for i, amount := range amounts {
+		if _, ok := byRate[amount.line.VATPercent]; !ok {
+			rates = append(rates, amount.line.VATPercent)
+		}
+		byRate[amount.line.VATPercent] = append(byRate[amount.line.VATPercent], i)
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(rates)))
+
+	inv.VAT = []VATBreakdown{}
+	inv.NetCents, inv.VATCents, inv.TotalCents = 0, 0, 0
+	for _, rate := range rates {
+		var net, gross []*InvoiceLine
+		var netSum, grossSum, base, total int64
+		for _, i := range byRate[rate] {
+			line := &amounts[i].line
+			switch amounts[i].given {
+			case givenNet:
+				net, netSum = append(net, line), netSum+line.NetCents
+			case givenGross:
+				gross, grossSum = append(gross, line), grossSum+line.TotalCents
+			default:
+				base, total = base+line.NetCents, total+line.TotalCents
+			}
+		}
+		netTotal := netSum + int64(math.Round(float64(netSum)*rate/100))
+		grossBase := int64(math.Round(float64(grossSum) / (1 + rate/100)))
+		left := netTotal
+		for k, line := range net {
+			line.TotalCents = left
+			if k < len(net)-1 {
+				line.TotalCents = line.NetCents + int64(math.Round(float64(line.NetCents)*rate/100))
+			}
+			left -= line.TotalCents
+		}
+		left = grossBase
+		for k, line := range gross {
+			line.NetCents = left
+			if k < len(gross)-1 {
+				line.NetCents = int64(math.Round(float64(line.TotalCents) / (1 + rate/100)))
+			}
+			left -= line.NetCents
+		}
+		base, total = base+netSum+grossBase, total+netTotal+grossSum
+		inv.VAT = append(inv.VAT, VATBreakdown{VATPercent: rate, BaseCents: base, VATCents: total - base})
+		inv.NetCents += base
+		inv.VATCents += total - base
+		inv.TotalCents += total
+	}
+	inv.Lines = make([]InvoiceLine, len(amounts))
+	for i := range amounts {
+		inv.Lines[i] = amounts[i].line
+	}
+}
+
+// @info 21, 10.5, without trailing zeros
+func formatPercent(percent float64) string {
+	return strconv.FormatFloat(percent, 'f', -1, 64)
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no invoice with that ID
+func GetInvoice(client *dbdriver.CouchDBClient, id string) (*Invoice, error) {
+	invoice := &Invoice{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return invoice, err
+	}
+	if err = dbdriver.DecodeDocument(doc, invoice); err != nil {
+		return invoice, err
+	}
+	if invoice.Type != InvoiceDocType {
+		return invoice, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not an invoice"}
+	}
+	return invoice, nil
+}
+
+// @info Newest invoices first. Pass the returned bookmark to get the next page.
+func ListInvoices(client *dbdriver.CouchDBClient, filter *InvoiceFilter, limit uint64, bookmark string) ([]Invoice, string, error) {
+	selector := map[string]interface{}{"type": InvoiceDocType}
+	sort := invoiceSort
+	if filter.CustomerID != "" {
+		selector["customer_id"] = filter.CustomerID
+		sort = customerInvoiceSort
+	}
+	if filter.Kind != "" {
+		selector["kind"] = filter.Kind
+	}
+	opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: sort}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	invoices := []Invoice{}
+	if err != nil {
+		return invoices, "", err
+	}
+	for _, doc := range found.Docs {
+		invoice := Invoice{}
+		if err := dbdriver.DecodeDocument(doc, &invoice); err != nil {
+			return invoices, "", err
+		}
+		invoices = append(invoices, invoice)
+	}
+	return invoices, found.Bookmark, nil
+}
+
+func getInvoiceSeries(client *dbdriver.CouchDBClient, id string) (*InvoiceSeries, error) {
+	series := &InvoiceSeries{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return series, err
+	}
+	if err = dbdriver.DecodeDocument(doc, series); err != nil {
+		return series, err
+	}
+	if series.Type != InvoiceSeriesDocType {
+		return series, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not an invoice series"}
+	}
+	return series, nil
+}
+
+// @info Read-modify-write of an invoice with conflict retries, see dbdriver.UpdateDocument
+func updateInvoice(client *dbdriver.CouchDBClient, id string, mutate func(invoice *Invoice) error) (*Invoice, error) {
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		invoice := &Invoice{}
+		if err := dbdriver.DecodeDocument(doc, invoice); err != nil {
+			return err
+		}
+		if invoice.Type != InvoiceDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not an invoice"}
+		}
+		if err := mutate(invoice); err != nil {
+			return err
+		}
+		invoice.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(invoice)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetInvoice(client, id)
+}
+
+// @info Read-modify-write of the numbers of a series with conflict retries, see dbdriver.UpdateDocument
+func updateInvoiceSeries(client *dbdriver.CouchDBClient, id string, mutate func(series *InvoiceSeries) error) (*InvoiceSeries, error) {
+	series := &InvoiceSeries{}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		series = &InvoiceSeries{}
+		if err := dbdriver.DecodeDocument(doc, series); err != nil {
+			return err
+		}
+		if series.Type != InvoiceSeriesDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not an invoice series"}
+		}
+		if series.Pending == nil {
+			series.Pending = map[string]PendingInvoice{}
+		}
+		if err := mutate(series); err != nil {
+			return err
+		}
+		series.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(series)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	return series, err
+}
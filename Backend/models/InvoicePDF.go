@@ -0,0 +1,220 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/pdf"
+	"3DQuest/taxid"
+	"fmt"
+	"strconv"
+	str "strings"
+	"time"
+)
+
+// @info The PDF of an invoice and its file name. It is stored as an attachment of the invoice the first time it is
+// rendered, so it is always the same file.
+func InvoicePDF(client *dbdriver.CouchDBClient, id string) ([]byte, string, error) {
+	invoice, err := GetInvoice(client, id)
+	if err != nil {
+		return nil, "", err
+	}
+	name := invoice.Code + ".pdf"
+	if _, stored := invoice.Attachments[name]; stored {
+		data, _, err := dbdriver.GetAttachment(client, id, name)
+		return data, name, err
+	}
+	data, err := renderInvoice(invoice)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := dbdriver.PutAttachment(client, id, invoice.Rev, name, "application/pdf", data); err != nil && !dbdriver.IsConflict(err) {
+		return nil, "", err
+	}
+	return data, name, nil
+}
+
+// @info Layout of the invoice on A4, in points
+const (
+	invoiceMargin    = 50.0
+	invoiceRight     = pdf.PageWidth - invoiceMargin
+	invoiceBottom    = 90.0
+	invoiceRowHeight = 13.0
+)
+
+// @info Right edges of the columns of the lines, after the description
+var invoiceColumns = []struct {
+	title string
+	right float64
+}{
+	{"Qty", 345}, {"VAT", 395}, {"Base", 470}, {"Total", invoiceRight - 5},
+}
+
+func renderInvoice(invoice *Invoice) ([]byte, error) {
+	doc := pdf.New()
+	doc.Title = "Invoice " + invoice.Code
+	doc.Author = invoice.Issuer.LegalName
+	page := doc.AddPage()
+	top := pdf.PageHeight - invoiceMargin
+
+	title := "INVOICE"
+	if invoice.Kind == InvoiceRectifying {
+		title = "RECTIFYING INVOICE"
+	}
+	page.Text(invoiceMargin, top-14, pdf.HelveticaBold, 20, title)
+	page.TextRight(invoiceRight, top-8, pdf.HelveticaBold, 12, "No. "+invoice.Code)
+	page.TextRight(invoiceRight, top-24, pdf.Helvetica, 10, "Date: "+invoice.IssuedAt.In(time.Local).Format("02/01/2006"))
+
+	y := top - 60
+	issuer := append([]string{taxIDLabel("", invoice.Issuer.TaxID) + invoice.Issuer.TaxID}, splitAddress(invoice.Issuer.Address)...)
+	customer := []string{}
+	if invoice.Customer.TaxID != "" {
+		customer = append(customer, taxIDLabel(invoice.Customer.TaxIDType, invoice.Customer.TaxID)+invoice.Customer.TaxID)
+	}
+	customer = append(customer, addressLines(&invoice.Customer.Address)...)
+	page.Text(invoiceMargin, y, pdf.HelveticaBold, 11, invoice.Issuer.LegalName)
+	page.Text(320, y+14, pdf.Helvetica, 8, "BILL TO")
+	page.Text(320, y, pdf.HelveticaBold, 11, invoice.Customer.LegalName)
+	for i := 0; i < len(issuer) || i < len(customer); i++ {
+		y -= invoiceRowHeight
+		if i < len(issuer) {
+			page.Text(invoiceMargin, y, pdf.Helvetica, 9, issuer[i])
+		}
+		if i < len(customer) {
+			page.Text(320, y, pdf.Helvetica, 9, customer[i])
+		}
+	}
+
+	if invoice.Kind == InvoiceRectifying {
+		y -= 2 * invoiceRowHeight
+		page.Text(invoiceMargin, y, pdf.HelveticaBold, 9, "Rectifies invoice "+invoice.RectifiesCode)
+		for _, line := range pdf.Wrap(pdf.Helvetica, 9, "Reason: "+invoice.Reason, invoiceRight-invoiceMargin) {
+			y -= invoiceRowHeight
+			page.Text(invoiceMargin, y, pdf.Helvetica, 9, line)
+		}
+	}
+
+	header := func(page *pdf.Page, y float64) {
+		page.FillRect(invoiceMargin, y-4, invoiceRight-invoiceMargin, invoiceRowHeight+4, 0.9)
+		page.Text(invoiceMargin+5, y, pdf.HelveticaBold, 9, "Description")
+		for _, column := range invoiceColumns {
+			page.TextRight(column.right, y, pdf.HelveticaBold, 9, column.title)
+		}
+	}
+	y -= 2.5 * invoiceRowHeight
+	header(page, y)
+	y -= 4
+	for _, line := range invoice.Lines {
+		description := pdf.Wrap(pdf.Helvetica, 9, line.Description, invoiceColumns[0].right-invoiceMargin-45)
+		if y-float64(len(description))*invoiceRowHeight < invoiceBottom {
+			page = doc.AddPage()
+			y = top
+			page.Text(invoiceMargin, y, pdf.Helvetica, 9, fmt.Sprintf("Invoice %s (continued)", invoice.Code))
+			y -= 2 * invoiceRowHeight
+			header(page, y)
+			y -= 4
+		}
+		y -= invoiceRowHeight
+		page.TextRight(invoiceColumns[0].right, y, pdf.Helvetica, 9, strconv.Itoa(line.Quantity))
+		page.TextRight(invoiceColumns[1].right, y, pdf.Helvetica, 9, formatPercent(line.VATPercent)+" %")
+		page.TextRight(invoiceColumns[2].right, y, pdf.Helvetica, 9, formatMoney(line.NetCents, invoice.Currency))
+		page.TextRight(invoiceColumns[3].right, y, pdf.Helvetica, 9, formatMoney(line.TotalCents, invoice.Currency))
+		for i, text := range description {
+			if i > 0 {
+				y -= invoiceRowHeight
+			}
+			page.Text(invoiceMargin+5, y, pdf.Helvetica, 9, text)
+		}
+	}
+
+	// @info The breakdown and the totals are kept together
+	if y-float64(len(invoice.VAT)+5)*invoiceRowHeight < invoiceBottom {
+		page = doc.AddPage()
+		y = top
+	}
+	y -= invoiceRowHeight / 2
+	page.Line(invoiceMargin, y, invoiceRight, y, 0.5)
+	y -= 1.5 * invoiceRowHeight
+	page.Text(300, y, pdf.HelveticaBold, 9, "VAT rate")
+	page.TextRight(invoiceColumns[2].right, y, pdf.HelveticaBold, 9, "Base")
+	page.TextRight(invoiceColumns[3].right, y, pdf.HelveticaBold, 9, "VAT")
+	for _, vat := range invoice.VAT {
+		y -= invoiceRowHeight
+		page.Text(300, y, pdf.Helvetica, 9, formatPercent(vat.VATPercent)+" %")
+		page.TextRight(invoiceColumns[2].right, y, pdf.Helvetica, 9, formatMoney(vat.BaseCents, invoice.Currency))
+		page.TextRight(invoiceColumns[3].right, y, pdf.Helvetica, 9, formatMoney(vat.VATCents, invoice.Currency))
+	}
+	y -= 1.5 * invoiceRowHeight
+	for _, total := range []struct {
+		label string
+		cents int64
+	}{{"Taxable base", invoice.NetCents}, {"VAT", invoice.VATCents}} {
+		page.Text(300, y, pdf.Helvetica, 10, total.label)
+		page.TextRight(invoiceColumns[3].right, y, pdf.Helvetica, 10, formatMoney(total.cents, invoice.Currency))
+		y -= invoiceRowHeight
+	}
+	page.Line(300, y+invoiceRowHeight-4, invoiceRight, y+invoiceRowHeight-4, 0.5)
+	y -= 4
+	page.Text(300, y, pdf.HelveticaBold, 12, "Total")
+	page.TextRight(invoiceColumns[3].right, y, pdf.HelveticaBold, 12, formatMoney(invoice.TotalCents, invoice.Currency))
+
+	return doc.Bytes()
+}
+
+// @info Amounts as written in Spain, e.g. 1.234,56 €
+func formatMoney(cents int64, currency string) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	units := strconv.FormatInt(cents/100, 10)
+	for i := len(units) - 3; i > 0; i -= 3 {
+		units = units[:i] + "." + units[i:]
+	}
+	symbol := str.ToUpper(currency)
+	if symbol == "EUR" {
+		symbol = "€"
+	}
+	return fmt.Sprintf("%s%s,%02d %s", sign, units, cents%100, symbol)
+}
+
+func taxIDLabel(kind taxid.Kind, value string) string {
+	if kind == "" {
+		if parsed, err := taxid.Parse(value); err == nil {
+			kind = parsed.Kind
+		}
+	}
+	switch kind {
+	case taxid.NIE:
+		return "NIE: "
+	case taxid.EUVAT:
+		return "VAT: "
+	}
+	return "NIF: "
+}
+
+func splitAddress(address string) []string {
+	lines := []string{}
+	for _, line := range str.Split(address, ",") {
+		if line = str.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func addressLines(address *Address) []string {
+	lines := []string{}
+	for _, line := range []string{
+		address.Line1,
+		address.Line2,
+		str.TrimSpace(address.PostalCode + " " + address.City),
+		address.Province,
+	} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if address.Country != "" && address.Country != "ES" {
+		lines = append(lines, address.Country)
+	}
+	return lines
+}
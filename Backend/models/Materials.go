@@ -0,0 +1,708 @@
+package models
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"math"
+	"sort"
+	str "strings"
+	"time"
+)
+
+const (
+	SpoolDocType             = "spool"
+	MaterialThresholdDocType = "material_threshold"
+)
+
+type SpoolStatus string
+
+const (
+	SpoolActive  SpoolStatus = "active"
+	SpoolEmpty   SpoolStatus = "empty"   // Set when jobs use up its filament
+	SpoolRetired SpoolStatus = "retired" // Thrown away with filament left, e.g. wet or brittle
+)
+
+// @info Default density of filament whose material is not in the tariffs, that of PLA
+const defaultDensity = 1.24
+
+// @info A spool of filament on the shelf or loaded on a printer
+type Spool struct {
+	ID             string      `json:"_id"`
+	Rev            string      `json:"_rev,omitempty"`
+	Type           string      `json:"type" validate:"required"`
+	Material       string      `json:"material" validate:"required,minlen=1,maxlen=64"` // Named as in the tariffs, e.g. PLA
+	Colour         string      `json:"colour,omitempty" validate:"maxlen=64"`
+	Brand          string      `json:"brand,omitempty" validate:"maxlen=128"`
+	DiameterMM     float64     `json:"diameter_mm"`     // 1.75 or 2.85
+	DensityGCM3    float64     `json:"density_g_cm3"`   // The density of the material in the tariffs if not given
+	NetGrams       float64     `json:"net_grams"`       // Filament it came with, without the spool itself
+	RemainingGrams float64     `json:"remaining_grams"` // Taken down as jobs are done, corrected by weighing it
+	CostPerKgCents int64       `json:"cost_per_kg_cents" validate:"min=0"`
+	Status         SpoolStatus `json:"status" validate:"required,enum=active|empty|retired"`
+	PrinterID      string      `json:"printer_id,omitempty"` // Printer it is loaded on, see LoadSpool
+	Location       string      `json:"location,omitempty" validate:"maxlen=256"`
+	Notes          string      `json:"notes,omitempty" validate:"maxlen=4096"`
+	CreatedAt      time.Time   `json:"created_at" validate:"required"`
+	UpdatedAt      time.Time   `json:"updated_at" validate:"required"`
+}
+
+// @info Fields of a spool that can be changed with UpdateSpool. Nil fields are left untouched.
+type SpoolUpdate struct {
+	Material       *string      `json:"material"`
+	Colour         *string      `json:"colour"`
+	Brand          *string      `json:"brand"`
+	DiameterMM     *float64     `json:"diameter_mm"`
+	DensityGCM3    *float64     `json:"density_g_cm3"`
+	NetGrams       *float64     `json:"net_grams"`
+	RemainingGrams *float64     `json:"remaining_grams"`
+	CostPerKgCents *int64       `json:"cost_per_kg_cents"`
+	Status         *SpoolStatus `json:"status"`
+	Location       *string      `json:"location"`
+	Notes          *string      `json:"notes"`
+}
+
+// @info Filters of ListSpools. Empty fields match every spool.
+type SpoolFilter struct {
+	Material  string
+	Colour    string
+	Status    SpoolStatus
+	PrinterID string
+}
+
+// @info Stock of a material and colour below which it is low. Without one, MATERIALS_LOW_STOCK_GRAMS applies.
+type MaterialThreshold struct {
+	ID          string    `json:"_id"`
+	Rev         string    `json:"_rev,omitempty"`
+	Type        string    `json:"type" validate:"required"`
+	Material    string    `json:"material" validate:"required,minlen=1,maxlen=64"`
+	Colour      string    `json:"colour,omitempty" validate:"maxlen=64"` // Empty for the filament of no particular colour
+	MinGrams    float64   `json:"min_grams" validate:"min=0"`
+	TargetGrams float64   `json:"target_grams" validate:"min=0"` // Stock to get back to when buying, a spool over MinGrams if zero
+	UpdatedBy   string    `json:"updated_by,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at" validate:"required"`
+}
+
+// @info Filament a job used, as reported by the staff or the printer host. Zero fields are unknown, the estimate of
+// the job is used when both are.
+type FilamentReport struct {
+	Grams float64 `json:"filament_grams"`
+	MM    float64 `json:"filament_mm"` // Length extruded, weighed with the diameter and density of the spool
+}
+
+type UsageSource string
+
+const (
+	UsageEstimated UsageSource = "estimated"
+	UsageReported  UsageSource = "reported"
+)
+
+// @info Filament a job took from the spools
+type FilamentUsage struct {
+	Grams        float64     `json:"grams"`
+	Source       UsageSource `json:"source"`
+	Spools       []SpoolDraw `json:"spools"`
+	MissingGrams float64     `json:"missing_grams,omitempty"` // Not found on any spool, the inventory is behind
+}
+
+type SpoolDraw struct {
+	SpoolID string  `json:"spool_id"`
+	Grams   float64 `json:"grams"`
+}
+
+// @info Filament of a material and colour on the shelf, against what the print queue needs
+type MaterialStock struct {
+	Material       string  `json:"material"`
+	Colour         string  `json:"colour"`
+	Spools         int     `json:"spools"` // Active ones
+	RemainingGrams float64 `json:"remaining_grams"`
+	ValueCents     int64   `json:"value_cents"`   // What the remaining filament cost
+	PlannedGrams   float64 `json:"planned_grams"` // Needed by the jobs printing or planned
+	MinGrams       float64 `json:"min_grams"`
+	TargetGrams    float64 `json:"target_grams"`
+	Low            bool    `json:"low"` // What is left after the planned jobs is under MinGrams
+}
+
+// @info Spools to buy to bring a material and colour back to its target
+type PurchaseSuggestion struct {
+	Material       string  `json:"material"`
+	Colour         string  `json:"colour"`
+	Brand          string  `json:"brand,omitempty"` // Of the last spool bought
+	Spools         int     `json:"spools"`
+	SpoolGrams     float64 `json:"spool_grams"`
+	MissingGrams   float64 `json:"missing_grams"` // To reach the target once the planned jobs are printed
+	EstimatedCents int64   `json:"estimated_cents"`
+}
+
+var spoolSort = []interface{}{map[string]string{"type": "asc"}, map[string]string{"material": "asc"}, map[string]string{"colour": "asc"}}
+
+func materialThresholdID(material string, colour string) string {
+	return MaterialThresholdDocType + ":" + str.ToLower(material) + ":" + str.ToLower(colour)
+}
+
+// @info Material and colour as a key, compared case insensitively like the scheduler does
+func stockKey(material string, colour string) string {
+	return str.ToLower(material) + "\x00" + str.ToLower(colour)
+}
+
+func IsSpoolStatus(status SpoolStatus) bool {
+	return status == SpoolActive || status == SpoolEmpty || status == SpoolRetired
+}
+
+func CreateSpool(client *dbdriver.CouchDBClient, spool *Spool) error {
+	now := time.Now().UTC()
+	spool.Type = SpoolDocType
+	spool.Status = SpoolActive
+	spool.PrinterID = ""
+	spool.CreatedAt = now
+	spool.UpdatedAt = now
+	if spool.RemainingGrams == 0 {
+		spool.RemainingGrams = spool.NetGrams
+	}
+	if err := normalizeSpool(client, spool); err != nil {
+		return err
+	}
+	if err := checkSpool(spool); err != nil {
+		return err
+	}
+	doc, err := dbdriver.EncodeDocument(spool)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, spool.ID)
+	if err != nil {
+		return err
+	}
+	spool.ID = resp_data.ID
+	spool.Rev = resp_data.REV
+	return nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no spool with that ID
+func GetSpool(client *dbdriver.CouchDBClient, id string) (*Spool, error) {
+	spool := &Spool{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return spool, err
+	}
+	if err = dbdriver.DecodeDocument(doc, spool); err != nil {
+		return spool, err
+	}
+	if spool.Type != SpoolDocType {
+		return spool, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a spool"}
+	}
+	return spool, nil
+}
+
+// @info Spools by material and colour. Pass the returned bookmark to get the next page, or a zero limit to get them
+// all.
+func ListSpools(client *dbdriver.CouchDBClient, filter *SpoolFilter, limit uint64, bookmark string) ([]Spool, string, error) {
+	selector := map[string]interface{}{"type": SpoolDocType}
+	if filter.Material != "" {
+		selector["material"] = filter.Material
+	}
+	if filter.Colour != "" {
+		selector["colour"] = filter.Colour
+	}
+	if filter.Status != "" {
+		selector["status"] = filter.Status
+	}
+	if filter.PrinterID != "" {
+		selector["printer_id"] = filter.PrinterID
+	}
+	spools := []Spool{}
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: spoolSort}
+		if limit == 0 {
+			opts.Limit = 200
+		}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return spools, "", err
+		}
+		for _, doc := range found.Docs {
+			spool := Spool{}
+			if err := dbdriver.DecodeDocument(doc, &spool); err != nil {
+				return spools, "", err
+			}
+			spools = append(spools, spool)
+		}
+		if limit > 0 || len(found.Docs) < int(opts.Limit) {
+			return spools, found.Bookmark, nil
+		}
+		bookmark = found.Bookmark
+	}
+}
+
+// @info Changes a spool, e.g. its remaining filament after weighing it. Where it is loaded has its own function, see
+// LoadSpool.
+func UpdateSpool(client *dbdriver.CouchDBClient, id string, update *SpoolUpdate) (*Spool, error) {
+	return updateSpool(client, id, func(spool *Spool) error {
+		if update.Material != nil {
+			spool.Material = *update.Material
+		}
+		if update.Colour != nil {
+			spool.Colour = *update.Colour
+		}
+		if update.Brand != nil {
+			spool.Brand = *update.Brand
+		}
+		if update.DiameterMM != nil {
+			spool.DiameterMM = *update.DiameterMM
+		}
+		if update.DensityGCM3 != nil {
+			spool.DensityGCM3 = *update.DensityGCM3
+		}
+		if update.NetGrams != nil {
+			spool.NetGrams = *update.NetGrams
+		}
+		if update.RemainingGrams != nil {
+			spool.RemainingGrams = *update.RemainingGrams
+			// @info Weighing a spool decides whether it is empty, unless it was thrown away
+			if spool.Status != SpoolRetired {
+				spool.Status = SpoolActive
+			}
+		}
+		if update.CostPerKgCents != nil {
+			spool.CostPerKgCents = *update.CostPerKgCents
+		}
+		if update.Status != nil {
+			spool.Status = *update.Status
+		}
+		if update.Location != nil {
+			spool.Location = *update.Location
+		}
+		if update.Notes != nil {
+			spool.Notes = *update.Notes
+		}
+		if err := normalizeSpool(client, spool); err != nil {
+			return err
+		}
+		return checkSpool(spool)
+	})
+}
+
+// @info Loads an active spool on a printer, unloading the one it had, and sets the filament loaded on the printer
+// for the scheduler. An empty printerID unloads the spool.
+func LoadSpool(client *dbdriver.CouchDBClient, id string, printerID string) (*Spool, error) {
+	spool, err := GetSpool(client, id)
+	if err != nil {
+		return nil, err
+	}
+	if printerID == "" {
+		return updateSpool(client, id, func(spool *Spool) error {
+			spool.PrinterID = ""
+			return nil
+		})
+	}
+	if spool.Status != SpoolActive {
+		return nil, &dbdriver.ValidationError{DocType: SpoolDocType, Fields: []dbdriver.FieldError{{Field: "status", Message: "only active spools can be loaded"}}}
+	}
+	printer, err := GetPrinter(client, printerID)
+	if dbdriver.IsNotFound(err) || printer.Status == PrinterRetired {
+		return nil, &dbdriver.ValidationError{DocType: SpoolDocType, Fields: []dbdriver.FieldError{{Field: "printer_id", Message: "is not a printer in use"}}}
+	}
+	if err != nil {
+		return nil, err
+	}
+	loaded, _, err := ListSpools(client, &SpoolFilter{PrinterID: printerID}, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range loaded {
+		if other.ID == id {
+			continue
+		}
+		if _, err := updateSpool(client, other.ID, func(other *Spool) error {
+			if other.PrinterID == printerID {
+				other.PrinterID = ""
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	spool, err = updateSpool(client, id, func(spool *Spool) error {
+		spool.PrinterID = printerID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = updatePrinter(client, printerID, func(printer *Printer) error {
+		printer.LoadedMaterial = spool.Material
+		printer.LoadedColour = spool.Colour
+		return nil
+	})
+	return spool, err
+}
+
+// @info Takes the filament of a job that was done from the spools, and records what was taken on the job. The
+// spool loaded on its printer goes first, then the spools of the same material and colour with the least left.
+// Nothing is taken if neither the report nor the job say how much was used.
+func ConsumeFilament(client *dbdriver.CouchDBClient, job *PrintJob, reported *FilamentReport) error {
+	spools, err := jobSpools(client, job)
+	if err != nil {
+		return err
+	}
+	usage := &FilamentUsage{Grams: job.Grams, Source: UsageEstimated, Spools: []SpoolDraw{}}
+	switch {
+	case reported != nil && reported.Grams > 0:
+		usage.Grams, usage.Source = reported.Grams, UsageReported
+	case reported != nil && reported.MM > 0:
+		diameter, density := 1.75, defaultDensity
+		if len(spools) > 0 {
+			diameter, density = spools[0].DiameterMM, spools[0].DensityGCM3
+		}
+		radius := diameter / 2
+		usage.Grams, usage.Source = reported.MM*math.Pi*radius*radius/1000*density, UsageReported
+	}
+	usage.Grams = math.Round(usage.Grams*10) / 10
+	if usage.Grams <= 0 {
+		return nil
+	}
+	left := usage.Grams
+	for _, spool := range spools {
+		if left <= 0 {
+			break
+		}
+		taken := 0.0
+		_, err := updateSpool(client, spool.ID, func(spool *Spool) error {
+			taken = math.Min(left, spool.RemainingGrams)
+			spool.RemainingGrams = math.Round((spool.RemainingGrams-taken)*10) / 10
+			if spool.RemainingGrams <= 0 && spool.Status == SpoolActive {
+				spool.Status = SpoolEmpty
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			usage.Spools = append(usage.Spools, SpoolDraw{SpoolID: spool.ID, Grams: math.Round(taken*10) / 10})
+			left -= taken
+		}
+	}
+	usage.MissingGrams = math.Round(math.Max(left, 0)*10) / 10
+	job.Usage = usage
+	return savePrintJob(client, job)
+}
+
+// @info Active spools a job may have used, in the order ConsumeFilament takes from them. A job of no particular
+// material can only have used the spool loaded on its printer.
+func jobSpools(client *dbdriver.CouchDBClient, job *PrintJob) ([]Spool, error) {
+	active, _, err := ListSpools(client, &SpoolFilter{Status: SpoolActive}, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	spools := []Spool{}
+	for _, spool := range active {
+		if spool.RemainingGrams <= 0 {
+			continue
+		}
+		if job.Material == "" {
+			if spool.PrinterID == job.PrinterID {
+				spools = append(spools, spool)
+			}
+			continue
+		}
+		if str.EqualFold(spool.Material, job.Material) && (job.Colour == "" || str.EqualFold(spool.Colour, job.Colour)) {
+			spools = append(spools, spool)
+		}
+	}
+	sort.SliceStable(spools, func(i, j int) bool {
+		loadedI, loadedJ := spools[i].PrinterID == job.PrinterID, spools[j].PrinterID == job.PrinterID
+		if loadedI != loadedJ {
+			return loadedI
+		}
+		return spools[i].RemainingGrams < spools[j].RemainingGrams
+	})
+	return spools, nil
+}
+
+// @info Sets the threshold of a material and colour, replacing the one it had
+func SetMaterialThreshold(client *dbdriver.CouchDBClient, threshold *MaterialThreshold) error {
+	threshold.Material = str.TrimSpace(threshold.Material)
+	threshold.Colour = str.TrimSpace(threshold.Colour)
+	threshold.ID = materialThresholdID(threshold.Material, threshold.Colour)
+	threshold.Type = MaterialThresholdDocType
+	threshold.UpdatedAt = time.Now().UTC()
+	if threshold.TargetGrams > 0 && threshold.TargetGrams < threshold.MinGrams {
+		return &dbdriver.ValidationError{DocType: MaterialThresholdDocType, Fields: []dbdriver.FieldError{{Field: "target_grams", Message: "must not be under min_grams"}}}
+	}
+	doc, err := dbdriver.EncodeDocument(threshold)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	current, err := dbdriver.GetDocument(client, threshold.ID)
+	if err == nil {
+		doc["_rev"] = current["_rev"]
+	} else if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, threshold.ID)
+	if err != nil {
+		return err
+	}
+	threshold.Rev = resp_data.REV
+	return nil
+}
+
+// @info Removes the threshold of a material and colour, MATERIALS_LOW_STOCK_GRAMS applies again
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if it had none
+func DeleteMaterialThreshold(client *dbdriver.CouchDBClient, material string, colour string) (*MaterialThreshold, error) {
+	threshold := &MaterialThreshold{}
+	doc, err := dbdriver.GetDocument(client, materialThresholdID(str.TrimSpace(material), str.TrimSpace(colour)))
+	if err != nil {
+		return nil, err
+	}
+	if err := dbdriver.DecodeDocument(doc, threshold); err != nil {
+		return nil, err
+	}
+	if threshold.Type != MaterialThresholdDocType {
+		return nil, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a material threshold"}
+	}
+	_, err = dbdriver.DeleteDocument(client, threshold.ID, threshold.Rev)
+	return threshold, err
+}
+
+// @info Every threshold, by material and colour
+func ListMaterialThresholds(client *dbdriver.CouchDBClient) ([]MaterialThreshold, error) {
+	thresholds := []MaterialThreshold{}
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{Selector: map[string]interface{}{"type": MaterialThresholdDocType}, Limit: 200, Bookmark: bookmark}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return thresholds, err
+		}
+		for _, doc := range found.Docs {
+			threshold := MaterialThreshold{}
+			if err := dbdriver.DecodeDocument(doc, &threshold); err != nil {
+				return thresholds, err
+			}
+			thresholds = append(thresholds, threshold)
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			break
+		}
+		bookmark = found.Bookmark
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i].ID < thresholds[j].ID })
+	return thresholds, nil
+}
+
+// @info Stock of every material and colour that has active spools, a threshold or planned jobs, by material and
+// colour. Jobs of no particular colour count against every spool of their material.
+func ListMaterialStock(client *dbdriver.CouchDBClient, cfg *config.MaterialsConfig) ([]MaterialStock, error) {
+	spools, _, err := ListSpools(client, &SpoolFilter{Status: SpoolActive}, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	thresholds, err := ListMaterialThresholds(client)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := findPrintJobs(client, map[string]interface{}{"status": map[string]interface{}{"$in": activeJobStatuses}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := map[string]*MaterialStock{}
+	row := func(material string, colour string) *MaterialStock {
+		key := stockKey(material, colour)
+		if rows[key] == nil {
+			rows[key] = &MaterialStock{Material: material, Colour: colour, MinGrams: cfg.LowStockGrams}
+		}
+		return rows[key]
+	}
+	materialGrams, materialPlanned := map[string]float64{}, map[string]float64{}
+	for _, spool := range spools {
+		stock := row(spool.Material, spool.Colour)
+		stock.Spools++
+		stock.RemainingGrams += spool.RemainingGrams
+		stock.ValueCents += int64(math.Round(spool.RemainingGrams / 1000 * float64(spool.CostPerKgCents)))
+		materialGrams[str.ToLower(spool.Material)] += spool.RemainingGrams
+	}
+	for _, job := range jobs {
+		if job.Material == "" || job.Grams <= 0 {
+			continue
+		}
+		row(job.Material, job.Colour).PlannedGrams += job.Grams
+		materialPlanned[str.ToLower(job.Material)] += job.Grams
+	}
+	for _, threshold := range thresholds {
+		stock := row(threshold.Material, threshold.Colour)
+		stock.MinGrams, stock.TargetGrams = threshold.MinGrams, threshold.TargetGrams
+	}
+
+	stocks := []MaterialStock{}
+	for _, stock := range rows {
+		available := stock.RemainingGrams - stock.PlannedGrams
+		if stock.Colour == "" {
+			material := str.ToLower(stock.Material)
+			available = materialGrams[material] - materialPlanned[material]
+		}
+		if stock.TargetGrams == 0 {
+			stock.TargetGrams = stock.MinGrams + cfg.SpoolGrams
+		}
+		stock.RemainingGrams = math.Round(stock.RemainingGrams*10) / 10
+		stock.PlannedGrams = math.Round(stock.PlannedGrams*10) / 10
+		stock.Low = available < stock.MinGrams
+		stocks = append(stocks, *stock)
+	}
+	sort.Slice(stocks, func(i, j int) bool {
+		return stockKey(stocks[i].Material, stocks[i].Colour) < stockKey(stocks[j].Material, stocks[j].Colour)
+	})
+	return stocks, nil
+}
+
+// @info Spools to buy for every material and colour that is low, sized like the last spool of it that was bought
+func SuggestPurchases(client *dbdriver.CouchDBClient, cfg *config.MaterialsConfig) ([]PurchaseSuggestion, error) {
+	stocks, err := ListMaterialStock(client, cfg)
+	if err != nil {
+		return nil, err
+	}
+	all, _, err := ListSpools(client, &SpoolFilter{}, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	// @info The last spool bought of each material and colour, and of each material
+	latest := map[string]Spool{}
+	for _, spool := range all {
+		for _, key := range []string{stockKey(spool.Material, spool.Colour), str.ToLower(spool.Material)} {
+			if last, ok := latest[key]; !ok || spool.CreatedAt.After(last.CreatedAt) {
+				latest[key] = spool
+			}
+		}
+	}
+
+	suggestions := []PurchaseSuggestion{}
+	for _, stock := range stocks {
+		if !stock.Low {
+			continue
+		}
+		suggestion := PurchaseSuggestion{Material: stock.Material, Colour: stock.Colour, SpoolGrams: cfg.SpoolGrams}
+		last, ok := latest[stockKey(stock.Material, stock.Colour)]
+		if !ok {
+			last, ok = latest[str.ToLower(stock.Material)]
+		}
+		if ok && last.NetGrams > 0 {
+			suggestion.Brand, suggestion.SpoolGrams = last.Brand, last.NetGrams
+		}
+		suggestion.MissingGrams = math.Round((stock.TargetGrams+stock.PlannedGrams-stock.RemainingGrams)*10) / 10
+		if suggestion.MissingGrams <= 0 {
+			continue
+		}
+		suggestion.Spools = int(math.Ceil(suggestion.MissingGrams / suggestion.SpoolGrams))
+		if ok {
+			suggestion.EstimatedCents = int64(math.Round(float64(suggestion.Spools) * suggestion.SpoolGrams / 1000 * float64(last.CostPerKgCents)))
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	return suggestions, nil
+}
+
+// @info Whether the active spools of a material, of any colour, hold grams of filament
+func MaterialInStock(client *dbdriver.CouchDBClient, material string, grams float64) (bool, error) {
+	spools, _, err := ListSpools(client, &SpoolFilter{Status: SpoolActive}, 0, "")
+	if err != nil {
+		return false, err
+	}
+	remaining := 0.0
+	for _, spool := range spools {
+		if str.EqualFold(spool.Material, material) {
+			remaining += spool.RemainingGrams
+		}
+	}
+	return remaining > 0 && remaining >= grams, nil
+}
+
+// @info Read-modify-write of a spool with conflict retries, see dbdriver.UpdateDocument
+func updateSpool(client *dbdriver.CouchDBClient, id string, mutate func(spool *Spool) error) (*Spool, error) {
+	spool := &Spool{}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		spool = &Spool{}
+		if err := dbdriver.DecodeDocument(doc, spool); err != nil {
+			return err
+		}
+		if spool.Type != SpoolDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a spool"}
+		}
+		if err := mutate(spool); err != nil {
+			return err
+		}
+		spool.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(spool)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetSpool(client, id)
+}
+
+// @info Trims the names, takes the density of the material from the tariffs when not given and marks spools without
+// filament left as empty
+func normalizeSpool(client *dbdriver.CouchDBClient, spool *Spool) error {
+	spool.Material = str.TrimSpace(spool.Material)
+	spool.Colour = str.TrimSpace(spool.Colour)
+	spool.Brand = str.TrimSpace(spool.Brand)
+	if spool.DiameterMM == 0 {
+		spool.DiameterMM = 1.75
+	}
+	if spool.DensityGCM3 == 0 {
+		spool.DensityGCM3 = defaultDensity
+		rules, err := GetCurrentPricingRules(client)
+		if err != nil && !dbdriver.IsNotFound(err) {
+			return err
+		}
+		if rules != nil {
+			for name, rate := range rules.Rules.Materials {
+				if str.EqualFold(name, spool.Material) && rate.DensityGCM3 > 0 {
+					spool.DensityGCM3 = rate.DensityGCM3
+				}
+			}
+		}
+	}
+	if spool.RemainingGrams <= 0 && spool.Status == SpoolActive {
+		spool.Status = SpoolEmpty
+	}
+	if spool.Status != SpoolActive {
+		spool.PrinterID = ""
+	}
+	return nil
+}
+
+func checkSpool(spool *Spool) error {
+	fields := []dbdriver.FieldError{}
+	if !(spool.DiameterMM > 0 && spool.DiameterMM <= 5) {
+		fields = append(fields, dbdriver.FieldError{Field: "diameter_mm", Message: "must be between 0 and 5 mm"})
+	}
+	if !(spool.DensityGCM3 > 0 && spool.DensityGCM3 <= 5) {
+		fields = append(fields, dbdriver.FieldError{Field: "density_g_cm3", Message: "must be between 0 and 5 g/cm³"})
+	}
+	if !(spool.NetGrams > 0) || math.IsInf(spool.NetGrams, 0) {
+		fields = append(fields, dbdriver.FieldError{Field: "net_grams", Message: "must be positive"})
+	}
+	if !(spool.RemainingGrams >= 0) || math.IsInf(spool.RemainingGrams, 0) {
+		fields = append(fields, dbdriver.FieldError{Field: "remaining_grams", Message: "must not be negative"})
+	}
+	if !IsSpoolStatus(spool.Status) {
+		fields = append(fields, dbdriver.FieldError{Field: "status", Message: "must be one of active, empty, retired"})
+	}
+	if len(fields) > 0 {
+		return &dbdriver.ValidationError{DocType: SpoolDocType, Fields: fields}
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/gcode"
+	"3DQuest/geometry"
+	"3DQuest/quote"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	str "strings"
+	"time"
+)
+
+const OrderDocType = "order"
+
+type OrderStatus string
+
+const (
+	OrderDraft          OrderStatus = "draft"           // Being put together by the customer
+	OrderQuoted         OrderStatus = "quoted"          // Priced, waiting for the customer
+	OrderAccepted       OrderStatus = "accepted"        // The customer agreed to the price
+	OrderQueued         OrderStatus = "queued"          // Waiting for a printer
+	OrderPrinting       OrderStatus = "printing"        // On a printer
+	OrderPostProcessing OrderStatus = "post_processing" // Support removal, curing, sanding...
+	OrderReady          OrderStatus = "ready"           // Waiting to be shipped or collected
+	OrderShipped        OrderStatus = "shipped"
+	OrderCollected      OrderStatus = "collected"
+	OrderCancelled      OrderStatus = "cancelled"
+	OrderFailed         OrderStatus = "failed" // The print failed, it is either reprinted or cancelled
+	OrderReprint        OrderStatus = "reprint"
+)
+
+// @info Who is moving an order. Customers can only move their own orders.
+type OrderActor string
+
+const (
+	ActorCustomer OrderActor = "customer"
+	ActorStaff    OrderActor = "staff"  // Operators and admins
+	ActorSystem   OrderActor = "system" // The backend itself, e.g. the quote engine or the print scheduler
+)
+
+// @info Allowed transitions: current status => next status => who may make it. Staff may always do what the system does.
+var orderTransitions = map[OrderStatus]map[OrderStatus][]OrderActor{
+	OrderDraft: {
+		OrderQuoted:    {ActorStaff, ActorSystem},
+		OrderCancelled: {ActorCustomer, ActorStaff},
+	},
+	OrderQuoted: {
+		OrderAccepted:  {ActorSystem},               // Once paid, see PayCart. Staff can accept an order paid some other way
+		OrderDraft:     {ActorCustomer, ActorStaff}, // To change the items, which needs a new quote
+		OrderCancelled: {ActorCustomer, ActorStaff, ActorSystem},
+	},
+	OrderAccepted: {
+		OrderQueued:    {ActorStaff, ActorSystem},
+		OrderCancelled: {ActorCustomer, ActorStaff},
+	},
+	OrderQueued: {
+		OrderPrinting:  {ActorStaff, ActorSystem},
+		OrderCancelled: {ActorStaff},
+	},
+	OrderPrinting: {
+		OrderPostProcessing: {ActorStaff, ActorSystem},
+		OrderReady:          {ActorStaff, ActorSystem}, // Nothing to post-process
+		OrderFailed:         {ActorStaff, ActorSystem},
+	},
+	OrderPostProcessing: {
+		OrderReady:  {ActorStaff},
+		OrderFailed: {ActorStaff},
+	},
+	OrderFailed: {
+		OrderReprint:   {ActorStaff},
+		OrderCancelled: {ActorStaff},
+	},
+	OrderReprint: {
+		OrderQueued: {ActorStaff, ActorSystem},
+	},
+	OrderReady: {
+		OrderShipped:   {ActorStaff, ActorSystem}, // The carrier picked up its parcel, see RecordShipmentEvents
+		OrderCollected: {ActorStaff, ActorSystem},
+	},
+}
+
+type OrderItem struct {
+	Name           string             `json:"name" validate:"required,minlen=1,maxlen=256"` // Usually the file name of the model
+	File           string             `json:"file,omitempty"`                               // Attachment holding the model, see AttachOrderModel
+	Material       string             `json:"material,omitempty"`                           // e.g. PLA, PETG, resin
+	Colour         string             `json:"colour,omitempty"`
+	Quantity       int                `json:"quantity" validate:"min=1"`
+	InfillPercent  float64            `json:"infill_percent,omitempty"`  // Zero takes the default of the tariffs
+	LayerHeightMM  float64            `json:"layer_height_mm,omitempty"` // Zero takes the default of the tariffs
+	PostProcessing []string           `json:"post_processing,omitempty"` // Extras of the tariffs, e.g. sanding
+	Notes          string             `json:"notes,omitempty" validate:"maxlen=2048"`
+	Model          *geometry.Analysis `json:"model,omitempty"` // Analysis of File when it is a model, set by the backend
+	GCode          *gcode.Analysis    `json:"gcode,omitempty"` // Analysis of File when it is sliced G-code, set by the backend
+}
+
+// @info An uploaded model (STL, OBJ, 3MF) or G-code, analysed. Exactly one of Model and GCode is set.
+type ModelUpload struct {
+	Filename string
+	Data     []byte
+	Model    *geometry.Analysis
+	GCode    *gcode.Analysis
+}
+
+type OrderEvent struct {
+	From    OrderStatus `json:"from"`
+	To      OrderStatus `json:"to"`
+	Actor   OrderActor  `json:"actor"`
+	ActorID string      `json:"actor_id,omitempty"`
+	Note    string      `json:"note,omitempty"`
+	At      time.Time   `json:"at"`
+}
+
+type Order struct {
+	ID          string                    `json:"_id"`
+	Rev         string                    `json:"_rev,omitempty"`
+	Type        string                    `json:"type" validate:"required"`
+	CustomerID  string                    `json:"customer_id" validate:"required"`
+	Status      OrderStatus               `json:"status" validate:"required"`
+	Items       []OrderItem               `json:"items"`
+	Notes       string                    `json:"notes,omitempty" validate:"maxlen=4096"`
+	TotalCents  int64                     `json:"total_cents" validate:"min=0"` // Price quoted, VAT included
+	Quote       *quote.Quote              `json:"quote,omitempty"`              // Breakdown of TotalCents when it was quoted automatically
+	Reprints    int                       `json:"reprints" validate:"min=0"`    // Times the order went through reprint
+	DueAt       *time.Time                `json:"due_at,omitempty"`             // When the customer needs it, the scheduler plans it first
+	CheckoutID  string                    `json:"checkout_id,omitempty"`        // Checkout paying for it, see PayCart
+	Delivery    *OrderDelivery            `json:"delivery,omitempty"`           // Chosen before paying, see SetOrderDelivery
+	ShipmentID  string                    `json:"shipment_id,omitempty"`        // Made once ready, see CreateShipment
+	InvoiceID   string                    `json:"invoice_id,omitempty"`         // Issued once shipped or collected, see IssueInvoice
+	StatusTimes map[OrderStatus]time.Time `json:"status_times"`                 // Last time the order entered each status
+	History     []OrderEvent              `json:"history"`
+	CreatedAt   time.Time                 `json:"created_at" validate:"required"`
+	UpdatedAt   time.Time                 `json:"updated_at" validate:"required"`
+
+	Attachments map[string]dbdriver.Attachment `json:"_attachments,omitempty"` // The models, kept so updates do not drop them
+}
+
+// @info Filters of ListOrders. Empty fields match every order.
+type OrderFilter struct {
+	CustomerID string
+	Status     OrderStatus
+}
+
+// @info A change of status, see TransitionOrder
+type OrderTransition struct {
+	To         OrderStatus  `json:"to"`
+	Note       string       `json:"note"`
+	TotalCents *int64       `json:"total_cents"` // Price, required when moving to quoted
+	Quote      *quote.Quote `json:"-"`           // Breakdown of the price, when quoted automatically
+	Actor      OrderActor   `json:"-"`
+	ActorID    string       `json:"-"`
+
+	checkoutID string // Checkout that paid for the order, see acceptCheckoutOrders
+}
+
+// @info Returned when an order can't go from one status to another, or not by that actor
+type TransitionError struct {
+	From   OrderStatus
+	To     OrderStatus
+	Reason string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("An order can't go from %s to %s: %s", e.From, e.To, e.Reason)
+}
+
+var orderSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"created_at": "desc"}}
+var customerOrderSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"customer_id": "desc"}, map[string]string{"created_at": "desc"}}
+
+func IsOrderStatus(status OrderStatus) bool {
+	_, ok := orderTransitions[status]
+	return ok || status == OrderShipped || status == OrderCollected || status == OrderCancelled
+}
+
+// @info Whether the order can't change anymore
+func (o *Order) IsClosed() bool {
+	return len(orderTransitions[o.Status]) == 0
+}
+
+// @info Statuses the actor may move the order to
+func (o *Order) NextStatuses(actor OrderActor) []OrderStatus {
+	next := []OrderStatus{}
+	for _, status := range orderStatuses {
+		if canTransition(o.Status, status, actor) {
+			next = append(next, status)
+		}
+	}
+	return next
+}
+
+// @info Every status in lifecycle order, so NextStatuses is stable
+var orderStatuses = []OrderStatus{
+	OrderDraft, OrderQuoted, OrderAccepted, OrderQueued, OrderPrinting, OrderPostProcessing, OrderReady,
+	OrderShipped, OrderCollected, OrderCancelled, OrderFailed, OrderReprint,
+}
+
+func canTransition(from OrderStatus, to OrderStatus, actor OrderActor) bool {
+	for _, allowed := range orderTransitions[from][to] {
+		if allowed == actor || (actor == ActorStaff && allowed == ActorSystem) {
+			return true
+		}
+	}
+	return false
+}
+
+// @info Stores a new draft order for the customer, filling in its ID and revision
+func CreateOrder(client *dbdriver.CouchDBClient, order *Order) error {
+	if err := checkOrderItems(order.Items); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	order.Type = OrderDocType
+	order.Status = OrderDraft
+	order.TotalCents = 0
+	order.Quote = nil
+	order.Attachments = nil
+	for i := range order.Items {
+		order.Items[i].File = "" // @info Models are uploaded afterwards, see AttachOrderModel
+		order.Items[i].Model = nil
+		order.Items[i].GCode = nil
+	}
+	order.Reprints = 0
+	order.StatusTimes = map[OrderStatus]time.Time{OrderDraft: now}
+	order.History = []OrderEvent{}
+	order.CreatedAt = now
+	order.UpdatedAt = now
+	doc, err := dbdriver.EncodeDocument(order)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, order.ID)
+	if err != nil {
+		return err
+	}
+	order.ID = resp_data.ID
+	order.Rev = resp_data.REV
+	return nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no order with that ID
+func GetOrder(client *dbdriver.CouchDBClient, id string) (*Order, error) {
+	order := &Order{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return order, err
+	}
+	if err = dbdriver.DecodeDocument(doc, order); err != nil {
+		return order, err
+	}
+	if order.Type != OrderDocType {
+		return order, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not an order"}
+	}
+	return order, nil
+}
+
+// @info Newest orders first. Pass the returned bookmark to get the next page.
+func ListOrders(client *dbdriver.CouchDBClient, filter *OrderFilter, limit uint64, bookmark string) ([]Order, string, error) {
+	selector := map[string]interface{}{"type": OrderDocType}
+	sort := orderSort
+	if filter.CustomerID != "" {
+		selector["customer_id"] = filter.CustomerID
+		sort = customerOrderSort
+	}
+	if filter.Status != "" {
+		selector["status"] = filter.Status
+	}
+	opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: sort}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	orders := []Order{}
+	if err != nil {
+		return orders, "", err
+	}
+	for _, doc := range found.Docs {
+		order := Order{}
+		if err := dbdriver.DecodeDocument(doc, &order); err != nil {
+			return orders, "", err
+		}
+		orders = append(orders, order)
+	}
+	return orders, found.Bookmark, nil
+}
+
+// @info Replaces the items, notes and due date of a draft order
+func UpdateOrderItems(client *dbdriver.CouchDBClient, id string, items []OrderItem, notes string, dueAt *time.Time) (*Order, error) {
+	if err := checkOrderItems(items); err != nil {
+		return nil, err
+	}
+	return updateOrder(client, id, func(order *Order) error {
+		if order.Status != OrderDraft {
+			return &TransitionError{From: order.Status, To: OrderDraft, Reason: "only draft orders can be edited"}
+		}
+		// @info The models can't be set here: items keep the analysis of their file, see AttachOrderModel
+		analysed := map[string]OrderItem{}
+		for _, item := range order.Items {
+			analysed[item.File] = item
+		}
+		for i := range items {
+			items[i].Model, items[i].GCode = nil, nil
+			if _, stored := order.Attachments[items[i].File]; !stored {
+				items[i].File = ""
+				continue
+			}
+			items[i].Model = analysed[items[i].File].Model
+			items[i].GCode = analysed[items[i].File].GCode
+		}
+		order.Items = items
+		order.Notes = notes
+		order.DueAt = dueAt
+		order.pruneModels()
+		return nil
+	})
+}
+
+// @info Moves the order to another status, recording when and who did it. Orders with a delivery get their shipment
+// once ready.
+// @error A *TransitionError if the transition is not allowed for the actor
+func TransitionOrder(client *dbdriver.CouchDBClient, id string, transition *OrderTransition) (*Order, error) {
+	order, err := updateOrder(client, id, func(order *Order) error {
+		return order.apply(transition)
+	})
+	if err != nil || order.Status != OrderReady || order.Delivery == nil || order.ShipmentID != "" {
+		return order, err
+	}
+	if _, err := CreateShipment(client, order.ID); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: couldn't make the shipment of order", order.ID+":", err)
+		return order, nil
+	}
+	return GetOrder(client, id)
+}
+
+func (o *Order) apply(transition *OrderTransition) error {
+	from := o.Status
+	if !canTransition(from, transition.To, transition.Actor) {
+		return &TransitionError{From: from, To: transition.To, Reason: fmt.Sprintf("not allowed for %s", transition.Actor)}
+	}
+	if o.CheckoutID != "" && from == OrderQuoted && (transition.To != OrderAccepted || transition.checkoutID != o.CheckoutID) {
+		return &TransitionError{From: from, To: transition.To, Reason: "the order is being paid, cancel its checkout first"}
+	}
+	switch transition.To {
+	case OrderQuoted:
+		if transition.TotalCents == nil || *transition.TotalCents < 0 {
+			return &TransitionError{From: from, To: transition.To, Reason: "a price is required"}
+		}
+		o.TotalCents = *transition.TotalCents
+		o.Quote = transition.Quote
+	case OrderDraft:
+		o.TotalCents = 0 // @info The quote is no longer valid, and so is the parcel priced with it
+		o.Quote = nil
+		o.Delivery = nil
+	case OrderReprint:
+		o.Reprints++
+	}
+	now := time.Now().UTC()
+	o.Status = transition.To
+	o.StatusTimes[transition.To] = now
+	o.History = append(o.History, OrderEvent{
+		From:    from,
+		To:      transition.To,
+		Actor:   transition.Actor,
+		ActorID: transition.ActorID,
+		Note:    transition.Note,
+		At:      now,
+	})
+	return nil
+}
+
+// @info Prices a draft order with the tariffs in force and the discount of its customer, and moves it to quoted.
+// The quote is made from the items as they are when the order is written, so a concurrent edit can't go unpriced.
+// @error A *TransitionError if the order is not a draft, quote.ErrUnknownMaterial, quote.ErrUnknownExtra or
+// quote.ErrInvalidSettings (e.g. an item without a model) if it can't be priced
+func QuoteOrder(client *dbdriver.CouchDBClient, id string, actorID string) (*Order, error) {
+	order, err := GetOrder(client, id)
+	if err != nil {
+		return nil, err
+	}
+	customer, err := GetUser(client, order.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := GetCurrentPricingRules(client)
+	if err != nil {
+		return nil, err
+	}
+	return updateOrder(client, id, func(order *Order) error {
+		if order.Status != OrderDraft {
+			return &TransitionError{From: order.Status, To: OrderQuoted, Reason: "only draft orders can be quoted"}
+		}
+		items := make([]quote.Item, len(order.Items))
+		for i, item := range order.Items {
+			items[i] = quote.Item{
+				Name:           item.Name,
+				Model:          item.Model,
+				GCode:          item.GCode,
+				Material:       item.Material,
+				InfillPercent:  item.InfillPercent,
+				LayerHeightMM:  item.LayerHeightMM,
+				Quantity:       item.Quantity,
+				PostProcessing: item.PostProcessing,
+			}
+		}
+		q, err := quote.Calculate(&current.Rules, items, customer.Type)
+		if err != nil {
+			return err
+		}
+		q.RulesVersion = current.Version
+		return order.apply(&OrderTransition{
+			To:         OrderQuoted,
+			Note:       fmt.Sprintf("Automatic quote with tariffs v%d", current.Version),
+			TotalCents: &q.TotalCents,
+			Quote:      q,
+			Actor:      ActorSystem,
+			ActorID:    actorID,
+		})
+	})
+}
+
+// @info Stores the model (or G-code) of an item as an attachment of the draft order, together with its analysis.
+// Identical files are stored once, the attachment is named after the hash of the content. The file and the item
+// referring to it are written in one revision, so a concurrent edit of the items can't prune one without the other.
+func AttachOrderModel(client *dbdriver.CouchDBClient, id string, index int, upload *ModelUpload) (*Order, error) {
+	sum := sha256.Sum256(upload.Data)
+	name := orderModelPrefix + hex.EncodeToString(sum[:8]) + str.ToLower(path.Ext(upload.Filename))
+	return updateOrder(client, id, func(order *Order) error {
+		if order.Status != OrderDraft {
+			return &TransitionError{From: order.Status, To: OrderDraft, Reason: "only draft orders can be edited"}
+		}
+		if index < 0 || index >= len(order.Items) {
+			return &dbdriver.ValidationError{DocType: OrderDocType, Fields: []dbdriver.FieldError{{Field: "items", Message: fmt.Sprintf("there is no item %d", index)}}}
+		}
+		if _, stored := order.Attachments[name]; !stored {
+			if order.Attachments == nil {
+				order.Attachments = map[string]dbdriver.Attachment{}
+			}
+			order.Attachments[name] = dbdriver.Attachment{ContentType: "application/octet-stream", Data: upload.Data}
+		}
+		order.Items[index].File = name
+		order.Items[index].Model = upload.Model
+		order.Items[index].GCode = upload.GCode
+		order.pruneModels()
+		return nil
+	})
+}
+
+// @info Attachments holding the models of the items
+const orderModelPrefix = "model-"
+
+// @info Drops the model attachments no item refers to anymore
+func (o *Order) pruneModels() {
+	used := map[string]bool{}
+	for _, item := range o.Items {
+		used[item.File] = true
+	}
+	for name := range o.Attachments {
+		if str.HasPrefix(name, orderModelPrefix) && !used[name] {
+			delete(o.Attachments, name)
+		}
+	}
+}
+
+// @info Read-modify-write of an order with conflict retries, see dbdriver.UpdateDocument
+func updateOrder(client *dbdriver.CouchDBClient, id string, mutate func(order *Order) error) (*Order, error) {
+	order := &Order{}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		order = &Order{}
+		if err := dbdriver.DecodeDocument(doc, order); err != nil {
+			return err
+		}
+		if order.Type != OrderDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not an order"}
+		}
+		if order.StatusTimes == nil {
+			order.StatusTimes = map[OrderStatus]time.Time{}
+		}
+		if err := mutate(order); err != nil {
+			return err
+		}
+		order.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(order)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetOrder(client, id)
+}
+
+func checkOrderItems(items []OrderItem) error {
+	if len(items) == 0 {
+		return &dbdriver.ValidationError{DocType: OrderDocType, Fields: []dbdriver.FieldError{{Field: "items", Message: "must have at least 1 elements"}}}
+	}
+	for i, item := range items {
+		if item.Quantity < 1 {
+			return &dbdriver.ValidationError{DocType: OrderDocType, Fields: []dbdriver.FieldError{{Field: fmt.Sprintf("items.%d.quantity", i), Message: "must be at least 1"}}}
+		}
+		if item.Name == "" {
+			return &dbdriver.ValidationError{DocType: OrderDocType, Fields: []dbdriver.FieldError{{Field: fmt.Sprintf("items.%d.name", i), Message: "is required"}}}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,638 @@
+package models
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/payment"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	PaymentDocType      = "payment"
+	PaymentEventDocType = "payment_event"
+)
+
+type PaymentPurpose string
+
+const (
+	PaymentForCheckout PaymentPurpose = "checkout" // A checkout paid by card
+	PaymentForTopUp    PaymentPurpose = "top_up"   // Credits bought by card
+)
+
+type PaymentStatus string
+
+const (
+	PaymentPending    PaymentStatus = "pending"    // Waiting for the customer
+	PaymentAuthorized PaymentStatus = "authorized" // Waiting to be captured, see PAYMENT_MANUAL_CAPTURE
+	PaymentSucceeded  PaymentStatus = "succeeded"
+	PaymentFailed     PaymentStatus = "failed" // The last attempt was declined, the customer may try again
+	PaymentCanceled   PaymentStatus = "canceled"
+)
+
+type PaymentEventStatus string
+
+const (
+	PaymentEventReceived  PaymentEventStatus = "received"
+	PaymentEventProcessed PaymentEventStatus = "processed"
+	PaymentEventIgnored   PaymentEventStatus = "ignored" // Not about a payment of this backend, or of a type it does not need
+	PaymentEventFailed    PaymentEventStatus = "failed"  // Processed again when the provider retries it
+)
+
+type PaymentRefund struct {
+	ID          string    `json:"id"` // Of the provider
+	AmountCents int64     `json:"amount_cents"`
+	Reason      string    `json:"reason,omitempty"`
+	ActorID     string    `json:"actor_id,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+// @info A payment intent of the provider, and what it paid for. The ID is derived from the intent, so events of the
+// provider find it straight away.
+type Payment struct {
+	ID             string          `json:"_id"`
+	Rev            string          `json:"_rev,omitempty"`
+	Type           string          `json:"type" validate:"required"`
+	Provider       payment.Kind    `json:"provider" validate:"required"`
+	IntentID       string          `json:"intent_id" validate:"required"`
+	Purpose        PaymentPurpose  `json:"purpose" validate:"required,enum=checkout|top_up"`
+	CheckoutID     string          `json:"checkout_id,omitempty"`
+	UserID         string          `json:"user_id" validate:"required"`
+	AmountCents    int64           `json:"amount_cents" validate:"min=1"`
+	CapturedCents  int64           `json:"captured_cents" validate:"min=0"`
+	RefundedCents  int64           `json:"refunded_cents" validate:"min=0"`
+	CreditedCents  int64           `json:"credited_cents" validate:"min=0"` // Turned into credits of the user: top-ups, and payments of checkouts that were no longer awaiting them
+	DebitedCents   int64           `json:"debited_cents" validate:"min=0"`  // Credits taken back because they were refunded
+	Currency       string          `json:"currency" validate:"required"`
+	Status         PaymentStatus   `json:"status" validate:"required,enum=pending|authorized|succeeded|failed|canceled"`
+	FailureMessage string          `json:"failure_message,omitempty"`
+	Refunds        []PaymentRefund `json:"refunds"`
+	Reconciled     bool            `json:"reconciled"`        // What it paid for was given, see ReconcilePayments
+	Problem        string          `json:"problem,omitempty"` // Why it could not be reconciled, for the staff to sort out
+	CreatedAt      time.Time       `json:"created_at" validate:"required"`
+	UpdatedAt      time.Time       `json:"updated_at" validate:"required"`
+}
+
+// @info An event received from the provider. The ID is derived from the event, so each one is only processed once
+// however many times it is delivered.
+type PaymentEvent struct {
+	ID          string             `json:"_id"`
+	Rev         string             `json:"_rev,omitempty"`
+	Type        string             `json:"type" validate:"required"`
+	Provider    payment.Kind       `json:"provider" validate:"required"`
+	Event       *payment.Event     `json:"event" validate:"required"`
+	Status      PaymentEventStatus `json:"status" validate:"required,enum=received|processed|ignored|failed"`
+	Error       string             `json:"error,omitempty"`
+	Attempts    int                `json:"attempts"`
+	ReceivedAt  time.Time          `json:"received_at" validate:"required"`
+	ProcessedAt *time.Time         `json:"processed_at,omitempty"`
+}
+
+// @info Filters of ListPayments. Empty fields match every payment.
+type PaymentFilter struct {
+	UserID     string
+	CheckoutID string
+	Status     PaymentStatus
+}
+
+var paymentSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"created_at": "desc"}}
+var userPaymentSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"user_id": "desc"}, map[string]string{"created_at": "desc"}}
+
+// @info Returned by applyPaymentEvent for events that need nothing done
+var errEventIgnored = errors.New("ignored")
+
+func paymentID(intentID string) string {
+	return PaymentDocType + ":" + intentID
+}
+
+func IsPaymentStatus(status PaymentStatus) bool {
+	switch status {
+	case PaymentPending, PaymentAuthorized, PaymentSucceeded, PaymentFailed, PaymentCanceled:
+		return true
+	}
+	return false
+}
+
+// @info Asks the provider for the payment of a checkout awaiting it. Asking again for the same checkout answers the
+// same payment. The client secret lets the customer pay it, it is not stored.
+// @error ErrCheckoutClosed, a *dbdriver.ValidationError if the checkout is not paid by card, or a *payment.ProviderError
+func StartCheckoutPayment(ctx context.Context, client *dbdriver.CouchDBClient, provider payment.Provider, cfg *config.PaymentConfig, checkoutID string, userID string) (*Payment, string, error) {
+	checkout, err := GetCheckout(client, checkoutID)
+	if err != nil {
+		return nil, "", err
+	}
+	if checkout.CustomerID != userID {
+		return nil, "", &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a checkout of the user"}
+	}
+	if checkout.Status != CheckoutAwaitingPayment {
+		return nil, "", ErrCheckoutClosed
+	}
+	if checkout.PaymentMethod != PaymentExternal || checkout.TotalCents == 0 {
+		return nil, "", &dbdriver.ValidationError{DocType: PaymentDocType, Fields: []dbdriver.FieldError{{Field: "checkout_id", Message: "has nothing to pay by card"}}}
+	}
+	intent, err := provider.CreateIntent(ctx, &payment.IntentRequest{
+		AmountCents:    checkout.TotalCents,
+		Currency:       cfg.Currency,
+		Description:    "3DQuest checkout " + checkout.ID,
+		ManualCapture:  cfg.ManualCapture,
+		Metadata:       map[string]string{"purpose": string(PaymentForCheckout), "checkout_id": checkout.ID, "user_id": userID},
+		IdempotencyKey: checkout.ID,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := createPayment(client, provider.Kind(), intent, PaymentForCheckout, checkout.ID, userID)
+	return p, intent.ClientSecret, err
+}
+
+// @info Asks the provider for a payment buying credits. The credits are given once the payment succeeds. Requests of
+// the same user with the same idempotency key answer the same payment.
+// @error A *dbdriver.ValidationError if the amount is below PAYMENT_MIN_TOP_UP_CENTS, or a *payment.ProviderError
+func StartTopUpPayment(ctx context.Context, client *dbdriver.CouchDBClient, provider payment.Provider, cfg *config.PaymentConfig, userID string, amountCents int64, idempotencyKey string) (*Payment, string, error) {
+	if amountCents < cfg.MinTopUpCents {
+		return nil, "", &dbdriver.ValidationError{DocType: PaymentDocType, Fields: []dbdriver.FieldError{{Field: "top_up_cents", Message: fmt.Sprintf("must be at least %d", cfg.MinTopUpCents)}}}
+	}
+	req := &payment.IntentRequest{
+		AmountCents: amountCents,
+		Currency:    cfg.Currency,
+		Description: "3DQuest credits",
+		Metadata:    map[string]string{"purpose": string(PaymentForTopUp), "user_id": userID},
+	}
+	if idempotencyKey != "" {
+		req.IdempotencyKey = "top_up:" + userID + ":" + idempotencyKey
+	}
+	intent, err := provider.CreateIntent(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	p, err := createPayment(client, provider.Kind(), intent, PaymentForTopUp, "", userID)
+	return p, intent.ClientSecret, err
+}
+
+// @info Records an event of the provider and applies it to its payment. An event already processed is not applied
+// again; one that failed is, so the provider retrying it fixes what failed.
+// @error What made the event fail, the webhook must then answer an error so the provider retries it
+func HandlePaymentEvent(client *dbdriver.CouchDBClient, kind payment.Kind, event *payment.Event) (*PaymentEvent, error) {
+	id := PaymentEventDocType + ":" + string(kind) + ":" + event.ID
+	record, err := getPaymentEvent(client, id)
+	if dbdriver.IsNotFound(err) {
+		record = &PaymentEvent{ID: id, Type: PaymentEventDocType, Provider: kind, Event: event, Status: PaymentEventReceived, ReceivedAt: time.Now().UTC()}
+		doc, err := dbdriver.EncodeDocument(record)
+		if err != nil {
+			return nil, err
+		}
+		delete(doc, "_rev")
+		if _, err := dbdriver.CreateOrModifyDocument(client, &doc, id); dbdriver.IsConflict(err) {
+			// @info Delivered twice at once, the other delivery processes it
+			return getPaymentEvent(client, id)
+		} else if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if record.Status == PaymentEventProcessed || record.Status == PaymentEventIgnored {
+		return record, nil
+	}
+
+	applyErr := applyPaymentEvent(client, event)
+	record, err = updatePaymentEvent(client, id, func(record *PaymentEvent) {
+		now := time.Now().UTC()
+		record.Attempts++
+		record.ProcessedAt = &now
+		record.Status, record.Error = PaymentEventProcessed, ""
+		switch {
+		case errors.Is(applyErr, errEventIgnored):
+			record.Status, record.Error = PaymentEventIgnored, applyErr.Error()
+		case applyErr != nil:
+			record.Status, record.Error = PaymentEventFailed, applyErr.Error()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if applyErr != nil && !errors.Is(applyErr, errEventIgnored) {
+		return record, applyErr
+	}
+	return record, nil
+}
+
+// @info Takes a payment that was only authorized, all of it if amountCents is 0, and gives what it paid for
+// @error A *dbdriver.ValidationError if it is not authorized, or a *payment.ProviderError
+func CapturePayment(ctx context.Context, client *dbdriver.CouchDBClient, provider payment.Provider, id string, amountCents int64) (*Payment, error) {
+	p, err := GetPayment(client, id)
+	if err != nil {
+		return nil, err
+	}
+	if p.Status != PaymentAuthorized {
+		return nil, &dbdriver.ValidationError{DocType: PaymentDocType, Fields: []dbdriver.FieldError{{Field: "status", Message: "only authorized payments can be captured"}}}
+	}
+	if amountCents < 0 || amountCents > p.AmountCents {
+		return nil, &dbdriver.ValidationError{DocType: PaymentDocType, Fields: []dbdriver.FieldError{{Field: "amount_cents", Message: fmt.Sprintf("must be between 0 and %d", p.AmountCents)}}}
+	}
+	intent, err := provider.Capture(ctx, p.IntentID, amountCents)
+	if err != nil {
+		return nil, err
+	}
+	if p, err = updatePayment(client, id, func(p *Payment) error {
+		p.advance(intentPaymentStatus(intent.Status), intent.CapturedCents, 0)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return settlePayment(client, p)
+}
+
+// @info Gives back part of a payment, all that is left if amountCents is 0. Credits bought with it are taken back.
+// @error A *dbdriver.ValidationError if it was not captured or there is not that much left, or a
+// *payment.ProviderError
+func RefundPayment(ctx context.Context, client *dbdriver.CouchDBClient, provider payment.Provider, id string, amountCents int64, reason string, actorID string) (*Payment, error) {
+	p, err := GetPayment(client, id)
+	if err != nil {
+		return nil, err
+	}
+	left := p.CapturedCents - p.RefundedCents
+	if p.Status != PaymentSucceeded || left <= 0 {
+		return nil, &dbdriver.ValidationError{DocType: PaymentDocType, Fields: []dbdriver.FieldError{{Field: "status", Message: "there is nothing to refund"}}}
+	}
+	if amountCents == 0 {
+		amountCents = left
+	}
+	if amountCents < 0 || amountCents > left {
+		return nil, &dbdriver.ValidationError{DocType: PaymentDocType, Fields: []dbdriver.FieldError{{Field: "amount_cents", Message: fmt.Sprintf("only %d left to refund", left)}}}
+	}
+	// @info The key only changes once a refund is recorded, so a refund retried before that is made once
+	key := p.ID + ":refund:" + strconv.Itoa(len(p.Refunds)+1)
+	refund, err := provider.Refund(ctx, p.IntentID, amountCents, key)
+	if err != nil {
+		return nil, err
+	}
+	if p, err = updatePayment(client, id, func(p *Payment) error {
+		recorded := int64(0)
+		for _, current := range p.Refunds {
+			if current.ID == refund.ID {
+				return nil
+			}
+			recorded += current.AmountCents
+		}
+		p.Refunds = append(p.Refunds, PaymentRefund{ID: refund.ID, AmountCents: refund.AmountCents, Reason: reason, ActorID: actorID, At: time.Now().UTC()})
+		p.advance(PaymentSucceeded, 0, recorded+refund.AmountCents)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return settlePayment(client, p)
+}
+
+// @info Gives what every captured payment not reconciled yet paid for, as the events would have, and answers those
+// that still have a problem. It fixes events that were lost or failed, and can be run any time.
+func ReconcilePayments(client *dbdriver.CouchDBClient) (int, []Payment, error) {
+	reconciled, problems := 0, []Payment{}
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{
+			Selector: map[string]interface{}{"type": PaymentDocType, "status": PaymentSucceeded, "reconciled": false},
+			Limit:    200,
+			Bookmark: bookmark,
+		}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return reconciled, problems, err
+		}
+		for _, doc := range found.Docs {
+			p := &Payment{}
+			if err := dbdriver.DecodeDocument(doc, p); err != nil {
+				return reconciled, problems, err
+			}
+			if p, err = settlePayment(client, p); err != nil {
+				return reconciled, problems, err
+			}
+			if p.Reconciled {
+				reconciled++
+			} else {
+				problems = append(problems, *p)
+			}
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			break
+		}
+		bookmark = found.Bookmark
+	}
+	return reconciled, problems, nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no payment with that ID
+func GetPayment(client *dbdriver.CouchDBClient, id string) (*Payment, error) {
+	p := &Payment{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return p, err
+	}
+	if err = dbdriver.DecodeDocument(doc, p); err != nil {
+		return p, err
+	}
+	if p.Type != PaymentDocType {
+		return p, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a payment"}
+	}
+	return p, nil
+}
+
+// @info Newest payments first. Pass the returned bookmark to get the next page.
+func ListPayments(client *dbdriver.CouchDBClient, filter *PaymentFilter, limit uint64, bookmark string) ([]Payment, string, error) {
+	selector := map[string]interface{}{"type": PaymentDocType}
+	sort := paymentSort
+	if filter.UserID != "" {
+		selector["user_id"] = filter.UserID
+		sort = userPaymentSort
+	}
+	if filter.CheckoutID != "" {
+		selector["checkout_id"] = filter.CheckoutID
+	}
+	if filter.Status != "" {
+		selector["status"] = filter.Status
+	}
+	opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: sort}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	payments := []Payment{}
+	if err != nil {
+		return payments, "", err
+	}
+	for _, doc := range found.Docs {
+		p := Payment{}
+		if err := dbdriver.DecodeDocument(doc, &p); err != nil {
+			return payments, "", err
+		}
+		payments = append(payments, p)
+	}
+	return payments, found.Bookmark, nil
+}
+
+// @info Moves the payment forward. Events arrive out of order, so it never goes back from succeeded and amounts only
+// grow.
+func (p *Payment) advance(status PaymentStatus, capturedCents int64, refundedCents int64) {
+	switch {
+	case p.Status == PaymentSucceeded:
+	case status == PaymentFailed && p.Status != PaymentPending && p.Status != PaymentFailed:
+	case status != "":
+		p.Status = status
+	}
+	if capturedCents > p.CapturedCents {
+		p.CapturedCents = capturedCents
+	}
+	if refundedCents > p.RefundedCents {
+		p.RefundedCents = refundedCents
+	}
+}
+
+func intentPaymentStatus(status payment.IntentStatus) PaymentStatus {
+	switch status {
+	case payment.IntentRequiresPayment, payment.IntentProcessing:
+		return PaymentPending
+	case payment.IntentRequiresCapture:
+		return PaymentAuthorized
+	case payment.IntentSucceeded:
+		return PaymentSucceeded
+	case payment.IntentCanceled:
+		return PaymentCanceled
+	}
+	return ""
+}
+
+func applyPaymentEvent(client *dbdriver.CouchDBClient, event *payment.Event) error {
+	var status PaymentStatus
+	switch event.Type {
+	case payment.EventAuthorized:
+		status = PaymentAuthorized
+	case payment.EventSucceeded, payment.EventRefunded:
+		status = PaymentSucceeded
+	case payment.EventFailed:
+		status = PaymentFailed
+	case payment.EventCanceled:
+		status = PaymentCanceled
+	default:
+		return fmt.Errorf("%w: events of type %s are not needed", errEventIgnored, event.Type)
+	}
+	p, err := updatePayment(client, paymentID(event.IntentID), func(p *Payment) error {
+		p.advance(status, event.CapturedCents, event.RefundedCents)
+		if event.Type == payment.EventFailed && p.Status == PaymentFailed {
+			p.FailureMessage = event.FailureMessage
+		}
+		return nil
+	})
+	if dbdriver.IsNotFound(err) {
+		return fmt.Errorf("%w: %s is not a payment of this backend", errEventIgnored, event.IntentID)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = settlePayment(client, p)
+	return err
+}
+
+// @info Gives what a captured payment paid for: the credits of a top-up, or the checkout, whose orders are then
+// accepted. Checkouts no longer awaiting the payment get it as credits instead. Credits refunded are taken back. Every
+// step is idempotent, so it can run any number of times.
+func settlePayment(client *dbdriver.CouchDBClient, p *Payment) (*Payment, error) {
+	if p.Status != PaymentSucceeded {
+		return p, nil
+	}
+	problem, credited, debited := "", p.CreditedCents, p.DebitedCents
+	credit := func(description string) error {
+		if credited >= p.CapturedCents {
+			return nil
+		}
+		_, err := PostCreditTransaction(client, &CreditRequest{
+			UserID:         p.UserID,
+			Kind:           CreditTopUp,
+			AmountCents:    p.CapturedCents - credited,
+			Description:    description,
+			Reference:      p.ID,
+			IdempotencyKey: p.ID + ":credit:" + strconv.FormatInt(p.CapturedCents, 10),
+		})
+		if err == nil {
+			credited = p.CapturedCents
+		}
+		return err
+	}
+
+	switch p.Purpose {
+	case PaymentForTopUp:
+		if err := credit("Credits bought by card"); err != nil {
+			return p, err
+		}
+	case PaymentForCheckout:
+		checkout, err := GetCheckout(client, p.CheckoutID)
+		if err != nil {
+			return p, err
+		}
+		switch {
+		case checkout.Status == CheckoutAwaitingPayment && p.CapturedCents != checkout.TotalCents:
+			problem = fmt.Sprintf("%d cents were captured but the checkout is %d", p.CapturedCents, checkout.TotalCents)
+		case checkout.Status == CheckoutAwaitingPayment:
+			if checkout, err = ConfirmCheckout(client, checkout.ID, p.IntentID); err != nil {
+				return p, err
+			}
+		case checkout.Status == CheckoutPaid && checkout.PaymentReference == p.IntentID:
+			acceptCheckoutOrders(client, checkout) // @info In case accepting them failed the first time
+		default:
+			// @info Cancelled meanwhile, or paid twice
+			if err := credit("Payment of a checkout that was no longer awaiting it"); err != nil {
+				return p, err
+			}
+		}
+	}
+
+	if owed := minCents(p.RefundedCents, credited) - debited; owed > 0 {
+		_, err := PostCreditTransaction(client, &CreditRequest{
+			UserID:         p.UserID,
+			Kind:           CreditTopUpRefund,
+			AmountCents:    -owed,
+			Description:    "Refund of credits bought by card",
+			Reference:      p.ID,
+			IdempotencyKey: p.ID + ":debit:" + strconv.FormatInt(debited+owed, 10),
+		})
+		switch {
+		case errors.Is(err, ErrInsufficientCredits):
+			problem = fmt.Sprintf("%d cents of refunded credits were already spent", owed)
+		case err != nil:
+			return p, err
+		default:
+			debited += owed
+		}
+	}
+
+	return updatePayment(client, p.ID, func(p *Payment) error {
+		if credited > p.CreditedCents {
+			p.CreditedCents = credited
+		}
+		if debited > p.DebitedCents {
+			p.DebitedCents = debited
+		}
+		p.Reconciled, p.Problem = problem == "", problem
+		return nil
+	})
+}
+
+func minCents(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// @info Stores a new intent, or answers the payment already stored for it
+func createPayment(client *dbdriver.CouchDBClient, kind payment.Kind, intent *payment.Intent, purpose PaymentPurpose, checkoutID string, userID string) (*Payment, error) {
+	existing, err := GetPayment(client, paymentID(intent.ID))
+	if err == nil {
+		return existing, nil
+	}
+	if !dbdriver.IsNotFound(err) {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	p := &Payment{
+		ID:          paymentID(intent.ID),
+		Type:        PaymentDocType,
+		Provider:    kind,
+		IntentID:    intent.ID,
+		Purpose:     purpose,
+		CheckoutID:  checkoutID,
+		UserID:      userID,
+		AmountCents: intent.AmountCents,
+		Currency:    intent.Currency,
+		Status:      PaymentPending,
+		Refunds:     []PaymentRefund{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	p.advance(intentPaymentStatus(intent.Status), intent.CapturedCents, 0)
+	doc, err := dbdriver.EncodeDocument(p)
+	if err != nil {
+		return nil, err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, p.ID)
+	if dbdriver.IsConflict(err) {
+		return GetPayment(client, p.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Rev = resp_data.REV
+	return p, nil
+}
+
+func getPaymentEvent(client *dbdriver.CouchDBClient, id string) (*PaymentEvent, error) {
+	record := &PaymentEvent{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return record, err
+	}
+	if err = dbdriver.DecodeDocument(doc, record); err != nil {
+		return record, err
+	}
+	if record.Type != PaymentEventDocType {
+		return record, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a payment event"}
+	}
+	return record, nil
+}
+
+// @info Read-modify-write of a payment with conflict retries, see dbdriver.UpdateDocument
+func updatePayment(client *dbdriver.CouchDBClient, id string, mutate func(p *Payment) error) (*Payment, error) {
+	p := &Payment{}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		p = &Payment{}
+		if err := dbdriver.DecodeDocument(doc, p); err != nil {
+			return err
+		}
+		if p.Type != PaymentDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a payment"}
+		}
+		if err := mutate(p); err != nil {
+			return err
+		}
+		p.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(p)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetPayment(client, id)
+}
+
+func updatePaymentEvent(client *dbdriver.CouchDBClient, id string, mutate func(record *PaymentEvent)) (*PaymentEvent, error) {
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		record := &PaymentEvent{}
+		if err := dbdriver.DecodeDocument(doc, record); err != nil {
+			return err
+		}
+		mutate(record)
+		updated, err := dbdriver.EncodeDocument(record)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return getPaymentEvent(client, id)
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/quote"
+	"fmt"
+	"time"
+)
+
+const PricingRulesDocType = "pricing_rules"
+
+// @info One version of the tariffs. Versions are never modified: admins publish a new one, which is in force from then
+// on, and quotes remember the version they were made with. Going back to older tariffs means publishing them again.
+// The ID is derived from Version, so two admins publishing at once can't both get the same version.
+type PricingRules struct {
+	ID        string      `json:"_id"`
+	Rev       string      `json:"_rev,omitempty"`
+	Type      string      `json:"type" validate:"required"`
+	Version   int         `json:"version" validate:"required,min=1"`
+	Rules     quote.Rules `json:"rules" validate:"required"`
+	Notes     string      `json:"notes,omitempty" validate:"maxlen=1024"` // What changed and why
+	CreatedBy string      `json:"created_by,omitempty"`                   // Empty for the defaults installed on startup
+	CreatedAt time.Time   `json:"created_at" validate:"required"`
+}
+
+var pricingSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"version": "desc"}}
+
+func pricingRulesID(version int) string {
+	return fmt.Sprintf("%s:%06d", PricingRulesDocType, version)
+}
+
+// @info Checks the tariffs, including that discounts are given to existing user types
+func checkPricingRules(rules *quote.Rules) error {
+	fields := []dbdriver.FieldError{}
+	for _, problem := range rules.Check() {
+		fields = append(fields, dbdriver.FieldError{Field: "rules." + problem.Field, Message: problem.Message})
+	}
+	for userType := range rules.Discounts {
+		if !IsUserType(userType) {
+			fields = append(fields, dbdriver.FieldError{Field: "rules.discounts." + userType, Message: "is not a user type"})
+		}
+	}
+	if len(fields) > 0 {
+		return &dbdriver.ValidationError{DocType: PricingRulesDocType, Fields: fields}
+	}
+	return nil
+}
+
+// @info Stores the tariffs as the next version, which is in force from now on
+// @error A *dbdriver.ValidationError if the tariffs are inconsistent
+func PublishPricingRules(client *dbdriver.CouchDBClient, rules *quote.Rules, notes string, actorID string) (*PricingRules, error) {
+	if err := checkPricingRules(rules); err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < dbdriver.DefaultUpdateAttempts; attempt++ {
+		current, err := GetCurrentPricingRules(client)
+		version := 1
+		switch {
+		case err == nil:
+			version = current.Version + 1
+		case !dbdriver.IsNotFound(err):
+			return nil, err
+		}
+		published := &PricingRules{
+			ID:        pricingRulesID(version),
+			Type:      PricingRulesDocType,
+			Version:   version,
+			Rules:     *rules,
+			Notes:     notes,
+			CreatedBy: actorID,
+			CreatedAt: time.Now().UTC(),
+		}
+		doc, err := dbdriver.EncodeDocument(published)
+		if err != nil {
+			return nil, err
+		}
+		delete(doc, "_rev")
+		resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, published.ID)
+		if dbdriver.IsConflict(err) {
+			continue // @info Someone else published this version in between, take the next one
+		}
+		if err != nil {
+			return nil, err
+		}
+		published.Rev = resp_data.REV
+		return published, nil
+	}
+	return nil, &dbdriver.CouchDBError{StatusCode: 409, ErrorName: "conflict", Reason: "too many concurrent pricing changes"}
+}
+
+// @info The tariffs in force, i.e. the latest version
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if no tariffs were ever published
+func GetCurrentPricingRules(client *dbdriver.CouchDBClient) (*PricingRules, error) {
+	versions, _, err := ListPricingRules(client, 1, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "no pricing rules"}
+	}
+	return &versions[0], nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no such version
+func GetPricingRules(client *dbdriver.CouchDBClient, version int) (*PricingRules, error) {
+	published := &PricingRules{}
+	doc, err := dbdriver.GetDocument(client, pricingRulesID(version))
+	if err != nil {
+		return published, err
+	}
+	err = dbdriver.DecodeDocument(doc, published)
+	return published, err
+}
+
+// @info Newest version first. Pass the returned bookmark to get the next page.
+func ListPricingRules(client *dbdriver.CouchDBClient, limit uint64, bookmark string) ([]PricingRules, string, error) {
+	opts := &dbdriver.FindOptions{
+		Selector: map[string]interface{}{"type": PricingRulesDocType},
+		Limit:    limit,
+		Bookmark: bookmark,
+		Sort:     pricingSort,
+	}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	versions := []PricingRules{}
+	if err != nil {
+		return versions, "", err
+	}
+	for _, doc := range found.Docs {
+		published := PricingRules{}
+		if err := dbdriver.DecodeDocument(doc, &published); err != nil {
+			return versions, "", err
+		}
+		versions = append(versions, published)
+	}
+	return versions, found.Bookmark, nil
+}
+
+// @info Publishes quote.DefaultRules as the first version if no tariffs were ever published. Called on startup.
+func EnsurePricingRules(client *dbdriver.CouchDBClient) error {
+	_, err := GetCurrentPricingRules(client)
+	if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	defaults := quote.DefaultRules()
+	_, err = PublishPricingRules(client, &defaults, "Default tariffs", "")
+	return err
+}
+
+// @info Prices the items with the tariffs in force for a customer of the given user type
+func QuoteItems(client *dbdriver.CouchDBClient, items []quote.Item, userType string) (*quote.Quote, error) {
+	current, err := GetCurrentPricingRules(client)
+	if err != nil {
+		return nil, err
+	}
+	q, err := quote.Calculate(&current.Rules, items, userType)
+	if err != nil {
+		return nil, err
+	}
+	q.RulesVersion = current.Version
+	return q, nil
+}
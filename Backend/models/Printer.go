@@ -0,0 +1,342 @@
+package models
+
+import (
+	"3DQuest/connector"
+	"3DQuest/dbdriver"
+	"3DQuest/geometry"
+	"3DQuest/mqtt"
+	"3DQuest/telemetry"
+	"fmt"
+	str "strings"
+	"time"
+)
+
+const PrinterDocType = "printer"
+
+type PrinterStatus string
+
+const (
+	PrinterIdle        PrinterStatus = "idle"
+	PrinterPrinting    PrinterStatus = "printing" // Set by the scheduler when a job starts, see StartJob
+	PrinterPaused      PrinterStatus = "paused"
+	PrinterMaintenance PrinterStatus = "maintenance"
+	PrinterOffline     PrinterStatus = "offline"
+	PrinterError       PrinterStatus = "error"
+	PrinterRetired     PrinterStatus = "retired" // Kept for the history of its jobs, never scheduled again
+)
+
+var printerStatuses = []PrinterStatus{PrinterIdle, PrinterPrinting, PrinterPaused, PrinterMaintenance, PrinterOffline, PrinterError, PrinterRetired}
+
+type Printer struct {
+	ID              string             `json:"_id"`
+	Rev             string             `json:"_rev,omitempty"`
+	Type            string             `json:"type" validate:"required"`
+	Name            string             `json:"name" validate:"required,minlen=1,maxlen=128"`
+	Model           string             `json:"model,omitempty" validate:"maxlen=128"` // e.g. Prusa MK4
+	BuildVolume     geometry.Vec3      `json:"build_volume"`                          // mm
+	NozzleDiameters []float64          `json:"nozzle_diameters"`                      // mm, the ones it can be fitted with
+	Materials       []string           `json:"materials"`                             // Materials it can print, named as in the tariffs
+	Status          PrinterStatus      `json:"status" validate:"required,enum=idle|printing|paused|maintenance|offline|error|retired"`
+	Location        string             `json:"location,omitempty" validate:"maxlen=256"`
+	LoadedMaterial  string             `json:"loaded_material,omitempty"` // Filament currently loaded, updated when jobs start
+	LoadedColour    string             `json:"loaded_colour,omitempty"`
+	Notes           string             `json:"notes,omitempty" validate:"maxlen=4096"`
+	Connection      *PrinterConnection `json:"connection,omitempty"` // Host software driving it, nil if it is operated by hand
+	MQTT            *PrinterMQTT       `json:"mqtt,omitempty"`       // Where it publishes its telemetry, nil if it does not
+	CreatedAt       time.Time          `json:"created_at" validate:"required"`
+	UpdatedAt       time.Time          `json:"updated_at" validate:"required"`
+}
+
+// @info How to reach the OctoPrint or Moonraker host of a printer
+type PrinterConnection struct {
+	Kind   connector.Kind `json:"kind" validate:"required,enum=octoprint|moonraker"`
+	URL    string         `json:"url" validate:"required,maxlen=512"` // e.g. http://octopi.local
+	APIKey string         `json:"api_key,omitempty" validate:"maxlen=256"`
+}
+
+// @info Topic filter the printer publishes on, e.g. device/01P00A123456789/report, and the format of its messages
+type PrinterMQTT struct {
+	Topic  string           `json:"topic" validate:"required,maxlen=256"`
+	Format telemetry.Format `json:"format" validate:"required,enum=generic|bambu|octoprint"`
+}
+
+// @info Fields of a printer that can be changed with UpdatePrinter. Nil fields are left untouched.
+type PrinterUpdate struct {
+	Name            *string            `json:"name"`
+	Model           *string            `json:"model"`
+	BuildVolume     *geometry.Vec3     `json:"build_volume"`
+	NozzleDiameters *[]float64         `json:"nozzle_diameters"`
+	Materials       *[]string          `json:"materials"`
+	Location        *string            `json:"location"`
+	LoadedMaterial  *string            `json:"loaded_material"`
+	LoadedColour    *string            `json:"loaded_colour"`
+	Notes           *string            `json:"notes"`
+	Connection      *PrinterConnection `json:"connection"` // An empty kind removes it. An empty API key keeps the current one
+	MQTT            *PrinterMQTT       `json:"mqtt"`       // An empty topic removes it
+}
+
+// @info Filters of ListPrinters. Empty fields match every printer.
+type PrinterFilter struct {
+	Status   PrinterStatus
+	Location string
+}
+
+// @info Sorted like the printers index, see EnsureIndexes
+var printerSort = []interface{}{map[string]string{"type": "asc"}, map[string]string{"name": "asc"}}
+
+func IsPrinterStatus(status PrinterStatus) bool {
+	for _, known := range printerStatuses {
+		if status == known {
+			return true
+		}
+	}
+	return false
+}
+
+// @info Whether the scheduler may give it plates. Paused printers keep their job and their queue.
+func (p *Printer) IsAvailable() bool {
+	return p.Status == PrinterIdle || p.Status == PrinterPrinting || p.Status == PrinterPaused
+}
+
+// @info Clears the API key of its connection before the printer is answered or audited. An empty key in an update
+// keeps the stored one.
+func (p *Printer) HideAPIKey() {
+	if p.Connection != nil {
+		connection := *p.Connection
+		connection.APIKey = ""
+		p.Connection = &connection
+	}
+}
+
+// @info Stores a new idle printer, filling in its ID and revision
+func CreatePrinter(client *dbdriver.CouchDBClient, printer *Printer) error {
+	now := time.Now().UTC()
+	printer.Type = PrinterDocType
+	printer.Status = PrinterIdle
+	printer.CreatedAt = now
+	printer.UpdatedAt = now
+	normalizePrinter(printer)
+	if err := checkPrinter(printer); err != nil {
+		return err
+	}
+	doc, err := dbdriver.EncodeDocument(printer)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, printer.ID)
+	if err != nil {
+		return err
+	}
+	printer.ID = resp_data.ID
+	printer.Rev = resp_data.REV
+	return nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no printer with that ID
+func GetPrinter(client *dbdriver.CouchDBClient, id string) (*Printer, error) {
+	printer := &Printer{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return printer, err
+	}
+	if err = dbdriver.DecodeDocument(doc, printer); err != nil {
+		return printer, err
+	}
+	if printer.Type != PrinterDocType {
+		return printer, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a printer"}
+	}
+	return printer, nil
+}
+
+// @info Printers by name. Pass the returned bookmark to get the next page, or a zero limit to get them all.
+func ListPrinters(client *dbdriver.CouchDBClient, filter *PrinterFilter, limit uint64, bookmark string) ([]Printer, string, error) {
+	selector := map[string]interface{}{"type": PrinterDocType}
+	if filter.Status != "" {
+		selector["status"] = filter.Status
+	}
+	if filter.Location != "" {
+		selector["location"] = filter.Location
+	}
+	printers := []Printer{}
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: printerSort}
+		if limit == 0 {
+			opts.Limit = 200
+		}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return printers, "", err
+		}
+		for _, doc := range found.Docs {
+			printer := Printer{}
+			if err := dbdriver.DecodeDocument(doc, &printer); err != nil {
+				return printers, "", err
+			}
+			printers = append(printers, printer)
+		}
+		if limit > 0 || len(found.Docs) < int(opts.Limit) {
+			return printers, found.Bookmark, nil
+		}
+		bookmark = found.Bookmark
+	}
+}
+
+// @info Changes the description of a printer. Its status has its own function, see SetPrinterStatus.
+func UpdatePrinter(client *dbdriver.CouchDBClient, id string, update *PrinterUpdate) (*Printer, error) {
+	return updatePrinter(client, id, func(printer *Printer) error {
+		if update.Name != nil {
+			printer.Name = *update.Name
+		}
+		if update.Model != nil {
+			printer.Model = *update.Model
+		}
+		if update.BuildVolume != nil {
+			printer.BuildVolume = *update.BuildVolume
+		}
+		if update.NozzleDiameters != nil {
+			printer.NozzleDiameters = *update.NozzleDiameters
+		}
+		if update.Materials != nil {
+			printer.Materials = *update.Materials
+		}
+		if update.Location != nil {
+			printer.Location = *update.Location
+		}
+		if update.LoadedMaterial != nil {
+			printer.LoadedMaterial = *update.LoadedMaterial
+		}
+		if update.LoadedColour != nil {
+			printer.LoadedColour = *update.LoadedColour
+		}
+		if update.Notes != nil {
+			printer.Notes = *update.Notes
+		}
+		if update.Connection != nil {
+			connection := *update.Connection
+			if connection.APIKey == "" && printer.Connection != nil {
+				connection.APIKey = printer.Connection.APIKey
+			}
+			printer.Connection = &connection
+		}
+		if update.MQTT != nil {
+			subscription := *update.MQTT
+			printer.MQTT = &subscription
+		}
+		normalizePrinter(printer)
+		return checkPrinter(printer)
+	})
+}
+
+// @info Changes the status of a printer, returning the previous one. Retired printers stay retired.
+func SetPrinterStatus(client *dbdriver.CouchDBClient, id string, status PrinterStatus) (*Printer, PrinterStatus, error) {
+	if !IsPrinterStatus(status) {
+		return nil, "", &dbdriver.ValidationError{DocType: PrinterDocType, Fields: []dbdriver.FieldError{{Field: "status", Message: "is not a printer status"}}}
+	}
+	previous := PrinterStatus("")
+	printer, err := updatePrinter(client, id, func(printer *Printer) error {
+		previous = printer.Status
+		if printer.Status == PrinterRetired && status != PrinterRetired {
+			return &dbdriver.ValidationError{DocType: PrinterDocType, Fields: []dbdriver.FieldError{{Field: "status", Message: "retired printers can't be used again"}}}
+		}
+		printer.Status = status
+		return nil
+	})
+	return printer, previous, err
+}
+
+// @info Read-modify-write of a printer with conflict retries, see dbdriver.UpdateDocument
+func updatePrinter(client *dbdriver.CouchDBClient, id string, mutate func(printer *Printer) error) (*Printer, error) {
+	printer := &Printer{}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		printer = &Printer{}
+		if err := dbdriver.DecodeDocument(doc, printer); err != nil {
+			return err
+		}
+		if printer.Type != PrinterDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a printer"}
+		}
+		if err := mutate(printer); err != nil {
+			return err
+		}
+		printer.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(printer)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetPrinter(client, id)
+}
+
+// @info Lists are never null. Materials are compared case insensitively by the scheduler.
+func normalizePrinter(printer *Printer) {
+	materials := []string{}
+	for _, material := range printer.Materials {
+		if material = str.TrimSpace(material); material != "" {
+			materials = append(materials, material)
+		}
+	}
+	printer.Materials = materials
+	printer.LoadedMaterial = str.TrimSpace(printer.LoadedMaterial)
+	if printer.NozzleDiameters == nil {
+		printer.NozzleDiameters = []float64{}
+	}
+	if printer.MQTT != nil {
+		printer.MQTT.Topic = str.TrimSpace(printer.MQTT.Topic)
+		if printer.MQTT.Topic == "" {
+			printer.MQTT = nil
+		} else if printer.MQTT.Format == "" {
+			printer.MQTT.Format = telemetry.FormatGeneric
+		}
+	}
+	if printer.Connection != nil && printer.Connection.Kind == "" {
+		printer.Connection = nil
+	}
+	if printer.Connection != nil {
+		printer.Connection.URL = str.TrimRight(str.TrimSpace(printer.Connection.URL), "/")
+		printer.Connection.APIKey = str.TrimSpace(printer.Connection.APIKey)
+	}
+}
+
+func checkPrinter(printer *Printer) error {
+	fields := []dbdriver.FieldError{}
+	volume := printer.BuildVolume
+	if !volume.IsFinite() || volume.X <= 0 || volume.Y <= 0 || volume.Z <= 0 {
+		fields = append(fields, dbdriver.FieldError{Field: "build_volume", Message: "must be positive in x, y and z"})
+	}
+	for i, diameter := range printer.NozzleDiameters {
+		if !(diameter > 0 && diameter <= 5) {
+			fields = append(fields, dbdriver.FieldError{Field: fmt.Sprintf("nozzle_diameters.%d", i), Message: "must be between 0 and 5 mm"})
+		}
+	}
+	if len(printer.Materials) == 0 {
+		fields = append(fields, dbdriver.FieldError{Field: "materials", Message: "must have at least 1 elements"})
+	}
+	if connection := printer.Connection; connection != nil {
+		if _, err := connector.New(connection.Kind, connection.URL, connection.APIKey); err != nil {
+			fields = append(fields, dbdriver.FieldError{Field: "connection", Message: err.Error()})
+		}
+	}
+	if subscription := printer.MQTT; subscription != nil {
+		if !mqtt.ValidFilter(subscription.Topic) || len(subscription.Topic) > 256 {
+			fields = append(fields, dbdriver.FieldError{Field: "mqtt.topic", Message: "must be an MQTT topic filter"})
+		}
+		if !telemetry.IsFormat(subscription.Format) {
+			fields = append(fields, dbdriver.FieldError{Field: "mqtt.format", Message: "must be one of generic, bambu, octoprint"})
+		}
+	}
+	if len(fields) > 0 {
+		return &dbdriver.ValidationError{DocType: PrinterDocType, Fields: fields}
+	}
+	return nil
+}
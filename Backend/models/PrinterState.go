@@ -0,0 +1,570 @@
+package models
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/mqtt"
+	"3DQuest/telemetry"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	PrinterStateDocType    = "printer_state"
+	TelemetrySampleDocType = "telemetry_sample"
+	PrinterAlertDocType    = "printer_alert"
+)
+
+// @info Latest telemetry of a printer publishing over MQTT. One per printer, see printerStateID.
+type PrinterState struct {
+	ID                 string    `json:"_id"`
+	Rev                string    `json:"_rev,omitempty"`
+	Type               string    `json:"type" validate:"required"`
+	PrinterID          string    `json:"printer_id" validate:"required"`
+	telemetry.Snapshot           // State, progress, temperatures, error and filament
+	Topic              string    `json:"topic"` // Of the last message
+	LastMessageAt      time.Time `json:"last_message_at" validate:"required"`
+	UpdatedAt          time.Time `json:"updated_at" validate:"required"`
+}
+
+// @info A point of the series of a printer, summarising its telemetry over MQTT_SAMPLE_INTERVAL
+type TelemetrySample struct {
+	ID               string `json:"_id"`
+	Rev              string `json:"_rev,omitempty"`
+	Type             string `json:"type" validate:"required"`
+	PrinterID        string `json:"printer_id" validate:"required"`
+	telemetry.Sample        // Start, end, count, temperature statistics, progress and state
+}
+
+type AlertStatus string
+
+const (
+	AlertOpen         AlertStatus = "open"
+	AlertAcknowledged AlertStatus = "acknowledged" // Someone is on it, it stays until the condition clears
+	AlertResolved     AlertStatus = "resolved"     // The condition cleared
+)
+
+// @info Raised when the telemetry of a printer shows a problem, resolved when it clears. There is at most one
+// unresolved alert of each kind per printer.
+type PrinterAlert struct {
+	ID             string              `json:"_id"`
+	Rev            string              `json:"_rev,omitempty"`
+	Type           string              `json:"type" validate:"required"`
+	PrinterID      string              `json:"printer_id" validate:"required"`
+	Kind           telemetry.AlertKind `json:"kind" validate:"required,enum=error|filament_runout|overheat|silent"`
+	Message        string              `json:"message" validate:"maxlen=1024"`
+	Status         AlertStatus         `json:"status" validate:"required,enum=open|acknowledged|resolved"`
+	RaisedAt       time.Time           `json:"raised_at" validate:"required"`
+	AcknowledgedAt *time.Time          `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string              `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time          `json:"resolved_at,omitempty"`
+	UpdatedAt      time.Time           `json:"updated_at" validate:"required"`
+}
+
+// @info Filters of ListPrinterAlerts. Empty fields match every alert, Active matches those not resolved.
+type AlertFilter struct {
+	PrinterID string
+	Status    AlertStatus
+	Active    bool
+}
+
+var sampleSort = []interface{}{map[string]string{"type": "asc"}, map[string]string{"printer_id": "asc"}, map[string]string{"start": "asc"}}
+var alertSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"raised_at": "desc"}}
+
+// @info Ingested printers are looked up again this often, so new topics are followed without a restart
+const printerRefresh = 30 * time.Second
+
+// @info Readings that change nothing but temperatures and progress are written at most this often
+const stateWriteInterval = 15 * time.Second
+
+func printerStateID(printerID string) string {
+	return PrinterStateDocType + ":" + printerID
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if the printer never published
+func GetPrinterState(client *dbdriver.CouchDBClient, printerID string) (*PrinterState, error) {
+	state := &PrinterState{}
+	doc, err := dbdriver.GetDocument(client, printerStateID(printerID))
+	if err != nil {
+		return state, err
+	}
+	if err = dbdriver.DecodeDocument(doc, state); err != nil {
+		return state, err
+	}
+	if state.Type != PrinterStateDocType {
+		return state, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a printer state"}
+	}
+	return state, nil
+}
+
+// @info Samples of a printer starting within [from, to), oldest first, at most limit
+func ListTelemetrySamples(client *dbdriver.CouchDBClient, printerID string, from time.Time, to time.Time, limit uint64) ([]TelemetrySample, error) {
+	selector := map[string]interface{}{
+		"type":       TelemetrySampleDocType,
+		"printer_id": printerID,
+		"start":      map[string]interface{}{"$gte": from.UTC(), "$lt": to.UTC()},
+	}
+	samples := []TelemetrySample{}
+	found, err := dbdriver.FindInDatabase(client, &dbdriver.FindOptions{Selector: selector, Limit: limit, Sort: sampleSort})
+	if err != nil {
+		return samples, err
+	}
+	for _, doc := range found.Docs {
+		sample := TelemetrySample{}
+		if err := dbdriver.DecodeDocument(doc, &sample); err != nil {
+			return samples, err
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no alert with that ID
+func GetPrinterAlert(client *dbdriver.CouchDBClient, id string) (*PrinterAlert, error) {
+	alert := &PrinterAlert{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return alert, err
+	}
+	if err = dbdriver.DecodeDocument(doc, alert); err != nil {
+		return alert, err
+	}
+	if alert.Type != PrinterAlertDocType {
+		return alert, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a printer alert"}
+	}
+	return alert, nil
+}
+
+// @info Newest alerts first. Pass the returned bookmark to get the next page, or a zero limit to get them all.
+func ListPrinterAlerts(client *dbdriver.CouchDBClient, filter *AlertFilter, limit uint64, bookmark string) ([]PrinterAlert, string, error) {
+	selector := map[string]interface{}{"type": PrinterAlertDocType}
+	if filter.PrinterID != "" {
+		selector["printer_id"] = filter.PrinterID
+	}
+	switch {
+	case filter.Status != "":
+		selector["status"] = filter.Status
+	case filter.Active:
+		selector["status"] = map[string]interface{}{"$ne": AlertResolved}
+	}
+	alerts := []PrinterAlert{}
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: alertSort}
+		if limit == 0 {
+			opts.Limit = 200
+		}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return alerts, "", err
+		}
+		for _, doc := range found.Docs {
+			alert := PrinterAlert{}
+			if err := dbdriver.DecodeDocument(doc, &alert); err != nil {
+				return alerts, "", err
+			}
+			alerts = append(alerts, alert)
+		}
+		if limit > 0 || len(found.Docs) < int(opts.Limit) {
+			return alerts, found.Bookmark, nil
+		}
+		bookmark = found.Bookmark
+	}
+}
+
+// @info Marks an open alert as being looked after by userID. Acknowledging it again changes nothing, resolved alerts
+// can't be acknowledged.
+func AcknowledgePrinterAlert(client *dbdriver.CouchDBClient, id string, userID string) (*PrinterAlert, error) {
+	return updatePrinterAlert(client, id, func(alert *PrinterAlert) error {
+		switch alert.Status {
+		case AlertResolved:
+			return &dbdriver.ValidationError{DocType: PrinterAlertDocType, Fields: []dbdriver.FieldError{{Field: "status", Message: "resolved alerts can't be acknowledged"}}}
+		case AlertOpen:
+			now := time.Now().UTC()
+			alert.Status = AlertAcknowledged
+			alert.AcknowledgedAt = &now
+			alert.AcknowledgedBy = userID
+		}
+		return nil
+	})
+}
+
+// @info Follows the printers that publish over MQTT: keeps a printer_state document per printer, stores their series
+// downsampled to MQTT_SAMPLE_INTERVAL and raises and resolves their alerts. Like the print scheduler, a single
+// instance should run it.
+type TelemetryIngester struct {
+	client *dbdriver.CouchDBClient
+	cfg    config.MQTTConfig
+	limits telemetry.Limits
+
+	mu        sync.Mutex
+	printers  []Printer // With an MQTT topic
+	loadedAt  time.Time
+	tracks    map[string]*printerTrack
+	alertsSet bool // Whether the unresolved alerts were loaded
+}
+
+type printerTrack struct {
+	state   *PrinterState
+	series  telemetry.Downsampler
+	written time.Time
+	dirty   bool
+	alerts  map[telemetry.AlertKind]*PrinterAlert // Unresolved ones
+}
+
+func NewTelemetryIngester(client *dbdriver.CouchDBClient, cfg *config.MQTTConfig) *TelemetryIngester {
+	return &TelemetryIngester{
+		client: client,
+		cfg:    *cfg,
+		limits: telemetry.Limits{OverheatMargin: cfg.OverheatMargin, Silence: cfg.Silence},
+		tracks: map[string]*printerTrack{},
+	}
+}
+
+// @info Connects to MQTT_BROKER and ingests what the printers publish until ctx is done, connecting again whenever
+// the connection is lost. Subscribes to the topic of every printer with one, and to new ones as they are added.
+func (t *TelemetryIngester) Run(ctx context.Context) {
+	go t.sweepLoop(ctx)
+	backoff := time.Second
+	for ctx.Err() == nil {
+		client, err := mqtt.Dial(t.cfg.Broker, mqtt.Options{ClientID: t.cfg.ClientID, Username: t.cfg.Username, Password: t.cfg.Password}, t.handle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Couldn't connect to the MQTT broker %s: %v\n", t.cfg.Broker, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+			continue
+		}
+		backoff = time.Second
+		t.follow(ctx, client)
+		client.Close()
+		if err := client.Err(); err != nil && ctx.Err() == nil && err != mqtt.ErrClosed {
+			fmt.Fprintln(os.Stderr, "Warning: Lost the connection to the MQTT broker:", err)
+		}
+	}
+	t.flush(time.Now().UTC())
+}
+
+// @info Keeps the subscriptions in line with the printers until the connection drops or ctx is done
+func (t *TelemetryIngester) follow(ctx context.Context, client *mqtt.Client) {
+	subscribed := map[string]bool{}
+	ticker := time.NewTicker(printerRefresh)
+	defer ticker.Stop()
+	for {
+		printers, err := t.routes(time.Now(), true)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: Couldn't list the printers publishing over MQTT:", err)
+		}
+		for _, printer := range printers {
+			if topic := printer.MQTT.Topic; !subscribed[topic] {
+				if err := client.Subscribe(topic); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Couldn't subscribe to %s: %v\n", topic, err)
+					continue
+				}
+				subscribed[topic] = true
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-client.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *TelemetryIngester) handle(msg mqtt.Message) {
+	if err := t.Ingest(msg.Topic, msg.Payload, time.Now().UTC()); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Couldn't ingest a message on %s: %v\n", msg.Topic, err)
+	}
+}
+
+// @info Ingests a message published at at on topic by the first printer whose topic filter matches. Messages of no
+// printer are ignored.
+func (t *TelemetryIngester) Ingest(topic string, payload []byte, at time.Time) error {
+	printers, err := t.routes(at, false)
+	if err != nil {
+		return err
+	}
+	var printer *Printer
+	for i := range printers {
+		if mqtt.Match(printers[i].MQTT.Topic, topic) {
+			printer = &printers[i]
+			break
+		}
+	}
+	if printer == nil {
+		return nil
+	}
+	reading, err := telemetry.Parse(printer.MQTT.Format, topic, payload)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	track, err := t.track(printer.ID)
+	if err != nil {
+		return err
+	}
+	changed := track.state.Apply(reading)
+	track.state.Topic = topic
+	track.state.LastMessageAt = at
+	if sample := track.series.Add(at, &track.state.Snapshot); sample != nil {
+		if err := t.saveSample(printer.ID, sample); err != nil {
+			return err
+		}
+	}
+	if err := t.checkAlerts(printer.ID, track, at); err != nil {
+		return err
+	}
+	track.dirty = true
+	if changed || at.Sub(track.written) >= stateWriteInterval {
+		return t.saveState(track, at)
+	}
+	return nil
+}
+
+// @info Printers with an MQTT topic, looked up again every printerRefresh or when forced
+func (t *TelemetryIngester) routes(now time.Time, force bool) ([]Printer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !force && t.printers != nil && now.Sub(t.loadedAt) < printerRefresh {
+		return t.printers, nil
+	}
+	found, _, err := ListPrinters(t.client, &PrinterFilter{}, 0, "")
+	if err != nil {
+		return t.printers, err
+	}
+	printers := []Printer{}
+	for _, printer := range found {
+		if printer.MQTT != nil && printer.Status != PrinterRetired {
+			printers = append(printers, printer)
+		}
+	}
+	t.printers, t.loadedAt = printers, now
+	return printers, nil
+}
+
+// @info The state of a printer, carried on from its document on the first message after a restart. Called with the
+// lock held.
+func (t *TelemetryIngester) track(printerID string) (*printerTrack, error) {
+	if !t.alertsSet {
+		alerts, _, err := ListPrinterAlerts(t.client, &AlertFilter{Active: true}, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		for i := range alerts {
+			t.trackOf(alerts[i].PrinterID).alerts[alerts[i].Kind] = &alerts[i]
+		}
+		t.alertsSet = true
+	}
+	track := t.trackOf(printerID)
+	if track.state == nil {
+		state, err := GetPrinterState(t.client, printerID)
+		if err != nil && !dbdriver.IsNotFound(err) {
+			return nil, err
+		}
+		if err != nil {
+			state = &PrinterState{ID: printerStateID(printerID), Type: PrinterStateDocType, PrinterID: printerID}
+		}
+		track.state = state
+	}
+	return track, nil
+}
+
+func (t *TelemetryIngester) trackOf(printerID string) *printerTrack {
+	track, ok := t.tracks[printerID]
+	if !ok {
+		track = &printerTrack{series: telemetry.Downsampler{Interval: t.cfg.SampleInterval}, alerts: map[telemetry.AlertKind]*PrinterAlert{}}
+		t.tracks[printerID] = track
+	}
+	return track
+}
+
+// @info Raises the alerts whose condition appeared and resolves those whose condition cleared. Called with the lock
+// held.
+func (t *TelemetryIngester) checkAlerts(printerID string, track *printerTrack, now time.Time) error {
+	if track.state == nil {
+		return nil
+	}
+	active := telemetry.Alerts(&track.state.Snapshot, track.state.LastMessageAt, now, t.limits)
+	for kind, message := range active {
+		if _, raised := track.alerts[kind]; raised {
+			continue
+		}
+		alert := &PrinterAlert{Type: PrinterAlertDocType, PrinterID: printerID, Kind: kind, Message: message, Status: AlertOpen, RaisedAt: now, UpdatedAt: now}
+		if err := savePrinterAlert(t.client, alert); err != nil {
+			return err
+		}
+		track.alerts[kind] = alert
+	}
+	for kind, alert := range track.alerts {
+		if _, still := active[kind]; still {
+			continue
+		}
+		if _, err := resolvePrinterAlert(t.client, alert.ID, now); err != nil && !dbdriver.IsNotFound(err) {
+			return err
+		}
+		delete(track.alerts, kind)
+	}
+	return nil
+}
+
+// @info Writes the states left dirty, closes the samples whose interval ended and looks for silent printers
+func (t *TelemetryIngester) sweepLoop(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.sweep(time.Now().UTC())
+		}
+	}
+}
+
+func (t *TelemetryIngester) sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for printerID, track := range t.tracks {
+		if track.state == nil {
+			continue
+		}
+		if since := track.series.Since(); !since.IsZero() && !now.Before(since.Add(t.cfg.SampleInterval)) {
+			if err := t.saveSample(printerID, track.series.Flush()); err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: Couldn't store a telemetry sample:", err)
+			}
+		}
+		if err := t.checkAlerts(printerID, track, now); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: Couldn't update the printer alerts:", err)
+		}
+		if track.dirty && now.Sub(track.written) >= stateWriteInterval {
+			if err := t.saveState(track, now); err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: Couldn't store a printer state:", err)
+			}
+		}
+	}
+}
+
+// @info Writes everything pending, on shutdown
+func (t *TelemetryIngester) flush(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for printerID, track := range t.tracks {
+		if sample := track.series.Flush(); sample != nil {
+			t.saveSample(printerID, sample)
+		}
+		if track.dirty {
+			t.saveState(track, now)
+		}
+	}
+}
+
+// @info Called with the lock held
+func (t *TelemetryIngester) saveState(track *printerTrack, now time.Time) error {
+	state := track.state
+	state.UpdatedAt = now
+	for attempt := 0; ; attempt++ {
+		doc, err := dbdriver.EncodeDocument(state)
+		if err != nil {
+			return err
+		}
+		if state.Rev == "" {
+			delete(doc, "_rev")
+		}
+		resp_data, err := dbdriver.CreateOrModifyDocument(t.client, &doc, state.ID)
+		if dbdriver.IsConflict(err) && attempt == 0 {
+			// @info Written by another process or restored from a backup: take its revision, keep our values
+			current, getErr := GetPrinterState(t.client, state.PrinterID)
+			if getErr != nil {
+				return err
+			}
+			state.Rev = current.Rev
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		state.Rev = resp_data.REV
+		track.written, track.dirty = now, false
+		return nil
+	}
+}
+
+func (t *TelemetryIngester) saveSample(printerID string, sample *telemetry.Sample) error {
+	doc, err := dbdriver.EncodeDocument(&TelemetrySample{Type: TelemetrySampleDocType, PrinterID: printerID, Sample: *sample})
+	if err != nil {
+		return err
+	}
+	delete(doc, "_id")
+	delete(doc, "_rev")
+	_, err = dbdriver.CreateOrModifyDocument(t.client, &doc, "")
+	return err
+}
+
+func savePrinterAlert(client *dbdriver.CouchDBClient, alert *PrinterAlert) error {
+	doc, err := dbdriver.EncodeDocument(alert)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, alert.ID)
+	if err != nil {
+		return err
+	}
+	alert.ID = resp_data.ID
+	alert.Rev = resp_data.REV
+	return nil
+}
+
+func resolvePrinterAlert(client *dbdriver.CouchDBClient, id string, now time.Time) (*PrinterAlert, error) {
+	return updatePrinterAlert(client, id, func(alert *PrinterAlert) error {
+		if alert.Status != AlertResolved {
+			alert.Status = AlertResolved
+			alert.ResolvedAt = &now
+		}
+		return nil
+	})
+}
+
+// @info Read-modify-write of an alert with conflict retries, see dbdriver.UpdateDocument
+func updatePrinterAlert(client *dbdriver.CouchDBClient, id string, mutate func(alert *PrinterAlert) error) (*PrinterAlert, error) {
+	alert := &PrinterAlert{}
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		alert = &PrinterAlert{}
+		if err := dbdriver.DecodeDocument(doc, alert); err != nil {
+			return err
+		}
+		if alert.Type != PrinterAlertDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a printer alert"}
+		}
+		if err := mutate(alert); err != nil {
+			return err
+		}
+		alert.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(alert)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetPrinterAlert(client, id)
+}
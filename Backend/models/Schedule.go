@@ -0,0 +1,781 @@
+package models
+
+import (
+	"3DQuest/config"
+	"3DQuest/connector"
+	"3DQuest/dbdriver"
+	"3DQuest/quote"
+	"3DQuest/scheduler"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const PrintJobDocType = "print_job"
+
+type JobStatus string
+
+const (
+	JobPlanned   JobStatus = "planned"  // Replaced every time the queue is replanned
+	JobStarting  JobStatus = "starting" // Its G-code is being sent to the printer, see StartJob
+	JobPrinting  JobStatus = "printing"
+	JobDone      JobStatus = "done"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// @info A plate: parts of one or more orders printed together on a printer
+type PrintJob struct {
+	ID           string                `json:"_id"`
+	Rev          string                `json:"_rev,omitempty"`
+	Type         string                `json:"type" validate:"required"`
+	PrinterID    string                `json:"printer_id" validate:"required"`
+	Status       JobStatus             `json:"status" validate:"required,enum=planned|starting|printing|done|failed|cancelled"`
+	Material     string                `json:"material,omitempty"`
+	Colour       string                `json:"colour,omitempty"`
+	Parts        []scheduler.PlatePart `json:"parts" validate:"required"`
+	Seconds      float64               `json:"seconds" validate:"min=0"` // Estimated print time
+	Grams        float64               `json:"grams" validate:"min=0"`   // Estimated filament, zero if unknown
+	PlannedStart time.Time             `json:"planned_start" validate:"required"`
+	PlannedEnd   time.Time             `json:"planned_end" validate:"required"`
+	DueAt        *time.Time            `json:"due_at,omitempty"` // Earliest due date of its orders
+	Late         bool                  `json:"late"`             // Planned to end after DueAt
+	StartedAt    *time.Time            `json:"started_at,omitempty"`
+	FinishedAt   *time.Time            `json:"finished_at,omitempty"`
+	Note         string                `json:"note,omitempty" validate:"maxlen=2048"` // Why it failed
+	RemoteFile   string                `json:"remote_file,omitempty"`                 // Name of its G-code on the printer host, if it was sent there
+	Usage        *FilamentUsage        `json:"usage,omitempty"`                       // Filament taken from the spools when it was done
+	CreatedAt    time.Time             `json:"created_at" validate:"required"`
+	UpdatedAt    time.Time             `json:"updated_at" validate:"required"`
+}
+
+// @info Jobs planned, starting or printing, in the order they start, and the parts that could not be planned
+type PrintQueue struct {
+	Jobs      []PrintJob           `json:"jobs"`
+	Unplaced  []scheduler.Unplaced `json:"unplaced"`
+	PlannedAt *time.Time           `json:"planned_at,omitempty"` // Last replan made by this server
+}
+
+// @info Plans the accepted orders on the printers and drives orders and printers as jobs start, finish and fail.
+// Writes are serialised within the process, so a single instance should run the scheduler.
+type PrintScheduler struct {
+	client    *dbdriver.CouchDBClient
+	opts      scheduler.Options
+	mu        sync.Mutex
+	unplaced  []scheduler.Unplaced
+	plannedAt *time.Time
+
+	linkMu    sync.Mutex // Guards the fields below, see Telemetry.go
+	links     map[string]*printerLink
+	telemetry map[string]*connector.Status
+	seenJobs  map[string]bool
+}
+
+// @info Orders whose parts are waiting for a printer or on one
+var schedulableStatuses = []OrderStatus{OrderAccepted, OrderQueued, OrderPrinting, OrderReprint}
+
+// @info Jobs holding a printer or waiting for one
+var activeJobStatuses = []JobStatus{JobStarting, JobPrinting, JobPlanned}
+
+// @info Assumed print time of a copy that can't be estimated
+const defaultPartSeconds = 3600
+
+// @info Sorted like the jobs index, see EnsureIndexes
+var jobSort = []interface{}{map[string]string{"type": "asc"}, map[string]string{"planned_start": "asc"}}
+
+// @error An error if the opening hours or time zone of the shop are invalid
+func NewPrintScheduler(client *dbdriver.CouchDBClient, cfg *config.ShopConfig) (*PrintScheduler, error) {
+	hours, err := scheduler.ParseHours(cfg.OpeningHours, cfg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	opts := scheduler.Options{Hours: hours, Overnight: cfg.Overnight, MaxPlate: cfg.MaxPlate, MaterialChange: cfg.MaterialChange}
+	return &PrintScheduler{
+		client:    client,
+		opts:      opts,
+		unplaced:  []scheduler.Unplaced{},
+		links:     map[string]*printerLink{},
+		telemetry: map[string]*connector.Status{},
+		seenJobs:  map[string]bool{},
+	}, nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no job with that ID
+func GetPrintJob(client *dbdriver.CouchDBClient, id string) (*PrintJob, error) {
+	job := &PrintJob{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return job, err
+	}
+	if err = dbdriver.DecodeDocument(doc, job); err != nil {
+		return job, err
+	}
+	if job.Type != PrintJobDocType {
+		return job, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a print job"}
+	}
+	return job, nil
+}
+
+// @info The queue of every printer, or of one if printerID is given
+func (s *PrintScheduler) Queue(printerID string) (*PrintQueue, error) {
+	jobs, err := findPrintJobs(s.client, map[string]interface{}{"status": map[string]interface{}{"$in": activeJobStatuses}}, jobSort)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	queue := &PrintQueue{Jobs: []PrintJob{}, Unplaced: s.unplaced, PlannedAt: s.plannedAt}
+	s.mu.Unlock()
+	for _, job := range jobs {
+		if printerID == "" || job.PrinterID == printerID {
+			queue.Jobs = append(queue.Jobs, job)
+		}
+	}
+	return queue, nil
+}
+
+// @info Plans again every part waiting for a printer: planned jobs are replaced, jobs printing are kept. Accepted and
+// reprinted orders with a plate are moved to queued.
+func (s *PrintScheduler) Replan() (*PrintQueue, error) {
+	s.mu.Lock()
+	err := s.replan()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.Queue("")
+}
+
+func (s *PrintScheduler) replan() error {
+	now := time.Now().UTC()
+	printers, _, err := ListPrinters(s.client, &PrinterFilter{}, 0, "")
+	if err != nil {
+		return err
+	}
+	active, err := findPrintJobs(s.client, map[string]interface{}{"status": map[string]interface{}{"$in": activeJobStatuses}}, jobSort)
+	if err != nil {
+		return err
+	}
+	candidates := []scheduler.Printer{}
+	for _, printer := range printers {
+		if !printer.IsAvailable() {
+			continue
+		}
+		candidate := scheduler.Printer{
+			ID:           printer.ID,
+			BuildVolume:  printer.BuildVolume,
+			Nozzles:      printer.NozzleDiameters,
+			Materials:    printer.Materials,
+			Loaded:       printer.LoadedMaterial,
+			LoadedColour: printer.LoadedColour,
+		}
+		for _, job := range active {
+			if job.PrinterID != printer.ID || job.Status == JobPlanned {
+				continue
+			}
+			start := now
+			if job.StartedAt != nil {
+				start = *job.StartedAt
+			}
+			candidate.FreeAt = start.Add(time.Duration(job.Seconds * float64(time.Second)))
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	orders, err := findOrders(s.client, schedulableStatuses)
+	if err != nil {
+		return err
+	}
+	printed, err := s.printedCopies(orders)
+	if err != nil {
+		return err
+	}
+	rules, err := GetCurrentPricingRules(s.client)
+	if err != nil && !dbdriver.IsNotFound(err) { // @info Without tariffs the filament of models is not estimated
+		return err
+	}
+	parts := []scheduler.Part{}
+	for i := range orders {
+		for index := range orders[i].Items {
+			part := orderPart(&orders[i], index, rules)
+			part.Quantity -= printed[partKey(orders[i].ID, index, orders[i].Reprints)]
+			if part.Quantity > 0 {
+				parts = append(parts, part)
+			}
+		}
+	}
+
+	opts := s.opts
+	opts.Now = now
+	plates, unplaced := scheduler.Plan(candidates, parts, opts)
+	if err := s.savePlan(active, plates, now); err != nil {
+		return err
+	}
+	planned := map[string]bool{}
+	for _, plate := range plates {
+		for _, part := range plate.Parts {
+			planned[part.OrderID] = true
+		}
+	}
+	for _, order := range orders {
+		if (order.Status == OrderAccepted || order.Status == OrderReprint) && planned[order.ID] {
+			_, err := TransitionOrder(s.client, order.ID, &OrderTransition{To: OrderQueued, Note: "Planned by the print scheduler", Actor: ActorSystem})
+			if err != nil && !isTransitionError(err) {
+				return err
+			}
+		}
+	}
+	s.unplaced = unplaced
+	s.plannedAt = &now
+	return nil
+}
+
+// @info Reuses the planned jobs (preferably of the same printer) for the new plates, so their IDs mostly survive
+// a replan, and deletes the ones left over
+func (s *PrintScheduler) savePlan(active []PrintJob, plates []scheduler.Plate, now time.Time) error {
+	reusable := []PrintJob{}
+	for _, job := range active {
+		if job.Status == JobPlanned {
+			reusable = append(reusable, job)
+		}
+	}
+	for _, plate := range plates {
+		job := PrintJob{CreatedAt: now}
+		for i := range reusable {
+			if reusable[i].PrinterID == plate.PrinterID || i == len(reusable)-1 {
+				job = reusable[i]
+				reusable = append(reusable[:i], reusable[i+1:]...)
+				break
+			}
+		}
+		job.Type = PrintJobDocType
+		job.Status = JobPlanned
+		job.PrinterID = plate.PrinterID
+		job.Material = plate.Material
+		job.Colour = plate.Colour
+		job.Parts = plate.Parts
+		job.Seconds = plate.Seconds
+		job.Grams = math.Round(plate.Grams*10) / 10
+		job.PlannedStart = plate.Start
+		job.PlannedEnd = plate.End
+		job.DueAt = plate.DueAt
+		job.Late = plate.Late
+		job.UpdatedAt = now
+		if err := savePrintJob(s.client, &job); err != nil {
+			return err
+		}
+	}
+	for _, job := range reusable {
+		if _, err := dbdriver.DeleteDocument(s.client, job.ID, job.Rev); err != nil && !dbdriver.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// @info Starts a planned job: its printer and orders move to printing. Sliced G-code is sent to printers with a
+// connection and started there, see startRemote. The job is held as starting while it is sent, which may take
+// minutes, so the rest of the scheduler is not blocked; if sending fails it goes back to planned.
+func (s *PrintScheduler) StartJob(id string) (*PrintJob, error) {
+	job, printer, previous, err := s.claimJob(id)
+	if err != nil {
+		return nil, err
+	}
+	sendErr := s.startRemote(printer, job)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sendErr != nil {
+		s.unclaimJob(job.ID, previous)
+		return nil, sendErr
+	}
+	remoteFile := job.RemoteFile
+	if job, err = GetPrintJob(s.client, id); err != nil {
+		return nil, err
+	}
+	if job.Status != JobStarting { // @info Failed by the staff or with its printer while it was sent
+		return nil, jobStatusError(job, JobPrinting)
+	}
+	now := time.Now().UTC()
+	job.Status = JobPrinting
+	job.RemoteFile = remoteFile
+	job.StartedAt = &now
+	job.UpdatedAt = now
+	if err := savePrintJob(s.client, job); err != nil {
+		if remoteFile != "" {
+			fmt.Fprintf(os.Stderr, "Warning: Job %s is printing as %s but couldn't be marked as printing: %v\n", job.ID, remoteFile, err)
+		}
+		return nil, err
+	}
+	printer, err = updatePrinter(s.client, job.PrinterID, func(printer *Printer) error {
+		printer.LoadedMaterial = job.Material
+		if job.Colour != "" {
+			printer.LoadedColour = job.Colour
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, orderID := range job.orderIDs() {
+		_, err := TransitionOrder(s.client, orderID, &OrderTransition{To: OrderPrinting, Note: fmt.Sprintf("Printing on %s", printer.Name), Actor: ActorSystem})
+		if err != nil && !isTransitionError(err) {
+			return nil, err
+		}
+	}
+	return job, s.replan()
+}
+
+// @info Moves a planned job to starting and its printer to printing, so neither can be started again while the
+// G-code is sent. Returns the status the printer had.
+func (s *PrintScheduler) claimJob(id string) (*PrintJob, *Printer, PrinterStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, err := GetPrintJob(s.client, id)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if job.Status != JobPlanned {
+		return nil, nil, "", jobStatusError(job, JobPrinting)
+	}
+	busy, err := findPrintJobs(s.client, map[string]interface{}{"status": map[string]interface{}{"$in": []JobStatus{JobStarting, JobPrinting}}, "printer_id": job.PrinterID}, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(busy) > 0 {
+		return nil, nil, "", &dbdriver.ValidationError{DocType: PrintJobDocType, Fields: []dbdriver.FieldError{{Field: "printer_id", Message: "the printer is already printing " + busy[0].ID}}}
+	}
+	job.Status = JobStarting
+	job.UpdatedAt = time.Now().UTC()
+	if err := savePrintJob(s.client, job); err != nil {
+		return nil, nil, "", err
+	}
+	previous := PrinterStatus("")
+	printer, err := updatePrinter(s.client, job.PrinterID, func(printer *Printer) error {
+		if !printer.IsAvailable() {
+			return printerUnavailableError(printer)
+		}
+		previous = printer.Status
+		printer.Status = PrinterPrinting
+		return nil
+	})
+	if err != nil {
+		s.unclaimJob(job.ID, "")
+		return nil, nil, "", err
+	}
+	return job, printer, previous, nil
+}
+
+// @info Puts a job that could not be started back to planned, and its printer back to the status it had unless
+// someone changed it meanwhile. Failures are only reported, the error that made the start fail is the one returned.
+func (s *PrintScheduler) unclaimJob(id string, previous PrinterStatus) {
+	job, err := GetPrintJob(s.client, id)
+	if err == nil && job.Status == JobStarting {
+		job.Status = JobPlanned
+		job.UpdatedAt = time.Now().UTC()
+		err = savePrintJob(s.client, job)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Couldn't put job %s back to planned: %v\n", id, err)
+		return
+	}
+	if previous == "" || previous == PrinterPrinting {
+		return
+	}
+	_, err = updatePrinter(s.client, job.PrinterID, func(printer *Printer) error {
+		if printer.Status == PrinterPrinting {
+			printer.Status = previous
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Couldn't put the printer %s back to %s: %v\n", job.PrinterID, previous, err)
+	}
+}
+
+// @info Finishes a printing job. Orders with every copy printed move on to post-processing, or to ready if none of
+// their items has extras.
+func (s *PrintScheduler) CompleteJob(id string, reported *FilamentReport) (*PrintJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, err := s.finishJob(id, JobDone, "")
+	if err != nil {
+		return nil, err
+	}
+	// @info The print is done whatever the inventory says, a spool off by a few grams is fixed by weighing it
+	if err := ConsumeFilament(s.client, job, reported); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Couldn't take the filament of job %s from the spools: %v\n", job.ID, err)
+	}
+	orders := []Order{}
+	for _, orderID := range job.orderIDs() {
+		order, err := GetOrder(s.client, orderID)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	printed, err := s.printedCopies(orders)
+	if err != nil {
+		return nil, err
+	}
+	printing, err := findPrintJobs(s.client, map[string]interface{}{"status": map[string]interface{}{"$in": []JobStatus{JobStarting, JobPrinting}}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range orders {
+		if order.Status != OrderPrinting || !order.allPrinted(printed) || hasOrder(printing, order.ID) {
+			continue
+		}
+		next := OrderReady
+		for _, item := range order.Items {
+			if len(item.PostProcessing) > 0 {
+				next = OrderPostProcessing
+			}
+		}
+		_, err := TransitionOrder(s.client, order.ID, &OrderTransition{To: next, Note: "Every part was printed", Actor: ActorSystem})
+		if err != nil && !isTransitionError(err) {
+			return nil, err
+		}
+	}
+	return job, s.replan()
+}
+
+// @info Marks a printing job as failed and its orders as failed, to be reprinted or cancelled by the staff. Plates
+// of those orders already printed are kept for the reprint.
+func (s *PrintScheduler) FailJob(id string, note string) (*PrintJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, err := s.failJob(id, note)
+	if err != nil {
+		return nil, err
+	}
+	return job, s.replan()
+}
+
+func (s *PrintScheduler) failJob(id string, note string) (*PrintJob, error) {
+	job, err := s.finishJob(id, JobFailed, note)
+	if err != nil {
+		return nil, err
+	}
+	for _, orderID := range job.orderIDs() {
+		order, err := TransitionOrder(s.client, orderID, &OrderTransition{To: OrderFailed, Note: "Print failed: " + note, Actor: ActorSystem})
+		if err != nil {
+			if isTransitionError(err) {
+				continue
+			}
+			return nil, err
+		}
+		if err := s.carryOver(order); err != nil {
+			return nil, err
+		}
+	}
+	return job, nil
+}
+
+// @info Changes the status of a printer. A printer that stops being available fails the job it was printing, and
+// its planned jobs go to other printers.
+func (s *PrintScheduler) SetPrinterStatus(id string, status PrinterStatus, note string) (*Printer, PrinterStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	printer, previous, err := SetPrinterStatus(s.client, id, status)
+	if err != nil {
+		return nil, "", err
+	}
+	if !printer.IsAvailable() {
+		printing, err := findPrintJobs(s.client, map[string]interface{}{"status": map[string]interface{}{"$in": []JobStatus{JobStarting, JobPrinting}}, "printer_id": id}, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		if note == "" {
+			note = fmt.Sprintf("The printer went %s", status)
+		}
+		for _, job := range printing {
+			if job.Status == JobStarting { // @info Nothing was printed yet, StartJob sees it planned again and gives up
+				job.Status = JobPlanned
+				job.UpdatedAt = time.Now().UTC()
+				if err := savePrintJob(s.client, &job); err != nil {
+					return nil, "", err
+				}
+				continue
+			}
+			if _, err := s.failJob(job.ID, note); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	if previous != status {
+		if err := s.replan(); err != nil {
+			return nil, "", err
+		}
+	}
+	printer, err = GetPrinter(s.client, id)
+	return printer, previous, err
+}
+
+// @info Moves a printing job to done or failed and frees its printer. Jobs left starting, by a server that stopped
+// while sending their G-code, can be failed too.
+func (s *PrintScheduler) finishJob(id string, status JobStatus, note string) (*PrintJob, error) {
+	job, err := GetPrintJob(s.client, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != JobPrinting && (job.Status != JobStarting || status != JobFailed) {
+		return nil, jobStatusError(job, status)
+	}
+	now := time.Now().UTC()
+	job.Status = status
+	job.Note = note
+	job.FinishedAt = &now
+	job.UpdatedAt = now
+	if err := savePrintJob(s.client, job); err != nil {
+		return nil, err
+	}
+	_, err = updatePrinter(s.client, job.PrinterID, func(printer *Printer) error {
+		if printer.Status == PrinterPrinting || printer.Status == PrinterPaused {
+			printer.Status = PrinterIdle
+		}
+		return nil
+	})
+	s.forgetJob(job.ID)
+	return job, err
+}
+
+// @info Copies of each item of the orders in jobs starting, printing or done, counting only the current run of each order
+func (s *PrintScheduler) printedCopies(orders []Order) (map[string]int, error) {
+	printed := map[string]int{}
+	if len(orders) == 0 {
+		return printed, nil
+	}
+	runs := map[string]int{}
+	ids := []string{}
+	for _, order := range orders {
+		runs[order.ID] = order.Reprints
+		ids = append(ids, order.ID)
+	}
+	selector := map[string]interface{}{
+		"status": map[string]interface{}{"$in": []JobStatus{JobStarting, JobPrinting, JobDone}},
+		"parts":  map[string]interface{}{"$elemMatch": map[string]interface{}{"order_id": map[string]interface{}{"$in": ids}}},
+	}
+	jobs, err := findPrintJobs(s.client, selector, nil)
+	if err != nil {
+		return printed, err
+	}
+	for _, job := range jobs {
+		for _, part := range job.Parts {
+			if run, ok := runs[part.OrderID]; ok && part.Run == run {
+				printed[partKey(part.OrderID, part.Item, part.Run)] += part.Quantity
+			}
+		}
+	}
+	return printed, nil
+}
+
+// @info Counts the plates already printed for a failed order towards its reprint, which increments its run
+func (s *PrintScheduler) carryOver(order *Order) error {
+	jobs, err := findPrintJobs(s.client, map[string]interface{}{
+		"status": JobDone,
+		"parts":  map[string]interface{}{"$elemMatch": map[string]interface{}{"order_id": order.ID, "run": order.Reprints}},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		for i := range job.Parts {
+			if job.Parts[i].OrderID == order.ID && job.Parts[i].Run == order.Reprints {
+				job.Parts[i].Run++
+			}
+		}
+		job.UpdatedAt = time.Now().UTC()
+		if err := savePrintJob(s.client, &job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// @info What the planner needs to know about an item. Print times and filament come from the quote, the G-code or,
+// failing those, an estimate with the tariffs in force.
+func orderPart(order *Order, index int, rules *PricingRules) scheduler.Part {
+	item := &order.Items[index]
+	part := scheduler.Part{
+		OrderID:  order.ID,
+		Item:     index,
+		Run:      order.Reprints,
+		Name:     item.Name,
+		Material: item.Material,
+		Colour:   item.Colour,
+		Quantity: item.Quantity,
+		DueAt:    order.DueAt,
+		Since:    order.CreatedAt,
+		Seconds:  defaultPartSeconds,
+	}
+	if accepted, ok := order.StatusTimes[OrderAccepted]; ok {
+		part.Since = accepted
+	}
+	switch {
+	case item.GCode != nil:
+		part.Sliced = true
+		part.Size = item.GCode.BoundingBox.Size()
+		part.Nozzle = item.GCode.NozzleDiameterMM
+		if part.Material == "" {
+			part.Material = item.GCode.Material
+		}
+	case item.Model != nil:
+		part.Size = item.Model.Size
+	}
+	switch {
+	case item.GCode != nil:
+		part.Grams = item.GCode.SlicerFilamentGrams
+		if part.Grams == 0 {
+			part.Grams = item.GCode.FilamentGrams
+		}
+	case order.Quote != nil && index < len(order.Quote.Lines):
+		part.Grams = order.Quote.Lines[index].FilamentGrams
+	}
+	switch {
+	case order.Quote != nil && index < len(order.Quote.Lines) && order.Quote.Lines[index].PrintSeconds > 0:
+		part.Seconds = float64(order.Quote.Lines[index].PrintSeconds)
+	case item.GCode != nil && item.GCode.PrintSeconds > 0:
+		part.Seconds = item.GCode.PrintSeconds
+	case item.Model != nil && rules != nil:
+		estimate, err := quote.Calculate(&rules.Rules, []quote.Item{{
+			Name:          item.Name,
+			Model:         item.Model,
+			Material:      item.Material,
+			InfillPercent: item.InfillPercent,
+			LayerHeightMM: item.LayerHeightMM,
+			Quantity:      1,
+		}}, "")
+		if err == nil && estimate.Lines[0].PrintSeconds > 0 {
+			part.Seconds = float64(estimate.Lines[0].PrintSeconds)
+		}
+		if err == nil && part.Grams == 0 {
+			part.Grams = estimate.Lines[0].FilamentGrams
+		}
+	}
+	return part
+}
+
+// @info Whether every copy of every item was printed in the current run
+func (o *Order) allPrinted(printed map[string]int) bool {
+	for index, item := range o.Items {
+		if printed[partKey(o.ID, index, o.Reprints)] < item.Quantity {
+			return false
+		}
+	}
+	return true
+}
+
+func partKey(orderID string, item int, run int) string {
+	return fmt.Sprintf("%s/%d/%d", orderID, item, run)
+}
+
+func (j *PrintJob) orderIDs() []string {
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, part := range j.Parts {
+		if !seen[part.OrderID] {
+			seen[part.OrderID] = true
+			ids = append(ids, part.OrderID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func hasOrder(jobs []PrintJob, orderID string) bool {
+	for _, job := range jobs {
+		for _, part := range job.Parts {
+			if part.OrderID == orderID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isTransitionError(err error) bool {
+	var transitionErr *TransitionError
+	return errors.As(err, &transitionErr)
+}
+
+func printerUnavailableError(printer *Printer) error {
+	return &dbdriver.ValidationError{DocType: PrintJobDocType, Fields: []dbdriver.FieldError{{Field: "printer_id", Message: fmt.Sprintf("the printer is %s", printer.Status)}}}
+}
+
+func jobStatusError(job *PrintJob, to JobStatus) error {
+	return &dbdriver.ValidationError{DocType: PrintJobDocType, Fields: []dbdriver.FieldError{{Field: "status", Message: fmt.Sprintf("a %s job can't become %s", job.Status, to)}}}
+}
+
+func savePrintJob(client *dbdriver.CouchDBClient, job *PrintJob) error {
+	doc, err := dbdriver.EncodeDocument(job)
+	if err != nil {
+		return err
+	}
+	if job.Rev == "" {
+		delete(doc, "_rev")
+	}
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, job.ID)
+	if err != nil {
+		return err
+	}
+	job.ID = resp_data.ID
+	job.Rev = resp_data.REV
+	return nil
+}
+
+// @info Every job matching the selector, following the bookmarks
+func findPrintJobs(client *dbdriver.CouchDBClient, selector map[string]interface{}, sort []interface{}) ([]PrintJob, error) {
+	selector["type"] = PrintJobDocType
+	jobs := []PrintJob{}
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: 200, Bookmark: bookmark, Sort: sort}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return jobs, err
+		}
+		for _, doc := range found.Docs {
+			job := PrintJob{}
+			if err := dbdriver.DecodeDocument(doc, &job); err != nil {
+				return jobs, err
+			}
+			jobs = append(jobs, job)
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			return jobs, nil
+		}
+		bookmark = found.Bookmark
+	}
+}
+
+// @info Every order in one of the statuses, oldest first
+func findOrders(client *dbdriver.CouchDBClient, statuses []OrderStatus) ([]Order, error) {
+	orders := []Order{}
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{
+			Selector: map[string]interface{}{"type": OrderDocType, "status": map[string]interface{}{"$in": statuses}},
+			Limit:    200,
+			Bookmark: bookmark,
+		}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return orders, err
+		}
+		for _, doc := range found.Docs {
+			order := Order{}
+			if err := dbdriver.DecodeDocument(doc, &order); err != nil {
+				return orders, err
+			}
+			orders = append(orders, order)
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			return orders, nil
+		}
+		bookmark = found.Bookmark
+	}
+}
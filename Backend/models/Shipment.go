@@ -0,0 +1,559 @@
+package models
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/shipping"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+const ShipmentDocType = "shipment"
+
+// @info Where the prints of an order are. Parcels take the statuses of the carrier, see shipping.Status.
+type ShipmentStatus string
+
+const (
+	ShipmentPending        ShipmentStatus = "pending"          // Being packed, or waiting for its label
+	ShipmentReadyForPickup ShipmentStatus = "ready_for_pickup" // At the pickup point, waiting for the customer
+	ShipmentCollected      ShipmentStatus = "collected"
+)
+
+const shipmentLabelName = "label"
+
+// @info Longest wait for an answer of the carrier
+const CarrierTimeout = 30 * time.Second
+
+var (
+	ErrNotShippable    = errors.New("Only orders ready and with a delivery chosen can be shipped")
+	ErrShipmentClosed  = errors.New("The shipment was already delivered, collected or returned")
+	ErrLabelExists     = errors.New("The shipment already has a label, cancel it first")
+	ErrNoLabel         = errors.New("The shipment has no label of the carrier")
+	ErrNoCarrier       = errors.New("No carrier is configured, enter the tracking number by hand")
+	ErrWrongPickupCode = errors.New("The pickup code is not the one of the order")
+	ErrCarrier         = errors.New("The carrier refused the request")
+)
+
+type ShipmentEvent struct {
+	Status      ShipmentStatus `json:"status"`
+	Description string         `json:"description,omitempty"`
+	Location    string         `json:"location,omitempty"`
+	Source      string         `json:"source"` // carrier, or the user who recorded it
+	At          time.Time      `json:"at"`
+}
+
+// @info How the prints of an order get to the customer. Orders have one at most, made once they are ready.
+type Shipment struct {
+	ID             string            `json:"_id"`
+	Rev            string            `json:"_rev,omitempty"`
+	Type           string            `json:"type" validate:"required"`
+	OrderID        string            `json:"order_id" validate:"required"`
+	CustomerID     string            `json:"customer_id" validate:"required"`
+	Method         DeliveryMethod    `json:"method" validate:"required,enum=pickup|parcel"`
+	PickupPoint    string            `json:"pickup_point,omitempty"`
+	PickupCode     string            `json:"pickup_code,omitempty"` // Shown by the customer to collect the prints
+	Service        string            `json:"service,omitempty"`
+	Address        *shipping.Address `json:"address,omitempty"`
+	Parcel         *shipping.Parcel  `json:"parcel,omitempty"`  // As packed, or estimated until the label is made
+	Carrier        string            `json:"carrier,omitempty"` // Carrier that made the label, empty if entered by hand
+	TrackingNumber string            `json:"tracking_number,omitempty"`
+	TrackingURL    string            `json:"tracking_url,omitempty"`
+	Status         ShipmentStatus    `json:"status" validate:"required"`
+	Events         []ShipmentEvent   `json:"events"`
+	CreatedAt      time.Time         `json:"created_at" validate:"required"`
+	CompletedAt    *time.Time        `json:"completed_at,omitempty"` // Delivered, collected or returned
+	UpdatedAt      time.Time         `json:"updated_at" validate:"required"`
+
+	Attachments map[string]dbdriver.Attachment `json:"_attachments,omitempty"` // The label, see ShipmentLabel
+}
+
+// @info What the staff record about a shipment, see RecordShipmentEvent
+type ShipmentUpdate struct {
+	Status         ShipmentStatus `json:"status"`
+	Description    string         `json:"description"`
+	Location       string         `json:"location"`
+	TrackingNumber string         `json:"tracking_number"` // Of a label bought outside the backend
+	TrackingURL    string         `json:"tracking_url"`
+}
+
+// @info Filters of ListShipments. Empty fields match every shipment.
+type ShipmentFilter struct {
+	CustomerID string
+	Status     ShipmentStatus
+}
+
+var shipmentSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"created_at": "desc"}}
+var customerShipmentSort = []interface{}{map[string]string{"type": "desc"}, map[string]string{"customer_id": "desc"}, map[string]string{"created_at": "desc"}}
+
+func shipmentID(orderID string) string {
+	return ShipmentDocType + ":" + orderID
+}
+
+// @info Whether nothing else will happen to the shipment
+func (s *Shipment) IsClosed() bool {
+	return s.Status == ShipmentCollected || shipping.Status(s.Status).Final()
+}
+
+// @info Makes the shipment of an order ready with its delivery. Asking again answers the one made.
+// @error ErrNotShippable
+func CreateShipment(client *dbdriver.CouchDBClient, orderID string) (*Shipment, error) {
+	order, err := GetOrder(client, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if order.ShipmentID != "" {
+		return GetShipment(client, order.ShipmentID)
+	}
+	if order.Status != OrderReady || order.Delivery == nil {
+		return nil, ErrNotShippable
+	}
+	now := time.Now().UTC()
+	delivery := order.Delivery
+	shipment := &Shipment{
+		ID:          shipmentID(order.ID),
+		Type:        ShipmentDocType,
+		OrderID:     order.ID,
+		CustomerID:  order.CustomerID,
+		Method:      delivery.Method,
+		PickupPoint: delivery.PickupPoint,
+		Service:     delivery.Service,
+		Address:     delivery.Address,
+		Parcel:      delivery.Parcel,
+		Status:      ShipmentPending,
+		Events:      []ShipmentEvent{{Status: ShipmentPending, Description: "Being packed", Source: "system", At: now}},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if shipment.Method == DeliveryPickup {
+		if shipment.PickupCode, err = newPickupCode(); err != nil {
+			return nil, err
+		}
+	}
+	doc, err := dbdriver.EncodeDocument(shipment)
+	if err != nil {
+		return nil, err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, shipment.ID)
+	if dbdriver.IsConflict(err) {
+		// @info Made in between, e.g. by the scheduler and the staff at once
+		shipment, err = GetShipment(client, shipment.ID)
+	} else if err == nil {
+		shipment.Rev = resp_data.REV
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = updateOrder(client, order.ID, func(order *Order) error {
+		order.ShipmentID = shipment.ID
+		return nil
+	})
+	return shipment, err
+}
+
+// @info Six random digits
+func newPickupCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no shipment with that ID
+func GetShipment(client *dbdriver.CouchDBClient, id string) (*Shipment, error) {
+	shipment := &Shipment{}
+	doc, err := dbdriver.GetDocument(client, id)
+	if err != nil {
+		return shipment, err
+	}
+	if err = dbdriver.DecodeDocument(doc, shipment); err != nil {
+		return shipment, err
+	}
+	if shipment.Type != ShipmentDocType {
+		return shipment, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a shipment"}
+	}
+	return shipment, nil
+}
+
+// @info Newest shipments first. Pass the returned bookmark to get the next page.
+func ListShipments(client *dbdriver.CouchDBClient, filter *ShipmentFilter, limit uint64, bookmark string) ([]Shipment, string, error) {
+	selector := map[string]interface{}{"type": ShipmentDocType}
+	sort := shipmentSort
+	if filter.CustomerID != "" {
+		selector["customer_id"] = filter.CustomerID
+		sort = customerShipmentSort
+	}
+	if filter.Status != "" {
+		selector["status"] = filter.Status
+	}
+	opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: sort}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	shipments := []Shipment{}
+	if err != nil {
+		return shipments, "", err
+	}
+	for _, doc := range found.Docs {
+		shipment := Shipment{}
+		if err := dbdriver.DecodeDocument(doc, &shipment); err != nil {
+			return shipments, "", err
+		}
+		shipments = append(shipments, shipment)
+	}
+	return shipments, found.Bookmark, nil
+}
+
+// @info Buys the label of a parcel from the carrier and stores it with the shipment. parcel replaces the estimate
+// when given, once the prints are packed.
+// @error ErrNoCarrier, ErrLabelExists, ErrShipmentClosed, ErrCarrier, shipping.ErrTooHeavy or shipping.ErrTooLarge
+func CreateShipmentLabel(ctx context.Context, client *dbdriver.CouchDBClient, carrier shipping.Carrier, cfg *config.ShippingConfig, id string, parcel *shipping.Parcel) (*Shipment, error) {
+	if carrier == nil {
+		return nil, ErrNoCarrier
+	}
+	shipment, err := GetShipment(client, id)
+	if err != nil {
+		return nil, err
+	}
+	if shipment.Method != DeliveryParcel {
+		return nil, &dbdriver.ValidationError{DocType: ShipmentDocType, Fields: []dbdriver.FieldError{{Field: "method", Message: "only parcels have labels"}}}
+	}
+	if err := shipment.checkLabelFree(); err != nil {
+		return nil, err
+	}
+	if parcel == nil {
+		parcel = shipment.Parcel
+	}
+	if parcel == nil || parcel.WeightGrams <= 0 || parcel.LengthMM <= 0 || parcel.WidthMM <= 0 || parcel.HeightMM <= 0 {
+		return nil, &dbdriver.ValidationError{DocType: ShipmentDocType, Fields: []dbdriver.FieldError{{Field: "parcel", Message: "weight and sides must be positive"}}}
+	}
+	service, err := GetShippingService(client, shipment.Service)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := service.Rates.Price(*parcel); err != nil {
+		return nil, err
+	}
+	label, err := carrier.CreateLabel(ctx, &shipping.LabelRequest{
+		Reference: shipment.OrderID,
+		Service:   shipment.Service,
+		From:      cfg.Sender(),
+		To:        *shipment.Address,
+		Parcel:    *parcel,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCarrier, err.Error())
+	}
+	shipment, err = updateShipment(client, id, func(shipment *Shipment) error {
+		if err := shipment.checkLabelFree(); err != nil {
+			return err
+		}
+		shipment.Carrier = carrier.Name()
+		shipment.TrackingNumber, shipment.TrackingURL = label.TrackingNumber, label.TrackingURL
+		shipment.Parcel = parcel
+		shipment.addEvent(ShipmentEvent{Status: ShipmentStatus(shipping.StatusLabelCreated), Description: "Label created", Source: "carrier", At: time.Now().UTC()})
+		return nil
+	})
+	if err != nil {
+		if cancelErr := carrier.CancelLabel(ctx, label.TrackingNumber); cancelErr != nil {
+			fmt.Fprintln(os.Stderr, "Warning: couldn't cancel label", label.TrackingNumber, "that was not saved:", cancelErr)
+		}
+		return nil, err
+	}
+	if _, err := dbdriver.PutAttachment(client, shipment.ID, shipment.Rev, shipmentLabelName, label.ContentType, label.Data); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: couldn't store the label of shipment", shipment.ID+":", err)
+		return shipment, nil
+	}
+	return GetShipment(client, id)
+}
+
+func (s *Shipment) checkLabelFree() error {
+	if s.IsClosed() {
+		return ErrShipmentClosed
+	}
+	if s.TrackingNumber != "" {
+		return ErrLabelExists
+	}
+	return nil
+}
+
+// @info Voids the label of a parcel the carrier has not picked up, so another one can be made
+// @error ErrNoCarrier, ErrNoLabel, or ErrCarrier if the parcel was picked up
+func CancelShipmentLabel(ctx context.Context, client *dbdriver.CouchDBClient, carrier shipping.Carrier, id string, actorID string) (*Shipment, error) {
+	if carrier == nil {
+		return nil, ErrNoCarrier
+	}
+	shipment, err := GetShipment(client, id)
+	if err != nil {
+		return nil, err
+	}
+	if shipment.Carrier != carrier.Name() || shipment.TrackingNumber == "" {
+		return nil, ErrNoLabel
+	}
+	if err := carrier.CancelLabel(ctx, shipment.TrackingNumber); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCarrier, err.Error())
+	}
+	tracking := shipment.TrackingNumber
+	return updateShipment(client, id, func(shipment *Shipment) error {
+		if shipment.TrackingNumber != tracking {
+			return nil
+		}
+		shipment.Carrier, shipment.TrackingNumber, shipment.TrackingURL = "", "", ""
+		delete(shipment.Attachments, shipmentLabelName)
+		shipment.addEvent(ShipmentEvent{Status: ShipmentPending, Description: "Label " + tracking + " cancelled", Source: actorID, At: time.Now().UTC()})
+		return nil
+	})
+}
+
+// @info The label of the carrier and its content type
+func ShipmentLabel(client *dbdriver.CouchDBClient, shipment *Shipment) ([]byte, string, error) {
+	if _, stored := shipment.Attachments[shipmentLabelName]; !stored {
+		return nil, "", &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "the shipment has no label"}
+	}
+	return dbdriver.GetAttachment(client, shipment.ID, shipmentLabelName)
+}
+
+// @info Records what the staff know of a shipment: a parcel sent with a label bought outside the backend, news of
+// the carrier, or the prints arriving at the pickup point. Parcels picked up by the carrier ship their order.
+// @error ErrShipmentClosed, or a *dbdriver.ValidationError if the status does not fit the shipment
+func RecordShipmentEvent(client *dbdriver.CouchDBClient, invoiceCfg *config.InvoiceConfig, id string, update *ShipmentUpdate, actorID string) (*Shipment, error) {
+	fail := func(field string, message string) error {
+		return &dbdriver.ValidationError{DocType: ShipmentDocType, Fields: []dbdriver.FieldError{{Field: field, Message: message}}}
+	}
+	shipment, err := updateShipment(client, id, func(shipment *Shipment) error {
+		if shipment.IsClosed() {
+			return ErrShipmentClosed
+		}
+		switch shipment.Method {
+		case DeliveryPickup:
+			if update.Status != ShipmentReadyForPickup {
+				return fail("status", "must be ready_for_pickup, pickups are completed with their code")
+			}
+		case DeliveryParcel:
+			if !shipping.IsStatus(shipping.Status(update.Status)) {
+				return fail("status", "must be one of label_created, in_transit, out_for_delivery, delivered, exception, returned")
+			}
+			if update.TrackingNumber != "" {
+				if shipment.Carrier != "" && update.TrackingNumber != shipment.TrackingNumber {
+					return ErrLabelExists
+				}
+				shipment.TrackingNumber, shipment.TrackingURL = update.TrackingNumber, update.TrackingURL
+			}
+			if shipment.TrackingNumber == "" {
+				return fail("tracking_number", "is required")
+			}
+		}
+		shipment.addEvent(ShipmentEvent{Status: update.Status, Description: update.Description, Location: update.Location, Source: actorID, At: time.Now().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	completeShipmentOrder(client, invoiceCfg, shipment, actorID)
+	return shipment, nil
+}
+
+// @info Hands the prints to the customer who shows the pickup code, and marks the order collected
+// @error ErrShipmentClosed, ErrWrongPickupCode, or a *dbdriver.ValidationError if it is not a pickup
+func CollectShipment(client *dbdriver.CouchDBClient, invoiceCfg *config.InvoiceConfig, id string, code string, actorID string) (*Shipment, error) {
+	shipment, err := updateShipment(client, id, func(shipment *Shipment) error {
+		if shipment.Method != DeliveryPickup {
+			return &dbdriver.ValidationError{DocType: ShipmentDocType, Fields: []dbdriver.FieldError{{Field: "method", Message: "only pickups are collected"}}}
+		}
+		if shipment.IsClosed() {
+			return ErrShipmentClosed
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(shipment.PickupCode)) != 1 {
+			return ErrWrongPickupCode
+		}
+		shipment.addEvent(ShipmentEvent{Status: ShipmentCollected, Description: "Collected at " + shipment.PickupPoint, Source: actorID, At: time.Now().UTC()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	completeShipmentOrder(client, invoiceCfg, shipment, actorID)
+	return shipment, nil
+}
+
+func (s *Shipment) addEvent(event ShipmentEvent) {
+	s.Events = append(s.Events, event)
+	s.Status = event.Status
+	if s.IsClosed() && s.CompletedAt == nil {
+		at := event.At
+		s.CompletedAt = &at
+	}
+}
+
+// @info Moves the order of the shipment on once the carrier has the parcel or the customer collected it, and
+// invoices it. Failures are only warned about, the staff can still move the order by hand.
+func completeShipmentOrder(client *dbdriver.CouchDBClient, invoiceCfg *config.InvoiceConfig, shipment *Shipment, actorID string) {
+	next := OrderShipped
+	note := "Parcel " + shipment.TrackingNumber + " handed to the carrier"
+	switch {
+	case shipment.Status == ShipmentCollected:
+		next, note = OrderCollected, "Collected at "+shipment.PickupPoint
+	case !shipping.Status(shipment.Status).Dispatched():
+		return
+	}
+	order, err := updateOrder(client, shipment.OrderID, func(order *Order) error {
+		if order.Status != OrderReady {
+			return nil
+		}
+		return order.apply(&OrderTransition{To: next, Note: note, Actor: ActorSystem, ActorID: actorID})
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: couldn't move order", shipment.OrderID, "of shipment", shipment.ID+":", err)
+		return
+	}
+	if invoiceCfg.Enabled() && order.InvoiceID == "" {
+		if _, err := IssueInvoice(client, invoiceCfg, &InvoiceRequest{OrderID: order.ID}); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: couldn't invoice order", order.ID+":", err)
+		}
+	}
+}
+
+// @info Follows the parcels of a carrier, see Track
+type ShipmentTracker struct {
+	client  *dbdriver.CouchDBClient
+	carrier shipping.Carrier
+	invoice *config.InvoiceConfig
+}
+
+func NewShipmentTracker(client *dbdriver.CouchDBClient, carrier shipping.Carrier, invoiceCfg *config.InvoiceConfig) *ShipmentTracker {
+	return &ShipmentTracker{client: client, carrier: carrier, invoice: invoiceCfg}
+}
+
+// @info Calls Track every interval until ctx is cancelled
+func (t *ShipmentTracker) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := t.Track(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: Couldn't track the parcels:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// @info Asks the carrier where its parcels on the way are and records what is new. Returns how many shipments changed.
+func (t *ShipmentTracker) Track(ctx context.Context) (int, error) {
+	selector := map[string]interface{}{
+		"type":    ShipmentDocType,
+		"carrier": t.carrier.Name(),
+		"status":  map[string]interface{}{"$nin": []ShipmentStatus{ShipmentStatus(shipping.StatusDelivered), ShipmentStatus(shipping.StatusReturned)}},
+	}
+	changed := 0
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: 200, Bookmark: bookmark}
+		found, err := dbdriver.FindInDatabase(t.client, opts)
+		if err != nil {
+			return changed, err
+		}
+		for _, doc := range found.Docs {
+			shipment := Shipment{}
+			if err := dbdriver.DecodeDocument(doc, &shipment); err != nil {
+				return changed, err
+			}
+			updated, err := t.track(ctx, &shipment)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: Couldn't track shipment", shipment.ID+":", err)
+			} else if updated {
+				changed++
+			}
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			return changed, nil
+		}
+		bookmark = found.Bookmark
+	}
+}
+
+func (t *ShipmentTracker) track(ctx context.Context, shipment *Shipment) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, CarrierTimeout)
+	defer cancel()
+	events, err := t.carrier.Track(ctx, shipment.TrackingNumber)
+	if err != nil {
+		return false, err
+	}
+	added := false
+	shipment, err = updateShipment(t.client, shipment.ID, func(shipment *Shipment) error {
+		added = false
+		known := map[string]bool{}
+		for _, event := range shipment.Events {
+			if event.Source == "carrier" {
+				known[string(event.Status)+event.At.UTC().Format(time.RFC3339)] = true
+			}
+		}
+		for _, event := range events {
+			key := string(event.Status) + event.At.UTC().Format(time.RFC3339)
+			if known[key] || shipment.IsClosed() {
+				continue
+			}
+			if event.Status == shipping.StatusLabelCreated {
+				continue // @info Recorded when the label was made, see CreateShipmentLabel
+			}
+			shipment.addEvent(ShipmentEvent{Status: ShipmentStatus(event.Status), Description: event.Description, Location: event.Location, Source: "carrier", At: event.At.UTC()})
+			known[key], added = true, true
+		}
+		if !added {
+			return errNoChange
+		}
+		return nil
+	})
+	if errors.Is(err, errNoChange) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	completeShipmentOrder(t.client, t.invoice, shipment, "")
+	return true, nil
+}
+
+var errNoChange = errors.New("nothing changed")
+
+// @info Read-modify-write of a shipment with conflict retries, see dbdriver.UpdateDocument
+func updateShipment(client *dbdriver.CouchDBClient, id string, mutate func(shipment *Shipment) error) (*Shipment, error) {
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		shipment := &Shipment{}
+		if err := dbdriver.DecodeDocument(doc, shipment); err != nil {
+			return err
+		}
+		if shipment.Type != ShipmentDocType {
+			return &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a shipment"}
+		}
+		if err := mutate(shipment); err != nil {
+			return err
+		}
+		shipment.UpdatedAt = time.Now().UTC()
+		updated, err := dbdriver.EncodeDocument(shipment)
+		if err != nil {
+			return err
+		}
+		for key := range doc {
+			delete(doc, key)
+		}
+		for key, value := range updated {
+			doc[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetShipment(client, id)
+}
@@ -0,0 +1,399 @@
+package models
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/shipping"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	str "strings"
+	"time"
+)
+
+const (
+	PickupPointDocType     = "pickup_point"
+	ShippingServiceDocType = "shipping_service"
+)
+
+type DeliveryMethod string
+
+const (
+	DeliveryPickup DeliveryMethod = "pickup" // Collected by the customer at a pickup point, with a pickup code
+	DeliveryParcel DeliveryMethod = "parcel" // Sent by a carrier to the address of the customer
+)
+
+// @info Density used to weigh models printed by hand-priced orders, PLA's
+const defaultDensityGCM3 = 1.24
+
+var ErrDeliveryClosed = errors.New("The delivery can only be chosen while the order is quoted and not being paid")
+
+// @info A place where customers collect their orders, e.g. the workshop or a partner shop
+type PickupPoint struct {
+	ID           string           `json:"_id"`
+	Rev          string           `json:"_rev,omitempty"`
+	Type         string           `json:"type" validate:"required"`
+	Slug         string           `json:"slug" validate:"required,minlen=1,maxlen=64,pattern=^[a-z0-9]+(-[a-z0-9]+)*$"`
+	Name         string           `json:"name" validate:"required,minlen=1,maxlen=128"`
+	Address      shipping.Address `json:"address"`
+	OpeningHours string           `json:"opening_hours,omitempty" validate:"maxlen=256"` // As shown to customers, e.g. "Mon-Fri 10:00-20:00"
+	PriceCents   int64            `json:"price_cents" validate:"min=0"`                  // VAT included, usually 0
+	Active       bool             `json:"active"`                                        // Inactive points are not offered, orders already sent there keep it
+	UpdatedBy    string           `json:"updated_by,omitempty"`
+	UpdatedAt    time.Time        `json:"updated_at" validate:"required"`
+}
+
+// @info A parcel service of the carrier and what it charges, e.g. standard or express
+type ShippingService struct {
+	ID        string             `json:"_id"`
+	Rev       string             `json:"_rev,omitempty"`
+	Type      string             `json:"type" validate:"required"`
+	Code      string             `json:"code" validate:"required,minlen=1,maxlen=64,pattern=^[a-z0-9]+(-[a-z0-9]+)*$"` // Passed to the carrier
+	Name      string             `json:"name" validate:"required,minlen=1,maxlen=128"`
+	Rates     shipping.RateTable `json:"rates"`
+	Active    bool               `json:"active"`
+	UpdatedBy string             `json:"updated_by,omitempty"`
+	UpdatedAt time.Time          `json:"updated_at" validate:"required"`
+}
+
+// @info How a print order gets to its customer, chosen before paying it. The price is fixed when it is chosen.
+type OrderDelivery struct {
+	Method      DeliveryMethod    `json:"method"`
+	PickupPoint string            `json:"pickup_point,omitempty"` // Slug, with the pickup method
+	Service     string            `json:"service,omitempty"`      // Code, with the parcel method
+	Address     *shipping.Address `json:"address,omitempty"`      // With the parcel method
+	Parcel      *shipping.Parcel  `json:"parcel,omitempty"`       // Estimated, see EstimateParcel
+	PriceCents  int64             `json:"price_cents"`            // VAT included, paid with the order
+}
+
+// @info A way the order can be delivered, priced
+type DeliveryOption struct {
+	Method      DeliveryMethod `json:"method"`
+	PickupPoint *PickupPoint   `json:"pickup_point,omitempty"`
+	Service     string         `json:"service,omitempty"`
+	Name        string         `json:"name"`
+	PriceCents  int64          `json:"price_cents"`
+	Problem     string         `json:"problem,omitempty"` // Why the order can't be sent with it
+}
+
+func pickupPointID(slug string) string {
+	return PickupPointDocType + ":" + slug
+}
+
+func shippingServiceID(code string) string {
+	return ShippingServiceDocType + ":" + code
+}
+
+func IsDeliveryMethod(method DeliveryMethod) bool {
+	return method == DeliveryPickup || method == DeliveryParcel
+}
+
+// @info Creates a pickup point or replaces the one with the same slug
+func SetPickupPoint(client *dbdriver.CouchDBClient, point *PickupPoint) error {
+	point.Slug = str.ToLower(str.TrimSpace(point.Slug))
+	point.Name = str.TrimSpace(point.Name)
+	point.OpeningHours = str.TrimSpace(point.OpeningHours)
+	point.ID = pickupPointID(point.Slug)
+	point.Type = PickupPointDocType
+	point.UpdatedAt = time.Now().UTC()
+	if point.Address.Name == "" {
+		point.Address.Name = point.Name
+	}
+	if fields := checkAddress(&point.Address, "address"); len(fields) > 0 {
+		return &dbdriver.ValidationError{DocType: PickupPointDocType, Fields: fields}
+	}
+	return setDocument(client, point.ID, point, &point.Rev)
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no pickup point with that slug
+func GetPickupPoint(client *dbdriver.CouchDBClient, slug string) (*PickupPoint, error) {
+	point := &PickupPoint{}
+	doc, err := dbdriver.GetDocument(client, pickupPointID(slug))
+	if err != nil {
+		return point, err
+	}
+	if err = dbdriver.DecodeDocument(doc, point); err != nil {
+		return point, err
+	}
+	if point.Type != PickupPointDocType {
+		return point, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a pickup point"}
+	}
+	return point, nil
+}
+
+// @info Every pickup point by name, only the active ones if activeOnly
+func ListPickupPoints(client *dbdriver.CouchDBClient, activeOnly bool) ([]PickupPoint, error) {
+	points := []PickupPoint{}
+	err := findAll(client, PickupPointDocType, activeOnly, func(doc dbdriver.GenericDocument) error {
+		point := PickupPoint{}
+		if err := dbdriver.DecodeDocument(doc, &point); err != nil {
+			return err
+		}
+		points = append(points, point)
+		return nil
+	})
+	sort.Slice(points, func(i, j int) bool { return points[i].Name < points[j].Name })
+	return points, err
+}
+
+// @info Creates a parcel service or replaces the one with the same code
+func SetShippingService(client *dbdriver.CouchDBClient, service *ShippingService) error {
+	service.Code = str.ToLower(str.TrimSpace(service.Code))
+	service.Name = str.TrimSpace(service.Name)
+	service.ID = shippingServiceID(service.Code)
+	service.Type = ShippingServiceDocType
+	service.UpdatedAt = time.Now().UTC()
+	if problems := service.Rates.Check(); len(problems) > 0 {
+		fields := []dbdriver.FieldError{}
+		for _, problem := range problems {
+			field, message, _ := str.Cut(problem, " ")
+			fields = append(fields, dbdriver.FieldError{Field: "rates." + field, Message: message})
+		}
+		return &dbdriver.ValidationError{DocType: ShippingServiceDocType, Fields: fields}
+	}
+	return setDocument(client, service.ID, service, &service.Rev)
+}
+
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no parcel service with that code
+func GetShippingService(client *dbdriver.CouchDBClient, code string) (*ShippingService, error) {
+	service := &ShippingService{}
+	doc, err := dbdriver.GetDocument(client, shippingServiceID(code))
+	if err != nil {
+		return service, err
+	}
+	if err = dbdriver.DecodeDocument(doc, service); err != nil {
+		return service, err
+	}
+	if service.Type != ShippingServiceDocType {
+		return service, &dbdriver.CouchDBError{StatusCode: 404, ErrorName: "not_found", Reason: "not a shipping service"}
+	}
+	return service, nil
+}
+
+// @info Every parcel service by name, only the active ones if activeOnly
+func ListShippingServices(client *dbdriver.CouchDBClient, activeOnly bool) ([]ShippingService, error) {
+	services := []ShippingService{}
+	err := findAll(client, ShippingServiceDocType, activeOnly, func(doc dbdriver.GenericDocument) error {
+		service := ShippingService{}
+		if err := dbdriver.DecodeDocument(doc, &service); err != nil {
+			return err
+		}
+		services = append(services, service)
+		return nil
+	})
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, err
+}
+
+// @info Size and weight of the parcel holding the prints of the order, packed. Pieces are laid side by side on their
+// largest face, so the box is as long and wide as the largest piece and as high as every piece stacked.
+func EstimateParcel(cfg *config.ShippingConfig, order *Order) shipping.Parcel {
+	grams := 0.0
+	if order.Quote != nil {
+		grams = order.Quote.FilamentGrams
+	}
+	length, width, height := 0.0, 0.0, 0.0
+	for _, item := range order.Items {
+		var size []float64
+		switch {
+		case item.Model != nil:
+			size = []float64{item.Model.Size.X, item.Model.Size.Y, item.Model.Size.Z}
+			if order.Quote == nil {
+				grams += item.Model.VolumeMM3 / 1000 * defaultDensityGCM3 * float64(item.Quantity)
+			}
+		case item.GCode != nil:
+			size = []float64{item.GCode.Size.X, item.GCode.Size.Y, item.GCode.Size.Z}
+			if order.Quote == nil {
+				grams += item.GCode.FilamentGrams * float64(item.Quantity)
+			}
+		default:
+			continue
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(size)))
+		length, width = math.Max(length, size[0]), math.Max(width, size[1])
+		height += size[2] * float64(item.Quantity)
+	}
+	padding := 2 * cfg.PaddingMM
+	return shipping.Parcel{
+		WeightGrams: int(math.Ceil(grams)) + cfg.PackagingGrams,
+		LengthMM:    int(math.Ceil(length)) + padding,
+		WidthMM:     int(math.Ceil(width)) + padding,
+		HeightMM:    int(math.Ceil(height)) + padding,
+	}
+}
+
+// @info The active pickup points and parcel services, priced for the order
+func DeliveryOptions(client *dbdriver.CouchDBClient, cfg *config.ShippingConfig, order *Order) ([]DeliveryOption, error) {
+	options := []DeliveryOption{}
+	points, err := ListPickupPoints(client, true)
+	if err != nil {
+		return options, err
+	}
+	for i := range points {
+		options = append(options, DeliveryOption{Method: DeliveryPickup, PickupPoint: &points[i], Name: points[i].Name, PriceCents: points[i].PriceCents})
+	}
+	services, err := ListShippingServices(client, true)
+	if err != nil {
+		return options, err
+	}
+	parcel := EstimateParcel(cfg, order)
+	for _, service := range services {
+		option := DeliveryOption{Method: DeliveryParcel, Service: service.Code, Name: service.Name}
+		option.PriceCents, err = service.Rates.Price(parcel)
+		if err != nil {
+			option.Problem = err.Error()
+		}
+		options = append(options, option)
+	}
+	return options, nil
+}
+
+// @info Chooses how a quoted order is delivered and prices it. A nil delivery removes the one chosen.
+// @error ErrDeliveryClosed, or a *dbdriver.ValidationError if the pickup point or the service can't be used
+func SetOrderDelivery(client *dbdriver.CouchDBClient, cfg *config.ShippingConfig, id string, delivery *OrderDelivery) (*Order, error) {
+	order, err := GetOrder(client, id)
+	if err != nil {
+		return nil, err
+	}
+	if delivery != nil {
+		if err := priceDelivery(client, cfg, order, delivery); err != nil {
+			return nil, err
+		}
+	}
+	return updateOrder(client, id, func(order *Order) error {
+		if order.Status != OrderQuoted || order.CheckoutID != "" {
+			return ErrDeliveryClosed
+		}
+		order.Delivery = delivery
+		return nil
+	})
+}
+
+func priceDelivery(client *dbdriver.CouchDBClient, cfg *config.ShippingConfig, order *Order, delivery *OrderDelivery) error {
+	fail := func(field string, message string) error {
+		return &dbdriver.ValidationError{DocType: OrderDocType, Fields: []dbdriver.FieldError{{Field: "delivery." + field, Message: message}}}
+	}
+	delivery.Parcel = nil
+	switch delivery.Method {
+	case DeliveryPickup:
+		delivery.Service, delivery.Address = "", nil
+		point, err := GetPickupPoint(client, str.ToLower(str.TrimSpace(delivery.PickupPoint)))
+		if dbdriver.IsNotFound(err) || (err == nil && !point.Active) {
+			return fail("pickup_point", "is not a pickup point in use")
+		} else if err != nil {
+			return err
+		}
+		delivery.PickupPoint, delivery.PriceCents = point.Slug, point.PriceCents
+	case DeliveryParcel:
+		delivery.PickupPoint = ""
+		if delivery.Address == nil {
+			return fail("address", "is required")
+		}
+		if fields := checkAddress(delivery.Address, "delivery.address"); len(fields) > 0 {
+			return &dbdriver.ValidationError{DocType: OrderDocType, Fields: fields}
+		}
+		service, err := GetShippingService(client, str.ToLower(str.TrimSpace(delivery.Service)))
+		if dbdriver.IsNotFound(err) || (err == nil && !service.Active) {
+			return fail("service", "is not a shipping service in use")
+		} else if err != nil {
+			return err
+		}
+		parcel := EstimateParcel(cfg, order)
+		price, err := service.Rates.Price(parcel)
+		if err != nil {
+			return fail("service", err.Error())
+		}
+		delivery.Service, delivery.Parcel, delivery.PriceCents = service.Code, &parcel, price
+	default:
+		return fail("method", "must be one of pickup, parcel")
+	}
+	return nil
+}
+
+// @info Normalizes the address in place and lists what is missing or malformed
+func checkAddress(addr *shipping.Address, prefix string) []dbdriver.FieldError {
+	problems := []dbdriver.FieldError{}
+	fail := func(field string, message string) {
+		problems = append(problems, dbdriver.FieldError{Field: prefix + "." + field, Message: message})
+	}
+	addr.Name = str.TrimSpace(addr.Name)
+	addr.Line1 = str.TrimSpace(addr.Line1)
+	addr.City = str.TrimSpace(addr.City)
+	addr.Country = str.ToUpper(str.TrimSpace(addr.Country))
+	addr.PostalCode = str.ToUpper(str.TrimSpace(addr.PostalCode))
+	for _, required := range []struct{ field, value string }{{"name", addr.Name}, {"line1", addr.Line1}, {"city", addr.City}} {
+		if required.value == "" {
+			fail(required.field, "is required")
+		}
+	}
+	if !countryPattern.MatchString(addr.Country) {
+		fail("country", "must be a two letter country code")
+	}
+	if addr.PostalCode == "" {
+		fail("postal_code", "is required")
+	} else if addr.Country == "ES" && !spanishPostalPattern.MatchString(addr.PostalCode) {
+		fail("postal_code", "is not a Spanish postal code")
+	}
+	return problems
+}
+
+// @info Stores a document with a fixed ID, creating it or replacing the current revision. rev is set to the new one.
+func setDocument(client *dbdriver.CouchDBClient, id string, model interface{}, rev *string) error {
+	doc, err := dbdriver.EncodeDocument(model)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	current, err := dbdriver.GetDocument(client, id)
+	if err == nil {
+		doc["_rev"] = current["_rev"]
+	} else if !dbdriver.IsNotFound(err) {
+		return err
+	}
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, id)
+	if err != nil {
+		return err
+	}
+	*rev = resp_data.REV
+	return nil
+}
+
+// @info Calls decode with every document of the type, only the active ones if activeOnly
+func findAll(client *dbdriver.CouchDBClient, docType string, activeOnly bool, decode func(doc dbdriver.GenericDocument) error) error {
+	selector := map[string]interface{}{"type": docType}
+	if activeOnly {
+		selector["active"] = true
+	}
+	bookmark := ""
+	for {
+		opts := &dbdriver.FindOptions{Selector: selector, Limit: 200, Bookmark: bookmark}
+		found, err := dbdriver.FindInDatabase(client, opts)
+		if err != nil {
+			return err
+		}
+		for _, doc := range found.Docs {
+			if err := decode(doc); err != nil {
+				return err
+			}
+		}
+		if len(found.Docs) < int(opts.Limit) {
+			return nil
+		}
+		bookmark = found.Bookmark
+	}
+}
+
+// @info Name of the delivery as shown in carts and on invoices
+func deliveryName(client *dbdriver.CouchDBClient, delivery *OrderDelivery) string {
+	if delivery.Method == DeliveryPickup {
+		if point, err := GetPickupPoint(client, delivery.PickupPoint); err == nil {
+			return "Pickup at " + point.Name
+		}
+		return "Pickup at " + delivery.PickupPoint
+	}
+	if service, err := GetShippingService(client, delivery.Service); err == nil {
+		return fmt.Sprintf("Shipping: %s", service.Name)
+	}
+	return "Shipping: " + delivery.Service
+}
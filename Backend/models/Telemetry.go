@@ -0,0 +1,331 @@
+package models
+
+import (
+	"3DQuest/connector"
+	"3DQuest/dbdriver"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// @info Returned when the OctoPrint or Moonraker host of a printer refuses a request or can't be reached
+var ErrPrinterHost = errors.New("The printer host failed")
+
+// @info Commands sent to a printer through its connection, see CommandPrinter
+type PrinterCommand string
+
+const (
+	PrinterPause  PrinterCommand = "pause"
+	PrinterResume PrinterCommand = "resume"
+	PrinterCancel PrinterCommand = "cancel" // Fails the job it was printing
+)
+
+const (
+	uploadTimeout  = 2 * time.Minute // G-code files reach tens of megabytes
+	commandTimeout = 15 * time.Second
+)
+
+type printerLink struct {
+	connection PrinterConnection
+	conn       connector.Connector
+}
+
+// @info Last reading of a printer with a connection, read now if it was never polled
+func (s *PrintScheduler) Telemetry(printerID string) (*connector.Status, error) {
+	s.linkMu.Lock()
+	status := s.telemetry[printerID]
+	s.linkMu.Unlock()
+	if status != nil {
+		return status, nil
+	}
+	printer, err := GetPrinter(s.client, printerID)
+	if err != nil {
+		return nil, err
+	}
+	if printer.Connection == nil {
+		return nil, noConnectionError()
+	}
+	return s.read(context.Background(), printer, commandTimeout), nil
+}
+
+// @info Polls the printers with a connection every interval until ctx is done, keeping their telemetry and moving
+// their jobs along: a print that completes completes its job, one cancelled on the printer fails it and a firmware
+// error puts the printer in error, which fails its job. Does nothing if interval is not positive.
+func (s *PrintScheduler) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.poll(ctx, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *PrintScheduler) poll(ctx context.Context, timeout time.Duration) {
+	printers, _, err := ListPrinters(s.client, &PrinterFilter{}, 0, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Couldn't list the printers to poll:", err)
+		return
+	}
+	printing, err := findPrintJobs(s.client, map[string]interface{}{"status": JobPrinting}, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: Couldn't list the jobs printing:", err)
+		return
+	}
+	jobs := map[string]*PrintJob{}
+	for i := range printing {
+		jobs[printing[i].PrinterID] = &printing[i]
+	}
+	wg := sync.WaitGroup{}
+	for i := range printers {
+		printer := &printers[i]
+		if printer.Connection == nil || printer.Status == PrinterRetired {
+			s.forgetPrinter(printer.ID)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status := s.read(ctx, printer, timeout)
+			if err := s.follow(printer, jobs[printer.ID], status); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: Couldn't follow the printer %s: %v\n", printer.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// @info Asks the printer for its status and keeps it. An unreachable host reads as offline.
+func (s *PrintScheduler) read(ctx context.Context, printer *Printer, timeout time.Duration) *connector.Status {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := s.connectorFor(printer)
+	var status *connector.Status
+	if err == nil {
+		status, err = conn.Status(ctx)
+	}
+	if err != nil {
+		status = &connector.Status{State: connector.StateOffline, Temperatures: map[string]connector.Temperature{}, Message: err.Error()}
+	}
+	status.At = time.Now().UTC()
+	s.linkMu.Lock()
+	s.telemetry[printer.ID] = status
+	s.linkMu.Unlock()
+	return status
+}
+
+// @info Maps a reading of the printer onto the job it is printing. Prints started by hand are followed too, but only
+// once they were seen printing, so the end of an earlier print is not mistaken for theirs.
+func (s *PrintScheduler) follow(printer *Printer, job *PrintJob, status *connector.Status) error {
+	if job == nil {
+		return nil
+	}
+	remote := job.RemoteFile != "" && status.Filename == job.RemoteFile
+	switch status.State {
+	case connector.StatePrinting:
+		if remote || job.RemoteFile == "" {
+			s.linkMu.Lock()
+			s.seenJobs[job.ID] = true
+			s.linkMu.Unlock()
+		}
+		if printer.Status == PrinterPaused {
+			_, _, err := SetPrinterStatus(s.client, printer.ID, PrinterPrinting)
+			return err
+		}
+	case connector.StatePaused:
+		if printer.Status == PrinterPrinting {
+			_, _, err := SetPrinterStatus(s.client, printer.ID, PrinterPaused)
+			return err
+		}
+	case connector.StateComplete:
+		if remote || s.seen(job.ID) {
+			_, err := s.CompleteJob(job.ID, &FilamentReport{MM: status.FilamentMM})
+			return ignoreJobStatus(err)
+		}
+	case connector.StateCancelled, connector.StateIdle:
+		if (remote && status.State == connector.StateCancelled) || s.seen(job.ID) {
+			_, err := s.FailJob(job.ID, "Cancelled on the printer")
+			return ignoreJobStatus(err)
+		}
+	case connector.StateError:
+		message := status.Message
+		if message == "" {
+			message = "the firmware stopped"
+		}
+		_, _, err := s.SetPrinterStatus(printer.ID, PrinterError, "Printer error: "+message)
+		return err
+	}
+	return nil
+}
+
+// @info Sends the G-code of a plate to the printer and starts it, if the printer has a connection and the plate is a
+// single sliced part. Plates of models are sliced and started by the staff, the telemetry follows them anyway.
+func (s *PrintScheduler) startRemote(printer *Printer, job *PrintJob) error {
+	if printer.Connection == nil || len(job.Parts) != 1 {
+		return nil
+	}
+	part := job.Parts[0]
+	order, err := GetOrder(s.client, part.OrderID)
+	if err != nil {
+		return err
+	}
+	if part.Item >= len(order.Items) || order.Items[part.Item].GCode == nil || order.Items[part.Item].File == "" {
+		return nil
+	}
+	data, _, err := dbdriver.GetAttachment(s.client, order.ID, order.Items[part.Item].File)
+	if err != nil {
+		return err
+	}
+	conn, err := s.connectorFor(printer)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), uploadTimeout)
+	defer cancel()
+	filename := fmt.Sprintf("3dquest-%s.gcode", job.ID)
+	if err := conn.Upload(ctx, filename, data); err != nil {
+		return hostError(printer, err)
+	}
+	if err := conn.Start(ctx, filename); err != nil {
+		return hostError(printer, err)
+	}
+	job.RemoteFile = filename
+	return nil
+}
+
+// @info Pauses, resumes or cancels the print of a printer through its connection. Cancelling fails the job it was
+// printing with note.
+func (s *PrintScheduler) CommandPrinter(id string, command PrinterCommand, note string) (*Printer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	printer, err := GetPrinter(s.client, id)
+	if err != nil {
+		return nil, err
+	}
+	if printer.Connection == nil {
+		return nil, noConnectionError()
+	}
+	conn, err := s.connectorFor(printer)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	switch command {
+	case PrinterPause:
+		if err := conn.Pause(ctx); err != nil {
+			return nil, hostError(printer, err)
+		}
+		if printer.Status == PrinterPrinting {
+			printer, _, err = SetPrinterStatus(s.client, id, PrinterPaused)
+		}
+	case PrinterResume:
+		if err := conn.Resume(ctx); err != nil {
+			return nil, hostError(printer, err)
+		}
+		if printer.Status == PrinterPaused {
+			printer, _, err = SetPrinterStatus(s.client, id, PrinterPrinting)
+		}
+	case PrinterCancel:
+		if err := conn.Cancel(ctx); err != nil {
+			return nil, hostError(printer, err)
+		}
+		printing, err := findPrintJobs(s.client, map[string]interface{}{"status": JobPrinting, "printer_id": id}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if note == "" {
+			note = "Cancelled by the staff"
+		}
+		for _, job := range printing {
+			if _, err := s.failJob(job.ID, note); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.replan(); err != nil {
+			return nil, err
+		}
+		printer, err = GetPrinter(s.client, id)
+	default:
+		return nil, &dbdriver.ValidationError{DocType: PrinterDocType, Fields: []dbdriver.FieldError{{Field: "command", Message: "must be pause, resume or cancel"}}}
+	}
+	return printer, err
+}
+
+// @info Connector of the printer, made again when its connection changes
+func (s *PrintScheduler) connectorFor(printer *Printer) (connector.Connector, error) {
+	if printer.Connection == nil {
+		return nil, noConnectionError()
+	}
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	if link, ok := s.links[printer.ID]; ok {
+		if link.connection == *printer.Connection {
+			return link.conn, nil
+		}
+		closeConnector(link.conn)
+	}
+	conn, err := connector.New(printer.Connection.Kind, printer.Connection.URL, printer.Connection.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	s.links[printer.ID] = &printerLink{connection: *printer.Connection, conn: conn}
+	return conn, nil
+}
+
+// @info Drops the connector and telemetry of a printer that lost its connection or was retired
+func (s *PrintScheduler) forgetPrinter(id string) {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	if link, ok := s.links[id]; ok {
+		closeConnector(link.conn)
+		delete(s.links, id)
+	}
+	delete(s.telemetry, id)
+}
+
+func (s *PrintScheduler) forgetJob(id string) {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	delete(s.seenJobs, id)
+}
+
+func (s *PrintScheduler) seen(jobID string) bool {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	return s.seenJobs[jobID]
+}
+
+// @info Moonraker keeps a WebSocket open
+func closeConnector(conn connector.Connector) {
+	if closer, ok := conn.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func hostError(printer *Printer, err error) error {
+	return fmt.Errorf("%w (%s): %v", ErrPrinterHost, printer.Name, err)
+}
+
+func noConnectionError() error {
+	return &dbdriver.ValidationError{DocType: PrinterDocType, Fields: []dbdriver.FieldError{{Field: "connection", Message: "the printer has no connection"}}}
+}
+
+// @info The job was finished by someone else between the reading and now
+func ignoreJobStatus(err error) error {
+	var validationErr *dbdriver.ValidationError
+	if errors.As(err, &validationErr) && validationErr.DocType == PrintJobDocType {
+		return nil
+	}
+	return err
+}
@@ -1,86 +1,388 @@
-package models
-
-type User struct {
-	ID        string  `json:"_id"`
-	Rev       string  `json:"_rev,omitempty"`
-	Type      string  `json:"type"` // Admin, User, ASCFI, CREA, ASOC, ACADEMIC, etc A list of several different types of users that could result in some discounts or benefits
-	Name      string  `json:"name"`
-	NIF       string  `json:"nif"`
-	EMAIL     string  `json:"email"`
-	PSWD_HASH string  `json:"password_hash"`
-	Credits   float32 `json:"credits"`
-}
-
-// func QueryAllUsers(db *kivik.DB, ctx context.Context) ([]User, error) {
-// 	rows := db.Query(ctx, os.Getenv("USER_DESIGN_DOC"), os.Getenv("ALL_USERS_VIEW"))
-// 	if err := rows.Err(); err != nil {
-// 		return nil, err
-// 	}
-// 	users := []User{}
-// 	for rows.Next() {
-// 		usr := User{}
-// 		if err := rows.ScanKey(&usr); err != nil {
-// 			return nil, err
-// 		}
-// 		fmt.Println(usr.EMAIL)
-// 		users = append(users, usr)
-// 	}
-
-// 	return users, nil
-// }
-
-// func QueryAdminUsers(db *kivik.DB, ctx context.Context) ([]User, error) {
-// 	rows := db.Query(ctx, os.Getenv("USER_DESIGN_DOC"), os.Getenv("ADMIN_USERS_VIEW"))
-// 	if err := rows.Err(); err != nil {
-// 		return nil, err
-// 	}
-// 	users := []User{}
-// 	for rows.Next() {
-// 		usr := User{}
-// 		if err := rows.ScanKey(&usr); err != nil {
-// 			return nil, err
-// 		}
-// 		fmt.Println(usr.EMAIL)
-// 		users = append(users, usr)
-// 	}
-
-// 	return users, nil
-// }
-
-// func QueryBasicUsers(db *kivik.DB, ctx context.Context) ([]User, error) {
-// 	rows := db.Query(ctx, os.Getenv("USER_DESIGN_DOC"), os.Getenv("BASIC_USERS_VIEW"))
-// 	if err := rows.Err(); err != nil {
-// 		return nil, err
-// 	}
-// 	users := []User{}
-// 	for rows.Next() {
-// 		usr := User{}
-// 		if err := rows.ScanKey(&usr); err != nil {
-// 			return nil, err
-// 		}
-// 		fmt.Println(usr.EMAIL)
-// 		users = append(users, usr)
-// 	}
-
-// 	return users, nil
-// }
-
-// func QueryUserByEmail(db *kivik.DB, ctx context.Context) ([]User, error) {
-// 	rows := db.Query(ctx, os.Getenv("USER_DESIGN_DOC"), os.Getenv("ALL_USERS_VIEW"), kivik.Options{
-// 		"startkey": json.RawMessage(`{"email": "vicente.rojo@lluch.es"}`),
-// 	})
-// 	if err := rows.Err(); err != nil {
-// 		return nil, err
-// 	}
-// 	users := []User{}
-// 	for rows.Next() {
-// 		usr := User{}
-// 		if err := rows.ScanKey(&usr); err != nil {
-// 			return nil, err
-// 		}
-// 		fmt.Println(usr.EMAIL)
-// 		users = append(users, usr)
-// 	}
-
-// 	return users, nil
-// }
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	str "strings"
+	"time"
+)
+
+// @info Value of the "type" field of every kind of user document. The type also works as the user's role, see
+// auth.HasPermission. "operator" is the print shop staff.
+var UserTypes = []string{"user", "admin", "operator", "ascfi", "crea", "asoc", "academic"}
+
+type User struct {
+	ID        string          `json:"_id"`
+	Rev       string          `json:"_rev,omitempty"`
+	Type      string          `json:"type" validate:"required"` // Admin, User, ASCFI, CREA, ASOC, ACADEMIC, etc A list of several different types of users that could result in some discounts or benefits
+	Name      string          `json:"name" validate:"required,minlen=1,maxlen=256"`
+	NIF       string          `json:"nif"`
+	EMAIL     string          `json:"email" validate:"required,format=email"`
+	PSWD_HASH string          `json:"password_hash" validate:"required,minlen=1"`
+	Billing   *BillingProfile `json:"billing,omitempty"`
+	DeletedAt *time.Time      `json:"deleted_at,omitempty"` // Set when the account is deleted, see DeleteUser
+}
+
+// @info What a user may see of themselves (or an admin of anyone), without the password hash
+type UserProfile struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Name      string          `json:"name"`
+	NIF       string          `json:"nif"`
+	EMAIL     string          `json:"email"`
+	Billing   *BillingProfile `json:"billing,omitempty"`
+	DeletedAt *time.Time      `json:"deleted_at,omitempty"`
+}
+
+// @info Fields of a user that can be changed with UpdateUserProfile. Nil fields are left untouched.
+type ProfileUpdate struct {
+	Name  *string `json:"name"`
+	NIF   *string `json:"nif"`
+	EMAIL *string `json:"email"`
+}
+
+// @info Filters of ListUsers. Empty fields match every user.
+type UserFilter struct {
+	Type           string
+	EMAIL          string
+	IncludeDeleted bool
+}
+
+// @info Returned when creating or updating a user with an email that already belongs to someone else
+var ErrEmailTaken = errors.New("There is already an account with that email")
+
+const userEmailDocType = "user_email"
+
+// @info CouchDB has no unique constraints, so every email in use is reserved by a user_email document whose ID is
+// derived from the email. Only one of several concurrent writers can create it, the others get a 409.
+type userEmail struct {
+	ID     string `json:"_id"`
+	Rev    string `json:"_rev,omitempty"`
+	Type   string `json:"type" validate:"required"`
+	UserID string `json:"user_id" validate:"required"`
+}
+
+// @info Sorted like the users index, see EnsureIndexes
+var userSort = []interface{}{map[string]string{"type": "asc"}, map[string]string{"email": "asc"}}
+
+func (u *User) Profile() UserProfile {
+	return UserProfile{ID: u.ID, Type: u.Type, Name: u.Name, NIF: u.NIF, EMAIL: u.EMAIL, Billing: u.Billing, DeletedAt: u.DeletedAt}
+}
+
+func (u *User) IsDeleted() bool {
+	return u.DeletedAt != nil
+}
+
+func IsUserType(docType string) bool {
+	for _, userType := range UserTypes {
+		if userType == docType {
+			return true
+		}
+	}
+	return false
+}
+
+// @info Types users were stored with before they were lowercase ("Admin", "User", "ASCFI"...), see NormalizeUserTypes
+func legacyUserTypes() []string {
+	legacy := []string{}
+	for _, userType := range UserTypes {
+		legacy = append(legacy, str.ToUpper(userType[:1])+userType[1:], str.ToUpper(userType))
+	}
+	return legacy
+}
+
+// @info Rewrites the type of the users stored with a capitalised one in lowercase, which is how UserTypes and the
+// roles name them. Safe to run on every startup. Returns how many users were changed; users that can't be changed
+// (e.g. they do not match the schema of their type) are skipped and reported in the error.
+func NormalizeUserTypes(client *dbdriver.CouchDBClient) (int, error) {
+	normalized := 0
+	failed := []string{}
+	var failure error
+	for {
+		selector := map[string]interface{}{"type": map[string]interface{}{"$in": legacyUserTypes()}}
+		if len(failed) > 0 {
+			selector["_id"] = map[string]interface{}{"$nin": failed}
+		}
+		found, err := dbdriver.FindInDatabase(client, &dbdriver.FindOptions{Selector: selector, Limit: 100})
+		if err != nil {
+			return normalized, err
+		}
+		if len(found.Docs) == 0 {
+			break
+		}
+		for _, doc := range found.Docs {
+			id, _ := doc["_id"].(string)
+			_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+				docType, _ := doc["type"].(string)
+				doc["type"] = str.ToLower(docType)
+				return nil
+			})
+			if err != nil {
+				failed = append(failed, id)
+				failure = err
+				continue
+			}
+			normalized++
+		}
+	}
+	if len(failed) > 0 {
+		return normalized, fmt.Errorf("Couldn't change the type of the users %s: %w", str.Join(failed, ", "), failure)
+	}
+	return normalized, nil
+}
+
+// @info Emails are stored trimmed and lowercased so lookups are case insensitive
+func NormalizeEmail(email string) string {
+	return str.ToLower(str.TrimSpace(email))
+}
+
+func errNotAUser() error {
+	return &dbdriver.CouchDBError{StatusCode: http.StatusNotFound, ErrorName: "not_found", Reason: "not a user"}
+}
+
+// url := "http://localhost:5984/{DB_NAME}/{USER_ID}"
+// @error A *dbdriver.CouchDBError satisfying dbdriver.IsNotFound if there is no user with that ID
+func GetUser(client *dbdriver.CouchDBClient, id string) (*User, error) {
+	doc, err := dbdriver.GetDocument(client, id)
+	return decodeUser(doc, err)
+}
+
+// @info Like GetUser, but read through the cache of the client, see dbdriver.GetCachedDocument. For lookups only.
+func GetCachedUser(client *dbdriver.CouchDBClient, id string) (*User, error) {
+	doc, err := dbdriver.GetCachedDocument(client, id)
+	return decodeUser(doc, err)
+}
+
+func decodeUser(doc dbdriver.GenericDocument, err error) (*User, error) {
+	usr := &User{}
+	if err != nil {
+		return usr, err
+	}
+	if err = dbdriver.DecodeDocument(doc, usr); err != nil {
+		return usr, err
+	}
+	if !IsUserType(usr.Type) {
+		return usr, errNotAUser()
+	}
+	return usr, nil
+}
+
+// @info Returns nil (and no error) if no user has that email. Deleted users are returned too, check IsDeleted.
+func GetUserByEmail(client *dbdriver.CouchDBClient, email string) (*User, error) {
+	opts := &dbdriver.FindOptions{
+		Selector: map[string]interface{}{
+			"type":  map[string]interface{}{"$in": UserTypes},
+			"email": NormalizeEmail(email),
+		},
+		Limit: 1,
+	}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	if err != nil || len(found.Docs) == 0 {
+		return nil, err
+	}
+	usr := &User{}
+	err = dbdriver.DecodeDocument(found.Docs[0], usr)
+	return usr, err
+}
+
+// @info Pages through the users sorted by type and email. Pass the returned bookmark to get the next page.
+func ListUsers(client *dbdriver.CouchDBClient, filter *UserFilter, limit uint64, bookmark string) ([]User, string, error) {
+	selector := map[string]interface{}{"type": map[string]interface{}{"$in": UserTypes}}
+	if filter.Type != "" {
+		selector["type"] = filter.Type
+	}
+	if filter.EMAIL != "" {
+		selector["email"] = NormalizeEmail(filter.EMAIL)
+	}
+	if !filter.IncludeDeleted {
+		selector["deleted_at"] = map[string]interface{}{"$exists": false}
+	}
+	opts := &dbdriver.FindOptions{Selector: selector, Limit: limit, Bookmark: bookmark, Sort: userSort}
+	found, err := dbdriver.FindInDatabase(client, opts)
+	users := []User{}
+	if err != nil {
+		return users, "", err
+	}
+	for _, doc := range found.Docs {
+		usr := User{}
+		if err := dbdriver.DecodeDocument(doc, &usr); err != nil {
+			return users, "", err
+		}
+		users = append(users, usr)
+	}
+	return users, found.Bookmark, nil
+}
+
+// @info Stores a new user, filling in its ID and revision. The email is normalized before being saved.
+// @error ErrEmailTaken if another user has the same email
+func CreateUser(client *dbdriver.CouchDBClient, usr *User) error {
+	usr.EMAIL = NormalizeEmail(usr.EMAIL)
+	nif, err := normalizeNIF(usr.NIF)
+	if err != nil {
+		return err
+	}
+	usr.NIF = nif
+	if usr.ID == "" {
+		id, err := dbdriver.GetUUIDFromCouchDB(client)
+		if err != nil {
+			return err
+		}
+		usr.ID = id
+	}
+	if err := reserveEmail(client, usr.EMAIL, usr.ID); err != nil {
+		return err
+	}
+	doc, err := dbdriver.EncodeDocument(usr)
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	resp_data, err := dbdriver.CreateOrModifyDocument(client, &doc, usr.ID)
+	if err != nil {
+		releaseEmail(client, usr.EMAIL, usr.ID)
+		return err
+	}
+	usr.Rev = resp_data.REV
+	return nil
+}
+
+// @info Changes the name, NIF and/or email of a user and returns it updated
+// @error ErrEmailTaken if the new email belongs to another user
+func UpdateUserProfile(client *dbdriver.CouchDBClient, id string, update *ProfileUpdate) (*User, error) {
+	usr, err := GetUser(client, id)
+	if err != nil {
+		return usr, err
+	}
+	if usr.IsDeleted() {
+		return usr, errNotAUser()
+	}
+	nif := ""
+	if update.NIF != nil {
+		if nif, err = normalizeNIF(*update.NIF); err != nil {
+			return usr, err
+		}
+	}
+	newEmail := ""
+	if update.EMAIL != nil && NormalizeEmail(*update.EMAIL) != usr.EMAIL {
+		newEmail = NormalizeEmail(*update.EMAIL)
+		if err := reserveEmail(client, newEmail, id); err != nil {
+			return usr, err
+		}
+	}
+	_, err = dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		if _, deleted := doc["deleted_at"]; deleted {
+			return errNotAUser()
+		}
+		if update.Name != nil {
+			doc["name"] = *update.Name
+		}
+		if update.NIF != nil {
+			doc["nif"] = nif
+		}
+		if newEmail != "" {
+			doc["email"] = newEmail
+		}
+		return nil
+	})
+	if err != nil {
+		if newEmail != "" {
+			releaseEmail(client, newEmail, id)
+		}
+		return usr, err
+	}
+	if newEmail != "" {
+		releaseEmail(client, usr.EMAIL, id)
+	}
+	return GetUser(client, id)
+}
+
+// @info Soft-deletes a user. The document is kept, since orders and invoices point to it, but it is hidden from
+// ListUsers and can't log in anymore. Its email stays reserved.
+func DeleteUser(client *dbdriver.CouchDBClient, id string) error {
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		userType, _ := doc["type"].(string)
+		if _, deleted := doc["deleted_at"]; deleted || !IsUserType(userType) {
+			return errNotAUser()
+		}
+		doc["deleted_at"] = time.Now().UTC()
+		return nil
+	})
+	return err
+}
+
+// @info Changes the type (and so the role) of a user, returning the previous one
+func SetUserType(client *dbdriver.CouchDBClient, id string, userType string) (string, error) {
+	if !IsUserType(userType) {
+		return "", fmt.Errorf("Unknown user type '%s'", userType)
+	}
+	previous := ""
+	_, err := dbdriver.UpdateDocument(client, id, func(doc dbdriver.GenericDocument) error {
+		previous, _ = doc["type"].(string)
+		if !IsUserType(previous) {
+			return errNotAUser()
+		}
+		doc["type"] = userType
+		return nil
+	})
+	return previous, err
+}
+
+func userEmailID(email string) string {
+	sum := sha256.Sum256([]byte(NormalizeEmail(email)))
+	return userEmailDocType + ":" + hex.EncodeToString(sum[:])
+}
+
+// @info Reserves the email for the user. Reserving an email the user already holds is not an error.
+func reserveEmail(client *dbdriver.CouchDBClient, email string, userID string) error {
+	id := userEmailID(email)
+	doc, err := dbdriver.EncodeDocument(&userEmail{Type: userEmailDocType, UserID: userID})
+	if err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	_, err = dbdriver.CreateOrModifyDocument(client, &doc, id)
+	if dbdriver.IsConflict(err) {
+		existing, err := dbdriver.GetDocument(client, id)
+		if err != nil {
+			return err
+		}
+		if existing["user_id"] != userID {
+			return ErrEmailTaken
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// @info Users created before emails were reserved have no user_email document
+	usr, err := GetUserByEmail(client, email)
+	if err == nil && usr != nil && usr.ID != userID {
+		err = ErrEmailTaken
+	}
+	if err != nil {
+		releaseEmail(client, email, userID)
+	}
+	return err
+}
+
+// @info Frees the email if it is reserved by the user
+func releaseEmail(client *dbdriver.CouchDBClient, email string, userID string) error {
+	id := userEmailID(email)
+	doc, err := dbdriver.GetDocument(client, id)
+	if dbdriver.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if doc["user_id"] != userID {
+		return nil
+	}
+	rev, _ := doc["_rev"].(string)
+	_, err = dbdriver.DeleteDocument(client, id, rev)
+	return err
+}
@@ -0,0 +1,166 @@
+package models_test
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPayCartIdempotency(t *testing.T) {
+	client, couch := newCouch(t)
+	product := newProduct(t, client, 10)
+	if _, err := models.AddCartItem(client, storeConfig, models.UserCartID("alice"), "alice", models.CartItem{Kind: models.CartProduct, ProductID: product.ID, SKU: "NZ-04", Quantity: 2}); err != nil {
+		t.Fatal(err)
+	}
+	req := &models.CheckoutRequest{PaymentMethod: models.PaymentExternal, IdempotencyKey: "key-1"}
+	first, err := models.PayCart(client, storeConfig, "alice", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.TotalCents != 2598 || first.Status != models.CheckoutAwaitingPayment {
+		t.Errorf("checkout total %d, status %s", first.TotalCents, first.Status)
+	}
+	second, err := models.PayCart(client, storeConfig, "alice", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID || second.Rev != first.Rev {
+		t.Errorf("second checkout %s %s, want %s %s", second.ID, second.Rev, first.ID, first.Rev)
+	}
+	if stock := stockOf(t, client, product); stock != 8 {
+		t.Errorf("stock %d, want 8", stock)
+	}
+
+	// @info The same key of another customer is another checkout
+	if _, err := models.AddCartItem(client, storeConfig, models.UserCartID("bob"), "bob", models.CartItem{Kind: models.CartProduct, ProductID: product.ID, SKU: "NZ-04", Quantity: 1}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := models.PayCart(client, storeConfig, "bob", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == first.ID || other.CustomerID != "bob" {
+		t.Errorf("checkout of bob %s of %s", other.ID, other.CustomerID)
+	}
+	if checkouts := couch.OfType(models.CheckoutDocType); len(checkouts) != 2 {
+		t.Errorf("%d checkouts, want 2", len(checkouts))
+	}
+}
+
+func TestPayCartConcurrentRetries(t *testing.T) {
+	client, couch := newCouch(t)
+	product := newProduct(t, client, 10)
+	if _, err := models.AddCartItem(client, storeConfig, models.UserCartID("alice"), "alice", models.CartItem{Kind: models.CartProduct, ProductID: product.ID, SKU: "NZ-04", Quantity: 3}); err != nil {
+		t.Fatal(err)
+	}
+	// @info All of them see no checkout with the key yet, only one gets to store it
+	var wg sync.WaitGroup
+	ids := make([]string, 5)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			checkout, err := models.PayCart(client, storeConfig, "alice", &models.CheckoutRequest{PaymentMethod: models.PaymentExternal, IdempotencyKey: "retry"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = checkout.ID
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("checkouts %v, want the same one", ids)
+			break
+		}
+	}
+	if checkouts := couch.OfType(models.CheckoutDocType); len(checkouts) != 1 {
+		t.Errorf("%d checkouts, want 1", len(checkouts))
+	}
+	if stock := stockOf(t, client, product); stock != 7 {
+		t.Errorf("stock %d, want 7", stock)
+	}
+}
+
+func TestPayCartRollback(t *testing.T) {
+	client, couch := newCouch(t)
+	product := newProduct(t, client, 2)
+	if _, err := models.AddCartItem(client, storeConfig, models.UserCartID("alice"), "alice", models.CartItem{Kind: models.CartProduct, ProductID: product.ID, SKU: "NZ-04", Quantity: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// @info With nothing to charge the credits to, the checkout fails after taking the stock
+	req := &models.CheckoutRequest{PaymentMethod: models.PaymentCredits, IdempotencyKey: "key-1"}
+	if _, err := models.PayCart(client, storeConfig, "alice", req); err == nil {
+		t.Fatal("a checkout without credits was paid")
+	}
+	if checkouts := couch.OfType(models.CheckoutDocType); len(checkouts) != 0 {
+		t.Errorf("%d checkouts left by a failed one", len(checkouts))
+	}
+	if stock := stockOf(t, client, product); stock != 2 {
+		t.Errorf("stock %d after a failed checkout, want 2", stock)
+	}
+	// @info The key of a failed checkout can be used again
+	req.PaymentMethod = models.PaymentExternal
+	if _, err := models.PayCart(client, storeConfig, "alice", req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpireCheckouts(t *testing.T) {
+	client, _ := newCouch(t)
+	product := newProduct(t, client, 10)
+	checkouts := map[string]*models.Checkout{}
+	for customer, quantity := range map[string]int{"alice": 2, "bob": 1, "carol": 3} {
+		if _, err := models.AddCartItem(client, storeConfig, models.UserCartID(customer), customer, models.CartItem{Kind: models.CartProduct, ProductID: product.ID, SKU: "NZ-04", Quantity: quantity}); err != nil {
+			t.Fatal(err)
+		}
+		checkout, err := models.PayCart(client, storeConfig, customer, &models.CheckoutRequest{PaymentMethod: models.PaymentExternal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkout.ExpiresAt == nil || !checkout.ExpiresAt.Equal(checkout.CreatedAt.Add(storeConfig.CheckoutTTL)) {
+			t.Errorf("checkout of %s expires at %v", customer, checkout.ExpiresAt)
+		}
+		checkouts[customer] = checkout
+	}
+	// @info bob pays, and the card payment of carol waits to be captured
+	if _, err := models.ConfirmCheckout(client, checkouts["bob"].ID, "bank transfer"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	authorized := &models.Payment{ID: "payment:pi_1", Type: models.PaymentDocType, Provider: "stripe", IntentID: "pi_1", Purpose: models.PaymentForCheckout, CheckoutID: checkouts["carol"].ID, UserID: "carol", AmountCents: checkouts["carol"].TotalCents, Currency: "eur", Status: models.PaymentAuthorized, Refunds: []models.PaymentRefund{}, CreatedAt: now, UpdatedAt: now}
+	doc, err := dbdriver.EncodeDocument(authorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(doc, "_rev")
+	if _, err := dbdriver.CreateOrModifyDocument(client, &doc, authorized.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if expired, err := models.ExpireCheckouts(client, storeConfig, now); err != nil || expired != 0 {
+		t.Errorf("%d checkouts expired before their time: %v", expired, err)
+	}
+	expired, err := models.ExpireCheckouts(client, storeConfig, now.Add(storeConfig.CheckoutTTL+time.Minute))
+	if err != nil || expired != 1 {
+		t.Errorf("%d checkouts expired, want 1: %v", expired, err)
+	}
+	for customer, want := range map[string]models.CheckoutStatus{"alice": models.CheckoutCancelled, "bob": models.CheckoutPaid, "carol": models.CheckoutAwaitingPayment} {
+		checkout, err := models.GetCheckout(client, checkouts[customer].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkout.Status != want {
+			t.Errorf("checkout of %s %s, want %s", customer, checkout.Status, want)
+		}
+		if (checkout.ExpiresAt != nil) != (want == models.CheckoutAwaitingPayment) {
+			t.Errorf("checkout of %s %s expiring at %v", customer, checkout.Status, checkout.ExpiresAt)
+		}
+	}
+	if stock := stockOf(t, client, product); stock != 6 {
+		t.Errorf("stock %d, want the 2 units of alice back", stock)
+	}
+}
@@ -0,0 +1,271 @@
+package models_test
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"bytes"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newCategory(t *testing.T, client *dbdriver.CouchDBClient, slug string, name string) {
+	t.Helper()
+	if err := models.SetCategory(client, &models.Category{Slug: slug, Name: name}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateProductValidation(t *testing.T) {
+	client, _ := newCouch(t)
+	newCategory(t, client, "tools", "Tools")
+	variant := models.ProductVariant{SKU: "NZ-04", PriceCents: 1299}
+	cases := []struct {
+		name   string
+		change func(product *models.Product)
+		fields []string
+	}{
+		{"valid", func(*models.Product) {}, nil},
+		{"unknown kind", func(p *models.Product) { p.Kind = "service" }, []string{"kind"}},
+		{"no variants", func(p *models.Product) { p.Variants = nil }, []string{"variants"}},
+		{"variant without SKU", func(p *models.Product) { p.Variants = []models.ProductVariant{{SKU: "  ", PriceCents: 100}} }, []string{"variants.0.sku"}},
+		{"repeated SKU", func(p *models.Product) { p.Variants = append(p.Variants, models.ProductVariant{SKU: " NZ-04"}) }, []string{"variants.1.sku"}},
+		{"negative price and stock", func(p *models.Product) { p.Variants[0].PriceCents, p.Variants[0].Stock = -1, -1 }, []string{"variants.0.price_cents", "variants.0.stock"}},
+		{"unknown category", func(p *models.Product) { p.Categories = []string{"tools", "toys"} }, []string{"categories"}},
+	}
+	for _, c := range cases {
+		product := &models.Product{Kind: models.ProductAccessory, Name: " Nozzle set ", VATPercent: 21, Categories: []string{" Tools", "tools"}, Variants: []models.ProductVariant{variant}}
+		c.change(product)
+		err := models.CreateProduct(client, product)
+		if c.fields == nil {
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if product.Name != "Nozzle set" || !reflect.DeepEqual(product.Categories, []string{"tools"}) || product.Published || product.Search != "nozzle set nz-04 tools" {
+				t.Errorf("%s: stored as %+v", c.name, product)
+			}
+			continue
+		}
+		var validationErr *dbdriver.ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("%s: error %v, want a *ValidationError", c.name, err)
+			continue
+		}
+		fields := []string{}
+		for _, field := range validationErr.Fields {
+			fields = append(fields, field.Field)
+		}
+		if !reflect.DeepEqual(fields, c.fields) {
+			t.Errorf("%s: problems with %v, want %v", c.name, fields, c.fields)
+		}
+	}
+}
+
+func TestListProducts(t *testing.T) {
+	client, _ := newCouch(t)
+	newCategory(t, client, "tools", "Tools")
+	newCategory(t, client, "spare-parts", "Spare parts")
+	products := []*models.Product{
+		{Kind: models.ProductFilament, Name: "PLA spool", Variants: []models.ProductVariant{
+			{SKU: "PLA-RED", Colour: "red", Material: "PLA", PriceCents: 2000, Stock: 3},
+			{SKU: "PLA-BLUE", Colour: "blue", Material: "PLA", PriceCents: 2200},
+		}},
+		{Kind: models.ProductPrinted, Name: "Dragon figure", Description: "Articulated, printed in silk PLA", Variants: []models.ProductVariant{
+			{SKU: "DRG-S", Colour: "red", Size: "S", PriceCents: 1500},
+			{SKU: "DRG-M", Colour: "blue", Size: "M", PriceCents: 2500, Stock: 1},
+		}},
+		{Kind: models.ProductAccessory, Name: "Nozzle set", Categories: []string{"tools", "spare-parts"}, Variants: []models.ProductVariant{{SKU: "NZ-04", PriceCents: 1299, Stock: 10}}},
+		{Kind: models.ProductAccessory, Name: "Spatula", Categories: []string{"tools"}, Variants: []models.ProductVariant{{SKU: "SP-1", PriceCents: 500, Stock: 2}}},
+	}
+	for i, product := range products {
+		product.VATPercent = 21
+		if err := models.CreateProduct(client, product); err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 {
+			if _, err := models.PublishProduct(client, product.ID, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	published, hidden := true, false
+	cases := []struct {
+		name   string
+		filter models.ProductFilter
+		want   []string // Names, sorted
+	}{
+		{"everything", models.ProductFilter{}, []string{"Dragon figure", "Nozzle set", "PLA spool", "Spatula"}},
+		{"published", models.ProductFilter{Published: &published}, []string{"Dragon figure", "Nozzle set", "PLA spool"}},
+		{"unpublished", models.ProductFilter{Published: &hidden}, []string{"Spatula"}},
+		{"kind", models.ProductFilter{Kind: models.ProductAccessory}, []string{"Nozzle set", "Spatula"}},
+		{"category", models.ProductFilter{Category: "tools"}, []string{"Nozzle set", "Spatula"}},
+		{"search in the description", models.ProductFilter{Query: "silk"}, []string{"Dragon figure"}},
+		{"every word must match", models.ProductFilter{Query: "PLA Spool"}, []string{"PLA spool"}},
+		{"search in the variants", models.ProductFilter{Query: "pla"}, []string{"Dragon figure", "PLA spool"}},
+		{"search in the categories", models.ProductFilter{Query: "spare parts"}, []string{"Nozzle set"}},
+		{"search is not a regular expression", models.ProductFilter{Query: "nz.04 ("}, []string{}},
+		{"colour", models.ProductFilter{Colour: "red"}, []string{"Dragon figure", "PLA spool"}},
+		{"colour and size of one variant", models.ProductFilter{Colour: "red", Size: "M"}, []string{}},
+		{"colour in stock", models.ProductFilter{Colour: "red", InStock: true}, []string{"PLA spool"}},
+		{"material", models.ProductFilter{Material: "PLA"}, []string{"PLA spool"}},
+		{"price range", models.ProductFilter{MinPriceCents: 1000, MaxPriceCents: 1500}, []string{"Dragon figure", "Nozzle set"}},
+		{"in stock", models.ProductFilter{InStock: true}, []string{"Dragon figure", "Nozzle set", "PLA spool", "Spatula"}},
+		{"nothing matches", models.ProductFilter{Kind: models.ProductFilament, Category: "tools"}, []string{}},
+	}
+	for _, c := range cases {
+		found, _, err := models.ListProducts(client, &c.filter, 0, "")
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		names := []string{}
+		for _, product := range found {
+			names = append(names, product.Name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, c.want) {
+			t.Errorf("%s: %v, want %v", c.name, names, c.want)
+		}
+	}
+
+	if _, err := models.DeleteCategory(client, "tools"); !errors.Is(err, models.ErrCategoryInUse) {
+		t.Errorf("deleting a category in use: %v", err)
+	}
+	page, bookmark, err := models.ListProducts(client, &models.ProductFilter{}, 3, "")
+	if err != nil || len(page) != 3 {
+		t.Fatalf("first page of %d: %v", len(page), err)
+	}
+	if rest, _, _ := models.ListProducts(client, &models.ProductFilter{}, 3, bookmark); len(rest) != 1 || rest[0].Name != "Spatula" {
+		t.Errorf("second page %+v", rest)
+	}
+}
+
+func TestProductStockAndVariants(t *testing.T) {
+	client, _ := newCouch(t)
+	product := newProduct(t, client, 5)
+
+	cases := []struct {
+		name  string
+		sku   string
+		delta int
+		stock int // Once done
+		fails bool
+	}{
+		{"restock", "NZ-04", 10, 15, false},
+		{"take", "NZ-04", -15, 0, false},
+		{"take more than there is", "NZ-04", -1, 0, true},
+		{"unknown variant", "NZ-06", 1, 0, true},
+	}
+	for _, c := range cases {
+		_, err := models.AdjustProductStock(client, product.ID, c.sku, c.delta)
+		if c.fails != dbdriver.IsValidationError(err) || (!c.fails && err != nil) {
+			t.Errorf("%s: error %v", c.name, err)
+		}
+		if stock := stockOf(t, client, product); stock != c.stock {
+			t.Errorf("%s: %d in stock, want %d", c.name, stock, c.stock)
+		}
+	}
+	if _, err := models.AdjustProductStock(client, product.ID, "NZ-04", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// @info Variants keep their stock, only new ones take the one sent
+	name := "Nozzle set, hardened"
+	variants := []models.ProductVariant{{SKU: "NZ-06", PriceCents: 1499, Stock: 7}, {SKU: "NZ-04", PriceCents: 1399, Stock: 100}}
+	updated, err := models.UpdateProduct(client, product.ID, &models.ProductUpdate{Name: &name, Variants: &variants})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != name || updated.Variant("NZ-04").Stock != 4 || updated.Variant("NZ-04").PriceCents != 1399 || updated.Variant("NZ-06").Stock != 7 {
+		t.Errorf("updated to %+v", updated.Variants)
+	}
+	if !updated.Published || updated.Search != "nozzle set, hardened nz-06 nz-04" {
+		t.Errorf("updated product published %v, search %q", updated.Published, updated.Search)
+	}
+	none := []models.ProductVariant{}
+	if _, err := models.UpdateProduct(client, product.ID, &models.ProductUpdate{Variants: &none}); !dbdriver.IsValidationError(err) {
+		t.Errorf("every variant removed: %v", err)
+	}
+	if product, _ := models.GetProduct(client, product.ID); len(product.Variants) != 2 || product.InStock() != true {
+		t.Errorf("product changed by a refused update: %+v", product.Variants)
+	}
+}
+
+func TestPublishAndDeleteProduct(t *testing.T) {
+	client, _ := newCouch(t)
+	product := newProduct(t, client, 1)
+	if product.PublishedAt == nil || !product.Published {
+		t.Fatalf("published product %+v", product)
+	}
+	publishedAt := *product.PublishedAt
+	if _, err := models.DeleteProduct(client, product.ID); !errors.Is(err, models.ErrProductNotDraft) {
+		t.Errorf("deleting a published product: %v", err)
+	}
+	if product, _ = models.PublishProduct(client, product.ID, true); !product.PublishedAt.Equal(publishedAt) {
+		t.Errorf("publishing again moved the date from %v to %v", publishedAt, product.PublishedAt)
+	}
+	if product, _ = models.PublishProduct(client, product.ID, false); product.Published {
+		t.Error("still published")
+	}
+	if _, err := models.DeleteProduct(client, product.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.GetProduct(client, product.ID); !dbdriver.IsNotFound(err) {
+		t.Errorf("deleted product: %v", err)
+	}
+	if _, err := models.PublishProduct(client, product.ID, true); !dbdriver.IsNotFound(err) {
+		t.Errorf("publishing a deleted product: %v", err)
+	}
+}
+
+func TestProductImages(t *testing.T) {
+	client, couch := newCouch(t)
+	product := newProduct(t, client, 1)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 64)...)
+	gif := append([]byte("GIF89a"), bytes.Repeat([]byte{0}, 64)...)
+
+	cases := []struct {
+		name   string
+		data   []byte
+		err    error
+		images int
+	}{
+		{"PNG", png, nil, 1},
+		{"GIF", gif, nil, 2},
+		{"same image again", png, nil, 2},
+		{"not an image", []byte("<html><body>hello</body></html>"), models.ErrImageType, 2},
+		{"too large", append(png, make([]byte, models.MaxProductImageBytes)...), models.ErrImageTooLarge, 2},
+	}
+	for _, c := range cases {
+		updated, err := models.AddProductImage(client, product.ID, c.data, c.name)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: error %v, want %v", c.name, err, c.err)
+		}
+		if err == nil && len(updated.Images) != c.images {
+			t.Errorf("%s: %d images, want %d", c.name, len(updated.Images), c.images)
+		}
+	}
+	product, err := models.GetProduct(client, product.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cover := product.Images[0]
+	if cover.Alt != "same image again" || len(product.Attachments) != 2 {
+		t.Errorf("images %+v stored as %d attachments", product.Images, len(product.Attachments))
+	}
+
+	if _, err := models.RemoveProductImage(client, product.ID, cover.Name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := models.RemoveProductImage(client, product.ID, cover.Name); !dbdriver.IsNotFound(err) {
+		t.Errorf("removing it twice: %v", err)
+	}
+	stored := couch.OfType(models.ProductDocType)[0]
+	if attachments, _ := stored["_attachments"].(map[string]interface{}); len(attachments) != 1 || attachments[cover.Name] != nil {
+		t.Errorf("attachments left %v", attachments)
+	}
+	if _, _, err := models.GetProductImage(client, product, "image-missing.png"); !dbdriver.IsNotFound(err) {
+		t.Errorf("reading an image the product does not have: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package models_test
+
+import (
+	"3DQuest/models"
+	"reflect"
+	str "strings"
+	"testing"
+	"time"
+)
+
+func percentOff(code string, percent float64) models.Coupon {
+	return models.Coupon{Code: code, Kind: models.CouponPercent, PercentOff: percent, Automatic: true, Active: true}
+}
+
+func amountOff(code string, cents int64) models.Coupon {
+	return models.Coupon{Code: code, Kind: models.CouponFixed, AmountOffCents: cents, Automatic: true, Active: true}
+}
+
+func TestEvaluatePromotions(t *testing.T) {
+	alice := &models.User{ID: "alice", Type: "user"}
+	academic := &models.User{ID: "bob", Type: "academic"}
+	stackable := func(coupon models.Coupon) models.Coupon {
+		coupon.Stackable = true
+		return coupon
+	}
+	entered := func(coupon models.Coupon) models.Coupon {
+		coupon.Automatic = false
+		return coupon
+	}
+	forAcademics := func(coupon models.Coupon) models.Coupon {
+		coupon.UserTypes = []string{"academic"}
+		return coupon
+	}
+	firstOrder := percentOff("WELCOME20", 20)
+	firstOrder.FirstOrderOnly = true
+	atLeast := amountOff("BIGCART", 500)
+	atLeast.MinTotalCents = 5000
+	inactive := percentOff("OLD50", 50)
+	inactive.Active = false
+
+	type promotion struct {
+		Code                     string
+		BaseCents, DiscountCents int64
+	}
+	cases := []struct {
+		name           string
+		coupons        []models.Coupon
+		customer       *models.User
+		code           string
+		total          int64
+		typeDiscounted int64
+		want           []promotion
+		problem        string // Part of the coupon problem, none if empty
+	}{
+		{"stackable add up, percentages first", []models.Coupon{stackable(amountOff("FIVE", 500)), stackable(percentOff("TEN", 10))}, alice, "", 10000, 0,
+			[]promotion{{"TEN", 10000, 1000}, {"FIVE", 9000, 500}}, ""},
+		{"the stack beats a smaller promotion", []models.Coupon{stackable(amountOff("FIVE", 500)), stackable(percentOff("TEN", 10)), percentOff("TWELVE", 12)}, alice, "", 10000, 0,
+			[]promotion{{"TEN", 10000, 1000}, {"FIVE", 9000, 500}}, ""},
+		{"a larger coupon beats the stack", []models.Coupon{stackable(amountOff("FIVE", 500)), stackable(percentOff("TEN", 10)), entered(percentOff("QUARTER", 25))}, alice, "quarter", 10000, 0,
+			[]promotion{{"QUARTER", 10000, 2500}}, ""},
+		{"a smaller coupon is not combined", []models.Coupon{stackable(percentOff("TEN", 10)), entered(percentOff("FIVEPC", 5))}, alice, "FIVEPC", 10000, 0,
+			[]promotion{{"TEN", 10000, 1000}}, "better promotion"},
+		{"the best automatic promotion", []models.Coupon{percentOff("EIGHT", 8), percentOff("TWELVE", 12), amountOff("TENNER", 1000)}, alice, "", 10000, 0,
+			[]promotion{{"TWELVE", 10000, 1200}}, ""},
+		{"fixed amounts are capped at the total", []models.Coupon{amountOff("FIFTY", 5000)}, alice, "", 3000, 0,
+			[]promotion{{"FIFTY", 3000, 3000}}, ""},
+		{"stacked discounts never go below zero", []models.Coupon{stackable(percentOff("ALL", 100)), stackable(amountOff("FIVE", 500))}, alice, "", 3000, 0,
+			[]promotion{{"ALL", 3000, 3000}}, ""},
+		{"below the smallest total", []models.Coupon{entered(atLeast)}, alice, "BIGCART", 3000, 0, nil, "at least 50.00"},
+		{"inactive", []models.Coupon{inactive}, alice, "", 3000, 0, nil, ""},
+		{"missing coupon", nil, alice, "NOPE", 3000, 0, nil, "no longer exists"},
+		{"first order", []models.Coupon{firstOrder}, alice, "", 1000, 0, []promotion{{"WELCOME20", 1000, 200}}, ""},
+		{"first order of a visitor", []models.Coupon{entered(firstOrder)}, nil, "WELCOME20", 1000, 0, nil, "Log in"},
+		{"user type", []models.Coupon{forAcademics(percentOff("CAMPUS", 15))}, academic, "", 10000, 0, []promotion{{"CAMPUS", 10000, 1500}}, ""},
+		{"another user type", []models.Coupon{entered(forAcademics(percentOff("CAMPUS", 15)))}, alice, "CAMPUS", 10000, 0, nil, "type of account"},
+		{"user type leaves out what the tariffs discounted", []models.Coupon{forAcademics(percentOff("CAMPUS", 15))}, academic, "", 10000, 6000,
+			[]promotion{{"CAMPUS", 4000, 600}}, ""},
+		{"user type on prices all discounted", []models.Coupon{entered(forAcademics(percentOff("CAMPUS", 15)))}, academic, "CAMPUS", 10000, 10000, nil, "already discounted"},
+		{"other promotions apply to all of it", []models.Coupon{stackable(forAcademics(percentOff("CAMPUS", 10))), stackable(percentOff("TEN", 10))}, academic, "", 10000, 5000,
+			[]promotion{{"CAMPUS", 5000, 500}, {"TEN", 9500, 950}}, ""},
+	}
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	for _, c := range cases {
+		client, _ := newCouch(t)
+		for _, coupon := range c.coupons {
+			coupon := coupon
+			if err := models.SetCoupon(client, &coupon); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+		result, err := models.EvaluatePromotions(client, c.customer, c.code, c.total, c.typeDiscounted, now)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var got []promotion
+		discount := int64(0)
+		for _, applied := range result.Promotions {
+			got = append(got, promotion{applied.Code, applied.BaseCents, applied.DiscountCents})
+			discount += applied.DiscountCents
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: promotions %+v, want %+v", c.name, got, c.want)
+		}
+		if result.DiscountCents != discount {
+			t.Errorf("%s: discount %d, the promotions add up to %d", c.name, result.DiscountCents, discount)
+		}
+		if (c.problem == "") != (result.CouponProblem == "") || !str.Contains(result.CouponProblem, c.problem) {
+			t.Errorf("%s: coupon problem %q, want %q", c.name, result.CouponProblem, c.problem)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package models_test
+
+import (
+	"3DQuest/config"
+	"3DQuest/dbdriver"
+	"3DQuest/dbdriver/fake"
+	"3DQuest/geometry"
+	"3DQuest/models"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// @info Fixtures shared by the tests of the models, each on its own fake CouchDB
+
+var (
+	storeConfig   = &config.StoreConfig{ReservationTTL: 30 * time.Minute, AnonymousCartTTL: 720 * time.Hour, CheckoutTTL: 72 * time.Hour}
+	invoiceConfig = &config.InvoiceConfig{Series: "F", RectifyingSeries: "R", IssuerName: "3DQuest S.L.", IssuerTaxID: "B12345678"}
+	mqttConfig    = config.MQTTConfig{ClientID: "3dquest-test", SampleInterval: time.Minute, Silence: 5 * time.Minute, OverheatMargin: 15}
+)
+
+func newCouch(t *testing.T) (*dbdriver.CouchDBClient, *fake.Couch) {
+	t.Helper()
+	couch := fake.NewCouch()
+	server := httptest.NewServer(couch)
+	t.Cleanup(server.Close)
+	client, err := fake.Client(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, couch
+}
+
+// @info A published product with stock units of a single variant
+func newProduct(t *testing.T, client *dbdriver.CouchDBClient, stock int) *models.Product {
+	t.Helper()
+	product := &models.Product{Kind: models.ProductAccessory, Name: "Nozzle set", VATPercent: 21, Variants: []models.ProductVariant{{SKU: "NZ-04", PriceCents: 1299, Stock: stock}}}
+	if err := models.CreateProduct(client, product); err != nil {
+		t.Fatal(err)
+	}
+	product, err := models.PublishProduct(client, product.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return product
+}
+
+func stockOf(t *testing.T, client *dbdriver.CouchDBClient, product *models.Product) int {
+	t.Helper()
+	product, err := models.GetProduct(client, product.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return product.Variants[0].Stock
+}
+
+func newMQTTPrinter(t *testing.T, client *dbdriver.CouchDBClient, topic string) *models.Printer {
+	t.Helper()
+	printer := &models.Printer{Name: "MK4", BuildVolume: geometry.Vec3{X: 250, Y: 210, Z: 220}, Materials: []string{"PLA"}, MQTT: &models.PrinterMQTT{Topic: topic}}
+	if err := models.CreatePrinter(client, printer); err != nil {
+		t.Fatal(err)
+	}
+	return printer
+}
+
+func alertsOf(t *testing.T, client *dbdriver.CouchDBClient, status models.AlertStatus) []models.PrinterAlert {
+	t.Helper()
+	alerts, _, err := models.ListPrinterAlerts(client, &models.AlertFilter{Status: status}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alerts
+}
+
+// @info An ordinary invoice of 12.10 at 21% VAT
+func newInvoice(t *testing.T, client *dbdriver.CouchDBClient) *models.Invoice {
+	t.Helper()
+	now := time.Now().UTC()
+	invoice := &models.Invoice{
+		ID: "invoice:F-2026-000001", Type: models.InvoiceDocType, Kind: models.InvoiceOrdinary, Series: "F", Year: 2026, Number: 1, Code: "F-2026-000001",
+		CustomerID: "alice", OrderID: "order-1", Currency: "EUR",
+		Lines:    []models.InvoiceLine{{Description: "Print", Quantity: 1, VATPercent: 21, NetCents: 1000, TotalCents: 1210}},
+		VAT:      []models.VATBreakdown{{VATPercent: 21, BaseCents: 1000, VATCents: 210}},
+		NetCents: 1000, VATCents: 210, TotalCents: 1210, IssuedAt: now, UpdatedAt: now,
+	}
+	doc, err := dbdriver.EncodeDocument(invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(doc, "_rev")
+	if _, err := dbdriver.CreateOrModifyDocument(client, &doc, invoice.ID); err != nil {
+		t.Fatal(err)
+	}
+	return invoice
+}
+
+// @info A print order of the customer quoted by the staff at 25.00
+func newQuotedOrder(t *testing.T, client *dbdriver.CouchDBClient, customerID string) *models.Order {
+	t.Helper()
+	order := &models.Order{CustomerID: customerID, Items: []models.OrderItem{{Name: "bracket.stl", Material: "PLA", Quantity: 2}}}
+	if err := models.CreateOrder(client, order); err != nil {
+		t.Fatal(err)
+	}
+	price := int64(2500)
+	order, err := models.TransitionOrder(client, order.ID, &models.OrderTransition{To: models.OrderQuoted, TotalCents: &price, Actor: models.ActorStaff, ActorID: "staff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"3DQuest/dbdriver"
+	"reflect"
+)
+
+// @info Mango indexes needed by the queries of the models. Called on startup, existing indexes are left untouched.
+var indexes = []*dbdriver.IndexDefinition{
+	dbdriver.NewIndex("idx-users-email", "type", "email"),
+	dbdriver.NewIndex("idx-audit-created", "type", "created_at"),
+	dbdriver.NewIndex("idx-credits-user", "type", "user_id", "sequence"),
+	dbdriver.NewIndex("idx-orders-created", "type", "created_at"),
+	dbdriver.NewIndex("idx-orders-customer", "type", "customer_id", "created_at"),
+	dbdriver.NewIndex("idx-pricing-version", "type", "version"),
+	dbdriver.NewIndex("idx-printers-name", "type", "name"),
+	dbdriver.NewIndex("idx-jobs-start", "type", "planned_start"),
+	dbdriver.NewIndex("idx-samples-printer", "type", "printer_id", "start"),
+	dbdriver.NewIndex("idx-alerts-raised", "type", "raised_at"),
+	dbdriver.NewIndex("idx-spools-material", "type", "material", "colour"),
+	dbdriver.NewIndex("idx-products-name", "type", "name"),
+	dbdriver.NewIndex("idx-checkouts-created", "type", "created_at"),
+	dbdriver.NewIndex("idx-checkouts-customer", "type", "customer_id", "created_at"),
+	dbdriver.NewIndex("idx-checkouts-status", "type", "status"),
+	dbdriver.NewIndex("idx-payments-created", "type", "created_at"),
+	dbdriver.NewIndex("idx-payments-user", "type", "user_id", "created_at"),
+	dbdriver.NewIndex("idx-invoices-issued", "type", "issued_at"),
+	dbdriver.NewIndex("idx-invoices-customer", "type", "customer_id", "issued_at"),
+	dbdriver.NewIndex("idx-shipments-created", "type", "created_at"),
+	dbdriver.NewIndex("idx-shipments-customer", "type", "customer_id", "created_at"),
+}
+
+const (
+	creditsDesignDoc   = "_design/credits"
+	creditBalancesView = "balances"
+)
+
+// @info Design documents holding the views of the models. Installed on startup, see EnsureViews.
+var designDocs = []dbdriver.DesignDocument{
+	{
+		ID:       creditsDesignDoc,
+		Language: "javascript",
+		Views: map[string]dbdriver.View{
+			creditBalancesView: {
+				MapFunction: `function (doc) {
+	if (doc.type === "credit_transaction") {
+		doc.entries.forEach(function (entry) { emit(entry.account, entry.amount_cents); });
+	}
+}`,
+				ReduceFunction: "_stats",
+			},
+		},
+	},
+}
+
+func EnsureIndexes(client *dbdriver.CouchDBClient) error {
+	for _, index := range indexes {
+		if _, err := dbdriver.CreateIndex(client, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// @info Creates the design documents of the models, or updates their views if they changed. Other fields of the
+// design documents (update handlers, validate_doc_update...) are kept.
+func EnsureViews(client *dbdriver.CouchDBClient) error {
+	for _, wanted := range designDocs {
+		doc, err := dbdriver.GetDesignDocument(client, wanted.ID)
+		if err != nil {
+			return err
+		}
+		if doc.ID == "" { // @info The design document does not exist yet
+			doc = &dbdriver.DesignDocument{ID: wanted.ID, Language: wanted.Language}
+		} else if reflect.DeepEqual(doc.Views, wanted.Views) {
+			continue
+		}
+		doc.Views = wanted.Views
+		if _, err := dbdriver.PutDesignDocument(client, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
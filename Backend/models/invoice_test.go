@@ -0,0 +1,101 @@
+package models_test
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestRectifyInvoice(t *testing.T) {
+	client, couch := newCouch(t)
+	original := newInvoice(t, client)
+
+	first, err := models.RectifyInvoice(client, invoiceConfig, original.ID, 500, "Scratched part", "refund-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Kind != models.InvoiceRectifying || first.TotalCents != -500 || first.RectifiesID != original.ID || first.Number != 1 {
+		t.Errorf("rectifying invoice %s of %d rectifying %s", first.Code, first.TotalCents, first.RectifiesID)
+	}
+	// @info A retry gets the same invoice, even asking for another amount
+	again, err := models.RectifyInvoice(client, invoiceConfig, original.ID, 700, "Scratched part", "refund-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("retry issued %s, want %s", again.ID, first.ID)
+	}
+
+	var validation *dbdriver.ValidationError
+	if _, err := models.RectifyInvoice(client, invoiceConfig, original.ID, 800, "Late", "refund-2"); !errors.As(err, &validation) {
+		t.Errorf("rectifying more than is left: %v", err)
+	}
+	if _, err := models.RectifyInvoice(client, invoiceConfig, original.ID, 0, "", "refund-2"); !errors.As(err, &validation) {
+		t.Errorf("rectifying without a reason: %v", err)
+	}
+	rest, err := models.RectifyInvoice(client, invoiceConfig, original.ID, 0, "Cancelled", "refund-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rest.TotalCents != -710 || rest.Number != 2 {
+		t.Errorf("rest rectified by %s of %d", rest.Code, rest.TotalCents)
+	}
+	if _, err := models.RectifyInvoice(client, invoiceConfig, first.ID, 0, "Twice", "refund-3"); !errors.As(err, &validation) {
+		t.Errorf("rectifying a rectifying invoice: %v", err)
+	}
+
+	original, err = models.GetInvoice(client, original.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []models.InvoiceRectification{{InvoiceID: first.ID, IdempotencyKey: "refund-1", TotalCents: -500}, {InvoiceID: rest.ID, IdempotencyKey: "refund-2", TotalCents: -710}}
+	if len(original.Rectifications) != len(want) || original.Rectifications[0] != want[0] || original.Rectifications[1] != want[1] {
+		t.Errorf("rectifications %+v, want %+v", original.Rectifications, want)
+	}
+	if invoices := couch.OfType(models.InvoiceDocType); len(invoices) != 3 {
+		t.Errorf("%d invoices, want 3", len(invoices))
+	}
+}
+
+func TestRectifyInvoiceConcurrently(t *testing.T) {
+	client, couch := newCouch(t)
+	original := newInvoice(t, client)
+
+	// @info Each one fits in what is left, both together do not
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = models.RectifyInvoice(client, invoiceConfig, original.ID, 800, "Refund", string(rune('a'+i)))
+		}(i)
+	}
+	wg.Wait()
+	issued := 0
+	for _, err := range errs {
+		var validation *dbdriver.ValidationError
+		switch {
+		case err == nil:
+			issued++
+		case !errors.As(err, &validation):
+			t.Error(err)
+		}
+	}
+	if issued != 1 {
+		t.Errorf("%d rectifications issued, want 1: %v", issued, errs)
+	}
+	original, err := models.GetInvoice(client, original.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(original.Rectifications) != 1 || original.Rectifications[0].InvoiceID == "" {
+		t.Errorf("rectifications %+v, want the issued one", original.Rectifications)
+	}
+	series := couch.OfType(models.InvoiceSeriesDocType)
+	if len(series) != 1 || series[0]["last"] != float64(1) {
+		t.Errorf("series %+v, want one number given", series)
+	}
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInvoiceTotal(t *testing.T) {
+	both := func(description string, vatPercent float64, netCents int64, totalCents int64) invoiceAmount {
+		return invoiceAmount{line: InvoiceLine{Description: description, Quantity: 1, VATPercent: vatPercent, NetCents: netCents, TotalCents: totalCents}, given: givenBoth}
+	}
+	cases := []struct {
+		name    string
+		amounts []invoiceAmount
+		want    [][2]int64 // Net and total of every line
+		vat     []VATBreakdown
+		totals  [3]int64 // Net, VAT and total of the invoice
+	}{
+		{"net lines, VAT on their sum",
+			[]invoiceAmount{netAmount("Print", 1, 21, 1000), netAmount("Post-processing", 1, 21, 333)},
+			[][2]int64{{1000, 1210}, {333, 403}},
+			[]VATBreakdown{{VATPercent: 21, BaseCents: 1333, VATCents: 280}},
+			[3]int64{1333, 280, 1613}},
+		{"gross lines, base out of their sum",
+			[]invoiceAmount{grossAmount("Nozzle set", 1, 10, 1299), grossAmount("Nozzle set", 1, 10, 1299)},
+			[][2]int64{{1181, 1299}, {1181, 1299}},
+			[]VATBreakdown{{VATPercent: 10, BaseCents: 2362, VATCents: 236}},
+			[3]int64{2362, 236, 2598}},
+		{"net and gross at one rate",
+			[]invoiceAmount{netAmount("Print", 1, 21, 1000), grossAmount("Spool", 1, 21, 1210)},
+			[][2]int64{{1000, 1210}, {1000, 1210}},
+			[]VATBreakdown{{VATPercent: 21, BaseCents: 2000, VATCents: 420}},
+			[3]int64{2000, 420, 2420}},
+		{"mixed rates, highest first",
+			[]invoiceAmount{grossAmount("Book", 1, 0, 300), netAmount("Print", 1, 21, 1000), grossAmount("Food", 1, 10, 550), both("Copied", 21, 100, 121)},
+			[][2]int64{{300, 300}, {1000, 1210}, {500, 550}, {100, 121}},
+			[]VATBreakdown{{VATPercent: 21, BaseCents: 1100, VATCents: 231}, {VATPercent: 10, BaseCents: 500, VATCents: 50}, {VATPercent: 0, BaseCents: 300}},
+			[3]int64{1900, 281, 2181}},
+		{"rounding goes to the last line",
+			[]invoiceAmount{netAmount("A", 1, 21, 7), netAmount("B", 1, 21, 7), netAmount("C", 1, 21, 7)},
+			[][2]int64{{7, 8}, {7, 8}, {7, 9}},
+			[]VATBreakdown{{VATPercent: 21, BaseCents: 21, VATCents: 4}},
+			[3]int64{21, 4, 25}},
+		{"refund",
+			[]invoiceAmount{grossAmount("Partial refund", 1, 21, -1299), grossAmount("Partial refund", 1, 10, -110)},
+			[][2]int64{{-1074, -1299}, {-100, -110}},
+			[]VATBreakdown{{VATPercent: 21, BaseCents: -1074, VATCents: -225}, {VATPercent: 10, BaseCents: -100, VATCents: -10}},
+			[3]int64{-1174, -235, -1409}},
+	}
+	for _, c := range cases {
+		invoice := &Invoice{}
+		invoice.total(c.amounts)
+		lines := [][2]int64{}
+		for _, line := range invoice.Lines {
+			lines = append(lines, [2]int64{line.NetCents, line.TotalCents})
+		}
+		if !reflect.DeepEqual(lines, c.want) {
+			t.Errorf("%s: lines %v, want %v", c.name, lines, c.want)
+		}
+		if !reflect.DeepEqual(invoice.VAT, c.vat) {
+			t.Errorf("%s: VAT %+v, want %+v", c.name, invoice.VAT, c.vat)
+		}
+		if totals := [3]int64{invoice.NetCents, invoice.VATCents, invoice.TotalCents}; totals != c.totals {
+			t.Errorf("%s: totals %v, want %v", c.name, totals, c.totals)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package models_test
+
+import (
+	"3DQuest/models"
+	"fmt"
+	"testing"
+)
+
+func TestConsumeFilament(t *testing.T) {
+	cases := []struct {
+		name     string
+		job      models.PrintJob // On the printer of the loaded spool unless said otherwise
+		reported *models.FilamentReport
+		draws    string  // Spool and grams taken from each, in order
+		missing  float64 // Grams not found on any spool
+		source   models.UsageSource
+	}{
+		{"estimate, from the loaded spool", models.PrintJob{Material: "PLA", Colour: "black", Grams: 100}, nil, "[loaded:100]", 0, models.UsageEstimated},
+		{"report over the estimate", models.PrintJob{Material: "PLA", Colour: "black", Grams: 100}, &models.FilamentReport{Grams: 120.04}, "[loaded:120]", 0, models.UsageReported},
+		{"then the emptiest of the shelf", models.PrintJob{Material: "pla", Colour: "Black", Grams: 450}, nil, "[loaded:300 small:150]", 0, models.UsageEstimated},
+		{"more than there is", models.PrintJob{Material: "PLA", Colour: "black"}, &models.FilamentReport{Grams: 1200}, "[loaded:300 small:200 large:500]", 200, models.UsageReported},
+		{"length weighed with the spool", models.PrintJob{Material: "PLA", Colour: "black"}, &models.FilamentReport{MM: 10000}, "[loaded:29.8]", 0, models.UsageReported},
+		{"any colour", models.PrintJob{Material: "PLA", Grams: 450}, nil, "[loaded:300 white:100 small:50]", 0, models.UsageEstimated},
+		{"no material, only the loaded spool", models.PrintJob{Grams: 400}, nil, "[loaded:300]", 100, models.UsageEstimated},
+		{"on another printer", models.PrintJob{PrinterID: "other", Material: "PETG", Colour: "black", Grams: 50}, nil, "[petg:50]", 0, models.UsageEstimated},
+		{"material not on the shelf", models.PrintJob{Material: "TPU", Grams: 50}, nil, "[]", 50, models.UsageEstimated},
+	}
+	for _, c := range cases {
+		client, _ := newCouch(t)
+		printer := newMQTTPrinter(t, client, "mk4")
+		spools := map[string]*models.Spool{
+			"loaded": {Material: "PLA", Colour: "Black", NetGrams: 1000, RemainingGrams: 300},
+			"small":  {Material: "PLA", Colour: "black", NetGrams: 1000, RemainingGrams: 200},
+			"large":  {Material: "PLA", Colour: "black", NetGrams: 1000, RemainingGrams: 500},
+			"white":  {Material: "PLA", Colour: "white", NetGrams: 1000, RemainingGrams: 100},
+			"petg":   {Material: "PETG", Colour: "black", NetGrams: 1000, RemainingGrams: 1000},
+		}
+		names := map[string]string{}
+		for name, spool := range spools {
+			if err := models.CreateSpool(client, spool); err != nil {
+				t.Fatal(err)
+			}
+			names[spool.ID] = name
+		}
+		if _, err := models.LoadSpool(client, spools["loaded"].ID, printer.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		job := c.job
+		job.Type, job.Status = models.PrintJobDocType, models.JobDone
+		if job.PrinterID == "" {
+			job.PrinterID = printer.ID
+		}
+		if err := models.ConsumeFilament(client, &job, c.reported); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		stored, err := models.GetPrintJob(client, job.ID)
+		if err != nil || stored.Usage == nil {
+			t.Fatalf("%s: usage not recorded on the job %+v: %v", c.name, stored, err)
+		}
+		draws := []string{}
+		taken := map[string]float64{}
+		for _, draw := range stored.Usage.Spools {
+			draws = append(draws, fmt.Sprintf("%s:%v", names[draw.SpoolID], draw.Grams))
+			taken[names[draw.SpoolID]] = draw.Grams
+		}
+		if fmt.Sprint(draws) != c.draws || stored.Usage.MissingGrams != c.missing || stored.Usage.Source != c.source {
+			t.Errorf("%s: took %v, %v missing (%s), want %s, %v missing (%s)", c.name, draws, stored.Usage.MissingGrams, stored.Usage.Source, c.draws, c.missing, c.source)
+		}
+
+		for name, before := range spools {
+			spool, err := models.GetSpool(client, before.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := before.RemainingGrams - taken[name]
+			if spool.RemainingGrams != want {
+				t.Errorf("%s: %s has %v g left, want %v", c.name, name, spool.RemainingGrams, want)
+			}
+			if (spool.Status == models.SpoolEmpty) != (want == 0) {
+				t.Errorf("%s: %s is %s with %v g left", c.name, name, spool.Status, want)
+			}
+		}
+	}
+}
+
+func TestConsumeNothingKnown(t *testing.T) {
+	client, _ := newCouch(t)
+	spool := &models.Spool{Material: "PLA", NetGrams: 1000}
+	if err := models.CreateSpool(client, spool); err != nil {
+		t.Fatal(err)
+	}
+	job := &models.PrintJob{PrinterID: "mk4", Material: "PLA"}
+	if err := models.ConsumeFilament(client, job, &models.FilamentReport{}); err != nil {
+		t.Fatal(err)
+	}
+	if spool, _ := models.GetSpool(client, spool.ID); job.Usage != nil || job.ID != "" || spool.RemainingGrams != 1000 {
+		t.Errorf("usage %+v of a job without estimate nor report, %v g left", job.Usage, spool.RemainingGrams)
+	}
+}
@@ -0,0 +1,271 @@
+package models_test
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/geometry"
+	"3DQuest/models"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestAcceptOrderOnlyWhenPaid(t *testing.T) {
+	client, _ := newCouch(t)
+	order := newQuotedOrder(t, client, "alice")
+	var transitionErr *models.TransitionError
+	if _, err := models.TransitionOrder(client, order.ID, &models.OrderTransition{To: models.OrderAccepted, Actor: models.ActorCustomer, ActorID: "alice"}); !errors.As(err, &transitionErr) {
+		t.Fatalf("customer accepting an unpaid order: %v", err)
+	}
+
+	if _, err := models.AddCartItem(client, storeConfig, models.UserCartID("alice"), "alice", models.CartItem{Kind: models.CartPrint, OrderID: order.ID}); err != nil {
+		t.Fatal(err)
+	}
+	checkout, err := models.PayCart(client, storeConfig, "alice", &models.CheckoutRequest{PaymentMethod: models.PaymentExternal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// @info Not even the staff accept it while its checkout is waiting to be paid
+	for _, actor := range []models.OrderActor{models.ActorCustomer, models.ActorStaff, models.ActorSystem} {
+		if _, err := models.TransitionOrder(client, order.ID, &models.OrderTransition{To: models.OrderAccepted, Actor: actor}); !errors.As(err, &transitionErr) {
+			t.Errorf("%s accepting an order being paid: %v", actor, err)
+		}
+	}
+	if order, _ = models.GetOrder(client, order.ID); order.Status != models.OrderQuoted {
+		t.Fatalf("status %s before paying, want quoted", order.Status)
+	}
+
+	if _, err := models.ConfirmCheckout(client, checkout.ID, "bank transfer"); err != nil {
+		t.Fatal(err)
+	}
+	if order, _ = models.GetOrder(client, order.ID); order.Status != models.OrderAccepted {
+		t.Errorf("status %s once paid, want accepted", order.Status)
+	}
+	if last := order.History[len(order.History)-1]; last.Actor != models.ActorSystem || last.ActorID != "alice" {
+		t.Errorf("accepted by %s %s", last.Actor, last.ActorID)
+	}
+}
+
+func TestAttachOrderModelWhileEditing(t *testing.T) {
+	client, couch := newCouch(t)
+	order := &models.Order{CustomerID: "alice", Items: []models.OrderItem{{Name: "bracket", Material: "PLA", Quantity: 1}, {Name: "lid", Material: "PLA", Quantity: 1}}}
+	if err := models.CreateOrder(client, order); err != nil {
+		t.Fatal(err)
+	}
+	// @info Each edit drops the files the customer does not know of yet, each upload adds one
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			upload := &models.ModelUpload{Filename: fmt.Sprintf("part-%d.stl", i), Data: []byte(fmt.Sprintf("solid part-%d", i)), Model: &geometry.Analysis{}}
+			if _, err := models.AttachOrderModel(client, order.ID, i%2, upload); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			items := []models.OrderItem{{Name: "bracket", Material: "PLA", Quantity: 2}, {Name: "lid", Material: "PLA", Quantity: 1}}
+			if _, err := models.UpdateOrderItems(client, order.ID, items, "", nil); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	order, err := models.GetOrder(client, order.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range order.Items {
+		if _, stored := order.Attachments[item.File]; item.File != "" && !stored {
+			t.Errorf("item %d refers to %s, which is not stored", i, item.File)
+		}
+		if (item.File == "") != (item.Model == nil) {
+			t.Errorf("item %d with file %q and model %v", i, item.File, item.Model)
+		}
+	}
+	if len(order.Attachments) > len(order.Items) {
+		t.Errorf("%d attachments kept for %d items", len(order.Attachments), len(order.Items))
+	}
+	stored, _ := couch.OfType(models.OrderDocType)[0]["_attachments"].(map[string]interface{})
+	for name, attachment := range stored {
+		if attachment.(map[string]interface{})["stub"] != true {
+			t.Errorf("attachment %s stored as %v", name, attachment)
+		}
+	}
+}
+
+// @info Staff transitions taking a new order to each status
+var orderPaths = map[models.OrderStatus][]models.OrderStatus{
+	models.OrderDraft:          {},
+	models.OrderQuoted:         {models.OrderQuoted},
+	models.OrderAccepted:       {models.OrderQuoted, models.OrderAccepted},
+	models.OrderQueued:         {models.OrderQuoted, models.OrderAccepted, models.OrderQueued},
+	models.OrderPrinting:       {models.OrderQuoted, models.OrderAccepted, models.OrderQueued, models.OrderPrinting},
+	models.OrderPostProcessing: {models.OrderQuoted, models.OrderAccepted, models.OrderQueued, models.OrderPrinting, models.OrderPostProcessing},
+	models.OrderReady:          {models.OrderQuoted, models.OrderAccepted, models.OrderQueued, models.OrderPrinting, models.OrderReady},
+	models.OrderFailed:         {models.OrderQuoted, models.OrderAccepted, models.OrderQueued, models.OrderPrinting, models.OrderFailed},
+	models.OrderReprint:        {models.OrderQuoted, models.OrderAccepted, models.OrderQueued, models.OrderPrinting, models.OrderFailed, models.OrderReprint},
+	models.OrderShipped:        {models.OrderQuoted, models.OrderAccepted, models.OrderQueued, models.OrderPrinting, models.OrderReady, models.OrderShipped},
+	models.OrderCollected:      {models.OrderQuoted, models.OrderAccepted, models.OrderQueued, models.OrderPrinting, models.OrderReady, models.OrderCollected},
+	models.OrderCancelled:      {models.OrderCancelled},
+}
+
+func orderIn(t *testing.T, client *dbdriver.CouchDBClient, status models.OrderStatus) *models.Order {
+	t.Helper()
+	order := &models.Order{CustomerID: "alice", Items: []models.OrderItem{{Name: "bracket.stl", Material: "PLA", Quantity: 1}}}
+	if err := models.CreateOrder(client, order); err != nil {
+		t.Fatal(err)
+	}
+	price := int64(2500)
+	for _, next := range orderPaths[status] {
+		var err error
+		if order, err = models.TransitionOrder(client, order.ID, &models.OrderTransition{To: next, TotalCents: &price, Actor: models.ActorStaff}); err != nil {
+			t.Fatalf("taking an order to %s: %v", status, err)
+		}
+	}
+	return order
+}
+
+func TestOrderTransitions(t *testing.T) {
+	client, _ := newCouch(t)
+	customer, staff, system := models.ActorCustomer, models.ActorStaff, models.ActorSystem
+	cases := []struct {
+		from    models.OrderStatus
+		to      models.OrderStatus
+		actor   models.OrderActor
+		allowed bool
+	}{
+		{models.OrderDraft, models.OrderQuoted, staff, true},
+		{models.OrderDraft, models.OrderQuoted, system, true},
+		{models.OrderDraft, models.OrderQuoted, customer, false},
+		{models.OrderDraft, models.OrderCancelled, customer, true},
+		{models.OrderDraft, models.OrderCancelled, system, false},
+		{models.OrderDraft, models.OrderAccepted, staff, false},
+		{models.OrderQuoted, models.OrderAccepted, system, true},
+		{models.OrderQuoted, models.OrderAccepted, staff, true},
+		{models.OrderQuoted, models.OrderAccepted, customer, false},
+		{models.OrderQuoted, models.OrderDraft, customer, true},
+		{models.OrderQuoted, models.OrderDraft, system, false},
+		{models.OrderQuoted, models.OrderCancelled, system, true},
+		{models.OrderAccepted, models.OrderQueued, system, true},
+		{models.OrderAccepted, models.OrderQueued, customer, false},
+		{models.OrderAccepted, models.OrderCancelled, customer, true},
+		{models.OrderAccepted, models.OrderPrinting, staff, false},
+		{models.OrderQueued, models.OrderPrinting, system, true},
+		{models.OrderQueued, models.OrderCancelled, customer, false},
+		{models.OrderQueued, models.OrderCancelled, staff, true},
+		{models.OrderPrinting, models.OrderPostProcessing, system, true},
+		{models.OrderPrinting, models.OrderReady, system, true},
+		{models.OrderPrinting, models.OrderFailed, system, true},
+		{models.OrderPrinting, models.OrderCancelled, staff, false},
+		{models.OrderPrinting, models.OrderFailed, customer, false},
+		{models.OrderPostProcessing, models.OrderReady, staff, true},
+		{models.OrderPostProcessing, models.OrderReady, system, false},
+		{models.OrderPostProcessing, models.OrderFailed, staff, true},
+		{models.OrderFailed, models.OrderReprint, staff, true},
+		{models.OrderFailed, models.OrderReprint, system, false},
+		{models.OrderFailed, models.OrderCancelled, staff, true},
+		{models.OrderFailed, models.OrderCancelled, customer, false},
+		{models.OrderReprint, models.OrderQueued, system, true},
+		{models.OrderReprint, models.OrderPrinting, staff, false},
+		{models.OrderReady, models.OrderShipped, system, true},
+		{models.OrderReady, models.OrderCollected, staff, true},
+		{models.OrderReady, models.OrderCollected, customer, false},
+		{models.OrderReady, models.OrderCancelled, staff, false},
+		{models.OrderShipped, models.OrderReady, staff, false},
+		{models.OrderCollected, models.OrderCancelled, staff, false},
+		{models.OrderCancelled, models.OrderDraft, staff, false},
+		{models.OrderCancelled, models.OrderQuoted, customer, false},
+	}
+	price := int64(1999)
+	for _, c := range cases {
+		order := orderIn(t, client, c.from)
+		events := len(order.History)
+		updated, err := models.TransitionOrder(client, order.ID, &models.OrderTransition{To: c.to, TotalCents: &price, Actor: c.actor, ActorID: "someone", Note: "testing"})
+		var transitionErr *models.TransitionError
+		if !c.allowed {
+			if !errors.As(err, &transitionErr) || transitionErr.From != c.from || transitionErr.To != c.to {
+				t.Errorf("%s to %s by %s: error %v, want a *TransitionError", c.from, c.to, c.actor, err)
+			}
+			if order, _ := models.GetOrder(client, order.ID); order.Status != c.from || len(order.History) != events {
+				t.Errorf("%s to %s by %s refused, and the order changed to %s", c.from, c.to, c.actor, order.Status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s to %s by %s: %v", c.from, c.to, c.actor, err)
+			continue
+		}
+		last := updated.History[len(updated.History)-1]
+		if updated.Status != c.to || len(updated.History) != events+1 || last.From != c.from || last.To != c.to || last.Actor != c.actor || last.ActorID != "someone" || last.Note != "testing" {
+			t.Errorf("%s to %s by %s: status %s, last event %+v", c.from, c.to, c.actor, updated.Status, last)
+		}
+		if at := updated.StatusTimes[c.to]; !at.Equal(last.At) {
+			t.Errorf("%s to %s by %s: entered at %v, recorded at %v", c.from, c.to, c.actor, at, last.At)
+		}
+	}
+}
+
+func TestOrderTransitionEffects(t *testing.T) {
+	client, _ := newCouch(t)
+	draft := orderIn(t, client, models.OrderDraft)
+	var transitionErr *models.TransitionError
+	for _, price := range []*int64{nil, new(int64)} {
+		if price != nil {
+			*price = -1
+		}
+		if _, err := models.TransitionOrder(client, draft.ID, &models.OrderTransition{To: models.OrderQuoted, TotalCents: price, Actor: models.ActorStaff}); !errors.As(err, &transitionErr) {
+			t.Errorf("quoted with the price %v: %v", price, err)
+		}
+	}
+
+	// @info Going back to draft drops the price, it needs a new quote
+	quoted := orderIn(t, client, models.OrderQuoted)
+	if quoted.TotalCents != 2500 {
+		t.Errorf("quoted at %d", quoted.TotalCents)
+	}
+	if order, err := models.TransitionOrder(client, quoted.ID, &models.OrderTransition{To: models.OrderDraft, Actor: models.ActorCustomer}); err != nil || order.TotalCents != 0 || order.Quote != nil {
+		t.Errorf("back to draft: %+v: %v", order, err)
+	}
+
+	// @info Every reprint is counted
+	order := orderIn(t, client, models.OrderReprint)
+	for _, next := range []models.OrderStatus{models.OrderQueued, models.OrderPrinting, models.OrderFailed, models.OrderReprint} {
+		var err error
+		if order, err = models.TransitionOrder(client, order.ID, &models.OrderTransition{To: next, Actor: models.ActorStaff}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if order.Reprints != 2 {
+		t.Errorf("%d reprints, want 2", order.Reprints)
+	}
+
+	cases := []struct {
+		status models.OrderStatus
+		actor  models.OrderActor
+		next   []models.OrderStatus
+		closed bool
+	}{
+		{models.OrderQuoted, models.ActorCustomer, []models.OrderStatus{models.OrderDraft, models.OrderCancelled}, false},
+		{models.OrderQuoted, models.ActorStaff, []models.OrderStatus{models.OrderDraft, models.OrderAccepted, models.OrderCancelled}, false},
+		{models.OrderPrinting, models.ActorCustomer, []models.OrderStatus{}, false},
+		{models.OrderPrinting, models.ActorSystem, []models.OrderStatus{models.OrderPostProcessing, models.OrderReady, models.OrderFailed}, false},
+		{models.OrderShipped, models.ActorStaff, []models.OrderStatus{}, true},
+		{models.OrderCollected, models.ActorStaff, []models.OrderStatus{}, true},
+		{models.OrderCancelled, models.ActorStaff, []models.OrderStatus{}, true},
+	}
+	for _, c := range cases {
+		order := &models.Order{Status: c.status}
+		if next := order.NextStatuses(c.actor); fmt.Sprint(next) != fmt.Sprint(c.next) {
+			t.Errorf("next statuses of %s for %s: %v, want %v", c.status, c.actor, next, c.next)
+		}
+		if order.IsClosed() != c.closed {
+			t.Errorf("%s closed: %v", c.status, order.IsClosed())
+		}
+	}
+	if _, err := models.TransitionOrder(client, "missing", &models.OrderTransition{To: models.OrderCancelled, Actor: models.ActorStaff}); !dbdriver.IsNotFound(err) {
+		t.Errorf("missing order: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+import "3DQuest/dbdriver"
+
+// @info Model => document types it is stored as
+var modelSchemas = []struct {
+	model    interface{}
+	docTypes []string
+}{
+	{User{}, UserTypes},
+	{userEmail{}, []string{userEmailDocType}},
+	{CreditTransaction{}, []string{CreditTransactionDocType}},
+	{Order{}, []string{OrderDocType}},
+	{AuditEntry{}, []string{AuditDocType}},
+	{PricingRules{}, []string{PricingRulesDocType}},
+	{Printer{}, []string{PrinterDocType}},
+	{PrintJob{}, []string{PrintJobDocType}},
+	{PrinterState{}, []string{PrinterStateDocType}},
+	{TelemetrySample{}, []string{TelemetrySampleDocType}},
+	{PrinterAlert{}, []string{PrinterAlertDocType}},
+	{Spool{}, []string{SpoolDocType}},
+	{MaterialThreshold{}, []string{MaterialThresholdDocType}},
+	{Product{}, []string{ProductDocType}},
+	{Category{}, []string{CategoryDocType}},
+	{Coupon{}, []string{CouponDocType}},
+	{Cart{}, []string{CartDocType}},
+	{Checkout{}, []string{CheckoutDocType}},
+	{Payment{}, []string{PaymentDocType}},
+	{PaymentEvent{}, []string{PaymentEventDocType}},
+	{Invoice{}, []string{InvoiceDocType}},
+	{InvoiceSeries{}, []string{InvoiceSeriesDocType}},
+	{PickupPoint{}, []string{PickupPointDocType}},
+	{ShippingService{}, []string{ShippingServiceDocType}},
+	{Shipment{}, []string{ShipmentDocType}},
+}
+
+// @info Registers the schemas of every model so they are validated before being written
+func RegisterSchemas(registry *dbdriver.SchemaRegistry) error {
+	for _, entry := range modelSchemas {
+		schema, err := dbdriver.SchemaFromStruct(entry.model)
+		if err != nil {
+			return err
+		}
+		if err := registry.Register(schema, entry.docTypes...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package models_test
+
+import (
+	"3DQuest/connector"
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"3DQuest/mqtt"
+	"3DQuest/telemetry"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIngest(t *testing.T) {
+	client, couch := newCouch(t)
+	printer := newMQTTPrinter(t, client, "shop/mk4/#")
+	ingester := models.NewTelemetryIngester(client, &mqttConfig)
+	start := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	ingest := func(seconds int, topic string, payload string) {
+		t.Helper()
+		if err := ingester.Ingest(topic, []byte(payload), start.Add(time.Duration(seconds)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ingest(0, "other/printer", `{"state":"error"}`)
+	if _, err := models.GetPrinterState(client, printer.ID); !dbdriver.IsNotFound(err) {
+		t.Fatalf("state after a message of no printer: %v", err)
+	}
+	ingest(0, "shop/mk4/status", `{"state":"printing","temperatures":{"nozzle":{"actual":214,"target":215}}}`)
+	state, err := models.GetPrinterState(client, printer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.State != connector.StatePrinting || state.Topic != "shop/mk4/status" || !state.LastMessageAt.Equal(start) {
+		t.Errorf("state %s on %s at %v", state.State, state.Topic, state.LastMessageAt)
+	}
+
+	// @info Temperatures alone are written once stateWriteInterval passed, alerts straight away
+	ingest(5, "shop/mk4/status", `{"temperatures":{"nozzle":{"actual":240,"target":215}}}`)
+	if state, _ = models.GetPrinterState(client, printer.ID); state.Temperatures["nozzle"].Actual != 214 {
+		t.Errorf("temperature written after 5 s: %v", state.Temperatures["nozzle"])
+	}
+	if open := alertsOf(t, client, models.AlertOpen); len(open) != 1 || open[0].Kind != telemetry.AlertOverheat || open[0].PrinterID != printer.ID {
+		t.Fatalf("open alerts %+v, want an overheat", open)
+	}
+	ingest(20, "shop/mk4/status", `{"temperatures":{"nozzle":{"actual":216,"target":215}}}`)
+	if state, _ = models.GetPrinterState(client, printer.ID); state.Temperatures["nozzle"].Actual != 216 {
+		t.Errorf("temperature written after 20 s: %v", state.Temperatures["nozzle"])
+	}
+	if resolved := alertsOf(t, client, models.AlertResolved); len(resolved) != 1 || resolved[0].ResolvedAt == nil || !resolved[0].ResolvedAt.Equal(start.Add(20*time.Second)) {
+		t.Errorf("resolved alerts %+v, want the overheat", resolved)
+	}
+	if samples := couch.OfType(models.TelemetrySampleDocType); len(samples) != 0 {
+		t.Errorf("%d samples before the minute ended", len(samples))
+	}
+
+	ingest(61, "shop/mk4/status", `{"progress":0.5}`)
+	samples, err := models.ListTelemetrySamples(client, printer.ID, start, start.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].Count != 3 || samples[0].Temperatures["nozzle"] != (telemetry.Stats{Min: 214, Max: 240, Avg: 223.3}) {
+		t.Errorf("samples %+v, want the first minute", samples)
+	}
+
+	if err := ingester.Ingest("shop/mk4/status", []byte(`{"state":"melting"}`), start.Add(62*time.Second)); err == nil {
+		t.Error("an unknown state was ingested")
+	}
+
+	// @info A new ingester, as after a restart, carries on from the stored state and alerts
+	ingest(62, "shop/mk4/status", `{"error":"Thermal runaway"}`)
+	restarted := models.NewTelemetryIngester(client, &mqttConfig)
+	if err := restarted.Ingest("shop/mk4/status", []byte(`{"error":""}`), start.Add(70*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ = models.GetPrinterState(client, printer.ID); state.Error != "" || state.Progress != 0.5 {
+		t.Errorf("state after the restart: error %q, progress %v", state.Error, state.Progress)
+	}
+	if open := alertsOf(t, client, models.AlertOpen); len(open) != 0 {
+		t.Errorf("open alerts %+v after the error cleared", open)
+	}
+}
+
+func TestIngestOverMQTT(t *testing.T) {
+	client, _ := newCouch(t)
+	printer := newMQTTPrinter(t, client, "device/+/report")
+	printer, err := models.UpdatePrinter(client, printer.ID, &models.PrinterUpdate{MQTT: &models.PrinterMQTT{Topic: "device/+/report", Format: telemetry.FormatBambu}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := mqtt.NewBroker()
+	broker.Username, broker.Password = "shop", "secret"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve(listener)
+	defer broker.Close()
+	cfg := mqttConfig
+	cfg.Broker, cfg.Username, cfg.Password = "tcp://"+listener.Addr().String(), "shop", "secret"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		models.NewTelemetryIngester(client, &cfg).Run(ctx)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	// @info Retained, so it reaches the ingester whenever it subscribes
+	report := `{"print":{"gcode_state":"RUNNING","mc_percent":12,"nozzle_temper":220,"nozzle_target_temper":220}}`
+	if err := broker.Publish(mqtt.Message{Topic: "device/01S00A1/report", Payload: []byte(report), Retained: true}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, err := models.GetPrinterState(client, printer.ID)
+		if err == nil && state.State == connector.StatePrinting && state.Progress == 0.12 && state.Temperatures["nozzle"].Actual == 220 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("state %+v, %v: the report was not ingested", state, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	publisher, err := mqtt.Dial(cfg.Broker, mqtt.Options{ClientID: "printer", Username: "shop", Password: "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if err := publisher.Publish("device/01S00A1/report", []byte(`{"print":{"gcode_state":"PAUSE","print_error":117473297}}`), false); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		open := alertsOf(t, client, models.AlertOpen)
+		if len(open) == 1 && open[0].Kind == telemetry.AlertFilamentRunout {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("open alerts %+v, want a filament runout", open)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,186 @@
+package models_test
+
+import (
+	"3DQuest/dbdriver"
+	"3DQuest/models"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newUser(t *testing.T, client *dbdriver.CouchDBClient, userType string, email string) *models.User {
+	t.Helper()
+	usr := &models.User{Type: userType, Name: email, EMAIL: email, PSWD_HASH: "$argon2id$test"}
+	if err := models.CreateUser(client, usr); err != nil {
+		t.Fatal(err)
+	}
+	return usr
+}
+
+func TestUniqueEmail(t *testing.T) {
+	client, _ := newCouch(t)
+	alice := newUser(t, client, "user", "Alice@Example.com ")
+	if alice.EMAIL != "alice@example.com" {
+		t.Errorf("email stored as %q", alice.EMAIL)
+	}
+	bob := newUser(t, client, "user", "bob@example.com")
+
+	cases := []struct {
+		name  string
+		email string
+		taken bool
+	}{
+		{"same email", "alice@example.com", true},
+		{"differently written", " ALICE@example.COM", true},
+		{"free email", "carol@example.com", false},
+	}
+	for _, c := range cases {
+		err := models.CreateUser(client, &models.User{Type: "user", Name: "someone", EMAIL: c.email, PSWD_HASH: "$argon2id$test"})
+		if errors.Is(err, models.ErrEmailTaken) != c.taken || (!c.taken && err != nil) {
+			t.Errorf("%s: creating: %v", c.name, err)
+		}
+	}
+
+	email := "alice@example.com"
+	if _, err := models.UpdateUserProfile(client, bob.ID, &models.ProfileUpdate{EMAIL: &email}); !errors.Is(err, models.ErrEmailTaken) {
+		t.Errorf("taking the email of another user: %v", err)
+	}
+	// @info Changing the email frees the old one, keeping the own one is not a change
+	if _, err := models.UpdateUserProfile(client, alice.ID, &models.ProfileUpdate{EMAIL: &email}); err != nil {
+		t.Errorf("keeping the own email: %v", err)
+	}
+	newEmail := "alice@example.org"
+	if usr, err := models.UpdateUserProfile(client, alice.ID, &models.ProfileUpdate{EMAIL: &newEmail}); err != nil || usr.EMAIL != newEmail {
+		t.Fatalf("changing the email: %v", err)
+	}
+	if _, err := models.UpdateUserProfile(client, bob.ID, &models.ProfileUpdate{EMAIL: &email}); err != nil {
+		t.Errorf("taking a freed email: %v", err)
+	}
+	if found, err := models.GetUserByEmail(client, "ALICE@example.org"); err != nil || found == nil || found.ID != alice.ID {
+		t.Errorf("by the new email: %v, %v", found, err)
+	}
+}
+
+func TestUniqueEmailConcurrently(t *testing.T) {
+	client, couch := newCouch(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- models.CreateUser(client, &models.User{Type: "user", Name: fmt.Sprint(i), EMAIL: "alice@example.com", PSWD_HASH: "$argon2id$test"})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, models.ErrEmailTaken):
+			t.Error(err)
+		}
+	}
+	if stored := len(couch.OfType("user")); created != 1 || stored != 1 {
+		t.Errorf("%d users created and %d stored with the same email", created, stored)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	client, _ := newCouch(t)
+	for i := 0; i < 5; i++ {
+		newUser(t, client, "user", fmt.Sprintf("user-%d@example.com", i))
+	}
+	newUser(t, client, "academic", "academic@example.com")
+	admin := newUser(t, client, "admin", "admin@example.com")
+	deleted := newUser(t, client, "user", "gone@example.com")
+	if err := models.DeleteUser(client, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		filter models.UserFilter
+		want   int
+	}{
+		{"everyone", models.UserFilter{}, 7},
+		{"by type", models.UserFilter{Type: "user"}, 5},
+		{"by email", models.UserFilter{EMAIL: "Admin@Example.com"}, 1},
+		{"with the deleted", models.UserFilter{IncludeDeleted: true}, 8},
+		{"deleted by type", models.UserFilter{Type: "user", IncludeDeleted: true}, 6},
+		{"type without users", models.UserFilter{Type: "operator"}, 0},
+	}
+	for _, c := range cases {
+		// @info Two at a time, following the bookmarks
+		seen := map[string]bool{}
+		bookmark := ""
+		for page := 0; page < 10; page++ {
+			users, next, err := models.ListUsers(client, &c.filter, 2, bookmark)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if len(users) > 2 {
+				t.Errorf("%s: page of %d users", c.name, len(users))
+			}
+			for _, usr := range users {
+				if seen[usr.ID] {
+					t.Errorf("%s: %s listed twice", c.name, usr.EMAIL)
+				}
+				seen[usr.ID] = true
+			}
+			if len(users) < 2 {
+				break
+			}
+			bookmark = next
+		}
+		if len(seen) != c.want {
+			t.Errorf("%s: %d users, want %d", c.name, len(seen), c.want)
+		}
+	}
+	if users, _, _ := models.ListUsers(client, &models.UserFilter{Type: "admin"}, 0, ""); len(users) != 1 || users[0].ID != admin.ID {
+		t.Errorf("admins %+v", users)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	client, _ := newCouch(t)
+	alice := newUser(t, client, "user", "alice@example.com")
+	if err := models.DeleteUser(client, alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	// @info The document stays, orders and invoices point to it
+	usr, err := models.GetUser(client, alice.ID)
+	if err != nil || !usr.IsDeleted() {
+		t.Fatalf("deleted user %+v: %v", usr, err)
+	}
+	name := "Alice"
+	_, updateErr := models.UpdateUserProfile(client, alice.ID, &models.ProfileUpdate{Name: &name})
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{"deleting again", models.DeleteUser(client, alice.ID)},
+		{"updating", updateErr},
+		{"deleting someone missing", models.DeleteUser(client, "nobody")},
+	}
+	for _, c := range cases {
+		if !dbdriver.IsNotFound(c.err) {
+			t.Errorf("%s: error %v, want not found", c.name, c.err)
+		}
+	}
+	if err := models.CreateUser(client, &models.User{Type: "user", Name: "Alice", EMAIL: "alice@example.com", PSWD_HASH: "$argon2id$test"}); !errors.Is(err, models.ErrEmailTaken) {
+		t.Errorf("email of a deleted user reused: %v", err)
+	}
+
+	// @info Documents of other types are not users
+	product := newProduct(t, client, 1)
+	if _, err := models.GetUser(client, product.ID); !dbdriver.IsNotFound(err) {
+		t.Errorf("product read as a user: %v", err)
+	}
+	if err := models.DeleteUser(client, product.ID); !dbdriver.IsNotFound(err) {
+		t.Errorf("product deleted as a user: %v", err)
+	}
+}
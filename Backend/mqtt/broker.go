@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/rs/zerolog"
+)
+
+// @info An MQTT broker (Mochi MQTT) for printers on the local network and for tests. Retained messages are kept in
+// memory; there are no persistent sessions.
+type Broker struct {
+	Username string // Required from clients if not empty
+	Password string
+
+	server    *mochi.Server
+	mu        sync.Mutex
+	listeners int
+	started   bool
+	closed    bool
+	done      chan struct{}
+}
+
+func NewBroker() *Broker {
+	// @info Mochi logs every connection; only its errors are of interest here
+	logger := zerolog.New(os.Stderr).Level(zerolog.ErrorLevel)
+	capabilities := *mochi.DefaultServerCapabilities
+	capabilities.MaximumPacketSize = MaxPacketBytes
+	b := &Broker{
+		server: mochi.New(&mochi.Options{Capabilities: &capabilities, Logger: &logger}),
+		done:   make(chan struct{}),
+	}
+	b.server.AddHook(&authHook{broker: b}, nil)
+	return b
+}
+
+// @info Listens on addr, e.g. ":1883", and serves clients until Close
+func (b *Broker) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(listener)
+}
+
+// @info Serves clients accepted on listener until Close. Returns nil once closed.
+func (b *Broker) Serve(listener net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	b.listeners++
+	l := &netListener{id: fmt.Sprintf("listener-%d", b.listeners), listener: listener, stopped: make(chan error, 1)}
+	if err := b.server.AddListener(l); err != nil {
+		b.mu.Unlock()
+		listener.Close()
+		return err
+	}
+	if b.started {
+		b.server.Listeners.Serve(l.id, b.server.EstablishConnection)
+	} else if err := b.server.Serve(); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.started = true
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case err := <-l.stopped:
+		select {
+		case <-b.done:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// @info Stops listening and disconnects every client
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	return b.server.Close()
+}
+
+// @info Publishes a message from the broker itself, as if a client had
+func (b *Broker) Publish(msg Message) error {
+	return b.server.Publish(msg.Topic, msg.Payload, msg.Retained, 0)
+}
+
+// @info Lets in the clients with the broker's user name and password, or everyone if it has none
+type authHook struct {
+	mochi.HookBase
+	broker *Broker
+}
+
+func (h *authHook) ID() string {
+	return "3dquest-auth"
+}
+
+func (h *authHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{mochi.OnConnectAuthenticate, mochi.OnACLCheck}, []byte{b})
+}
+
+func (h *authHook) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	if h.broker.Username == "" {
+		return true
+	}
+	// @info Both are always compared, in constant time, so that the time taken does not tell how much was right
+	username := subtle.ConstantTimeCompare(pk.Connect.Username, []byte(h.broker.Username))
+	password := subtle.ConstantTimeCompare(pk.Connect.Password, []byte(h.broker.Password))
+	return username&password == 1
+}
+
+func (h *authHook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	return true
+}
+
+// @info Serves the connections of a listener opened by the caller, which Mochi's own TCP listener cannot take
+type netListener struct {
+	id       string
+	listener net.Listener
+	stopped  chan error // Receives why Accept failed
+}
+
+func (l *netListener) ID() string {
+	return l.id
+}
+
+func (l *netListener) Address() string {
+	return l.listener.Addr().String()
+}
+
+func (l *netListener) Protocol() string {
+	return "tcp"
+}
+
+func (l *netListener) Init(*zerolog.Logger) error {
+	return nil
+}
+
+func (l *netListener) Serve(establish listeners.EstablishFn) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.stopped <- err
+			return
+		}
+		go establish(l.id, conn)
+	}
+}
+
+func (l *netListener) Close(closeClients listeners.CloseFn) {
+	l.listener.Close()
+	closeClients(l.id)
+}
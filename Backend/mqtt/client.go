@@ -0,0 +1,213 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	str "strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+type Options struct {
+	ClientID    string
+	Username    string // Sent only if not empty
+	Password    string
+	KeepAlive   time.Duration // 60s if zero
+	DialTimeout time.Duration // Also the time to wait for the broker's acknowledgements. 10s if zero
+}
+
+var ErrClosed = errors.New("The MQTT connection is closed")
+
+// @info Returned when the broker refuses the connection
+type ConnectError struct {
+	Code byte
+}
+
+func (e *ConnectError) Error() string {
+	reasons := map[byte]string{1: "unacceptable protocol version", 2: "client identifier rejected", 3: "server unavailable", 4: "bad user name or password", 5: "not authorised"}
+	if reason, ok := reasons[e.Code]; ok {
+		return "The MQTT broker refused the connection: " + reason
+	}
+	return fmt.Sprintf("The MQTT broker refused the connection with code %d", e.Code)
+}
+
+// @info An MQTT 3.1.1 client (Eclipse Paho) subscribing and publishing at QoS 0, enough to follow telemetry. It
+// does not reconnect: wait on Done and dial again.
+type Client struct {
+	client paho.Client
+	opts   Options
+
+	mu   sync.Mutex
+	done chan struct{}
+	err  error
+}
+
+// @info Connects to a broker at tcp://host:port, mqtt://, ssl://, tls:// or mqtts:// (1883 and 8883 by default), or a
+// bare host:port. Messages of the subscriptions are passed to handler one at a time, in the order they arrive.
+func Dial(broker string, opts Options, handler func(Message)) (*Client, error) {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = time.Minute
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 10 * time.Second
+	}
+	server, err := brokerURL(broker)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{opts: opts, done: make(chan struct{})}
+	options := paho.NewClientOptions().
+		AddBroker(server).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetProtocolVersion(4).
+		SetCleanSession(true). // @info Subscriptions are made again on every connection
+		SetKeepAlive(opts.KeepAlive).
+		SetPingTimeout(opts.DialTimeout).
+		SetConnectTimeout(opts.DialTimeout).
+		SetWriteTimeout(opts.DialTimeout).
+		SetAutoReconnect(false).
+		SetOrderMatters(true).
+		SetConnectionLostHandler(func(_ paho.Client, err error) { c.fail(err) })
+	if handler != nil {
+		options.SetDefaultPublishHandler(func(_ paho.Client, msg paho.Message) {
+			handler(Message{Topic: msg.Topic(), Payload: msg.Payload(), Retained: msg.Retained()})
+		})
+	}
+	c.client = paho.NewClient(options)
+	token := c.client.Connect()
+	if !token.WaitTimeout(opts.DialTimeout + time.Second) {
+		c.client.Disconnect(0)
+		return nil, errors.New("The MQTT broker did not answer in time")
+	}
+	if err := token.Error(); err != nil {
+		return nil, connectError(err)
+	}
+	return c, nil
+}
+
+func brokerURL(broker string) (string, error) {
+	scheme, host := "tcp", broker
+	if u, err := url.Parse(broker); err == nil && u.Host != "" {
+		scheme, host = u.Scheme, u.Host
+	}
+	secure := scheme == "ssl" || scheme == "tls" || scheme == "mqtts"
+	if scheme != "tcp" && scheme != "mqtt" && !secure {
+		return "", fmt.Errorf("Unsupported MQTT scheme '%s'", scheme)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if secure {
+			host = net.JoinHostPort(host, "8883")
+		} else {
+			host = net.JoinHostPort(host, "1883")
+		}
+	}
+	if secure {
+		return "ssl://" + host, nil
+	}
+	return "tcp://" + host, nil
+}
+
+// @info Paho reports a refusal with the errors of its packets package, network errors come prefixed with one of them
+func connectError(err error) error {
+	for code, refusal := range packets.ConnErrors {
+		if code == packets.Accepted || code == packets.ErrNetworkError {
+			continue
+		}
+		if err == refusal {
+			return &ConnectError{Code: code}
+		}
+	}
+	message := err.Error()
+	if prefix := packets.ConnErrors[packets.ErrNetworkError].Error() + " : "; str.HasPrefix(message, prefix) {
+		return errors.New(str.TrimPrefix(message, prefix))
+	}
+	return err
+}
+
+// @info Subscribes to the topic filters at QoS 0 and waits for the broker to acknowledge them
+func (c *Client) Subscribe(filters ...string) error {
+	qos := map[string]byte{}
+	for _, filter := range filters {
+		if !ValidFilter(filter) {
+			return fmt.Errorf("Invalid MQTT topic filter '%s'", filter)
+		}
+		qos[filter] = 0
+	}
+	token := c.client.SubscribeMultiple(qos, nil)
+	if err := c.wait(token); err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		if code, ok := token.(*paho.SubscribeToken).Result()[filter]; ok && code == 0x80 {
+			return fmt.Errorf("The MQTT broker refused the subscription to '%s'", filter)
+		}
+	}
+	return nil
+}
+
+func (c *Client) Unsubscribe(filters ...string) error {
+	return c.wait(c.client.Unsubscribe(filters...))
+}
+
+// @info Publishes at QoS 0
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	return c.wait(c.client.Publish(topic, 0, retain, payload))
+}
+
+// @info Disconnects cleanly
+func (c *Client) Close() error {
+	if c.Err() == nil {
+		c.client.Disconnect(250)
+	}
+	c.fail(ErrClosed)
+	return nil
+}
+
+// @info Closed when the connection is lost or closed, Err tells why
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// @info Waits for the broker to acknowledge, or for the connection to drop
+func (c *Client) wait(token paho.Token) error {
+	timer := time.NewTimer(c.opts.DialTimeout)
+	defer timer.Stop()
+	select {
+	case <-token.Done():
+		if err := c.Err(); err != nil && token.Error() != nil {
+			return err
+		}
+		return token.Error()
+	case <-c.done:
+		return c.Err()
+	case <-timer.C:
+		return errors.New("The MQTT broker did not acknowledge in time")
+	}
+}
+
+// @info Records the first error and closes Done
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+}
@@ -0,0 +1,155 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func startBroker(t *testing.T, broker *Broker) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve(listener)
+	t.Cleanup(func() { broker.Close() })
+	return "tcp://" + listener.Addr().String()
+}
+
+func receive(t *testing.T, messages chan Message) Message {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+	}
+	return Message{}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	addr := startBroker(t, NewBroker())
+	messages := make(chan Message, 10)
+	sub, err := Dial(addr, Options{ClientID: "sub"}, func(msg Message) { messages <- msg })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	pub, err := Dial(addr, Options{ClientID: "pub"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	if err := pub.Publish("printers/mk4/status", []byte(`{"state":"idle"}`), true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // @info Publishes are not acknowledged at QoS 0
+	if err := sub.Subscribe("printers/+/status", "printers/mk4/#"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, messages); msg.Topic != "printers/mk4/status" || !msg.Retained || string(msg.Payload) != `{"state":"idle"}` {
+		t.Fatalf("retained message = %+v", msg)
+	}
+	// @info The retained message is sent again for the second filter it matches
+	if msg := receive(t, messages); msg.Topic != "printers/mk4/status" || !msg.Retained {
+		t.Fatalf("retained message for the second filter = %+v", msg)
+	}
+
+	pub.Publish("printers/mk4/status", []byte("printing"), false)
+	pub.Publish("other/topic", []byte("ignored"), false)
+	pub.Publish("printers/mk4/temperature/bed", []byte("60"), false)
+	if msg := receive(t, messages); msg.Topic != "printers/mk4/status" || msg.Retained || string(msg.Payload) != "printing" {
+		t.Fatalf("first message = %+v", msg)
+	}
+	if msg := receive(t, messages); msg.Topic != "printers/mk4/temperature/bed" {
+		t.Fatalf("second message = %+v", msg)
+	}
+
+	if err := sub.Unsubscribe("printers/mk4/#"); err != nil {
+		t.Fatal(err)
+	}
+	pub.Publish("printers/mk4/temperature/bed", []byte("61"), false)
+	pub.Publish("printers/mini/status", []byte("idle"), false)
+	if msg := receive(t, messages); msg.Topic != "printers/mini/status" {
+		t.Fatalf("message after unsubscribing = %+v", msg)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	broker := NewBroker()
+	broker.Username, broker.Password = "shop", "secret"
+	addr := startBroker(t, broker)
+
+	_, err := Dial(addr, Options{ClientID: "anon"}, nil)
+	var connectErr *ConnectError
+	// @info MQTT 3.1.1 clients are told they are not authorised (5) rather than that the password was wrong (4)
+	if !errors.As(err, &connectErr) || connectErr.Code != 5 {
+		t.Fatalf("anonymous connection = %v, want a refusal with code 5", err)
+	}
+	for _, password := range []string{"secreT", "secret2", ""} {
+		if _, err := Dial(addr, Options{ClientID: "shop", Username: "shop", Password: password}, nil); !errors.As(err, &connectErr) {
+			t.Fatalf("connection with the password %q = %v, want a refusal", password, err)
+		}
+	}
+	client, err := Dial(addr, Options{ClientID: "shop", Username: "shop", Password: "secret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed after Close")
+	}
+	if err := client.Publish("a", nil, false); !errors.Is(err, ErrClosed) {
+		t.Fatalf("publish after close = %v, want ErrClosed", err)
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	broker := NewBroker()
+	addr := startBroker(t, broker)
+	client, err := Dial(addr, Options{ClientID: "c"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("the client did not notice the broker closing")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/+/c", "a/x/c", true},
+		{"a/+/c", "a/x/y/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+", "a", true},
+		{"+/+", "a", false},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+		{"a/+", "a/", true},
+	}
+	for _, c := range cases {
+		if got := Match(c.filter, c.topic); got != c.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.filter, c.topic, got, c.want)
+		}
+	}
+	for filter, want := range map[string]bool{"a/#": true, "a/#/b": false, "a+": false, "+/b": true, "": false} {
+		if got := ValidFilter(filter); got != want {
+			t.Errorf("ValidFilter(%q) = %v, want %v", filter, got, want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	str "strings"
+)
+
+// @info Largest packet the broker accepts. Telemetry payloads are a few kilobytes.
+const MaxPacketBytes = 1 << 20
+
+// @info A message published on a topic
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool // Sent when subscribing, it was the last one published on the topic with the retain flag
+}
+
+// @info Whether topic matches filter, where + stands for one level and a trailing # for any number of them. Topics
+// starting with $ are only matched by filters starting with $.
+func Match(filter string, topic string) bool {
+	if str.HasPrefix(topic, "$") != str.HasPrefix(filter, "$") {
+		return false
+	}
+	filterLevels := str.Split(filter, "/")
+	topicLevels := str.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// @info Whether filter is a valid subscription: wildcards take a whole level and # only the last one
+func ValidFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := str.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+		if len(level) > 1 && str.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
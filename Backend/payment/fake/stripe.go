@@ -0,0 +1,378 @@
+package fake
+
+import (
+	"3DQuest/payment"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	str "strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoIntent   = errors.New("No such payment intent")
+	errNoEvent    = errors.New("No such event")
+	errUnexpected = errors.New("The payment intent is not in a state that allows it")
+)
+
+type intent struct {
+	ID               string            `json:"id"`
+	Object           string            `json:"object"`
+	Amount           int64             `json:"amount"`
+	AmountCapturable int64             `json:"amount_capturable"`
+	AmountReceived   int64             `json:"amount_received"`
+	Currency         string            `json:"currency"`
+	Status           string            `json:"status"`
+	CaptureMethod    string            `json:"capture_method"`
+	ClientSecret     string            `json:"client_secret"`
+	Description      string            `json:"description,omitempty"`
+	Metadata         map[string]string `json:"metadata"`
+	LastPaymentError *paymentError     `json:"last_payment_error"`
+	refunded         int64
+}
+
+type paymentError struct {
+	Message string `json:"message"`
+}
+
+type refund struct {
+	ID            string `json:"id"`
+	Object        string `json:"object"`
+	Amount        int64  `json:"amount"`
+	PaymentIntent string `json:"payment_intent"`
+	Status        string `json:"status"`
+}
+
+type charge struct {
+	ID             string            `json:"id"`
+	Object         string            `json:"object"`
+	Amount         int64             `json:"amount"`
+	AmountCaptured int64             `json:"amount_captured"`
+	AmountRefunded int64             `json:"amount_refunded"`
+	Currency       string            `json:"currency"`
+	PaymentIntent  string            `json:"payment_intent"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+type event struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object interface{} `json:"object"`
+	} `json:"data"`
+}
+
+// @info A stand-in for Stripe with the part of its API the payment package uses. Customers pay with Pay, and every
+// change of an intent is recorded as a signed event, also sent to the webhook URL if there is one.
+type Stripe struct {
+	mu            sync.Mutex
+	secretKey     string
+	webhookSecret string
+	webhookURL    string
+	intents       map[string]*intent
+	keys          map[string][]byte // Idempotency key => answer given
+	events        map[string][]byte // Event ID => payload
+	order         []string          // Event IDs, oldest first
+	next          int
+	mux           *http.ServeMux
+}
+
+// @info Requests must carry secretKey as a bearer token. Events are signed with webhookSecret and sent to webhookURL
+// unless it is empty.
+func NewStripe(secretKey string, webhookSecret string, webhookURL string) *Stripe {
+	s := &Stripe{
+		secretKey:     secretKey,
+		webhookSecret: webhookSecret,
+		webhookURL:    webhookURL,
+		intents:       map[string]*intent{},
+		keys:          map[string][]byte{},
+		events:        map[string][]byte{},
+		mux:           http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/payment_intents", s.createIntent)
+	s.mux.HandleFunc("/v1/payment_intents/", s.intent)
+	s.mux.HandleFunc("/v1/refunds", s.refund)
+	return s
+}
+
+func (s *Stripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+s.secretKey {
+		writeError(w, http.StatusUnauthorized, "", "Invalid API Key provided")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// @info The customer pays the intent. Intents captured by hand are only authorized.
+func (s *Stripe) Pay(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pi, ok := s.intents[id]
+	if !ok {
+		return errNoIntent
+	}
+	if pi.Status != string(payment.IntentRequiresPayment) {
+		return errUnexpected
+	}
+	pi.LastPaymentError = nil
+	if pi.CaptureMethod == "manual" {
+		pi.Status, pi.AmountCapturable = string(payment.IntentRequiresCapture), pi.Amount
+		s.emit(payment.EventAuthorized, pi.snapshot())
+		return nil
+	}
+	pi.Status, pi.AmountReceived = string(payment.IntentSucceeded), pi.Amount
+	s.emit(payment.EventSucceeded, pi.snapshot())
+	return nil
+}
+
+// @info The card of the customer is declined with message. The intent keeps waiting for a payment.
+func (s *Stripe) Decline(id string, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pi, ok := s.intents[id]
+	if !ok {
+		return errNoIntent
+	}
+	if pi.Status != string(payment.IntentRequiresPayment) {
+		return errUnexpected
+	}
+	pi.LastPaymentError = &paymentError{Message: message}
+	s.emit(payment.EventFailed, pi.snapshot())
+	return nil
+}
+
+// @info Sends an event again, as Stripe does when a webhook does not answer 2xx
+func (s *Stripe) Redeliver(eventID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload, ok := s.events[eventID]
+	if !ok {
+		return errNoEvent
+	}
+	s.deliver(payload)
+	return nil
+}
+
+// @info Payloads of every event, oldest first
+func (s *Stripe) Events() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := [][]byte{}
+	for _, id := range s.order {
+		events = append(events, s.events[id])
+	}
+	return events
+}
+
+// @info Signs a payload as the webhooks are
+func (s *Stripe) Sign(payload []byte) string {
+	return payment.SignStripe(payload, s.webhookSecret, time.Now())
+}
+
+func (s *Stripe) createIntent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "", "Method not allowed")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replay(w, r) {
+		return
+	}
+	amount, err := strconv.ParseInt(r.PostFormValue("amount"), 10, 64)
+	if err != nil || amount < 1 {
+		writeError(w, http.StatusBadRequest, "amount_too_small", "Amount must be at least 1 cent")
+		return
+	}
+	if r.PostFormValue("currency") == "" {
+		writeError(w, http.StatusBadRequest, "parameter_missing", "Missing required param: currency")
+		return
+	}
+	s.next++
+	pi := &intent{
+		ID:            fmt.Sprintf("pi_fake%d", s.next),
+		Object:        "payment_intent",
+		Amount:        amount,
+		Currency:      r.PostFormValue("currency"),
+		Status:        string(payment.IntentRequiresPayment),
+		CaptureMethod: "automatic",
+		Description:   r.PostFormValue("description"),
+		Metadata:      map[string]string{},
+	}
+	pi.ClientSecret = pi.ID + "_secret_fake"
+	if r.PostFormValue("capture_method") == "manual" {
+		pi.CaptureMethod = "manual"
+	}
+	for key, values := range r.PostForm {
+		if str.HasPrefix(key, "metadata[") && str.HasSuffix(key, "]") {
+			pi.Metadata[key[len("metadata["):len(key)-1]] = values[0]
+		}
+	}
+	s.intents[pi.ID] = pi
+	s.answer(w, r, pi.snapshot())
+}
+
+// @info GET /v1/payment_intents/{id} and POST /v1/payment_intents/{id}/capture
+func (s *Stripe) intent(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := str.Cut(str.TrimPrefix(r.URL.Path, "/v1/payment_intents/"), "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pi, ok := s.intents[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "resource_missing", errNoIntent.Error())
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, pi.snapshot())
+	case action == "capture" && r.Method == http.MethodPost:
+		if pi.Status != string(payment.IntentRequiresCapture) {
+			writeError(w, http.StatusBadRequest, "payment_intent_unexpected_state", errUnexpected.Error())
+			return
+		}
+		amount := pi.AmountCapturable
+		if raw := r.PostFormValue("amount_to_capture"); raw != "" {
+			if amount, _ = strconv.ParseInt(raw, 10, 64); amount < 1 || amount > pi.AmountCapturable {
+				writeError(w, http.StatusBadRequest, "amount_too_large", "The amount to capture is larger than what was authorized")
+				return
+			}
+		}
+		pi.Status, pi.AmountCapturable, pi.AmountReceived = string(payment.IntentSucceeded), 0, amount
+		s.emit(payment.EventSucceeded, pi.snapshot())
+		writeJSON(w, http.StatusOK, pi.snapshot())
+	default:
+		writeError(w, http.StatusNotFound, "", "Unrecognized request URL")
+	}
+}
+
+func (s *Stripe) refund(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "", "Method not allowed")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replay(w, r) {
+		return
+	}
+	pi, ok := s.intents[r.PostFormValue("payment_intent")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "resource_missing", errNoIntent.Error())
+		return
+	}
+	left := pi.AmountReceived - pi.refunded
+	if pi.Status != string(payment.IntentSucceeded) || left == 0 {
+		writeError(w, http.StatusBadRequest, "charge_already_refunded", "There is nothing left to refund")
+		return
+	}
+	amount := left
+	if raw := r.PostFormValue("amount"); raw != "" {
+		if amount, _ = strconv.ParseInt(raw, 10, 64); amount < 1 || amount > left {
+			writeError(w, http.StatusBadRequest, "amount_too_large", fmt.Sprintf("Refund amount is greater than the %d left to refund", left))
+			return
+		}
+	}
+	pi.refunded += amount
+	s.next++
+	re := &refund{ID: fmt.Sprintf("re_fake%d", s.next), Object: "refund", Amount: amount, PaymentIntent: pi.ID, Status: "succeeded"}
+	s.emit(payment.EventRefunded, &charge{
+		ID:             "ch_" + str.TrimPrefix(pi.ID, "pi_"),
+		Object:         "charge",
+		Amount:         pi.Amount,
+		AmountCaptured: pi.AmountReceived,
+		AmountRefunded: pi.refunded,
+		Currency:       pi.Currency,
+		PaymentIntent:  pi.ID,
+		Metadata:       pi.Metadata,
+	})
+	s.answer(w, r, re)
+}
+
+func (i *intent) snapshot() *intent {
+	copied := *i
+	copied.Metadata = map[string]string{}
+	for key, value := range i.Metadata {
+		copied.Metadata[key] = value
+	}
+	return &copied
+}
+
+// @info Answers again what was answered to a request with the same Idempotency-Key
+func (s *Stripe) replay(w http.ResponseWriter, r *http.Request) bool {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return false
+	}
+	body, ok := s.keys[r.URL.Path+" "+key]
+	if ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Write(body)
+	}
+	return ok
+}
+
+func (s *Stripe) answer(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, _ := json.Marshal(v)
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		s.keys[r.URL.Path+" "+key] = body
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// @info Records an event and sends it. Called with the lock held.
+func (s *Stripe) emit(eventType payment.EventType, object interface{}) {
+	s.next++
+	e := &event{ID: fmt.Sprintf("evt_fake%d", s.next), Object: "event", Type: string(eventType), Created: time.Now().Unix()}
+	e.Data.Object = object
+	payload, _ := json.Marshal(e)
+	s.events[e.ID] = payload
+	s.order = append(s.order, e.ID)
+	s.deliver(payload)
+}
+
+// @info Posts the event to the webhook in the background, as Stripe does after answering the request
+func (s *Stripe) deliver(payload []byte) {
+	if s.webhookURL == "" {
+		return
+	}
+	signature := s.Sign(payload)
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, s.webhookURL, bytes.NewReader(payload))
+		if err != nil {
+			log.Println("Couldn't send the webhook:", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Stripe-Signature", signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Println("Couldn't send the webhook:", err)
+			return
+		}
+		resp.Body.Close()
+		log.Printf("Webhook answered %d", resp.StatusCode)
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	failure := map[string]interface{}{"type": "invalid_request_error", "message": message}
+	if code != "" {
+		failure["code"] = code
+	}
+	writeJSON(w, status, map[string]interface{}{"error": failure})
+}
@@ -0,0 +1,122 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	str "strings"
+	"time"
+)
+
+type Kind string
+
+const KindStripe Kind = "stripe" // Stripe, or any server speaking the same API
+
+// @info Where a payment intent is, with the names Stripe gives them
+type IntentStatus string
+
+const (
+	IntentRequiresPayment IntentStatus = "requires_payment_method" // Waiting for the customer to pay
+	IntentProcessing      IntentStatus = "processing"
+	IntentRequiresCapture IntentStatus = "requires_capture" // Authorized, the money is taken when it is captured
+	IntentSucceeded       IntentStatus = "succeeded"
+	IntentCanceled        IntentStatus = "canceled"
+)
+
+// @info An amount the customer is asked to pay
+type Intent struct {
+	ID            string            `json:"id"`
+	AmountCents   int64             `json:"amount_cents"`
+	CapturedCents int64             `json:"captured_cents"` // Taken from the customer so far
+	Currency      string            `json:"currency"`
+	Status        IntentStatus      `json:"status"`
+	ClientSecret  string            `json:"-"` // Lets the frontend complete the payment, only told to the customer
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+type IntentRequest struct {
+	AmountCents    int64
+	Currency       string
+	Description    string
+	ManualCapture  bool              // Only authorize the amount, see Provider.Capture
+	Metadata       map[string]string // Sent back in the events of the intent
+	IdempotencyKey string            // Requests with the same key create the intent once
+}
+
+type Refund struct {
+	ID          string `json:"id"`
+	IntentID    string `json:"intent_id"`
+	AmountCents int64  `json:"amount_cents"`
+	Status      string `json:"status"`
+}
+
+type EventType string
+
+const (
+	EventAuthorized EventType = "payment_intent.amount_capturable_updated" // The intent can be captured
+	EventSucceeded  EventType = "payment_intent.succeeded"
+	EventFailed     EventType = "payment_intent.payment_failed" // The customer may try again
+	EventCanceled   EventType = "payment_intent.canceled"
+	EventRefunded   EventType = "charge.refunded" // A refund of the intent, full or partial
+)
+
+// @info A notification of the provider about an intent. Providers send the same event more than once, and not always
+// in order.
+type Event struct {
+	ID             string            `json:"id"`
+	Type           EventType         `json:"type"`
+	IntentID       string            `json:"intent_id"`
+	AmountCents    int64             `json:"amount_cents"`
+	CapturedCents  int64             `json:"captured_cents"`
+	RefundedCents  int64             `json:"refunded_cents"` // Refunded so far, only in EventRefunded
+	Currency       string            `json:"currency"`
+	FailureMessage string            `json:"failure_message,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Created        time.Time         `json:"created"`
+}
+
+// @info Takes card payments through an external provider. Every call honours the context's deadline.
+type Provider interface {
+	Kind() Kind
+	CreateIntent(ctx context.Context, req *IntentRequest) (*Intent, error)
+	// @info Takes an authorized amount, all of it if amountCents is 0
+	Capture(ctx context.Context, intentID string, amountCents int64) (*Intent, error)
+	// @info Gives back part of what was captured, all of it if amountCents is 0
+	Refund(ctx context.Context, intentID string, amountCents int64, idempotencyKey string) (*Refund, error)
+	// @info Checks the signature of a webhook request and reads its event
+	// @error ErrSignature if it was not sent by the provider
+	ParseWebhook(payload []byte, header http.Header) (*Event, error)
+}
+
+var (
+	ErrUnknownKind = errors.New("Unknown payment provider")
+	ErrSignature   = errors.New("Invalid webhook signature")
+)
+
+// @info Returned when the provider answers with an error, e.g. a refund larger than the payment
+type ProviderError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ProviderError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("The payment provider answered %d (%s): %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("The payment provider answered %d: %s", e.StatusCode, e.Message)
+}
+
+// @info Provider at apiURL, authenticated with secretKey. Webhooks must be signed with webhookSecret.
+func New(kind Kind, apiURL string, secretKey string, webhookSecret string) (Provider, error) {
+	apiURL = str.TrimRight(apiURL, "/")
+	if !str.HasPrefix(apiURL, "http://") && !str.HasPrefix(apiURL, "https://") {
+		return nil, fmt.Errorf("The payment API URL must start with http:// or https://, got '%s'", apiURL)
+	}
+	switch kind {
+	case KindStripe:
+		return NewStripe(apiURL, secretKey, webhookSecret), nil
+	}
+	return nil, fmt.Errorf("%w: '%s'", ErrUnknownKind, kind)
+}
@@ -0,0 +1,251 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	str "strings"
+	"time"
+)
+
+// @info Webhooks signed longer ago than this are refused, so a captured request can't be replayed later
+const StripeSignatureTolerance = 5 * time.Minute
+
+// @info Stripe's API, https://stripe.com/docs/api. Only payment intents, refunds and their webhooks.
+type Stripe struct {
+	apiURL        string
+	secretKey     string
+	webhookSecret string
+}
+
+func NewStripe(apiURL string, secretKey string, webhookSecret string) *Stripe {
+	return &Stripe{apiURL: apiURL, secretKey: secretKey, webhookSecret: webhookSecret}
+}
+
+func (s *Stripe) Kind() Kind {
+	return KindStripe
+}
+
+// @info A PaymentIntent as Stripe sends it
+type stripeIntent struct {
+	ID               string            `json:"id"`
+	Amount           int64             `json:"amount"`
+	AmountReceived   int64             `json:"amount_received"`
+	Currency         string            `json:"currency"`
+	Status           IntentStatus      `json:"status"`
+	ClientSecret     string            `json:"client_secret"`
+	Metadata         map[string]string `json:"metadata"`
+	LastPaymentError *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+}
+
+func (i *stripeIntent) intent() *Intent {
+	return &Intent{
+		ID:            i.ID,
+		AmountCents:   i.Amount,
+		CapturedCents: i.AmountReceived,
+		Currency:      i.Currency,
+		Status:        i.Status,
+		ClientSecret:  i.ClientSecret,
+		Metadata:      i.Metadata,
+	}
+}
+
+// @info A Charge as Stripe sends it, only in refund events
+type stripeCharge struct {
+	Amount         int64             `json:"amount"`
+	AmountCaptured int64             `json:"amount_captured"`
+	AmountRefunded int64             `json:"amount_refunded"`
+	Currency       string            `json:"currency"`
+	PaymentIntent  string            `json:"payment_intent"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+type stripeRefund struct {
+	ID            string `json:"id"`
+	Amount        int64  `json:"amount"`
+	PaymentIntent string `json:"payment_intent"`
+	Status        string `json:"status"`
+}
+
+type stripeEvent struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Created int64  `json:"created"`
+	Data    struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type stripeError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// @info POST /v1/payment_intents
+func (s *Stripe) CreateIntent(ctx context.Context, req *IntentRequest) (*Intent, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(req.AmountCents, 10))
+	form.Set("currency", str.ToLower(req.Currency))
+	form.Set("automatic_payment_methods[enabled]", "true")
+	if req.Description != "" {
+		form.Set("description", req.Description)
+	}
+	if req.ManualCapture {
+		form.Set("capture_method", "manual")
+	}
+	for key, value := range req.Metadata {
+		form.Set("metadata["+key+"]", value)
+	}
+	intent := &stripeIntent{}
+	if err := s.post(ctx, "/v1/payment_intents", form, req.IdempotencyKey, intent); err != nil {
+		return nil, err
+	}
+	return intent.intent(), nil
+}
+
+// @info POST /v1/payment_intents/{id}/capture
+func (s *Stripe) Capture(ctx context.Context, intentID string, amountCents int64) (*Intent, error) {
+	form := url.Values{}
+	if amountCents > 0 {
+		form.Set("amount_to_capture", strconv.FormatInt(amountCents, 10))
+	}
+	intent := &stripeIntent{}
+	if err := s.post(ctx, "/v1/payment_intents/"+url.PathEscape(intentID)+"/capture", form, "", intent); err != nil {
+		return nil, err
+	}
+	return intent.intent(), nil
+}
+
+// @info POST /v1/refunds
+func (s *Stripe) Refund(ctx context.Context, intentID string, amountCents int64, idempotencyKey string) (*Refund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", intentID)
+	if amountCents > 0 {
+		form.Set("amount", strconv.FormatInt(amountCents, 10))
+	}
+	refund := &stripeRefund{}
+	if err := s.post(ctx, "/v1/refunds", form, idempotencyKey, refund); err != nil {
+		return nil, err
+	}
+	return &Refund{ID: refund.ID, IntentID: refund.PaymentIntent, AmountCents: refund.Amount, Status: refund.Status}, nil
+}
+
+// @info Checks the Stripe-Signature header, https://stripe.com/docs/webhooks#verify-manually, and reads the event.
+// Events of other types are returned with only their ID and type.
+func (s *Stripe) ParseWebhook(payload []byte, header http.Header) (*Event, error) {
+	if err := VerifyStripeSignature(payload, header.Get("Stripe-Signature"), s.webhookSecret, time.Now()); err != nil {
+		return nil, err
+	}
+	raw := &stripeEvent{}
+	if err := json.Unmarshal(payload, raw); err != nil {
+		return nil, fmt.Errorf("The webhook is not a Stripe event: %w", err)
+	}
+	event := &Event{ID: raw.ID, Type: EventType(raw.Type), Created: time.Unix(raw.Created, 0).UTC()}
+	switch event.Type {
+	case EventAuthorized, EventSucceeded, EventFailed, EventCanceled:
+		intent := &stripeIntent{}
+		if err := json.Unmarshal(raw.Data.Object, intent); err != nil {
+			return nil, fmt.Errorf("The webhook does not hold a payment intent: %w", err)
+		}
+		event.IntentID, event.AmountCents, event.CapturedCents = intent.ID, intent.Amount, intent.AmountReceived
+		event.Currency, event.Metadata = intent.Currency, intent.Metadata
+		if intent.LastPaymentError != nil {
+			event.FailureMessage = intent.LastPaymentError.Message
+		}
+	case EventRefunded:
+		charge := &stripeCharge{}
+		if err := json.Unmarshal(raw.Data.Object, charge); err != nil {
+			return nil, fmt.Errorf("The webhook does not hold a charge: %w", err)
+		}
+		event.IntentID, event.AmountCents, event.CapturedCents = charge.PaymentIntent, charge.Amount, charge.AmountCaptured
+		event.RefundedCents, event.Currency, event.Metadata = charge.AmountRefunded, charge.Currency, charge.Metadata
+	}
+	return event, nil
+}
+
+// @info Checks a Stripe-Signature header ("t=1700000000,v1=<hex>,v1=..."): one of the v1 signatures must be the
+// HMAC-SHA256 of "<t>.<payload>" with the secret, and t must be within StripeSignatureTolerance of now
+func VerifyStripeSignature(payload []byte, header string, secret string, now time.Time) error {
+	timestamp, signatures := "", []string{}
+	for _, part := range str.Split(header, ",") {
+		key, value, _ := str.Cut(str.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return fmt.Errorf("%w: malformed header", ErrSignature)
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > StripeSignatureTolerance || age < -StripeSignatureTolerance {
+		return fmt.Errorf("%w: signed too long ago", ErrSignature)
+	}
+	expected := stripeSignature(payload, timestamp, secret)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrSignature
+}
+
+// @info The Stripe-Signature header of a payload sent at the given time
+func SignStripe(payload []byte, secret string, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + stripeSignature(payload, timestamp, secret)
+}
+
+func stripeSignature(payload []byte, timestamp string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// @info Client of the API calls, the context sets the deadlines
+var httpClient = &http.Client{}
+
+// @info Sends a form and decodes the answer into out, failing with a *ProviderError on any status above 299
+func (s *Stripe) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.apiURL+path, str.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.secretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode > 299 {
+		failure := &stripeError{}
+		if json.Unmarshal(body, failure) != nil || failure.Error.Message == "" {
+			return &ProviderError{StatusCode: resp.StatusCode, Message: str.TrimSpace(string(body))}
+		}
+		return &ProviderError{StatusCode: resp.StatusCode, Code: failure.Error.Code, Message: failure.Error.Message}
+	}
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,194 @@
+package payment_test
+
+import (
+	"3DQuest/payment"
+	"3DQuest/payment/fake"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	secretKey     = "sk_test"
+	webhookSecret = "whsec_test"
+)
+
+func connect(t *testing.T, key string) (payment.Provider, *fake.Stripe) {
+	t.Helper()
+	stripe := fake.NewStripe(secretKey, webhookSecret, "")
+	server := httptest.NewServer(stripe)
+	t.Cleanup(server.Close)
+	provider, err := payment.New(payment.KindStripe, server.URL+"/", key, webhookSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider, stripe
+}
+
+// @info Parses the last event the fake sent, signed as it was
+func lastEvent(t *testing.T, provider payment.Provider, stripe *fake.Stripe) *payment.Event {
+	t.Helper()
+	events := stripe.Events()
+	if len(events) == 0 {
+		t.Fatal("no event was sent")
+	}
+	payload := events[len(events)-1]
+	header := http.Header{}
+	header.Set("Stripe-Signature", stripe.Sign(payload))
+	event, err := provider.ParseWebhook(payload, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestPayAndRefund(t *testing.T) {
+	provider, stripe := connect(t, secretKey)
+	ctx := context.Background()
+	intent, err := provider.CreateIntent(ctx, &payment.IntentRequest{
+		AmountCents: 2500,
+		Currency:    "EUR",
+		Metadata:    map[string]string{"checkout_id": "checkout:1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intent.Status != payment.IntentRequiresPayment || intent.AmountCents != 2500 || intent.Currency != "eur" || intent.ClientSecret == "" {
+		t.Fatalf("intent = %+v", intent)
+	}
+
+	if err := stripe.Decline(intent.ID, "Your card was declined."); err != nil {
+		t.Fatal(err)
+	}
+	if event := lastEvent(t, provider, stripe); event.Type != payment.EventFailed || event.FailureMessage != "Your card was declined." {
+		t.Fatalf("event after declining = %+v", event)
+	}
+
+	if err := stripe.Pay(intent.ID); err != nil {
+		t.Fatal(err)
+	}
+	event := lastEvent(t, provider, stripe)
+	if event.Type != payment.EventSucceeded || event.IntentID != intent.ID || event.CapturedCents != 2500 || event.Metadata["checkout_id"] != "checkout:1" {
+		t.Fatalf("event after paying = %+v", event)
+	}
+
+	refund, err := provider.Refund(ctx, intent.ID, 1000, "refund-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := provider.Refund(ctx, intent.ID, 1000, "refund-1")
+	if err != nil || again.ID != refund.ID {
+		t.Fatalf("retried refund = %+v, %v, want %s", again, err, refund.ID)
+	}
+	if event := lastEvent(t, provider, stripe); event.Type != payment.EventRefunded || event.RefundedCents != 1000 {
+		t.Fatalf("event after refunding = %+v", event)
+	}
+	var providerErr *payment.ProviderError
+	if _, err := provider.Refund(ctx, intent.ID, 2000, ""); !errors.As(err, &providerErr) || providerErr.Code != "amount_too_large" {
+		t.Fatalf("refunding more than is left: %v", err)
+	}
+	if _, err := provider.Refund(ctx, intent.ID, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if event := lastEvent(t, provider, stripe); event.RefundedCents != 2500 {
+		t.Fatalf("refunded after refunding the rest = %d, want 2500", event.RefundedCents)
+	}
+}
+
+func TestManualCapture(t *testing.T) {
+	provider, stripe := connect(t, secretKey)
+	ctx := context.Background()
+	intent, err := provider.CreateIntent(ctx, &payment.IntentRequest{AmountCents: 4000, Currency: "eur", ManualCapture: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Capture(ctx, intent.ID, 0); err == nil {
+		t.Fatal("captured an intent that was not paid")
+	}
+	if err := stripe.Pay(intent.ID); err != nil {
+		t.Fatal(err)
+	}
+	if event := lastEvent(t, provider, stripe); event.Type != payment.EventAuthorized || event.CapturedCents != 0 {
+		t.Fatalf("event after authorizing = %+v", event)
+	}
+	captured, err := provider.Capture(ctx, intent.ID, 3500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if captured.Status != payment.IntentSucceeded || captured.CapturedCents != 3500 {
+		t.Fatalf("captured = %+v", captured)
+	}
+	if event := lastEvent(t, provider, stripe); event.Type != payment.EventSucceeded || event.CapturedCents != 3500 {
+		t.Fatalf("event after capturing = %+v", event)
+	}
+}
+
+func TestIdempotentIntent(t *testing.T) {
+	provider, _ := connect(t, secretKey)
+	ctx := context.Background()
+	req := &payment.IntentRequest{AmountCents: 100, Currency: "eur", IdempotencyKey: "checkout:1"}
+	first, err := provider.CreateIntent(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := provider.CreateIntent(ctx, req)
+	if err != nil || second.ID != first.ID {
+		t.Fatalf("second intent = %+v, %v, want %s", second, err, first.ID)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	provider, _ := connect(t, "sk_wrong")
+	_, err := provider.CreateIntent(context.Background(), &payment.IntentRequest{AmountCents: 100, Currency: "eur"})
+	var providerErr *payment.ProviderError
+	if !errors.As(err, &providerErr) || providerErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("err = %v, want a 401", err)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	payload := []byte(`{"id":"evt_1","type":"payment_intent.succeeded","created":1700000000,"data":{"object":{"id":"pi_1","amount":100,"amount_received":100}}}`)
+	now := time.Now()
+	cases := map[string]struct {
+		header string
+		err    bool
+	}{
+		"valid":         {payment.SignStripe(payload, webhookSecret, now), false},
+		"rotated":       {payment.SignStripe(payload, webhookSecret, now) + ",v1=0123", false},
+		"wrong secret":  {payment.SignStripe(payload, "whsec_other", now), true},
+		"too old":       {payment.SignStripe(payload, webhookSecret, now.Add(-time.Hour)), true},
+		"from future":   {payment.SignStripe(payload, webhookSecret, now.Add(time.Hour)), true},
+		"missing":       {"", true},
+		"no signatures": {"t=1700000000", true},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := payment.VerifyStripeSignature(payload, c.header, webhookSecret, now)
+			if c.err != (err != nil) {
+				t.Fatalf("err = %v, want an error: %v", err, c.err)
+			}
+			if err != nil && !errors.Is(err, payment.ErrSignature) {
+				t.Fatalf("err = %v, want ErrSignature", err)
+			}
+		})
+	}
+
+	stripe := payment.NewStripe("http://localhost", secretKey, webhookSecret)
+	header := http.Header{}
+	header.Set("Stripe-Signature", payment.SignStripe(payload, webhookSecret, now))
+	event, err := stripe.ParseWebhook(payload, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ID != "evt_1" || event.Type != payment.EventSucceeded || event.IntentID != "pi_1" || event.CapturedCents != 100 {
+		t.Fatalf("event = %+v", event)
+	}
+	tampered := append([]byte{}, payload...)
+	tampered[len(tampered)-4] = '9'
+	if _, err := stripe.ParseWebhook(tampered, header); !errors.Is(err, payment.ErrSignature) {
+		t.Fatalf("tampered payload: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package pdf
+
+// @info Windows-1252 codes of the characters between 0x80 and 0x9F, the rest of the code page is Latin-1
+var cp1252 = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A,
+	'‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// @info Text in the WinAnsiEncoding of the standard fonts
+func encode(text string) []byte {
+	encoded := make([]byte, 0, len(text))
+	for _, r := range text {
+		switch {
+		case r < 0x80 || (r >= 0xA0 && r <= 0xFF):
+			encoded = append(encoded, byte(r))
+		case cp1252[r] != 0:
+			encoded = append(encoded, cp1252[r])
+		default:
+			encoded = append(encoded, '?')
+		}
+	}
+	return encoded
+}
+
+// @info Advance widths, in thousandths of the font size, of the printable ASCII characters (32 to 126), from the
+// Adobe font metrics of the standard fonts
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+var helveticaBoldWidths = [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}
+
+// @info Accented letters are as wide as the letter without the accent
+var latinBase = map[byte]byte{
+	0xC0: 'A', 0xC1: 'A', 0xC2: 'A', 0xC3: 'A', 0xC4: 'A', 0xC5: 'A', 0xC7: 'C', 0xC8: 'E', 0xC9: 'E', 0xCA: 'E',
+	0xCB: 'E', 0xD0: 'D', 0xD1: 'N', 0xD2: 'O', 0xD3: 'O', 0xD4: 'O', 0xD5: 'O', 0xD6: 'O', 0xD8: 'O', 0xD9: 'U',
+	0xDA: 'U', 0xDB: 'U', 0xDC: 'U', 0xDD: 'Y', 0xE0: 'a', 0xE1: 'a', 0xE2: 'a', 0xE3: 'a', 0xE4: 'a', 0xE5: 'a',
+	0xE7: 'c', 0xE8: 'e', 0xE9: 'e', 0xEA: 'e', 0xEB: 'e', 0xF1: 'n', 0xF2: 'o', 0xF3: 'o', 0xF4: 'o', 0xF5: 'o',
+	0xF6: 'o', 0xF9: 'u', 0xFA: 'u', 0xFB: 'u', 0xFC: 'u', 0xFD: 'y', 0xFF: 'y', 0x8A: 'S', 0x9A: 's', 0x8E: 'Z',
+	0x9E: 'z', 0x9F: 'Y',
+}
+
+// @info Other characters likely on an invoice. Anything else is taken as wide as a digit.
+var otherWidths = map[byte]int{
+	0x80: 556, 0x85: 1000, 0x91: 222, 0x92: 222, 0x93: 333, 0x94: 333, 0x95: 350, 0x96: 556, 0x97: 1000,
+	0xA0: 278, 0xA1: 333, 0xA9: 737, 0xAA: 370, 0xAB: 556, 0xAE: 737, 0xB0: 400, 0xB7: 278, 0xBA: 365, 0xBB: 556,
+	0xBF: 611, 0xC6: 1000, 0xCC: 278, 0xCD: 278, 0xCE: 278, 0xCF: 278, 0xD7: 584, 0xDF: 611, 0xE6: 889, 0xEC: 278,
+	0xED: 278, 0xEE: 278, 0xEF: 278, 0xF7: 584, 0xF8: 611,
+}
+
+func charWidth(widths *[95]int, c byte) int {
+	if c >= 32 && c <= 126 {
+		return widths[c-32]
+	}
+	if base, ok := latinBase[c]; ok {
+		return widths[base-32]
+	}
+	if width, ok := otherWidths[c]; ok {
+		return width
+	}
+	return 556
+}
@@ -0,0 +1,171 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	str "strings"
+)
+
+// @info A4 in points (1/72 inch), the size of every page
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+// @info One of the standard fonts every PDF reader has, so nothing needs to be embedded
+type Font int
+
+const (
+	Helvetica Font = iota
+	HelveticaBold
+)
+
+var fontNames = []string{"Helvetica", "Helvetica-Bold"}
+
+// @info A document being put together page by page. Coordinates start at the bottom left corner of the page.
+type Document struct {
+	Title  string
+	Author string
+	pages  []*Page
+}
+
+type Page struct {
+	content bytes.Buffer
+}
+
+func New() *Document {
+	return &Document{}
+}
+
+func (d *Document) AddPage() *Page {
+	page := &Page{}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// @info Writes text with its baseline starting at x, y. Characters outside Windows-1252 are written as '?'.
+func (p *Page) Text(x float64, y float64, font Font, size float64, text string) {
+	fmt.Fprintf(&p.content, "BT /F%d %s Tf %s %s Td (%s) Tj ET\n", font+1, num(size), num(x), num(y), escape(encode(text)))
+}
+
+// @info Writes text ending at x
+func (p *Page) TextRight(x float64, y float64, font Font, size float64, text string) {
+	p.Text(x-Width(font, size, text), y, font, size, text)
+}
+
+func (p *Page) Line(x1 float64, y1 float64, x2 float64, y2 float64, width float64) {
+	fmt.Fprintf(&p.content, "%s w %s %s m %s %s l S\n", num(width), num(x1), num(y1), num(x2), num(y2))
+}
+
+// @info Fills a rectangle in a shade of grey, from 0 (black) to 1 (white)
+func (p *Page) FillRect(x float64, y float64, width float64, height float64, grey float64) {
+	fmt.Fprintf(&p.content, "q %s g %s %s %s %s re f Q\n", num(grey), num(x), num(y), num(width), num(height))
+}
+
+// @info Width of the text in points
+func Width(font Font, size float64, text string) float64 {
+	widths := &helveticaWidths
+	if font == HelveticaBold {
+		widths = &helveticaBoldWidths
+	}
+	units := 0
+	for _, c := range encode(text) {
+		units += charWidth(widths, c)
+	}
+	return float64(units) * size / 1000
+}
+
+// @info Cuts the text in lines no wider than width, between words when possible
+func Wrap(font Font, size float64, text string, width float64) []string {
+	lines := []string{}
+	line := ""
+	for _, word := range str.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && Width(font, size, candidate) > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// @info The document as a PDF 1.4 file. Page contents are compressed.
+func (d *Document) Bytes() ([]byte, error) {
+	if len(d.pages) == 0 {
+		d.AddPage()
+	}
+	// @info Objects: 1 catalog, 2 page tree, 3 info, 4 and 5 the fonts, then a page and its content for every page
+	objects := []string{}
+	kids := []string{}
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 6+2*i))
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", str.Join(kids, " "), len(d.pages)),
+		fmt.Sprintf("<< /Title (%s) /Author (%s) /Producer (3DQuest) >>", escape(encode(d.Title)), escape(encode(d.Author))),
+	)
+	for _, name := range fontNames {
+		objects = append(objects, fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", name))
+	}
+	for i, page := range d.pages {
+		var compressed bytes.Buffer
+		w := zlib.NewWriter(&compressed)
+		if _, err := w.Write(page.content.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents %d 0 R >>", num(PageWidth), num(PageHeight), 7+2*i),
+			fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 3 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes(), nil
+}
+
+// @info Numbers with at most two decimals, as short as possible
+func num(value float64) string {
+	s := fmt.Sprintf("%.2f", value)
+	s = str.TrimRight(s, "0")
+	return str.TrimSuffix(s, ".")
+}
+
+func escape(text []byte) string {
+	var b str.Builder
+	for _, c := range text {
+		switch c {
+		case '\\', '(', ')':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n', '\r', '\t':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
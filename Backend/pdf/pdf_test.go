@@ -0,0 +1,92 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestDocument(t *testing.T) {
+	doc := New()
+	doc.Title = "Invoice (F-2024-000001)"
+	for i := 0; i < 2; i++ {
+		page := doc.AddPage()
+		page.Text(40, 800, HelveticaBold, 16, fmt.Sprintf("Page %d", i+1))
+		page.TextRight(555, 780, Helvetica, 10, "Añadido: 1.234,56 €")
+		page.Line(40, 770, 555, 770, 0.5)
+		page.FillRect(40, 700, 100, 20, 0.9)
+	}
+	data, err := doc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatal("not a PDF")
+	}
+
+	// @info Every entry of the cross-reference table must point to its object
+	start := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(data)
+	if start == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(start[1]))
+	if !bytes.HasPrefix(data[xref:], []byte("xref\n0 10\n")) {
+		t.Fatalf("startxref %d does not point to a table of 10 entries", xref)
+	}
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(data[xref:], -1)
+	if len(entries) != 9 {
+		t.Fatalf("%d objects in the table, want 9", len(entries))
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(data[offset:], []byte(want)) {
+			t.Fatalf("object %d is not at %d", i+1, offset)
+		}
+	}
+	if !bytes.Contains(data, []byte(`/Title (Invoice \(F-2024-000001\))`)) {
+		t.Fatal("the title is not escaped")
+	}
+
+	stream := regexp.MustCompile(`(?s)/Length (\d+) /Filter /FlateDecode >>\nstream\n`).FindSubmatchIndex(data)
+	length, _ := strconv.Atoi(string(data[stream[2]:stream[3]]))
+	r, err := zlib.NewReader(bytes.NewReader(data[stream[1] : stream[1]+length]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(content, []byte("(A\xf1adido: 1.234,56 \x80) Tj")) {
+		t.Fatalf("text not in WinAnsiEncoding:\n%s", content)
+	}
+}
+
+func TestWidthAndWrap(t *testing.T) {
+	// @info From the metrics: H 722, e 556, l 222, o 556
+	if w := Width(Helvetica, 10, "Hello"); w != 22.78 {
+		t.Fatalf("width of Hello = %v, want 22.78", w)
+	}
+	if Width(Helvetica, 10, "Año") != Width(Helvetica, 10, "Ano") {
+		t.Fatal("ñ is not as wide as n")
+	}
+	if Width(HelveticaBold, 10, "Hello") <= Width(Helvetica, 10, "Hello") {
+		t.Fatal("bold is not wider")
+	}
+	lines := Wrap(Helvetica, 10, "PLA dragon printed at 0.2 mm with sanding and primer", 100)
+	if len(lines) < 2 {
+		t.Fatalf("lines = %q", lines)
+	}
+	for _, line := range lines {
+		if Width(Helvetica, 10, line) > 100 {
+			t.Fatalf("%q is wider than 100", line)
+		}
+	}
+	if lines := Wrap(Helvetica, 10, "", 100); len(lines) != 1 || lines[0] != "" {
+		t.Fatalf("empty text = %q", lines)
+	}
+}
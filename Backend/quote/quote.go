@@ -0,0 +1,303 @@
+package quote
+
+import (
+	"3DQuest/gcode"
+	"3DQuest/geometry"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	str "strings"
+)
+
+// @info Tariffs used to price a print. Amounts are in cents, VAT excluded.
+type Rules struct {
+	Currency             string                  `json:"currency"`
+	VATPercent           float64                 `json:"vat_percent"`
+	MachineHourCents     int64                   `json:"machine_hour_cents"`      // Printer time, electricity and wear included
+	MinimumFeeCents      int64                   `json:"minimum_fee_cents"`       // Minimum of a whole quote, before discounts
+	Materials            map[string]MaterialRate `json:"materials"`               // Keyed by material name, e.g. PLA
+	PostProcessing       map[string]int64        `json:"post_processing"`         // Extra => cents per piece, e.g. sanding
+	Discounts            map[string]float64      `json:"discounts"`               // User type => percentage off
+	DefaultInfillPercent float64                 `json:"default_infill_percent"`  // Used when the customer does not choose one
+	DefaultLayerHeightMM float64                 `json:"default_layer_height_mm"` // Used when the customer does not choose one
+	ShellThicknessMM     float64                 `json:"shell_thickness_mm"`      // Walls, top and bottom are printed solid
+	VolumetricSpeedMM3S  float64                 `json:"volumetric_speed_mm3_s"`  // Average plastic laid per second
+	LayerChangeSeconds   float64                 `json:"layer_change_seconds"`    // Travel, retraction and z hop of every layer
+	TimeOverheadPercent  float64                 `json:"time_overhead_percent"`   // Heating, travel and slow first layer
+}
+
+type MaterialRate struct {
+	DensityGCM3   float64 `json:"density_g_cm3"`
+	KilogramCents int64   `json:"kilogram_cents"` // Price of a kilogram of filament
+}
+
+// @info Tariffs to start with on an empty database
+func DefaultRules() Rules {
+	return Rules{
+		Currency:         "EUR",
+		VATPercent:       21,
+		MachineHourCents: 150,
+		MinimumFeeCents:  300,
+		Materials: map[string]MaterialRate{
+			"PLA":  {DensityGCM3: 1.24, KilogramCents: 2500},
+			"PETG": {DensityGCM3: 1.27, KilogramCents: 2800},
+			"ABS":  {DensityGCM3: 1.04, KilogramCents: 2800},
+			"TPU":  {DensityGCM3: 1.21, KilogramCents: 4000},
+		},
+		PostProcessing: map[string]int64{
+			"support_removal": 100,
+			"sanding":         400,
+			"painting":        1200,
+		},
+		Discounts: map[string]float64{
+			"ascfi":    20,
+			"crea":     15,
+			"asoc":     10,
+			"academic": 25,
+		},
+		DefaultInfillPercent: 20,
+		DefaultLayerHeightMM: 0.2,
+		ShellThicknessMM:     1.2,
+		VolumetricSpeedMM3S:  8,
+		LayerChangeSeconds:   2,
+		TimeOverheadPercent:  10,
+	}
+}
+
+// @info A problem found by Rules.Check
+type RuleError struct {
+	Field   string
+	Message string
+}
+
+// @info Lists every inconsistency of the tariffs, sorted by field
+func (r *Rules) Check() []RuleError {
+	problems := []RuleError{}
+	add := func(field string, message string) {
+		problems = append(problems, RuleError{Field: field, Message: message})
+	}
+	if len(r.Currency) != 3 {
+		add("currency", "must be an ISO 4217 code")
+	}
+	if r.VATPercent < 0 || r.VATPercent > 100 {
+		add("vat_percent", "must be between 0 and 100")
+	}
+	if r.MachineHourCents < 0 {
+		add("machine_hour_cents", "must be at least 0")
+	}
+	if r.MinimumFeeCents < 0 {
+		add("minimum_fee_cents", "must be at least 0")
+	}
+	if len(r.Materials) == 0 {
+		add("materials", "must have at least 1 elements")
+	}
+	for name, material := range r.Materials {
+		if name == "" || name != str.TrimSpace(name) {
+			add("materials", fmt.Sprintf("invalid material name '%s'", name))
+		}
+		if material.DensityGCM3 <= 0 {
+			add("materials."+name+".density_g_cm3", "must be greater than 0")
+		}
+		if material.KilogramCents < 0 {
+			add("materials."+name+".kilogram_cents", "must be at least 0")
+		}
+	}
+	for name, cents := range r.PostProcessing {
+		if cents < 0 {
+			add("post_processing."+name, "must be at least 0")
+		}
+	}
+	for userType, percent := range r.Discounts {
+		if percent < 0 || percent > 100 {
+			add("discounts."+userType, "must be between 0 and 100")
+		}
+	}
+	if r.DefaultInfillPercent < 0 || r.DefaultInfillPercent > 100 {
+		add("default_infill_percent", "must be between 0 and 100")
+	}
+	if r.DefaultLayerHeightMM <= 0 || r.DefaultLayerHeightMM > 1 {
+		add("default_layer_height_mm", "must be greater than 0 and at most 1")
+	}
+	if r.ShellThicknessMM < 0 {
+		add("shell_thickness_mm", "must be at least 0")
+	}
+	if r.VolumetricSpeedMM3S <= 0 {
+		add("volumetric_speed_mm3_s", "must be greater than 0")
+	}
+	if r.LayerChangeSeconds < 0 {
+		add("layer_change_seconds", "must be at least 0")
+	}
+	if r.TimeOverheadPercent < 0 {
+		add("time_overhead_percent", "must be at least 0")
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+	return problems
+}
+
+// @info Material names sorted, to show them to customers
+func (r *Rules) MaterialNames() []string {
+	names := make([]string, 0, len(r.Materials))
+	for name := range r.Materials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	ErrUnknownMaterial = errors.New("The material is not in the tariffs")
+	ErrUnknownExtra    = errors.New("The post-processing option is not in the tariffs")
+	ErrInvalidSettings = errors.New("Invalid print settings")
+)
+
+// @info A model to price and how to print it. Zero InfillPercent or LayerHeightMM take the defaults of the rules.
+// Items already sliced carry their G-code instead of a model, its filament and simulated time are used as they are and
+// its filament type is the default material.
+type Item struct {
+	Name           string             `json:"name"`
+	Model          *geometry.Analysis `json:"-"`
+	GCode          *gcode.Analysis    `json:"-"`
+	Material       string             `json:"material"`
+	InfillPercent  float64            `json:"infill_percent"`
+	LayerHeightMM  float64            `json:"layer_height_mm"`
+	Quantity       int                `json:"quantity"`
+	PostProcessing []string           `json:"post_processing"`
+}
+
+// @info Price of one item. Per piece amounts are multiplied by Quantity into SubtotalCents.
+type Line struct {
+	Name                string   `json:"name"`
+	Material            string   `json:"material"`
+	InfillPercent       float64  `json:"infill_percent"`
+	LayerHeightMM       float64  `json:"layer_height_mm"`
+	Quantity            int      `json:"quantity"`
+	PostProcessing      []string `json:"post_processing,omitempty"`
+	FilamentGrams       float64  `json:"filament_grams"`        // Per piece
+	PrintSeconds        int64    `json:"print_seconds"`         // Per piece
+	MaterialCents       int64    `json:"material_cents"`        // Per piece
+	MachineCents        int64    `json:"machine_cents"`         // Per piece
+	PostProcessingCents int64    `json:"post_processing_cents"` // Per piece
+	UnitCents           int64    `json:"unit_cents"`
+	SubtotalCents       int64    `json:"subtotal_cents"`
+}
+
+// @info Breakdown of a price. TotalCents = NetCents + VATCents, NetCents = SubtotalCents + MinimumFeeCents - DiscountCents
+type Quote struct {
+	RulesVersion    int     `json:"rules_version"` // Version of the tariffs used, 0 if they were not stored
+	Currency        string  `json:"currency"`
+	Lines           []Line  `json:"lines"`
+	FilamentGrams   float64 `json:"filament_grams"` // Every piece of every line
+	PrintSeconds    int64   `json:"print_seconds"`  // Every piece of every line
+	SubtotalCents   int64   `json:"subtotal_cents"`
+	MinimumFeeCents int64   `json:"minimum_fee_cents"` // Added to reach the minimum fee, if the subtotal is lower
+	DiscountPercent float64 `json:"discount_percent"`
+	DiscountCents   int64   `json:"discount_cents"`
+	NetCents        int64   `json:"net_cents"`
+	VATPercent      float64 `json:"vat_percent"`
+	VATCents        int64   `json:"vat_cents"`
+	TotalCents      int64   `json:"total_cents"`
+}
+
+// @info Prices the items for a customer of the given user type
+// @error ErrUnknownMaterial, ErrUnknownExtra or ErrInvalidSettings, wrapped with the item they refer to
+func Calculate(rules *Rules, items []Item, userType string) (*Quote, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: nothing to quote", ErrInvalidSettings)
+	}
+	q := &Quote{Currency: rules.Currency, Lines: []Line{}, VATPercent: rules.VATPercent}
+	for i := range items {
+		line, err := rules.price(&items[i])
+		if err != nil {
+			return nil, fmt.Errorf("item %d (%s): %w", i, items[i].Name, err)
+		}
+		q.Lines = append(q.Lines, *line)
+		q.FilamentGrams += line.FilamentGrams * float64(line.Quantity)
+		q.PrintSeconds += line.PrintSeconds * int64(line.Quantity)
+		q.SubtotalCents += line.SubtotalCents
+	}
+	q.FilamentGrams = math.Round(q.FilamentGrams*10) / 10
+	if q.SubtotalCents < rules.MinimumFeeCents {
+		q.MinimumFeeCents = rules.MinimumFeeCents - q.SubtotalCents
+	}
+	q.DiscountPercent = rules.Discounts[userType]
+	q.DiscountCents = cents(float64(q.SubtotalCents+q.MinimumFeeCents) * q.DiscountPercent / 100)
+	q.NetCents = q.SubtotalCents + q.MinimumFeeCents - q.DiscountCents
+	q.VATCents = cents(float64(q.NetCents) * q.VATPercent / 100)
+	q.TotalCents = q.NetCents + q.VATCents
+	return q, nil
+}
+
+// @info Walls, top and bottom (area × shell thickness) are solid, the rest of the volume is filled at the infill
+// percentage. Print time is the plastic laid at the volumetric speed plus the time spent changing layers.
+// Sliced items take both from their G-code instead.
+func (r *Rules) price(item *Item) (*Line, error) {
+	name := item.Material
+	if name == "" && item.GCode != nil {
+		name = item.GCode.Material
+	}
+	material, ok := r.Materials[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownMaterial, name)
+	}
+	line := &Line{
+		Name:           item.Name,
+		Material:       name,
+		InfillPercent:  item.InfillPercent,
+		LayerHeightMM:  item.LayerHeightMM,
+		Quantity:       item.Quantity,
+		PostProcessing: item.PostProcessing,
+	}
+	if item.GCode != nil { // @info The slicer already decided, these are only informative
+		line.InfillPercent = item.GCode.InfillPercent
+		line.LayerHeightMM = item.GCode.LayerHeightMM
+	}
+	if line.InfillPercent == 0 {
+		line.InfillPercent = r.DefaultInfillPercent
+	}
+	if line.LayerHeightMM == 0 {
+		line.LayerHeightMM = r.DefaultLayerHeightMM
+	}
+	switch {
+	case item.Model == nil && item.GCode == nil:
+		return nil, fmt.Errorf("%w: the model has not been analysed", ErrInvalidSettings)
+	case line.Quantity < 1:
+		return nil, fmt.Errorf("%w: the quantity must be at least 1", ErrInvalidSettings)
+	case line.InfillPercent < 0 || line.InfillPercent > 100:
+		return nil, fmt.Errorf("%w: the infill must be between 0 and 100", ErrInvalidSettings)
+	case line.LayerHeightMM < 0.04 || line.LayerHeightMM > 1:
+		return nil, fmt.Errorf("%w: the layer height must be between 0.04 and 1 mm", ErrInvalidSettings)
+	}
+
+	var plastic, seconds float64 // mm³, s
+	if item.GCode != nil {
+		plastic = item.GCode.FilamentMM3
+		seconds = item.GCode.PrintSeconds
+	} else {
+		volume := item.Model.VolumeMM3
+		shell := math.Min(item.Model.AreaMM2*r.ShellThicknessMM, volume)
+		plastic = shell + (volume-shell)*line.InfillPercent/100
+		layers := math.Ceil(item.Model.Size.Z / line.LayerHeightMM)
+		seconds = (plastic/r.VolumetricSpeedMM3S + layers*r.LayerChangeSeconds) * (1 + r.TimeOverheadPercent/100)
+	}
+	line.FilamentGrams = math.Round(plastic/1000*material.DensityGCM3*10) / 10
+	line.PrintSeconds = int64(math.Ceil(seconds))
+
+	line.MaterialCents = cents(line.FilamentGrams / 1000 * float64(material.KilogramCents))
+	line.MachineCents = cents(float64(line.PrintSeconds) / 3600 * float64(r.MachineHourCents))
+	for _, extra := range item.PostProcessing {
+		extraCents, ok := r.PostProcessing[extra]
+		if !ok {
+			return nil, fmt.Errorf("%w: '%s'", ErrUnknownExtra, extra)
+		}
+		line.PostProcessingCents += extraCents
+	}
+	line.UnitCents = line.MaterialCents + line.MachineCents + line.PostProcessingCents
+	line.SubtotalCents = line.UnitCents * int64(line.Quantity)
+	return line, nil
+}
+
+// @info Rounds half away from zero to whole cents
+func cents(amount float64) int64 {
+	return int64(math.Round(amount))
+}
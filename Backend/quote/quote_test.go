@@ -0,0 +1,161 @@
+package quote_test
+
+import (
+	"3DQuest/gcode"
+	"3DQuest/geometry"
+	"3DQuest/quote"
+	"errors"
+	"testing"
+)
+
+func rules() *quote.Rules {
+	r := quote.DefaultRules()
+	r.PostProcessing["fixed"] = 1 // @info Lets a test choose the subtotal: one cent per extra and piece
+	return &r
+}
+
+// @info A sliced item whose whole price is its post-processing, quantity × cents
+func fixed(cents int, quantity int) quote.Item {
+	extras := make([]string, cents)
+	for i := range extras {
+		extras[i] = "fixed"
+	}
+	return quote.Item{Name: "fixed", Material: "PLA", GCode: &gcode.Analysis{}, Quantity: quantity, PostProcessing: extras}
+}
+
+func TestPriceSliced(t *testing.T) {
+	item := quote.Item{
+		Name:           "sliced",
+		GCode:          &gcode.Analysis{Material: "PETG", FilamentMM3: 10000, PrintSeconds: 5400, InfillPercent: 15, LayerHeightMM: 0.28},
+		Quantity:       3,
+		PostProcessing: []string{"sanding"},
+	}
+	q, err := quote.Calculate(rules(), []quote.Item{item}, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := q.Lines[0]
+	// 10 cm³ of PETG at 1.27 g/cm³ is 12.7 g, 35.56 cents at 28 €/kg; 1.5 h at 1.50 €/h is 225 cents
+	if line.Material != "PETG" || line.FilamentGrams != 12.7 || line.MaterialCents != 36 || line.MachineCents != 225 || line.PostProcessingCents != 400 {
+		t.Errorf("line = %+v", line)
+	}
+	if line.InfillPercent != 15 || line.LayerHeightMM != 0.28 {
+		t.Errorf("settings = %v%% %v mm, want those of the G-code", line.InfillPercent, line.LayerHeightMM)
+	}
+	if line.UnitCents != 661 || line.SubtotalCents != 1983 || q.FilamentGrams != 38.1 || q.PrintSeconds != 16200 {
+		t.Errorf("line = %+v, quote = %+v", line, q)
+	}
+	if q.MinimumFeeCents != 0 || q.DiscountCents != 0 || q.NetCents != 1983 || q.VATCents != 416 || q.TotalCents != 2399 {
+		t.Errorf("quote = %+v", q)
+	}
+}
+
+func TestPriceModel(t *testing.T) {
+	item := quote.Item{
+		Name:     "model",
+		Model:    &geometry.Analysis{VolumeMM3: 10000, AreaMM2: 1000, Size: geometry.Vec3{X: 20, Y: 20, Z: 25}},
+		Material: "PLA",
+		Quantity: 1,
+	}
+	q, err := quote.Calculate(rules(), []quote.Item{item}, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := q.Lines[0]
+	// Shell 1000 mm² × 1.2 mm = 1200 mm³, plus 20% of the other 8800 mm³: 2960 mm³, 3.67 g of PLA
+	// (2960 / 8 s + 125 layers × 2 s) + 10% = 682 s
+	if line.InfillPercent != 20 || line.LayerHeightMM != 0.2 {
+		t.Errorf("settings = %v%% %v mm, want the defaults", line.InfillPercent, line.LayerHeightMM)
+	}
+	if line.FilamentGrams != 3.7 || line.PrintSeconds != 682 || line.MaterialCents != 9 || line.MachineCents != 28 {
+		t.Errorf("line = %+v", line)
+	}
+	// @info Solid models are all shell
+	item.Model = &geometry.Analysis{VolumeMM3: 1000, AreaMM2: 6000, Size: geometry.Vec3{Z: 10}}
+	item.InfillPercent = 50
+	q, err = quote.Calculate(rules(), []quote.Item{item}, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grams := q.Lines[0].FilamentGrams; grams != 1.2 {
+		t.Errorf("grams of a solid model = %v, want 1.2", grams)
+	}
+}
+
+func TestMinimumFeeAndDiscounts(t *testing.T) {
+	cases := []struct {
+		name                 string
+		items                []quote.Item
+		userType             string
+		minimum              int64
+		discount, net, total int64
+	}{
+		{"over the minimum", []quote.Item{fixed(1000, 1)}, "user", 0, 0, 1000, 1210},
+		{"under the minimum", []quote.Item{fixed(100, 1), fixed(50, 2)}, "user", 100, 0, 300, 363},
+		{"minimum discounted", []quote.Item{fixed(100, 1)}, "ascfi", 200, 60, 240, 290},
+		{"half cent discount rounds up", []quote.Item{fixed(1005, 1)}, "asoc", 0, 101, 904, 1094},
+		{"half cent VAT rounds up", []quote.Item{fixed(1000, 1)}, "academic", 0, 250, 750, 908},
+		{"VAT rounds down", []quote.Item{fixed(111, 3)}, "crea", 0, 50, 283, 342},
+		{"unknown type", []quote.Item{fixed(1000, 1)}, "nobody", 0, 0, 1000, 1210},
+	}
+	for _, c := range cases {
+		q, err := quote.Calculate(rules(), c.items, c.userType)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if q.MinimumFeeCents != c.minimum || q.DiscountCents != c.discount || q.NetCents != c.net || q.TotalCents != c.total {
+			t.Errorf("%s: minimum %d, discount %d, net %d, total %d, want %d, %d, %d, %d", c.name,
+				q.MinimumFeeCents, q.DiscountCents, q.NetCents, q.TotalCents, c.minimum, c.discount, c.net, c.total)
+		}
+		if q.NetCents+q.VATCents != q.TotalCents || q.SubtotalCents+q.MinimumFeeCents-q.DiscountCents != q.NetCents {
+			t.Errorf("%s: the breakdown does not add up: %+v", c.name, q)
+		}
+	}
+}
+
+func TestCalculateErrors(t *testing.T) {
+	model := &geometry.Analysis{VolumeMM3: 1000, AreaMM2: 600, Size: geometry.Vec3{Z: 10}}
+	cases := []struct {
+		name string
+		item quote.Item
+		err  error
+	}{
+		{"unknown material", quote.Item{Model: model, Material: "Wood", Quantity: 1}, quote.ErrUnknownMaterial},
+		{"unknown extra", quote.Item{Model: model, Material: "PLA", Quantity: 1, PostProcessing: []string{"gilding"}}, quote.ErrUnknownExtra},
+		{"no model", quote.Item{Material: "PLA", Quantity: 1}, quote.ErrInvalidSettings},
+		{"no quantity", quote.Item{Model: model, Material: "PLA"}, quote.ErrInvalidSettings},
+		{"too much infill", quote.Item{Model: model, Material: "PLA", Quantity: 1, InfillPercent: 101}, quote.ErrInvalidSettings},
+		{"thin layers", quote.Item{Model: model, Material: "PLA", Quantity: 1, LayerHeightMM: 0.01}, quote.ErrInvalidSettings},
+	}
+	for _, c := range cases {
+		if _, err := quote.Calculate(rules(), []quote.Item{c.item}, "user"); !errors.Is(err, c.err) {
+			t.Errorf("%s: error = %v, want %v", c.name, err, c.err)
+		}
+	}
+	if _, err := quote.Calculate(rules(), nil, "user"); !errors.Is(err, quote.ErrInvalidSettings) {
+		t.Errorf("no items: error = %v, want ErrInvalidSettings", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if problems := rules().Check(); len(problems) != 0 {
+		t.Fatalf("the default rules have problems: %v", problems)
+	}
+	r := rules()
+	r.Currency = "EURO"
+	r.VATPercent = 121
+	r.Materials["PLA"] = quote.MaterialRate{DensityGCM3: 0, KilogramCents: -1}
+	r.Discounts["ascfi"] = -5
+	r.DefaultLayerHeightMM = 0
+	r.VolumetricSpeedMM3S = 0
+	want := []string{"currency", "default_layer_height_mm", "discounts.ascfi", "materials.PLA.density_g_cm3", "materials.PLA.kilogram_cents", "vat_percent", "volumetric_speed_mm3_s"}
+	problems := r.Check()
+	if len(problems) != len(want) {
+		t.Fatalf("problems = %v, want %v", problems, want)
+	}
+	for i, problem := range problems {
+		if problem.Field != want[i] {
+			t.Errorf("problem %d on %s, want %s", i, problem.Field, want[i])
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package scheduler
+
+import (
+	"fmt"
+	str "strings"
+	"time"
+)
+
+// @info Weekly opening hours of the shop, in its time zone. The zero value is always open.
+type Hours struct {
+	loc  *time.Location
+	days [7][]span // Indexed by time.Weekday
+}
+
+// @info Minutes since midnight, [from, to)
+type span struct {
+	from int
+	to   int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// @info Parses lines such as "mon-fri 09:00-14:00 16:00-20:00" or "sat 10:00-14:00". Days not listed are closed, and
+// no lines at all means always open. A span ending at 24:00 (or before it starts) runs until midnight.
+func ParseHours(specs []string, timezone string) (*Hours, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown time zone '%s'", timezone)
+	}
+	h := &Hours{loc: loc}
+	for _, spec := range specs {
+		fields := str.Fields(str.ToLower(spec))
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Invalid opening hours '%s', expected e.g. 'mon-fri 09:00-20:00'", spec)
+		}
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid opening hours '%s': %w", spec, err)
+		}
+		for _, rangeSpec := range fields[1:] {
+			s, err := parseSpan(rangeSpec)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid opening hours '%s': %w", spec, err)
+			}
+			for _, day := range days {
+				h.days[day] = append(h.days[day], s)
+			}
+		}
+	}
+	return h, nil
+}
+
+func parseDays(spec string) ([]time.Weekday, error) {
+	from, to, isRange := str.Cut(spec, "-")
+	first, ok := weekdays[from]
+	if !ok {
+		return nil, fmt.Errorf("unknown day '%s'", from)
+	}
+	if !isRange {
+		return []time.Weekday{first}, nil
+	}
+	last, ok := weekdays[to]
+	if !ok {
+		return nil, fmt.Errorf("unknown day '%s'", to)
+	}
+	days := []time.Weekday{first}
+	for day := first; day != last; {
+		day = (day + 1) % 7
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+func parseSpan(spec string) (span, error) {
+	from, to, ok := str.Cut(spec, "-")
+	if !ok {
+		return span{}, fmt.Errorf("expected a range such as 09:00-20:00, got '%s'", spec)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return span{}, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return span{}, err
+	}
+	if end <= start {
+		end = 24 * 60
+	}
+	return span{from: start, to: end}, nil
+}
+
+func parseClock(clock string) (int, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes); err != nil || hours < 0 || hours > 24 || minutes < 0 || minutes > 59 || (hours == 24 && minutes > 0) {
+		return 0, fmt.Errorf("invalid time '%s'", clock)
+	}
+	return hours*60 + minutes, nil
+}
+
+func (h *Hours) alwaysOpen() bool {
+	if h == nil || h.loc == nil {
+		return true
+	}
+	for _, spans := range h.days {
+		if len(spans) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// @info The open span holding t, or the next one starting after t. ok is false if the shop never opens.
+func (h *Hours) window(t time.Time) (start time.Time, end time.Time, ok bool) {
+	if h.alwaysOpen() {
+		return t, time.Time{}, true
+	}
+	local := t.In(h.loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, h.loc)
+	for offset := 0; offset <= 7; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		for _, s := range h.days[day.Weekday()] {
+			from := day.Add(time.Duration(s.from) * time.Minute)
+			to := day.Add(time.Duration(s.to) * time.Minute)
+			if !to.After(t) {
+				continue
+			}
+			if from.Before(t) {
+				from = t
+			}
+			if start.IsZero() || from.Before(start) {
+				start, end = from, to
+			}
+		}
+		if !start.IsZero() {
+			return start, end, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// @info Whether the shop is open at t
+func (h *Hours) Open(t time.Time) bool {
+	start, _, ok := h.window(t)
+	return ok && start.Equal(t)
+}
+
+// @info Earliest time not before t at which a plate lasting d can start. Plates must start while the shop is open,
+// and when overnight is false they must also end before it closes. ok is false if no opening is long enough.
+func (h *Hours) NextStart(t time.Time, d time.Duration, overnight bool) (time.Time, bool) {
+	for attempts := 0; attempts < 7*24; attempts++ {
+		start, end, ok := h.window(t)
+		if !ok {
+			return time.Time{}, false
+		}
+		if overnight || end.IsZero() || !start.Add(d).After(end) {
+			return start, true
+		}
+		t = end.Add(time.Second)
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,339 @@
+package scheduler
+
+import (
+	"3DQuest/geometry"
+	"math"
+	"sort"
+	str "strings"
+	"time"
+)
+
+// @info A printer that can take plates, as seen by the planner
+type Printer struct {
+	ID           string
+	BuildVolume  geometry.Vec3 // mm
+	Nozzles      []float64     // Diameters in mm it can be fitted with
+	Materials    []string
+	Loaded       string    // Material loaded, empty if unknown
+	LoadedColour string    // Colour loaded, empty if unknown
+	FreeAt       time.Time // When it finishes its current job. Zero if idle
+}
+
+// @info Copies of one item of an order waiting to be printed
+type Part struct {
+	OrderID  string
+	Item     int // Index in the order
+	Run      int // Reprints of the order when it was planned, copied to the plates
+	Name     string
+	Material string
+	Colour   string
+	Size     geometry.Vec3 // Bounding box in mm. Zero if unknown, it is then assumed to fit any printer
+	Seconds  float64       // Print time of one copy
+	Grams    float64       // Filament of one copy, zero if unknown
+	Nozzle   float64       // Nozzle diameter in mm it was sliced for. Zero if any
+	Sliced   bool          // G-code is already a whole plate: every copy is printed alone
+	Quantity int
+	DueAt    *time.Time
+	Since    time.Time // When the order was accepted, breaking ties between due dates
+}
+
+// @info Copies of one item printed on a plate
+type PlatePart struct {
+	OrderID  string `json:"order_id"`
+	Item     int    `json:"item"`
+	Run      int    `json:"run"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+}
+
+// @info A batch of parts printed together on one printer
+type Plate struct {
+	PrinterID string
+	Material  string
+	Colour    string
+	Parts     []PlatePart
+	Seconds   float64
+	Grams     float64 // Filament of every copy, as far as known
+	Start     time.Time
+	End       time.Time
+	DueAt     *time.Time // Earliest due date of its parts
+	Late      bool       // Ends after DueAt
+}
+
+// @info Copies the planner could not place, and why
+type Unplaced struct {
+	OrderID  string `json:"order_id"`
+	Item     int    `json:"item"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+	Reason   string `json:"reason"`
+}
+
+type Options struct {
+	Hours          *Hours        // Plates only start while the shop is open. Nil is always open
+	Overnight      bool          // Whether plates may keep printing after closing time
+	MaxPlate       time.Duration // Longest plate batching may build. A single copy may still be longer
+	MaterialChange time.Duration // Added before a plate when the printer has another material or colour loaded
+	PackingFactor  float64       // Share of the bed area that can be filled with parts, 0.6 if zero
+	Now            time.Time
+}
+
+// @info Gap kept around each part on the bed, in mm
+const partSpacing = 5.0
+
+type batch struct {
+	plate    Plate
+	printers []int // Indexes of the printers that can print every part
+	area     float64
+	sliced   bool
+	index    map[partKey]int // Position of each part in plate.Parts
+}
+
+type partKey struct {
+	orderID string
+	item    int
+	run     int
+}
+
+// @info Plans the parts on the printers: earliest due date first, batching copies sharing material and colour while
+// they fit on the smallest bed they can use and the plate stays under MaxPlate, and giving each plate to the compatible
+// printer that finishes it first. Printers are not modified.
+func Plan(printers []Printer, parts []Part, opts Options) ([]Plate, []Unplaced) {
+	if opts.PackingFactor <= 0 {
+		opts.PackingFactor = 0.6
+	}
+	ordered := make([]Part, len(parts))
+	copy(ordered, parts)
+	sort.SliceStable(ordered, func(i, j int) bool { return before(&ordered[i], &ordered[j]) })
+
+	batches := []*batch{}
+	unplaced := []Unplaced{}
+	for _, part := range ordered {
+		if part.Quantity <= 0 {
+			continue
+		}
+		compatible := []int{}
+		for i := range printers {
+			if fits(&printers[i], &part) {
+				compatible = append(compatible, i)
+			}
+		}
+		if len(compatible) == 0 {
+			unplaced = append(unplaced, unplacedPart(&part, part.Quantity, incompatibility(printers, &part)))
+			continue
+		}
+		for copies := 0; copies < part.Quantity; copies++ {
+			if b := findBatch(batches, printers, &part, compatible, opts); b != nil {
+				b.add(&part, compatible)
+				continue
+			}
+			b := &batch{plate: Plate{Material: part.Material, Colour: part.Colour}, printers: compatible, sliced: part.Sliced, index: map[partKey]int{}}
+			b.add(&part, compatible)
+			batches = append(batches, b)
+		}
+	}
+
+	free := make([]Printer, len(printers))
+	copy(free, printers)
+	plates := []Plate{}
+	for _, b := range batches {
+		if !schedule(b, free, opts) {
+			for _, p := range b.plate.Parts {
+				unplaced = append(unplaced, Unplaced{OrderID: p.OrderID, Item: p.Item, Name: p.Name, Quantity: p.Quantity, Reason: "The shop is never open long enough for this plate"})
+			}
+			continue
+		}
+		plates = append(plates, b.plate)
+	}
+	sort.SliceStable(plates, func(i, j int) bool { return plates[i].Start.Before(plates[j].Start) })
+	return plates, unplaced
+}
+
+func before(a *Part, b *Part) bool {
+	switch {
+	case a.DueAt != nil && b.DueAt == nil:
+		return true
+	case a.DueAt == nil && b.DueAt != nil:
+		return false
+	case a.DueAt != nil && !a.DueAt.Equal(*b.DueAt):
+		return a.DueAt.Before(*b.DueAt)
+	case !a.Since.Equal(b.Since):
+		return a.Since.Before(b.Since)
+	case a.OrderID != b.OrderID:
+		return a.OrderID < b.OrderID
+	}
+	return a.Item < b.Item
+}
+
+// @info Whether the printer can print the part: material, nozzle and size, in either orientation on the bed
+func fits(printer *Printer, part *Part) bool {
+	return supportsMaterial(printer, part.Material) && hasNozzle(printer, part.Nozzle) && fitsVolume(printer.BuildVolume, part.Size)
+}
+
+func supportsMaterial(printer *Printer, material string) bool {
+	if material == "" {
+		return true
+	}
+	for _, supported := range printer.Materials {
+		if str.EqualFold(supported, material) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNozzle(printer *Printer, nozzle float64) bool {
+	if nozzle <= 0 || len(printer.Nozzles) == 0 {
+		return true
+	}
+	for _, diameter := range printer.Nozzles {
+		if math.Abs(diameter-nozzle) < 0.01 {
+			return true
+		}
+	}
+	return false
+}
+
+func fitsVolume(volume geometry.Vec3, size geometry.Vec3) bool {
+	if size.Z > volume.Z {
+		return false
+	}
+	return (size.X <= volume.X && size.Y <= volume.Y) || (size.Y <= volume.X && size.X <= volume.Y)
+}
+
+func incompatibility(printers []Printer, part *Part) string {
+	if len(printers) == 0 {
+		return "No printer is available"
+	}
+	material, nozzle := false, false
+	for i := range printers {
+		material = material || supportsMaterial(&printers[i], part.Material)
+		nozzle = nozzle || (supportsMaterial(&printers[i], part.Material) && hasNozzle(&printers[i], part.Nozzle))
+	}
+	switch {
+	case !material:
+		return "No available printer prints " + part.Material
+	case !nozzle:
+		return "No available printer has the nozzle it was sliced for"
+	}
+	return "It doesn't fit in any available printer"
+}
+
+func unplacedPart(part *Part, quantity int, reason string) Unplaced {
+	return Unplaced{OrderID: part.OrderID, Item: part.Item, Name: part.Name, Quantity: quantity, Reason: reason}
+}
+
+func footprint(size geometry.Vec3) float64 {
+	return (size.X + partSpacing) * (size.Y + partSpacing)
+}
+
+// @info The open batch a copy of the part can join, if any
+func findBatch(batches []*batch, printers []Printer, part *Part, compatible []int, opts Options) *batch {
+	if part.Sliced {
+		return nil
+	}
+	for _, b := range batches {
+		if b.sliced || !str.EqualFold(b.plate.Material, part.Material) || !str.EqualFold(b.plate.Colour, part.Colour) {
+			continue
+		}
+		if opts.MaxPlate > 0 && b.plate.Seconds+part.Seconds > opts.MaxPlate.Seconds() {
+			continue
+		}
+		shared := intersect(b.printers, compatible)
+		if len(shared) == 0 {
+			continue
+		}
+		if b.area+footprint(part.Size) > smallestBed(printers, shared)*opts.PackingFactor {
+			continue
+		}
+		return b
+	}
+	return nil
+}
+
+func (b *batch) add(part *Part, compatible []int) {
+	b.printers = intersect(b.printers, compatible)
+	b.area += footprint(part.Size)
+	b.plate.Seconds += part.Seconds
+	b.plate.Grams += part.Grams
+	if part.DueAt != nil && (b.plate.DueAt == nil || part.DueAt.Before(*b.plate.DueAt)) {
+		due := *part.DueAt
+		b.plate.DueAt = &due
+	}
+	key := partKey{orderID: part.OrderID, item: part.Item, run: part.Run}
+	if i, ok := b.index[key]; ok {
+		b.plate.Parts[i].Quantity++
+		return
+	}
+	b.index[key] = len(b.plate.Parts)
+	b.plate.Parts = append(b.plate.Parts, PlatePart{OrderID: part.OrderID, Item: part.Item, Run: part.Run, Name: part.Name, Quantity: 1})
+}
+
+func intersect(a []int, b []int) []int {
+	shared := []int{}
+	for _, i := range a {
+		for _, j := range b {
+			if i == j {
+				shared = append(shared, i)
+				break
+			}
+		}
+	}
+	return shared
+}
+
+func smallestBed(printers []Printer, indexes []int) float64 {
+	smallest := math.Inf(1)
+	for _, i := range indexes {
+		smallest = math.Min(smallest, printers[i].BuildVolume.X*printers[i].BuildVolume.Y)
+	}
+	return smallest
+}
+
+// @info Gives the plate to the printer that finishes it first, and books that printer until then
+func schedule(b *batch, printers []Printer, opts Options) bool {
+	duration := time.Duration(b.plate.Seconds * float64(time.Second))
+	best := -1
+	var bestStart, bestEnd time.Time
+	for _, i := range b.printers {
+		printer := &printers[i]
+		ready := opts.Now
+		if printer.FreeAt.After(ready) {
+			ready = printer.FreeAt
+		}
+		if needsChange(printer, &b.plate) {
+			ready = ready.Add(opts.MaterialChange)
+		}
+		start, ok := opts.Hours.NextStart(ready, duration, opts.Overnight)
+		if !ok {
+			continue
+		}
+		end := start.Add(duration)
+		if best < 0 || end.Before(bestEnd) {
+			best, bestStart, bestEnd = i, start, end
+		}
+	}
+	if best < 0 {
+		return false
+	}
+	printer := &printers[best]
+	printer.FreeAt = bestEnd
+	printer.Loaded = b.plate.Material
+	if b.plate.Colour != "" {
+		printer.LoadedColour = b.plate.Colour
+	}
+	b.plate.PrinterID = printer.ID
+	b.plate.Start, b.plate.End = bestStart, bestEnd
+	b.plate.Late = b.plate.DueAt != nil && bestEnd.After(*b.plate.DueAt)
+	return true
+}
+
+func needsChange(printer *Printer, plate *Plate) bool {
+	if printer.Loaded == "" || plate.Material == "" {
+		return false
+	}
+	if !str.EqualFold(printer.Loaded, plate.Material) {
+		return true
+	}
+	return plate.Colour != "" && printer.LoadedColour != "" && !str.EqualFold(printer.LoadedColour, plate.Colour)
+}
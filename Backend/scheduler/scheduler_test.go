@@ -0,0 +1,268 @@
+package scheduler_test
+
+import (
+	"3DQuest/geometry"
+	"3DQuest/scheduler"
+	"testing"
+	"time"
+)
+
+var madrid, _ = time.LoadLocation("Europe/Madrid")
+
+// @info 19 October 2026 is a Monday
+func at(day int, hour int, minute int) time.Time {
+	return time.Date(2026, time.October, day, hour, minute, 0, 0, madrid)
+}
+
+func shopHours(t *testing.T) *scheduler.Hours {
+	t.Helper()
+	hours, err := scheduler.ParseHours([]string{"mon-fri 09:00-14:00 16:00-20:00", "sat 10:00-14:00"}, "Europe/Madrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hours
+}
+
+func TestParseHours(t *testing.T) {
+	for _, spec := range []string{"mon", "mond 09:00-14:00", "mon-xyz 09:00-14:00", "mon 09:00", "mon 9-14", "mon 25:00-26:00", "mon 24:30-10:00", "mon 09:60-10:00"} {
+		if _, err := scheduler.ParseHours([]string{spec}, "UTC"); err == nil {
+			t.Errorf("ParseHours(%q) did not fail", spec)
+		}
+	}
+	if _, err := scheduler.ParseHours(nil, "Europe/Nowhere"); err == nil {
+		t.Error("ParseHours with an unknown time zone did not fail")
+	}
+	// @info Day ranges wrap around the week, and spans ending before they start run until midnight
+	hours, err := scheduler.ParseHours([]string{"fri-mon 22:00-02:00"}, "Europe/Madrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		at   time.Time
+		open bool
+	}{{at(24, 23, 0), true}, {at(26, 22, 0), true}, {at(21, 23, 0), false}, {at(24, 1, 0), false}} {
+		if open := hours.Open(c.at); open != c.open {
+			t.Errorf("Open(%s) = %v, want %v", c.at.Format(time.RFC1123), open, c.open)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	hours := shopHours(t)
+	cases := []struct {
+		at   time.Time
+		open bool
+	}{
+		{at(19, 9, 0), true},
+		{at(19, 8, 59), false},
+		{at(19, 13, 59), true},
+		{at(19, 14, 0), false},
+		{at(19, 17, 0), true},
+		{at(24, 11, 0), true},
+		{at(24, 16, 0), false},
+		{time.Date(2026, time.October, 19, 7, 30, 0, 0, time.UTC), true}, // @info 09:30 in Madrid
+	}
+	for _, c := range cases {
+		if open := hours.Open(c.at); open != c.open {
+			t.Errorf("Open(%s) = %v, want %v", c.at.Format(time.RFC1123), open, c.open)
+		}
+	}
+	var always *scheduler.Hours
+	if !always.Open(at(25, 3, 0)) {
+		t.Error("nil hours are closed")
+	}
+}
+
+func TestNextStart(t *testing.T) {
+	hours := shopHours(t)
+	cases := []struct {
+		name      string
+		from      time.Time
+		hours     float64
+		overnight bool
+		start     time.Time
+		ok        bool
+	}{
+		{"open and fits", at(19, 9, 30), 2, false, at(19, 9, 30), true},
+		{"waits for the afternoon", at(19, 13, 0), 3, false, at(19, 16, 0), true},
+		{"overnight starts now", at(19, 13, 0), 3, true, at(19, 13, 0), true},
+		{"before opening", at(20, 6, 0), 1, false, at(20, 9, 0), true},
+		{"saturday morning", at(23, 19, 0), 2, false, at(24, 10, 0), true},
+		{"too long for saturday", at(23, 19, 0), 4.5, false, at(26, 9, 0), true},
+		{"longer than any opening", at(19, 9, 0), 6, false, time.Time{}, false},
+		{"long plates print overnight", at(19, 21, 0), 30, true, at(20, 9, 0), true},
+	}
+	for _, c := range cases {
+		start, ok := hours.NextStart(c.from, time.Duration(c.hours*float64(time.Hour)), c.overnight)
+		if ok != c.ok || !start.Equal(c.start) {
+			t.Errorf("%s: NextStart = %s %v, want %s %v", c.name, start, ok, c.start, c.ok)
+		}
+	}
+	var always *scheduler.Hours
+	if start, ok := always.NextStart(at(25, 3, 0), 100*time.Hour, false); !ok || !start.Equal(at(25, 3, 0)) {
+		t.Errorf("NextStart of nil hours = %s %v, want now", start, ok)
+	}
+}
+
+func printer(id string, materials ...string) scheduler.Printer {
+	return scheduler.Printer{ID: id, BuildVolume: geometry.Vec3{X: 250, Y: 210, Z: 220}, Nozzles: []float64{0.4}, Materials: materials}
+}
+
+func part(order string, material string, colour string, quantity int, hours float64) scheduler.Part {
+	return scheduler.Part{
+		OrderID:  order,
+		Name:     order,
+		Material: material,
+		Colour:   colour,
+		Size:     geometry.Vec3{X: 40, Y: 40, Z: 40},
+		Seconds:  hours * 3600,
+		Grams:    10,
+		Quantity: quantity,
+		Since:    at(19, 8, 0),
+	}
+}
+
+func TestPlanBatches(t *testing.T) {
+	now := at(19, 9, 0)
+	printers := []scheduler.Printer{printer("p1", "PLA")}
+	sliced := part("c", "PLA", "red", 2, 1)
+	sliced.Sliced = true
+	parts := []scheduler.Part{part("a", "PLA", "red", 3, 1), part("b", "pla", "RED", 1, 1), part("d", "PLA", "blue", 1, 1), sliced}
+	plates, unplaced := scheduler.Plan(printers, parts, scheduler.Options{Now: now})
+	if len(unplaced) != 0 {
+		t.Fatalf("unplaced = %+v", unplaced)
+	}
+	// @info One plate of red PLA with a and b, one per copy of the G-code, then one of blue
+	if len(plates) != 4 {
+		t.Fatalf("plates = %+v, want 4", plates)
+	}
+	red := plates[0]
+	if len(red.Parts) != 2 || red.Parts[0].Quantity != 3 || red.Parts[1].Quantity != 1 || red.Seconds != 4*3600 || red.Grams != 40 {
+		t.Errorf("red plate = %+v", red)
+	}
+	for i, plate := range plates {
+		if plate.PrinterID != "p1" {
+			t.Errorf("plate %d on %s", i, plate.PrinterID)
+		}
+		if i > 0 && plate.Start.Before(plates[i-1].End) {
+			t.Errorf("plate %d starts at %s, before the previous one ends", i, plate.Start)
+		}
+	}
+	for _, plate := range plates[1:3] {
+		if len(plate.Parts) != 1 || plate.Parts[0].OrderID != "c" || plate.Parts[0].Quantity != 1 {
+			t.Errorf("sliced plate = %+v", plate)
+		}
+	}
+	if plates[3].Colour != "blue" {
+		t.Errorf("last plate = %+v, want the blue one", plates[3])
+	}
+
+	// @info MaxPlate and the bed area limit the batches
+	plates, _ = scheduler.Plan(printers, []scheduler.Part{part("a", "PLA", "", 5, 1)}, scheduler.Options{Now: now, MaxPlate: 2 * time.Hour})
+	if len(plates) != 3 {
+		t.Errorf("plates under MaxPlate = %d, want 3", len(plates))
+	}
+	// @info With the spacing each copy takes 125 × 105 mm, two fill 60% of the bed
+	big := part("a", "PLA", "", 4, 1)
+	big.Size = geometry.Vec3{X: 120, Y: 100, Z: 10}
+	plates, _ = scheduler.Plan(printers, []scheduler.Part{big}, scheduler.Options{Now: now})
+	if len(plates) != 2 {
+		t.Errorf("plates of big parts = %d, want 2", len(plates))
+	}
+}
+
+func TestPlanOrder(t *testing.T) {
+	now := at(19, 9, 0)
+	printers := []scheduler.Printer{printer("p1", "PLA")}
+	due := at(19, 12, 0)
+	urgent := part("urgent", "PLA", "blue", 1, 2)
+	urgent.DueAt = &due
+	older := part("older", "PLA", "red", 1, 2)
+	older.Since = at(18, 8, 0)
+	plates, _ := scheduler.Plan(printers, []scheduler.Part{part("newer", "PLA", "green", 1, 2), older, urgent}, scheduler.Options{Now: now})
+	if len(plates) != 3 {
+		t.Fatalf("plates = %+v", plates)
+	}
+	for i, want := range []string{"urgent", "older", "newer"} {
+		if plates[i].Parts[0].OrderID != want {
+			t.Errorf("plate %d is %s, want %s", i, plates[i].Parts[0].OrderID, want)
+		}
+	}
+	if plates[0].Late || plates[0].DueAt == nil || !plates[0].End.Equal(at(19, 11, 0)) {
+		t.Errorf("urgent plate = %+v", plates[0])
+	}
+
+	late := at(19, 10, 0)
+	urgent.DueAt = &late
+	plates, _ = scheduler.Plan(printers, []scheduler.Part{urgent}, scheduler.Options{Now: now})
+	if !plates[0].Late {
+		t.Errorf("plate ending after its due date is not late: %+v", plates[0])
+	}
+}
+
+func TestPlanPrinters(t *testing.T) {
+	now := at(19, 9, 0)
+	busy := printer("busy", "PLA", "PETG")
+	busy.FreeAt = at(19, 12, 0)
+	loaded := printer("loaded", "PLA", "PETG")
+	loaded.Loaded, loaded.LoadedColour = "PETG", "black"
+	printers := []scheduler.Printer{busy, loaded}
+
+	plates, _ := scheduler.Plan(printers, []scheduler.Part{part("a", "PLA", "", 1, 1)}, scheduler.Options{Now: now, MaterialChange: 30 * time.Minute})
+	if plates[0].PrinterID != "loaded" || !plates[0].Start.Equal(at(19, 9, 30)) {
+		t.Errorf("plate = %+v, want on loaded after changing the filament", plates[0])
+	}
+	plates, _ = scheduler.Plan(printers, []scheduler.Part{part("a", "PLA", "", 1, 1)}, scheduler.Options{Now: now, MaterialChange: 4 * time.Hour})
+	if plates[0].PrinterID != "busy" || !plates[0].Start.Equal(at(19, 12, 0)) {
+		t.Errorf("plate = %+v, want on busy when it is free", plates[0])
+	}
+	plates, _ = scheduler.Plan(printers, []scheduler.Part{part("a", "PETG", "black", 1, 1)}, scheduler.Options{Now: now, MaterialChange: 4 * time.Hour})
+	if plates[0].PrinterID != "loaded" || !plates[0].Start.Equal(now) {
+		t.Errorf("plate = %+v, want on loaded straight away", plates[0])
+	}
+	if printers[0].FreeAt != at(19, 12, 0) || printers[1].Loaded != "PETG" {
+		t.Error("Plan modified the printers")
+	}
+
+	plates, _ = scheduler.Plan(printers, []scheduler.Part{part("a", "PLA", "", 1, 1)}, scheduler.Options{Now: at(19, 19, 0), Hours: shopHours(t)})
+	if !plates[0].Start.Equal(at(19, 19, 0)) {
+		t.Errorf("plate = %+v, want it to start before closing", plates[0])
+	}
+	plates, _ = scheduler.Plan(printers, []scheduler.Part{part("a", "PLA", "", 1, 1.5)}, scheduler.Options{Now: at(19, 19, 0), Hours: shopHours(t)})
+	if !plates[0].Start.Equal(at(20, 9, 0)) {
+		t.Errorf("plate = %+v, want it to wait for the next morning", plates[0])
+	}
+}
+
+func TestPlanUnplaced(t *testing.T) {
+	now := at(19, 9, 0)
+	printers := []scheduler.Printer{printer("p1", "PLA")}
+	nozzle := part("nozzle", "PLA", "", 1, 1)
+	nozzle.Nozzle = 0.6
+	tall := part("tall", "PLA", "", 2, 1)
+	tall.Size = geometry.Vec3{X: 10, Y: 10, Z: 300}
+	long := part("long", "PLA", "", 1, 7)
+	cases := []struct {
+		printers []scheduler.Printer
+		part     scheduler.Part
+		reason   string
+	}{
+		{nil, part("a", "PLA", "", 1, 1), "No printer is available"},
+		{printers, part("petg", "PETG", "", 1, 1), "No available printer prints PETG"},
+		{printers, nozzle, "No available printer has the nozzle it was sliced for"},
+		{printers, tall, "It doesn't fit in any available printer"},
+		{printers, long, "The shop is never open long enough for this plate"},
+	}
+	for _, c := range cases {
+		plates, unplaced := scheduler.Plan(c.printers, []scheduler.Part{c.part}, scheduler.Options{Now: now, Hours: shopHours(t)})
+		if len(plates) != 0 || len(unplaced) != 1 || unplaced[0].Reason != c.reason || unplaced[0].Quantity != c.part.Quantity {
+			t.Errorf("%s: plates %+v, unplaced %+v, want %q", c.part.OrderID, plates, unplaced, c.reason)
+		}
+	}
+	// @info A part rotated on the bed still fits
+	wide := part("wide", "PLA", "", 1, 1)
+	wide.Size = geometry.Vec3{X: 200, Y: 240, Z: 10}
+	if plates, _ := scheduler.Plan(printers, []scheduler.Part{wide}, scheduler.Options{Now: now}); len(plates) != 1 {
+		t.Errorf("rotated part not planned")
+	}
+}
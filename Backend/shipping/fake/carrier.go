@@ -0,0 +1,188 @@
+package fake
+
+import (
+	"3DQuest/pdf"
+	"3DQuest/shipping"
+	"context"
+	"errors"
+	"fmt"
+	str "strings"
+	"sync"
+	"time"
+)
+
+var errPickedUp = errors.New("The parcel was already picked up")
+
+// @info How a parcel moves on when nothing goes wrong
+var route = []shipping.Event{
+	{Status: shipping.StatusLabelCreated, Description: "Label created"},
+	{Status: shipping.StatusInTransit, Description: "Picked up", Location: "Origin depot"},
+	{Status: shipping.StatusOutForDelivery, Description: "Out for delivery", Location: "Destination depot"},
+	{Status: shipping.StatusDelivered, Description: "Delivered"},
+}
+
+type parcel struct {
+	req     shipping.LabelRequest
+	created time.Time
+	events  []shipping.Event
+	next    int // Step of the route the parcel goes to next
+}
+
+// @info A carrier that keeps its parcels in memory, for the tests and to try shipping without a carrier account.
+// Parcels move on along the route every Step after their label is created, or when told with Advance.
+type Carrier struct {
+	Step    time.Duration // 0 to only move parcels with Advance
+	mu      sync.Mutex
+	parcels map[string]*parcel
+	count   int
+}
+
+func New(step time.Duration) *Carrier {
+	return &Carrier{Step: step, parcels: map[string]*parcel{}}
+}
+
+func (c *Carrier) Name() string {
+	return "fake"
+}
+
+func (c *Carrier) CreateLabel(ctx context.Context, req *shipping.LabelRequest) (*shipping.Label, error) {
+	if req.To.Name == "" || req.To.Line1 == "" || req.To.City == "" || req.To.PostalCode == "" || req.To.Country == "" {
+		return nil, errors.New("The address is incomplete")
+	}
+	if req.Parcel.WeightGrams <= 0 {
+		return nil, errors.New("The parcel must weigh something")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count++
+	number := fmt.Sprintf("FK%010d", c.count)
+	p := &parcel{req: *req, created: time.Now().UTC()}
+	c.parcels[number] = p
+	c.move(p, p.created)
+	label, err := renderLabel(number, req)
+	if err != nil {
+		return nil, err
+	}
+	return &shipping.Label{TrackingNumber: number, TrackingURL: "https://fake.invalid/track/" + number, ContentType: "application/pdf", Data: label}, nil
+}
+
+func (c *Carrier) CancelLabel(ctx context.Context, trackingNumber string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, err := c.parcel(trackingNumber)
+	if err != nil {
+		return err
+	}
+	if p.events[len(p.events)-1].Status != shipping.StatusLabelCreated {
+		return errPickedUp
+	}
+	delete(c.parcels, trackingNumber)
+	return nil
+}
+
+func (c *Carrier) Track(ctx context.Context, trackingNumber string) ([]shipping.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, err := c.parcel(trackingNumber)
+	if err != nil {
+		return nil, err
+	}
+	return append([]shipping.Event{}, p.events...), nil
+}
+
+// @info Moves the parcel to the next step of its route now
+func (c *Carrier) Advance(trackingNumber string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, err := c.parcel(trackingNumber)
+	if err != nil {
+		return err
+	}
+	c.move(p, time.Now().UTC())
+	return nil
+}
+
+// @info Adds an event off the route, e.g. an exception or a return. A parcel returned does not move on anymore.
+func (c *Carrier) Report(trackingNumber string, status shipping.Status, description string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, err := c.parcel(trackingNumber)
+	if err != nil {
+		return err
+	}
+	p.events = append(p.events, shipping.Event{Status: status, Description: description, At: time.Now().UTC()})
+	if status.Final() {
+		p.next = len(route)
+	}
+	return nil
+}
+
+// @info The parcel with the steps due by now taken. Must be called with the lock held.
+func (c *Carrier) parcel(trackingNumber string) (*parcel, error) {
+	p, ok := c.parcels[trackingNumber]
+	if !ok {
+		return nil, shipping.ErrUnknownTracking
+	}
+	if c.Step > 0 {
+		now := time.Now().UTC()
+		for p.next < len(route) {
+			due := p.created.Add(time.Duration(p.next) * c.Step)
+			if due.After(now) {
+				break
+			}
+			c.move(p, due)
+		}
+	}
+	return p, nil
+}
+
+func (c *Carrier) move(p *parcel, at time.Time) {
+	if p.next >= len(route) {
+		return
+	}
+	event := route[p.next]
+	event.At = at
+	if event.Location == "" && event.Status == shipping.StatusDelivered {
+		event.Location = p.req.To.City
+	}
+	p.events = append(p.events, event)
+	p.next++
+}
+
+// @info A label with the addresses and the tracking number, as the carrier would print it
+func renderLabel(number string, req *shipping.LabelRequest) ([]byte, error) {
+	doc := pdf.New()
+	doc.Title = "Label " + number
+	doc.Author = "Fake carrier"
+	page := doc.AddPage()
+	top := pdf.PageHeight - 60
+	page.Line(40, top+20, 320, top+20, 1)
+	page.Text(48, top, pdf.HelveticaBold, 12, "FAKE CARRIER · "+str.ToUpper(req.Service))
+	y := top - 30
+	for _, block := range []struct {
+		title   string
+		address shipping.Address
+	}{{"FROM", req.From}, {"TO", req.To}} {
+		page.Text(48, y, pdf.HelveticaBold, 8, block.title)
+		y -= 14
+		lines := []string{block.address.Name, block.address.Line1, block.address.Line2, block.address.PostalCode + " " + block.address.City, block.address.Province, block.address.Country, block.address.Phone}
+		for _, line := range lines {
+			if str.TrimSpace(line) == "" {
+				continue
+			}
+			size := 9.0
+			if block.title == "TO" {
+				size = 12
+			}
+			page.Text(48, y, pdf.Helvetica, size, line)
+			y -= size + 3
+		}
+		y -= 10
+	}
+	page.Text(48, y, pdf.Helvetica, 9, fmt.Sprintf("%d g · %d × %d × %d mm · Ref. %s", req.Parcel.WeightGrams, req.Parcel.LengthMM, req.Parcel.WidthMM, req.Parcel.HeightMM, req.Reference))
+	y -= 40
+	page.FillRect(48, y, 264, 28, 0)
+	page.Text(48, y-16, pdf.HelveticaBold, 16, number)
+	page.Line(40, y-30, 320, y-30, 1)
+	return doc.Bytes()
+}
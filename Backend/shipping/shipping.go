@@ -0,0 +1,175 @@
+package shipping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// @info Where a parcel goes, or where it comes from
+type Address struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	PostalCode string `json:"postal_code"`
+	Province   string `json:"province,omitempty"`
+	Country    string `json:"country"`         // ISO 3166-1 alpha-2, e.g. ES
+	Phone      string `json:"phone,omitempty"` // For the courier
+}
+
+// @info A packed parcel. Sides are in mm and in any order.
+type Parcel struct {
+	WeightGrams int `json:"weight_grams"`
+	LengthMM    int `json:"length_mm"`
+	WidthMM     int `json:"width_mm"`
+	HeightMM    int `json:"height_mm"`
+}
+
+// @info The sides, longest first
+func (p Parcel) Sides() [3]int {
+	sides := []int{p.LengthMM, p.WidthMM, p.HeightMM}
+	sort.Sort(sort.Reverse(sort.IntSlice(sides)))
+	return [3]int{sides[0], sides[1], sides[2]}
+}
+
+// @info Weight charged for the parcel: its own or, if larger, the volumetric weight of its size, which is its volume in
+// cm³ divided by volumetricDivisor kilograms. A zero divisor only charges the weight.
+func (p Parcel) BillableGrams(volumetricDivisor int) int {
+	if volumetricDivisor <= 0 {
+		return p.WeightGrams
+	}
+	cm3 := float64(p.LengthMM) * float64(p.WidthMM) * float64(p.HeightMM) / 1000
+	volumetric := int(math.Ceil(cm3 / float64(volumetricDivisor) * 1000))
+	if volumetric > p.WeightGrams {
+		return volumetric
+	}
+	return p.WeightGrams
+}
+
+type RateBracket struct {
+	MaxGrams   int   `json:"max_grams"`
+	PriceCents int64 `json:"price_cents"` // VAT included
+}
+
+// @info Prices of a parcel service by billable weight, and the largest parcel it takes
+type RateTable struct {
+	VolumetricDivisor int           `json:"volumetric_divisor"` // cm³ per kg, e.g. 5000. 0 to charge only the weight
+	MaxLengthMM       int           `json:"max_length_mm"`      // Longest side, 0 for no limit
+	MaxGirthMM        int           `json:"max_girth_mm"`       // Longest side plus twice the other two, 0 for no limit
+	Brackets          []RateBracket `json:"brackets"`           // From the lightest, the first the weight fits in is charged
+}
+
+var (
+	ErrTooHeavy        = errors.New("The parcel is too heavy for the service")
+	ErrTooLarge        = errors.New("The parcel is too large for the service")
+	ErrUnknownTracking = errors.New("The carrier does not know the tracking number")
+)
+
+// @info Lists every inconsistency of the table
+func (t *RateTable) Check() []string {
+	problems := []string{}
+	if t.VolumetricDivisor < 0 {
+		problems = append(problems, "volumetric_divisor must be at least 0")
+	}
+	if t.MaxLengthMM < 0 || t.MaxGirthMM < 0 {
+		problems = append(problems, "max_length_mm and max_girth_mm must be at least 0")
+	}
+	if len(t.Brackets) == 0 {
+		problems = append(problems, "brackets must have at least 1 elements")
+	}
+	for i, bracket := range t.Brackets {
+		if bracket.MaxGrams <= 0 || (i > 0 && bracket.MaxGrams <= t.Brackets[i-1].MaxGrams) {
+			problems = append(problems, fmt.Sprintf("brackets.%d.max_grams must be positive and larger than the one before", i))
+		}
+		if bracket.PriceCents < 0 {
+			problems = append(problems, fmt.Sprintf("brackets.%d.price_cents must be at least 0", i))
+		}
+	}
+	return problems
+}
+
+// @info Price of sending the parcel
+// @error ErrTooHeavy or ErrTooLarge if the service does not take it
+func (t *RateTable) Price(parcel Parcel) (int64, error) {
+	sides := parcel.Sides()
+	if (t.MaxLengthMM > 0 && sides[0] > t.MaxLengthMM) || (t.MaxGirthMM > 0 && sides[0]+2*(sides[1]+sides[2]) > t.MaxGirthMM) {
+		return 0, ErrTooLarge
+	}
+	grams := parcel.BillableGrams(t.VolumetricDivisor)
+	for _, bracket := range t.Brackets {
+		if grams <= bracket.MaxGrams {
+			return bracket.PriceCents, nil
+		}
+	}
+	return 0, ErrTooHeavy
+}
+
+// @info Where a parcel is, as reported by the carrier
+type Status string
+
+const (
+	StatusLabelCreated   Status = "label_created" // Waiting for the carrier to pick it up
+	StatusInTransit      Status = "in_transit"
+	StatusOutForDelivery Status = "out_for_delivery"
+	StatusDelivered      Status = "delivered"
+	StatusException      Status = "exception" // e.g. nobody was home, the carrier tries again
+	StatusReturned       Status = "returned"  // Sent back to the sender
+)
+
+var statuses = []Status{StatusLabelCreated, StatusInTransit, StatusOutForDelivery, StatusDelivered, StatusException, StatusReturned}
+
+func IsStatus(status Status) bool {
+	for _, known := range statuses {
+		if known == status {
+			return true
+		}
+	}
+	return false
+}
+
+// @info Whether the carrier has the parcel or had it
+func (s Status) Dispatched() bool {
+	return IsStatus(s) && s != StatusLabelCreated
+}
+
+// @info Whether nothing else will happen to the parcel
+func (s Status) Final() bool {
+	return s == StatusDelivered || s == StatusReturned
+}
+
+type Event struct {
+	Status      Status    `json:"status"`
+	Description string    `json:"description,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+type LabelRequest struct {
+	Reference string // Ours, printed on the label
+	Service   string
+	From      Address
+	To        Address
+	Parcel    Parcel
+}
+
+type Label struct {
+	TrackingNumber string
+	TrackingURL    string // Where customers can follow the parcel, if the carrier has such a page
+	ContentType    string // Of Data, e.g. application/pdf
+	Data           []byte
+}
+
+// @info Sends parcels. Every call honours the context's deadline.
+type Carrier interface {
+	Name() string
+	CreateLabel(ctx context.Context, req *LabelRequest) (*Label, error)
+	// @info Voids a label the carrier has not picked up yet
+	CancelLabel(ctx context.Context, trackingNumber string) error
+	// @info Every event of the parcel so far, oldest first
+	// @error ErrUnknownTracking
+	Track(ctx context.Context, trackingNumber string) ([]Event, error)
+}
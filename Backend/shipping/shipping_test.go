@@ -0,0 +1,146 @@
+package shipping_test
+
+import (
+	"3DQuest/shipping"
+	"3DQuest/shipping/fake"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var table = shipping.RateTable{
+	VolumetricDivisor: 5000,
+	MaxLengthMM:       1000,
+	MaxGirthMM:        3000,
+	Brackets: []shipping.RateBracket{
+		{MaxGrams: 1000, PriceCents: 495},
+		{MaxGrams: 5000, PriceCents: 795},
+		{MaxGrams: 10000, PriceCents: 1295},
+	},
+}
+
+func TestPrice(t *testing.T) {
+	cases := []struct {
+		name   string
+		parcel shipping.Parcel
+		cents  int64
+		err    error
+	}{
+		{"light and small", shipping.Parcel{WeightGrams: 300, LengthMM: 100, WidthMM: 100, HeightMM: 100}, 495, nil},
+		{"bracket edge", shipping.Parcel{WeightGrams: 1000, LengthMM: 100, WidthMM: 100, HeightMM: 100}, 495, nil},
+		// 400 × 300 × 200 mm is 24000 cm³, 4.8 kg at 5000 cm³/kg
+		{"light but bulky", shipping.Parcel{WeightGrams: 500, LengthMM: 200, WidthMM: 400, HeightMM: 300}, 795, nil},
+		{"too heavy", shipping.Parcel{WeightGrams: 10001, LengthMM: 100, WidthMM: 100, HeightMM: 100}, 0, shipping.ErrTooHeavy},
+		{"too long", shipping.Parcel{WeightGrams: 100, LengthMM: 50, WidthMM: 1001, HeightMM: 50}, 0, shipping.ErrTooLarge},
+		{"too much girth", shipping.Parcel{WeightGrams: 100, LengthMM: 1000, WidthMM: 600, HeightMM: 500}, 0, shipping.ErrTooLarge},
+	}
+	for _, c := range cases {
+		cents, err := table.Price(c.parcel)
+		if !errors.Is(err, c.err) || cents != c.cents {
+			t.Errorf("%s: Price = %d, %v, want %d, %v", c.name, cents, err, c.cents, c.err)
+		}
+	}
+}
+
+func TestBillableGramsWithoutDivisor(t *testing.T) {
+	parcel := shipping.Parcel{WeightGrams: 500, LengthMM: 400, WidthMM: 300, HeightMM: 200}
+	if grams := parcel.BillableGrams(0); grams != 500 {
+		t.Errorf("BillableGrams(0) = %d, want 500", grams)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if problems := table.Check(); len(problems) != 0 {
+		t.Errorf("Check = %v, want none", problems)
+	}
+	bad := shipping.RateTable{
+		VolumetricDivisor: -1,
+		Brackets:          []shipping.RateBracket{{MaxGrams: 1000, PriceCents: 495}, {MaxGrams: 1000, PriceCents: -1}},
+	}
+	if problems := bad.Check(); len(problems) != 3 {
+		t.Errorf("Check = %v, want 3 problems", problems)
+	}
+	if problems := (&shipping.RateTable{}).Check(); len(problems) != 1 {
+		t.Errorf("Check of an empty table = %v, want 1 problem", problems)
+	}
+}
+
+func label(t *testing.T, carrier *fake.Carrier) *shipping.Label {
+	t.Helper()
+	address := shipping.Address{Name: "Ana García", Line1: "Calle Mayor 1", City: "Madrid", PostalCode: "28013", Country: "ES"}
+	label, err := carrier.CreateLabel(context.Background(), &shipping.LabelRequest{
+		Reference: "order:1",
+		Service:   "standard",
+		From:      address,
+		To:        address,
+		Parcel:    shipping.Parcel{WeightGrams: 350, LengthMM: 120, WidthMM: 120, HeightMM: 80},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label.TrackingNumber == "" || label.ContentType != "application/pdf" || !bytes.HasPrefix(label.Data, []byte("%PDF-")) {
+		t.Fatalf("label = %s %s %.8q", label.TrackingNumber, label.ContentType, label.Data)
+	}
+	return label
+}
+
+func lastStatus(t *testing.T, carrier shipping.Carrier, tracking string) shipping.Status {
+	t.Helper()
+	events, err := carrier.Track(context.Background(), tracking)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events[len(events)-1].Status
+}
+
+func TestFakeCarrierLifecycle(t *testing.T) {
+	carrier := fake.New(0)
+	ctx := context.Background()
+	tracking := label(t, carrier).TrackingNumber
+	if status := lastStatus(t, carrier, tracking); status != shipping.StatusLabelCreated {
+		t.Fatalf("status = %s, want %s", status, shipping.StatusLabelCreated)
+	}
+	for _, want := range []shipping.Status{shipping.StatusInTransit, shipping.StatusOutForDelivery, shipping.StatusDelivered, shipping.StatusDelivered} {
+		if err := carrier.Advance(tracking); err != nil {
+			t.Fatal(err)
+		}
+		if status := lastStatus(t, carrier, tracking); status != want {
+			t.Fatalf("status = %s, want %s", status, want)
+		}
+	}
+	if err := carrier.CancelLabel(ctx, tracking); err == nil {
+		t.Fatal("a delivered parcel's label was cancelled")
+	}
+
+	cancelled := label(t, carrier).TrackingNumber
+	if err := carrier.CancelLabel(ctx, cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := carrier.Track(ctx, cancelled); !errors.Is(err, shipping.ErrUnknownTracking) {
+		t.Fatalf("Track of a cancelled label = %v, want ErrUnknownTracking", err)
+	}
+}
+
+func TestFakeCarrierReturn(t *testing.T) {
+	carrier := fake.New(0)
+	tracking := label(t, carrier).TrackingNumber
+	carrier.Advance(tracking)
+	if err := carrier.Report(tracking, shipping.StatusReturned, "Refused"); err != nil {
+		t.Fatal(err)
+	}
+	carrier.Advance(tracking)
+	if status := lastStatus(t, carrier, tracking); status != shipping.StatusReturned {
+		t.Fatalf("status = %s, want %s", status, shipping.StatusReturned)
+	}
+}
+
+func TestFakeCarrierSteps(t *testing.T) {
+	carrier := fake.New(time.Millisecond)
+	tracking := label(t, carrier).TrackingNumber
+	time.Sleep(5 * time.Millisecond)
+	if status := lastStatus(t, carrier, tracking); status != shipping.StatusDelivered {
+		t.Fatalf("status = %s, want %s", status, shipping.StatusDelivered)
+	}
+}
@@ -0,0 +1,171 @@
+package taxid
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	str "strings"
+)
+
+// @info Kind of tax identification number
+type Kind string
+
+const (
+	NIF   Kind = "nif"    // Spanish individuals: 8 digits and a check letter. Also K, L and M followed by 7 digits and a letter
+	NIE   Kind = "nie"    // Foreigners resident in Spain: X, Y or Z, 7 digits and a check letter
+	CIF   Kind = "cif"    // Spanish companies and organisations: a letter, 7 digits and a check digit or letter
+	EUVAT Kind = "eu_vat" // VAT number of a company in another EU country, e.g. FR12345678901
+)
+
+var (
+	ErrEmpty       = errors.New("The tax ID is empty")
+	ErrFormat      = errors.New("The tax ID doesn't look like a NIF, NIE, CIF or EU VAT number")
+	ErrCheckDigit  = errors.New("The check digit of the tax ID is wrong")
+	ErrUnknownKind = errors.New("Unknown kind of tax ID")
+)
+
+// @info A parsed and normalized tax ID
+type TaxID struct {
+	Kind    Kind   `json:"kind"`
+	Country string `json:"country"` // ISO 3166-1 alpha-2, except Greece which is EL as in VAT numbers
+	Value   string `json:"value"`   // Normalized, without the country prefix for Spanish IDs
+}
+
+// @info A Spanish ID with the ES prefix, which is how it appears in intra-community invoices
+func (t *TaxID) VATNumber() string {
+	if t.Country == "ES" {
+		return "ES" + t.Value
+	}
+	return t.Value
+}
+
+func (t *TaxID) IsSpanish() bool {
+	return t.Country == "ES"
+}
+
+const nifLetters = "TRWAGMYFPDXBNJZSQVHLCKE"
+
+var (
+	nifPattern = regexp.MustCompile(`^[0-9]{8}[A-Z]$`)
+	klmPattern = regexp.MustCompile(`^[KLM][0-9]{7}[A-Z]$`)
+	niePattern = regexp.MustCompile(`^[XYZ][0-9]{7}[A-Z]$`)
+	cifPattern = regexp.MustCompile(`^[ABCDEFGHJNPQRSUVW][0-9]{7}[0-9A-J]$`)
+)
+
+// @info Uppercases and removes spaces, dashes, dots and slashes, e.g. " 12.345.678-z " becomes "12345678Z"
+func Normalize(id string) string {
+	return str.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '-', '.', '/', '_':
+			return -1
+		}
+		return r
+	}, str.ToUpper(str.TrimSpace(id)))
+}
+
+// @info Detects the kind of the ID and checks it. Spanish IDs may come with the ES prefix, which is removed.
+// @error ErrEmpty, ErrFormat or ErrCheckDigit
+func Parse(id string) (*TaxID, error) {
+	value := Normalize(id)
+	if value == "" {
+		return nil, ErrEmpty
+	}
+	if str.HasPrefix(value, "ES") && len(value) == 11 {
+		value = value[2:]
+	}
+	var err error
+	kind := Kind("")
+	switch {
+	case nifPattern.MatchString(value) || klmPattern.MatchString(value):
+		kind, err = NIF, checkNIF(value)
+	case niePattern.MatchString(value):
+		kind, err = NIE, checkNIE(value)
+	case cifPattern.MatchString(value):
+		kind, err = CIF, checkCIF(value)
+	default:
+		return parseVAT(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TaxID{Kind: kind, Country: "ES", Value: value}, nil
+}
+
+// @info Like Parse, but the ID must be of the given kind
+func ParseAs(kind Kind, id string) (*TaxID, error) {
+	switch kind {
+	case NIF, NIE, CIF, EUVAT:
+	default:
+		return nil, ErrUnknownKind
+	}
+	taxID, err := Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	if taxID.Kind != kind {
+		return nil, ErrFormat
+	}
+	return taxID, nil
+}
+
+func Valid(id string) bool {
+	_, err := Parse(id)
+	return err == nil
+}
+
+func checkNIF(value string) error {
+	digits := value[:8]
+	if value[0] == 'K' || value[0] == 'L' || value[0] == 'M' {
+		digits = value[1:8]
+	}
+	return checkLetter(digits, value[8])
+}
+
+func checkNIE(value string) error {
+	prefix := strconv.Itoa(str.IndexByte("XYZ", value[0]))
+	return checkLetter(prefix+value[1:8], value[8])
+}
+
+func checkLetter(digits string, letter byte) error {
+	number, err := strconv.Atoi(digits)
+	if err != nil {
+		return ErrFormat
+	}
+	if nifLetters[number%23] != letter {
+		return ErrCheckDigit
+	}
+	return nil
+}
+
+// @info https://es.wikipedia.org/wiki/C%C3%B3digo_de_identificaci%C3%B3n_fiscal#Letra_o_d%C3%ADgito_de_control
+func checkCIF(value string) error {
+	sum := 0
+	for i := 1; i <= 7; i++ {
+		digit := int(value[i] - '0')
+		if i%2 == 1 {
+			digit *= 2
+			digit = digit/10 + digit%10
+		}
+		sum += digit
+	}
+	control := (10 - sum%10) % 10
+	controlLetter := "JABCDEFGHI"[control]
+	controlDigit := byte('0' + control)
+
+	got := value[8]
+	switch value[0] {
+	case 'P', 'Q', 'R', 'S', 'N', 'W': // Public bodies, foreign and non-profit organisations always use a letter
+		if got != controlLetter {
+			return ErrCheckDigit
+		}
+	case 'A', 'B', 'E', 'H': // Companies always use a digit
+		if got != controlDigit {
+			return ErrCheckDigit
+		}
+	default:
+		if got != controlLetter && got != controlDigit {
+			return ErrCheckDigit
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package taxid_test
+
+import (
+	"3DQuest/taxid"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		id      string
+		kind    taxid.Kind
+		country string
+		value   string
+		err     error
+	}{
+		{"12345678Z", taxid.NIF, "ES", "12345678Z", nil},
+		{" 12.345.678-z ", taxid.NIF, "ES", "12345678Z", nil},
+		{"es 12345678z", taxid.NIF, "ES", "12345678Z", nil},
+		{"12345678A", "", "", "", taxid.ErrCheckDigit},
+		{"K1234567L", taxid.NIF, "ES", "K1234567L", nil},
+		{"m1234567l", taxid.NIF, "ES", "M1234567L", nil},
+		{"K1234567T", "", "", "", taxid.ErrCheckDigit},
+		{"X1234567L", taxid.NIE, "ES", "X1234567L", nil},
+		{"y-1234567-x", taxid.NIE, "ES", "Y1234567X", nil},
+		{"Z1234567R", taxid.NIE, "ES", "Z1234567R", nil},
+		{"Z1234567L", "", "", "", taxid.ErrCheckDigit},
+		{"B12345674", taxid.CIF, "ES", "B12345674", nil},
+		{" b-1234567-4\t", taxid.CIF, "ES", "B12345674", nil},
+		{"ESB12345674", taxid.CIF, "ES", "B12345674", nil},
+		{"B1234567D", "", "", "", taxid.ErrCheckDigit}, // Companies use a digit
+		{"B12345675", "", "", "", taxid.ErrCheckDigit},
+		{"P1234567D", taxid.CIF, "ES", "P1234567D", nil},
+		{"P12345674", "", "", "", taxid.ErrCheckDigit}, // Public bodies use a letter
+		{"C12345674", taxid.CIF, "ES", "C12345674", nil},
+		{"c1234567d", taxid.CIF, "ES", "C1234567D", nil},
+		{"FR12345678901", taxid.EUVAT, "FR", "FR12345678901", nil},
+		{"fr 12 345 678 901", taxid.EUVAT, "FR", "FR12345678901", nil},
+		{"GR123456789", taxid.EUVAT, "EL", "EL123456789", nil},
+		{"nl123456789b01", taxid.EUVAT, "NL", "NL123456789B01", nil},
+		{"DE12345678", "", "", "", taxid.ErrFormat},
+		{"US123456789", "", "", "", taxid.ErrFormat},
+		{"1234567Z", "", "", "", taxid.ErrFormat},
+		{" - ", "", "", "", taxid.ErrEmpty},
+		{"", "", "", "", taxid.ErrEmpty},
+	}
+	for _, c := range cases {
+		id, err := taxid.Parse(c.id)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Parse(%q) error = %v, want %v", c.id, err, c.err)
+			continue
+		}
+		if err != nil {
+			if id != nil || taxid.Valid(c.id) {
+				t.Errorf("Parse(%q) = %+v, want nothing", c.id, id)
+			}
+			continue
+		}
+		if id.Kind != c.kind || id.Country != c.country || id.Value != c.value {
+			t.Errorf("Parse(%q) = %+v, want %s %s %s", c.id, id, c.kind, c.country, c.value)
+		}
+	}
+}
+
+func TestParseAs(t *testing.T) {
+	if id, err := taxid.ParseAs(taxid.NIE, "x1234567l"); err != nil || id.Value != "X1234567L" {
+		t.Errorf("ParseAs(NIE) = %+v, %v", id, err)
+	}
+	if _, err := taxid.ParseAs(taxid.NIE, "12345678Z"); !errors.Is(err, taxid.ErrFormat) {
+		t.Errorf("ParseAs(NIE) of a NIF = %v, want ErrFormat", err)
+	}
+	if _, err := taxid.ParseAs(taxid.CIF, "B12345675"); !errors.Is(err, taxid.ErrCheckDigit) {
+		t.Errorf("ParseAs(CIF) of a wrong CIF = %v, want ErrCheckDigit", err)
+	}
+	if _, err := taxid.ParseAs("ssn", "12345678Z"); !errors.Is(err, taxid.ErrUnknownKind) {
+		t.Errorf("ParseAs of an unknown kind = %v, want ErrUnknownKind", err)
+	}
+}
+
+func TestVATNumber(t *testing.T) {
+	for id, want := range map[string]string{"12345678Z": "ES12345678Z", "B12345674": "ESB12345674", "FR12345678901": "FR12345678901"} {
+		parsed, err := taxid.Parse(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parsed.VATNumber(); got != want {
+			t.Errorf("VATNumber of %s = %s, want %s", id, got, want)
+		}
+		if parsed.IsSpanish() != (want[:2] == "ES") {
+			t.Errorf("IsSpanish of %s = %v", id, parsed.IsSpanish())
+		}
+	}
+}
+
+func TestIsEUCountry(t *testing.T) {
+	for country, want := range map[string]bool{"ES": true, "FR": true, "GR": true, "EL": true, "XI": false, "US": false, "GB": false} {
+		if got := taxid.IsEUCountry(country); got != want {
+			t.Errorf("IsEUCountry(%s) = %v, want %v", country, got, want)
+		}
+	}
+}
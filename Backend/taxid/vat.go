@@ -0,0 +1,61 @@
+package taxid
+
+import "regexp"
+
+// @info Format of the VAT numbers of every other EU member state (plus Northern Ireland), after the country prefix.
+// Only the format is checked, whether the number is registered has to be checked with VIES.
+// https://ec.europa.eu/taxation_customs/vies/faq.html#item_11
+var vatPatterns = map[string]*regexp.Regexp{
+	"AT": regexp.MustCompile(`^U[0-9]{8}$`),
+	"BE": regexp.MustCompile(`^[01][0-9]{9}$`),
+	"BG": regexp.MustCompile(`^[0-9]{9,10}$`),
+	"CY": regexp.MustCompile(`^[0-9]{8}[A-Z]$`),
+	"CZ": regexp.MustCompile(`^[0-9]{8,10}$`),
+	"DE": regexp.MustCompile(`^[0-9]{9}$`),
+	"DK": regexp.MustCompile(`^[0-9]{8}$`),
+	"EE": regexp.MustCompile(`^[0-9]{9}$`),
+	"EL": regexp.MustCompile(`^[0-9]{9}$`),
+	"FI": regexp.MustCompile(`^[0-9]{8}$`),
+	"FR": regexp.MustCompile(`^[0-9A-HJ-NP-Z]{2}[0-9]{9}$`),
+	"HR": regexp.MustCompile(`^[0-9]{11}$`),
+	"HU": regexp.MustCompile(`^[0-9]{8}$`),
+	"IE": regexp.MustCompile(`^([0-9]{7}[A-W][A-I]?|[0-9][A-Z+*][0-9]{5}[A-W])$`),
+	"IT": regexp.MustCompile(`^[0-9]{11}$`),
+	"LT": regexp.MustCompile(`^([0-9]{9}|[0-9]{12})$`),
+	"LU": regexp.MustCompile(`^[0-9]{8}$`),
+	"LV": regexp.MustCompile(`^[0-9]{11}$`),
+	"MT": regexp.MustCompile(`^[0-9]{8}$`),
+	"NL": regexp.MustCompile(`^[0-9]{9}B[0-9]{2}$`),
+	"PL": regexp.MustCompile(`^[0-9]{10}$`),
+	"PT": regexp.MustCompile(`^[0-9]{9}$`),
+	"RO": regexp.MustCompile(`^[0-9]{2,10}$`),
+	"SE": regexp.MustCompile(`^[0-9]{10}01$`),
+	"SI": regexp.MustCompile(`^[0-9]{8}$`),
+	"SK": regexp.MustCompile(`^[0-9]{10}$`),
+	"XI": regexp.MustCompile(`^([0-9]{9}|[0-9]{12}|GD[0-4][0-9]{2}|HA[5-9][0-9]{2})$`),
+}
+
+// @info Parses a VAT number of another EU country. Greek numbers may also be given with their ISO code, GR.
+func parseVAT(value string) (*TaxID, error) {
+	if len(value) < 4 {
+		return nil, ErrFormat
+	}
+	country, number := value[:2], value[2:]
+	if country == "GR" {
+		country = "EL"
+	}
+	pattern, ok := vatPatterns[country]
+	if !ok || !pattern.MatchString(number) {
+		return nil, ErrFormat
+	}
+	return &TaxID{Kind: EUVAT, Country: country, Value: country + number}, nil
+}
+
+// @info Whether the country (ISO 3166-1 alpha-2) is an EU member state, Spain included
+func IsEUCountry(country string) bool {
+	if country == "ES" || country == "GR" {
+		return true
+	}
+	_, ok := vatPatterns[country]
+	return ok && country != "XI"
+}
@@ -0,0 +1,289 @@
+package telemetry
+
+import (
+	"3DQuest/connector"
+	"encoding/json"
+	"errors"
+	"fmt"
+	str "strings"
+)
+
+// @info How a printer formats the messages it publishes
+type Format string
+
+const (
+	FormatGeneric   Format = "generic"   // Our own JSON, see genericMessage
+	FormatBambu     Format = "bambu"     // Bambu Lab printers, device/<serial>/report
+	FormatOctoPrint Format = "octoprint" // The MQTT plugin of OctoPrint, octoPrint/temperature/tool0, octoPrint/event/PrintDone...
+)
+
+var formats = []Format{FormatGeneric, FormatBambu, FormatOctoPrint}
+
+var ErrUnknownFormat = errors.New("Unknown telemetry format")
+
+func IsFormat(format Format) bool {
+	for _, known := range formats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// @info What one message says about a printer. Printers often publish only what changed, so anything not in the
+// message is left nil (or empty) and keeps its previous value.
+type Reading struct {
+	State            connector.State
+	Filename         string
+	Progress         *float64 // 0 to 1
+	RemainingSeconds *float64
+	Temperatures     map[string]connector.Temperature // "nozzle", "bed", "nozzle1"...
+	Error            *string                          // Empty clears a previous error
+	FilamentRunout   *bool
+}
+
+// @info Parses a message published on topic. Messages that say nothing about the printer (e.g. OctoPrint's other
+// events) give an empty reading.
+func Parse(format Format, topic string, payload []byte) (*Reading, error) {
+	switch format {
+	case FormatGeneric:
+		return parseGeneric(payload)
+	case FormatBambu:
+		return parseBambu(payload)
+	case FormatOctoPrint:
+		return parseOctoPrint(topic, payload)
+	}
+	return nil, fmt.Errorf("%w: '%s'", ErrUnknownFormat, format)
+}
+
+// @info {"state": "printing", "filename": "cube.gcode", "progress": 0.42, "remaining_seconds": 1800,
+// "temperatures": {"nozzle": {"actual": 214.8, "target": 215}, "bed": {...}}, "error": "", "filament_runout": false}.
+// Any field may be left out.
+type genericMessage struct {
+	State            *string                          `json:"state"`
+	Filename         *string                          `json:"filename"`
+	Progress         *float64                         `json:"progress"`
+	RemainingSeconds *float64                         `json:"remaining_seconds"`
+	Temperatures     map[string]connector.Temperature `json:"temperatures"`
+	Error            *string                          `json:"error"`
+	FilamentRunout   *bool                            `json:"filament_runout"`
+}
+
+func parseGeneric(payload []byte) (*Reading, error) {
+	msg := genericMessage{}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	reading := &Reading{Progress: msg.Progress, RemainingSeconds: msg.RemainingSeconds, Temperatures: msg.Temperatures, Error: msg.Error, FilamentRunout: msg.FilamentRunout}
+	if msg.State != nil {
+		reading.State = connector.State(str.ToLower(*msg.State))
+		if !isState(reading.State) {
+			return nil, fmt.Errorf("Unknown printer state '%s'", *msg.State)
+		}
+	}
+	if msg.Filename != nil {
+		reading.Filename = *msg.Filename
+	}
+	if reading.Progress != nil && (*reading.Progress < 0 || *reading.Progress > 1) {
+		return nil, fmt.Errorf("Progress must be between 0 and 1, got %f", *reading.Progress)
+	}
+	return reading, nil
+}
+
+type bambuMessage struct {
+	Print *struct {
+		GCodeState       *string  `json:"gcode_state"` // IDLE, PREPARE, RUNNING, PAUSE, FINISH, FAILED
+		Percent          *float64 `json:"mc_percent"`
+		RemainingMinutes *float64 `json:"mc_remaining_time"`
+		Subtask          *string  `json:"subtask_name"`
+		NozzleTemper     *float64 `json:"nozzle_temper"`
+		NozzleTarget     *float64 `json:"nozzle_target_temper"`
+		BedTemper        *float64 `json:"bed_temper"`
+		BedTarget        *float64 `json:"bed_target_temper"`
+		PrintError       *int64   `json:"print_error"` // 0 when there is none
+	} `json:"print"`
+}
+
+// @info Error codes ending in 8011 are "filament ran out" on every AMS slot and on the external spool
+const bambuRunout = 0x8011
+
+func parseBambu(payload []byte) (*Reading, error) {
+	msg := bambuMessage{}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	reading := &Reading{}
+	p := msg.Print
+	if p == nil {
+		return reading, nil // @info "info", "system" and other reports
+	}
+	if p.GCodeState != nil {
+		switch *p.GCodeState {
+		case "RUNNING", "PREPARE", "SLICING":
+			reading.State = connector.StatePrinting
+		case "PAUSE":
+			reading.State = connector.StatePaused
+		case "FINISH":
+			reading.State = connector.StateComplete
+		case "FAILED":
+			reading.State = connector.StateError
+		default:
+			reading.State = connector.StateIdle
+		}
+	}
+	if p.Percent != nil {
+		progress := *p.Percent / 100
+		reading.Progress = &progress
+	}
+	if p.RemainingMinutes != nil {
+		seconds := *p.RemainingMinutes * 60
+		reading.RemainingSeconds = &seconds
+	}
+	if p.Subtask != nil {
+		reading.Filename = *p.Subtask
+	}
+	reading.Temperatures = map[string]connector.Temperature{}
+	mergeHeater(reading.Temperatures, "nozzle", p.NozzleTemper, p.NozzleTarget)
+	mergeHeater(reading.Temperatures, "bed", p.BedTemper, p.BedTarget)
+	if p.PrintError != nil {
+		message, runout := "", false
+		if code := *p.PrintError; code != 0 {
+			// @info A runout is reported on its own, not as an error as well
+			if runout = code&0xFFFF == bambuRunout; !runout {
+				message = fmt.Sprintf("Printer error %08X", code)
+			}
+		}
+		reading.Error, reading.FilamentRunout = &message, &runout
+	}
+	return reading, nil
+}
+
+// @info Bambu reports the current and target temperatures in separate fields, either may come alone. A missing one
+// is marked as negative to be filled in from the previous reading, see Snapshot.Apply.
+func mergeHeater(temperatures map[string]connector.Temperature, key string, actual *float64, target *float64) {
+	if actual == nil && target == nil {
+		return
+	}
+	temperature := connector.Temperature{Actual: -1, Target: -1}
+	if actual != nil {
+		temperature.Actual = *actual
+	}
+	if target != nil {
+		temperature.Target = *target
+	}
+	temperatures[key] = temperature
+}
+
+type octoPrintProgress struct {
+	Progress *float64 `json:"progress"` // Percent
+	Path     string   `json:"path"`
+}
+
+type octoPrintEvent struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// @info The plugin publishes under a base topic (octoPrint/ by default): temperature/<heater>, progress/printing and
+// event/<name>
+func parseOctoPrint(topic string, payload []byte) (*Reading, error) {
+	levels := str.Split(topic, "/")
+	reading := &Reading{}
+	for i := 0; i+1 < len(levels); i++ {
+		switch levels[i] {
+		case "temperature":
+			heater := levels[i+1]
+			key := ""
+			switch {
+			case heater == "bed":
+				key = "bed"
+			case heater == "tool0":
+				key = "nozzle"
+			case str.HasPrefix(heater, "tool"):
+				key = "nozzle" + str.TrimPrefix(heater, "tool")
+			default:
+				return reading, nil
+			}
+			temperature := connector.Temperature{}
+			if err := json.Unmarshal(payload, &temperature); err != nil {
+				return nil, err
+			}
+			reading.Temperatures = map[string]connector.Temperature{key: temperature}
+			return reading, nil
+		case "progress":
+			if levels[i+1] != "printing" {
+				return reading, nil
+			}
+			progress := octoPrintProgress{}
+			if err := json.Unmarshal(payload, &progress); err != nil {
+				return nil, err
+			}
+			if progress.Progress != nil {
+				value := *progress.Progress / 100
+				reading.Progress = &value
+			}
+			reading.Filename = progress.Path
+			return reading, nil
+		case "event":
+			event := octoPrintEvent{}
+			if err := json.Unmarshal(payload, &event); err != nil {
+				return nil, err
+			}
+			octoPrintEventReading(levels[i+1], &event, reading)
+			return reading, nil
+		}
+	}
+	return reading, nil
+}
+
+func octoPrintEventReading(name string, event *octoPrintEvent, reading *Reading) {
+	clear, runout, loaded := "", true, false
+	switch name {
+	case "PrintStarted", "PrintResumed":
+		reading.State = connector.StatePrinting
+		reading.Error = &clear
+		reading.FilamentRunout = &loaded
+		if name == "PrintStarted" {
+			zero := 0.0
+			reading.Progress = &zero
+		}
+	case "PrintPaused":
+		reading.State = connector.StatePaused
+	case "PrintDone":
+		reading.State = connector.StateComplete
+	case "PrintCancelled":
+		reading.State = connector.StateCancelled
+	case "PrintFailed":
+		reading.State = connector.StateCancelled
+		if event.Reason == "error" {
+			reading.State = connector.StateError
+		}
+	case "Error":
+		reading.State = connector.StateError
+		message := event.Error
+		if message == "" {
+			message = "OctoPrint reported an error"
+		}
+		reading.Error = &message
+	case "Disconnected":
+		reading.State = connector.StateOffline
+	case "Connected":
+		reading.State = connector.StateIdle
+		reading.Error = &clear
+	case "FilamentRunout": // @info Sent by the filament sensor plugins
+		reading.FilamentRunout = &runout
+	}
+	if event.Path != "" {
+		reading.Filename = event.Path
+	}
+}
+
+func isState(state connector.State) bool {
+	switch state {
+	case connector.StateIdle, connector.StatePrinting, connector.StatePaused, connector.StateComplete, connector.StateCancelled, connector.StateError, connector.StateOffline:
+		return true
+	}
+	return false
+}
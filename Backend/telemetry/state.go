@@ -0,0 +1,177 @@
+package telemetry
+
+import (
+	"3DQuest/connector"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// @info Everything known about a printer, built up from its readings
+type Snapshot struct {
+	State            connector.State                  `json:"state"`
+	Filename         string                           `json:"filename,omitempty"`
+	Progress         float64                          `json:"progress"` // 0 to 1
+	RemainingSeconds float64                          `json:"remaining_seconds"`
+	Temperatures     map[string]connector.Temperature `json:"temperatures"`
+	Error            string                           `json:"error,omitempty"`
+	FilamentRunout   bool                             `json:"filament_runout"`
+}
+
+// @info Merges a reading into the snapshot. Returns whether the state, error or filament changed, which are worth
+// storing straight away.
+func (s *Snapshot) Apply(r *Reading) bool {
+	before := *s
+	if s.Temperatures == nil {
+		s.Temperatures = map[string]connector.Temperature{}
+	}
+	if r.State != "" {
+		s.State = r.State
+	}
+	if r.Filename != "" {
+		s.Filename = r.Filename
+	}
+	if r.Progress != nil {
+		s.Progress = *r.Progress
+	}
+	if r.RemainingSeconds != nil {
+		s.RemainingSeconds = *r.RemainingSeconds
+	}
+	for key, temperature := range r.Temperatures {
+		previous := s.Temperatures[key]
+		if temperature.Actual < 0 {
+			temperature.Actual = previous.Actual
+		}
+		if temperature.Target < 0 {
+			temperature.Target = previous.Target
+		}
+		s.Temperatures[key] = temperature
+	}
+	if r.Error != nil {
+		s.Error = *r.Error
+	}
+	if r.FilamentRunout != nil {
+		s.FilamentRunout = *r.FilamentRunout
+	}
+	return s.State != before.State || s.Error != before.Error || s.FilamentRunout != before.FilamentRunout
+}
+
+type Stats struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+	Avg float64 `json:"avg"`
+}
+
+// @info A printer over one interval of the series: temperature statistics, and the progress and state at its end
+type Sample struct {
+	Start        time.Time        `json:"start"`
+	End          time.Time        `json:"end"`
+	Count        int              `json:"count"` // Readings it summarises
+	Temperatures map[string]Stats `json:"temperatures"`
+	Progress     float64          `json:"progress"`
+	State        connector.State  `json:"state"`
+}
+
+// @info Turns a stream of snapshots into one sample per interval, aligned to the clock
+type Downsampler struct {
+	Interval time.Duration
+	current  *Sample
+	sums     map[string]float64
+}
+
+// @info Adds the snapshot taken at at. Returns the sample of the previous interval once at falls in a new one.
+func (d *Downsampler) Add(at time.Time, snap *Snapshot) *Sample {
+	start := at.Truncate(d.Interval)
+	var done *Sample
+	if d.current != nil && !start.Equal(d.current.Start) {
+		done = d.Flush()
+	}
+	if d.current == nil {
+		d.current = &Sample{Start: start, End: start.Add(d.Interval), Temperatures: map[string]Stats{}}
+		d.sums = map[string]float64{}
+	}
+	sample := d.current
+	sample.Count++
+	sample.Progress = snap.Progress
+	sample.State = snap.State
+	for key, temperature := range snap.Temperatures {
+		stats, seen := sample.Temperatures[key]
+		if !seen {
+			stats = Stats{Min: temperature.Actual, Max: temperature.Actual}
+		}
+		stats.Min = math.Min(stats.Min, temperature.Actual)
+		stats.Max = math.Max(stats.Max, temperature.Actual)
+		d.sums[key] += temperature.Actual
+		sample.Temperatures[key] = stats
+	}
+	return done
+}
+
+// @info Ends the current interval early and returns its sample, nil if it has none
+func (d *Downsampler) Flush() *Sample {
+	sample := d.current
+	if sample == nil {
+		return nil
+	}
+	for key, stats := range sample.Temperatures {
+		stats.Avg = math.Round(d.sums[key]/float64(sample.Count)*10) / 10
+		sample.Temperatures[key] = stats
+	}
+	d.current, d.sums = nil, nil
+	return sample
+}
+
+// @info The starting time of the interval being summarised, zero if none
+func (d *Downsampler) Since() time.Time {
+	if d.current == nil {
+		return time.Time{}
+	}
+	return d.current.Start
+}
+
+type AlertKind string
+
+const (
+	AlertError          AlertKind = "error"
+	AlertFilamentRunout AlertKind = "filament_runout"
+	AlertOverheat       AlertKind = "overheat" // A heater well above its target. Heaters cooling down have none
+	AlertSilent         AlertKind = "silent"   // A printer that was printing stopped reporting
+)
+
+type Limits struct {
+	OverheatMargin float64       // °C over the target
+	Silence        time.Duration // Without messages while printing
+}
+
+// @info Conditions of the snapshot that deserve an alert, with a message for each. lastMessage is when the printer
+// last published.
+func Alerts(snap *Snapshot, lastMessage time.Time, now time.Time, limits Limits) map[AlertKind]string {
+	alerts := map[AlertKind]string{}
+	if snap.Error != "" || snap.State == connector.StateError {
+		message := snap.Error
+		if message == "" {
+			message = "The printer reported an error"
+		}
+		alerts[AlertError] = message
+	}
+	if snap.FilamentRunout {
+		alerts[AlertFilamentRunout] = "The filament ran out"
+	}
+	heaters := []string{}
+	for key := range snap.Temperatures {
+		heaters = append(heaters, key)
+	}
+	sort.Strings(heaters)
+	for _, key := range heaters {
+		temperature := snap.Temperatures[key]
+		if limits.OverheatMargin > 0 && temperature.Target > 0 && temperature.Actual > temperature.Target+limits.OverheatMargin {
+			alerts[AlertOverheat] = fmt.Sprintf("The %s is at %.0f°C, its target is %.0f°C", key, temperature.Actual, temperature.Target)
+			break
+		}
+	}
+	if limits.Silence > 0 && snap.State == connector.StatePrinting && now.Sub(lastMessage) > limits.Silence {
+		alerts[AlertSilent] = fmt.Sprintf("No news from the printer since %s", lastMessage.UTC().Format(time.RFC3339))
+	}
+	return alerts
+}
@@ -0,0 +1,181 @@
+package telemetry_test
+
+import (
+	"3DQuest/connector"
+	"3DQuest/telemetry"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func parse(t *testing.T, format telemetry.Format, topic string, payload string) *telemetry.Snapshot {
+	t.Helper()
+	reading, err := telemetry.Parse(format, topic, []byte(payload))
+	if err != nil {
+		t.Fatalf("%s %s: %v", format, topic, err)
+	}
+	snap := &telemetry.Snapshot{}
+	snap.Apply(reading)
+	return snap
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name    string
+		format  telemetry.Format
+		topic   string
+		payload string
+		want    telemetry.Snapshot
+	}{
+		{"generic", telemetry.FormatGeneric, "shop/mk4", `{"state":"Printing","filename":"cube.gcode","progress":0.42,"remaining_seconds":1800,"temperatures":{"nozzle":{"actual":214.8,"target":215}},"filament_runout":false}`,
+			telemetry.Snapshot{State: connector.StatePrinting, Filename: "cube.gcode", Progress: 0.42, RemainingSeconds: 1800, Temperatures: map[string]connector.Temperature{"nozzle": {Actual: 214.8, Target: 215}}}},
+		{"generic error", telemetry.FormatGeneric, "shop/mk4", `{"error":"Thermal runaway"}`,
+			telemetry.Snapshot{Error: "Thermal runaway", Temperatures: map[string]connector.Temperature{}}},
+		{"bambu", telemetry.FormatBambu, "device/01S00A1/report", `{"print":{"gcode_state":"RUNNING","mc_percent":50,"mc_remaining_time":30,"subtask_name":"benchy","nozzle_temper":220,"nozzle_target_temper":220,"bed_temper":55}}`,
+			telemetry.Snapshot{State: connector.StatePrinting, Filename: "benchy", Progress: 0.5, RemainingSeconds: 1800, Temperatures: map[string]connector.Temperature{"nozzle": {Actual: 220, Target: 220}, "bed": {Actual: 55}}}},
+		{"bambu runout", telemetry.FormatBambu, "device/01S00A1/report", `{"print":{"gcode_state":"PAUSE","print_error":117473297}}`,
+			telemetry.Snapshot{State: connector.StatePaused, FilamentRunout: true, Temperatures: map[string]connector.Temperature{}}},
+		{"bambu error", telemetry.FormatBambu, "device/01S00A1/report", `{"print":{"gcode_state":"FAILED","print_error":50348044}}`,
+			telemetry.Snapshot{State: connector.StateError, Error: "Printer error 0300400C", Temperatures: map[string]connector.Temperature{}}},
+		{"bambu info report", telemetry.FormatBambu, "device/01S00A1/report", `{"info":{"command":"get_version"}}`,
+			telemetry.Snapshot{Temperatures: map[string]connector.Temperature{}}},
+		{"octoprint temperature", telemetry.FormatOctoPrint, "octoPrint/temperature/tool1", `{"actual":201.5,"target":200}`,
+			telemetry.Snapshot{Temperatures: map[string]connector.Temperature{"nozzle1": {Actual: 201.5, Target: 200}}}},
+		{"octoprint progress", telemetry.FormatOctoPrint, "octoPrint/progress/printing", `{"progress":25,"path":"part.gcode"}`,
+			telemetry.Snapshot{Filename: "part.gcode", Progress: 0.25, Temperatures: map[string]connector.Temperature{}}},
+		{"octoprint failure", telemetry.FormatOctoPrint, "octoPrint/event/PrintFailed", `{"reason":"error","path":"part.gcode"}`,
+			telemetry.Snapshot{State: connector.StateError, Filename: "part.gcode", Temperatures: map[string]connector.Temperature{}}},
+		{"octoprint cancel", telemetry.FormatOctoPrint, "octoPrint/event/PrintFailed", `{"reason":"cancelled"}`,
+			telemetry.Snapshot{State: connector.StateCancelled, Temperatures: map[string]connector.Temperature{}}},
+		{"octoprint other event", telemetry.FormatOctoPrint, "octoPrint/event/ClientOpened", `{"remoteAddress":"10.0.0.2"}`,
+			telemetry.Snapshot{Temperatures: map[string]connector.Temperature{}}},
+	}
+	for _, c := range cases {
+		if snap := parse(t, c.format, c.topic, c.payload); !reflect.DeepEqual(*snap, c.want) {
+			t.Errorf("%s: %+v, want %+v", c.name, *snap, c.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		format  telemetry.Format
+		payload string
+	}{
+		{telemetry.FormatGeneric, `{"state":"melting"}`},
+		{telemetry.FormatGeneric, `{"progress":42}`},
+		{telemetry.FormatGeneric, `not json`},
+		{telemetry.FormatBambu, `[1, 2]`},
+	}
+	for _, c := range cases {
+		if _, err := telemetry.Parse(c.format, "a", []byte(c.payload)); err == nil {
+			t.Errorf("%s %s parsed", c.format, c.payload)
+		}
+	}
+	if _, err := telemetry.Parse("marlin", "a", []byte("{}")); !errors.Is(err, telemetry.ErrUnknownFormat) {
+		t.Errorf("unknown format = %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	snap := parse(t, telemetry.FormatBambu, "r", `{"print":{"gcode_state":"RUNNING","nozzle_temper":180,"nozzle_target_temper":220,"bed_target_temper":60}}`)
+	reading, _ := telemetry.Parse(telemetry.FormatBambu, "r", []byte(`{"print":{"nozzle_temper":219,"bed_temper":58}}`))
+	// @info Only the temperatures changed, and each heater keeps the target it had
+	if snap.Apply(reading) {
+		t.Error("a temperature update reported a change")
+	}
+	want := map[string]connector.Temperature{"nozzle": {Actual: 219, Target: 220}, "bed": {Actual: 58, Target: 60}}
+	if !reflect.DeepEqual(snap.Temperatures, want) {
+		t.Errorf("temperatures %+v, want %+v", snap.Temperatures, want)
+	}
+	reading, _ = telemetry.Parse(telemetry.FormatBambu, "r", []byte(`{"print":{"print_error":0}}`))
+	if snap.Apply(reading) {
+		t.Error("clearing an error the printer did not have reported a change")
+	}
+	reading, _ = telemetry.Parse(telemetry.FormatBambu, "r", []byte(`{"print":{"gcode_state":"FINISH"}}`))
+	if !snap.Apply(reading) || snap.State != connector.StateComplete {
+		t.Errorf("finishing: state %s", snap.State)
+	}
+}
+
+func TestDownsampler(t *testing.T) {
+	start := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	d := telemetry.Downsampler{Interval: time.Minute}
+	at := func(seconds int, nozzle float64, progress float64) *telemetry.Sample {
+		snap := &telemetry.Snapshot{State: connector.StatePrinting, Progress: progress, Temperatures: map[string]connector.Temperature{"nozzle": {Actual: nozzle}}}
+		return d.Add(start.Add(time.Duration(seconds)*time.Second), snap)
+	}
+	if d.Since() != (time.Time{}) {
+		t.Errorf("since = %v before any snapshot", d.Since())
+	}
+	for i, nozzle := range []float64{210, 215, 212.5} {
+		if sample := at(i*20, nozzle, float64(i)/10); sample != nil {
+			t.Fatalf("sample %+v before the minute ended", sample)
+		}
+	}
+	if !d.Since().Equal(start) {
+		t.Errorf("since = %v, want %v", d.Since(), start)
+	}
+	sample := at(65, 220, 0.5)
+	want := &telemetry.Sample{Start: start, End: start.Add(time.Minute), Count: 3, Temperatures: map[string]telemetry.Stats{"nozzle": {Min: 210, Max: 215, Avg: 212.5}}, Progress: 0.2, State: connector.StatePrinting}
+	if !reflect.DeepEqual(sample, want) {
+		t.Errorf("first sample %+v, want %+v", sample, want)
+	}
+	// @info A gap of several intervals gives no empty samples in between
+	sample = at(300, 230, 0.9)
+	if sample == nil || !sample.Start.Equal(start.Add(time.Minute)) || sample.Count != 1 || sample.Temperatures["nozzle"] != (telemetry.Stats{Min: 220, Max: 220, Avg: 220}) {
+		t.Errorf("second sample %+v", sample)
+	}
+	if sample = d.Flush(); sample == nil || !sample.Start.Equal(start.Add(5*time.Minute)) || sample.Progress != 0.9 {
+		t.Errorf("flushed sample %+v", sample)
+	}
+	if sample = d.Flush(); sample != nil {
+		t.Errorf("second flush = %+v, want nil", sample)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	limits := telemetry.Limits{OverheatMargin: 15, Silence: 5 * time.Minute}
+	heater := func(actual float64, target float64) map[string]connector.Temperature {
+		return map[string]connector.Temperature{"nozzle": {Actual: actual, Target: target}}
+	}
+	cases := []struct {
+		name   string
+		snap   telemetry.Snapshot
+		silent time.Duration
+		limits telemetry.Limits
+		want   []telemetry.AlertKind
+	}{
+		{"printing fine", telemetry.Snapshot{State: connector.StatePrinting, Temperatures: heater(214, 215)}, time.Minute, limits, nil},
+		{"error message", telemetry.Snapshot{State: connector.StateIdle, Error: "Heater failed"}, 0, limits, []telemetry.AlertKind{telemetry.AlertError}},
+		{"error state", telemetry.Snapshot{State: connector.StateError}, 0, limits, []telemetry.AlertKind{telemetry.AlertError}},
+		{"runout", telemetry.Snapshot{State: connector.StatePaused, FilamentRunout: true}, 0, limits, []telemetry.AlertKind{telemetry.AlertFilamentRunout}},
+		{"at the margin", telemetry.Snapshot{Temperatures: heater(230, 215)}, 0, limits, nil},
+		{"over the margin", telemetry.Snapshot{Temperatures: heater(230.5, 215)}, 0, limits, []telemetry.AlertKind{telemetry.AlertOverheat}},
+		{"cooling down", telemetry.Snapshot{Temperatures: heater(180, 0)}, 0, limits, nil},
+		{"no overheat margin", telemetry.Snapshot{Temperatures: heater(300, 215)}, 0, telemetry.Limits{Silence: time.Minute}, nil},
+		{"silent while printing", telemetry.Snapshot{State: connector.StatePrinting}, 6 * time.Minute, limits, []telemetry.AlertKind{telemetry.AlertSilent}},
+		{"silent at the limit", telemetry.Snapshot{State: connector.StatePrinting}, 5 * time.Minute, limits, nil},
+		{"silent while idle", telemetry.Snapshot{State: connector.StateIdle}, time.Hour, limits, nil},
+		{"everything at once", telemetry.Snapshot{State: connector.StatePrinting, Error: "Clog", FilamentRunout: true, Temperatures: heater(260, 215)}, time.Hour, limits,
+			[]telemetry.AlertKind{telemetry.AlertError, telemetry.AlertFilamentRunout, telemetry.AlertOverheat, telemetry.AlertSilent}},
+	}
+	for _, c := range cases {
+		alerts := telemetry.Alerts(&c.snap, now.Add(-c.silent), now, c.limits)
+		if len(alerts) != len(c.want) {
+			t.Errorf("%s: alerts %v, want %v", c.name, alerts, c.want)
+			continue
+		}
+		for _, kind := range c.want {
+			if alerts[kind] == "" {
+				t.Errorf("%s: no %s alert in %v", c.name, kind, alerts)
+			}
+		}
+	}
+	alerts := telemetry.Alerts(&telemetry.Snapshot{Temperatures: heater(240, 215)}, now, now, limits)
+	if want := "The nozzle is at 240°C, its target is 215°C"; alerts[telemetry.AlertOverheat] != want {
+		t.Errorf("overheat message %q, want %q", alerts[telemetry.AlertOverheat], want)
+	}
+}